@@ -0,0 +1,23 @@
+// Command escrowkey generates the organization key pair for envelope key escrow. The
+// public key goes into AEGIS_KEY_ESCROW_PUBLIC_KEY; the private key is kept offline and
+// only handed to the completeKeyRecovery mutation once two admins agreed on a recovery.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func main() {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate escrow key pair: %v", err)
+	}
+
+	fmt.Printf("AEGIS_KEY_ESCROW_PUBLIC_KEY=%s\n", base64.StdEncoding.EncodeToString(publicKey[:]))
+	fmt.Printf("Escrow private key (store offline): %s\n", base64.StdEncoding.EncodeToString(privateKey[:]))
+}
@@ -3,10 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -20,8 +18,6 @@ import (
 	"github.com/99designs/gqlgen/graphql/playground"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/vektah/gqlparser/v2/gqlerror"
 
 	"github.com/balkanid/aegis-backend/graph"
@@ -31,7 +27,6 @@ import (
 	apperrors "github.com/balkanid/aegis-backend/internal/errors"
 	"github.com/balkanid/aegis-backend/internal/handlers"
 	"github.com/balkanid/aegis-backend/internal/middleware"
-	"github.com/balkanid/aegis-backend/internal/models"
 	"github.com/balkanid/aegis-backend/internal/services"
 )
 
@@ -83,69 +78,146 @@ func main() {
 	// }
 
 	// Initialize services
-	// Initialize MinIO client
-	var minioClient *minio.Client
-	var bucketName string
-	if cfg.MinIOEndpoint != "" && cfg.MinIOAccessKey != "" && cfg.MinIOSecretKey != "" && cfg.MinIOBucket != "" {
-		log.Printf("DEBUG: Initializing MinIO client with endpoint: %s, bucket: %s", cfg.MinIOEndpoint, cfg.MinIOBucket)
-		var err error
-		minioClient, err = minio.New(cfg.MinIOEndpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(cfg.MinIOAccessKey, cfg.MinIOSecretKey, ""),
-			Secure: false, // Use HTTP for local development
-		})
-		if err != nil {
-			log.Fatalf("Failed to initialize MinIO client: %v", err)
-		}
-		bucketName = cfg.MinIOBucket
+	// Initialize object storage backend
+	storageBackend, err := services.NewStorageBackend(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize %s storage backend: %v", cfg.StorageBackend, err)
+	}
+	log.Printf("DEBUG: Using %s storage backend", cfg.StorageBackend)
 
-		// Check if bucket exists, create if not
-		exists, err := minioClient.BucketExists(context.Background(), bucketName)
-		if err != nil {
-			log.Fatalf("Failed to check if bucket exists: %v", err)
-		}
-		if !exists {
-			err = minioClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
-			if err != nil {
-				log.Fatalf("Failed to create bucket: %v", err)
-			}
-			log.Printf("Created MinIO bucket: %s", bucketName)
-		} else {
-			log.Printf("MinIO bucket %s already exists", bucketName)
-		}
-	} else {
-		log.Printf("DEBUG: MinIO not configured - endpoint: %s, access_key: %s, secret_key: %s, bucket: %s",
-			cfg.MinIOEndpoint, cfg.MinIOAccessKey != "", cfg.MinIOSecretKey != "", cfg.MinIOBucket)
+	fileStorageService := services.NewFileStorageServiceWithBackend(storageBackend)
+
+	// Initialize outbound mail
+	mailSender, err := services.NewMailSender(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize %s mail backend: %v", cfg.MailBackend, err)
 	}
 
-	fileStorageService := services.NewFileStorageService(minioClient, bucketName)
+	// Initialize the key provider that wraps envelope keys and service keys
+	keyProvider, err := services.NewKeyProvider(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize %s key provider: %v", cfg.KeyProvider, err)
+	}
 
 	// Initialize centralized crypto manager
-	cryptoManager, err := services.NewCryptoManager()
+	cryptoManager, err := services.NewCryptoManagerWithKeyProvider(context.Background(), keyProvider, db)
 	if err != nil {
 		log.Fatalf("Failed to initialize crypto manager: %v", err)
 	}
 
+	// Sign access tokens with rotating asymmetric keys unless HS256 is configured
+	var signingKeyService *services.SigningKeyService
 	authService := services.NewAuthService(cfg)
+	if cfg.JWTSigningAlgorithm != "HS256" {
+		signingKeyService = services.NewSigningKeyService(cfg, db)
+		if err := signingKeyService.EnsureSigningKey(); err != nil {
+			log.Fatalf("Failed to initialize token signing keys: %v", err)
+		}
+		authService = services.NewAuthServiceWithKeys(cfg, signingKeyService)
+	}
 	fileService := services.NewFileService(cfg, db, fileStorageService, authService)
+	downloadTicketService := services.NewDownloadTicketService(cfg, db)
 	userService := services.NewUserService(authService, db)
+	refreshTokenService := services.NewRefreshTokenService(cfg, db, authService)
+	sessionService := services.NewSessionService(db, authService, refreshTokenService)
+	twoFactorService := services.NewTwoFactorService(cfg, db, authService)
+	personalAccessTokenService := services.NewPersonalAccessTokenService(db)
+	oidcService := services.NewOIDCService(cfg, db)
+	emailTokenService := services.NewEmailTokenService(cfg, db, mailSender)
+	loginThrottleService := services.NewLoginThrottleService(cfg, db, userService, emailTokenService)
+	userKeyService := services.NewUserKeyService(cfg, db)
 	roomService := services.NewRoomService(db, userService)
+	roomKeyService := services.NewRoomKeyService(db, roomService)
 	adminService := services.NewAdminService(db)
 	shareService := services.NewShareService(db, cfg.BaseURL, cryptoManager)
+	if recorded, err := shareService.RecordLegacyKDFParams(); err != nil {
+		log.Fatalf("Failed to record legacy share key derivation parameters: %v", err)
+	} else if recorded > 0 {
+		log.Printf("Recorded PBKDF2 parameters of %d legacy shares", recorded)
+	}
 	keyRotationService := services.NewKeyRotationService(db, cryptoManager)
+	if wrapped, err := keyRotationService.WrapLegacyEnvelopeKeys(context.Background()); err != nil {
+		log.Fatalf("Failed to wrap legacy envelope keys: %v", err)
+	} else if wrapped > 0 {
+		log.Printf("Wrapped %d legacy envelope keys with the %s key provider", wrapped, cfg.KeyProvider)
+	}
+	keyRotationCampaignService := services.NewKeyRotationCampaignService(db, cryptoManager, keyRotationService)
+	keyRecoveryService := services.NewKeyRecoveryService(db, cryptoManager)
+	if escrowed, err := keyRecoveryService.EscrowEnvelopeKeys(context.Background()); err != nil {
+		log.Printf("Warning: failed to escrow envelope keys: %v", err)
+	} else if escrowed > 0 {
+		log.Printf("Sealed %d envelope keys to the organization escrow key", escrowed)
+	}
+	uploadSessionService := services.NewUploadSessionService(cfg, db, fileService, fileStorageService, userService)
+	storageGCService := services.NewStorageGCService(cfg, db, fileStorageService)
+	integrityScrubService := services.NewIntegrityScrubService(db, fileStorageService)
+	reencryptionService := services.NewReencryptionService(db, cryptoManager, fileStorageService)
+
+	// Periodically expire abandoned upload sessions and remove their partial chunks
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	uploadSessionService.StartCleanupWorker(workerCtx, time.Duration(cfg.UploadCleanupIntervalMins)*time.Minute)
+
+	// Periodically delete expired sessions and refresh tokens
+	sessionService.StartCleanupWorker(workerCtx)
+
+	// Periodically forget failed logins that are no longer counted
+	loginThrottleService.StartCleanupWorker(workerCtx)
+
+	// Periodically forget used single-use download tickets once they have expired
+	downloadTicketService.StartCleanupWorker(workerCtx)
+
+	// Pick up signing keys rotated elsewhere and rotate on schedule
+	if signingKeyService != nil {
+		signingKeyService.StartRotationWorker(workerCtx)
+	}
+
+	// Periodically reconcile the object store against the files table
+	storageGCService.StartWorker(workerCtx, time.Duration(cfg.StorageGCIntervalHours)*time.Hour, cfg.StorageGCDryRun)
+
+	// Periodically re-verify stored objects against their recorded content hashes
+	integrityScrubService.StartWorker(workerCtx, time.Duration(cfg.StorageScrubIntervalHours)*time.Hour)
+
+	// Resume key rotations interrupted by a restart, then run new ones as they are requested
+	keyRotationService.StartWorker(workerCtx)
+
+	// Resume key rotation campaigns interrupted by a restart, then run them as admins start them
+	keyRotationCampaignService.StartWorker(workerCtx)
+
+	// Periodically migrate shares and stored files off deprecated algorithms
+	reencryptionService.StartWorker(workerCtx, time.Duration(cfg.ReencryptIntervalHours)*time.Hour)
 
 	// Initialize handlers
 	fileHandler := handlers.NewFileHandler(fileService, authService)
+	uploadHandler := handlers.NewUploadHandler(uploadSessionService)
+	shareHandler := handlers.NewShareHandler(shareService, fileService, downloadTicketService, cryptoManager, cfg.APIEndpoints.Share.Base)
 
 	// Initialize GraphQL resolver
 	resolver := &graph.Resolver{
-		DB:                 db,
-		FileService:        fileService,
-		UserService:        userService,
-		RoomService:        roomService,
-		AdminService:       adminService,
-		ShareService:       shareService,
-		CryptoManager:      cryptoManager,
-		KeyRotationService: keyRotationService,
+		DB:                         db,
+		FileService:                fileService,
+		UserService:                userService,
+		RefreshTokenService:        refreshTokenService,
+		SessionService:             sessionService,
+		TwoFactorService:           twoFactorService,
+		PersonalAccessTokenService: personalAccessTokenService,
+		OIDCService:                oidcService,
+		EmailTokenService:          emailTokenService,
+		LoginThrottleService:       loginThrottleService,
+		SigningKeyService:          signingKeyService,
+		DownloadTicketService:      downloadTicketService,
+		UserKeyService:             userKeyService,
+		RoomService:                roomService,
+		RoomKeyService:             roomKeyService,
+		AdminService:               adminService,
+		ShareService:               shareService,
+		CryptoManager:              cryptoManager,
+		KeyRotationService:         keyRotationService,
+		KeyRotationCampaignService: keyRotationCampaignService,
+		KeyRecoveryService:         keyRecoveryService,
+		StorageGCService:           storageGCService,
+		IntegrityScrubService:      integrityScrubService,
+		ReencryptionService:        reencryptionService,
 	}
 
 	// Create GraphQL server with custom error handling
@@ -184,6 +256,11 @@ func main() {
 	// Initialize Gin router
 	r := gin.Default()
 
+	// Only believe forwarded client addresses from the configured proxies
+	if err := middleware.TrustProxies(r, cfg); err != nil {
+		log.Fatalf("CONFIG ERROR: invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Add security headers middleware
 	r.Use(middleware.SecurityHeaders())
 
@@ -199,8 +276,9 @@ func main() {
 		}
 	}
 	corsConfig.AllowCredentials = true
-	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	corsConfig.AllowHeaders = []string{"Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "accept", "origin", "Cache-Control", "X-Requested-With"}
+	corsConfig.AllowMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	corsConfig.AllowHeaders = []string{"Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "accept", "origin", "Cache-Control", "X-Requested-With", "Upload-Offset", "Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+	corsConfig.ExposeHeaders = []string{"Location", "Upload-Offset", "Upload-Length", "Upload-Expires", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified", "Content-Disposition", "X-Integrity-Status"}
 	r.Use(cors.New(corsConfig))
 
 	// Add rate limiting middleware
@@ -217,6 +295,16 @@ func main() {
 		})
 	})
 
+	// Public keys for verifying access tokens, for other services
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		if signingKeyService == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tokens are not signed with published keys"})
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, signingKeyService.JWKS())
+	})
+
 	// GraphQL playground (only in development)
 	if cfg.GinMode == "debug" {
 		r.GET("/", gin.WrapH(playground.Handler("GraphQL playground", "/graphql")))
@@ -240,15 +328,28 @@ func main() {
 		})
 	}
 
+	// File downloads, which accept a download ticket in place of the Authorization header
+	r.GET(cfg.APIEndpoints.Files.Download,
+		middleware.DownloadTicketAuth(downloadTicketService, db, middleware.AuthMiddleware(cfg, authService, db)),
+		middleware.RequireTokenScope(services.ScopeFilesRead),
+		middleware.ShareSecurityHeaders(),
+		fileHandler.DownloadFile)
+
 	// API routes group (authenticated endpoints)
 	apiGroup := r.Group(cfg.APIEndpoints.Base)
 	apiGroup.Use(middleware.AuthMiddleware(cfg, authService, db))
 	{
-		// File-related endpoints
-		relativeFilesPath := strings.TrimPrefix(cfg.APIEndpoints.Files.Base, cfg.APIEndpoints.Base)
-		filesGroup := apiGroup.Group(relativeFilesPath)
+		// Resumable chunked upload endpoints
+		relativeUploadsPath := strings.TrimPrefix(cfg.APIEndpoints.Uploads.Base, cfg.APIEndpoints.Base)
+		uploadsGroup := apiGroup.Group(relativeUploadsPath)
+		uploadsGroup.Use(middleware.RequireTokenScope(services.ScopeFilesWrite))
 		{
-			filesGroup.GET("/:id/download", middleware.ShareSecurityHeaders(), fileHandler.DownloadFile)
+			uploadsGroup.POST("", uploadHandler.CreateUpload)
+			uploadsGroup.HEAD("/:id", uploadHandler.GetUploadOffset)
+			uploadsGroup.GET("/:id", uploadHandler.GetUploadOffset)
+			uploadsGroup.PATCH("/:id", uploadHandler.PatchUpload)
+			uploadsGroup.POST("/:id/finalize", uploadHandler.FinalizeUpload)
+			uploadsGroup.DELETE("/:id", uploadHandler.AbortUpload)
 		}
 	}
 
@@ -301,126 +402,10 @@ func main() {
 			c.String(http.StatusOK, buf.String())
 		})
 
-		shareGroup.POST("/:token/access", func(c *gin.Context) {
-			token := c.Param("token")
-
-			var req struct {
-				Password string `json:"password" binding:"required"`
-			}
-
-			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
-				return
-			}
-
-			// Validate share and decrypt file key
-			fileShare, err := shareService.ValidateShareToken(token)
-			if err != nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
-				return
-			}
-
-			_, err = shareService.DecryptFileKey(fileShare, req.Password)
-			if err != nil {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
-				return
-			}
-
-			// Generate download URL
-			downloadPath := strings.Replace(cfg.APIEndpoints.Files.Download, ":id", fmt.Sprintf("%d", fileShare.UserFileID), 1)
-			downloadURL := fmt.Sprintf("%s?share_token=%s&password=%s",
-				downloadPath, token, req.Password)
-
-			c.JSON(http.StatusOK, gin.H{"downloadUrl": downloadURL})
-		})
+		shareGroup.POST("/:token/access", middleware.OptionalAuthMiddleware(authService, db), shareHandler.AccessShare)
 
 		// Direct download endpoint for shared files
-		shareGroup.GET("/:token/download", func(c *gin.Context) {
-			token := c.Param("token")
-			password := c.Query("password")
-			keyParam := c.Query("key")
-
-			if password == "" && keyParam == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Password or decryption key is required"})
-				return
-			}
-
-			// Validate share token
-			fileShare, err := shareService.ValidateShareToken(token)
-			if err != nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
-				return
-			}
-
-			// Get user file info for filename and encryption key
-			var userFile models.UserFile
-			if err := shareService.GetDB().GetDB().Preload("File").Where("id = ?", fileShare.UserFileID).First(&userFile).Error; err != nil {
-				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-				return
-			}
-
-			// Get the file encryption key. For shared files, this must be decrypted
-			// using the password provided for the share.
-			var fileKey []byte
-			if keyParam != "" {
-				// If a raw key is provided (e.g., from passwordless share), decode and use it
-				var err error
-				fileKey, err = base64.StdEncoding.DecodeString(keyParam)
-				if err != nil {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key format"})
-					return
-				}
-			} else {
-				// If password is provided, use it to decrypt the file key stored in the share
-				var err error
-				fileKey, err = shareService.DecryptFileKey(fileShare, password)
-				if err != nil {
-					c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
-					return
-				}
-			}
-
-			if len(fileKey) == 0 {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to obtain file key"})
-				return
-			}
-
-			// Get the encrypted file content
-			reader, mimeType, err := fileService.StreamFile(userFile.UserID, fileShare.UserFileID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file"})
-				return
-			}
-			defer reader.Close()
-
-			// Read encrypted content
-			encryptedData, err := io.ReadAll(reader)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
-				return
-			}
-
-			// Decrypt the file content using the centralized crypto manager
-			decryptedData, err := cryptoManager.DecryptFileWithNoncePrefix(encryptedData, fileKey)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt file"})
-				return
-			}
-
-			// Increment download count
-			shareService.IncrementDownloadCount(fileShare.ID)
-
-			// Set headers for download
-			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", userFile.Filename))
-			c.Header("Content-Type", mimeType)
-			c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
-			c.Header("Pragma", "no-cache")
-			c.Header("Expires", "0")
-			c.Header("Content-Length", fmt.Sprintf("%d", len(decryptedData)))
-
-			// Send the decrypted file
-			c.Data(http.StatusOK, mimeType, decryptedData)
-		})
+		shareGroup.GET("/:token/download", shareHandler.DownloadShare)
 	}
 
 	// Shared dashboard endpoint - serve React app with shared view
@@ -455,6 +440,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
+	stopWorkers()
 
 	// Give outstanding requests a deadline to complete
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
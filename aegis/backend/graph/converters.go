@@ -0,0 +1,142 @@
+package graph
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/balkanid/aegis-backend/graph/model"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+// Conversions between service-layer types and the GraphQL models generated by gqlgen.
+// Kept out of schema.resolvers.go so that regenerating the resolvers leaves them alone.
+
+func toStorageGCReport(report *services.StorageGCReport) *model.StorageGCReport {
+	if report == nil {
+		return nil
+	}
+
+	orphans := make([]*model.StorageGCObject, len(report.OrphanObjects))
+	for i, object := range report.OrphanObjects {
+		orphans[i] = &model.StorageGCObject{
+			Key:          object.Key,
+			SizeBytes:    int(object.Size),
+			LastModified: object.LastModified,
+		}
+	}
+
+	missing := make([]*model.StorageGCMissingObject, len(report.MissingObjects))
+	for i, object := range report.MissingObjects {
+		missing[i] = &model.StorageGCMissingObject{
+			FileID:      strconv.FormatUint(uint64(object.FileID), 10),
+			StoragePath: object.StoragePath,
+		}
+	}
+
+	unreferenced := make([]string, len(report.UnreferencedFileIDs))
+	for i, fileID := range report.UnreferencedFileIDs {
+		unreferenced[i] = strconv.FormatUint(uint64(fileID), 10)
+	}
+
+	return &model.StorageGCReport{
+		DryRun:              report.DryRun,
+		StartedAt:           report.StartedAt,
+		CompletedAt:         report.CompletedAt,
+		ObjectsScanned:      report.ObjectsScanned,
+		FilesScanned:        report.FilesScanned,
+		OrphanObjects:       orphans,
+		OrphanBytes:         int(report.OrphanBytes),
+		MissingObjects:      missing,
+		UnreferencedFileIds: unreferenced,
+		RepairedRefCounts:   report.RepairedRefCounts,
+		DeletedObjects:      report.DeletedObjects,
+		DeletedFiles:        report.DeletedFiles,
+		Errors:              report.Errors,
+	}
+}
+
+func toIntegrityScrubReport(report *services.IntegrityScrubReport) *model.IntegrityScrubReport {
+	if report == nil {
+		return nil
+	}
+
+	return &model.IntegrityScrubReport{
+		StartedAt:      report.StartedAt,
+		CompletedAt:    report.CompletedAt,
+		FilesChecked:   report.FilesChecked,
+		BytesChecked:   int(report.BytesChecked),
+		CorruptedFiles: report.CorruptedFiles,
+		MissingFiles:   report.MissingFiles,
+		ResolvedIssues: report.ResolvedIssues,
+		Errors:         report.Errors,
+	}
+}
+
+func toReencryptionReport(report *services.ReencryptionReport) *model.ReencryptionReport {
+	if report == nil {
+		return nil
+	}
+
+	return &model.ReencryptionReport{
+		StartedAt:      report.StartedAt,
+		CompletedAt:    report.CompletedAt,
+		SharesScanned:  report.SharesScanned,
+		SharesMigrated: report.SharesMigrated,
+		SharesSkipped:  report.SharesSkipped,
+		FilesScanned:   report.FilesScanned,
+		FilesMigrated:  report.FilesMigrated,
+		FilesSkipped:   report.FilesSkipped,
+		Errors:         report.Errors,
+	}
+}
+
+func toSharePasswordKeyStatus(status *services.SharePasswordKeyStatus) *model.SharePasswordKeyStatus {
+	return &model.SharePasswordKeyStatus{
+		CurrentVersion: status.CurrentVersion,
+		OutdatedShares: status.OutdatedShares,
+	}
+}
+
+func toKeyRotationCampaignUser(user *services.KeyRotationCampaignUser) *model.KeyRotationCampaignUser {
+	var errorMessage *string
+	if user.Rotation.ErrorMessage != "" {
+		errorMessage = &user.Rotation.ErrorMessage
+	}
+
+	return &model.KeyRotationCampaignUser{
+		UserID:   strconv.FormatUint(uint64(user.UserID), 10),
+		Username: user.Username,
+		Rotation: &model.KeyRotationResult{
+			RotationID:         user.Rotation.RotationID,
+			Status:             model.KeyRotationStatus(user.Rotation.Status),
+			TotalFilesAffected: user.Rotation.TotalFilesAffected,
+			FilesProcessed:     user.Rotation.FilesProcessed,
+			ErrorMessage:       errorMessage,
+		},
+	}
+}
+
+func toRecoveryStatus(status *services.RecoveryStatus) *model.RecoveryStatus {
+	return &model.RecoveryStatus{
+		RecoveryKeyEnrolled: status.RecoveryKeyEnrolled,
+		EnrolledAt:          status.EnrolledAt,
+		Escrowed:            status.Escrowed,
+	}
+}
+
+func roomMemberKeys(inputs []*model.RoomMemberKeyInput) ([]services.RoomMemberKey, error) {
+	memberKeys := make([]services.RoomMemberKey, 0, len(inputs))
+	for _, input := range inputs {
+		userID, err := strconv.ParseUint(input.UserID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID: %w", err)
+		}
+		memberKeys = append(memberKeys, services.RoomMemberKey{
+			UserID:         uint(userID),
+			Version:        input.Version,
+			KeyFingerprint: input.KeyFingerprint,
+			WrappedKey:     input.WrappedKey,
+		})
+	}
+	return memberKeys, nil
+}
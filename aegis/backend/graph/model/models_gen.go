@@ -40,8 +40,14 @@ type AdminDashboard struct {
 }
 
 type AuthPayload struct {
-	Token string       `json:"token"`
-	User  *models.User `json:"user"`
+	Token        string       `json:"token"`
+	RefreshToken string       `json:"refresh_token"`
+	User         *models.User `json:"user"`
+}
+
+type AuthSettings struct {
+	OidcEnabled           bool `json:"oidc_enabled"`
+	PasswordSignupEnabled bool `json:"password_signup_enabled"`
 }
 
 type CreateFileShareInput struct {
@@ -57,6 +63,17 @@ type CreateFolderInput struct {
 	ParentID *string `json:"parent_id,omitempty"`
 }
 
+type CreatePersonalAccessTokenInput struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays *int     `json:"expires_in_days,omitempty"`
+}
+
+type CreatePersonalAccessTokenPayload struct {
+	Token               string                      `json:"token"`
+	PersonalAccessToken *models.PersonalAccessToken `json:"personal_access_token"`
+}
+
 type CreateRoomInput struct {
 	Name string `json:"name"`
 }
@@ -76,6 +93,40 @@ type FileFilterInput struct {
 	FolderID       *string    `json:"folder_id,omitempty"`
 }
 
+type FileKeyGrantInput struct {
+	RecipientID    string `json:"recipient_id"`
+	KeyFingerprint string `json:"key_fingerprint"`
+	WrappedKey     string `json:"wrapped_key"`
+}
+
+type GrantFileKeysInput struct {
+	UserFileID string               `json:"user_file_id"`
+	RoomID     *string              `json:"room_id,omitempty"`
+	Grants     []*FileKeyGrantInput `json:"grants"`
+}
+
+type GrantRoomKeysInput struct {
+	RoomID string                `json:"room_id"`
+	Keys   []*RoomMemberKeyInput `json:"keys"`
+}
+
+type IntegrityScrubReport struct {
+	StartedAt      time.Time `json:"started_at"`
+	CompletedAt    time.Time `json:"completed_at"`
+	FilesChecked   int       `json:"files_checked"`
+	BytesChecked   int       `json:"bytes_checked"`
+	CorruptedFiles int       `json:"corrupted_files"`
+	MissingFiles   int       `json:"missing_files"`
+	ResolvedIssues int       `json:"resolved_issues"`
+	Errors         []string  `json:"errors"`
+}
+
+type KeyRotationCampaignUser struct {
+	UserID   string             `json:"user_id"`
+	Username string             `json:"username"`
+	Rotation *KeyRotationResult `json:"rotation"`
+}
+
 type KeyRotationResult struct {
 	RotationID         string            `json:"rotation_id"`
 	Status             KeyRotationStatus `json:"status"`
@@ -89,6 +140,14 @@ type LoginInput struct {
 	Password   string `json:"password"`
 }
 
+type LoginPayload struct {
+	TwoFactorRequired bool         `json:"two_factor_required"`
+	ChallengeToken    *string      `json:"challenge_token,omitempty"`
+	Token             *string      `json:"token,omitempty"`
+	RefreshToken      *string      `json:"refresh_token,omitempty"`
+	User              *models.User `json:"user,omitempty"`
+}
+
 type MoveFileInput struct {
 	ID       string  `json:"id"`
 	FolderID *string `json:"folder_id,omitempty"`
@@ -105,17 +164,59 @@ type Mutation struct {
 type Query struct {
 }
 
+type RecoveryStatus struct {
+	RecoveryKeyEnrolled bool       `json:"recovery_key_enrolled"`
+	EnrolledAt          *time.Time `json:"enrolled_at,omitempty"`
+	Escrowed            bool       `json:"escrowed"`
+}
+
+type ReencryptionReport struct {
+	StartedAt      time.Time `json:"started_at"`
+	CompletedAt    time.Time `json:"completed_at"`
+	SharesScanned  int       `json:"shares_scanned"`
+	SharesMigrated int       `json:"shares_migrated"`
+	SharesSkipped  int       `json:"shares_skipped"`
+	FilesScanned   int       `json:"files_scanned"`
+	FilesMigrated  int       `json:"files_migrated"`
+	FilesSkipped   int       `json:"files_skipped"`
+	Errors         []string  `json:"errors"`
+}
+
 type RegisterInput struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
+type RegisterKeyPairInput struct {
+	PublicKey         string `json:"public_key"`
+	WrappedPrivateKey string `json:"wrapped_private_key"`
+}
+
 type RenameFolderInput struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
 }
 
+type RoomFileKeyInput struct {
+	UserFileID string `json:"user_file_id"`
+	WrappedKey string `json:"wrapped_key"`
+}
+
+type RoomMemberKeyInput struct {
+	UserID         string `json:"user_id"`
+	Version        int    `json:"version"`
+	KeyFingerprint string `json:"key_fingerprint"`
+	WrappedKey     string `json:"wrapped_key"`
+}
+
+type RotateRoomKeyInput struct {
+	RoomID     string                `json:"room_id"`
+	Version    int                   `json:"version"`
+	MemberKeys []*RoomMemberKeyInput `json:"member_keys"`
+	FileKeys   []*RoomFileKeyInput   `json:"file_keys,omitempty"`
+}
+
 type ShareExpiryInfo struct {
 	Expires         bool       `json:"expires"`
 	Expired         bool       `json:"expired"`
@@ -140,6 +241,11 @@ type ShareMetadata struct {
 	RequiresPassword bool       `json:"requires_password"`
 }
 
+type SharePasswordKeyStatus struct {
+	CurrentVersion int `json:"current_version"`
+	OutdatedShares int `json:"outdated_shares"`
+}
+
 type SharedWithMeFile struct {
 	ID            string       `json:"id"`
 	Filename      string       `json:"filename"`
@@ -156,6 +262,38 @@ type SharedWithMeFile struct {
 	CreatedAt     time.Time    `json:"created_at"`
 }
 
+type StorageGCMissingObject struct {
+	FileID      string `json:"file_id"`
+	StoragePath string `json:"storage_path"`
+}
+
+type StorageGCObject struct {
+	Key          string    `json:"key"`
+	SizeBytes    int       `json:"size_bytes"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type StorageGCReport struct {
+	DryRun              bool                      `json:"dry_run"`
+	StartedAt           time.Time                 `json:"started_at"`
+	CompletedAt         time.Time                 `json:"completed_at"`
+	ObjectsScanned      int                       `json:"objects_scanned"`
+	FilesScanned        int                       `json:"files_scanned"`
+	OrphanObjects       []*StorageGCObject        `json:"orphan_objects"`
+	OrphanBytes         int                       `json:"orphan_bytes"`
+	MissingObjects      []*StorageGCMissingObject `json:"missing_objects"`
+	UnreferencedFileIds []string                  `json:"unreferenced_file_ids"`
+	RepairedRefCounts   int                       `json:"repaired_ref_counts"`
+	DeletedObjects      int                       `json:"deleted_objects"`
+	DeletedFiles        int                       `json:"deleted_files"`
+	Errors              []string                  `json:"errors"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
 type UpdateFileShareInput struct {
 	ShareID        string     `json:"share_id"`
 	MasterPassword *string    `json:"master_password,omitempty"`
@@ -211,6 +349,7 @@ const (
 	KeyRotationStatusCompleted  KeyRotationStatus = "COMPLETED"
 	KeyRotationStatusFailed     KeyRotationStatus = "FAILED"
 	KeyRotationStatusRolledBack KeyRotationStatus = "ROLLED_BACK"
+	KeyRotationStatusCancelled  KeyRotationStatus = "CANCELLED"
 )
 
 var AllKeyRotationStatus = []KeyRotationStatus{
@@ -219,11 +358,12 @@ var AllKeyRotationStatus = []KeyRotationStatus{
 	KeyRotationStatusCompleted,
 	KeyRotationStatusFailed,
 	KeyRotationStatusRolledBack,
+	KeyRotationStatusCancelled,
 }
 
 func (e KeyRotationStatus) IsValid() bool {
 	switch e {
-	case KeyRotationStatusPending, KeyRotationStatusInProgress, KeyRotationStatusCompleted, KeyRotationStatusFailed, KeyRotationStatusRolledBack:
+	case KeyRotationStatusPending, KeyRotationStatusInProgress, KeyRotationStatusCompleted, KeyRotationStatusFailed, KeyRotationStatusRolledBack, KeyRotationStatusCancelled:
 		return true
 	}
 	return false
@@ -0,0 +1,17 @@
+package graph
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientInfo returns the User-Agent and client IP of the HTTP request a resolver is
+// serving, or empty strings when no gin context was attached.
+func clientInfo(ctx context.Context) (string, string) {
+	ginCtx, ok := ctx.Value("gin").(*gin.Context)
+	if !ok {
+		return "", ""
+	}
+	return ginCtx.GetHeader("User-Agent"), ginCtx.ClientIP()
+}
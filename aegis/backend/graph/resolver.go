@@ -10,12 +10,28 @@ import (
 // It serves as dependency injection for your app, add any dependencies you require here.
 
 type Resolver struct {
-	DB                 *database.DB
-	FileService        *services.FileService
-	UserService        *services.UserService
-	RoomService        *services.RoomService
-	AdminService       *services.AdminService
-	ShareService       *services.ShareService
-	KeyRotationService *services.KeyRotationService
-	CryptoManager      *services.CryptoManager
+	DB                         *database.DB
+	FileService                *services.FileService
+	UserService                *services.UserService
+	RefreshTokenService        *services.RefreshTokenService
+	SessionService             *services.SessionService
+	TwoFactorService           *services.TwoFactorService
+	PersonalAccessTokenService *services.PersonalAccessTokenService
+	OIDCService                *services.OIDCService
+	EmailTokenService          *services.EmailTokenService
+	LoginThrottleService       *services.LoginThrottleService
+	SigningKeyService          *services.SigningKeyService // nil when tokens are signed with HS256
+	DownloadTicketService      *services.DownloadTicketService
+	UserKeyService             *services.UserKeyService
+	RoomService                *services.RoomService
+	RoomKeyService             *services.RoomKeyService
+	AdminService               *services.AdminService
+	ShareService               *services.ShareService
+	KeyRotationService         *services.KeyRotationService
+	KeyRotationCampaignService *services.KeyRotationCampaignService
+	KeyRecoveryService         *services.KeyRecoveryService
+	CryptoManager              *services.CryptoManager
+	StorageGCService           *services.StorageGCService
+	IntegrityScrubService      *services.IntegrityScrubService
+	ReencryptionService        *services.ReencryptionService
 }
@@ -6,13 +6,11 @@ package graph
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"strconv"
-	"strings"
 
 	"github.com/balkanid/aegis-backend/graph/generated"
 	"github.com/balkanid/aegis-backend/graph/model"
@@ -27,6 +25,35 @@ func (r *fileResolver) ID(ctx context.Context, obj *models.File) (string, error)
 	return fmt.Sprintf("%d", obj.ID), nil
 }
 
+// ID is the resolver for the id field.
+func (r *fileKeyGrantResolver) ID(ctx context.Context, obj *models.FileKeyGrant) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
+// UserFileID is the resolver for the user_file_id field.
+func (r *fileKeyGrantResolver) UserFileID(ctx context.Context, obj *models.FileKeyGrant) (string, error) {
+	return fmt.Sprintf("%d", obj.UserFileID), nil
+}
+
+// RecipientID is the resolver for the recipient_id field.
+func (r *fileKeyGrantResolver) RecipientID(ctx context.Context, obj *models.FileKeyGrant) (string, error) {
+	return fmt.Sprintf("%d", obj.RecipientID), nil
+}
+
+// GranterID is the resolver for the granter_id field.
+func (r *fileKeyGrantResolver) GranterID(ctx context.Context, obj *models.FileKeyGrant) (string, error) {
+	return fmt.Sprintf("%d", obj.GranterID), nil
+}
+
+// RoomID is the resolver for the room_id field.
+func (r *fileKeyGrantResolver) RoomID(ctx context.Context, obj *models.FileKeyGrant) (*string, error) {
+	if obj.RoomID == nil {
+		return nil, nil
+	}
+	roomID := fmt.Sprintf("%d", *obj.RoomID)
+	return &roomID, nil
+}
+
 // ID is the resolver for the id field.
 func (r *fileShareResolver) ID(ctx context.Context, obj *models.FileShare) (string, error) {
 	if obj == nil {
@@ -62,6 +89,21 @@ func (r *fileShareResolver) AllowedEmails(ctx context.Context, obj *models.FileS
 	return emails, nil
 }
 
+// UserFileID is the resolver for the user_file_id field.
+func (r *fileVersionResolver) UserFileID(ctx context.Context, obj *models.FileVersion) (string, error) {
+	return fmt.Sprintf("%d", obj.UserFileID), nil
+}
+
+// FileID is the resolver for the file_id field.
+func (r *fileVersionResolver) FileID(ctx context.Context, obj *models.FileVersion) (string, error) {
+	return fmt.Sprintf("%d", obj.FileID), nil
+}
+
+// SizeBytes is the resolver for the size_bytes field.
+func (r *fileVersionResolver) SizeBytes(ctx context.Context, obj *models.FileVersion) (int, error) {
+	return int(obj.File.SizeBytes), nil
+}
+
 // ID is the resolver for the id field.
 func (r *folderResolver) ID(ctx context.Context, obj *models.Folder) (string, error) {
 	return fmt.Sprintf("%d", obj.ID), nil
@@ -81,32 +123,134 @@ func (r *folderResolver) ParentID(ctx context.Context, obj *models.Folder) (*str
 	return &parentID, nil
 }
 
+// ID is the resolver for the id field.
+func (r *keyRecoveryAuditEventResolver) ID(ctx context.Context, obj *models.KeyRecoveryAuditEvent) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
+// UserID is the resolver for the user_id field.
+func (r *keyRecoveryAuditEventResolver) UserID(ctx context.Context, obj *models.KeyRecoveryAuditEvent) (string, error) {
+	return fmt.Sprintf("%d", obj.UserID), nil
+}
+
+// ActorID is the resolver for the actor_id field.
+func (r *keyRecoveryAuditEventResolver) ActorID(ctx context.Context, obj *models.KeyRecoveryAuditEvent) (string, error) {
+	return fmt.Sprintf("%d", obj.ActorID), nil
+}
+
+// RequestID is the resolver for the request_id field.
+func (r *keyRecoveryAuditEventResolver) RequestID(ctx context.Context, obj *models.KeyRecoveryAuditEvent) (*string, error) {
+	if obj.RequestID == nil {
+		return nil, nil
+	}
+	requestID := fmt.Sprintf("%d", *obj.RequestID)
+	return &requestID, nil
+}
+
+// ID is the resolver for the id field.
+func (r *keyRecoveryRequestResolver) ID(ctx context.Context, obj *models.KeyRecoveryRequest) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
+// UserID is the resolver for the user_id field.
+func (r *keyRecoveryRequestResolver) UserID(ctx context.Context, obj *models.KeyRecoveryRequest) (string, error) {
+	return fmt.Sprintf("%d", obj.UserID), nil
+}
+
+// RequestedBy is the resolver for the requested_by field.
+func (r *keyRecoveryRequestResolver) RequestedBy(ctx context.Context, obj *models.KeyRecoveryRequest) (string, error) {
+	return fmt.Sprintf("%d", obj.RequestedBy), nil
+}
+
+// ApprovedBy is the resolver for the approved_by field.
+func (r *keyRecoveryRequestResolver) ApprovedBy(ctx context.Context, obj *models.KeyRecoveryRequest) (*string, error) {
+	if obj.ApprovedBy == nil {
+		return nil, nil
+	}
+	approvedBy := fmt.Sprintf("%d", *obj.ApprovedBy)
+	return &approvedBy, nil
+}
+
+// CompletedBy is the resolver for the completed_by field.
+func (r *keyRecoveryRequestResolver) CompletedBy(ctx context.Context, obj *models.KeyRecoveryRequest) (*string, error) {
+	if obj.CompletedBy == nil {
+		return nil, nil
+	}
+	completedBy := fmt.Sprintf("%d", *obj.CompletedBy)
+	return &completedBy, nil
+}
+
+// StartedBy is the resolver for the started_by field.
+func (r *keyRotationCampaignResolver) StartedBy(ctx context.Context, obj *models.KeyRotationCampaign) (string, error) {
+	return fmt.Sprintf("%d", obj.StartedBy), nil
+}
+
+// ID is the resolver for the id field.
+func (r *loginAuditEventResolver) ID(ctx context.Context, obj *models.LoginAuditEvent) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
+// UserID is the resolver for the user_id field.
+func (r *loginAuditEventResolver) UserID(ctx context.Context, obj *models.LoginAuditEvent) (*string, error) {
+	if obj.UserID == nil {
+		return nil, nil
+	}
+	userID := fmt.Sprintf("%d", *obj.UserID)
+	return &userID, nil
+}
+
+// ActorID is the resolver for the actor_id field.
+func (r *loginAuditEventResolver) ActorID(ctx context.Context, obj *models.LoginAuditEvent) (*string, error) {
+	if obj.ActorID == nil {
+		return nil, nil
+	}
+	actorID := fmt.Sprintf("%d", *obj.ActorID)
+	return &actorID, nil
+}
+
+// ID is the resolver for the id field.
+func (r *loginThrottleResolver) ID(ctx context.Context, obj *models.LoginThrottle) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
 // Register is the resolver for the register field.
 func (r *mutationResolver) Register(ctx context.Context, input model.RegisterInput) (*model.AuthPayload, error) {
 	userService := r.Resolver.UserService
 
-	user, token, err := userService.Register(input.Username, input.Email, input.Password)
+	if err := r.Resolver.OIDCService.RequirePasswordSignup(); err != nil {
+		return nil, err
+	}
+
+	user, err := userService.CreateUser(input.Username, input.Email, input.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registration succeeds even when the mail cannot be sent; the user can ask again
+	if err := r.Resolver.EmailTokenService.SendVerificationEmail(user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+	}
+
+	userAgent, ipAddress := clientInfo(ctx)
+	token, refreshToken, err := r.Resolver.SessionService.StartSession(user, userAgent, ipAddress)
 	if err != nil {
 		return nil, err
 	}
 
 	return &model.AuthPayload{
-		Token: token,
-		User:  user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         user,
 	}, nil
 }
 
 // Login is the resolver for the login field.
-func (r *mutationResolver) Login(ctx context.Context, input model.LoginInput) (*model.AuthPayload, error) {
+func (r *mutationResolver) Login(ctx context.Context, input model.LoginInput) (*model.LoginPayload, error) {
 	// For debugging: let's add some debug logging
 	fmt.Printf("DEBUG: Login resolver called with identifier: %s\n", input.Identifier)
 
-	userService := r.Resolver.UserService
-	if userService == nil {
-		return nil, fmt.Errorf("user service is nil")
-	}
-
-	user, token, err := userService.Login(input.Identifier, input.Password)
+	userAgent, ipAddress := clientInfo(ctx)
+	user, err := r.Resolver.LoginThrottleService.Authenticate(input.Identifier, input.Password, ipAddress)
 	if err != nil {
 		fmt.Printf("DEBUG: User service login failed: %v\n", err)
 		return nil, err
@@ -114,20 +258,306 @@ func (r *mutationResolver) Login(ctx context.Context, input model.LoginInput) (*
 
 	fmt.Printf("DEBUG: Login successful for user: %s\n", user.Email)
 
+	// The session only starts once the second factor has been verified
+	if user.TwoFactorEnabled {
+		challengeToken, err := r.Resolver.TwoFactorService.IssueChallenge(user)
+		if err != nil {
+			return nil, err
+		}
+		return &model.LoginPayload{
+			TwoFactorRequired: true,
+			ChallengeToken:    &challengeToken,
+		}, nil
+	}
+
+	token, refreshToken, err := r.Resolver.SessionService.StartSession(user, userAgent, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.LoginPayload{
+		Token:        &token,
+		RefreshToken: &refreshToken,
+		User:         user,
+	}, nil
+}
+
+// VerifyTwoFactorLogin is the resolver for the verifyTwoFactorLogin field.
+func (r *mutationResolver) VerifyTwoFactorLogin(ctx context.Context, challengeToken string, code string) (*model.AuthPayload, error) {
+	user, err := r.Resolver.TwoFactorService.CompleteLogin(challengeToken, code)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent, ipAddress := clientInfo(ctx)
+	token, refreshToken, err := r.Resolver.SessionService.StartSession(user, userAgent, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+
 	return &model.AuthPayload{
-		Token: token,
-		User:  user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		User:         user,
 	}, nil
 }
 
+// BeginOIDCLogin is the resolver for the beginOIDCLogin field.
+func (r *mutationResolver) BeginOIDCLogin(ctx context.Context) (string, error) {
+	return r.Resolver.OIDCService.BeginLogin()
+}
+
+// CompleteOIDCLogin is the resolver for the completeOIDCLogin field.
+func (r *mutationResolver) CompleteOIDCLogin(ctx context.Context, state string, code string) (*model.LoginPayload, error) {
+	user, err := r.Resolver.OIDCService.CompleteLogin(state, code)
+	if err != nil {
+		return nil, err
+	}
+
+	// Accounts with two-factor authentication still need their second factor
+	if user.TwoFactorEnabled {
+		challengeToken, err := r.Resolver.TwoFactorService.IssueChallenge(user)
+		if err != nil {
+			return nil, err
+		}
+		return &model.LoginPayload{
+			TwoFactorRequired: true,
+			ChallengeToken:    &challengeToken,
+		}, nil
+	}
+
+	userAgent, ipAddress := clientInfo(ctx)
+	token, refreshToken, err := r.Resolver.SessionService.StartSession(user, userAgent, ipAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.LoginPayload{
+		Token:        &token,
+		RefreshToken: &refreshToken,
+		User:         user,
+	}, nil
+}
+
+// SendVerificationEmail is the resolver for the sendVerificationEmail field.
+func (r *mutationResolver) SendVerificationEmail(ctx context.Context) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
+
+	if err := r.Resolver.EmailTokenService.SendVerificationEmail(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// VerifyEmail is the resolver for the verifyEmail field.
+func (r *mutationResolver) VerifyEmail(ctx context.Context, token string) (bool, error) {
+	if _, err := r.Resolver.EmailTokenService.VerifyEmail(token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RequestPasswordReset is the resolver for the requestPasswordReset field.
+func (r *mutationResolver) RequestPasswordReset(ctx context.Context, email string) (bool, error) {
+	if err := r.Resolver.EmailTokenService.RequestPasswordReset(email); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ResetPassword is the resolver for the resetPassword field.
+func (r *mutationResolver) ResetPassword(ctx context.Context, token string, newPassword string) (bool, error) {
+	if err := r.Resolver.EmailTokenService.ResetPassword(token, newPassword); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UnlockAccountWithToken is the resolver for the unlockAccountWithToken field.
+func (r *mutationResolver) UnlockAccountWithToken(ctx context.Context, token string) (bool, error) {
+	if err := r.Resolver.EmailTokenService.UnlockAccount(token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // RefreshToken is the resolver for the refreshToken field.
-func (r *mutationResolver) RefreshToken(ctx context.Context) (*model.AuthPayload, error) {
-	panic(fmt.Errorf("not implemented: RefreshToken - refreshToken"))
+func (r *mutationResolver) RefreshToken(ctx context.Context, refreshToken string) (*model.AuthPayload, error) {
+	user, token, nextRefreshToken, err := r.Resolver.RefreshTokenService.RotateRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.AuthPayload{
+		Token:        token,
+		RefreshToken: nextRefreshToken,
+		User:         user,
+	}, nil
 }
 
 // Logout is the resolver for the logout field.
-func (r *mutationResolver) Logout(ctx context.Context) (bool, error) {
-	// No cookies to clear since we use JWT-only authentication
+func (r *mutationResolver) Logout(ctx context.Context, refreshToken *string) (bool, error) {
+	// End the session the request was made with, and the one the refresh token belongs to
+	if sessionID := middleware.GetSessionIDFromContext(ctx); sessionID != "" {
+		if err := r.Resolver.SessionService.EndSession(sessionID); err != nil {
+			return false, err
+		}
+	}
+	if refreshToken != nil {
+		if err := r.Resolver.RefreshTokenService.RevokeRefreshToken(*refreshToken); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// RevokeSession is the resolver for the revokeSession field.
+func (r *mutationResolver) RevokeSession(ctx context.Context, sessionID string) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
+
+	id, err := strconv.ParseUint(sessionID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid session ID: %w", err)
+	}
+
+	if err := r.Resolver.SessionService.RevokeSession(user.ID, uint(id)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RevokeAllOtherSessions is the resolver for the revokeAllOtherSessions field.
+func (r *mutationResolver) RevokeAllOtherSessions(ctx context.Context) (int, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return 0, err
+	}
+
+	currentSessionID := middleware.GetSessionIDFromContext(ctx)
+	if currentSessionID == "" {
+		return 0, fmt.Errorf("the current token is not bound to a session")
+	}
+
+	return r.Resolver.SessionService.RevokeOtherSessions(user.ID, currentSessionID)
+}
+
+// BeginTwoFactorEnrollment is the resolver for the beginTwoFactorEnrollment field.
+func (r *mutationResolver) BeginTwoFactorEnrollment(ctx context.Context) (*model.TwoFactorEnrollment, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	enrollment, err := r.Resolver.TwoFactorService.BeginEnrollment(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.TwoFactorEnrollment{
+		Secret:          enrollment.Secret,
+		ProvisioningURI: enrollment.ProvisioningURI,
+	}, nil
+}
+
+// ConfirmTwoFactorEnrollment is the resolver for the confirmTwoFactorEnrollment field.
+func (r *mutationResolver) ConfirmTwoFactorEnrollment(ctx context.Context, code string) ([]string, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.Resolver.TwoFactorService.ConfirmEnrollment(user.ID, code)
+}
+
+// RegenerateRecoveryCodes is the resolver for the regenerateRecoveryCodes field.
+func (r *mutationResolver) RegenerateRecoveryCodes(ctx context.Context, code string) ([]string, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.Resolver.TwoFactorService.RegenerateRecoveryCodes(user.ID, code)
+}
+
+// DisableTwoFactor is the resolver for the disableTwoFactor field.
+func (r *mutationResolver) DisableTwoFactor(ctx context.Context, code string) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
+
+	if err := r.Resolver.TwoFactorService.Disable(user.ID, code); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CreatePersonalAccessToken is the resolver for the createPersonalAccessToken field.
+func (r *mutationResolver) CreatePersonalAccessToken(ctx context.Context, input model.CreatePersonalAccessTokenInput) (*model.CreatePersonalAccessTokenPayload, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	token, record, err := r.Resolver.PersonalAccessTokenService.CreateToken(user, input.Name, input.Scopes, input.ExpiresInDays)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.CreatePersonalAccessTokenPayload{
+		Token:               token,
+		PersonalAccessToken: record,
+	}, nil
+}
+
+// RevokePersonalAccessToken is the resolver for the revokePersonalAccessToken field.
+func (r *mutationResolver) RevokePersonalAccessToken(ctx context.Context, id string) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
+
+	tokenID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid token ID: %w", err)
+	}
+
+	if err := r.Resolver.PersonalAccessTokenService.RevokeToken(user.ID, uint(tokenID)); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -137,6 +567,9 @@ func (r *mutationResolver) UploadFile(ctx context.Context, input model.UploadFil
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return nil, err
+	}
 
 	sizeBytes := int64(input.SizeBytes)
 
@@ -146,19 +579,11 @@ func (r *mutationResolver) UploadFile(ctx context.Context, input model.UploadFil
 		return nil, err
 	}
 
-	// For now, create a simple reader from the upload data
-	// In production, this would handle the actual file upload
-	var fileReader io.Reader
-	if input.FileData.File != nil {
-		fileReader = input.FileData.File
-	} else {
-		// Fallback for test scenarios - create content based on size_bytes
-		content := fmt.Sprintf("test file content of size %d bytes", sizeBytes)
-		if len(content) > int(sizeBytes) {
-			content = content[:sizeBytes]
-		}
-		fileReader = strings.NewReader(content)
+	// The bytes are required: the service verifies them against content_hash
+	if input.FileData.File == nil {
+		return nil, fmt.Errorf("file data is required for upload")
 	}
+	var fileReader io.Reader = input.FileData.File
 
 	// Convert folder_id if provided
 	var folderID *uint
@@ -196,6 +621,9 @@ func (r *mutationResolver) UploadFileFromMap(ctx context.Context, input model.Up
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return nil, err
+	}
 
 	// Parse the JSON string into a map
 	var uploadData map[string]interface{}
@@ -230,6 +658,9 @@ func (r *mutationResolver) DeleteFile(ctx context.Context, id string) (bool, err
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	userFileID, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
@@ -250,6 +681,9 @@ func (r *mutationResolver) RestoreFile(ctx context.Context, fileID string) (bool
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	userFileID, err := strconv.ParseUint(fileID, 10, 32)
 	if err != nil {
@@ -270,6 +704,9 @@ func (r *mutationResolver) PermanentlyDeleteFile(ctx context.Context, fileID str
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	userFileID, err := strconv.ParseUint(fileID, 10, 32)
 	if err != nil {
@@ -290,6 +727,9 @@ func (r *mutationResolver) RestoreFolder(ctx context.Context, folderID string) (
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	fID, err := strconv.ParseUint(folderID, 10, 32)
 	if err != nil {
@@ -301,42 +741,102 @@ func (r *mutationResolver) RestoreFolder(ctx context.Context, folderID string) (
 		return false, err
 	}
 
-	return true, nil
+	return true, nil
+}
+
+// PermanentlyDeleteFolder is the resolver for the permanentlyDeleteFolder field.
+func (r *mutationResolver) PermanentlyDeleteFolder(ctx context.Context, folderID string) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
+
+	fID, err := strconv.ParseUint(folderID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid folder ID: %w", err)
+	}
+
+	err = r.Resolver.FileService.PermanentlyDeleteFolder(user.ID, uint(fID))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DownloadFile is the resolver for the downloadFile field.
+func (r *mutationResolver) DownloadFile(ctx context.Context, id string) (string, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return "", err
+	}
+
+	userFileID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid file ID: %w", err)
+	}
+
+	return r.Resolver.FileService.GetFileDownloadURL(ctx, user, uint(userFileID))
+}
+
+// DownloadFileVersion is the resolver for the downloadFileVersion field.
+func (r *mutationResolver) DownloadFileVersion(ctx context.Context, userFileID string, versionNumber int) (string, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return "", err
+	}
+
+	fileID, err := strconv.ParseUint(userFileID, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid file ID: %w", err)
+	}
+
+	return r.Resolver.FileService.GetFileVersionDownloadURL(ctx, user, uint(fileID), versionNumber)
 }
 
-// PermanentlyDeleteFolder is the resolver for the permanentlyDeleteFolder field.
-func (r *mutationResolver) PermanentlyDeleteFolder(ctx context.Context, folderID string) (bool, error) {
+// RestoreFileVersion is the resolver for the restoreFileVersion field.
+func (r *mutationResolver) RestoreFileVersion(ctx context.Context, userFileID string, versionNumber int) (*models.UserFile, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
-		return false, fmt.Errorf("unauthenticated: %w", err)
+		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
-
-	fID, err := strconv.ParseUint(folderID, 10, 32)
-	if err != nil {
-		return false, fmt.Errorf("invalid folder ID: %w", err)
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return nil, err
 	}
 
-	err = r.Resolver.FileService.PermanentlyDeleteFolder(user.ID, uint(fID))
+	fileID, err := strconv.ParseUint(userFileID, 10, 32)
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("invalid file ID: %w", err)
 	}
 
-	return true, nil
+	return r.Resolver.FileService.RestoreFileVersion(user.ID, uint(fileID), versionNumber)
 }
 
-// DownloadFile is the resolver for the downloadFile field.
-func (r *mutationResolver) DownloadFile(ctx context.Context, id string) (string, error) {
+// PruneFileVersions is the resolver for the pruneFileVersions field.
+func (r *mutationResolver) PruneFileVersions(ctx context.Context, userFileID string, keep int) (int, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
-		return "", fmt.Errorf("unauthenticated: %w", err)
+		return 0, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return 0, err
 	}
 
-	userFileID, err := strconv.ParseUint(id, 10, 32)
+	fileID, err := strconv.ParseUint(userFileID, 10, 32)
 	if err != nil {
-		return "", fmt.Errorf("invalid file ID: %w", err)
+		return 0, fmt.Errorf("invalid file ID: %w", err)
 	}
 
-	return r.Resolver.FileService.GetFileDownloadURL(ctx, user, uint(userFileID))
+	return r.Resolver.FileService.PruneFileVersions(user.ID, uint(fileID), keep)
 }
 
 // StarFile is the resolver for the starFile field.
@@ -345,6 +845,9 @@ func (r *mutationResolver) StarFile(ctx context.Context, id string) (bool, error
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	userFileID, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
@@ -368,6 +871,9 @@ func (r *mutationResolver) UnstarFile(ctx context.Context, id string) (bool, err
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	userFileID, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
@@ -388,6 +894,9 @@ func (r *mutationResolver) StarFolder(ctx context.Context, id string) (bool, err
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	folderID, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
@@ -408,6 +917,9 @@ func (r *mutationResolver) UnstarFolder(ctx context.Context, id string) (bool, e
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	folderID, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
@@ -422,12 +934,94 @@ func (r *mutationResolver) UnstarFolder(ctx context.Context, id string) (bool, e
 	return true, nil
 }
 
+// RegisterKeyPair is the resolver for the registerKeyPair field.
+func (r *mutationResolver) RegisterKeyPair(ctx context.Context, input model.RegisterKeyPairInput) (*models.UserKeyPair, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.Resolver.UserKeyService.RegisterKeyPair(user.ID, input.PublicKey, input.WrappedPrivateKey)
+}
+
+// GrantFileKeys is the resolver for the grantFileKeys field.
+func (r *mutationResolver) GrantFileKeys(ctx context.Context, input model.GrantFileKeysInput) ([]*models.FileKeyGrant, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeSharesManage); err != nil {
+		return nil, err
+	}
+
+	userFileID, err := strconv.ParseUint(input.UserFileID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file ID: %w", err)
+	}
+
+	var roomID *uint
+	if input.RoomID != nil {
+		parsedRoomID, err := strconv.ParseUint(*input.RoomID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid room ID: %w", err)
+		}
+		id := uint(parsedRoomID)
+		roomID = &id
+	}
+
+	grants := make([]services.FileKeyGrantInput, 0, len(input.Grants))
+	for _, grant := range input.Grants {
+		recipientID, err := strconv.ParseUint(grant.RecipientID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient ID: %w", err)
+		}
+		grants = append(grants, services.FileKeyGrantInput{
+			RecipientID:    uint(recipientID),
+			KeyFingerprint: grant.KeyFingerprint,
+			WrappedKey:     grant.WrappedKey,
+		})
+	}
+
+	return r.Resolver.UserKeyService.GrantFileKeys(user.ID, uint(userFileID), roomID, grants)
+}
+
+// RevokeFileKeyGrant is the resolver for the revokeFileKeyGrant field.
+func (r *mutationResolver) RevokeFileKeyGrant(ctx context.Context, userFileID string, recipientID string) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeSharesManage); err != nil {
+		return false, err
+	}
+
+	parsedUserFileID, err := strconv.ParseUint(userFileID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid file ID: %w", err)
+	}
+	parsedRecipientID, err := strconv.ParseUint(recipientID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid recipient ID: %w", err)
+	}
+
+	if err := r.Resolver.UserKeyService.RevokeFileKeyGrant(user.ID, uint(parsedUserFileID), uint(parsedRecipientID)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // CreateRoom is the resolver for the createRoom field.
 func (r *mutationResolver) CreateRoom(ctx context.Context, input model.CreateRoomInput) (*models.Room, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
 
 	return r.Resolver.RoomService.CreateRoom(user.ID, input.Name)
 }
@@ -438,6 +1032,9 @@ func (r *mutationResolver) AddRoomMember(ctx context.Context, input model.AddRoo
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	roomID, err := strconv.ParseUint(input.RoomID, 10, 32)
 	if err != nil {
@@ -472,6 +1069,9 @@ func (r *mutationResolver) UpdateRoomMemberRole(ctx context.Context, input model
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	roomID, err := strconv.ParseUint(input.RoomID, 10, 32)
 	if err != nil {
@@ -511,6 +1111,9 @@ func (r *mutationResolver) UpdateRoom(ctx context.Context, input model.UpdateRoo
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
 
 	roomID, err := strconv.ParseUint(input.RoomID, 10, 32)
 	if err != nil {
@@ -526,6 +1129,9 @@ func (r *mutationResolver) DeleteRoom(ctx context.Context, input model.DeleteRoo
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	roomID, err := strconv.ParseUint(input.RoomID, 10, 32)
 	if err != nil {
@@ -546,6 +1152,9 @@ func (r *mutationResolver) RemoveRoomMember(ctx context.Context, roomID string,
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	rID, err := strconv.ParseUint(roomID, 10, 32)
 	if err != nil {
@@ -571,6 +1180,9 @@ func (r *mutationResolver) LeaveRoom(ctx context.Context, roomID string) (bool,
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	rID, err := strconv.ParseUint(roomID, 10, 32)
 	if err != nil {
@@ -586,11 +1198,14 @@ func (r *mutationResolver) LeaveRoom(ctx context.Context, roomID string) (bool,
 }
 
 // ShareFileToRoom is the resolver for the shareFileToRoom field.
-func (r *mutationResolver) ShareFileToRoom(ctx context.Context, userFileID string, roomID string) (bool, error) {
+func (r *mutationResolver) ShareFileToRoom(ctx context.Context, userFileID string, roomID string, roomKeyVersion *int, wrappedKey *string) (bool, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	ufID, err := strconv.ParseUint(userFileID, 10, 32)
 	if err != nil {
@@ -602,7 +1217,15 @@ func (r *mutationResolver) ShareFileToRoom(ctx context.Context, userFileID strin
 		return false, fmt.Errorf("invalid room ID: %w", err)
 	}
 
-	err = r.Resolver.RoomService.ShareFileToRoom(uint(ufID), uint(rID), user.ID)
+	var key *services.RoomFileKey
+	if wrappedKey != nil {
+		key = &services.RoomFileKey{UserFileID: uint(ufID), WrappedKey: *wrappedKey}
+		if roomKeyVersion != nil {
+			key.KeyVersion = *roomKeyVersion
+		}
+	}
+
+	err = r.Resolver.RoomService.ShareEncryptedFileToRoom(uint(ufID), uint(rID), user.ID, key)
 	if err != nil {
 		return false, err
 	}
@@ -616,6 +1239,9 @@ func (r *mutationResolver) RemoveFileFromRoom(ctx context.Context, userFileID st
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	ufID, err := strconv.ParseUint(userFileID, 10, 32)
 	if err != nil {
@@ -635,12 +1261,73 @@ func (r *mutationResolver) RemoveFileFromRoom(ctx context.Context, userFileID st
 	return true, nil
 }
 
+// RotateRoomKey is the resolver for the rotateRoomKey field.
+func (r *mutationResolver) RotateRoomKey(ctx context.Context, input model.RotateRoomKeyInput) (*models.Room, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	rID, err := strconv.ParseUint(input.RoomID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid room ID: %w", err)
+	}
+
+	memberKeys, err := roomMemberKeys(input.MemberKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKeys := make([]services.RoomFileKey, 0, len(input.FileKeys))
+	for _, fileKey := range input.FileKeys {
+		ufID, err := strconv.ParseUint(fileKey.UserFileID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user file ID: %w", err)
+		}
+		fileKeys = append(fileKeys, services.RoomFileKey{UserFileID: uint(ufID), WrappedKey: fileKey.WrappedKey})
+	}
+
+	return r.Resolver.RoomKeyService.RotateRoomKey(user.ID, uint(rID), input.Version, memberKeys, fileKeys)
+}
+
+// GrantRoomKeys is the resolver for the grantRoomKeys field.
+func (r *mutationResolver) GrantRoomKeys(ctx context.Context, input model.GrantRoomKeysInput) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
+
+	rID, err := strconv.ParseUint(input.RoomID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid room ID: %w", err)
+	}
+
+	memberKeys, err := roomMemberKeys(input.Keys)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.Resolver.RoomKeyService.GrantRoomKeys(user.ID, uint(rID), memberKeys); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // CreateFolder is the resolver for the createFolder field.
 func (r *mutationResolver) CreateFolder(ctx context.Context, input model.CreateFolderInput) (*models.Folder, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return nil, err
+	}
 
 	var parentID *uint
 	if input.ParentID != nil {
@@ -661,6 +1348,9 @@ func (r *mutationResolver) RenameFolder(ctx context.Context, input model.RenameF
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	folderID, err := strconv.ParseUint(input.ID, 10, 32)
 	if err != nil {
@@ -681,6 +1371,9 @@ func (r *mutationResolver) DeleteFolder(ctx context.Context, id string) (bool, e
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	folderID, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
@@ -701,6 +1394,9 @@ func (r *mutationResolver) MoveFolder(ctx context.Context, input model.MoveFolde
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	folderID, err := strconv.ParseUint(input.ID, 10, 32)
 	if err != nil {
@@ -731,6 +1427,9 @@ func (r *mutationResolver) MoveFile(ctx context.Context, input model.MoveFileInp
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesWrite); err != nil {
+		return false, err
+	}
 
 	log.Printf("DEBUG: MoveFile called - UserID: %d, FileID: %s, FolderID: %v", user.ID, input.ID, input.FolderID)
 
@@ -768,6 +1467,9 @@ func (r *mutationResolver) ShareFolderToRoom(ctx context.Context, input model.Sh
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	folderID, err := strconv.ParseUint(input.FolderID, 10, 32)
 	if err != nil {
@@ -793,6 +1495,9 @@ func (r *mutationResolver) RemoveFolderFromRoom(ctx context.Context, folderID st
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	fID, err := strconv.ParseUint(folderID, 10, 32)
 	if err != nil {
@@ -822,6 +1527,9 @@ func (r *mutationResolver) CreateFileShare(ctx context.Context, input model.Crea
 		fmt.Printf("DEBUG: Authentication failed: %v\n", err)
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeSharesManage); err != nil {
+		return nil, err
+	}
 
 	// Debug logging
 	fmt.Printf("DEBUG: CreateFileShare input.UserFileID = '%s' (length=%d)\n", input.UserFileID, len(input.UserFileID))
@@ -871,6 +1579,9 @@ func (r *mutationResolver) UpdateFileShare(ctx context.Context, input model.Upda
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeSharesManage); err != nil {
+		return nil, err
+	}
 
 	shareID, err := strconv.ParseUint(input.ShareID, 10, 32)
 	if err != nil {
@@ -903,6 +1614,9 @@ func (r *mutationResolver) DeleteFileShare(ctx context.Context, shareID string)
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeSharesManage); err != nil {
+		return false, err
+	}
 
 	sID, err := strconv.ParseUint(shareID, 10, 32)
 	if err != nil {
@@ -947,26 +1661,10 @@ func (r *mutationResolver) AccessSharedFile(ctx context.Context, input model.Acc
 		return "", err
 	}
 
-	// Check allowed emails authorization if user is authenticated and allowed_emails is not empty
-	if user != nil && fileShare.AllowedEmails != "" && fileShare.AllowedEmails != "[]" {
-		var allowedEmails []string
-		if err := json.Unmarshal([]byte(fileShare.AllowedEmails), &allowedEmails); err != nil {
-			r.Resolver.ShareService.LogFailedDownload(fileShare.ID, attempt, "failed to parse allowed emails")
-			return "", fmt.Errorf("failed to parse allowed emails")
-		}
-		if len(allowedEmails) > 0 {
-			authorized := false
-			for _, allowedEmail := range allowedEmails {
-				if allowedEmail == user.Email {
-					authorized = true
-					break
-				}
-			}
-			if !authorized {
-				r.Resolver.ShareService.LogFailedDownload(fileShare.ID, attempt, "user not in allowed list")
-				return "", fmt.Errorf("access denied: your email is not in the allowed list for this share")
-			}
-		}
+	// Shares restricted to emails need a signed-in user with a matching, verified address
+	if err := r.Resolver.ShareService.AuthorizeRecipient(fileShare, user); err != nil {
+		r.Resolver.ShareService.LogFailedDownload(fileShare.ID, attempt, "recipient not authorized")
+		return "", err
 	}
 
 	// Validate password (skip for passwordless shares)
@@ -993,6 +1691,12 @@ func (r *mutationResolver) AccessSharedFile(ctx context.Context, input model.Acc
 		}
 	}
 
+	// Charge the download; this fails if another recipient used up the last one
+	if err := r.Resolver.ShareService.IncrementDownloadCount(fileShare.ID); err != nil {
+		r.Resolver.ShareService.LogFailedDownload(fileShare.ID, attempt, "download limit exceeded")
+		return "", err
+	}
+
 	// Log successful access
 	r.Resolver.ShareService.LogSuccessfulDownload(fileShare.ID, attempt)
 
@@ -1005,23 +1709,23 @@ func (r *mutationResolver) AccessSharedFile(ctx context.Context, input model.Acc
 		}
 	}
 
-	// Increment download count
-	err = r.Resolver.ShareService.IncrementDownloadCount(fileShare.ID)
-	if err != nil {
-		return "", fmt.Errorf("failed to increment download count: %w", err)
+	var recipientID uint
+	if userID != nil {
+		recipientID = *userID
 	}
 
-	// Generate download URL
-	downloadURL, err := r.Resolver.ShareService.GenerateShareLink(fileShare)
+	// Generate download URL. The unlocked key travels inside a short-lived download
+	// ticket rather than in the URL itself.
+	shareURL, err := r.Resolver.ShareService.GenerateShareLink(fileShare)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate download URL: %w", err)
+	}
+	ticket, err := r.Resolver.DownloadTicketService.IssueShareTicket(fileShare.ID, recipientID, decryptedKey)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate download URL: %w", err)
 	}
 
-	// Add decrypted key as query parameter for frontend decryption
-	// Base64 encode the raw key bytes for safe URL transmission
-	downloadURL += "?key=" + base64.StdEncoding.EncodeToString(decryptedKey)
-
-	return downloadURL, nil
+	return shareURL + "/download?ticket=" + ticket, nil
 }
 
 // PromoteUserToAdmin is the resolver for the promoteUserToAdmin field.
@@ -1051,17 +1755,131 @@ func (r *mutationResolver) DeleteUserAccount(ctx context.Context, userID string)
 		return false, fmt.Errorf("admin access required: %w", err)
 	}
 
-	uID, err := strconv.ParseUint(userID, 10, 32)
+	uID, err := strconv.ParseUint(userID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	err = r.Resolver.UserService.DeleteUser(uint(uID))
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ResetUserTwoFactor is the resolver for the resetUserTwoFactor field.
+func (r *mutationResolver) ResetUserTwoFactor(ctx context.Context, userID string) (bool, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("admin access required: %w", err)
+	}
+
+	uID, err := strconv.ParseUint(userID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	if err := r.Resolver.TwoFactorService.Reset(uint(uID)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UnlockAccount is the resolver for the unlockAccount field.
+func (r *mutationResolver) UnlockAccount(ctx context.Context, userID string) (bool, error) {
+	admin, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("admin access required: %w", err)
+	}
+
+	uID, err := strconv.ParseUint(userID, 10, 32)
+	if err != nil {
+		return false, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	if err := r.Resolver.LoginThrottleService.UnlockAccount(admin.ID, uint(uID)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RotateSigningKey is the resolver for the rotateSigningKey field.
+func (r *mutationResolver) RotateSigningKey(ctx context.Context) (*models.SigningKey, error) {
+	admin, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+	if r.Resolver.SigningKeyService == nil {
+		return nil, fmt.Errorf("signing keys are not in use, tokens are signed with HS256")
+	}
+
+	key, err := r.Resolver.SigningKeyService.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Admin %d rotated the token signing key to %s", admin.ID, key.KID)
+	return key, nil
+}
+
+// RunStorageGc is the resolver for the runStorageGC field.
+func (r *mutationResolver) RunStorageGc(ctx context.Context, dryRun bool) (*model.StorageGCReport, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	report, err := r.Resolver.StorageGCService.Run(ctx, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	return toStorageGCReport(report), nil
+}
+
+// RunIntegrityScrub is the resolver for the runIntegrityScrub field.
+func (r *mutationResolver) RunIntegrityScrub(ctx context.Context) (*model.IntegrityScrubReport, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	report, err := r.Resolver.IntegrityScrubService.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return toIntegrityScrubReport(report), nil
+}
+
+// RunReencryption is the resolver for the runReencryption field.
+func (r *mutationResolver) RunReencryption(ctx context.Context) (*model.ReencryptionReport, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	report, err := r.Resolver.ReencryptionService.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return toReencryptionReport(report), nil
+}
+
+// RotateSharePasswordKey is the resolver for the rotateSharePasswordKey field.
+func (r *mutationResolver) RotateSharePasswordKey(ctx context.Context) (*model.SharePasswordKeyStatus, error) {
+	_, err := middleware.RequireAdmin(ctx)
 	if err != nil {
-		return false, fmt.Errorf("invalid user ID: %w", err)
+		return nil, fmt.Errorf("admin access required: %w", err)
 	}
 
-	err = r.Resolver.UserService.DeleteUser(uint(uID))
+	status, err := r.Resolver.ReencryptionService.RotateSharePasswordKey(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	return true, nil
+	return toSharePasswordKeyStatus(status), nil
 }
 
 // UpdateProfile is the resolver for the updateProfile field.
@@ -1070,6 +1888,9 @@ func (r *mutationResolver) UpdateProfile(ctx context.Context, input model.Update
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
 
 	// Convert pointers to strings, using empty string for nil values
 	username := ""
@@ -1103,6 +1924,12 @@ func (r *mutationResolver) UpdateProfile(ctx context.Context, input model.Update
 		return nil, err
 	}
 
+	if updatedUser.Email != user.Email {
+		if err := r.Resolver.EmailTokenService.SendVerificationEmail(updatedUser); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", updatedUser.ID, err)
+		}
+	}
+
 	return updatedUser, nil
 }
 
@@ -1112,6 +1939,9 @@ func (r *mutationResolver) RotateUserEnvelopeKey(ctx context.Context) (*model.Ke
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
 
 	result, err := r.Resolver.KeyRotationService.RotateEnvelopeKey(user.ID)
 	if err != nil {
@@ -1140,6 +1970,9 @@ func (r *mutationResolver) RotateEnvelopeKeys(ctx context.Context) (*model.KeyRo
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
 
 	result, err := r.Resolver.KeyRotationService.RotateEnvelopeKey(user.ID)
 	if err != nil {
@@ -1166,6 +1999,9 @@ func (r *mutationResolver) RollbackKeyRotation(ctx context.Context, rotationID s
 	if err != nil {
 		return false, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
 
 	err = r.Resolver.KeyRotationService.RollbackRotation(rotationID, user.ID)
 	if err != nil {
@@ -1181,6 +2017,9 @@ func (r *mutationResolver) GetRotationStatus(ctx context.Context, rotationID str
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
 
 	result, err := r.Resolver.KeyRotationService.GetRotationStatus(rotationID, user.ID)
 	if err != nil {
@@ -1201,6 +2040,176 @@ func (r *mutationResolver) GetRotationStatus(ctx context.Context, rotationID str
 	}, nil
 }
 
+// StartKeyRotationCampaign is the resolver for the startKeyRotationCampaign field.
+func (r *mutationResolver) StartKeyRotationCampaign(ctx context.Context, concurrency *int, rateLimitPerSecond *int) (*models.KeyRotationCampaign, error) {
+	admin, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	var workers, ratePerSecond int
+	if concurrency != nil {
+		workers = *concurrency
+	}
+	if rateLimitPerSecond != nil {
+		ratePerSecond = *rateLimitPerSecond
+	}
+
+	return r.Resolver.KeyRotationCampaignService.StartCampaign(admin.ID, workers, ratePerSecond)
+}
+
+// PauseKeyRotationCampaign is the resolver for the pauseKeyRotationCampaign field.
+func (r *mutationResolver) PauseKeyRotationCampaign(ctx context.Context, campaignID string) (*models.KeyRotationCampaign, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return r.Resolver.KeyRotationCampaignService.PauseCampaign(campaignID)
+}
+
+// ResumeKeyRotationCampaign is the resolver for the resumeKeyRotationCampaign field.
+func (r *mutationResolver) ResumeKeyRotationCampaign(ctx context.Context, campaignID string) (*models.KeyRotationCampaign, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return r.Resolver.KeyRotationCampaignService.ResumeCampaign(campaignID)
+}
+
+// CancelKeyRotationCampaign is the resolver for the cancelKeyRotationCampaign field.
+func (r *mutationResolver) CancelKeyRotationCampaign(ctx context.Context, campaignID string) (*models.KeyRotationCampaign, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return r.Resolver.KeyRotationCampaignService.CancelCampaign(campaignID)
+}
+
+// EnrollRecoveryKey is the resolver for the enrollRecoveryKey field.
+func (r *mutationResolver) EnrollRecoveryKey(ctx context.Context) (string, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return "", err
+	}
+
+	return r.Resolver.KeyRecoveryService.EnrollRecoveryKey(ctx, user.ID)
+}
+
+// RecoverEnvelopeKey is the resolver for the recoverEnvelopeKey field.
+func (r *mutationResolver) RecoverEnvelopeKey(ctx context.Context, recoveryKey string) (bool, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return false, err
+	}
+
+	if err := r.Resolver.KeyRecoveryService.RecoverWithRecoveryKey(ctx, user.ID, recoveryKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RequestKeyRecovery is the resolver for the requestKeyRecovery field.
+func (r *mutationResolver) RequestKeyRecovery(ctx context.Context, userID string, reason string) (*models.KeyRecoveryRequest, error) {
+	admin, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	uID, err := strconv.ParseUint(userID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	request, err := r.Resolver.KeyRecoveryService.RequestEscrowRecovery(admin.ID, uint(uID), reason)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Admin %d requested recovery of the envelope key of user %d", admin.ID, request.UserID)
+	return request, nil
+}
+
+// ApproveKeyRecovery is the resolver for the approveKeyRecovery field.
+func (r *mutationResolver) ApproveKeyRecovery(ctx context.Context, requestID string) (*models.KeyRecoveryRequest, error) {
+	admin, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	rID, err := strconv.ParseUint(requestID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	request, err := r.Resolver.KeyRecoveryService.ApproveEscrowRecovery(admin.ID, uint(rID))
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Admin %d approved key recovery request %d", admin.ID, request.ID)
+	return request, nil
+}
+
+// CompleteKeyRecovery is the resolver for the completeKeyRecovery field.
+func (r *mutationResolver) CompleteKeyRecovery(ctx context.Context, requestID string, escrowKey string) (*models.KeyRecoveryRequest, error) {
+	admin, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	rID, err := strconv.ParseUint(requestID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	request, err := r.Resolver.KeyRecoveryService.CompleteEscrowRecovery(ctx, admin.ID, uint(rID), escrowKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Admin %d restored the envelope key of user %d from escrow", admin.ID, request.UserID)
+	return request, nil
+}
+
+// CancelKeyRecovery is the resolver for the cancelKeyRecovery field.
+func (r *mutationResolver) CancelKeyRecovery(ctx context.Context, requestID string) (*models.KeyRecoveryRequest, error) {
+	admin, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	rID, err := strconv.ParseUint(requestID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	return r.Resolver.KeyRecoveryService.CancelEscrowRecovery(admin.ID, uint(rID))
+}
+
+// ID is the resolver for the id field.
+func (r *personalAccessTokenResolver) ID(ctx context.Context, obj *models.PersonalAccessToken) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
+// Scopes is the resolver for the scopes field.
+func (r *personalAccessTokenResolver) Scopes(ctx context.Context, obj *models.PersonalAccessToken) ([]string, error) {
+	return services.TokenScopes(obj), nil
+}
+
+// AuthSettings is the resolver for the authSettings field.
+func (r *queryResolver) AuthSettings(ctx context.Context) (*model.AuthSettings, error) {
+	return &model.AuthSettings{
+		OidcEnabled:           r.Resolver.OIDCService.Enabled(),
+		PasswordSignupEnabled: r.Resolver.OIDCService.PasswordSignupAllowed(),
+	}, nil
+}
+
 // Me is the resolver for the me field.
 func (r *queryResolver) Me(ctx context.Context) (*models.User, error) {
 	user, err := middleware.GetUserFromContext(ctx)
@@ -1216,6 +2225,9 @@ func (r *queryResolver) MyFiles(ctx context.Context, filter *model.FileFilterInp
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
 	log.Printf("DEBUG: MyFiles resolver called with filter: %+v", filter)
 
@@ -1261,6 +2273,9 @@ func (r *queryResolver) MyStarredFiles(ctx context.Context) ([]*models.UserFile,
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
 	log.Printf("DEBUG: MyStarredFiles called for user %d", user.ID)
 	files, err := r.Resolver.FileService.GetStarredFiles(user.ID)
@@ -1274,6 +2289,9 @@ func (r *queryResolver) MyStarredFolders(ctx context.Context) ([]*models.Folder,
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
 	log.Printf("DEBUG: MyStarredFolders called for user %d", user.ID)
 	folders, err := r.Resolver.FileService.GetStarredFolders(user.ID)
@@ -1287,6 +2305,9 @@ func (r *queryResolver) MyTrashedFiles(ctx context.Context) ([]*models.UserFile,
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
 	includeTrashed := true
 	filter := &services.FileFilter{
@@ -1307,86 +2328,263 @@ func (r *queryResolver) MyTrashedFiles(ctx context.Context) ([]*models.UserFile,
 		}
 	}
 
-	return trashedFiles, nil
+	return trashedFiles, nil
+}
+
+// MyTrashedFolders is the resolver for the myTrashedFolders field.
+func (r *queryResolver) MyTrashedFolders(ctx context.Context) ([]*models.Folder, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
+
+	log.Printf("DEBUG: MyTrashedFolders called for user %d", user.ID)
+
+	// Get all folders including deleted ones for this user
+	trashedFolders, err := r.Resolver.FileService.GetTrashedFolders(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("DEBUG: Found %d trashed folders", len(trashedFolders))
+	return trashedFolders, nil
+}
+
+// FileVersions is the resolver for the fileVersions field.
+func (r *queryResolver) FileVersions(ctx context.Context, userFileID string) ([]*models.FileVersion, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
+
+	fileID, err := strconv.ParseUint(userFileID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file ID: %w", err)
+	}
+
+	return r.Resolver.FileService.GetFileVersions(user.ID, uint(fileID))
+}
+
+// MyStats is the resolver for the myStats field.
+func (r *queryResolver) MyStats(ctx context.Context) (*model.UserStats, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
+
+	stats, err := r.Resolver.UserService.GetUserStats(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.UserStats{
+		TotalFiles:     stats.TotalFiles,
+		UsedStorage:    stats.UsedStorage,
+		StorageQuota:   stats.StorageQuota,
+		StorageSavings: stats.StorageSavings,
+	}, nil
+}
+
+// MySessions is the resolver for the mySessions field.
+func (r *queryResolver) MySessions(ctx context.Context) ([]*models.Session, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.Resolver.SessionService.ListSessions(user.ID, middleware.GetSessionIDFromContext(ctx))
+}
+
+// MyPersonalAccessTokens is the resolver for the myPersonalAccessTokens field.
+func (r *queryResolver) MyPersonalAccessTokens(ctx context.Context) ([]*models.PersonalAccessToken, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	return r.Resolver.PersonalAccessTokenService.ListTokens(user.ID)
+}
+
+// MyRecoveryStatus is the resolver for the myRecoveryStatus field.
+func (r *queryResolver) MyRecoveryStatus(ctx context.Context) (*model.RecoveryStatus, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireSessionAuth(ctx); err != nil {
+		return nil, err
+	}
+
+	status, err := r.Resolver.KeyRecoveryService.GetRecoveryStatus(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return toRecoveryStatus(status), nil
+}
+
+// Users is the resolver for the users field.
+func (r *queryResolver) Users(ctx context.Context, search *string) ([]*models.User, error) {
+	_, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeRoomsRead); err != nil {
+		return nil, err
+	}
+
+	searchTerm := ""
+	if search != nil {
+		searchTerm = *search
+	}
+
+	return r.Resolver.UserService.SearchUsers(searchTerm)
+}
+
+// MyKeyPair is the resolver for the myKeyPair field.
+func (r *queryResolver) MyKeyPair(ctx context.Context) (*models.UserKeyPair, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
+
+	return r.Resolver.UserKeyService.GetKeyPair(user.ID)
+}
+
+// PublicKeys is the resolver for the publicKeys field.
+func (r *queryResolver) PublicKeys(ctx context.Context, userIds []string) ([]*models.UserKeyPair, error) {
+	if _, err := middleware.GetUserFromContext(ctx); err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(userIds))
+	for _, userID := range userIds {
+		id, err := strconv.ParseUint(userID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID: %w", err)
+		}
+		ids = append(ids, uint(id))
+	}
+
+	return r.Resolver.UserKeyService.GetPublicKeys(ids)
 }
 
-// MyTrashedFolders is the resolver for the myTrashedFolders field.
-func (r *queryResolver) MyTrashedFolders(ctx context.Context) ([]*models.Folder, error) {
+// FileKeyGrants is the resolver for the fileKeyGrants field.
+func (r *queryResolver) FileKeyGrants(ctx context.Context, userFileID string) ([]*models.FileKeyGrant, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
-	log.Printf("DEBUG: MyTrashedFolders called for user %d", user.ID)
-
-	// Get all folders including deleted ones for this user
-	trashedFolders, err := r.Resolver.FileService.GetTrashedFolders(user.ID)
+	parsedUserFileID, err := strconv.ParseUint(userFileID, 10, 32)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid file ID: %w", err)
 	}
 
-	log.Printf("DEBUG: Found %d trashed folders", len(trashedFolders))
-	return trashedFolders, nil
+	return r.Resolver.UserKeyService.GetFileKeyGrants(user.ID, uint(parsedUserFileID))
 }
 
-// MyStats is the resolver for the myStats field.
-func (r *queryResolver) MyStats(ctx context.Context) (*model.UserStats, error) {
+// MyFileKeyGrants is the resolver for the myFileKeyGrants field.
+func (r *queryResolver) MyFileKeyGrants(ctx context.Context) ([]*models.FileKeyGrant, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
-	stats, err := r.Resolver.UserService.GetUserStats(user.ID)
+	return r.Resolver.UserKeyService.GetReceivedFileKeyGrants(user.ID)
+}
+
+// MyRooms is the resolver for the myRooms field.
+func (r *queryResolver) MyRooms(ctx context.Context) ([]*models.Room, error) {
+	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+	if err := middleware.RequireScope(ctx, services.ScopeRoomsRead); err != nil {
 		return nil, err
 	}
 
-	return &model.UserStats{
-		TotalFiles:     stats.TotalFiles,
-		UsedStorage:    stats.UsedStorage,
-		StorageQuota:   stats.StorageQuota,
-		StorageSavings: stats.StorageSavings,
-	}, nil
+	return r.Resolver.RoomService.GetUserRooms(user.ID)
 }
 
-// Users is the resolver for the users field.
-func (r *queryResolver) Users(ctx context.Context, search *string) ([]*models.User, error) {
-	_, err := middleware.GetUserFromContext(ctx)
+// Room is the resolver for the room field.
+func (r *queryResolver) Room(ctx context.Context, id string) (*models.Room, error) {
+	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeRoomsRead); err != nil {
+		return nil, err
+	}
 
-	searchTerm := ""
-	if search != nil {
-		searchTerm = *search
+	roomID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid room ID: %w", err)
 	}
 
-	return r.Resolver.UserService.SearchUsers(searchTerm)
+	return r.Resolver.RoomService.GetRoom(uint(roomID), user.ID)
 }
 
-// MyRooms is the resolver for the myRooms field.
-func (r *queryResolver) MyRooms(ctx context.Context) ([]*models.Room, error) {
+// MyRoomKeys is the resolver for the myRoomKeys field.
+func (r *queryResolver) MyRoomKeys(ctx context.Context, roomID string) ([]*models.RoomKey, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeRoomsRead); err != nil {
+		return nil, err
+	}
 
-	return r.Resolver.RoomService.GetUserRooms(user.ID)
+	rID, err := strconv.ParseUint(roomID, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid room ID: %w", err)
+	}
+
+	return r.Resolver.RoomKeyService.GetMemberKeys(user.ID, uint(rID))
 }
 
-// Room is the resolver for the room field.
-func (r *queryResolver) Room(ctx context.Context, id string) (*models.Room, error) {
+// RoomFileKeys is the resolver for the roomFileKeys field.
+func (r *queryResolver) RoomFileKeys(ctx context.Context, roomID string) ([]*models.RoomFile, error) {
 	user, err := middleware.GetUserFromContext(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeRoomsRead); err != nil {
+		return nil, err
+	}
 
-	roomID, err := strconv.ParseUint(id, 10, 32)
+	rID, err := strconv.ParseUint(roomID, 10, 32)
 	if err != nil {
 		return nil, fmt.Errorf("invalid room ID: %w", err)
 	}
 
-	return r.Resolver.RoomService.GetRoom(uint(roomID), user.ID)
+	return r.Resolver.RoomKeyService.GetRoomFileKeys(user.ID, uint(rID))
 }
 
 // MyFolders is the resolver for the myFolders field.
@@ -1395,6 +2593,9 @@ func (r *queryResolver) MyFolders(ctx context.Context) ([]*models.Folder, error)
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
 	return r.Resolver.FileService.GetUserFolders(user.ID)
 }
@@ -1405,6 +2606,9 @@ func (r *queryResolver) Folder(ctx context.Context, id string) (*models.Folder,
 	if err != nil {
 		return nil, fmt.Errorf("unauthenticated: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
 	folderID, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
@@ -1420,6 +2624,9 @@ func (r *queryResolver) MyShares(ctx context.Context) ([]*models.FileShare, erro
 	if err != nil {
 		return nil, fmt.Errorf("unauthorized: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeSharesManage); err != nil {
+		return nil, err
+	}
 
 	// Use ShareService to get user shares
 	shares, err := r.Resolver.ShareService.GetUserShares(user.ID)
@@ -1436,6 +2643,9 @@ func (r *queryResolver) SharedWithMe(ctx context.Context) ([]*model.SharedWithMe
 	if err != nil {
 		return nil, fmt.Errorf("unauthorized: %w", err)
 	}
+	if err := middleware.RequireScope(ctx, services.ScopeFilesRead); err != nil {
+		return nil, err
+	}
 
 	// Get shared files accessed by this user
 	sharedFiles, err := r.Resolver.ShareService.GetSharedWithMeFiles(user.ID)
@@ -1536,6 +2746,181 @@ func (r *queryResolver) AllFiles(ctx context.Context) ([]*models.UserFile, error
 	return r.Resolver.FileService.GetAllFiles()
 }
 
+// LastStorageGCReport is the resolver for the lastStorageGCReport field.
+func (r *queryResolver) LastStorageGCReport(ctx context.Context) (*model.StorageGCReport, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return toStorageGCReport(r.Resolver.StorageGCService.LastReport()), nil
+}
+
+// StorageIntegrityIssues is the resolver for the storageIntegrityIssues field.
+func (r *queryResolver) StorageIntegrityIssues(ctx context.Context, includeResolved *bool) ([]*models.StorageIntegrityIssue, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return r.Resolver.IntegrityScrubService.ListIssues(includeResolved != nil && *includeResolved)
+}
+
+// LastIntegrityScrubReport is the resolver for the lastIntegrityScrubReport field.
+func (r *queryResolver) LastIntegrityScrubReport(ctx context.Context) (*model.IntegrityScrubReport, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return toIntegrityScrubReport(r.Resolver.IntegrityScrubService.LastReport()), nil
+}
+
+// LastReencryptionReport is the resolver for the lastReencryptionReport field.
+func (r *queryResolver) LastReencryptionReport(ctx context.Context) (*model.ReencryptionReport, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return toReencryptionReport(r.Resolver.ReencryptionService.LastReport()), nil
+}
+
+// SharePasswordKeyStatus is the resolver for the sharePasswordKeyStatus field.
+func (r *queryResolver) SharePasswordKeyStatus(ctx context.Context) (*model.SharePasswordKeyStatus, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	status, err := r.Resolver.ReencryptionService.SharePasswordKeyStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return toSharePasswordKeyStatus(status), nil
+}
+
+// LoginLockouts is the resolver for the loginLockouts field.
+func (r *queryResolver) LoginLockouts(ctx context.Context) ([]*models.LoginThrottle, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return r.Resolver.LoginThrottleService.ListLockouts()
+}
+
+// LoginAuditEvents is the resolver for the loginAuditEvents field.
+func (r *queryResolver) LoginAuditEvents(ctx context.Context, limit *int) ([]*models.LoginAuditEvent, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	n := 0
+	if limit != nil {
+		n = *limit
+	}
+	return r.Resolver.LoginThrottleService.ListAuditEvents(n)
+}
+
+// SigningKeys is the resolver for the signingKeys field.
+func (r *queryResolver) SigningKeys(ctx context.Context) ([]*models.SigningKey, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+	if r.Resolver.SigningKeyService == nil {
+		return []*models.SigningKey{}, nil
+	}
+
+	return r.Resolver.SigningKeyService.ListKeys()
+}
+
+// KeyRotationCampaigns is the resolver for the keyRotationCampaigns field.
+func (r *queryResolver) KeyRotationCampaigns(ctx context.Context) ([]*models.KeyRotationCampaign, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return r.Resolver.KeyRotationCampaignService.ListCampaigns()
+}
+
+// KeyRotationCampaign is the resolver for the keyRotationCampaign field.
+func (r *queryResolver) KeyRotationCampaign(ctx context.Context, campaignID string) (*models.KeyRotationCampaign, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	return r.Resolver.KeyRotationCampaignService.GetCampaign(campaignID)
+}
+
+// KeyRotationCampaignUsers is the resolver for the keyRotationCampaignUsers field.
+func (r *queryResolver) KeyRotationCampaignUsers(ctx context.Context, campaignID string, status *model.KeyRotationStatus) ([]*model.KeyRotationCampaignUser, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	var rotationStatus *services.KeyRotationStatus
+	if status != nil {
+		s := services.KeyRotationStatus(*status)
+		rotationStatus = &s
+	}
+
+	users, err := r.Resolver.KeyRotationCampaignService.CampaignUsers(campaignID, rotationStatus)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*model.KeyRotationCampaignUser, len(users))
+	for i, user := range users {
+		result[i] = toKeyRotationCampaignUser(user)
+	}
+	return result, nil
+}
+
+// KeyRecoveryRequests is the resolver for the keyRecoveryRequests field.
+func (r *queryResolver) KeyRecoveryRequests(ctx context.Context, status *string) ([]*models.KeyRecoveryRequest, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	filter := ""
+	if status != nil {
+		filter = *status
+	}
+	return r.Resolver.KeyRecoveryService.ListRecoveryRequests(filter)
+}
+
+// KeyRecoveryAuditEvents is the resolver for the keyRecoveryAuditEvents field.
+func (r *queryResolver) KeyRecoveryAuditEvents(ctx context.Context, userID *string, limit *int) ([]*models.KeyRecoveryAuditEvent, error) {
+	_, err := middleware.RequireAdmin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("admin access required: %w", err)
+	}
+
+	var uID *uint
+	if userID != nil {
+		parsed, err := strconv.ParseUint(*userID, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID: %w", err)
+		}
+		id := uint(parsed)
+		uID = &id
+	}
+
+	n := 0
+	if limit != nil {
+		n = *limit
+	}
+	return r.Resolver.KeyRecoveryService.ListAuditEvents(uID, n)
+}
+
 // Health is the resolver for the health field.
 func (r *queryResolver) Health(ctx context.Context) (string, error) {
 	return "OK", nil
@@ -1573,6 +2958,26 @@ func (r *roomResolver) Folders(ctx context.Context, obj *models.Room) ([]*models
 	return folders, nil
 }
 
+// RoomID is the resolver for the room_id field.
+func (r *roomFileResolver) RoomID(ctx context.Context, obj *models.RoomFile) (string, error) {
+	return fmt.Sprintf("%d", obj.RoomID), nil
+}
+
+// UserFileID is the resolver for the user_file_id field.
+func (r *roomFileResolver) UserFileID(ctx context.Context, obj *models.RoomFile) (string, error) {
+	return fmt.Sprintf("%d", obj.UserFileID), nil
+}
+
+// RoomID is the resolver for the room_id field.
+func (r *roomKeyResolver) RoomID(ctx context.Context, obj *models.RoomKey) (string, error) {
+	return fmt.Sprintf("%d", obj.RoomID), nil
+}
+
+// UserID is the resolver for the user_id field.
+func (r *roomKeyResolver) UserID(ctx context.Context, obj *models.RoomKey) (string, error) {
+	return fmt.Sprintf("%d", obj.UserID), nil
+}
+
 // ID is the resolver for the id field.
 func (r *roomMemberResolver) ID(ctx context.Context, obj *models.RoomMember) (string, error) {
 	return fmt.Sprintf("%d", obj.ID), nil
@@ -1588,6 +2993,11 @@ func (r *roomMemberResolver) UserID(ctx context.Context, obj *models.RoomMember)
 	return fmt.Sprintf("%d", obj.UserID), nil
 }
 
+// ID is the resolver for the id field.
+func (r *sessionResolver) ID(ctx context.Context, obj *models.Session) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
 // ID is the resolver for the id field.
 func (r *sharedFileAccessResolver) ID(ctx context.Context, obj *models.SharedFileAccess) (string, error) {
 	panic(fmt.Errorf("not implemented: ID - id"))
@@ -1603,6 +3013,16 @@ func (r *sharedFileAccessResolver) FileShareID(ctx context.Context, obj *models.
 	panic(fmt.Errorf("not implemented: FileShareID - file_share_id"))
 }
 
+// ID is the resolver for the id field.
+func (r *storageIntegrityIssueResolver) ID(ctx context.Context, obj *models.StorageIntegrityIssue) (string, error) {
+	return fmt.Sprintf("%d", obj.ID), nil
+}
+
+// FileID is the resolver for the file_id field.
+func (r *storageIntegrityIssueResolver) FileID(ctx context.Context, obj *models.StorageIntegrityIssue) (string, error) {
+	return fmt.Sprintf("%d", obj.FileID), nil
+}
+
 // ID is the resolver for the id field.
 func (r *userResolver) ID(ctx context.Context, obj *models.User) (string, error) {
 	return fmt.Sprintf("%d", obj.ID), nil
@@ -1635,6 +3055,11 @@ func (r *userFileResolver) EncryptionKey(ctx context.Context, obj *models.UserFi
 		return obj.EncryptionKey, nil
 	}
 
+	// Other users get the key through a key grant unless legacy file keys are allowed
+	if r.Resolver.UserKeyService.RequireGrants() {
+		return "", fmt.Errorf("access denied: use the file key granted to you")
+	}
+
 	// Check if the file is shared to any room that the user is a member of
 	db := r.Resolver.DB.GetDB()
 	var count int64
@@ -1664,45 +3089,138 @@ func (r *userFileResolver) FolderID(ctx context.Context, obj *models.UserFile) (
 	return &folderID, nil
 }
 
+// KeyGrant is the resolver for the key_grant field.
+func (r *userFileResolver) KeyGrant(ctx context.Context, obj *models.UserFile) (*models.FileKeyGrant, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+
+	return r.Resolver.UserKeyService.GetFileKeyGrant(user.ID, obj.ID)
+}
+
+// UserID is the resolver for the user_id field.
+func (r *userKeyPairResolver) UserID(ctx context.Context, obj *models.UserKeyPair) (string, error) {
+	return fmt.Sprintf("%d", obj.UserID), nil
+}
+
+// WrappedPrivateKey is the resolver for the wrapped_private_key field.
+func (r *userKeyPairResolver) WrappedPrivateKey(ctx context.Context, obj *models.UserKeyPair) (*string, error) {
+	user, err := middleware.GetUserFromContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unauthenticated: %w", err)
+	}
+
+	// Other users only need the public key
+	if user.ID != obj.UserID {
+		return nil, nil
+	}
+	return &obj.WrappedPrivateKey, nil
+}
+
 // File returns generated.FileResolver implementation.
 func (r *Resolver) File() generated.FileResolver { return &fileResolver{r} }
 
+// FileKeyGrant returns generated.FileKeyGrantResolver implementation.
+func (r *Resolver) FileKeyGrant() generated.FileKeyGrantResolver { return &fileKeyGrantResolver{r} }
+
 // FileShare returns generated.FileShareResolver implementation.
 func (r *Resolver) FileShare() generated.FileShareResolver { return &fileShareResolver{r} }
 
+// FileVersion returns generated.FileVersionResolver implementation.
+func (r *Resolver) FileVersion() generated.FileVersionResolver { return &fileVersionResolver{r} }
+
 // Folder returns generated.FolderResolver implementation.
 func (r *Resolver) Folder() generated.FolderResolver { return &folderResolver{r} }
 
+// KeyRecoveryAuditEvent returns generated.KeyRecoveryAuditEventResolver implementation.
+func (r *Resolver) KeyRecoveryAuditEvent() generated.KeyRecoveryAuditEventResolver {
+	return &keyRecoveryAuditEventResolver{r}
+}
+
+// KeyRecoveryRequest returns generated.KeyRecoveryRequestResolver implementation.
+func (r *Resolver) KeyRecoveryRequest() generated.KeyRecoveryRequestResolver {
+	return &keyRecoveryRequestResolver{r}
+}
+
+// KeyRotationCampaign returns generated.KeyRotationCampaignResolver implementation.
+func (r *Resolver) KeyRotationCampaign() generated.KeyRotationCampaignResolver {
+	return &keyRotationCampaignResolver{r}
+}
+
+// LoginAuditEvent returns generated.LoginAuditEventResolver implementation.
+func (r *Resolver) LoginAuditEvent() generated.LoginAuditEventResolver {
+	return &loginAuditEventResolver{r}
+}
+
+// LoginThrottle returns generated.LoginThrottleResolver implementation.
+func (r *Resolver) LoginThrottle() generated.LoginThrottleResolver { return &loginThrottleResolver{r} }
+
 // Mutation returns generated.MutationResolver implementation.
 func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
 
+// PersonalAccessToken returns generated.PersonalAccessTokenResolver implementation.
+func (r *Resolver) PersonalAccessToken() generated.PersonalAccessTokenResolver {
+	return &personalAccessTokenResolver{r}
+}
+
 // Query returns generated.QueryResolver implementation.
 func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 
 // Room returns generated.RoomResolver implementation.
 func (r *Resolver) Room() generated.RoomResolver { return &roomResolver{r} }
 
+// RoomFile returns generated.RoomFileResolver implementation.
+func (r *Resolver) RoomFile() generated.RoomFileResolver { return &roomFileResolver{r} }
+
+// RoomKey returns generated.RoomKeyResolver implementation.
+func (r *Resolver) RoomKey() generated.RoomKeyResolver { return &roomKeyResolver{r} }
+
 // RoomMember returns generated.RoomMemberResolver implementation.
 func (r *Resolver) RoomMember() generated.RoomMemberResolver { return &roomMemberResolver{r} }
 
+// Session returns generated.SessionResolver implementation.
+func (r *Resolver) Session() generated.SessionResolver { return &sessionResolver{r} }
+
 // SharedFileAccess returns generated.SharedFileAccessResolver implementation.
 func (r *Resolver) SharedFileAccess() generated.SharedFileAccessResolver {
 	return &sharedFileAccessResolver{r}
 }
 
+// StorageIntegrityIssue returns generated.StorageIntegrityIssueResolver implementation.
+func (r *Resolver) StorageIntegrityIssue() generated.StorageIntegrityIssueResolver {
+	return &storageIntegrityIssueResolver{r}
+}
+
 // User returns generated.UserResolver implementation.
 func (r *Resolver) User() generated.UserResolver { return &userResolver{r} }
 
 // UserFile returns generated.UserFileResolver implementation.
 func (r *Resolver) UserFile() generated.UserFileResolver { return &userFileResolver{r} }
 
+// UserKeyPair returns generated.UserKeyPairResolver implementation.
+func (r *Resolver) UserKeyPair() generated.UserKeyPairResolver { return &userKeyPairResolver{r} }
+
 type fileResolver struct{ *Resolver }
+type fileKeyGrantResolver struct{ *Resolver }
 type fileShareResolver struct{ *Resolver }
+type fileVersionResolver struct{ *Resolver }
 type folderResolver struct{ *Resolver }
+type keyRecoveryAuditEventResolver struct{ *Resolver }
+type keyRecoveryRequestResolver struct{ *Resolver }
+type keyRotationCampaignResolver struct{ *Resolver }
+type loginAuditEventResolver struct{ *Resolver }
+type loginThrottleResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
+type personalAccessTokenResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
 type roomResolver struct{ *Resolver }
+type roomFileResolver struct{ *Resolver }
+type roomKeyResolver struct{ *Resolver }
 type roomMemberResolver struct{ *Resolver }
+type sessionResolver struct{ *Resolver }
 type sharedFileAccessResolver struct{ *Resolver }
+type storageIntegrityIssueResolver struct{ *Resolver }
 type userResolver struct{ *Resolver }
 type userFileResolver struct{ *Resolver }
+type userKeyPairResolver struct{ *Resolver }
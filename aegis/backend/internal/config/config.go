@@ -17,6 +17,10 @@ type ShareEndpoints struct {
 	Access string
 }
 
+type UploadsEndpoints struct {
+	Base string
+}
+
 type SharedEndpoints struct {
 	Base string
 }
@@ -32,6 +36,7 @@ type GraphQLEndpoints struct {
 type APIEndpoints struct {
 	Base    string
 	Files   FilesEndpoints
+	Uploads UploadsEndpoints
 	Share   ShareEndpoints
 	Shared  SharedEndpoints
 	Health  HealthEndpoints
@@ -44,38 +49,147 @@ type Config struct {
 	MinIOAccessKey             string
 	MinIOSecretKey             string
 	MinIOBucket                string
+	StorageBackend             string
+	StorageLocalPath           string
 	JWTSecret                  string
+	AccessTokenTTLMinutes      int
+	RefreshTokenTTLHours       int
+	JWTSigningAlgorithm        string
+	JWTKeyRotationHours        int
+	JWTKeyGraceHours           int
+	DownloadTicketTTLSeconds   int
+	DownloadTicketSingleUse    bool
+	AllowLegacyFileKeys        bool
+	KeyProvider                string
+	KeystorePath               string
+	VaultAddr                  string
+	VaultToken                 string
+	VaultTransitMount          string
+	VaultTransitKey            string
+	AWSKMSKeyID                string
+	AWSKMSEndpoint             string
+	AWSRegion                  string
+	AWSAccessKeyID             string
+	AWSSecretAccessKey         string
+	AWSSessionToken            string
 	Port                       string
 	GinMode                    string
 	CORSAllowedOrigins         string
+	TrustedProxies             string
 	BaseURL                    string
 	RateLimitRequestsPerSecond float64
 	RateLimitBurst             int
+	UploadSessionTTLHours      int
+	UploadMaxChunkBytes        int64
+	UploadCleanupIntervalMins  int
+	StorageGCIntervalHours     int
+	StorageGCGraceHours        int
+	StorageGCDryRun            bool
+	StorageScrubIntervalHours  int
+	ReencryptIntervalHours     int
+	OIDCIssuerURL              string
+	OIDCClientID               string
+	OIDCClientSecret           string
+	OIDCRedirectURL            string
+	OIDCScopes                 string
+	OIDCGroupsClaim            string
+	OIDCAdminGroups            string
+	PasswordSignupDisabled     bool
+	FrontendURL                string
+	MailBackend                string
+	SMTPHost                   string
+	SMTPPort                   int
+	SMTPUsername               string
+	SMTPPassword               string
+	MailFrom                   string
+	LoginMaxFailures           int
+	LoginIPMaxFailures         int
+	LoginFailureWindowMins     int
+	LoginLockoutMinutes        int
+	LoginDelayBaseSeconds      int
 	APIEndpoints               APIEndpoints
 }
 
 func Load() *Config {
 	log.Println("DEBUG: Loading configuration...")
 
+	// MinIO credentials are only needed when objects are stored in MinIO
+	storageBackend := getEnv("STORAGE_BACKEND", "minio")
+	minioRequired := storageBackend == "minio"
+
 	config := &Config{
 		DatabaseURL:                getEnvRequired("DATABASE_URL"),
 		MinIOEndpoint:              getEnv("MINIO_ENDPOINT", "localhost:9000"),
-		MinIOAccessKey:             getEnvRequired("MINIO_ACCESS_KEY"),
-		MinIOSecretKey:             getEnvRequired("MINIO_SECRET_KEY"),
+		MinIOAccessKey:             getEnvRequiredIf("MINIO_ACCESS_KEY", minioRequired),
+		MinIOSecretKey:             getEnvRequiredIf("MINIO_SECRET_KEY", minioRequired),
 		MinIOBucket:                getEnv("MINIO_BUCKET", "aegis-files"),
+		StorageBackend:             storageBackend,
+		StorageLocalPath:           getEnv("STORAGE_LOCAL_PATH", "./data/objects"),
 		JWTSecret:                  getEnvRequired("JWT_SECRET"),
+		AccessTokenTTLMinutes:      getEnvInt("ACCESS_TOKEN_TTL_MINUTES", 15),
+		RefreshTokenTTLHours:       getEnvInt("REFRESH_TOKEN_TTL_HOURS", 720),
+		JWTSigningAlgorithm:        getEnv("JWT_SIGNING_ALGORITHM", "EdDSA"),
+		JWTKeyRotationHours:        getEnvInt("JWT_KEY_ROTATION_HOURS", 720),
+		JWTKeyGraceHours:           getEnvInt("JWT_KEY_GRACE_HOURS", 24),
+		DownloadTicketTTLSeconds:   getEnvInt("DOWNLOAD_TICKET_TTL_SECONDS", 300),
+		DownloadTicketSingleUse:    getEnvBool("DOWNLOAD_TICKET_SINGLE_USE", false),
+		AllowLegacyFileKeys:        getEnvBool("ALLOW_LEGACY_FILE_KEYS", false),
+		KeyProvider:                getEnv("KEY_PROVIDER", "local"),
+		KeystorePath:               getEnv("KEYSTORE_PATH", "./data/keystore.json"),
+		VaultAddr:                  getEnv("VAULT_ADDR", ""),
+		VaultToken:                 getEnv("VAULT_TOKEN", ""),
+		VaultTransitMount:          getEnv("VAULT_TRANSIT_MOUNT", "transit"),
+		VaultTransitKey:            getEnv("VAULT_TRANSIT_KEY", "aegis"),
+		AWSKMSKeyID:                getEnv("AWS_KMS_KEY_ID", ""),
+		AWSKMSEndpoint:             getEnv("AWS_KMS_ENDPOINT", ""),
+		AWSRegion:                  getEnv("AWS_REGION", ""),
+		AWSAccessKeyID:             getEnv("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey:         getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		AWSSessionToken:            getEnv("AWS_SESSION_TOKEN", ""),
 		Port:                       getEnv("PORT", "8080"),
 		GinMode:                    getEnv("GIN_MODE", "debug"),
 		CORSAllowedOrigins:         getEnv("CORS_ALLOWED_ORIGINS", "http://localhost:3000"),
+		TrustedProxies:             getEnv("TRUSTED_PROXIES", ""),
 		BaseURL:                    getEnv("BASE_URL", "http://localhost:8080"),
 		RateLimitRequestsPerSecond: getEnvFloat("RATE_LIMIT_REQUESTS_PER_SECOND", 10.0),
 		RateLimitBurst:             getEnvInt("RATE_LIMIT_BURST", 20),
+		UploadSessionTTLHours:      getEnvInt("UPLOAD_SESSION_TTL_HOURS", 24),
+		UploadMaxChunkBytes:        int64(getEnvInt("UPLOAD_MAX_CHUNK_BYTES", 64*1024*1024)),
+		UploadCleanupIntervalMins:  getEnvInt("UPLOAD_CLEANUP_INTERVAL_MINUTES", 15),
+		StorageGCIntervalHours:     getEnvInt("STORAGE_GC_INTERVAL_HOURS", 24),
+		StorageGCGraceHours:        getEnvInt("STORAGE_GC_GRACE_HOURS", 24),
+		StorageGCDryRun:            getEnvBool("STORAGE_GC_DRY_RUN", false),
+		StorageScrubIntervalHours:  getEnvInt("STORAGE_SCRUB_INTERVAL_HOURS", 168),
+		ReencryptIntervalHours:     getEnvInt("REENCRYPT_INTERVAL_HOURS", 24),
+		OIDCIssuerURL:              getEnv("OIDC_ISSUER_URL", ""),
+		OIDCClientID:               getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:           getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:            getEnv("OIDC_REDIRECT_URL", "http://localhost:3000/auth/callback"),
+		OIDCScopes:                 getEnv("OIDC_SCOPES", "openid email profile"),
+		OIDCGroupsClaim:            getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		OIDCAdminGroups:            getEnv("OIDC_ADMIN_GROUPS", ""),
+		PasswordSignupDisabled:     getEnvBool("PASSWORD_SIGNUP_DISABLED", false),
+		FrontendURL:                getEnv("FRONTEND_URL", "http://localhost:3000"),
+		MailBackend:                getEnv("MAIL_BACKEND", "log"),
+		SMTPHost:                   getEnv("SMTP_HOST", ""),
+		SMTPPort:                   getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:               getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:               getEnv("SMTP_PASSWORD", ""),
+		MailFrom:                   getEnv("MAIL_FROM", "Aegis <no-reply@localhost>"),
+		LoginMaxFailures:           getEnvInt("LOGIN_MAX_FAILURES", 5),
+		LoginIPMaxFailures:         getEnvInt("LOGIN_IP_MAX_FAILURES", 50),
+		LoginFailureWindowMins:     getEnvInt("LOGIN_FAILURE_WINDOW_MINUTES", 15),
+		LoginLockoutMinutes:        getEnvInt("LOGIN_LOCKOUT_MINUTES", 15),
+		LoginDelayBaseSeconds:      getEnvInt("LOGIN_DELAY_BASE_SECONDS", 1),
 		APIEndpoints: APIEndpoints{
 			Base: "/v1/api",
 			Files: FilesEndpoints{
 				Base:     "/v1/api/files",
 				Download: "/v1/api/files/:id/download",
 			},
+			Uploads: UploadsEndpoints{
+				Base: "/v1/api/uploads",
+			},
 			Share: ShareEndpoints{
 				Base:   "/v1/share",
 				Access: "/v1/share/:token/access",
@@ -94,6 +208,7 @@ func Load() *Config {
 
 	log.Printf("DEBUG: Configuration loaded - Port: %s, CORS Origins: %s, BaseURL: %s", config.Port, config.CORSAllowedOrigins, config.BaseURL)
 	log.Printf("DEBUG: JWT Secret length: %d characters", len(config.JWTSecret))
+	log.Printf("DEBUG: Storage backend: %s", config.StorageBackend)
 	log.Printf("DEBUG: MinIO config - Endpoint: %s, Bucket: %s, AccessKey set: %t, SecretKey set: %t", 
 		config.MinIOEndpoint, config.MinIOBucket, config.MinIOAccessKey != "", config.MinIOSecretKey != "")
 
@@ -118,6 +233,13 @@ func getEnvRequired(key string) string {
 	return value
 }
 
+func getEnvRequiredIf(key string, required bool) string {
+	if required {
+		return getEnvRequired(key)
+	}
+	return os.Getenv(key)
+}
+
 func getEnvFloat(key string, defaultValue float64) float64 {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
@@ -138,6 +260,16 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+		log.Printf("WARNING: Invalid bool value for %s: %s, using default %t", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
 func validateSecureConfig(config *Config) {
 	// Check for known insecure defaults
 	insecureDefaults := map[string]string{
@@ -174,6 +306,87 @@ func validateConfigValues(config *Config) {
 		log.Fatalf("SECURITY ERROR: JWT_SECRET must be at least 32 characters long for security")
 	}
 
+	// Validate access token signing. HS256 signs with JWT_SECRET itself, the asymmetric
+	// algorithms use rotating keys published at /.well-known/jwks.json.
+	switch config.JWTSigningAlgorithm {
+	case "EdDSA", "RS256":
+		if config.JWTKeyRotationHours < 0 {
+			log.Fatalf("CONFIG ERROR: JWT_KEY_ROTATION_HOURS must not be negative")
+		}
+		if config.JWTKeyGraceHours*60 < config.AccessTokenTTLMinutes {
+			log.Fatalf("CONFIG ERROR: JWT_KEY_GRACE_HOURS must cover ACCESS_TOKEN_TTL_MINUTES, or rotating keys would reject unexpired tokens")
+		}
+	case "HS256":
+		log.Printf("WARNING: JWT_SIGNING_ALGORITHM is HS256, tokens cannot be verified without JWT_SECRET and rotating it signs everyone out")
+	default:
+		log.Fatalf("CONFIG ERROR: JWT_SIGNING_ALGORITHM must be one of EdDSA, RS256 or HS256, got '%s'", config.JWTSigningAlgorithm)
+	}
+
+	// Validate download ticket lifetime, where zero uses the default
+	if config.DownloadTicketTTLSeconds < 0 || config.DownloadTicketTTLSeconds > 86400 {
+		log.Fatalf("CONFIG ERROR: DOWNLOAD_TICKET_TTL_SECONDS must be between 0 and 86400")
+	}
+
+	// Validate the key provider that wraps envelope keys and service keys
+	switch config.KeyProvider {
+	case "local":
+		if config.KeystorePath == "" {
+			log.Fatalf("CONFIG ERROR: KEYSTORE_PATH is required when KEY_PROVIDER is local")
+		}
+	case "vault":
+		if config.VaultAddr == "" || config.VaultToken == "" || config.VaultTransitKey == "" {
+			log.Fatalf("CONFIG ERROR: VAULT_ADDR, VAULT_TOKEN and VAULT_TRANSIT_KEY are required when KEY_PROVIDER is vault")
+		}
+	case "awskms":
+		if config.AWSKMSKeyID == "" || config.AWSRegion == "" || config.AWSAccessKeyID == "" || config.AWSSecretAccessKey == "" {
+			log.Fatalf("CONFIG ERROR: AWS_KMS_KEY_ID, AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required when KEY_PROVIDER is awskms")
+		}
+	default:
+		log.Fatalf("CONFIG ERROR: KEY_PROVIDER must be one of local, vault or awskms, got '%s'", config.KeyProvider)
+	}
+
+	// Validate storage backend selection
+	switch config.StorageBackend {
+	case "minio", "local", "memory":
+	default:
+		log.Fatalf("CONFIG ERROR: STORAGE_BACKEND must be one of minio, local or memory, got '%s'", config.StorageBackend)
+	}
+
+	// Validate outbound mail selection
+	switch config.MailBackend {
+	case "smtp":
+		if config.SMTPHost == "" {
+			log.Fatalf("CONFIG ERROR: SMTP_HOST is required when MAIL_BACKEND is smtp")
+		}
+	case "log", "memory":
+	default:
+		log.Fatalf("CONFIG ERROR: MAIL_BACKEND must be one of smtp, log or memory, got '%s'", config.MailBackend)
+	}
+
+	// Validate login throttling, where zero turns a limit off
+	if config.LoginMaxFailures < 0 || config.LoginIPMaxFailures < 0 || config.LoginDelayBaseSeconds < 0 {
+		log.Fatalf("CONFIG ERROR: LOGIN_MAX_FAILURES, LOGIN_IP_MAX_FAILURES and LOGIN_DELAY_BASE_SECONDS must not be negative")
+	}
+	if (config.LoginMaxFailures > 0 || config.LoginIPMaxFailures > 0) && (config.LoginFailureWindowMins <= 0 || config.LoginLockoutMinutes <= 0) {
+		log.Fatalf("CONFIG ERROR: LOGIN_FAILURE_WINDOW_MINUTES and LOGIN_LOCKOUT_MINUTES must be positive when login lockouts are enabled")
+	}
+	if config.LoginMaxFailures == 0 {
+		log.Printf("WARNING: LOGIN_MAX_FAILURES is 0, accounts are never locked after failed logins")
+	}
+
+	// Validate single sign-on settings
+	if config.OIDCIssuerURL != "" {
+		if config.OIDCClientID == "" {
+			log.Fatalf("CONFIG ERROR: OIDC_CLIENT_ID is required when OIDC_ISSUER_URL is set")
+		}
+		if !strings.HasPrefix(config.OIDCIssuerURL, "https://") && !strings.HasPrefix(config.OIDCIssuerURL, "http://localhost") {
+			log.Printf("WARNING: OIDC issuer '%s' does not use https", config.OIDCIssuerURL)
+		}
+	}
+	if config.PasswordSignupDisabled && config.OIDCIssuerURL == "" {
+		log.Printf("WARNING: PASSWORD_SIGNUP_DISABLED is set and single sign-on is not configured, so no new accounts can be created")
+	}
+
 	// Validate MinIO endpoint format
 	if config.MinIOEndpoint != "" && !strings.Contains(config.MinIOEndpoint, ":") {
 		log.Printf("WARNING: MinIO endpoint '%s' does not contain a port number", config.MinIOEndpoint)
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 )
 
 // CryptoConfig holds configuration for all cryptographic operations
@@ -14,6 +15,12 @@ type CryptoConfig struct {
 	KeyLength        int
 	SaltLength       int
 	
+	// Password-based key derivation for envelope keys and share passwords
+	KDFAlgorithm    string // "argon2id" or "pbkdf2-sha256"
+	Argon2Time      uint32
+	Argon2MemoryKiB uint32
+	Argon2Threads   uint8
+	
 	// AES-GCM configuration
 	AESGCMIVLength int
 	
@@ -24,23 +31,40 @@ type CryptoConfig struct {
 	// Service-wide keys (loaded from environment or generated)
 	SharePasswordKey []byte
 	
+	// Organization key escrow, disabled when empty
+	KeyEscrowPublicKey string // Base64 X25519 public key envelope keys are additionally sealed to
+	
 	// Encryption algorithms
 	FileEncryptionAlgorithm string // "nacl-secretbox" or "aes-gcm"
-	KeyEncryptionAlgorithm  string // "aes-gcm" for envelope encryption
+	KeyEncryptionAlgorithm  string // "xchacha20-poly1305" or "aes-gcm" for envelope encryption
+	
+	// Algorithms whose ciphertexts the re-encryption job migrates away from
+	DeprecatedAlgorithms []string
 }
 
+// Ciphers of the ciphertext format. Browsers can decrypt files in the first two, so only
+// those are accepted as the file encryption algorithm.
+var (
+	fileEncryptionAlgorithms = []string{"nacl-secretbox", "aes-gcm"}
+	knownAlgorithms          = []string{"nacl-secretbox", "aes-gcm", "xchacha20-poly1305"}
+)
+
 // DefaultCryptoConfig returns the default crypto configuration
 func DefaultCryptoConfig() *CryptoConfig {
 	return &CryptoConfig{
 		PBKDF2Iterations:        100000,
 		KeyLength:               32, // 256 bits
 		SaltLength:              16, // 128 bits
+		KDFAlgorithm:            "argon2id",
+		Argon2Time:              3,
+		Argon2MemoryKiB:         65536, // 64 MiB
+		Argon2Threads:           4,
 		AESGCMIVLength:          12, // 96 bits for AES-GCM
 		SecretboxKeyLength:      32, // NaCl secretbox key length
 		SecretboxNonceLength:    24, // NaCl secretbox nonce length
 		SharePasswordKey:        nil, // Will be loaded/generated
 		FileEncryptionAlgorithm: "nacl-secretbox",
-		KeyEncryptionAlgorithm:  "aes-gcm",
+		KeyEncryptionAlgorithm:  "xchacha20-poly1305",
 	}
 }
 
@@ -55,6 +79,26 @@ func LoadCryptoConfigFromEnv() *CryptoConfig {
 		}
 	}
 	
+	// Load password KDF and Argon2id parameters from environment
+	if kdf := os.Getenv("AEGIS_KDF_ALGORITHM"); kdf != "" {
+		config.KDFAlgorithm = kdf
+	}
+	if time := os.Getenv("AEGIS_ARGON2_TIME"); time != "" {
+		if parsed, err := strconv.ParseUint(time, 10, 32); err == nil && parsed > 0 {
+			config.Argon2Time = uint32(parsed)
+		}
+	}
+	if memory := os.Getenv("AEGIS_ARGON2_MEMORY_KIB"); memory != "" {
+		if parsed, err := strconv.ParseUint(memory, 10, 32); err == nil && parsed > 0 {
+			config.Argon2MemoryKiB = uint32(parsed)
+		}
+	}
+	if threads := os.Getenv("AEGIS_ARGON2_THREADS"); threads != "" {
+		if parsed, err := strconv.ParseUint(threads, 10, 8); err == nil && parsed > 0 {
+			config.Argon2Threads = uint8(parsed)
+		}
+	}
+	
 	// Load key length from environment
 	if keyLen := os.Getenv("AEGIS_KEY_LENGTH"); keyLen != "" {
 		if parsed, err := strconv.Atoi(keyLen); err == nil && parsed > 0 {
@@ -69,6 +113,11 @@ func LoadCryptoConfigFromEnv() *CryptoConfig {
 		}
 	}
 	
+	// Load the organization escrow public key (base64 encoded)
+	if escrowKey := os.Getenv("AEGIS_KEY_ESCROW_PUBLIC_KEY"); escrowKey != "" {
+		config.KeyEscrowPublicKey = strings.TrimSpace(escrowKey)
+	}
+	
 	// Load file encryption algorithm preference
 	if algo := os.Getenv("AEGIS_FILE_ENCRYPTION_ALGORITHM"); algo != "" {
 		if algo == "nacl-secretbox" || algo == "aes-gcm" {
@@ -76,6 +125,20 @@ func LoadCryptoConfigFromEnv() *CryptoConfig {
 		}
 	}
 	
+	// Load key encryption algorithm preference
+	if algo := os.Getenv("AEGIS_KEY_ENCRYPTION_ALGORITHM"); algo != "" {
+		config.KeyEncryptionAlgorithm = algo
+	}
+	
+	// Load algorithms to migrate away from
+	if deprecated := os.Getenv("AEGIS_DEPRECATED_ALGORITHMS"); deprecated != "" {
+		for _, algo := range strings.Split(deprecated, ",") {
+			if algo = strings.TrimSpace(algo); algo != "" {
+				config.DeprecatedAlgorithms = append(config.DeprecatedAlgorithms, algo)
+			}
+		}
+	}
+	
 	return config
 }
 
@@ -85,6 +148,22 @@ func ValidateCryptoConfig(config *CryptoConfig) error {
 		return fmt.Errorf("PBKDF2 iterations too low: %d (minimum 10000)", config.PBKDF2Iterations)
 	}
 	
+	switch config.KDFAlgorithm {
+	case "argon2id":
+		if config.Argon2Time < 1 {
+			return fmt.Errorf("Argon2id time too low: %d (minimum 1)", config.Argon2Time)
+		}
+		if config.Argon2MemoryKiB < 8192 {
+			return fmt.Errorf("Argon2id memory too low: %d KiB (minimum 8192)", config.Argon2MemoryKiB)
+		}
+		if config.Argon2Threads < 1 {
+			return fmt.Errorf("Argon2id threads too low: %d (minimum 1)", config.Argon2Threads)
+		}
+	case "pbkdf2-sha256":
+	default:
+		return fmt.Errorf("unsupported key derivation function: %s", config.KDFAlgorithm)
+	}
+	
 	if config.KeyLength < 16 {
 		return fmt.Errorf("key length too short: %d (minimum 16)", config.KeyLength)
 	}
@@ -93,26 +172,77 @@ func ValidateCryptoConfig(config *CryptoConfig) error {
 		return fmt.Errorf("salt length too short: %d (minimum 8)", config.SaltLength)
 	}
 	
-	if config.FileEncryptionAlgorithm != "nacl-secretbox" && config.FileEncryptionAlgorithm != "aes-gcm" {
+	if !containsAlgorithm(fileEncryptionAlgorithms, config.FileEncryptionAlgorithm) {
 		return fmt.Errorf("unsupported file encryption algorithm: %s", config.FileEncryptionAlgorithm)
 	}
 	
-	if config.KeyEncryptionAlgorithm != "aes-gcm" {
+	if config.KeyEncryptionAlgorithm != "aes-gcm" && config.KeyEncryptionAlgorithm != "xchacha20-poly1305" {
 		return fmt.Errorf("unsupported key encryption algorithm: %s", config.KeyEncryptionAlgorithm)
 	}
 	
+	if config.KeyEncryptionAlgorithm == "xchacha20-poly1305" && config.KeyLength != 32 {
+		return fmt.Errorf("xchacha20-poly1305 requires a key length of 32, got %d", config.KeyLength)
+	}
+	
+	if config.KeyEscrowPublicKey != "" {
+		decoded, err := base64.StdEncoding.DecodeString(config.KeyEscrowPublicKey)
+		if err != nil || len(decoded) != 32 {
+			return fmt.Errorf("key escrow public key must be a base64-encoded 32-byte X25519 key")
+		}
+	}
+	
+	for _, algo := range config.DeprecatedAlgorithms {
+		if !containsAlgorithm(knownAlgorithms, algo) {
+			return fmt.Errorf("unknown deprecated algorithm: %s", algo)
+		}
+		if algo == config.FileEncryptionAlgorithm || algo == config.KeyEncryptionAlgorithm {
+			return fmt.Errorf("algorithm %s cannot be both deprecated and in use", algo)
+		}
+	}
+	
 	return nil
 }
 
+// containsAlgorithm reports whether algo is one of algorithms
+func containsAlgorithm(algorithms []string, algo string) bool {
+	for _, candidate := range algorithms {
+		if candidate == algo {
+			return true
+		}
+	}
+	return false
+}
+
 // Environment variable documentation:
 //
 // AEGIS_PBKDF2_ITERATIONS: Number of PBKDF2 iterations (default: 100000)
+// AEGIS_KDF_ALGORITHM: Password KDF for envelope keys and share passwords ("argon2id" or
+// "pbkdf2-sha256", default: "argon2id"). Each salt is stored with its parameters, so changing
+// this or the parameters below only affects keys wrapped afterwards
+// AEGIS_ARGON2_TIME: Argon2id passes (default: 3)
+// AEGIS_ARGON2_MEMORY_KIB: Argon2id memory in KiB (default: 65536)
+// AEGIS_ARGON2_THREADS: Argon2id parallelism (default: 4)
 // AEGIS_KEY_LENGTH: Length of encryption keys in bytes (default: 32)
-// AEGIS_SHARE_PASSWORD_KEY: Base64-encoded 32-byte key for share password encryption
+// AEGIS_SHARE_PASSWORD_KEY: Base64-encoded 32-byte key for share password encryption. With a key
+// provider the key is stored wrapped in the database, and this only seeds its first version on
+// first start. Admins rotate it with the rotateSharePasswordKey mutation
+// AEGIS_KEY_ESCROW_PUBLIC_KEY: Base64-encoded X25519 public key of the organization recovery
+// key. When set, every envelope key is additionally sealed to it, so two admins holding the
+// private key can restore a user's envelope key. Generate the pair with go run ./cmd/escrowkey
+// and keep the private key offline (default: escrow disabled)
 // AEGIS_FILE_ENCRYPTION_ALGORITHM: File encryption algorithm ("nacl-secretbox" or "aes-gcm", default: "nacl-secretbox")
+// AEGIS_KEY_ENCRYPTION_ALGORITHM: Algorithm for file keys, envelope keys and share passwords
+// ("xchacha20-poly1305" or "aes-gcm", default: "xchacha20-poly1305")
+// AEGIS_DEPRECATED_ALGORITHMS: Comma-separated algorithms the re-encryption job migrates
+// away from, in addition to ciphertexts without a format header (default: none)
 //
 // Example environment setup:
 // export AEGIS_PBKDF2_ITERATIONS=100000
+// export AEGIS_KDF_ALGORITHM="argon2id"
+// export AEGIS_ARGON2_MEMORY_KIB=65536
 // export AEGIS_KEY_LENGTH=32
 // export AEGIS_SHARE_PASSWORD_KEY="$(openssl rand -base64 32)"
-// export AEGIS_FILE_ENCRYPTION_ALGORITHM="nacl-secretbox"
\ No newline at end of file
+// export AEGIS_KEY_ESCROW_PUBLIC_KEY="<public key printed by cmd/escrowkey>"
+// export AEGIS_FILE_ENCRYPTION_ALGORITHM="nacl-secretbox"
+// export AEGIS_KEY_ENCRYPTION_ALGORITHM="xchacha20-poly1305"
+// export AEGIS_DEPRECATED_ALGORITHMS="aes-gcm"
\ No newline at end of file
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContentETag builds a strong ETag from a file's SHA-256 content hash. Files are
+// content-addressed, so the hash changes exactly when the bytes do. A non-empty
+// variant distinguishes other representations of the same content, such as the
+// decrypted body served to share recipients.
+func ContentETag(contentHash, variant string) string {
+	if variant != "" {
+		return fmt.Sprintf("\"%s-%s\"", contentHash, variant)
+	}
+	return fmt.Sprintf("\"%s\"", contentHash)
+}
+
+// ServeFileContent streams a file body to the client. Seekable readers are handed to
+// http.ServeContent, which answers Range/If-Range requests with 206 Partial Content and
+// handles If-None-Match/If-Modified-Since; anything else is streamed in full.
+func ServeFileContent(c *gin.Context, reader io.Reader, size int64, filename, mimeType, etag string, modTime time.Time) {
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	c.Header("Content-Type", mimeType)
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, filename, modTime, seeker)
+		return
+	}
+
+	if !modTime.IsZero() {
+		c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	c.Header("Accept-Ranges", "none")
+	if size >= 0 {
+		c.Header("Content-Length", strconv.FormatInt(size, 10))
+	}
+	c.Status(http.StatusOK)
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(c.Writer, reader); err != nil {
+		log.Printf("Warning: Failed to stream %s to client: %v", filename, err)
+	}
+}
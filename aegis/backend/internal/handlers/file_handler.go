@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"fmt"
-	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -42,6 +41,20 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 		return
 	}
 
+	// An earlier revision of the file was requested. Download tickets name the
+	// revision they were issued for.
+	versionParam := c.Query("version")
+	if ticket := middleware.GetDownloadTicketFromContext(c.Request.Context()); ticket != nil {
+		versionParam = ""
+		if ticket.Version != 0 {
+			versionParam = strconv.Itoa(ticket.Version)
+		}
+	}
+	if versionParam != "" {
+		h.downloadFileVersion(c, user.ID, uint(fileID), versionParam)
+		return
+	}
+
 	// Get user file info for filename
 	var userFile models.UserFile
 	db := h.fileService.GetDB().GetDB()
@@ -78,24 +91,38 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 	}
 	defer reader.Close()
 
-	// For simplicity, read all content (not ideal for large files, but works for now)
-	var content []byte
-	buf := make([]byte, 1024)
-	for {
-		n, err := reader.Read(buf)
-		if n > 0 {
-			content = append(content, buf[:n]...)
-		}
-		if err != nil {
-			break
-		}
+	// The storage scrubber found the stored content damaged; let the client warn the user
+	if userFile.IntegrityStatus != "" && userFile.IntegrityStatus != models.IntegrityStatusOK {
+		c.Header("X-Integrity-Status", userFile.IntegrityStatus)
+	}
+
+	// Stream straight from storage; Range requests are answered with 206 Partial Content
+	ServeFileContent(c, reader, userFile.File.SizeBytes, userFile.Filename, mimeType,
+		ContentETag(userFile.File.ContentHash, ""), userFile.File.CreatedAt)
+}
+
+// downloadFileVersion streams one revision of a file. The service checks that the user
+// owns the file or can see it through a room.
+func (h *FileHandler) downloadFileVersion(c *gin.Context, userID, userFileID uint, versionParam string) {
+	versionNumber, err := strconv.Atoi(versionParam)
+	if err != nil || versionNumber < 1 {
+		c.Error(errors.New(errors.ErrCodeInvalidArgument, "Invalid file version"))
+		return
 	}
 
-	// Set headers
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", userFile.Filename))
-	c.Header("Content-Type", mimeType)
-	c.Header("Content-Length", strconv.Itoa(len(content)))
+	reader, version, err := h.fileService.StreamFileVersion(userID, userFileID, versionNumber)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+	defer reader.Close()
+
+	var userFile models.UserFile
+	if err := h.fileService.GetDB().GetDB().First(&userFile, userFileID).Error; err != nil {
+		c.Error(errors.New(errors.ErrCodeNotFound, "File not found"))
+		return
+	}
 
-	// Send the file
-	c.Data(http.StatusOK, mimeType, content)
+	ServeFileContent(c, reader, version.File.SizeBytes, userFile.Filename, version.MimeType,
+		ContentETag(version.File.ContentHash, ""), version.UploadedAt)
 }
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	stderrors "errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/middleware"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+// ShareHandler serves password-protected share links. Recipients need no account, except
+// for shares restricted to emails, which need a signed-in user with a matching address.
+type ShareHandler struct {
+	shareService          *services.ShareService
+	fileService           *services.FileService
+	downloadTicketService *services.DownloadTicketService
+	cryptoManager         *services.CryptoManager
+	shareBase             string
+}
+
+func NewShareHandler(shareService *services.ShareService, fileService *services.FileService, downloadTicketService *services.DownloadTicketService, cryptoManager *services.CryptoManager, shareBase string) *ShareHandler {
+	return &ShareHandler{
+		shareService:          shareService,
+		fileService:           fileService,
+		downloadTicketService: downloadTicketService,
+		cryptoManager:         cryptoManager,
+		shareBase:             shareBase,
+	}
+}
+
+// AccessShare unlocks a share with its password, or a passwordless share for an allowed
+// recipient, and returns a download URL. Each access is charged once against the
+// share's download limit. The route is optionally authenticated, so the signed-in user
+// can be checked against the allowed emails.
+func (h *ShareHandler) AccessShare(c *gin.Context) {
+	token := c.Param("token")
+
+	var req struct {
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	// Validate share and decrypt file key
+	fileShare, err := h.shareService.ValidateShareToken(token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+
+	// Shares restricted to emails need a signed-in user with a matching, verified address
+	user, _ := middleware.GetUserFromContext(c.Request.Context())
+	if err := h.shareService.AuthorizeRecipient(fileShare, user); err != nil {
+		respondRecipientError(c, err)
+		return
+	}
+
+	// Shares restricted to emails are passwordless, and unlocked with the stored password
+	password := req.Password
+	if fileShare.PlainTextPassword == "" {
+		password = ""
+	} else if password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return
+	}
+
+	fileKey, err := h.shareService.DecryptFileKey(fileShare, password)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+
+	// Charge the download now: the ticket can then be used for as many range requests as
+	// the recipient needs
+	if err := h.shareService.IncrementDownloadCount(fileShare.ID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Download limit exceeded"})
+		return
+	}
+
+	// The download URL carries a short-lived ticket rather than the password
+	var recipientID uint
+	if user != nil {
+		recipientID = user.ID
+	}
+	ticket, err := h.downloadTicketService.IssueShareTicket(fileShare.ID, recipientID, fileKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create download link"})
+		return
+	}
+	downloadURL := fmt.Sprintf("%s/%s/download?ticket=%s", h.shareBase, token, ticket)
+
+	c.JSON(http.StatusOK, gin.H{"downloadUrl": downloadURL})
+}
+
+// DownloadShare serves a shared file to the holder of a download ticket. Download URLs
+// are opened by the browser without an Authorization header, so for shares restricted to
+// emails the user the ticket was issued to is checked again. The file is decrypted into
+// a temporary file, so Range requests are answered without holding the file in memory.
+func (h *ShareHandler) DownloadShare(c *gin.Context) {
+	token := c.Param("token")
+	ticketParam := c.Query("ticket")
+
+	if ticketParam == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A download ticket is required"})
+		return
+	}
+
+	// Validate share token. The download was charged when the ticket was issued.
+	fileShare, err := h.shareService.ValidateTicketedShareToken(token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+
+	// The ticket must have been issued for this share, and carries the file key
+	// that the share's password unlocked
+	ticket, err := h.downloadTicketService.Redeem(ticketParam, services.DownloadTicketShare)
+	if err != nil || ticket.FileShareID != fileShare.ID {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired download link"})
+		return
+	}
+	fileKey, err := h.downloadTicketService.FileKey(ticket)
+	if err != nil || len(fileKey) == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired download link"})
+		return
+	}
+
+	// The recipient may have lost access since the ticket was issued
+	var recipient *models.User
+	if ticket.UserID != 0 {
+		recipient = &models.User{}
+		if err := h.shareService.GetDB().GetDB().First(recipient, ticket.UserID).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired download link"})
+			return
+		}
+	}
+	if err := h.shareService.AuthorizeRecipient(fileShare, recipient); err != nil {
+		respondRecipientError(c, err)
+		return
+	}
+
+	// Get user file info for filename
+	var userFile models.UserFile
+	if err := h.shareService.GetDB().GetDB().Preload("File").Where("id = ?", fileShare.UserFileID).First(&userFile).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	// Get the encrypted file content
+	reader, mimeType, err := h.fileService.StreamFile(userFile.UserID, fileShare.UserFileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file"})
+		return
+	}
+	defer reader.Close()
+
+	decrypted, err := h.cryptoManager.DecryptFileToTemp(reader, fileKey)
+	if err != nil {
+		log.Printf("Warning: Failed to decrypt shared file %d: %v", userFile.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt file"})
+		return
+	}
+	defer decrypted.Close()
+
+	// Set headers for download
+	c.Header("Cache-Control", "no-cache, no-store, must-revalidate")
+	c.Header("Pragma", "no-cache")
+	c.Header("Expires", "0")
+
+	// Send the decrypted file, honouring Range/If-Range requests
+	ServeFileContent(c, decrypted, decrypted.Size, userFile.Filename, mimeType,
+		ContentETag(userFile.File.ContentHash, "plain"), userFile.File.CreatedAt)
+}
+
+// respondRecipientError reports why AuthorizeRecipient turned a recipient away.
+func respondRecipientError(c *gin.Context, err error) {
+	var appErr *errors.Error
+	if !stderrors.As(err, &appErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check share recipient"})
+		return
+	}
+	switch appErr.Code {
+	case errors.ErrCodeUnauthorized:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": appErr.Message})
+	case errors.ErrCodeForbidden:
+		c.JSON(http.StatusForbidden, gin.H{"error": appErr.Message})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check share recipient"})
+	}
+}
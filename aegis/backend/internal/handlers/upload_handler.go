@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/middleware"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+// Headers used by the resumable upload protocol (modelled on tus.io)
+const (
+	headerUploadOffset  = "Upload-Offset"
+	headerUploadLength  = "Upload-Length"
+	headerUploadExpires = "Upload-Expires"
+)
+
+type UploadHandler struct {
+	uploadSessionService *services.UploadSessionService
+}
+
+func NewUploadHandler(uploadSessionService *services.UploadSessionService) *UploadHandler {
+	return &UploadHandler{
+		uploadSessionService: uploadSessionService,
+	}
+}
+
+type createUploadRequest struct {
+	Filename     string  `json:"filename" binding:"required"`
+	MimeType     string  `json:"mime_type"`
+	ContentHash  string  `json:"content_hash" binding:"required"`
+	EncryptedKey string  `json:"encrypted_key" binding:"required"`
+	SizeBytes    int64   `json:"size_bytes" binding:"required"`
+	FolderID     *string `json:"folder_id,omitempty"`
+}
+
+// CreateUpload opens a new upload session and returns its location.
+func (h *UploadHandler) CreateUpload(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	var req createUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(errors.Wrap(err, errors.ErrCodeInvalidArgument, "Invalid upload request"))
+		return
+	}
+
+	var folderID *uint
+	if req.FolderID != nil && *req.FolderID != "" {
+		fid, err := strconv.ParseUint(*req.FolderID, 10, 32)
+		if err != nil {
+			c.Error(errors.New(errors.ErrCodeInvalidArgument, "Invalid folder ID"))
+			return
+		}
+		fidUint := uint(fid)
+		folderID = &fidUint
+	}
+
+	session, err := h.uploadSessionService.CreateSession(user.ID, req.Filename, req.MimeType, req.ContentHash, req.EncryptedKey, req.SizeBytes, folderID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+session.SessionToken)
+	setUploadHeaders(c, session)
+	c.JSON(http.StatusCreated, session)
+}
+
+// GetUploadOffset reports how many bytes of the upload have been received. It answers
+// both HEAD (headers only, as in tus) and GET (headers plus the session as JSON).
+func (h *UploadHandler) GetUploadOffset(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	session, err := h.uploadSessionService.GetSession(user.ID, c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	setUploadHeaders(c, session)
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.JSON(http.StatusOK, session)
+}
+
+// PatchUpload appends the request body to the upload at the offset given in the Upload-Offset header.
+func (h *UploadHandler) PatchUpload(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader(headerUploadOffset), 10, 64)
+	if err != nil || offset < 0 {
+		c.Error(errors.New(errors.ErrCodeInvalidArgument, "Missing or invalid Upload-Offset header"))
+		return
+	}
+	if c.Request.ContentLength <= 0 {
+		c.Error(errors.New(errors.ErrCodeInvalidArgument, "Content-Length is required for upload chunks"))
+		return
+	}
+	if c.Request.ContentLength > h.uploadSessionService.MaxChunkSize() {
+		c.Error(errors.New(errors.ErrCodeInvalidArgument, "Upload chunk is too large"))
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, c.Request.ContentLength)
+	session, err := h.uploadSessionService.AppendChunk(c.Request.Context(), user.ID, c.Param("id"), offset, body, c.Request.ContentLength)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	setUploadHeaders(c, session)
+	c.Status(http.StatusNoContent)
+}
+
+// FinalizeUpload turns a fully received upload into a file.
+func (h *UploadHandler) FinalizeUpload(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	userFile, err := h.uploadSessionService.FinalizeSession(c.Request.Context(), user.ID, c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, userFile)
+}
+
+// AbortUpload cancels an upload and discards the chunks received so far.
+func (h *UploadHandler) AbortUpload(c *gin.Context) {
+	user, ok := h.requireUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.uploadSessionService.AbortSession(c.Request.Context(), user.ID, c.Param("id")); err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *UploadHandler) requireUser(c *gin.Context) (*models.User, bool) {
+	user, err := middleware.GetUserFromContext(c.Request.Context())
+	if err != nil {
+		c.Error(errors.New(errors.ErrCodeUnauthorized, "Unauthorized"))
+		return nil, false
+	}
+	return user, true
+}
+
+func setUploadHeaders(c *gin.Context, session *models.UploadSession) {
+	c.Header(headerUploadOffset, strconv.FormatInt(session.UploadOffset, 10))
+	c.Header(headerUploadLength, strconv.FormatInt(session.TotalSize, 10))
+	c.Header(headerUploadExpires, session.ExpiresAt.UTC().Format(time.RFC1123))
+}
@@ -2,9 +2,11 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/balkanid/aegis-backend/internal/services"
 	"github.com/gin-gonic/gin"
@@ -12,6 +14,7 @@ import (
 
 	"github.com/balkanid/aegis-backend/internal/config"
 	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
 	"github.com/balkanid/aegis-backend/internal/models"
 )
 
@@ -19,11 +22,25 @@ import (
 type contextKey string
 
 const (
-	UserContextKey contextKey = "user"
+	UserContextKey    contextKey = "user"
+	SessionContextKey contextKey = "session"
+	ScopesContextKey  contextKey = "scopes"
+	TicketContextKey  contextKey = "download_ticket"
+)
+
+// sessionTouchInterval limits how often a session's or personal access token's
+// last-seen time is written
+const sessionTouchInterval = time.Minute
+
+var (
+	errSessionRevoked  = errors.New("session revoked or expired")
+	errSessionRequired = errors.New("token is not bound to a session")
 )
 
 // AuthMiddleware validates JWT tokens and adds user context
 func AuthMiddleware(cfg *config.Config, authService *services.AuthService, db *database.DB) gin.HandlerFunc {
+	patService := services.NewPersonalAccessTokenService(db)
+
 	return func(c *gin.Context) {
 		// Skip authentication for certain endpoints
 		path := c.Request.URL.Path
@@ -39,40 +56,7 @@ func AuthMiddleware(cfg *config.Config, authService *services.AuthService, db *d
 		// For GraphQL requests, handle authentication at resolver level
 		if path == cfg.APIEndpoints.GraphQL.Base {
 			fmt.Printf("DEBUG: Handling GraphQL request at configured path: %s\n", cfg.APIEndpoints.GraphQL.Base)
-			// Check for token in Authorization header only
-			var tokenString string
-			authHeader := c.GetHeader("Authorization")
-			if authHeader != "" {
-				// Expect "Bearer <token>"
-				bearerToken := strings.Split(authHeader, " ")
-				if len(bearerToken) == 2 && bearerToken[0] == "Bearer" {
-					tokenString = bearerToken[1]
-				}
-			}
-
-			if tokenString != "" {
-				fmt.Printf("DEBUG: GraphQL request has authorization token\n")
-				// Parse and validate token
-				claims, err := authService.ParseToken(tokenString)
-
-				if err != nil {
-					// Log authentication failure without sensitive details
-					fmt.Printf("DEBUG: GraphQL authentication failed: %v\n", err)
-				} else {
-					// Verify user still exists
-					var user models.User
-					if err := db.GetDB().First(&user, claims.UserID).Error; err == nil {
-						// Add user to context for GraphQL resolvers
-						ctx := context.WithValue(c.Request.Context(), UserContextKey, &user)
-						c.Request = c.Request.WithContext(ctx)
-						fmt.Printf("DEBUG: User authenticated for GraphQL: %s\n", user.Email)
-					} else {
-						fmt.Printf("DEBUG: User not found in database: %v\n", err)
-					}
-				}
-			} else {
-				fmt.Printf("DEBUG: No authorization header for GraphQL request\n")
-			}
+			authenticateIfPresent(c, authService, db, patService, "GraphQL")
 			// Always allow GraphQL requests to proceed - authentication handled at resolver level
 			fmt.Printf("DEBUG: Allowing GraphQL request to proceed\n")
 			c.Next()
@@ -108,6 +92,18 @@ func AuthMiddleware(cfg *config.Config, authService *services.AuthService, db *d
 			return
 		}
 
+		if strings.HasPrefix(tokenString, services.PersonalAccessTokenPrefix) {
+			ctx, err := authenticatePersonalAccessToken(c, patService, tokenString)
+			if err != nil {
+				fmt.Printf("DEBUG: Personal access token rejected for REST endpoint: %v\n", err)
+				c.AbortWithStatusJSON(401, gin.H{"error": "Invalid token"})
+				return
+			}
+			c.Request = c.Request.WithContext(ctx)
+			c.Next()
+			return
+		}
+
 		fmt.Printf("DEBUG: Validating token for REST endpoint\n")
 
 		// Parse and validate token
@@ -126,16 +122,170 @@ func AuthMiddleware(cfg *config.Config, authService *services.AuthService, db *d
 			return
 		}
 
+		if err := validateSession(c, db, claims); err != nil {
+			fmt.Printf("DEBUG: Session rejected for REST endpoint: %v\n", err)
+			c.AbortWithStatusJSON(401, gin.H{"error": "Session has been revoked"})
+			return
+		}
+
 		fmt.Printf("DEBUG: User authenticated for REST endpoint: %s\n", user.Email)
 
 		// Add user to context for REST handlers
 		ctx := context.WithValue(c.Request.Context(), UserContextKey, &user)
+		ctx = context.WithValue(ctx, SessionContextKey, claims.ID)
 		c.Request = c.Request.WithContext(ctx)
 
 		c.Next()
 	}
 }
 
+// OptionalAuthMiddleware adds the user to the context when the request carries a valid
+// token, and lets anonymous requests through. Handlers decide what anonymous users can do.
+func OptionalAuthMiddleware(authService *services.AuthService, db *database.DB) gin.HandlerFunc {
+	patService := services.NewPersonalAccessTokenService(db)
+
+	return func(c *gin.Context) {
+		authenticateIfPresent(c, authService, db, patService, "REST")
+		c.Next()
+	}
+}
+
+// authenticateIfPresent adds the user of the request's bearer token to its context. A
+// missing or invalid token leaves the request anonymous.
+func authenticateIfPresent(c *gin.Context, authService *services.AuthService, db *database.DB, patService *services.PersonalAccessTokenService, label string) {
+	// Check for token in Authorization header only
+	var tokenString string
+	authHeader := c.GetHeader("Authorization")
+	if authHeader != "" {
+		// Expect "Bearer <token>"
+		bearerToken := strings.Split(authHeader, " ")
+		if len(bearerToken) == 2 && bearerToken[0] == "Bearer" {
+			tokenString = bearerToken[1]
+		}
+	}
+
+	if strings.HasPrefix(tokenString, services.PersonalAccessTokenPrefix) {
+		fmt.Printf("DEBUG: %s request has personal access token\n", label)
+		if ctx, err := authenticatePersonalAccessToken(c, patService, tokenString); err != nil {
+			fmt.Printf("DEBUG: %s personal access token rejected: %v\n", label, err)
+		} else {
+			c.Request = c.Request.WithContext(ctx)
+		}
+	} else if tokenString != "" {
+		fmt.Printf("DEBUG: %s request has authorization token\n", label)
+		// Parse and validate token
+		claims, err := authService.ParseToken(tokenString)
+
+		if err != nil {
+			// Log authentication failure without sensitive details
+			fmt.Printf("DEBUG: %s authentication failed: %v\n", label, err)
+		} else {
+			// Verify user still exists and the session has not been revoked
+			var user models.User
+			if err := db.GetDB().First(&user, claims.UserID).Error; err != nil {
+				fmt.Printf("DEBUG: User not found in database: %v\n", err)
+			} else if err := validateSession(c, db, claims); err != nil {
+				fmt.Printf("DEBUG: %s session rejected: %v\n", label, err)
+			} else {
+				// Add user to context for resolvers and handlers
+				ctx := context.WithValue(c.Request.Context(), UserContextKey, &user)
+				ctx = context.WithValue(ctx, SessionContextKey, claims.ID)
+				c.Request = c.Request.WithContext(ctx)
+				fmt.Printf("DEBUG: User authenticated for %s: %s\n", label, user.Email)
+			}
+		}
+	} else {
+		fmt.Printf("DEBUG: No authorization header for %s request\n", label)
+	}
+}
+
+// DownloadTicketAuth authenticates a file download with the download ticket in its
+// ticket query parameter, so that download URLs work without an Authorization header.
+// The ticket must have been issued for the file in the path. Requests without a ticket
+// are authenticated by next.
+func DownloadTicketAuth(tickets *services.DownloadTicketService, db *database.DB, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ticketString := c.Query("ticket")
+		if ticketString == "" {
+			next(c)
+			return
+		}
+
+		ticket, err := tickets.Redeem(ticketString, services.DownloadTicketFile)
+		if err != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid or expired download link"})
+			return
+		}
+		if strconv.FormatUint(uint64(ticket.UserFileID), 10) != c.Param("id") {
+			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid or expired download link"})
+			return
+		}
+
+		var user models.User
+		if err := db.GetDB().First(&user, ticket.UserID).Error; err != nil {
+			c.AbortWithStatusJSON(401, gin.H{"error": "User not found"})
+			return
+		}
+
+		ctx := context.WithValue(c.Request.Context(), UserContextKey, &user)
+		ctx = context.WithValue(ctx, TicketContextKey, ticket)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// GetDownloadTicketFromContext returns the download ticket a request was authenticated
+// with, or nil
+func GetDownloadTicketFromContext(ctx context.Context) *services.DownloadTicket {
+	ticket, _ := ctx.Value(TicketContextKey).(*services.DownloadTicket)
+	return ticket
+}
+
+// validateSession checks that the session named by the token's jti is still active and
+// records when it was last seen. Access tokens are only issued for sessions, so tokens
+// without a jti are rejected: signing out or revoking a session could not stop them.
+func validateSession(c *gin.Context, db *database.DB, claims *services.Claims) error {
+	if claims.ID == "" {
+		return errSessionRequired
+	}
+
+	var session models.Session
+	if err := db.GetDB().Where("session_id = ? AND user_id = ?", claims.ID, claims.UserID).First(&session).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return errSessionRevoked
+	}
+
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval || session.IPAddress != c.ClientIP() {
+		if err := db.GetDB().Model(&session).UpdateColumns(map[string]interface{}{
+			"last_seen_at": now,
+			"ip_address":   c.ClientIP(),
+		}).Error; err != nil {
+			fmt.Printf("DEBUG: Failed to update session last-seen time: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// authenticatePersonalAccessToken validates a personal access token and returns the
+// request context carrying its user and scopes
+func authenticatePersonalAccessToken(c *gin.Context, patService *services.PersonalAccessTokenService, tokenString string) (context.Context, error) {
+	token, err := patService.Authenticate(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if err := patService.TouchToken(token, sessionTouchInterval); err != nil {
+		fmt.Printf("DEBUG: Failed to update token last-used time: %v\n", err)
+	}
+
+	user := token.User
+	ctx := context.WithValue(c.Request.Context(), UserContextKey, &user)
+	ctx = context.WithValue(ctx, ScopesContextKey, services.TokenScopes(token))
+	return ctx, nil
+}
+
 // GetUserFromContext extracts the user from the request context
 func GetUserFromContext(ctx context.Context) (*models.User, error) {
 	user, ok := ctx.Value(UserContextKey).(*models.User)
@@ -145,6 +295,48 @@ func GetUserFromContext(ctx context.Context) (*models.User, error) {
 	return user, nil
 }
 
+// GetSessionIDFromContext returns the jti of the session the request was made with, or
+// an empty string when the token is not bound to a session
+func GetSessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(SessionContextKey).(string)
+	return sessionID
+}
+
+// RequireScope checks that a request made with a personal access token was granted the
+// scope. Requests authenticated by a session may do anything the user may.
+func RequireScope(ctx context.Context, scope string) error {
+	scopes, ok := ctx.Value(ScopesContextKey).([]string)
+	if !ok {
+		return nil
+	}
+	for _, granted := range scopes {
+		if granted == scope {
+			return nil
+		}
+	}
+	return apperrors.New(apperrors.ErrCodeForbidden, fmt.Sprintf("personal access token lacks the %s scope", scope))
+}
+
+// RequireTokenScope is the REST counterpart of RequireScope
+func RequireTokenScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := RequireScope(c.Request.Context(), scope); err != nil {
+			c.AbortWithStatusJSON(403, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSessionAuth rejects requests made with a personal access token, for operations
+// that only a signed-in user may perform, such as managing credentials.
+func RequireSessionAuth(ctx context.Context) error {
+	if _, ok := ctx.Value(ScopesContextKey).([]string); ok {
+		return apperrors.New(apperrors.ErrCodeForbidden, "this operation is not available to personal access tokens")
+	}
+	return nil
+}
+
 // RequireAdmin checks if the user has admin privileges
 func RequireAdmin(ctx context.Context) (*models.User, error) {
 	user, err := GetUserFromContext(ctx)
@@ -156,6 +348,10 @@ func RequireAdmin(ctx context.Context) (*models.User, error) {
 		return nil, jwt.ErrTokenInvalidClaims
 	}
 
+	if err := RequireScope(ctx, services.ScopeAdmin); err != nil {
+		return nil, err
+	}
+
 	return user, nil
 }
 
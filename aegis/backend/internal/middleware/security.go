@@ -4,8 +4,24 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/balkanid/aegis-backend/internal/config"
 )
 
+// TrustProxies sets which proxies are believed about the client address. X-Forwarded-For
+// and X-Real-IP are only read from requests relayed by an address in TRUSTED_PROXIES;
+// with none configured, ClientIP is the address of the connection itself, so clients
+// cannot choose the address that rate limits and login throttling count them under.
+func TrustProxies(r *gin.Engine, cfg *config.Config) error {
+	var proxies []string
+	for _, proxy := range strings.Split(cfg.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return r.SetTrustedProxies(proxies)
+}
+
 // SecurityHeaders adds security headers to HTTP responses
 func SecurityHeaders() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -11,11 +11,14 @@ type User struct {
 	ID                   uint           `gorm:"primaryKey" json:"id"`
 	Username             string         `gorm:"uniqueIndex;not null" json:"username"`
 	Email                string         `gorm:"uniqueIndex;not null" json:"email"`
+	EmailVerified        bool           `gorm:"not null;default:false" json:"email_verified"`
 	PasswordHash         string         `gorm:"not null" json:"-"`
 	StorageQuota         int64          `gorm:"default:10485760" json:"storage_quota"` // 10MB default
 	UsedStorage          int64          `gorm:"default:0" json:"used_storage"`
 	IsAdmin              bool           `json:"is_admin"`
+	TwoFactorEnabled     bool           `gorm:"not null;default:false" json:"two_factor_enabled"`
 	EnvelopeKey          string         `gorm:"not null;default:''" json:"-"` // Encrypted envelope key
+	EnvelopeKeyID        string         `gorm:"not null;default:''" json:"-"` // Key provider key that wrapped the envelope key, empty for legacy hex keys
 	EnvelopeKeyVersion   int            `gorm:"not null;default:1;index" json:"envelope_key_version"`
 	EnvelopeKeySalt      string         `gorm:"not null;default:''" json:"-"` // Salt for envelope key encryption
 	EnvelopeKeyIV        string         `gorm:"not null;default:''" json:"-"` // IV for envelope key encryption
@@ -31,7 +34,9 @@ type File struct {
 	ID          uint           `gorm:"primaryKey" json:"id"`
 	ContentHash string         `gorm:"uniqueIndex;not null" json:"content_hash"` // SHA-256
 	SizeBytes   int64          `gorm:"not null" json:"size_bytes"`
-	StoragePath string         `gorm:"not null" json:"-"` // MinIO object key
+	StoragePath string         `gorm:"not null" json:"-"`                   // MinIO object key
+	RefCount    int64          `gorm:"not null;default:0" json:"ref_count"` // Number of UserFiles (trashed included) pointing at this content
+	Cipher      string         `gorm:"not null;default:'';index" json:"-"`  // Cipher of the stored object, empty until the re-encryption job reads its header
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
@@ -39,19 +44,22 @@ type File struct {
 
 // UserFile represents a user's file with metadata
 type UserFile struct {
-	ID            uint           `gorm:"primaryKey" json:"id"`
-	UserID        uint           `gorm:"not null;index" json:"user_id"`
-	FileID        uint           `gorm:"not null;index" json:"file_id"`
-	FolderID      *uint          `gorm:"index" json:"folder_id"` // Nullable folder reference
-	Filename      string         `gorm:"not null" json:"filename"`
-	MimeType      string         `gorm:"not null" json:"mime_type"`
-	EncryptionKey string         `gorm:"not null" json:"-"` // Encrypted symmetric key for E2EE
-	IsShared      bool           `gorm:"default:false" json:"is_shared"`
-	IsStarred     bool           `gorm:"default:false" json:"is_starred"`
-	ShareCount    int            `gorm:"default:0" json:"share_count"`
-	CreatedAt     time.Time      `json:"created_at"`
-	UpdatedAt     time.Time      `json:"updated_at"`
-	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                uint           `gorm:"primaryKey" json:"id"`
+	UserID            uint           `gorm:"not null;index" json:"user_id"`
+	FileID            uint           `gorm:"not null;index" json:"file_id"`
+	FolderID          *uint          `gorm:"index" json:"folder_id"` // Nullable folder reference
+	Filename          string         `gorm:"not null" json:"filename"`
+	MimeType          string         `gorm:"not null" json:"mime_type"`
+	EncryptionKey     string         `gorm:"not null" json:"-"` // Encrypted symmetric key for E2EE
+	IsShared          bool           `gorm:"default:false" json:"is_shared"`
+	IsStarred         bool           `gorm:"default:false" json:"is_starred"`
+	ShareCount        int            `gorm:"default:0" json:"share_count"`
+	IntegrityStatus   string         `gorm:"not null;default:'OK'" json:"integrity_status"` // OK, CORRUPTED or MISSING, set by the storage scrubber
+	CurrentVersion    int            `gorm:"not null;default:1" json:"current_version"`     // Number of the revision FileID points at
+	VersionUploadedAt *time.Time     `json:"version_uploaded_at"`                           // When the current revision was uploaded; nil means CreatedAt
+	CreatedAt         time.Time      `json:"created_at"`
+	UpdatedAt         time.Time      `json:"updated_at"`
+	DeletedAt         gorm.DeletedAt `gorm:"index" json:"-"`
 
 	// Associations
 	User   User    `gorm:"foreignKey:UserID" json:"user,omitempty"`
@@ -61,12 +69,14 @@ type UserFile struct {
 
 // Room represents a collaborative file sharing room
 type Room struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	Name      string         `gorm:"not null" json:"name"`
-	CreatorID uint           `gorm:"not null;index" json:"creator_id"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	Name          string         `gorm:"not null" json:"name"`
+	CreatorID     uint           `gorm:"not null;index" json:"creator_id"`
+	KeyVersion    int            `gorm:"not null;default:0" json:"key_version"`        // Current room key, 0 while the room has none
+	RekeyRequired bool           `gorm:"not null;default:false" json:"rekey_required"` // Set when a member leaves; cleared by a new key version
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
 
 	// Associations
 	Creator User          `gorm:"foreignKey:CreatorID" json:"creator,omitempty"`
@@ -93,6 +103,8 @@ type RoomFile struct {
 	ID         uint      `gorm:"primaryKey" json:"id"`
 	RoomID     uint      `gorm:"not null;index" json:"room_id"`
 	UserFileID uint      `gorm:"not null;index" json:"user_file_id"`
+	KeyVersion int       `gorm:"not null;default:0" json:"key_version"`            // Room key version WrappedKey is wrapped under
+	WrappedKey string    `gorm:"type:text;not null;default:''" json:"wrapped_key"` // File key wrapped under the room key on the client
 	CreatedAt  time.Time `json:"created_at"`
 
 	// Associations
@@ -155,10 +167,12 @@ type FileShare struct {
 	EnvelopeKey  string `gorm:"not null" json:"envelope_key"`  // Encrypted envelope key (encrypted with password)
 	EnvelopeSalt string `gorm:"not null" json:"envelope_salt"` // Salt for envelope key encryption
 	EnvelopeIV   string `gorm:"not null" json:"envelope_iv"`   // IV for envelope key encryption
+	KDFParams    string `gorm:"not null;default:''" json:"-"`  // KDF of the legacy salts, empty once keys are sealed
 
-	EncryptedPassword string `json:"encrypted_password"`  // Encrypted share password
-	PasswordIV        string `json:"password_iv"`         // IV for password encryption
-	PlainTextPassword string `json:"plain_text_password"` // Plain text password for display
+	EncryptedPassword  string `json:"encrypted_password"`                // Encrypted share password
+	PasswordIV         string `json:"password_iv"`                       // IV for password encryption
+	PasswordKeyVersion int    `gorm:"not null;default:1;index" json:"-"` // Version of the share password service key EncryptedPassword is under
+	PlainTextPassword  string `json:"plain_text_password"`               // Plain text password for display
 
 	MaxDownloads  int        `gorm:"default:-1" json:"max_downloads"` // -1 means unlimited
 	DownloadCount int        `gorm:"default:0" json:"download_count"`
@@ -283,12 +297,18 @@ func (ShareRateLimit) TableName() string {
 type KeyRotation struct {
 	ID                    uint       `gorm:"primaryKey" json:"id"`
 	UserID                uint       `gorm:"not null;index" json:"user_id"`
-	RotationID            string     `gorm:"uniqueIndex;not null" json:"rotation_id"` // UUID for tracking
-	Status                string     `gorm:"not null" json:"status"`                  // PENDING, IN_PROGRESS, COMPLETED, FAILED, ROLLED_BACK
+	RotationID            string     `gorm:"uniqueIndex;not null" json:"rotation_id"`      // UUID for tracking
+	CampaignID            string     `gorm:"not null;default:'';index" json:"campaign_id"` // Set when run as part of a KeyRotationCampaign
+	Status                string     `gorm:"not null" json:"status"`                       // PENDING, IN_PROGRESS, COMPLETED, FAILED, ROLLED_BACK, CANCELLED
 	OldEnvelopeKeyVersion int        `gorm:"not null" json:"old_envelope_key_version"`
 	NewEnvelopeKeyVersion int        `gorm:"not null" json:"new_envelope_key_version"`
 	TotalFilesAffected    int        `gorm:"not null;default:0" json:"total_files_affected"`
 	FilesProcessed        int        `gorm:"not null;default:0" json:"files_processed"`
+	LastUserFileID        uint       `gorm:"not null;default:0" json:"last_user_file_id"` // Checkpoint: files up to this ID are re-wrapped
+	OldEnvelopeKey        string     `gorm:"not null;default:''" json:"-"`                // Wrapped key being replaced, kept for rollback
+	OldEnvelopeKeyID      string     `gorm:"not null;default:''" json:"-"`
+	NewEnvelopeKey        string     `gorm:"not null;default:''" json:"-"` // Wrapped replacement, recorded before anything is changed
+	NewEnvelopeKeyID      string     `gorm:"not null;default:''" json:"-"`
 	StartedAt             time.Time  `json:"started_at"`
 	CompletedAt           *time.Time `json:"completed_at"`
 	FailedAt              *time.Time `json:"failed_at"`
@@ -300,6 +320,32 @@ type KeyRotation struct {
 	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
 }
 
+// KeyRotationCampaign is an admin-initiated rotation of every user's envelope key and
+// every share envelope. Each user's rotation is a KeyRotation carrying the campaign ID
+type KeyRotationCampaign struct {
+	ID                 uint       `gorm:"primaryKey" json:"id"`
+	CampaignID         string     `gorm:"uniqueIndex;not null" json:"campaign_id"`
+	Status             string     `gorm:"not null;index" json:"status"` // RUNNING, PAUSED, COMPLETED or CANCELLED
+	StartedBy          uint       `gorm:"not null" json:"started_by"`
+	Concurrency        int        `gorm:"not null" json:"concurrency"`           // Users rotated at once
+	RateLimitPerSecond int        `gorm:"not null" json:"rate_limit_per_second"` // Database batches per second, 0 for no limit
+	UsersEnrolled      bool       `gorm:"not null;default:false" json:"-"`       // Every user has a KeyRotation of the campaign
+	LastUserID         uint       `gorm:"not null;default:0" json:"-"`           // Checkpoint: users up to this ID are enrolled
+	LastFileShareID    uint       `gorm:"not null;default:0" json:"-"`           // Checkpoint: shares up to this ID are rotated
+	TotalUsers         int        `gorm:"not null;default:0" json:"total_users"`
+	UsersRotated       int        `gorm:"not null;default:0" json:"users_rotated"`
+	UsersFailed        int        `gorm:"not null;default:0" json:"users_failed"`
+	TotalShares        int        `gorm:"not null;default:0" json:"total_shares"`
+	SharesRotated      int        `gorm:"not null;default:0" json:"shares_rotated"`
+	SharesSkipped      int        `gorm:"not null;default:0" json:"shares_skipped"` // Shares without a stored password, or changed during the campaign
+	SharesFailed       int        `gorm:"not null;default:0" json:"shares_failed"`
+	LastError          string     `gorm:"type:text;not null;default:''" json:"last_error"`
+	StartedAt          time.Time  `json:"started_at"`
+	CompletedAt        *time.Time `json:"completed_at"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
 // KeyRotationBackup stores backup data for rollback operations
 type KeyRotationBackup struct {
 	ID               uint      `gorm:"primaryKey" json:"id"`
@@ -322,3 +368,493 @@ func (KeyRotation) TableName() string {
 func (KeyRotationBackup) TableName() string {
 	return "key_rotation_backups"
 }
+
+// Keys an envelope key escrow is sealed to
+const (
+	EnvelopeKeyEscrowRecoveryKey  = "recovery_key" // The user's printed recovery key
+	EnvelopeKeyEscrowOrganization = "organization" // The organization escrow key
+)
+
+// EnvelopeKeyEscrow is a copy of a user's envelope key sealed to an X25519 public key whose
+// private key the server never stores. It is re-sealed whenever the envelope key changes.
+type EnvelopeKeyEscrow struct {
+	ID                 uint      `gorm:"primaryKey" json:"id"`
+	UserID             uint      `gorm:"not null;uniqueIndex:idx_envelope_key_escrows_user_kind" json:"user_id"`
+	Kind               string    `gorm:"not null;uniqueIndex:idx_envelope_key_escrows_user_kind" json:"kind"` // recovery_key or organization
+	PublicKey          string    `gorm:"not null" json:"public_key"`                                          // Base64 X25519 key the envelope key is sealed to
+	SealedEnvelopeKey  string    `gorm:"type:text;not null" json:"-"`
+	EnvelopeKeyVersion int       `gorm:"not null" json:"envelope_key_version"` // Version of the envelope key that is sealed
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+func (EnvelopeKeyEscrow) TableName() string {
+	return "envelope_key_escrows"
+}
+
+// Key recovery request statuses
+const (
+	KeyRecoveryStatusPending   = "PENDING"
+	KeyRecoveryStatusApproved  = "APPROVED"
+	KeyRecoveryStatusCompleted = "COMPLETED"
+	KeyRecoveryStatusCancelled = "CANCELLED"
+)
+
+// KeyRecoveryRequest restores a user's envelope key from the organization escrow. It is
+// requested by one admin, approved by a second and then completed with the escrow
+// private key by either of them.
+type KeyRecoveryRequest struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	RequestedBy uint       `gorm:"not null" json:"requested_by"`
+	ApprovedBy  *uint      `json:"approved_by"`
+	CompletedBy *uint      `json:"completed_by"`
+	Reason      string     `gorm:"type:text;not null" json:"reason"`
+	Status      string     `gorm:"not null;index" json:"status"` // PENDING, APPROVED, COMPLETED or CANCELLED
+	ExpiresAt   time.Time  `gorm:"not null" json:"expires_at"`   // Requests not completed by then can no longer be approved or completed
+	ApprovedAt  *time.Time `json:"approved_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+func (KeyRecoveryRequest) TableName() string {
+	return "key_recovery_requests"
+}
+
+// Key recovery audit event types
+const (
+	KeyRecoveryAuditRecoveryKeyEnrolled = "recovery_key_enrolled"
+	KeyRecoveryAuditRecoveryKeyUsed     = "recovery_key_used"
+	KeyRecoveryAuditRecoveryKeyRejected = "recovery_key_rejected"
+	KeyRecoveryAuditRequested           = "escrow_recovery_requested"
+	KeyRecoveryAuditApproved            = "escrow_recovery_approved"
+	KeyRecoveryAuditCompleted           = "escrow_recovery_completed"
+	KeyRecoveryAuditCancelled           = "escrow_recovery_cancelled"
+	KeyRecoveryAuditFailed              = "escrow_recovery_failed"
+)
+
+// KeyRecoveryAuditEvent records a recovery key being enrolled or used, or a step of an
+// escrow recovery request.
+type KeyRecoveryAuditEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Event     string    `gorm:"not null;index" json:"event"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"` // User whose envelope key is concerned
+	ActorID   uint      `gorm:"not null" json:"actor_id"`      // The user themselves, or the admin acting on a request
+	RequestID *uint     `gorm:"index" json:"request_id"`
+	Detail    string    `json:"detail"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (KeyRecoveryAuditEvent) TableName() string {
+	return "key_recovery_audit_events"
+}
+
+// Upload session statuses
+const (
+	UploadSessionStatusActive    = "ACTIVE"
+	UploadSessionStatusCompleted = "COMPLETED"
+	UploadSessionStatusAborted   = "ABORTED"
+	UploadSessionStatusExpired   = "EXPIRED"
+)
+
+// UploadSession tracks a resumable, chunked upload until it is finalized into a UserFile
+type UploadSession struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	SessionToken  string     `gorm:"uniqueIndex;not null" json:"session_token"` // Opaque ID used in upload URLs
+	UserID        uint       `gorm:"not null;index" json:"user_id"`
+	FolderID      *uint      `json:"folder_id"`
+	Filename      string     `gorm:"not null" json:"filename"`
+	MimeType      string     `gorm:"not null" json:"mime_type"`
+	ContentHash   string     `gorm:"not null" json:"content_hash"` // Declared SHA-256 of the complete (encrypted) content
+	EncryptionKey string     `gorm:"not null" json:"-"`
+	TotalSize     int64      `gorm:"not null" json:"total_size"`
+	UploadOffset  int64      `gorm:"not null;default:0" json:"upload_offset"` // Bytes received so far
+	ChunkCount    int        `gorm:"not null;default:0" json:"chunk_count"`
+	ChunkKeys     string     `gorm:"type:text;not null;default:''" json:"-"` // Keys of the accepted chunks, one per line
+	Status        string     `gorm:"not null;index" json:"status"`           // ACTIVE, COMPLETED, ABORTED, EXPIRED
+	UserFileID    *uint      `json:"user_file_id"`                           // Set once the session is finalized
+	ExpiresAt     time.Time  `gorm:"not null;index" json:"expires_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Associations
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (UploadSession) TableName() string {
+	return "upload_sessions"
+}
+
+// Storage integrity statuses, shared by UserFile.IntegrityStatus and StorageIntegrityIssue.Status
+const (
+	IntegrityStatusOK        = "OK"
+	IntegrityStatusCorrupted = "CORRUPTED"
+	IntegrityStatusMissing   = "MISSING"
+)
+
+// StorageIntegrityIssue records a stored object that no longer matches its File record.
+// An issue stays open until a later scrub finds the object intact again.
+type StorageIntegrityIssue struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	FileID        uint       `gorm:"not null;index" json:"file_id"`
+	StoragePath   string     `gorm:"not null" json:"storage_path"`
+	Status        string     `gorm:"not null;index" json:"status"` // CORRUPTED or MISSING
+	ExpectedHash  string     `gorm:"not null" json:"expected_hash"`
+	ActualHash    string     `json:"actual_hash"` // Empty when the object is missing
+	ExpectedSize  int64      `gorm:"not null" json:"expected_size"`
+	ActualSize    int64      `json:"actual_size"`
+	DetectedAt    time.Time  `gorm:"not null" json:"detected_at"`
+	LastCheckedAt time.Time  `gorm:"not null" json:"last_checked_at"`
+	ResolvedAt    *time.Time `gorm:"index" json:"resolved_at"` // Set once the object verifies again
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Associations
+	File File `gorm:"foreignKey:FileID" json:"file,omitempty"`
+}
+
+func (StorageIntegrityIssue) TableName() string {
+	return "storage_integrity_issues"
+}
+
+// FileVersion is an earlier revision of a UserFile. The current revision lives on the
+// UserFile itself; uploading over it or restoring an older one archives it here.
+type FileVersion struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	UserFileID    uint      `gorm:"not null;uniqueIndex:idx_file_versions_user_file_version" json:"user_file_id"`
+	UserID        uint      `gorm:"not null;index" json:"user_id"`
+	VersionNumber int       `gorm:"not null;uniqueIndex:idx_file_versions_user_file_version" json:"version_number"`
+	FileID        uint      `gorm:"not null;index" json:"file_id"`
+	MimeType      string    `gorm:"not null" json:"mime_type"`
+	EncryptionKey string    `gorm:"not null" json:"-"` // Each revision is encrypted with its own key
+	UploadedAt    time.Time `gorm:"not null" json:"uploaded_at"`
+	CreatedAt     time.Time `json:"created_at"` // When the revision stopped being current
+
+	// IsCurrent marks the entry standing in for the UserFile's current revision in listings
+	IsCurrent bool `gorm:"-" json:"is_current"`
+
+	// Associations
+	File File `gorm:"foreignKey:FileID" json:"file,omitempty"`
+}
+
+func (FileVersion) TableName() string {
+	return "file_versions"
+}
+
+// UserTwoFactor holds a user's TOTP secret. It exists while enrollment is pending and
+// stays once the first code has been verified, at which point EnabledAt is set.
+type UserTwoFactor struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          uint       `gorm:"uniqueIndex;not null" json:"user_id"`
+	EncryptedSecret string     `gorm:"not null" json:"-"` // AES-GCM sealed base32 secret
+	EnabledAt       *time.Time `json:"enabled_at"`
+	LastUsedStep    int64      `gorm:"not null;default:0" json:"-"` // Time step of the last accepted code, to refuse replays
+	FailedAttempts  int        `gorm:"not null;default:0" json:"-"`
+	// ChallengesValidAfter invalidates login challenges issued before it, after too many wrong codes
+	ChallengesValidAfter *time.Time `json:"-"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+}
+
+func (UserTwoFactor) TableName() string {
+	return "user_two_factors"
+}
+
+// TwoFactorRecoveryCode is a single-use code that stands in for a TOTP code. Only a
+// bcrypt hash of the code is stored.
+type TwoFactorRecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (TwoFactorRecoveryCode) TableName() string {
+	return "two_factor_recovery_codes"
+}
+
+// PersonalAccessToken is a long-lived credential for scripts and CI. Only a SHA-256 of
+// the token is stored; Scopes is a space separated list of what it may do.
+type PersonalAccessToken struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	Name        string     `gorm:"not null" json:"name"`
+	TokenPrefix string     `gorm:"not null" json:"token_prefix"` // First characters of the token, to tell tokens apart
+	TokenHash   string     `gorm:"uniqueIndex;not null" json:"-"`
+	Scopes      string     `gorm:"not null" json:"scopes"`
+	ExpiresAt   *time.Time `json:"expires_at"` // NULL for tokens that do not expire
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// Associations
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (PersonalAccessToken) TableName() string {
+	return "personal_access_tokens"
+}
+
+// EmailToken is a single-use token mailed to a user to verify their email address or
+// reset their password. Only a SHA-256 of the token is stored, together with the
+// address it was sent to.
+type EmailToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	Purpose   string     `gorm:"not null" json:"purpose"` // verify_email or password_reset
+	Email     string     `gorm:"not null" json:"email"`
+	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Associations
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (EmailToken) TableName() string {
+	return "email_tokens"
+}
+
+// UserIdentity links a user to an account at an external OpenID Connect provider,
+// identified by the provider's issuer and the stable subject it assigns.
+type UserIdentity struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      uint      `gorm:"not null;index" json:"user_id"`
+	Issuer      string    `gorm:"not null;uniqueIndex:idx_user_identities_issuer_subject" json:"issuer"`
+	Subject     string    `gorm:"not null;uniqueIndex:idx_user_identities_issuer_subject" json:"subject"`
+	Email       string    `json:"email"` // Email claim at the last login
+	LastLoginAt time.Time `gorm:"not null" json:"last_login_at"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// Associations
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (UserIdentity) TableName() string {
+	return "user_identities"
+}
+
+// OIDCLoginState holds the state, nonce and PKCE verifier of a single-sign-on login
+// between the redirect to the identity provider and its callback. Each state is used once.
+type OIDCLoginState struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	State        string    `gorm:"uniqueIndex;not null" json:"-"`
+	Nonce        string    `gorm:"not null" json:"-"`
+	CodeVerifier string    `gorm:"not null" json:"-"`
+	ExpiresAt    time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (OIDCLoginState) TableName() string {
+	return "oidc_login_states"
+}
+
+// Login throttle scopes
+const (
+	LoginThrottleScopeAccount = "account"
+	LoginThrottleScopeIP      = "ip"
+)
+
+// LoginThrottle counts recent failed password logins for one account or one client IP
+// address. Accounts are identified by user ID, or by the identifier that was typed when
+// it matches no account, so unknown names are throttled like real ones.
+type LoginThrottle struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Scope         string     `gorm:"not null;uniqueIndex:idx_login_throttles_scope_subject" json:"scope"` // account or ip
+	Subject       string     `gorm:"not null;uniqueIndex:idx_login_throttles_scope_subject" json:"subject"`
+	UserID        *uint      `gorm:"index" json:"user_id"`
+	FailedCount   int        `gorm:"not null;default:0" json:"failed_count"`
+	FirstFailedAt time.Time  `json:"first_failed_at"`
+	LastFailedAt  time.Time  `json:"last_failed_at"`
+	LockedUntil   *time.Time `gorm:"index" json:"locked_until"`
+	LockoutCount  int        `gorm:"not null;default:0" json:"lockout_count"` // Consecutive lockouts, each twice as long as the last
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+
+	// Associations
+	User *User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (LoginThrottle) TableName() string {
+	return "login_throttles"
+}
+
+// Login audit event types
+const (
+	LoginAuditAccountLocked   = "account_locked"
+	LoginAuditIPLocked        = "ip_locked"
+	LoginAuditAccountUnlocked = "account_unlocked"
+)
+
+// LoginAuditEvent records a lockout being applied or lifted.
+type LoginAuditEvent struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	Event      string    `gorm:"not null;index" json:"event"`
+	UserID     *uint     `gorm:"index" json:"user_id"`
+	ActorID    *uint     `json:"actor_id"`   // Admin who lifted the lockout
+	Identifier string    `json:"identifier"` // What was typed at the login that caused a lockout
+	IPAddress  string    `json:"ip_address"`
+	Detail     string    `json:"detail"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+func (LoginAuditEvent) TableName() string {
+	return "login_audit_events"
+}
+
+// Session is one signed-in device. Its SessionID is carried as the jti claim of every
+// access token issued to the device and doubles as the FamilyID of its refresh tokens.
+type Session struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	SessionID  string     `gorm:"uniqueIndex;not null" json:"-"`
+	UserID     uint       `gorm:"not null;index" json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	LastSeenAt time.Time  `gorm:"not null" json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"not null;index" json:"expires_at"` // Extended every time the session is refreshed
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// IsCurrent marks the session the listing was requested from
+	IsCurrent bool `gorm:"-" json:"is_current"`
+
+	// Associations
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
+
+// RefreshToken is one link in a chain of rotating refresh tokens. Every token issued
+// to the same Session shares a FamilyID; only a SHA-256 of the token is stored.
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	FamilyID  string     `gorm:"not null;index" json:"family_id"`
+	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`    // Set when the token is exchanged for its successor
+	RevokedAt *time.Time `json:"revoked_at"` // Set on logout or when reuse is detected
+	CreatedAt time.Time  `json:"created_at"`
+
+	// Associations
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
+
+// SigningKey is an asymmetric key pair used to sign access tokens. Only the newest
+// unretired key signs; retired keys stay published in the JWKS until ExpiresAt so that
+// tokens signed before a rotation keep verifying for the rest of their lifetime.
+type SigningKey struct {
+	ID                  uint       `gorm:"primaryKey" json:"id"`
+	KID                 string     `gorm:"column:kid;uniqueIndex;not null" json:"kid"`
+	Algorithm           string     `gorm:"not null" json:"algorithm"`   // EdDSA or RS256
+	PublicKey           string     `gorm:"type:text;not null" json:"-"` // PEM encoded PKIX public key
+	EncryptedPrivateKey string     `gorm:"type:text" json:"-"`          // Sealed PKCS #8 key, cleared on retirement
+	RetiredAt           *time.Time `gorm:"index" json:"retired_at"`     // When a newer key took over signing
+	ExpiresAt           *time.Time `gorm:"index" json:"expires_at"`     // When the key stops verifying
+	CreatedAt           time.Time  `json:"created_at"`
+}
+
+func (SigningKey) TableName() string {
+	return "signing_keys"
+}
+
+// DownloadTicketRedemption records a single-use download ticket that has been used.
+// Tickets themselves are never stored; rows are only kept until the ticket expires.
+type DownloadTicketRedemption struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TicketID  string    `gorm:"uniqueIndex;not null" json:"ticket_id"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (DownloadTicketRedemption) TableName() string {
+	return "download_ticket_redemptions"
+}
+
+// UserKeyPair is a user's X25519 key pair for end-to-end sharing. The private key is
+// wrapped on the client before it is uploaded, so the server stores it only to hand it
+// back to its owner on another device.
+type UserKeyPair struct {
+	ID                uint      `gorm:"primaryKey" json:"id"`
+	UserID            uint      `gorm:"uniqueIndex;not null" json:"user_id"`
+	PublicKey         string    `gorm:"not null" json:"public_key"`        // Base64 encoded X25519 public key
+	Fingerprint       string    `gorm:"not null;index" json:"fingerprint"` // Hex SHA-256 of the public key
+	WrappedPrivateKey string    `gorm:"type:text;not null" json:"-"`       // Opaque to the server
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+
+	// Associations
+	User User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+func (UserKeyPair) TableName() string {
+	return "user_key_pairs"
+}
+
+// FileKeyGrant is a file key wrapped on the client to a recipient's public key. A grant
+// made for a room lasts as long as the file stays in the room and the recipient stays a
+// member; a grant without a room shares the file with the recipient directly.
+type FileKeyGrant struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	UserFileID     uint      `gorm:"not null;uniqueIndex:idx_file_key_grants_file_recipient" json:"user_file_id"`
+	RecipientID    uint      `gorm:"not null;uniqueIndex:idx_file_key_grants_file_recipient;index" json:"recipient_id"`
+	GranterID      uint      `gorm:"not null" json:"granter_id"`
+	RoomID         *uint     `gorm:"index" json:"room_id"`
+	Version        int       `gorm:"not null" json:"version"`         // Revision of the file whose key is wrapped
+	KeyFingerprint string    `gorm:"not null" json:"key_fingerprint"` // Recipient key the file key is wrapped to
+	WrappedKey     string    `gorm:"type:text;not null" json:"wrapped_key"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+
+	// Associations
+	UserFile  UserFile `gorm:"foreignKey:UserFileID" json:"user_file,omitempty"`
+	Recipient User     `gorm:"foreignKey:RecipientID" json:"recipient,omitempty"`
+	Granter   User     `gorm:"foreignKey:GranterID" json:"granter,omitempty"`
+}
+
+func (FileKeyGrant) TableName() string {
+	return "file_key_grants"
+}
+
+// RoomKey is one version of a room key, wrapped on the client to one member's public
+// key. A new version is made whenever a member leaves, so that content shared to the
+// room afterwards is out of their reach; members keep earlier versions for older files.
+type RoomKey struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	RoomID         uint      `gorm:"not null;uniqueIndex:idx_room_keys_room_version_user" json:"room_id"`
+	Version        int       `gorm:"not null;uniqueIndex:idx_room_keys_room_version_user" json:"version"`
+	UserID         uint      `gorm:"not null;uniqueIndex:idx_room_keys_room_version_user;index" json:"user_id"`
+	KeyFingerprint string    `gorm:"not null" json:"key_fingerprint"` // Member key the room key is wrapped to
+	WrappedKey     string    `gorm:"type:text;not null" json:"wrapped_key"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (RoomKey) TableName() string {
+	return "room_keys"
+}
+
+// ServiceKey is a service-wide key, such as the key that encrypts share passwords,
+// stored wrapped by the configured key provider.
+type ServiceKey struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	Name       string    `gorm:"uniqueIndex:idx_service_keys_name_version;not null" json:"name"`
+	Version    int       `gorm:"uniqueIndex:idx_service_keys_name_version;not null;default:1" json:"version"` // Earlier versions stay for data under them
+	KeyID      string    `gorm:"not null" json:"key_id"`                                                      // Key provider key that wrapped the key
+	WrappedKey string    `gorm:"type:text;not null" json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (ServiceKey) TableName() string {
+	return "service_keys"
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"errors"
 	"time"
 
 	"github.com/balkanid/aegis-backend/internal/config"
@@ -8,14 +9,40 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// defaultAccessTokenTTL is used when no access token lifetime is configured. Access
+// tokens are short-lived and renewed with a refresh token.
+const defaultAccessTokenTTL = 15 * time.Minute
+
+// Challenge tokens prove only the password step of a two-step login. Their audience
+// keeps them from being accepted as access tokens.
+const (
+	twoFactorChallengeAudience = "aegis-2fa-challenge"
+	twoFactorChallengeTTL      = 5 * time.Minute
+)
+
+var errTwoFactorChallenge = errors.New("token is a two-factor login challenge")
+
 type AuthService struct {
-	cfg *config.Config
+	cfg  *config.Config
+	keys *SigningKeyService
+
+	// switchedAt is when signing keys took over from HS256. Older HS256 tokens are
+	// accepted until they expire.
+	switchedAt time.Time
 }
 
+// NewAuthService creates an AuthService that signs tokens with HS256 and the JWT secret
 func NewAuthService(cfg *config.Config) *AuthService {
 	return &AuthService{cfg: cfg}
 }
 
+// NewAuthServiceWithKeys creates an AuthService that signs tokens with the current key
+// of keys and names it in the kid header. HS256 tokens issued before it was created
+// are still accepted, so that switching algorithms does not sign anyone out.
+func NewAuthServiceWithKeys(cfg *config.Config, keys *SigningKeyService) *AuthService {
+	return &AuthService{cfg: cfg, keys: keys, switchedAt: time.Now()}
+}
+
 // Claims represents the JWT claims
 type Claims struct {
 	UserID  uint   `json:"user_id"`
@@ -24,29 +51,86 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
-// GenerateToken creates a JWT token for the user
-func (s *AuthService) GenerateToken(user *models.User) (string, error) {
+// GenerateSessionToken creates a JWT token for the user whose jti claim names the
+// session it belongs to, so that revoking the session also rejects the token
+func (s *AuthService) GenerateSessionToken(user *models.User, sessionID string) (string, error) {
 	claims := &Claims{
 		UserID:  user.ID,
 		Email:   user.Email,
 		IsAdmin: user.IsAdmin,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ID:        sessionID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.AccessTokenTTL())),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.cfg.JWTSecret))
+	return s.sign(claims)
 }
 
+// AccessTokenTTL returns how long issued access tokens stay valid
+func (s *AuthService) AccessTokenTTL() time.Duration {
+	if s.cfg.AccessTokenTTLMinutes > 0 {
+		return time.Duration(s.cfg.AccessTokenTTLMinutes) * time.Minute
+	}
+	return defaultAccessTokenTTL
+}
+
+// GenerateTwoFactorChallenge creates a short-lived token for a user who passed the
+// password check and still has to present a second factor
+func (s *AuthService) GenerateTwoFactorChallenge(user *models.User) (string, error) {
+	claims := &Claims{
+		UserID:  user.ID,
+		Email:   user.Email,
+		IsAdmin: user.IsAdmin,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{twoFactorChallengeAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(twoFactorChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	return s.sign(claims)
+}
+
+// ParseToken parses an access token. Two-factor challenge tokens are rejected.
 func (s *AuthService) ParseToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	for _, audience := range claims.Audience {
+		if audience == twoFactorChallengeAudience {
+			return nil, errTwoFactorChallenge
 		}
-		return []byte(s.cfg.JWTSecret), nil
-	})
+	}
+	return claims, nil
+}
+
+// ParseTwoFactorChallenge parses a token created by GenerateTwoFactorChallenge
+func (s *AuthService) ParseTwoFactorChallenge(tokenString string) (*Claims, error) {
+	return s.parse(tokenString, jwt.WithAudience(twoFactorChallengeAudience))
+}
+
+// sign signs claims with the current signing key, or with the JWT secret when no
+// signing keys are configured
+func (s *AuthService) sign(claims *Claims) (string, error) {
+	if s.keys == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(s.cfg.JWTSecret))
+	}
+
+	key, err := s.keys.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+func (s *AuthService) parse(tokenString string, options ...jwt.ParserOption) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, s.keyFunc, options...)
 
 	if err != nil {
 		return nil, err
@@ -58,3 +142,38 @@ func (s *AuthService) ParseToken(tokenString string) (*Claims, error) {
 
 	return nil, jwt.ErrTokenInvalidClaims
 }
+
+// keyFunc picks the key a token is verified with. The algorithm must be the one the
+// key was created for, so a public key can never be used as an HMAC secret.
+func (s *AuthService) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if s.keys != nil && !s.isLegacyToken(token) {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(s.cfg.JWTSecret), nil
+	}
+	if s.keys == nil {
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := s.keys.verificationKey(kid)
+	if !ok {
+		return nil, jwt.ErrTokenUnverifiable
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.public, nil
+}
+
+// isLegacyToken reports whether an HS256 token was issued before signing keys took over
+// and within one access token lifetime of that
+func (s *AuthService) isLegacyToken(token *jwt.Token) bool {
+	issuedAt, err := token.Claims.GetIssuedAt()
+	if err != nil || issuedAt == nil {
+		return false
+	}
+	switchedAt := s.switchedAt.Truncate(time.Second)
+	return issuedAt.Before(switchedAt) && time.Now().Before(switchedAt.Add(s.AccessTokenTTL()))
+}
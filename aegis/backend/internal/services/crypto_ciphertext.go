@@ -0,0 +1,467 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Ciphertexts written by the server, including files re-encrypted by ReencryptionService,
+// use a self-describing format, so that the algorithm, key derivation and key can change
+// while older ciphertexts stay readable:
+//
+//	magic       4 bytes   "AEGC"
+//	version     1 byte    1
+//	cipher      1 byte    1 nacl-secretbox, 2 aes-gcm, 3 xchacha20-poly1305
+//	kdf         1 byte    0 none, 1 pbkdf2-sha256, 2 argon2id
+//	kdf params            pbkdf2-sha256: 4-byte big-endian iterations, 1-byte salt length, salt
+//	                      argon2id: 4-byte big-endian time and memory in KiB, 1-byte threads,
+//	                      1-byte salt length, salt
+//	key id      1-byte length, key ID (such as a service key name), may be empty
+//	nonce       1-byte length, nonce
+//	ciphertext            the rest, including the authentication tag
+//
+// The AEAD ciphers authenticate the header as additional data. Stored strings hold the
+// format in standard base64. Data without the magic uses one of the legacy layouts, which
+// decryption still accepts: nonce-prefixed secretbox for files, hex or base64 AES-GCM with
+// a separate IV and salt for keys and passwords.
+
+// Ciphers and key derivation functions of the ciphertext format.
+const (
+	CipherNaClSecretbox     = "nacl-secretbox"
+	CipherAESGCM            = "aes-gcm"
+	CipherXChaCha20Poly1305 = "xchacha20-poly1305"
+
+	KDFNone         = ""
+	KDFPBKDF2SHA256 = "pbkdf2-sha256"
+	KDFArgon2id     = "argon2id"
+)
+
+const (
+	ciphertextVersion = 1
+
+	// maxCiphertextHeaderSize bounds the header: magic, version, cipher and kdf bytes,
+	// argon2id parameters, and three fields of at most 255 bytes with their lengths
+	maxCiphertextHeaderSize = 4 + 3 + 9 + 3*256
+)
+
+var (
+	ciphertextMagic = []byte("AEGC")
+	cipherIDs       = map[string]byte{CipherNaClSecretbox: 1, CipherAESGCM: 2, CipherXChaCha20Poly1305: 3}
+	kdfIDs          = map[string]byte{KDFNone: 0, KDFPBKDF2SHA256: 1, KDFArgon2id: 2}
+)
+
+// KDFParams describes how the key of a ciphertext was derived from a password.
+type KDFParams struct {
+	Algorithm  string
+	Iterations uint32 // PBKDF2 iterations, or Argon2id passes
+	MemoryKiB  uint32 // Argon2id only
+	Threads    uint8  // Argon2id only
+	Salt       []byte
+}
+
+// CiphertextHeader describes a ciphertext in the self-describing format.
+type CiphertextHeader struct {
+	Version   byte
+	Algorithm string
+	KDF       KDFParams
+	KeyID     string
+	Nonce     []byte
+}
+
+// IsSealedCiphertext reports whether data starts like a ciphertext in the self-describing format.
+func IsSealedCiphertext(data []byte) bool {
+	return bytes.HasPrefix(data, ciphertextMagic)
+}
+
+// ParseCiphertextHeader reads the header of a ciphertext in the self-describing format,
+// returning it with its length in bytes.
+func ParseCiphertextHeader(data []byte) (*CiphertextHeader, int, error) {
+	if !IsSealedCiphertext(data) {
+		return nil, 0, fmt.Errorf("not a sealed ciphertext")
+	}
+	r := headerReader{data: data, pos: len(ciphertextMagic)}
+
+	header := &CiphertextHeader{Version: r.byte()}
+	if header.Version != ciphertextVersion {
+		return nil, 0, fmt.Errorf("unsupported ciphertext version %d", header.Version)
+	}
+	header.Algorithm = nameForID(cipherIDs, r.byte())
+	if header.Algorithm == "" {
+		return nil, 0, fmt.Errorf("unsupported cipher")
+	}
+	kdfID := r.byte()
+	header.KDF.Algorithm = nameForID(kdfIDs, kdfID)
+	if header.KDF.Algorithm == KDFNone && kdfID != kdfIDs[KDFNone] {
+		return nil, 0, fmt.Errorf("unsupported key derivation function")
+	}
+	switch header.KDF.Algorithm {
+	case KDFPBKDF2SHA256:
+		header.KDF.Iterations = r.uint32()
+		header.KDF.Salt = r.bytes()
+	case KDFArgon2id:
+		header.KDF.Iterations = r.uint32()
+		header.KDF.MemoryKiB = r.uint32()
+		header.KDF.Threads = r.byte()
+		header.KDF.Salt = r.bytes()
+	}
+	header.KeyID = string(r.bytes())
+	header.Nonce = r.bytes()
+
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return header, r.pos, nil
+}
+
+// marshal encodes the header in the self-describing format.
+func (h *CiphertextHeader) marshal() ([]byte, error) {
+	cipherID, ok := cipherIDs[h.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher: %s", h.Algorithm)
+	}
+	kdfID, ok := kdfIDs[h.KDF.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key derivation function: %s", h.KDF.Algorithm)
+	}
+	if len(h.KDF.Salt) > 255 || len(h.KeyID) > 255 || len(h.Nonce) > 255 {
+		return nil, fmt.Errorf("ciphertext header field too long")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(ciphertextMagic)
+	buf.WriteByte(ciphertextVersion)
+	buf.WriteByte(cipherID)
+	buf.WriteByte(kdfID)
+	switch h.KDF.Algorithm {
+	case KDFPBKDF2SHA256:
+		binary.Write(&buf, binary.BigEndian, h.KDF.Iterations)
+		buf.WriteByte(byte(len(h.KDF.Salt)))
+		buf.Write(h.KDF.Salt)
+	case KDFArgon2id:
+		binary.Write(&buf, binary.BigEndian, h.KDF.Iterations)
+		binary.Write(&buf, binary.BigEndian, h.KDF.MemoryKiB)
+		buf.WriteByte(h.KDF.Threads)
+		buf.WriteByte(byte(len(h.KDF.Salt)))
+		buf.Write(h.KDF.Salt)
+	}
+	buf.WriteByte(byte(len(h.KeyID)))
+	buf.WriteString(h.KeyID)
+	buf.WriteByte(byte(len(h.Nonce)))
+	buf.Write(h.Nonce)
+	return buf.Bytes(), nil
+}
+
+// headerReader reads length-prefixed header fields, remembering the first error.
+type headerReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *headerReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data)-r.pos {
+		r.err = fmt.Errorf("ciphertext header is truncated")
+		return nil
+	}
+	field := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return field
+}
+
+func (r *headerReader) byte() byte {
+	if field := r.next(1); field != nil {
+		return field[0]
+	}
+	return 0
+}
+
+func (r *headerReader) uint32() uint32 {
+	if field := r.next(4); field != nil {
+		return binary.BigEndian.Uint32(field)
+	}
+	return 0
+}
+
+func (r *headerReader) bytes() []byte {
+	return r.next(int(r.byte()))
+}
+
+// nameForID returns the name registered for an ID, or "" if there is none.
+func nameForID(ids map[string]byte, id byte) string {
+	for name, registered := range ids {
+		if registered == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// newAEAD creates the AEAD for one of the AEAD ciphers of the format.
+func newAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+		}
+		return cipher.NewGCM(block)
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %s", algorithm)
+	}
+}
+
+// nonceSize returns the nonce length of a cipher of the format.
+func nonceSize(algorithm string) (int, error) {
+	switch algorithm {
+	case CipherNaClSecretbox:
+		return 24, nil
+	case CipherAESGCM:
+		return 12, nil
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NonceSizeX, nil
+	default:
+		return 0, fmt.Errorf("unsupported cipher: %s", algorithm)
+	}
+}
+
+//================================================================================
+// Sealing and Opening
+//================================================================================
+
+// SealCiphertext encrypts plaintext with key in the self-describing format. keyID and kdf
+// are recorded in the header to say which key, or which password derivation, opens it.
+func (c *CryptoManager) SealCiphertext(algorithm string, key, plaintext []byte, keyID string, kdf KDFParams) ([]byte, error) {
+	size, err := nonceSize(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := c.GenerateRandomKey(size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	header := &CiphertextHeader{Version: ciphertextVersion, Algorithm: algorithm, KDF: kdf, KeyID: keyID, Nonce: nonce}
+	headerBytes, err := header.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if algorithm == CipherNaClSecretbox {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid key length: expected 32, got %d", len(key))
+		}
+		var secretboxKey [32]byte
+		var secretboxNonce [24]byte
+		copy(secretboxKey[:], key)
+		copy(secretboxNonce[:], nonce)
+		return secretbox.Seal(headerBytes, plaintext, &secretboxNonce, &secretboxKey), nil
+	}
+
+	aead, err := newAEAD(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(headerBytes, nonce, plaintext, headerBytes), nil
+}
+
+// OpenCiphertext decrypts a ciphertext in the self-describing format with key, using the
+// cipher its header names.
+func (c *CryptoManager) OpenCiphertext(data, key []byte) ([]byte, *CiphertextHeader, error) {
+	return c.openCiphertextTo(nil, data, key)
+}
+
+// openCiphertextTo is OpenCiphertext appending the plaintext to dst, which it writes in
+// place when dst has the capacity.
+func (c *CryptoManager) openCiphertextTo(dst, data, key []byte) ([]byte, *CiphertextHeader, error) {
+	header, headerLen, err := ParseCiphertextHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	headerBytes, body := data[:headerLen], data[headerLen:]
+
+	if header.Algorithm == CipherNaClSecretbox {
+		if len(key) != 32 || len(header.Nonce) != 24 {
+			return nil, nil, fmt.Errorf("invalid key or nonce length")
+		}
+		var secretboxKey [32]byte
+		var secretboxNonce [24]byte
+		copy(secretboxKey[:], key)
+		copy(secretboxNonce[:], header.Nonce)
+		plaintext, ok := secretbox.Open(dst, body, &secretboxNonce, &secretboxKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("failed to decrypt")
+		}
+		return plaintext, header, nil
+	}
+
+	aead, err := newAEAD(header.Algorithm, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(header.Nonce) != aead.NonceSize() {
+		return nil, nil, fmt.Errorf("invalid nonce length")
+	}
+	plaintext, err := aead.Open(dst, header.Nonce, body, headerBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, header, nil
+}
+
+// sealWithPassword seals plaintext under a key derived from password with the configured
+// KDF, recording the salt and derivation parameters in the header, and returns it base64
+// encoded.
+func (c *CryptoManager) sealWithPassword(plaintext []byte, password string) (string, error) {
+	salt, err := c.GenerateSalt()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	kdf := c.currentKDFParams()
+	kdf.Salt = salt
+	key, err := c.deriveKey(password, kdf)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := c.SealCiphertext(c.config.KeyEncryptionAlgorithm, key, plaintext, "", kdf)
+	if err != nil {
+		return "", err
+	}
+	return c.EncodeToBase64(sealed), nil
+}
+
+// openWithPassword opens a ciphertext sealed by sealWithPassword, deriving the key with
+// the parameters recorded in its header.
+func (c *CryptoManager) openWithPassword(data []byte, password string) ([]byte, error) {
+	header, _, err := ParseCiphertextHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.deriveKey(password, header.KDF)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, _, err := c.OpenCiphertext(data, key)
+	return plaintext, err
+}
+
+// currentKDFParams returns the configured password KDF and its parameters, without a salt.
+func (c *CryptoManager) currentKDFParams() KDFParams {
+	if c.config.KDFAlgorithm == KDFPBKDF2SHA256 {
+		return KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: uint32(c.config.PBKDF2Iterations)}
+	}
+	return KDFParams{
+		Algorithm:  KDFArgon2id,
+		Iterations: c.config.Argon2Time,
+		MemoryKiB:  c.config.Argon2MemoryKiB,
+		Threads:    c.config.Argon2Threads,
+	}
+}
+
+// deriveKey derives a key from a password with the given parameters.
+func (c *CryptoManager) deriveKey(password string, kdf KDFParams) ([]byte, error) {
+	switch kdf.Algorithm {
+	case KDFPBKDF2SHA256:
+		if kdf.Iterations == 0 || len(kdf.Salt) == 0 {
+			return nil, fmt.Errorf("invalid PBKDF2 parameters")
+		}
+		return pbkdf2.Key([]byte(password), kdf.Salt, int(kdf.Iterations), c.config.KeyLength, sha256.New), nil
+	case KDFArgon2id:
+		if kdf.Iterations == 0 || kdf.MemoryKiB == 0 || kdf.Threads == 0 || len(kdf.Salt) == 0 {
+			return nil, fmt.Errorf("invalid Argon2id parameters")
+		}
+		return argon2.IDKey([]byte(password), kdf.Salt, kdf.Iterations, kdf.MemoryKiB, kdf.Threads, uint32(c.config.KeyLength)), nil
+	default:
+		return nil, fmt.Errorf("ciphertext is not password protected")
+	}
+}
+
+// decodeSealedText returns the ciphertext held in a stored string if it uses the
+// self-describing format, or false for the legacy hex and base64 layouts.
+func decodeSealedText(text string) ([]byte, bool) {
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || !IsSealedCiphertext(data) {
+		return nil, false
+	}
+	if _, _, err := ParseCiphertextHeader(data); err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// decodeRawFileKey returns a file key stored as plain base64, as clients upload it,
+// rather than wrapped under an envelope key.
+func decodeRawFileKey(text string) ([]byte, bool) {
+	if _, ok := decodeSealedText(text); ok {
+		return nil, false
+	}
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(key) != 32 {
+		return nil, false
+	}
+	return key, true
+}
+
+//================================================================================
+// Algorithm Migration
+//================================================================================
+
+// FileCipher returns the cipher of file data: the one its header names, or nacl-secretbox
+// for the nonce-prefixed layout browsers upload.
+func FileCipher(data []byte) string {
+	if header, _, err := ParseCiphertextHeader(data); err == nil {
+		return header.Algorithm
+	}
+	return CipherNaClSecretbox
+}
+
+// IsDeprecatedAlgorithm reports whether algorithm is listed in AEGIS_DEPRECATED_ALGORITHMS.
+func (c *CryptoManager) IsDeprecatedAlgorithm(algorithm string) bool {
+	for _, deprecated := range c.config.DeprecatedAlgorithms {
+		if deprecated == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDeprecatedText reports whether a stored ciphertext should be re-encrypted, because it
+// uses a legacy layout without a header or a deprecated cipher.
+func (c *CryptoManager) IsDeprecatedText(text string) bool {
+	data, ok := decodeSealedText(text)
+	if !ok {
+		return true
+	}
+	header, _, _ := ParseCiphertextHeader(data)
+	return c.IsDeprecatedAlgorithm(header.Algorithm)
+}
+
+// NeedsKDFUpgrade reports whether a stored password-sealed ciphertext should be sealed
+// again the next time its password is known, because it uses a legacy layout, a different
+// KDF than the configured one, or weaker parameters.
+func (c *CryptoManager) NeedsKDFUpgrade(text string) bool {
+	data, ok := decodeSealedText(text)
+	if !ok {
+		return true
+	}
+	header, _, _ := ParseCiphertextHeader(data)
+	current := c.currentKDFParams()
+	if header.KDF.Algorithm != current.Algorithm {
+		return true
+	}
+	return header.KDF.Iterations < current.Iterations || header.KDF.MemoryKiB < current.MemoryKiB
+}
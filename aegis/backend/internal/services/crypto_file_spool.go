@@ -0,0 +1,133 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// fileCipherOverhead is the tag every file cipher appends: the secretbox tag, and the
+// AES-GCM and XChaCha20-Poly1305 tags, are 16 bytes.
+const fileCipherOverhead = secretbox.Overhead
+
+// legacyFileNonceSize is the secretbox nonce prefixed to files uploaded without a header.
+const legacyFileNonceSize = 24
+
+// DecryptedFile is a decrypted copy of a stored file in a temporary file, which is
+// removed when it is closed.
+type DecryptedFile struct {
+	*os.File
+	Size int64
+}
+
+// Close closes and removes the temporary file.
+func (f *DecryptedFile) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) && err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// DecryptFileToTemp decrypts file data read from ciphertext into a temporary file, so it
+// can be served with Range support. The file ciphers authenticate a file as a whole, so
+// nothing is released until all of it has been checked. The ciphertext is spooled to
+// disk and both it and the plaintext are memory-mapped while the cipher runs, so neither
+// is held on the heap. The caller closes the returned file.
+func (c *CryptoManager) DecryptFileToTemp(ciphertext io.Reader, key []byte) (*DecryptedFile, error) {
+	spool, err := os.CreateTemp("", "aegis-ciphertext-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer (&DecryptedFile{File: spool}).Close()
+
+	size, err := io.Copy(spool, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file data: %w", err)
+	}
+	data, unmapData, err := mapFile(spool, size, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unmapData()
+
+	plainSize, err := filePlaintextSize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := os.CreateTemp("", "aegis-plaintext-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decrypted file: %w", err)
+	}
+	decrypted := &DecryptedFile{File: plain, Size: plainSize}
+	if err := c.decryptFileDataTo(plain, plainSize, data, key); err != nil {
+		decrypted.Close()
+		return nil, err
+	}
+	if _, err := plain.Seek(0, io.SeekStart); err != nil {
+		decrypted.Close()
+		return nil, fmt.Errorf("failed to rewind decrypted file: %w", err)
+	}
+	return decrypted, nil
+}
+
+// decryptFileDataTo decrypts data into the mapped contents of out, sized to the plaintext.
+func (c *CryptoManager) decryptFileDataTo(out *os.File, plainSize int64, data, key []byte) error {
+	if err := out.Truncate(plainSize); err != nil {
+		return fmt.Errorf("failed to size decrypted file: %w", err)
+	}
+	buf, unmap, err := mapFile(out, plainSize, true)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := c.openFileData(buf[:0], data, key)
+	if err == nil && (int64(len(plaintext)) != plainSize || (plainSize > 0 && &plaintext[0] != &buf[0])) {
+		err = fmt.Errorf("file data was not decrypted in place")
+	}
+	if unmapErr := unmap(); err == nil {
+		err = unmapErr
+	}
+	return err
+}
+
+// openFileData decrypts file data like DecryptFileData, appending the plaintext to dst.
+func (c *CryptoManager) openFileData(dst, data, key []byte) ([]byte, error) {
+	if _, _, err := ParseCiphertextHeader(data); err != nil {
+		if len(data) < legacyFileNonceSize || len(key) != 32 {
+			return nil, fmt.Errorf("failed to decrypt file data")
+		}
+		var secretboxKey [32]byte
+		var secretboxNonce [24]byte
+		copy(secretboxKey[:], key)
+		copy(secretboxNonce[:], data[:legacyFileNonceSize])
+		plaintext, ok := secretbox.Open(dst, data[legacyFileNonceSize:], &secretboxNonce, &secretboxKey)
+		if !ok {
+			return nil, fmt.Errorf("failed to decrypt file data")
+		}
+		return plaintext, nil
+	}
+
+	plaintext, _, err := c.openCiphertextTo(dst, data, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file data: %w", err)
+	}
+	return plaintext, nil
+}
+
+// filePlaintextSize returns the size of the plaintext of file data.
+func filePlaintextSize(data []byte) (int64, error) {
+	prefix := legacyFileNonceSize
+	if _, headerLen, err := ParseCiphertextHeader(data); err == nil {
+		prefix = headerLen
+	}
+	size := int64(len(data)) - int64(prefix) - fileCipherOverhead
+	if size < 0 {
+		return 0, fmt.Errorf("file data is too short")
+	}
+	return size, nil
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package services
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of f into memory on platforms without mmap. Writes
+// to the returned buffer are written back to the file by the returned function.
+func mapFile(f *os.File, size int64, write bool) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", f.Name(), err)
+	}
+	return data, func() error {
+		if !write {
+			return nil
+		}
+		_, err := f.WriteAt(data, 0)
+		return err
+	}, nil
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package services
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of f into memory, writable if write is set. Writes
+// reach the file once it is unmapped.
+func mapFile(f *os.File, size int64, write bool) ([]byte, func() error, error) {
+	if size == 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+	prot := syscall.PROT_READ
+	if write {
+		prot |= syscall.PROT_WRITE
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to map %s: %w", f.Name(), err)
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -1,25 +1,48 @@
 package services
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base32"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
 
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/pbkdf2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
 	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
 )
 
+// ServiceKeySharePassword names the service key that encrypts stored share passwords.
+const ServiceKeySharePassword = "share_password"
+
 // CryptoManager provides a centralized interface for all cryptographic operations
 // It consolidates encryption, decryption, key management, and crypto utilities
 type CryptoManager struct {
-	config *config.CryptoConfig
+	config      *config.CryptoConfig
+	keyProvider KeyProvider // Wraps envelope keys and service keys, nil when not configured
+	db          *gorm.DB    // Holds the wrapped service keys, nil without a key provider
+
+	keyringMu               sync.RWMutex
+	sharePasswordKeys       map[int][]byte // Every version of the share password key, by version
+	sharePasswordKeyVersion int            // Version new share passwords are encrypted with
 }
 
 // EncryptedKeyData represents encrypted key data with metadata
@@ -27,6 +50,7 @@ type EncryptedKeyData struct {
 	EncryptedKey string `json:"encrypted_key"`
 	Salt         string `json:"salt"`
 	IV           string `json:"iv"`
+	KDF          string `json:"kdf,omitempty"` // Parameters the salt was derived with, see FormatKDFParams
 }
 
 // FileEncryptionResult represents the result of file encryption
@@ -55,7 +79,9 @@ func NewCryptoManager() (*CryptoManager, error) {
 	}
 
 	return &CryptoManager{
-		config: cryptoConfig,
+		config:                  cryptoConfig,
+		sharePasswordKeys:       map[int][]byte{1: cryptoConfig.SharePasswordKey},
+		sharePasswordKeyVersion: 1,
 	}, nil
 }
 
@@ -76,10 +102,41 @@ func NewCryptoManagerWithConfig(cryptoConfig *config.CryptoConfig) (*CryptoManag
 	}
 
 	return &CryptoManager{
-		config: cryptoConfig,
+		config:                  cryptoConfig,
+		sharePasswordKeys:       map[int][]byte{1: cryptoConfig.SharePasswordKey},
+		sharePasswordKeyVersion: 1,
 	}, nil
 }
 
+// NewCryptoManagerWithKeyProvider creates a crypto manager that wraps envelope keys and
+// service keys with provider. Service keys are kept wrapped in the service_keys table and
+// generated on first start; AEGIS_SHARE_PASSWORD_KEY, if set, only seeds the first version
+// of the share password key so that shares created before the key was stored keep working.
+// Every version of the share password key is loaded, so shares not yet migrated to the
+// current one still open.
+func NewCryptoManagerWithKeyProvider(ctx context.Context, provider KeyProvider, db *database.DB) (*CryptoManager, error) {
+	if provider == nil {
+		return nil, fmt.Errorf("a key provider is required")
+	}
+	cryptoConfig := config.LoadCryptoConfigFromEnv()
+
+	// Validate configuration
+	if err := config.ValidateCryptoConfig(cryptoConfig); err != nil {
+		return nil, fmt.Errorf("invalid crypto configuration: %w", err)
+	}
+
+	c := &CryptoManager{
+		config:      cryptoConfig,
+		keyProvider: provider,
+		db:          db.GetDB(),
+	}
+	if err := c.loadSharePasswordKeys(ctx, cryptoConfig.SharePasswordKey); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
 //================================================================================
 // Key Generation and Management
 //================================================================================
@@ -127,6 +184,58 @@ func (c *CryptoManager) DeriveKeyFromPassword(password string, salt []byte) []by
 	return pbkdf2.Key([]byte(password), salt, c.config.PBKDF2Iterations, c.config.KeyLength, sha256.New)
 }
 
+// LegacyKDFParams returns the current PBKDF2 setting in the form stored alongside legacy
+// salts, so that they can be recorded before the setting changes.
+func (c *CryptoManager) LegacyKDFParams() string {
+	return FormatKDFParams(KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: uint32(c.config.PBKDF2Iterations)})
+}
+
+// FormatKDFParams encodes KDF parameters without the salt, as "pbkdf2-sha256$i=100000" or
+// "argon2id$t=3,m=65536,p=4".
+func FormatKDFParams(kdf KDFParams) string {
+	switch kdf.Algorithm {
+	case KDFPBKDF2SHA256:
+		return fmt.Sprintf("%s$i=%d", kdf.Algorithm, kdf.Iterations)
+	case KDFArgon2id:
+		return fmt.Sprintf("%s$t=%d,m=%d,p=%d", kdf.Algorithm, kdf.Iterations, kdf.MemoryKiB, kdf.Threads)
+	default:
+		return ""
+	}
+}
+
+// ParseKDFParams decodes parameters encoded by FormatKDFParams.
+func ParseKDFParams(text string) (KDFParams, error) {
+	algorithm, params, _ := strings.Cut(text, "$")
+	kdf := KDFParams{Algorithm: algorithm}
+	var err error
+	switch algorithm {
+	case KDFPBKDF2SHA256:
+		_, err = fmt.Sscanf(params, "i=%d", &kdf.Iterations)
+	case KDFArgon2id:
+		_, err = fmt.Sscanf(params, "t=%d,m=%d,p=%d", &kdf.Iterations, &kdf.MemoryKiB, &kdf.Threads)
+	default:
+		return KDFParams{}, fmt.Errorf("unsupported key derivation function: %q", algorithm)
+	}
+	if err != nil || FormatKDFParams(kdf) != text {
+		return KDFParams{}, fmt.Errorf("invalid key derivation parameters: %q", text)
+	}
+	return kdf, nil
+}
+
+// deriveLegacyKey derives the key for a legacy layout whose salt is stored separately.
+// Salts stored without parameters were derived with the current PBKDF2 setting.
+func (c *CryptoManager) deriveLegacyKey(password string, salt []byte, kdfParams string) ([]byte, error) {
+	if kdfParams == "" {
+		return c.DeriveKeyFromPassword(password, salt), nil
+	}
+	kdf, err := ParseKDFParams(kdfParams)
+	if err != nil {
+		return nil, err
+	}
+	kdf.Salt = salt
+	return c.deriveKey(password, kdf)
+}
+
 // ValidatePasswordStrength validates password strength for security
 func (c *CryptoManager) ValidatePasswordStrength(password string) error {
 	if len(password) < 8 {
@@ -227,6 +336,26 @@ func (c *CryptoManager) DecryptFileWithNoncePrefix(encryptedDataWithNonce []byte
 	return c.DecryptFile(ciphertext, nonce, key)
 }
 
+// SealFile encrypts file data in the ciphertext format with the configured file
+// encryption algorithm, which clients can read by its header.
+func (c *CryptoManager) SealFile(data []byte, key []byte) ([]byte, error) {
+	return c.SealCiphertext(c.config.FileEncryptionAlgorithm, key, data, "", KDFParams{})
+}
+
+// DecryptFileData decrypts file data with the cipher named in its header, falling back
+// to the nonce-prefixed secretbox layout of files uploaded without one.
+func (c *CryptoManager) DecryptFileData(data []byte, key []byte) ([]byte, error) {
+	if _, _, err := ParseCiphertextHeader(data); err != nil {
+		return c.DecryptFileWithNoncePrefix(data, key)
+	}
+
+	plaintext, _, err := c.OpenCiphertext(data, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file data: %w", err)
+	}
+	return plaintext, nil
+}
+
 //================================================================================
 // AES-GCM Encryption (for envelope keys and sensitive data)
 //================================================================================
@@ -271,36 +400,29 @@ func (c *CryptoManager) DecryptWithAESGCM(ciphertext []byte, key []byte, iv []by
 // Envelope Encryption (Password-Protected Key Encryption)
 //================================================================================
 
-// EncryptEnvelopeKey encrypts an envelope key with a password-derived key
+// EncryptEnvelopeKey encrypts an envelope key with a password-derived key. The result is
+// sealed in the ciphertext format, which carries the salt and nonce itself, so the
+// returned salt and IV are empty.
 func (c *CryptoManager) EncryptEnvelopeKey(envelopeKey []byte, password string) (encryptedKey, salt, iv string, err error) {
-	// Generate salt and IV
-	saltBytes, err := c.GenerateSalt()
-	if err != nil {
-		return "", "", "", fmt.Errorf("failed to generate salt: %w", err)
-	}
-
-	ivBytes, err := c.GenerateIV()
-	if err != nil {
-		return "", "", "", fmt.Errorf("failed to generate IV: %w", err)
-	}
-
-	// Derive key from password
-	derivedKey := c.DeriveKeyFromPassword(password, saltBytes)
-
-	// Encrypt envelope key
-	encryptedBytes, err := c.EncryptWithAESGCM(envelopeKey, derivedKey, ivBytes)
+	encryptedKey, err = c.sealWithPassword(envelopeKey, password)
 	if err != nil {
 		return "", "", "", fmt.Errorf("failed to encrypt envelope key: %w", err)
 	}
 
-	return c.EncodeToHex(encryptedBytes),
-		c.EncodeToHex(saltBytes),
-		c.EncodeToHex(ivBytes),
-		nil
+	return encryptedKey, "", "", nil
 }
 
-// DecryptEnvelopeKey decrypts an envelope key with a password
-func (c *CryptoManager) DecryptEnvelopeKey(encryptedKey, salt, iv, password string) ([]byte, error) {
+// DecryptEnvelopeKey decrypts an envelope key with a password. Keys in the legacy layout
+// are hex encoded AES-GCM with a separate salt and IV, derived with the parameters in kdf.
+func (c *CryptoManager) DecryptEnvelopeKey(encryptedKey, salt, iv, kdf, password string) ([]byte, error) {
+	if sealed, ok := decodeSealedText(encryptedKey); ok {
+		envelopeKey, err := c.openWithPassword(sealed, password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt envelope key: %w", err)
+		}
+		return envelopeKey, nil
+	}
+
 	// Decode hex strings
 	encryptedBytes, err := c.DecodeFromHex(encryptedKey)
 	if err != nil {
@@ -318,7 +440,10 @@ func (c *CryptoManager) DecryptEnvelopeKey(encryptedKey, salt, iv, password stri
 	}
 
 	// Derive key from password
-	derivedKey := c.DeriveKeyFromPassword(password, saltBytes)
+	derivedKey, err := c.deriveLegacyKey(password, saltBytes, kdf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
 
 	// Decrypt envelope key
 	envelopeKey, err := c.DecryptWithAESGCM(encryptedBytes, derivedKey, ivBytes)
@@ -333,27 +458,28 @@ func (c *CryptoManager) DecryptEnvelopeKey(encryptedKey, salt, iv, password stri
 // File Key Encryption (with Envelope Keys)
 //================================================================================
 
-// EncryptFileKey encrypts a file key with an envelope key
+// EncryptFileKey encrypts a file key with an envelope key, sealed in the ciphertext
+// format with the configured key encryption algorithm. The returned IV is empty.
 func (c *CryptoManager) EncryptFileKey(fileKey []byte, envelopeKey []byte) (encryptedKey, iv string, err error) {
-	// Generate IV
-	ivBytes, err := c.GenerateIV()
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate IV: %w", err)
-	}
-
-	// Encrypt file key
-	encryptedBytes, err := c.EncryptWithAESGCM(fileKey, envelopeKey, ivBytes)
+	sealed, err := c.SealCiphertext(c.config.KeyEncryptionAlgorithm, envelopeKey, fileKey, "", KDFParams{})
 	if err != nil {
 		return "", "", fmt.Errorf("failed to encrypt file key: %w", err)
 	}
 
-	return c.EncodeToHex(encryptedBytes),
-		c.EncodeToHex(ivBytes),
-		nil
+	return c.EncodeToBase64(sealed), "", nil
 }
 
-// DecryptFileKey decrypts a file key with an envelope key
+// DecryptFileKey decrypts a file key with an envelope key. Keys in the legacy layout are
+// hex encoded AES-GCM with a separate IV.
 func (c *CryptoManager) DecryptFileKey(encryptedKey, iv string, envelopeKey []byte) ([]byte, error) {
+	if sealed, ok := decodeSealedText(encryptedKey); ok {
+		fileKey, _, err := c.OpenCiphertext(sealed, envelopeKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt file key: %w", err)
+		}
+		return fileKey, nil
+	}
+
 	// Decode hex strings
 	encryptedBytes, err := c.DecodeFromHex(encryptedKey)
 	if err != nil {
@@ -378,27 +504,36 @@ func (c *CryptoManager) DecryptFileKey(encryptedKey, iv string, envelopeKey []by
 // Share Password Encryption (for secure storage)
 //================================================================================
 
-// EncryptSharePassword encrypts a share password for secure storage
-func (c *CryptoManager) EncryptSharePassword(password string) (string, string, error) {
-	// Generate IV
-	iv, err := c.GenerateIV()
+// EncryptSharePassword encrypts a share password for secure storage, sealed in the
+// ciphertext format under the current version of the share password service key. The
+// returned IV is empty; the key version is to be stored with the share.
+func (c *CryptoManager) EncryptSharePassword(password string) (string, string, int, error) {
+	keyVersion, key := c.currentSharePasswordKey()
+	sealed, err := c.SealCiphertext(c.config.KeyEncryptionAlgorithm, key, []byte(password), ServiceKeySharePassword, KDFParams{})
 	if err != nil {
-		return "", "", fmt.Errorf("failed to generate IV: %w", err)
+		return "", "", 0, fmt.Errorf("failed to encrypt password: %w", err)
 	}
 
-	// Encrypt password with service key
-	encryptedBytes, err := c.EncryptWithAESGCM([]byte(password), c.config.SharePasswordKey, iv)
+	return c.EncodeToBase64(sealed), "", keyVersion, nil
+}
+
+// DecryptSharePassword decrypts a share password stored under the given version of the
+// share password service key. Passwords in the legacy layout are base64 encoded AES-GCM
+// with a separate IV.
+func (c *CryptoManager) DecryptSharePassword(encryptedPassword, iv string, keyVersion int) (string, error) {
+	key, err := c.sharePasswordKey(keyVersion)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to encrypt password: %w", err)
+		return "", err
 	}
 
-	return base64.StdEncoding.EncodeToString(encryptedBytes),
-		base64.StdEncoding.EncodeToString(iv),
-		nil
-}
+	if sealed, ok := decodeSealedText(encryptedPassword); ok {
+		passwordBytes, _, err := c.OpenCiphertext(sealed, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt password: %w", err)
+		}
+		return string(passwordBytes), nil
+	}
 
-// DecryptSharePassword decrypts a stored share password
-func (c *CryptoManager) DecryptSharePassword(encryptedPassword, iv string) (string, error) {
 	// Decode base64 strings
 	encryptedBytes, err := base64.StdEncoding.DecodeString(encryptedPassword)
 	if err != nil {
@@ -411,7 +546,7 @@ func (c *CryptoManager) DecryptSharePassword(encryptedPassword, iv string) (stri
 	}
 
 	// Decrypt password
-	passwordBytes, err := c.DecryptWithAESGCM(encryptedBytes, c.config.SharePasswordKey, ivBytes)
+	passwordBytes, err := c.DecryptWithAESGCM(encryptedBytes, key, ivBytes)
 	if err != nil {
 		return "", fmt.Errorf("failed to decrypt password: %w", err)
 	}
@@ -419,6 +554,288 @@ func (c *CryptoManager) DecryptSharePassword(encryptedPassword, iv string) (stri
 	return string(passwordBytes), nil
 }
 
+// SharePasswordKeyVersion returns the version of the share password service key new share
+// passwords are encrypted with.
+func (c *CryptoManager) SharePasswordKeyVersion() int {
+	keyVersion, _ := c.currentSharePasswordKey()
+	return keyVersion
+}
+
+// RotateSharePasswordKey adds a new version of the share password service key and makes it
+// current. Earlier versions stay in the keyring, so stored share passwords keep opening
+// until the re-encryption job has moved them to the new version.
+func (c *CryptoManager) RotateSharePasswordKey(ctx context.Context) (int, error) {
+	if c.keyProvider == nil || c.db == nil {
+		return 0, fmt.Errorf("rotating the share password key requires a key provider")
+	}
+
+	// Start from the newest stored version, which another instance may have added
+	if err := c.loadSharePasswordKeys(ctx, nil); err != nil {
+		return 0, err
+	}
+	keyVersion := c.SharePasswordKeyVersion() + 1
+
+	key, err := c.GenerateRandomKey(c.config.KeyLength)
+	if err != nil {
+		return 0, err
+	}
+	keyID, wrapped, err := c.keyProvider.WrapKey(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to wrap %s service key: %w", ServiceKeySharePassword, err)
+	}
+
+	// An instance rotating at the same time may store this version first, and everyone
+	// then uses that one
+	stored := models.ServiceKey{Name: ServiceKeySharePassword, Version: keyVersion, KeyID: keyID, WrappedKey: wrapped}
+	if err := c.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&stored).Error; err != nil {
+		return 0, fmt.Errorf("failed to store %s service key: %w", ServiceKeySharePassword, err)
+	}
+	if err := c.loadSharePasswordKeys(ctx, nil); err != nil {
+		return 0, err
+	}
+	return c.SharePasswordKeyVersion(), nil
+}
+
+// ReloadSharePasswordKeys picks up versions of the share password key added by other
+// instances. Without a key provider the keyring is fixed and this does nothing.
+func (c *CryptoManager) ReloadSharePasswordKeys(ctx context.Context) error {
+	if c.db == nil {
+		return nil
+	}
+	return c.loadSharePasswordKeys(ctx, nil)
+}
+
+// currentSharePasswordKey returns the current version of the share password key.
+func (c *CryptoManager) currentSharePasswordKey() (int, []byte) {
+	c.keyringMu.RLock()
+	defer c.keyringMu.RUnlock()
+	return c.sharePasswordKeyVersion, c.sharePasswordKeys[c.sharePasswordKeyVersion]
+}
+
+// sharePasswordKey returns a version of the share password key, reloading the keyring
+// once if the version was added by another instance.
+func (c *CryptoManager) sharePasswordKey(keyVersion int) ([]byte, error) {
+	c.keyringMu.RLock()
+	key, ok := c.sharePasswordKeys[keyVersion]
+	c.keyringMu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if err := c.ReloadSharePasswordKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	c.keyringMu.RLock()
+	key, ok = c.sharePasswordKeys[keyVersion]
+	c.keyringMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown %s service key version %d", ServiceKeySharePassword, keyVersion)
+	}
+	return key, nil
+}
+
+// loadSharePasswordKeys loads every version of the share password key into the keyring
+// and makes the newest current.
+func (c *CryptoManager) loadSharePasswordKeys(ctx context.Context, seed []byte) error {
+	keys, err := c.loadServiceKeys(ctx, c.db, ServiceKeySharePassword, seed)
+	if err != nil {
+		return err
+	}
+
+	c.keyringMu.Lock()
+	defer c.keyringMu.Unlock()
+	c.sharePasswordKeys = keys
+	for keyVersion := range keys {
+		if keyVersion > c.sharePasswordKeyVersion {
+			c.sharePasswordKeyVersion = keyVersion
+		}
+	}
+	c.config.SharePasswordKey = keys[c.sharePasswordKeyVersion]
+	return nil
+}
+
+//================================================================================
+// Key Provider Wrapping (for envelope keys and service keys)
+//================================================================================
+
+// WrapEnvelopeKey wraps a user's envelope key with the key provider, returning the ID of
+// the provider key to store next to the wrapped value.
+func (c *CryptoManager) WrapEnvelopeKey(ctx context.Context, envelopeKey []byte) (keyID, wrapped string, err error) {
+	if c.keyProvider == nil {
+		return "", "", fmt.Errorf("no key provider configured")
+	}
+	keyID, wrapped, err = c.keyProvider.WrapKey(ctx, envelopeKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to wrap envelope key: %w", err)
+	}
+	return keyID, wrapped, nil
+}
+
+// UnwrapEnvelopeKey unwraps a user's envelope key. An empty key ID marks a legacy key
+// stored as plain hex before envelope keys were wrapped.
+func (c *CryptoManager) UnwrapEnvelopeKey(ctx context.Context, keyID, wrapped string) ([]byte, error) {
+	if keyID == "" {
+		return c.DecodeFromHex(wrapped)
+	}
+	if c.keyProvider == nil {
+		return nil, fmt.Errorf("no key provider configured")
+	}
+	envelopeKey, err := c.keyProvider.UnwrapKey(ctx, keyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap envelope key: %w", err)
+	}
+	return envelopeKey, nil
+}
+
+// loadServiceKeys unwraps every version of the named service key. When none is stored yet
+// it generates the first version, or uses seed if given, and stores it wrapped.
+func (c *CryptoManager) loadServiceKeys(ctx context.Context, db *gorm.DB, name string, seed []byte) (map[int][]byte, error) {
+	var stored models.ServiceKey
+	err := db.Where("name = ?", name).Order("version").First(&stored).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		key := seed
+		if key == nil {
+			if key, err = c.GenerateRandomKey(c.config.KeyLength); err != nil {
+				return nil, err
+			}
+		}
+		var keyID, wrapped string
+		if keyID, wrapped, err = c.keyProvider.WrapKey(ctx, key); err != nil {
+			return nil, fmt.Errorf("failed to wrap %s service key: %w", name, err)
+		}
+
+		// Another instance starting at the same time may store its key first, and
+		// everyone then uses that one
+		stored = models.ServiceKey{Name: name, Version: 1, KeyID: keyID, WrappedKey: wrapped}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&stored).Error; err != nil {
+			return nil, fmt.Errorf("failed to store %s service key: %w", name, err)
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s service key: %w", name, err)
+	}
+
+	var versions []models.ServiceKey
+	if err := db.Where("name = ?", name).Order("version").Find(&versions).Error; err != nil {
+		return nil, fmt.Errorf("failed to load %s service key: %w", name, err)
+	}
+	keys := make(map[int][]byte, len(versions))
+	for _, version := range versions {
+		key, err := c.keyProvider.UnwrapKey(ctx, version.KeyID, version.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap %s service key version %d: %w", name, version.Version, err)
+		}
+		if len(key) != c.config.KeyLength {
+			return nil, fmt.Errorf("stored %s service key version %d has length %d, expected %d", name, version.Version, len(key), c.config.KeyLength)
+		}
+		keys[version.Version] = key
+	}
+	if seed != nil && !hmac.Equal(seed, keys[1]) {
+		log.Printf("WARNING: the stored %s service key differs from the one in the environment, which is ignored", name)
+	}
+	return keys, nil
+}
+
+//================================================================================
+// Recovery Keys and Key Escrow
+//================================================================================
+
+// recoveryKeyEncoding prints recovery keys in unpadded base32, which survives being
+// written down and typed back in.
+var recoveryKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryKey generates an X25519 key pair for recovering an envelope key. The
+// private key is returned formatted for printing, in dash-separated groups of four
+// characters, and must not be stored.
+func (c *CryptoManager) GenerateRecoveryKey() (recoveryKey string, publicKey []byte, err error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate recovery key: %w", err)
+	}
+
+	encoded := recoveryKeyEncoding.EncodeToString(private[:])
+	groups := make([]string, 0, len(encoded)/4+1)
+	for len(encoded) > 4 {
+		groups = append(groups, encoded[:4])
+		encoded = encoded[4:]
+	}
+	return strings.Join(append(groups, encoded), "-"), public[:], nil
+}
+
+// ParseRecoveryKey decodes a printed recovery key into its X25519 private key. Case,
+// spaces and dashes are ignored.
+func ParseRecoveryKey(recoveryKey string) ([]byte, error) {
+	cleaned := strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, recoveryKey)
+
+	privateKey, err := recoveryKeyEncoding.DecodeString(cleaned)
+	if err != nil || len(privateKey) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("malformed recovery key")
+	}
+	return privateKey, nil
+}
+
+// RecoveryPublicKey returns the X25519 public key of a recovery or escrow private key
+func RecoveryPublicKey(privateKey []byte) ([]byte, error) {
+	return curve25519.X25519(privateKey, curve25519.Basepoint)
+}
+
+// SealEnvelopeKey seals an envelope key to an X25519 public key, so that only the holder
+// of the matching private key can open it.
+func (c *CryptoManager) SealEnvelopeKey(envelopeKey, publicKey []byte) (string, error) {
+	if len(publicKey) != curve25519.PointSize {
+		return "", fmt.Errorf("invalid public key length: %d", len(publicKey))
+	}
+	var recipient [32]byte
+	copy(recipient[:], publicKey)
+
+	sealed, err := box.SealAnonymous(nil, envelopeKey, &recipient, rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to seal envelope key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenEnvelopeKey opens an envelope key sealed by SealEnvelopeKey with the private key
+// matching the public key it was sealed to.
+func (c *CryptoManager) OpenEnvelopeKey(sealed string, privateKey []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sealed envelope key: %w", err)
+	}
+	publicKey, err := RecoveryPublicKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	var public, private [32]byte
+	copy(public[:], publicKey)
+	copy(private[:], privateKey)
+	envelopeKey, ok := box.OpenAnonymous(nil, data, &public, &private)
+	if !ok {
+		return nil, fmt.Errorf("failed to open sealed envelope key")
+	}
+	return envelopeKey, nil
+}
+
+// EscrowPublicKey returns the organization escrow public key, or nil when key escrow is
+// not enabled.
+func (c *CryptoManager) EscrowPublicKey() []byte {
+	if c.config.KeyEscrowPublicKey == "" {
+		return nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(c.config.KeyEscrowPublicKey)
+	if err != nil {
+		return nil // Rejected by ValidateCryptoConfig
+	}
+	return publicKey
+}
+
 //================================================================================
 // Utility Functions
 //================================================================================
@@ -454,8 +871,11 @@ func (c *CryptoManager) SetSharePasswordKey(key []byte) error {
 	if len(key) != c.config.KeyLength {
 		return fmt.Errorf("invalid key length: expected %d, got %d", c.config.KeyLength, len(key))
 	}
+	c.keyringMu.Lock()
+	defer c.keyringMu.Unlock()
 	c.config.SharePasswordKey = make([]byte, len(key))
 	copy(c.config.SharePasswordKey, key)
+	c.sharePasswordKeys[c.sharePasswordKeyVersion] = c.config.SharePasswordKey
 	return nil
 }
 
@@ -512,7 +932,10 @@ func (c *CryptoManager) DecryptFileKeyWithPassword(encryptedKeyData *EncryptedKe
 	}
 
 	// Derive key from password
-	derivedKey := c.DeriveKeyFromPassword(password, salt)
+	derivedKey, err := c.deriveLegacyKey(password, salt, encryptedKeyData.KDF)
+	if err != nil {
+		return nil, err
+	}
 
 	// Decrypt file key
 	fileKey, err := c.DecryptWithAESGCM(encryptedBytes, derivedKey, iv)
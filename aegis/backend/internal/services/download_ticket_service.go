@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+// What a DownloadTicket grants access to
+const (
+	DownloadTicketFile  = "file"
+	DownloadTicketShare = "share"
+)
+
+const (
+	defaultDownloadTicketTTL = 5 * time.Minute
+
+	downloadTicketCleanupEvery = time.Hour
+)
+
+// DownloadTicket is the signed content of a download ticket.
+type DownloadTicket struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	UserID      uint   `json:"uid,omitempty"`  // Who the ticket was issued to; share tickets: the signed-in recipient, if any
+	UserFileID  uint   `json:"file,omitempty"` // File tickets: the file
+	Version     int    `json:"ver,omitempty"`  // File tickets: an earlier revision, or 0 for the current one
+	FileShareID uint   `json:"share,omitempty"`
+	SealedKey   string `json:"key,omitempty"` // Share tickets: the file key, encrypted for the server
+	ExpiresAt   int64  `json:"exp"`
+	SingleUse   bool   `json:"once,omitempty"`
+}
+
+// DownloadTicketService issues and redeems download tickets: short-lived, HMAC-signed
+// strings that grant one download route access to one file or share. Tickets stand in
+// for credentials in download URLs, which end up in logs and browser history. They are
+// verified without a database lookup; only single-use tickets are recorded, once used,
+// until they expire. Tickets consist of URL-safe characters only.
+type DownloadTicketService struct {
+	*BaseService
+	ttl        time.Duration
+	singleUse  bool
+	signingKey []byte
+	sealKey    []byte
+}
+
+// NewDownloadTicketService creates a new DownloadTicketService.
+func NewDownloadTicketService(cfg *config.Config, db *database.DB) *DownloadTicketService {
+	signingKey, err := hkdf.Key(sha256.New, []byte(cfg.JWTSecret), nil, "aegis download ticket", 32)
+	if err != nil {
+		// Only possible for an invalid key length
+		panic(err)
+	}
+	sealKey, err := hkdf.Key(sha256.New, []byte(cfg.JWTSecret), nil, "aegis download ticket key", 32)
+	if err != nil {
+		panic(err)
+	}
+
+	ttl := time.Duration(cfg.DownloadTicketTTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = defaultDownloadTicketTTL
+	}
+
+	return &DownloadTicketService{
+		BaseService: NewBaseService(db),
+		ttl:         ttl,
+		singleUse:   cfg.DownloadTicketSingleUse,
+		signingKey:  signingKey,
+		sealKey:     sealKey,
+	}
+}
+
+//================================================================================
+// Tickets
+//================================================================================
+
+// IssueFileTicket issues a ticket for userID to download a file, or one of its earlier
+// revisions when version is not 0. Access is checked again when the ticket is used.
+func (s *DownloadTicketService) IssueFileTicket(userID, userFileID uint, version int) (string, error) {
+	return s.issue(&DownloadTicket{
+		Kind:       DownloadTicketFile,
+		UserID:     userID,
+		UserFileID: userFileID,
+		Version:    version,
+	})
+}
+
+// IssueShareTicket issues a ticket to download a shared file whose key was unlocked
+// with the share's password. The key travels inside the ticket, encrypted so that only
+// the server can read it. recipientID names the signed-in user who unlocked the share,
+// or is 0 for anonymous recipients, so shares restricted to emails can be checked again
+// when the file is downloaded.
+func (s *DownloadTicketService) IssueShareTicket(fileShareID, recipientID uint, fileKey []byte) (string, error) {
+	sealed, err := s.sealFileKey(fileKey)
+	if err != nil {
+		return "", err
+	}
+	return s.issue(&DownloadTicket{
+		Kind:        DownloadTicketShare,
+		UserID:      recipientID,
+		FileShareID: fileShareID,
+		SealedKey:   sealed,
+	})
+}
+
+// Redeem verifies a ticket of the given kind and, for single-use tickets, records its
+// use. Every failure is reported the same way.
+func (s *DownloadTicketService) Redeem(ticket, kind string) (*DownloadTicket, error) {
+	invalid := apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired download ticket")
+
+	payload, signature, ok := strings.Cut(ticket, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return nil, invalid
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, invalid
+	}
+	var claims DownloadTicket
+	if err := json.Unmarshal(decoded, &claims); err != nil {
+		return nil, invalid
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if claims.Kind != kind || claims.ID == "" || !time.Now().Before(expiresAt) {
+		return nil, invalid
+	}
+
+	if claims.SingleUse {
+		// Inserting the ticket ID claims it, so concurrent uses cannot both succeed
+		result := s.db.GetDB().Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.DownloadTicketRedemption{TicketID: claims.ID, ExpiresAt: expiresAt})
+		if result.Error != nil {
+			return nil, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to redeem download ticket")
+		}
+		if result.RowsAffected == 0 {
+			return nil, invalid
+		}
+	}
+	return &claims, nil
+}
+
+// FileKey returns the file key carried by a share ticket.
+func (s *DownloadTicketService) FileKey(ticket *DownloadTicket) ([]byte, error) {
+	if ticket.SealedKey == "" {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "download ticket carries no file key")
+	}
+	return s.openFileKey(ticket.SealedKey)
+}
+
+// CleanupExpired forgets used single-use tickets that have expired anyway.
+func (s *DownloadTicketService) CleanupExpired() (int64, error) {
+	result := s.db.GetDB().Where("expires_at < ?", time.Now()).Delete(&models.DownloadTicketRedemption{})
+	if result.Error != nil {
+		return 0, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to clean up download tickets")
+	}
+	return result.RowsAffected, nil
+}
+
+// StartCleanupWorker runs CleanupExpired every hour until ctx is cancelled.
+func (s *DownloadTicketService) StartCleanupWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(downloadTicketCleanupEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := s.CleanupExpired(); err != nil {
+					log.Printf("Warning: Download ticket cleanup failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+func (s *DownloadTicketService) issue(claims *DownloadTicket) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate download ticket")
+	}
+	claims.ID = base64.RawURLEncoding.EncodeToString(id)
+	claims.ExpiresAt = time.Now().Add(s.ttl).Unix()
+	claims.SingleUse = s.singleUse
+
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encode download ticket")
+	}
+	payload := base64.RawURLEncoding.EncodeToString(encoded)
+	return payload + "." + s.sign(payload), nil
+}
+
+func (s *DownloadTicketService) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *DownloadTicketService) sealFileKey(fileKey []byte) (string, error) {
+	gcm, err := s.fileKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate nonce")
+	}
+	sealed := gcm.Seal(nonce, nonce, fileKey, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (s *DownloadTicketService) openFileKey(sealedKey string) ([]byte, error) {
+	gcm, err := s.fileKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(sealedKey)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired download ticket")
+	}
+	fileKey, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired download ticket")
+	}
+	return fileKey, nil
+}
+
+func (s *DownloadTicketService) fileKeyCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.sealKey)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create GCM")
+	}
+	return gcm, nil
+}
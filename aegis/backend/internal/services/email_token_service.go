@@ -0,0 +1,387 @@
+package services
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/utils"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+// Purposes an EmailToken can be issued for
+const (
+	EmailTokenPurposeVerifyEmail   = "verify_email"
+	EmailTokenPurposePasswordReset = "password_reset"
+	EmailTokenPurposeUnlockAccount = "unlock_account"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	passwordResetTTL     = time.Hour
+	accountUnlockTTL     = 24 * time.Hour
+
+	// emailTokenResendInterval limits how often mail of one kind is sent to a user
+	emailTokenResendInterval = time.Minute
+
+	emailDeliveryTimeout = 30 * time.Second
+)
+
+// EmailTokenService sends email verification, password reset and account unlock links. Tokens are
+// signed with a key derived from the JWT secret, so forged tokens are rejected
+// without a database lookup, and each can be redeemed once.
+type EmailTokenService struct {
+	*BaseService
+	mailSender  MailSender
+	frontendURL string
+	signingKey  []byte
+}
+
+// NewEmailTokenService creates a new EmailTokenService.
+func NewEmailTokenService(cfg *config.Config, db *database.DB, mailSender MailSender) *EmailTokenService {
+	signingKey, err := hkdf.Key(sha256.New, []byte(cfg.JWTSecret), nil, "aegis email token", 32)
+	if err != nil {
+		// Only possible for an invalid key length
+		panic(err)
+	}
+
+	return &EmailTokenService{
+		BaseService: NewBaseService(db),
+		mailSender:  mailSender,
+		frontendURL: strings.TrimSuffix(cfg.FrontendURL, "/"),
+		signingKey:  signingKey,
+	}
+}
+
+//================================================================================
+// Email Verification
+//================================================================================
+
+// SendVerificationEmail mails the user a link that verifies their current address.
+func (s *EmailTokenService) SendVerificationEmail(user *models.User) error {
+	if user.EmailVerified {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "email address is already verified")
+	}
+
+	token, err := s.issueToken(user, EmailTokenPurposeVerifyEmail, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "a verification email was sent recently, please try again in a minute")
+	}
+
+	msg := MailMessage{
+		To:      user.Email,
+		Subject: "Verify your Aegis email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm that this is your email address by opening the link below:\n\n%s\n\nThe link expires in %d hours. If you did not create an Aegis account, you can ignore this email.\n",
+			user.Username, s.link("/verify-email", token), int(emailVerificationTTL.Hours())),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), emailDeliveryTimeout)
+	defer cancel()
+	return s.mailSender.Send(ctx, msg)
+}
+
+// VerifyEmail redeems a verification token and marks the address it was sent to as
+// verified. Tokens for an address the user has since changed are rejected.
+func (s *EmailTokenService) VerifyEmail(token string) (*models.User, error) {
+	var user models.User
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		emailToken, err := s.consumeToken(tx, token, EmailTokenPurposeVerifyEmail)
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&user, emailToken.UserID).Error; err != nil {
+			return err
+		}
+		if !strings.EqualFold(user.Email, emailToken.Email) {
+			return apperrors.New(apperrors.ErrCodeInvalidArgument, "this link was sent to an email address that is no longer on the account")
+		}
+		user.EmailVerified = true
+		return tx.Model(&user).Update("email_verified", true).Error
+	})
+	if err != nil {
+		return nil, wrapEmailTokenError(err)
+	}
+	return &user, nil
+}
+
+//================================================================================
+// Password Reset
+//================================================================================
+
+// RequestPasswordReset mails a reset link to the account with the given email. To avoid
+// revealing which addresses have accounts, it succeeds whether or not one exists, and
+// the mail is delivered in the background so the response time does not tell either.
+func (s *EmailTokenService) RequestPasswordReset(email string) error {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "email is required")
+	}
+
+	var user models.User
+	if err := s.db.GetDB().Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	token, err := s.issueToken(&user, EmailTokenPurposePasswordReset, passwordResetTTL)
+	if err != nil || token == "" {
+		return err
+	}
+
+	msg := MailMessage{
+		To:      user.Email,
+		Subject: "Reset your Aegis password",
+		Body: fmt.Sprintf("Hello %s,\n\nA password reset was requested for your Aegis account. Open the link below to choose a new password:\n\n%s\n\nThe link expires in %d minutes and can only be used once. If you did not ask for this, you can ignore this email; your password has not been changed.\n",
+			user.Username, s.link("/reset-password", token), int(passwordResetTTL.Minutes())),
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailDeliveryTimeout)
+		defer cancel()
+		if err := s.mailSender.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// ResetPassword redeems a reset token and sets a new password. Every session of the
+// user is signed out, and since the link arrived by email the address counts as verified.
+func (s *EmailTokenService) ResetPassword(token, newPassword string) error {
+	// Checked first so that a rejected password does not use up the link
+	if result := utils.ValidatePassword(newPassword, utils.DefaultPasswordRequirements()); result.HasErrors() {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "password validation failed: "+strings.Join(result.Errors, ", "))
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to hash password")
+	}
+
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		emailToken, err := s.consumeToken(tx, token, EmailTokenPurposePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.First(&user, emailToken.UserID).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"password_hash": string(hashedPassword),
+			"updated_at":    time.Now(),
+		}
+		if strings.EqualFold(user.Email, emailToken.Email) {
+			updates["email_verified"] = true
+		}
+		if err := tx.Model(&user).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		// Other reset links stop working once the password has been changed
+		if err := tx.Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, EmailTokenPurposePasswordReset).
+			Delete(&models.EmailToken{}).Error; err != nil {
+			return err
+		}
+		if _, err := revokeUserSessions(tx, user.ID, ""); err != nil {
+			return err
+		}
+
+		// Resetting the password proves control of the address, just like an unlock link
+		wasLocked, err := clearAccountLockout(tx, user.ID)
+		if err != nil || !wasLocked {
+			return err
+		}
+		return tx.Create(&models.LoginAuditEvent{
+			Event:  models.LoginAuditAccountUnlocked,
+			UserID: &user.ID,
+			Detail: "unlocked by password reset",
+		}).Error
+	})
+	return wrapEmailTokenError(err)
+}
+
+//================================================================================
+// Account Unlock
+//================================================================================
+
+// SendAccountUnlockEmail tells a user their account was locked after too many failed
+// logins and mails a link that lifts the lockout. Like reset mail, it is delivered in
+// the background.
+func (s *EmailTokenService) SendAccountUnlockEmail(user *models.User) error {
+	token, err := s.issueToken(user, EmailTokenPurposeUnlockAccount, accountUnlockTTL)
+	if err != nil || token == "" {
+		return err
+	}
+
+	msg := MailMessage{
+		To:      user.Email,
+		Subject: "Your Aegis account has been locked",
+		Body: fmt.Sprintf("Hello %s,\n\nYour Aegis account was locked after too many failed login attempts. If these were you, open the link below to unlock it now, or wait for the lockout to end:\n\n%s\n\nIf you did not try to sign in, someone may be guessing your password. Unlocking does not change your password; consider resetting it.\n",
+			user.Username, s.link("/unlock-account", token)),
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), emailDeliveryTimeout)
+		defer cancel()
+		if err := s.mailSender.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send account unlock email to user %d: %v", user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// UnlockAccount redeems an unlock token, lifting the lockout of its user and
+// forgetting their failed logins.
+func (s *EmailTokenService) UnlockAccount(token string) error {
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		emailToken, err := s.consumeToken(tx, token, EmailTokenPurposeUnlockAccount)
+		if err != nil {
+			return err
+		}
+		if _, err := clearAccountLockout(tx, emailToken.UserID); err != nil {
+			return err
+		}
+		return tx.Create(&models.LoginAuditEvent{
+			Event:  models.LoginAuditAccountUnlocked,
+			UserID: &emailToken.UserID,
+			Detail: "unlocked by email link",
+		}).Error
+	})
+	return wrapEmailTokenError(err)
+}
+
+//================================================================================
+// Token Handling
+//================================================================================
+
+// issueToken creates a token for the user's current address, replacing unused tokens
+// of the same purpose. It returns an empty token, and sends nothing, when one was
+// issued less than emailTokenResendInterval ago.
+func (s *EmailTokenService) issueToken(user *models.User, purpose string, ttl time.Duration) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate token")
+	}
+	value := base64.RawURLEncoding.EncodeToString(random)
+	token := value + "." + s.sign(purpose, value)
+
+	issued := false
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var recent int64
+		if err := tx.Model(&models.EmailToken{}).
+			Where("user_id = ? AND purpose = ? AND created_at > ?", user.ID, purpose, time.Now().Add(-emailTokenResendInterval)).
+			Count(&recent).Error; err != nil {
+			return err
+		}
+		if recent > 0 {
+			return nil
+		}
+
+		if err := tx.Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).
+			Delete(&models.EmailToken{}).Error; err != nil {
+			return err
+		}
+		issued = true
+		return tx.Create(&models.EmailToken{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			Email:     user.Email,
+			TokenHash: hashEmailToken(value),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to issue email token")
+	}
+	if !issued {
+		return "", nil
+	}
+	return token, nil
+}
+
+// consumeToken checks a token's signature and marks its record used. Signatures bind
+// the purpose, so a verification link cannot be replayed as a reset link.
+func (s *EmailTokenService) consumeToken(tx *gorm.DB, token, purpose string) (*models.EmailToken, error) {
+	invalid := apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired link")
+
+	value, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.sign(purpose, value))) {
+		return nil, invalid
+	}
+
+	var emailToken models.EmailToken
+	if err := tx.Where("token_hash = ? AND purpose = ?", hashEmailToken(value), purpose).First(&emailToken).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, invalid
+		}
+		return nil, err
+	}
+	if emailToken.UsedAt != nil || time.Now().After(emailToken.ExpiresAt) {
+		return nil, invalid
+	}
+
+	// The conditional update claims the token, so concurrent redemptions cannot both succeed
+	result := tx.Model(&models.EmailToken{}).
+		Where("id = ? AND used_at IS NULL", emailToken.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, invalid
+	}
+	return &emailToken, nil
+}
+
+func (s *EmailTokenService) sign(purpose, value string) string {
+	mac := hmac.New(sha256.New, s.signingKey)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *EmailTokenService) link(path, token string) string {
+	return s.frontendURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// hashEmailToken returns the SHA-256 under which a token's random part is stored.
+func hashEmailToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// wrapEmailTokenError passes application errors through and wraps the rest.
+func wrapEmailTokenError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var appErr *apperrors.Error
+	if errors.As(err, &appErr) {
+		return err
+	}
+	return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+}
@@ -3,7 +3,10 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +14,7 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	apperrors "github.com/balkanid/aegis-backend/internal/errors"
 	"gorm.io/gorm"
@@ -21,12 +25,16 @@ import (
 	"github.com/balkanid/aegis-backend/internal/repositories"
 )
 
+// uploadStagingPrefix holds uploads while their content hash is being verified.
+const uploadStagingPrefix = "staging"
+
 type FileService struct {
 	*BaseService
 	userResourceRepo   *repositories.UserResourceRepository
 	fileStorageService *FileStorageService
 	cfg                *config.Config
 	authService        *AuthService
+	downloadTickets    *DownloadTicketService
 }
 
 func NewFileService(cfg *config.Config, db *database.DB, fileStorageService *FileStorageService, authService *AuthService) *FileService {
@@ -36,6 +44,7 @@ func NewFileService(cfg *config.Config, db *database.DB, fileStorageService *Fil
 		cfg:                cfg,
 		fileStorageService: fileStorageService,
 		authService:        authService,
+		downloadTickets:    NewDownloadTicketService(cfg, db),
 	}
 }
 
@@ -100,9 +109,41 @@ func (s *FileService) UploadFileFromMap(userID uint, data map[string]interface{}
 	)
 }
 
+// UploadFile stores an upload and links it to the user. The declared content hash is
+// never trusted on its own: the bytes are hashed while they are written to a staging
+// object, and only a verified upload may be deduplicated against an existing File.
+// Otherwise anyone who learned a hash could claim the matching blob without holding it.
 func (s *FileService) UploadFile(userID uint, filename, mimeType, contentHash, encryptionKey string, fileData io.Reader, sizeBytes int64, folderID *uint) (*models.UserFile, error) {
+	ctx := context.Background()
 	db := s.db.GetDB()
 
+	stagingPath, err := s.stageUpload(ctx, userID, contentHash, mimeType, fileData, sizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	contentHash = strings.ToLower(contentHash)
+
+	// Whatever happens below, the staging object must not outlive this call, and a blob
+	// promoted for a File record that was never committed must not be left behind.
+	staged, promotedPath, committed := true, "", false
+	defer func() {
+		if staged {
+			if err := s.fileStorageService.DeleteFile(ctx, stagingPath); err != nil {
+				log.Printf("Warning: Failed to delete staged upload %s: %v", stagingPath, err)
+			}
+		}
+		if promotedPath != "" && !committed {
+			// A concurrent upload of the same content may have committed a File at this path
+			var references int64
+			if err := db.Model(&models.File{}).Where("storage_path = ?", promotedPath).Count(&references).Error; err != nil || references > 0 {
+				return
+			}
+			if err := s.fileStorageService.DeleteFile(ctx, promotedPath); err != nil {
+				log.Printf("Warning: Failed to delete uncommitted upload %s: %v", promotedPath, err)
+			}
+		}
+	}()
+
 	// Use a transaction to handle concurrent uploads safely
 	tx := db.Begin()
 	if tx.Error != nil {
@@ -114,34 +155,32 @@ func (s *FileService) UploadFile(userID uint, filename, mimeType, contentHash, e
 		}
 	}()
 
-	// Check for existing file
+	// Check for existing file. The staged copy proved the content, so it is safe to reuse.
 	var existingFile models.File
-	err := tx.Where("content_hash = ?", contentHash).First(&existingFile).Error
+	err = tx.Where("content_hash = ?", contentHash).First(&existingFile).Error
 
 	var file *models.File
-	var storagePath string
 
 	if err == nil {
 		file = &existingFile
-		storagePath = existingFile.StoragePath
 	} else if errors.Is(err, gorm.ErrRecordNotFound) {
-		storagePath = fmt.Sprintf("%d/%s", userID, contentHash)
-		if err := s.fileStorageService.UploadFile(context.Background(), storagePath, fileData, sizeBytes, mimeType); err != nil {
-			tx.Rollback()
-			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to upload file to storage")
-		}
-
 		file = &models.File{
 			ContentHash: contentHash,
 			SizeBytes:   sizeBytes,
-			StoragePath: storagePath,
+			StoragePath: fmt.Sprintf("%d/%s", userID, contentHash),
 		}
 
+		// Create the record first so a failed promotion simply rolls it back
 		if err := tx.Create(file).Error; err != nil {
-			s.fileStorageService.DeleteFile(context.Background(), storagePath)
 			tx.Rollback()
 			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create file record")
 		}
+
+		if err := s.fileStorageService.RenameFile(ctx, stagingPath, file.StoragePath, mimeType); err != nil {
+			tx.Rollback()
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to upload file to storage")
+		}
+		staged, promotedPath = false, file.StoragePath
 	} else {
 		tx.Rollback()
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error checking for existing file")
@@ -188,20 +227,41 @@ func (s *FileService) UploadFile(userID uint, filename, mimeType, contentHash, e
 	}
 	var existingNameUserFile models.UserFile
 	if err := query.First(&existingNameUserFile).Error; err == nil {
-		tx.Rollback()
-		return nil, apperrors.New(apperrors.ErrCodeConflict, "A file with this name already exists in this folder")
+		// Uploading over an existing name adds a new version of that file
+		if err := s.addFileVersion(tx, &existingNameUserFile, file.ID, mimeType, encryptionKey); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to commit transaction")
+		}
+		committed = true
+
+		db.Preload("File").First(&existingNameUserFile, existingNameUserFile.ID)
+		return &existingNameUserFile, nil
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
 		tx.Rollback()
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error checking for existing file")
 	}
 
+	// Deduplicated uploads inherit any integrity problem already found on the content
+	integrityStatus, err := s.integrityStatusOf(tx, file.ID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	now := time.Now()
 	userFile := &models.UserFile{
-		UserID:        userID,
-		FileID:        file.ID,
-		FolderID:      folderID,
-		Filename:      filename,
-		MimeType:      mimeType,
-		EncryptionKey: encryptionKey,
+		UserID:            userID,
+		FileID:            file.ID,
+		FolderID:          folderID,
+		Filename:          filename,
+		MimeType:          mimeType,
+		EncryptionKey:     encryptionKey,
+		IntegrityStatus:   integrityStatus,
+		CurrentVersion:    1,
+		VersionUploadedAt: &now,
 	}
 
 	// Try to create the user file, but handle the case where it might already exist due to concurrent requests
@@ -223,15 +283,80 @@ func (s *FileService) UploadFile(userID uint, filename, mimeType, contentHash, e
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create user file record")
 	}
 
+	if err := s.addFileReference(tx, file.ID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to commit transaction")
 	}
+	committed = true
 
 	db.Preload("File").First(userFile, userFile.ID)
 
 	return userFile, nil
 }
 
+// stageUpload streams an upload into a staging object while hashing it and returns the
+// staging path once the received bytes match the declared hash and size. A mismatching
+// upload is removed and rejected with a validation error.
+func (s *FileService) stageUpload(ctx context.Context, userID uint, contentHash, mimeType string, fileData io.Reader, sizeBytes int64) (string, error) {
+	if fileData == nil {
+		return "", apperrors.New(apperrors.ErrCodeInvalidArgument, "file data is required for upload")
+	}
+	if !contentHashPattern.MatchString(strings.ToLower(contentHash)) {
+		return "", apperrors.New(apperrors.ErrCodeValidation, "content_hash must be a hex-encoded SHA-256 digest")
+	}
+
+	token, err := generateStagingToken()
+	if err != nil {
+		return "", err
+	}
+	stagingPath := fmt.Sprintf("%s/%d/%s", uploadStagingPrefix, userID, token)
+
+	hasher := sha256.New()
+	counter := &countingReader{reader: io.TeeReader(fileData, hasher)}
+	if err := s.fileStorageService.UploadFile(ctx, stagingPath, counter, sizeBytes, mimeType); err != nil {
+		s.fileStorageService.DeleteFile(ctx, stagingPath)
+		if appErr, ok := err.(*apperrors.Error); ok && appErr.Code == apperrors.ErrCodeInvalidArgument {
+			return "", apperrors.Wrap(err, apperrors.ErrCodeValidation, "uploaded data does not match size_bytes")
+		}
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to upload file to storage")
+	}
+
+	if counter.count != sizeBytes {
+		s.fileStorageService.DeleteFile(ctx, stagingPath)
+		return "", apperrors.New(apperrors.ErrCodeValidation, fmt.Sprintf("uploaded data is %d bytes, expected %d", counter.count, sizeBytes))
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(actual, contentHash) {
+		s.fileStorageService.DeleteFile(ctx, stagingPath)
+		return "", apperrors.New(apperrors.ErrCodeValidation, "uploaded data does not match content_hash")
+	}
+
+	return stagingPath, nil
+}
+
+// countingReader records how many bytes have been read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+func generateStagingToken() (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate staging object name")
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
 func (s *FileService) GetUserFiles(userID uint, filter *FileFilter) ([]*models.UserFile, error) {
 	filters := make(map[string]interface{})
 	if filter != nil {
@@ -474,35 +599,154 @@ func (s *FileService) PermanentlyDeleteFile(userID, userFileID uint) error {
 		}
 		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
 	}
-	db.Preload("File").First(&userFile, userFile.ID)
 
 	if userFile.DeletedAt.Valid == false {
 		return apperrors.New(apperrors.ErrCodeInvalidArgument, "file is not in trash - use DeleteFile first")
 	}
 
-	if err := s.fileStorageService.DeleteFile(context.Background(), userFile.File.StoragePath); err != nil {
-		log.Printf("Warning: Failed to delete file from storage: %v", err)
+	tx := db.Begin()
+	if tx.Error != nil {
+		return apperrors.Wrap(tx.Error, apperrors.ErrCodeInternal, "failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	releasedPaths, err := s.releaseFileVersions(tx, userFile.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	if err := db.Unscoped().Delete(&userFile).Error; err != nil {
+	if err := tx.Unscoped().Delete(&userFile).Error; err != nil {
+		tx.Rollback()
 		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to permanently delete user file record")
 	}
 
-	var count int64
-	if err := db.Unscoped().Model(&models.UserFile{}).Where("file_id = ?", userFile.FileID).Count(&count).Error; err != nil {
-		log.Printf("Warning: Failed to check for other file references: %v", err)
-		return nil
+	// The blob is shared by every UserFile with the same content; it only goes once the
+	// last reference has been released
+	releasedPath, err := s.releaseFileReference(tx, userFile.FileID)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
+	releasedPaths = append(releasedPaths, releasedPath)
 
-	if count == 0 {
-		if err := db.Unscoped().Delete(&models.File{}, userFile.FileID).Error; err != nil {
-			log.Printf("Warning: Failed to permanently delete file record: %v", err)
-		}
+	if err := tx.Commit().Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to commit transaction")
+	}
+
+	for _, releasedPath := range releasedPaths {
+		s.deleteReleasedObject(context.Background(), releasedPath)
 	}
 
 	return nil
 }
 
+// integrityStatusOf returns the status of the File's open integrity issue, or OK if the
+// storage scrubber has not found a problem with it.
+func (s *FileService) integrityStatusOf(tx *gorm.DB, fileID uint) (string, error) {
+	var issue models.StorageIntegrityIssue
+	err := tx.Where("file_id = ? AND resolved_at IS NULL", fileID).First(&issue).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.IntegrityStatusOK, nil
+	}
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error checking file integrity")
+	}
+	return issue.Status, nil
+}
+
+// addFileReference records one more UserFile pointing at a File. The update takes the
+// File's row lock, so it serialises against a concurrent release of the last reference;
+// if that release won, the File is gone and the caller must retry the upload.
+func (s *FileService) addFileReference(tx *gorm.DB, fileID uint) error {
+	result := tx.Model(&models.File{}).Where("id = ?", fileID).UpdateColumn("ref_count", gorm.Expr("ref_count + 1"))
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to update file reference count")
+	}
+	if result.RowsAffected == 0 {
+		return apperrors.New(apperrors.ErrCodeConflict, "file was removed while it was being uploaded, please retry")
+	}
+	return nil
+}
+
+// releaseFileReference drops one reference to a File inside tx, after the UserFile row
+// has been deleted. When that was the last reference the File row is deleted too and its
+// storage path is returned, so the caller can remove the blob once tx has committed.
+func (s *FileService) releaseFileReference(tx *gorm.DB, fileID uint) (string, error) {
+	if err := tx.Unscoped().Model(&models.File{}).Where("id = ? AND ref_count > 0", fileID).
+		UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to update file reference count")
+	}
+
+	var file models.File
+	if err := tx.Unscoped().First(&file, fileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil
+		}
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load file record")
+	}
+	if file.RefCount > 0 {
+		return "", nil
+	}
+
+	// Never trust a zero counter alone: rows written before reference counting existed
+	// may be undercounted, so confirm no UserFile (trashed ones included) or archived
+	// version remains
+	remaining, err := s.countFileReferences(tx, fileID)
+	if err != nil {
+		return "", err
+	}
+	if remaining > 0 {
+		if err := tx.Unscoped().Model(&file).UpdateColumn("ref_count", remaining).Error; err != nil {
+			return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to repair file reference count")
+		}
+		return "", nil
+	}
+
+	if err := tx.Unscoped().Delete(&file).Error; err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to permanently delete file record")
+	}
+	return file.StoragePath, nil
+}
+
+// countFileReferences counts the UserFiles, trashed ones included, and archived file
+// versions that point at a File.
+func (s *FileService) countFileReferences(tx *gorm.DB, fileID uint) (int64, error) {
+	var userFiles, versions int64
+	if err := tx.Unscoped().Model(&models.UserFile{}).Where("file_id = ?", fileID).Count(&userFiles).Error; err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to check for other file references")
+	}
+	if err := tx.Model(&models.FileVersion{}).Where("file_id = ?", fileID).Count(&versions).Error; err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to check for other file references")
+	}
+	return userFiles + versions, nil
+}
+
+// deleteReleasedObject removes a blob whose last File reference has been committed away.
+// Failures are only logged: the storage garbage collector reclaims anything left behind.
+func (s *FileService) deleteReleasedObject(ctx context.Context, storagePath string) {
+	if storagePath == "" {
+		return
+	}
+
+	var references int64
+	if err := s.db.GetDB().Unscoped().Model(&models.File{}).Where("storage_path = ?", storagePath).Count(&references).Error; err != nil {
+		log.Printf("Warning: Failed to check references to %s, leaving it for garbage collection: %v", storagePath, err)
+		return
+	}
+	if references > 0 {
+		return
+	}
+
+	if err := s.fileStorageService.DeleteFile(ctx, storagePath); err != nil {
+		log.Printf("Warning: Failed to delete file from storage: %v", err)
+	}
+}
+
 func (s *FileService) GetFile(userID, userFileID uint) ([]byte, string, error) {
 	db := s.db.GetDB()
 
@@ -547,18 +791,12 @@ func (s *FileService) StreamFile(userID, userFileID uint) (io.ReadCloser, string
 
 	// Check if user owns the file OR is a member of a room that has access to this file
 	if userFile.UserID != userID {
-		// Check if file is shared to any room that the user is a member of
-		var count int64
-		err := db.Table("room_files").
-			Joins("INNER JOIN room_members ON room_files.room_id = room_members.room_id").
-			Where("room_files.user_file_id = ? AND room_members.user_id = ?", userFileID, userID).
-			Count(&count).Error
-
+		shared, err := isSharedWithUser(db, userFileID, userID)
 		if err != nil {
-			return nil, "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+			return nil, "", err
 		}
 
-		if count == 0 {
+		if !shared {
 			return nil, "", apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
 		}
 	}
@@ -585,33 +823,32 @@ func (s *FileService) GetFileDownloadURL(ctx context.Context, user *models.User,
 
 	// Check if user owns the file OR is a member of a room that has access to this file
 	if userFile.UserID != user.ID {
-		// Check if file is shared to any room that the user is a member of
-		var count int64
-		err := db.Table("room_files").
-			Joins("INNER JOIN room_members ON room_files.room_id = room_members.room_id").
-			Where("room_files.user_file_id = ? AND room_members.user_id = ?", userFileID, user.ID).
-			Count(&count).Error
-
+		shared, err := isSharedWithUser(db, userFileID, user.ID)
 		if err != nil {
-			return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+			return "", err
 		}
 
-		if count == 0 {
+		if !shared {
 			return "", apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
 		}
 	}
 
-	token, err := s.authService.GenerateToken(user)
+	ticket, err := s.downloadTickets.IssueFileTicket(user.ID, userFileID, 0)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate download token: %w", err)
+		return "", fmt.Errorf("failed to generate download ticket: %w", err)
 	}
 
+	return s.downloadURL(userFileID, ticket), nil
+}
+
+// downloadURL returns the URL a download ticket is redeemed at.
+func (s *FileService) downloadURL(userFileID uint, ticket string) string {
 	baseURL := s.cfg.BaseURL
 	if baseURL == "" {
 		baseURL = "http://localhost:8080"
 	}
 
-	return fmt.Sprintf("%s/v1/api/files/%d/download?token=%s", baseURL, userFileID, token), nil
+	return fmt.Sprintf("%s/v1/api/files/%d/download?ticket=%s", baseURL, userFileID, ticket)
 }
 
 func (s *FileService) CheckDuplicateName(tableName, fieldName, parentFieldName string, userID uint, name string, parentID *uint, excludeID *uint) error {
@@ -655,6 +892,318 @@ func (s *FileService) GetAllFiles() ([]*models.UserFile, error) {
 	return userFiles, err
 }
 
+//================================================================================
+// File Version Operations
+//================================================================================
+
+// GetFileVersions lists every revision of a file, newest first. The first entry is the
+// current revision, which lives on the UserFile itself.
+func (s *FileService) GetFileVersions(userID, userFileID uint) ([]*models.FileVersion, error) {
+	userFile, err := s.loadAccessibleUserFile(userID, userFileID)
+	if err != nil {
+		return nil, err
+	}
+
+	var archived []*models.FileVersion
+	if err := s.db.GetDB().Preload("File").
+		Where("user_file_id = ?", userFile.ID).
+		Order("version_number DESC").
+		Find(&archived).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to retrieve file versions")
+	}
+
+	return append([]*models.FileVersion{currentFileVersion(userFile)}, archived...), nil
+}
+
+// GetFileVersion returns one revision of a file, with its File record loaded.
+func (s *FileService) GetFileVersion(userID, userFileID uint, versionNumber int) (*models.FileVersion, error) {
+	userFile, err := s.loadAccessibleUserFile(userID, userFileID)
+	if err != nil {
+		return nil, err
+	}
+	if versionNumber == userFile.CurrentVersion {
+		return currentFileVersion(userFile), nil
+	}
+
+	var version models.FileVersion
+	if err := s.db.GetDB().Preload("File").
+		Where("user_file_id = ? AND version_number = ?", userFile.ID, versionNumber).
+		First(&version).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "file version not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return &version, nil
+}
+
+// StreamFileVersion opens the stored content of one revision of a file.
+func (s *FileService) StreamFileVersion(userID, userFileID uint, versionNumber int) (io.ReadCloser, *models.FileVersion, error) {
+	version, err := s.GetFileVersion(userID, userFileID, versionNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	object, err := s.fileStorageService.DownloadFile(context.Background(), version.File.StoragePath)
+	if err != nil {
+		return nil, nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get file from storage")
+	}
+	return object, version, nil
+}
+
+// GetFileVersionDownloadURL returns a download URL for one revision of a file.
+func (s *FileService) GetFileVersionDownloadURL(ctx context.Context, user *models.User, userFileID uint, versionNumber int) (string, error) {
+	if _, err := s.GetFileVersion(user.ID, userFileID, versionNumber); err != nil {
+		return "", err
+	}
+
+	ticket, err := s.downloadTickets.IssueFileTicket(user.ID, userFileID, versionNumber)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate download ticket: %w", err)
+	}
+
+	return s.downloadURL(userFileID, ticket), nil
+}
+
+// RestoreFileVersion makes an earlier revision current again. The restored content
+// becomes a new revision, so the history is never rewritten.
+func (s *FileService) RestoreFileVersion(userID, userFileID uint, versionNumber int) (*models.UserFile, error) {
+	db := s.db.GetDB()
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return nil, apperrors.Wrap(tx.Error, apperrors.ErrCodeInternal, "failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var userFile models.UserFile
+	if err := tx.Where("id = ? AND user_id = ?", userFileID, userID).First(&userFile).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "file not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	if versionNumber == userFile.CurrentVersion {
+		tx.Rollback()
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "version is already the current version")
+	}
+
+	var version models.FileVersion
+	if err := tx.Where("user_file_id = ? AND version_number = ?", userFile.ID, versionNumber).First(&version).Error; err != nil {
+		tx.Rollback()
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "file version not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	if err := s.addFileVersion(tx, &userFile, version.FileID, version.MimeType, version.EncryptionKey); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to commit transaction")
+	}
+
+	db.Preload("File").First(&userFile, userFile.ID)
+	return &userFile, nil
+}
+
+// PruneFileVersions deletes all but the newest keep earlier revisions of a file and
+// returns how many were removed. The current revision is never pruned.
+func (s *FileService) PruneFileVersions(userID, userFileID uint, keep int) (int, error) {
+	if keep < 0 {
+		return 0, apperrors.New(apperrors.ErrCodeInvalidArgument, "keep must not be negative")
+	}
+
+	var userFile models.UserFile
+	if err := s.ValidateOwnership(&userFile, userFileID, userID); err != nil {
+		return 0, err
+	}
+
+	db := s.db.GetDB()
+	tx := db.Begin()
+	if tx.Error != nil {
+		return 0, apperrors.Wrap(tx.Error, apperrors.ErrCodeInternal, "failed to start transaction")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var versions []models.FileVersion
+	if err := tx.Where("user_file_id = ?", userFile.ID).
+		Order("version_number DESC").
+		Offset(keep).
+		Find(&versions).Error; err != nil {
+		tx.Rollback()
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to retrieve file versions")
+	}
+
+	releasedPaths, err := s.deleteFileVersions(tx, versions)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to commit transaction")
+	}
+
+	for _, releasedPath := range releasedPaths {
+		s.deleteReleasedObject(context.Background(), releasedPath)
+	}
+
+	return len(versions), nil
+}
+
+// addFileVersion archives the UserFile's current revision and points it at fileID
+// instead, inside tx. The archived revision keeps its File reference and the new one
+// adds a reference of its own.
+func (s *FileService) addFileVersion(tx *gorm.DB, userFile *models.UserFile, fileID uint, mimeType, encryptionKey string) error {
+	archived := models.FileVersion{
+		UserFileID:    userFile.ID,
+		UserID:        userFile.UserID,
+		VersionNumber: userFile.CurrentVersion,
+		FileID:        userFile.FileID,
+		MimeType:      userFile.MimeType,
+		EncryptionKey: userFile.EncryptionKey,
+		UploadedAt:    currentFileVersion(userFile).UploadedAt,
+	}
+	if err := tx.Create(&archived).Error; err != nil {
+		if isUniqueViolation(err) {
+			return apperrors.New(apperrors.ErrCodeConflict, "file was modified concurrently, please retry")
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to archive file version")
+	}
+
+	// A new revision inherits any integrity problem already found on its content
+	integrityStatus, err := s.integrityStatusOf(tx, fileID)
+	if err != nil {
+		return err
+	}
+
+	result := tx.Model(&models.UserFile{}).
+		Where("id = ? AND current_version = ?", userFile.ID, userFile.CurrentVersion).
+		Updates(map[string]interface{}{
+			"file_id":             fileID,
+			"mime_type":           mimeType,
+			"encryption_key":      encryptionKey,
+			"current_version":     userFile.CurrentVersion + 1,
+			"version_uploaded_at": time.Now(),
+			"integrity_status":    integrityStatus,
+		})
+	if result.Error != nil {
+		if isUniqueViolation(result.Error) {
+			return apperrors.New(apperrors.ErrCodeConflict, "this content is already stored as another file")
+		}
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to update user file record")
+	}
+	if result.RowsAffected == 0 {
+		return apperrors.New(apperrors.ErrCodeConflict, "file was modified concurrently, please retry")
+	}
+
+	return s.addFileReference(tx, fileID)
+}
+
+// releaseFileVersions deletes every archived revision of a UserFile inside tx and
+// returns the storage paths that are no longer referenced by anything.
+func (s *FileService) releaseFileVersions(tx *gorm.DB, userFileID uint) ([]string, error) {
+	var versions []models.FileVersion
+	if err := tx.Where("user_file_id = ?", userFileID).Find(&versions).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to retrieve file versions")
+	}
+	return s.deleteFileVersions(tx, versions)
+}
+
+func (s *FileService) deleteFileVersions(tx *gorm.DB, versions []models.FileVersion) ([]string, error) {
+	var releasedPaths []string
+	for _, version := range versions {
+		if err := tx.Delete(&version).Error; err != nil {
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to delete file version")
+		}
+		releasedPath, err := s.releaseFileReference(tx, version.FileID)
+		if err != nil {
+			return nil, err
+		}
+		if releasedPath != "" {
+			releasedPaths = append(releasedPaths, releasedPath)
+		}
+	}
+	return releasedPaths, nil
+}
+
+// loadAccessibleUserFile returns a UserFile, with its File, that the user owns or that
+// has been shared with them.
+func (s *FileService) loadAccessibleUserFile(userID, userFileID uint) (*models.UserFile, error) {
+	db := s.db.GetDB()
+
+	var userFile models.UserFile
+	if err := db.Preload("File").First(&userFile, userFileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	if userFile.UserID != userID {
+		shared, err := isSharedWithUser(db, userFileID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !shared {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
+		}
+	}
+
+	return &userFile, nil
+}
+
+// isSharedWithUser reports whether a file is shared to a room the user is a member of.
+// A key grant alone does not give access to the stored object.
+func isSharedWithUser(db *gorm.DB, userFileID, userID uint) (bool, error) {
+	var count int64
+	err := db.Table("room_files").
+		Joins("INNER JOIN room_members ON room_files.room_id = room_members.room_id").
+		Where("room_files.user_file_id = ? AND room_members.user_id = ?", userFileID, userID).
+		Count(&count).Error
+	if err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return count > 0, nil
+}
+
+// currentFileVersion describes the UserFile's current revision as a FileVersion.
+func currentFileVersion(userFile *models.UserFile) *models.FileVersion {
+	uploadedAt := userFile.CreatedAt
+	if userFile.VersionUploadedAt != nil {
+		uploadedAt = *userFile.VersionUploadedAt
+	}
+	return &models.FileVersion{
+		UserFileID:    userFile.ID,
+		UserID:        userFile.UserID,
+		VersionNumber: userFile.CurrentVersion,
+		FileID:        userFile.FileID,
+		MimeType:      userFile.MimeType,
+		EncryptionKey: userFile.EncryptionKey,
+		UploadedAt:    uploadedAt,
+		IsCurrent:     true,
+		File:          userFile.File,
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	return strings.Contains(err.Error(), "duplicate key value violates unique constraint") ||
+		strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
 //================================================================================
 // Folder Operations
 //================================================================================
@@ -1044,6 +1593,7 @@ func (s *FileService) PermanentlyDeleteFolder(userID, folderID uint) error {
 	}
 	folderIDsToDelete = append(folderIDsToDelete, folderID)
 
+	var releasedPaths []string
 	if len(folderIDsToDelete) > 0 {
 		// Get all user files in the folders to be permanently deleted
 		var userFiles []models.UserFile
@@ -1066,11 +1616,27 @@ func (s *FileService) PermanentlyDeleteFolder(userID, folderID uint) error {
 				return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to remove file from rooms")
 			}
 
+			versionPaths, err := s.releaseFileVersions(tx, userFile.ID)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			releasedPaths = append(releasedPaths, versionPaths...)
+
 			// Permanently delete user file record
 			if err := tx.Unscoped().Delete(&userFile).Error; err != nil {
 				tx.Rollback()
 				return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to permanently delete user file record")
 			}
+
+			releasedPath, err := s.releaseFileReference(tx, userFile.FileID)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if releasedPath != "" {
+				releasedPaths = append(releasedPaths, releasedPath)
+			}
 		}
 
 		// Remove folders from rooms
@@ -1092,5 +1658,9 @@ func (s *FileService) PermanentlyDeleteFolder(userID, folderID uint) error {
 		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to commit transaction")
 	}
 
+	for _, releasedPath := range releasedPaths {
+		s.deleteReleasedObject(context.Background(), releasedPath)
+	}
+
 	return nil
 }
@@ -3,38 +3,76 @@ package services
 import (
 	"context"
 	"io"
+	"log"
 
 	"github.com/minio/minio-go/v7"
 )
 
 // FileStorageService is a service for interacting with a file storage system.
 type FileStorageService struct {
-	minioClient *minio.Client
-	bucketName  string
+	backend StorageBackend
 }
 
-// NewFileStorageService creates a new FileStorageService.
+// NewFileStorageService creates a new FileStorageService backed by a MinIO bucket.
 func NewFileStorageService(minioClient *minio.Client, bucketName string) *FileStorageService {
+	return NewFileStorageServiceWithBackend(NewMinIOStorageBackend(minioClient, bucketName))
+}
+
+// NewFileStorageServiceWithBackend creates a new FileStorageService on top of any StorageBackend.
+func NewFileStorageServiceWithBackend(backend StorageBackend) *FileStorageService {
 	return &FileStorageService{
-		minioClient: minioClient,
-		bucketName:  bucketName,
+		backend: backend,
 	}
 }
 
+// Backend returns the underlying storage backend.
+func (s *FileStorageService) Backend() StorageBackend {
+	return s.backend
+}
+
 // UploadFile uploads a file to the file storage system.
 func (s *FileStorageService) UploadFile(ctx context.Context, objectName string, reader io.Reader, objectSize int64, contentType string) error {
-	_, err := s.minioClient.PutObject(ctx, s.bucketName, objectName, reader, objectSize, minio.PutObjectOptions{
-		ContentType: contentType,
-	})
-	return err
+	return s.backend.Put(ctx, objectName, reader, objectSize, contentType)
 }
 
-// DownloadFile downloads a file from the file storage system.
-func (s *FileStorageService) DownloadFile(ctx context.Context, objectName string) (*minio.Object, error) {
-	return s.minioClient.GetObject(ctx, s.bucketName, objectName, minio.GetObjectOptions{})
+// DownloadFile opens a file from the file storage system. The caller must close the reader.
+func (s *FileStorageService) DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	return s.backend.Get(ctx, objectName)
+}
+
+// StatFile returns metadata for a stored file.
+func (s *FileStorageService) StatFile(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	return s.backend.Stat(ctx, objectName)
 }
 
 // DeleteFile deletes a file from the file storage system.
 func (s *FileStorageService) DeleteFile(ctx context.Context, objectName string) error {
-	return s.minioClient.RemoveObject(ctx, s.bucketName, objectName, minio.RemoveObjectOptions{})
+	return s.backend.Delete(ctx, objectName)
+}
+
+// ListFiles lists stored files whose names start with prefix.
+func (s *FileStorageService) ListFiles(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return s.backend.List(ctx, prefix)
+}
+
+// RenameFile relocates a stored file to a new name. It is built on Get/Put/Delete so it
+// works with every backend; the source is only removed once the copy has been written.
+func (s *FileStorageService) RenameFile(ctx context.Context, srcName, dstName, contentType string) error {
+	info, err := s.backend.Stat(ctx, srcName)
+	if err != nil {
+		return err
+	}
+	reader, err := s.backend.Get(ctx, srcName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := s.backend.Put(ctx, dstName, reader, info.Size, contentType); err != nil {
+		return err
+	}
+	if err := s.backend.Delete(ctx, srcName); err != nil {
+		log.Printf("Warning: Failed to delete %s after renaming it to %s: %v", srcName, dstName, err)
+	}
+	return nil
 }
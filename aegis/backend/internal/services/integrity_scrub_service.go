@@ -0,0 +1,286 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/utils"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const integrityScrubBatchSize = 100
+
+// IntegrityScrubService re-reads every stored object and checks it against the
+// content hash and size recorded on its File. Objects that are missing or no longer
+// match are recorded as StorageIntegrityIssues, and every UserFile pointing at them
+// is flagged so owners are warned before downloading damaged content.
+type IntegrityScrubService struct {
+	*BaseService
+	fileStorageService *FileStorageService
+
+	mu         sync.Mutex
+	running    bool
+	lastReport *IntegrityScrubReport
+}
+
+// IntegrityScrubReport describes one scrub run.
+type IntegrityScrubReport struct {
+	StartedAt      time.Time
+	CompletedAt    time.Time
+	FilesChecked   int
+	BytesChecked   int64
+	CorruptedFiles int
+	MissingFiles   int
+	ResolvedIssues int
+	Errors         []string
+}
+
+// NewIntegrityScrubService creates a new IntegrityScrubService.
+func NewIntegrityScrubService(db *database.DB, fileStorageService *FileStorageService) *IntegrityScrubService {
+	return &IntegrityScrubService{
+		BaseService:        NewBaseService(db),
+		fileStorageService: fileStorageService,
+	}
+}
+
+//================================================================================
+// Scrubbing
+//================================================================================
+
+// Run verifies every stored file once. Only one run may be in progress at a time.
+func (s *IntegrityScrubService) Run(ctx context.Context) (*IntegrityScrubReport, error) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "an integrity scrub is already running")
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	report := &IntegrityScrubReport{
+		StartedAt: time.Now(),
+		Errors:    []string{},
+	}
+
+	var files []models.File
+	result := s.db.GetDB().Model(&models.File{}).Order("id").FindInBatches(&files, integrityScrubBatchSize, func(batch *gorm.DB, _ int) error {
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			s.scrubFile(ctx, file, report)
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return nil, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "integrity scrub aborted")
+	}
+
+	report.CompletedAt = time.Now()
+
+	s.mu.Lock()
+	s.lastReport = report
+	s.mu.Unlock()
+
+	return report, nil
+}
+
+// LastReport returns the report of the most recent completed run, or nil if none has completed.
+func (s *IntegrityScrubService) LastReport() *IntegrityScrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastReport
+}
+
+// ListIssues returns recorded integrity issues, most recently checked first. Resolved
+// issues are only included when includeResolved is set.
+func (s *IntegrityScrubService) ListIssues(includeResolved bool) ([]*models.StorageIntegrityIssue, error) {
+	query := s.db.GetDB().Order("last_checked_at DESC")
+	if !includeResolved {
+		query = query.Where("resolved_at IS NULL")
+	}
+
+	var issues []*models.StorageIntegrityIssue
+	if err := query.Find(&issues).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to retrieve integrity issues")
+	}
+	return issues, nil
+}
+
+// StartWorker runs a scrub every interval until ctx is cancelled. A non-positive
+// interval disables the background worker; Run can still be triggered by an admin.
+func (s *IntegrityScrubService) StartWorker(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		log.Printf("Storage integrity scrub worker disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := s.Run(ctx)
+				if err != nil {
+					log.Printf("Warning: Storage integrity scrub failed: %v", err)
+					continue
+				}
+				log.Printf("Storage integrity scrub: %d files (%d bytes) checked, %d corrupted, %d missing, %d resolved, %d errors",
+					report.FilesChecked, report.BytesChecked, report.CorruptedFiles, report.MissingFiles,
+					report.ResolvedIssues, len(report.Errors))
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// scrubFile verifies one file and records the outcome. Storage errors other than a
+// missing object are reported but not recorded, since they say nothing about the data.
+func (s *IntegrityScrubService) scrubFile(ctx context.Context, file models.File, report *IntegrityScrubReport) {
+	status, actualHash, actualSize, err := s.verifyObject(ctx, file)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to verify file %d: %v", file.ID, err))
+		return
+	}
+	report.FilesChecked++
+	report.BytesChecked += actualSize
+
+	recorded, resolved, err := s.recordResult(file, status, actualHash, actualSize, time.Now())
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to record integrity status of file %d: %v", file.ID, err))
+		return
+	}
+	if resolved {
+		report.ResolvedIssues++
+	}
+	if !recorded {
+		return
+	}
+	switch status {
+	case models.IntegrityStatusCorrupted:
+		report.CorruptedFiles++
+	case models.IntegrityStatusMissing:
+		report.MissingFiles++
+	}
+}
+
+// verifyObject streams a file's object and compares its SHA-256 and length against the
+// File record.
+func (s *IntegrityScrubService) verifyObject(ctx context.Context, file models.File) (string, string, int64, error) {
+	object, err := s.fileStorageService.DownloadFile(ctx, file.StoragePath)
+	if err != nil {
+		if IsObjectNotFound(err) {
+			return models.IntegrityStatusMissing, "", 0, nil
+		}
+		return "", "", 0, err
+	}
+	defer object.Close()
+
+	counter := &countingReader{reader: object}
+	actualHash, err := utils.CalculateFileHash(counter)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	if actualHash != strings.ToLower(file.ContentHash) || counter.count != file.SizeBytes {
+		return models.IntegrityStatusCorrupted, actualHash, counter.count, nil
+	}
+	return models.IntegrityStatusOK, actualHash, counter.count, nil
+}
+
+// recordResult opens, updates or resolves the file's integrity issue and propagates the
+// status to its UserFiles. recorded is false when the file was deleted while it was
+// being read; resolved is true when a previously open issue was closed.
+func (s *IntegrityScrubService) recordResult(file models.File, status, actualHash string, actualSize int64, checkedAt time.Time) (recorded, resolved bool, err error) {
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var issue models.StorageIntegrityIssue
+		err := tx.Where("file_id = ? AND resolved_at IS NULL", file.ID).First(&issue).Error
+		open := err == nil
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if status == models.IntegrityStatusOK {
+			if !open {
+				return nil
+			}
+			if err := tx.Model(&issue).Updates(map[string]interface{}{
+				"resolved_at":     checkedAt,
+				"last_checked_at": checkedAt,
+			}).Error; err != nil {
+				return err
+			}
+			resolved = true
+			return s.flagUserFiles(tx, file.ID, models.IntegrityStatusOK)
+		}
+
+		// A permanent delete may have removed the row and its object mid-read
+		var exists int64
+		if err := tx.Model(&models.File{}).Where("id = ?", file.ID).Count(&exists).Error; err != nil {
+			return err
+		}
+		if exists == 0 {
+			return nil
+		}
+
+		if open {
+			if err := tx.Model(&issue).Updates(map[string]interface{}{
+				"status":          status,
+				"actual_hash":     actualHash,
+				"actual_size":     actualSize,
+				"last_checked_at": checkedAt,
+			}).Error; err != nil {
+				return err
+			}
+		} else {
+			issue = models.StorageIntegrityIssue{
+				FileID:        file.ID,
+				StoragePath:   file.StoragePath,
+				Status:        status,
+				ExpectedHash:  file.ContentHash,
+				ActualHash:    actualHash,
+				ExpectedSize:  file.SizeBytes,
+				ActualSize:    actualSize,
+				DetectedAt:    checkedAt,
+				LastCheckedAt: checkedAt,
+			}
+			if err := tx.Create(&issue).Error; err != nil {
+				return err
+			}
+		}
+		recorded = true
+		return s.flagUserFiles(tx, file.ID, status)
+	})
+	return recorded, resolved, err
+}
+
+// flagUserFiles sets the integrity status of every UserFile, trashed ones included,
+// that points at fileID. UpdatedAt is left alone since the user did not change anything.
+func (s *IntegrityScrubService) flagUserFiles(tx *gorm.DB, fileID uint, status string) error {
+	return tx.Unscoped().Model(&models.UserFile{}).
+		Where("file_id = ?", fileID).
+		UpdateColumn("integrity_status", status).Error
+}
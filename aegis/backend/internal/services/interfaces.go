@@ -6,19 +6,18 @@ import (
 	"time"
 
 	"github.com/balkanid/aegis-backend/internal/models"
-	"github.com/minio/minio-go/v7"
 )
 
 // AuthServiceInterface defines the contract for authentication services
 type AuthServiceInterface interface {
-	GenerateToken(user *models.User) (string, error)
+	GenerateSessionToken(user *models.User, sessionID string) (string, error)
 	ParseToken(tokenString string) (*Claims, error)
 }
 
 // UserServiceInterface defines the contract for user management services
 type UserServiceInterface interface {
-	Register(username, email, password string) (*models.User, string, error)
-	Login(identifier, password string) (*models.User, string, error)
+	CreateUser(username, email, password string) (*models.User, error)
+	Authenticate(identifier, password string) (*models.User, error)
 	GetUserStats(userID uint) (*UserStats, error)
 	UpdateStorageUsage(userID uint, deltaBytes int64) error
 	CheckStorageQuota(userID uint, additionalBytes int64) error
@@ -60,7 +59,7 @@ type FileServiceInterface interface {
 
 	// File Storage
 	UploadFile(ctx context.Context, objectName string, reader io.Reader, objectSize int64, contentType string) error
-	DownloadFile(ctx context.Context, objectName string) (*minio.Object, error)
+	DownloadFile(ctx context.Context, objectName string) (io.ReadCloser, error)
 	DeleteFile(ctx context.Context, objectName string) error
 }
 
@@ -78,6 +77,7 @@ type PasswordShareServiceInterface interface {
 type ShareLinkServiceInterface interface {
 	GenerateShareLink(fileShare *models.FileShare) (string, error)
 	ValidateShareToken(token string) (*models.FileShare, error)
+	ValidateTicketedShareToken(token string) (*models.FileShare, error)
 	GetShareMetadata(token string) (*ShareMetadata, error)
 	IsExpired(fileShare *models.FileShare) bool
 	IsDownloadLimitReached(fileShare *models.FileShare) bool
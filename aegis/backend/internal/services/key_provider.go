@@ -0,0 +1,56 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// Supported key provider names for config.Config.KeyProvider.
+const (
+	KeyProviderLocal  = "local"
+	KeyProviderVault  = "vault"
+	KeyProviderAWSKMS = "awskms"
+)
+
+// KeyProvider is the contract every key management system used to wrap envelope keys and
+// service keys must satisfy. WrapKey returns the ID of the key that wrapped the material,
+// prefixed with the provider name, and it must be stored next to the wrapped value:
+// UnwrapKey needs it back, and it still names the right key after the provider's key has
+// been rotated.
+type KeyProvider interface {
+	WrapKey(ctx context.Context, plaintext []byte) (keyID string, wrapped string, err error)
+	UnwrapKey(ctx context.Context, keyID, wrapped string) ([]byte, error)
+}
+
+// NewKeyProvider creates the key provider selected by cfg.KeyProvider.
+func NewKeyProvider(cfg *config.Config) (KeyProvider, error) {
+	switch cfg.KeyProvider {
+	case "", KeyProviderLocal:
+		return NewLocalKeyProvider(cfg.KeystorePath)
+	case KeyProviderVault:
+		return NewVaultKeyProvider(cfg.VaultAddr, cfg.VaultToken, cfg.VaultTransitMount, cfg.VaultTransitKey), nil
+	case KeyProviderAWSKMS:
+		return NewAWSKMSKeyProvider(cfg.AWSKMSEndpoint, cfg.AWSRegion, cfg.AWSKMSKeyID, cfg.AWSAccessKeyID, cfg.AWSSecretAccessKey, cfg.AWSSessionToken), nil
+	default:
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("unsupported key provider: %s", cfg.KeyProvider))
+	}
+}
+
+// providerKeyID prefixes a provider's own key identifier with the provider name.
+func providerKeyID(provider, id string) string {
+	return provider + ":" + id
+}
+
+// parseProviderKeyID returns the provider's own key identifier from a stored key ID,
+// rejecting IDs written by another provider.
+func parseProviderKeyID(provider, keyID string) (string, error) {
+	id, ok := strings.CutPrefix(keyID, provider+":")
+	if !ok || id == "" {
+		return "", apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("key %q was not wrapped by the %s key provider", keyID, provider))
+	}
+	return id, nil
+}
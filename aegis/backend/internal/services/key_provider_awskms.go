@@ -0,0 +1,195 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// AWSKMSKeyProvider wraps keys with an AWS KMS key, or any server speaking the KMS JSON
+// API such as local-kms. Requests are signed with AWS Signature Version 4. KMS records
+// the key in each ciphertext blob, and the key ARN it reports is what is stored.
+type AWSKMSKeyProvider struct {
+	endpoint        string
+	region          string
+	keyID           string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	httpClient      *http.Client
+	now             func() time.Time
+}
+
+// awsKMSResponse holds the fields of KMS Encrypt, Decrypt and error responses.
+type awsKMSResponse struct {
+	CiphertextBlob string `json:"CiphertextBlob"`
+	Plaintext      string `json:"Plaintext"`
+	KeyID          string `json:"KeyId"`
+	Type           string `json:"__type"`
+	Message        string `json:"message"`
+}
+
+// NewAWSKMSKeyProvider creates an AWSKMSKeyProvider for the KMS key keyID in region.
+// An empty endpoint uses the public KMS endpoint for the region.
+func NewAWSKMSKeyProvider(endpoint, region, keyID, accessKeyID, secretAccessKey, sessionToken string) *AWSKMSKeyProvider {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", region)
+	}
+	return &AWSKMSKeyProvider{
+		endpoint:        strings.TrimRight(endpoint, "/") + "/",
+		region:          region,
+		keyID:           keyID,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    sessionToken,
+		httpClient:      &http.Client{Timeout: 10 * time.Second},
+		now:             time.Now,
+	}
+}
+
+// WrapKey encrypts key material with the KMS key.
+func (p *AWSKMSKeyProvider) WrapKey(ctx context.Context, plaintext []byte) (string, string, error) {
+	resp, err := p.call(ctx, "Encrypt", map[string]string{
+		"KeyId":     p.keyID,
+		"Plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if resp.CiphertextBlob == "" {
+		return "", "", apperrors.New(apperrors.ErrCodeInternal, "kms returned no ciphertext")
+	}
+	keyID := resp.KeyID
+	if keyID == "" {
+		keyID = p.keyID
+	}
+	return providerKeyID(KeyProviderAWSKMS, keyID), resp.CiphertextBlob, nil
+}
+
+// UnwrapKey decrypts key material with the KMS key named by keyID.
+func (p *AWSKMSKeyProvider) UnwrapKey(ctx context.Context, keyID, wrapped string) ([]byte, error) {
+	kmsKeyID, err := parseProviderKeyID(KeyProviderAWSKMS, keyID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.call(ctx, "Decrypt", map[string]string{
+		"KeyId":          kmsKeyID,
+		"CiphertextBlob": wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "kms returned malformed plaintext")
+	}
+	return plaintext, nil
+}
+
+// call sends a signed request for a KMS API action.
+func (p *AWSKMSKeyProvider) call(ctx context.Context, action string, body interface{}) (*awsKMSResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encode kms request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to build kms request")
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	p.sign(req, payload)
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeNetwork, "kms request failed")
+	}
+	defer res.Body.Close()
+
+	var resp awsKMSResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&resp); err != nil && res.StatusCode == http.StatusOK {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to decode kms response")
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, apperrors.New(apperrors.ErrCodeNetwork, fmt.Sprintf("kms %s failed with status %d: %s %s", action, res.StatusCode, resp.Type, resp.Message))
+	}
+	return &resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to a KMS request.
+func (p *AWSKMSKeyProvider) sign(req *http.Request, payload []byte) {
+	now := p.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if p.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.sessionToken)
+	}
+
+	// Signed headers, in the sorted order both the list and the canonical headers use
+	signedHeaders := []string{"content-type", "host", "x-amz-date"}
+	if p.sessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	signedHeaders = append(signedHeaders, "x-amz-target")
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaderList := strings.Join(signedHeaders, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaderList,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + p.region + "/kms/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+p.secretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, p.region)
+	signingKey = hmacSHA256(signingKey, "kms")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		p.accessKeyID, scope, signedHeaderList, signature))
+}
+
+// canonicalQuery encodes query parameters the way Signature Version 4 expects.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// localKeystore is the on-disk layout of a LocalKeyProvider keystore.
+type localKeystore struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"` // Base64-encoded 256-bit keys by ID
+}
+
+// LocalKeyProvider wraps keys with AES-256-GCM under keys held in a JSON keystore file,
+// for development and single-node deployments without a key management service. The
+// keystore is created with a fresh key on first use; rotating it adds a key that wraps
+// from then on, and the earlier keys stay to unwrap what they wrapped.
+type LocalKeyProvider struct {
+	mu       sync.RWMutex
+	path     string
+	keystore localKeystore
+}
+
+// NewLocalKeyProvider opens the keystore at path, creating it if it does not exist.
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	if path == "" {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "local key provider requires KEYSTORE_PATH")
+	}
+
+	p := &LocalKeyProvider{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := p.RotateKey(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to read keystore")
+	}
+
+	if err := json.Unmarshal(data, &p.keystore); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to parse keystore")
+	}
+	if _, err := p.key(p.keystore.Active); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WrapKey encrypts key material under the active keystore key.
+func (p *LocalKeyProvider) WrapKey(ctx context.Context, plaintext []byte) (string, string, error) {
+	p.mu.RLock()
+	id := p.keystore.Active
+	p.mu.RUnlock()
+
+	gcm, err := p.cipher(id)
+	if err != nil {
+		return "", "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate nonce")
+	}
+
+	keyID := providerKeyID(KeyProviderLocal, id)
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(keyID))
+	return keyID, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// UnwrapKey decrypts key material wrapped under the named keystore key.
+func (p *LocalKeyProvider) UnwrapKey(ctx context.Context, keyID, wrapped string) ([]byte, error) {
+	id, err := parseProviderKeyID(KeyProviderLocal, keyID)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := p.cipher(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "malformed wrapped key")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to unwrap key")
+	}
+	return plaintext, nil
+}
+
+// RotateKey adds a new key to the keystore and makes it the one that wraps, returning
+// its key ID.
+func (p *LocalKeyProvider) RotateKey() (string, error) {
+	idBytes := make([]byte, 8)
+	key := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate key ID")
+	}
+	if _, err := rand.Read(key); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate key")
+	}
+	id := hex.EncodeToString(idBytes)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	keys := make(map[string]string, len(p.keystore.Keys)+1)
+	for existing, encoded := range p.keystore.Keys {
+		keys[existing] = encoded
+	}
+	keys[id] = base64.StdEncoding.EncodeToString(key)
+	updated := localKeystore{Active: id, Keys: keys}
+	if err := p.save(updated); err != nil {
+		return "", err
+	}
+	p.keystore = updated
+	return providerKeyID(KeyProviderLocal, id), nil
+}
+
+// save writes the keystore to a temporary file and renames it into place, so a crash
+// never leaves a truncated keystore behind.
+func (p *LocalKeyProvider) save(keystore localKeystore) error {
+	data, err := json.MarshalIndent(keystore, "", "  ")
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encode keystore")
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0o700); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create keystore directory")
+	}
+
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to write keystore")
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		os.Remove(tmp)
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to write keystore")
+	}
+	return nil
+}
+
+// key returns the keystore key with the given ID.
+func (p *LocalKeyProvider) key(id string) ([]byte, error) {
+	p.mu.RLock()
+	encoded, ok := p.keystore.Keys[id]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, apperrors.New(apperrors.ErrCodeNotFound, "key not found in keystore: "+id)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, "keystore key is malformed: "+id)
+	}
+	return key, nil
+}
+
+// cipher returns an AES-GCM cipher for the keystore key with the given ID.
+func (p *LocalKeyProvider) cipher(id string) (cipher.AEAD, error) {
+	key, err := p.key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create cipher")
+	}
+	return gcm, nil
+}
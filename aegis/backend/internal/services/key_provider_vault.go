@@ -0,0 +1,112 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// VaultKeyProvider wraps keys with a named key of a HashiCorp Vault transit secrets
+// engine, or any server speaking its encrypt and decrypt API. Vault keeps the key
+// version inside each ciphertext, so keys rotated in Vault still unwrap older values.
+type VaultKeyProvider struct {
+	addr       string
+	token      string
+	mount      string
+	keyName    string
+	httpClient *http.Client
+}
+
+// vaultResponse is the envelope of Vault API responses.
+type vaultResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// NewVaultKeyProvider creates a VaultKeyProvider for the transit key keyName mounted at
+// mount on the Vault server at addr.
+func NewVaultKeyProvider(addr, token, mount, keyName string) *VaultKeyProvider {
+	if mount == "" {
+		mount = "transit"
+	}
+	return &VaultKeyProvider{
+		addr:       strings.TrimRight(addr, "/"),
+		token:      token,
+		mount:      strings.Trim(mount, "/"),
+		keyName:    keyName,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WrapKey encrypts key material with the transit key.
+func (p *VaultKeyProvider) WrapKey(ctx context.Context, plaintext []byte) (string, string, error) {
+	resp, err := p.call(ctx, "encrypt", p.keyName, map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if !strings.HasPrefix(resp.Data.Ciphertext, "vault:") {
+		return "", "", apperrors.New(apperrors.ErrCodeInternal, "vault returned no ciphertext")
+	}
+	return providerKeyID(KeyProviderVault, p.keyName), resp.Data.Ciphertext, nil
+}
+
+// UnwrapKey decrypts key material with the transit key named by keyID.
+func (p *VaultKeyProvider) UnwrapKey(ctx context.Context, keyID, wrapped string) ([]byte, error) {
+	keyName, err := parseProviderKeyID(KeyProviderVault, keyID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.call(ctx, "decrypt", keyName, map[string]string{"ciphertext": wrapped})
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "vault returned malformed plaintext")
+	}
+	return plaintext, nil
+}
+
+// call posts a request to a transit endpoint for the named key.
+func (p *VaultKeyProvider) call(ctx context.Context, operation, keyName string, body interface{}) (*vaultResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encode vault request")
+	}
+	endpoint := fmt.Sprintf("%s/v1/%s/%s/%s", p.addr, p.mount, operation, url.PathEscape(keyName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to build vault request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", p.token)
+
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeNetwork, "vault request failed")
+	}
+	defer res.Body.Close()
+
+	var resp vaultResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&resp); err != nil && res.StatusCode == http.StatusOK {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to decode vault response")
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, apperrors.New(apperrors.ErrCodeNetwork, fmt.Sprintf("vault %s failed with status %d: %s", operation, res.StatusCode, strings.Join(resp.Errors, "; ")))
+	}
+	return &resp, nil
+}
@@ -0,0 +1,638 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	keyRecoveryRequestTTL        = 24 * time.Hour
+	escrowBatchSize              = 100
+	defaultKeyRecoveryAuditLimit = 100
+	maxKeyRecoveryAuditLimit     = 500
+)
+
+// KeyRecoveryService recovers envelope keys whose wrapped copy can no longer be opened.
+// Users can enroll a printable recovery key, and with AEGIS_KEY_ESCROW_PUBLIC_KEY set every
+// envelope key is also sealed to the organization escrow key, which two admins can use
+// together to restore it. Only public keys are stored; KeyRotationService re-seals both
+// copies whenever it changes an envelope key.
+type KeyRecoveryService struct {
+	*BaseService
+	cryptoManager *CryptoManager
+}
+
+// RecoveryStatus describes how a user's envelope key can be recovered.
+type RecoveryStatus struct {
+	RecoveryKeyEnrolled bool
+	EnrolledAt          *time.Time
+	Escrowed            bool // Sealed to the organization escrow key at its current version
+}
+
+// NewKeyRecoveryService creates a new key recovery service
+func NewKeyRecoveryService(db *database.DB, cryptoManager *CryptoManager) *KeyRecoveryService {
+	return &KeyRecoveryService{
+		BaseService:   NewBaseService(db),
+		cryptoManager: cryptoManager,
+	}
+}
+
+//================================================================================
+// Recovery Keys
+//================================================================================
+
+// EnrollRecoveryKey generates a recovery key for the user and seals their envelope key to
+// it, replacing any recovery key enrolled before. The printable key is returned once and
+// not kept anywhere.
+func (s *KeyRecoveryService) EnrollRecoveryKey(ctx context.Context, userID uint) (string, error) {
+	db := s.GetDB().GetDB()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return "", apperrors.New(apperrors.ErrCodeNotFound, "user not found")
+		}
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get user")
+	}
+	if user.EnvelopeKey == "" {
+		return "", apperrors.New(apperrors.ErrCodeInvalidArgument, "user has no envelope key to recover")
+	}
+
+	envelopeKey, err := s.cryptoManager.UnwrapEnvelopeKey(ctx, user.EnvelopeKeyID, user.EnvelopeKey)
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to unwrap envelope key")
+	}
+	recoveryKey, publicKey, err := s.cryptoManager.GenerateRecoveryKey()
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate recovery key")
+	}
+	sealed, err := s.cryptoManager.SealEnvelopeKey(envelopeKey, publicKey)
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to seal envelope key")
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// A rotation that swapped the key meanwhile would leave this copy outdated
+		var current models.User
+		if err := tx.Select("envelope_key_version").First(&current, userID).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get user")
+		}
+		if current.EnvelopeKeyVersion != user.EnvelopeKeyVersion {
+			return apperrors.New(apperrors.ErrCodeConflict, "envelope key changed during enrollment, try again")
+		}
+
+		escrow := models.EnvelopeKeyEscrow{
+			UserID:             userID,
+			Kind:               models.EnvelopeKeyEscrowRecoveryKey,
+			PublicKey:          base64.StdEncoding.EncodeToString(publicKey),
+			SealedEnvelopeKey:  sealed,
+			EnvelopeKeyVersion: user.EnvelopeKeyVersion,
+		}
+		if err := upsertEnvelopeKeyEscrow(tx, &escrow); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to store recovery key")
+		}
+		return recordKeyRecoveryEvent(tx, models.KeyRecoveryAuditRecoveryKeyEnrolled, userID, userID, nil, "")
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return recoveryKey, nil
+}
+
+// RecoverWithRecoveryKey restores the user's envelope key from the copy sealed to their
+// recovery key, re-wrapping it with the key provider. The recovery key stays valid.
+func (s *KeyRecoveryService) RecoverWithRecoveryKey(ctx context.Context, userID uint, recoveryKey string) error {
+	privateKey, err := ParseRecoveryKey(recoveryKey)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInvalidArgument, "malformed recovery key")
+	}
+
+	escrow, err := s.getEscrow(userID, models.EnvelopeKeyEscrowRecoveryKey)
+	if err != nil {
+		return err
+	}
+	if escrow == nil {
+		return apperrors.New(apperrors.ErrCodeNotFound, "no recovery key is enrolled")
+	}
+
+	envelopeKey, err := s.openEscrow(escrow, privateKey)
+	if err != nil {
+		s.recordFailure(models.KeyRecoveryAuditRecoveryKeyRejected, userID, userID, nil, err.Error())
+		return apperrors.Wrap(err, apperrors.ErrCodeUnauthorized, "recovery key does not match")
+	}
+
+	return s.restoreEnvelopeKey(ctx, escrow, envelopeKey, func(tx *gorm.DB) error {
+		return recordKeyRecoveryEvent(tx, models.KeyRecoveryAuditRecoveryKeyUsed, userID, userID, nil, "")
+	})
+}
+
+// GetRecoveryStatus reports whether the user has a recovery key and an escrowed envelope key
+func (s *KeyRecoveryService) GetRecoveryStatus(userID uint) (*RecoveryStatus, error) {
+	db := s.GetDB().GetDB()
+
+	var user models.User
+	if err := db.Select("id", "envelope_key_version").First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "user not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get user")
+	}
+
+	var escrows []models.EnvelopeKeyEscrow
+	if err := db.Where("user_id = ?", userID).Find(&escrows).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get envelope key escrows")
+	}
+
+	status := &RecoveryStatus{}
+	escrowPublicKey := base64.StdEncoding.EncodeToString(s.cryptoManager.EscrowPublicKey())
+	for _, escrow := range escrows {
+		switch escrow.Kind {
+		case models.EnvelopeKeyEscrowRecoveryKey:
+			status.RecoveryKeyEnrolled = true
+			enrolledAt := escrow.CreatedAt
+			status.EnrolledAt = &enrolledAt
+		case models.EnvelopeKeyEscrowOrganization:
+			status.Escrowed = escrow.PublicKey == escrowPublicKey && escrow.EnvelopeKeyVersion == user.EnvelopeKeyVersion
+		}
+	}
+	return status, nil
+}
+
+//================================================================================
+// Organization Escrow
+//================================================================================
+
+// EscrowEnvelopeKeys seals every envelope key not yet sealed to the current organization
+// escrow key at its current version, returning how many were sealed. Keys that can no
+// longer be unwrapped are skipped with a warning. It is run at startup and does nothing
+// when key escrow is not enabled.
+func (s *KeyRecoveryService) EscrowEnvelopeKeys(ctx context.Context) (int, error) {
+	escrowPublicKey := s.cryptoManager.EscrowPublicKey()
+	if escrowPublicKey == nil {
+		return 0, nil
+	}
+	encodedPublicKey := base64.StdEncoding.EncodeToString(escrowPublicKey)
+	db := s.GetDB().GetDB()
+
+	escrowed := 0
+	var lastUserID uint
+	for {
+		if err := ctx.Err(); err != nil {
+			return escrowed, err
+		}
+
+		var users []models.User
+		if err := db.Model(&models.User{}).
+			Joins("LEFT JOIN envelope_key_escrows ON envelope_key_escrows.user_id = users.id AND envelope_key_escrows.kind = ?", models.EnvelopeKeyEscrowOrganization).
+			Where("users.envelope_key <> '' AND users.id > ?", lastUserID).
+			Where("envelope_key_escrows.id IS NULL OR envelope_key_escrows.public_key <> ? OR envelope_key_escrows.envelope_key_version <> users.envelope_key_version", encodedPublicKey).
+			Order("users.id").Limit(escrowBatchSize).Find(&users).Error; err != nil {
+			return escrowed, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find envelope keys to escrow")
+		}
+		if len(users) == 0 {
+			return escrowed, nil
+		}
+
+		for _, user := range users {
+			sealed, err := s.escrowEnvelopeKey(ctx, &user, escrowPublicKey)
+			if err != nil {
+				return escrowed, err
+			}
+			if sealed {
+				escrowed++
+			}
+		}
+		lastUserID = users[len(users)-1].ID
+	}
+}
+
+// escrowEnvelopeKey seals one user's envelope key to the organization escrow key. A key
+// rotated since the user was read is left to the rotation, which seals it itself.
+func (s *KeyRecoveryService) escrowEnvelopeKey(ctx context.Context, user *models.User, escrowPublicKey []byte) (bool, error) {
+	envelopeKey, err := s.cryptoManager.UnwrapEnvelopeKey(ctx, user.EnvelopeKeyID, user.EnvelopeKey)
+	if err != nil {
+		log.Printf("Warning: not escrowing the envelope key of user %d: %v", user.ID, err)
+		return false, nil
+	}
+	sealed, err := s.cryptoManager.SealEnvelopeKey(envelopeKey, escrowPublicKey)
+	if err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to seal envelope key")
+	}
+
+	stored := false
+	err = s.GetDB().GetDB().Transaction(func(tx *gorm.DB) error {
+		var current models.User
+		if err := tx.Select("envelope_key_version").First(&current, user.ID).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get user")
+		}
+		if current.EnvelopeKeyVersion != user.EnvelopeKeyVersion {
+			return nil
+		}
+
+		escrow := models.EnvelopeKeyEscrow{
+			UserID:             user.ID,
+			Kind:               models.EnvelopeKeyEscrowOrganization,
+			PublicKey:          base64.StdEncoding.EncodeToString(escrowPublicKey),
+			SealedEnvelopeKey:  sealed,
+			EnvelopeKeyVersion: user.EnvelopeKeyVersion,
+		}
+		if err := upsertEnvelopeKeyEscrow(tx, &escrow); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to store escrowed envelope key")
+		}
+		stored = true
+		return nil
+	})
+	return stored, err
+}
+
+// RequestEscrowRecovery opens a request to restore the user's envelope key from the
+// organization escrow. It has to be approved by a second admin before it can be completed.
+func (s *KeyRecoveryService) RequestEscrowRecovery(adminID, userID uint, reason string) (*models.KeyRecoveryRequest, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, apperrors.New(apperrors.ErrCodeValidation, "a reason is required")
+	}
+
+	escrow, err := s.getEscrow(userID, models.EnvelopeKeyEscrowOrganization)
+	if err != nil {
+		return nil, err
+	}
+	if escrow == nil {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "user's envelope key is not escrowed")
+	}
+
+	request := models.KeyRecoveryRequest{
+		UserID:      userID,
+		RequestedBy: adminID,
+		Reason:      reason,
+		Status:      models.KeyRecoveryStatusPending,
+		ExpiresAt:   time.Now().Add(keyRecoveryRequestTTL),
+	}
+	err = s.GetDB().GetDB().Transaction(func(tx *gorm.DB) error {
+		var open int64
+		if err := tx.Model(&models.KeyRecoveryRequest{}).
+			Where("user_id = ? AND status IN ? AND expires_at > ?", userID,
+				[]string{models.KeyRecoveryStatusPending, models.KeyRecoveryStatusApproved}, time.Now()).
+			Count(&open).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to check open recovery requests")
+		}
+		if open > 0 {
+			return apperrors.New(apperrors.ErrCodeConflict, "a recovery request for this user is already open")
+		}
+
+		if err := tx.Create(&request).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create recovery request")
+		}
+		return recordKeyRecoveryEvent(tx, models.KeyRecoveryAuditRequested, userID, adminID, &request.ID, reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// ApproveEscrowRecovery approves a pending recovery request. The approver must be a
+// different admin from the one who requested it, and not the user being recovered.
+func (s *KeyRecoveryService) ApproveEscrowRecovery(adminID, requestID uint) (*models.KeyRecoveryRequest, error) {
+	request, err := s.getOpenRequest(requestID, models.KeyRecoveryStatusPending)
+	if err != nil {
+		return nil, err
+	}
+	if request.RequestedBy == adminID {
+		return nil, apperrors.New(apperrors.ErrCodeForbidden, "a recovery request must be approved by a second admin")
+	}
+	if request.UserID == adminID {
+		return nil, apperrors.New(apperrors.ErrCodeForbidden, "admins cannot approve the recovery of their own key")
+	}
+
+	now := time.Now()
+	err = s.GetDB().GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.KeyRecoveryRequest{}).
+			Where("id = ? AND status = ?", requestID, models.KeyRecoveryStatusPending).
+			Updates(map[string]interface{}{
+				"status":      models.KeyRecoveryStatusApproved,
+				"approved_by": adminID,
+				"approved_at": now,
+			})
+		if result.Error != nil {
+			return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to approve recovery request")
+		}
+		if result.RowsAffected == 0 {
+			return apperrors.New(apperrors.ErrCodeConflict, "recovery request is no longer pending")
+		}
+		return recordKeyRecoveryEvent(tx, models.KeyRecoveryAuditApproved, request.UserID, adminID, &request.ID, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request.Status = models.KeyRecoveryStatusApproved
+	request.ApprovedBy = &adminID
+	request.ApprovedAt = &now
+	return request, nil
+}
+
+// CompleteEscrowRecovery restores the user's envelope key of an approved request with the
+// organization escrow private key, given base64-encoded. Only the requesting or the
+// approving admin can complete it. The private key is used for this request only.
+func (s *KeyRecoveryService) CompleteEscrowRecovery(ctx context.Context, adminID, requestID uint, escrowPrivateKey string) (*models.KeyRecoveryRequest, error) {
+	request, err := s.getOpenRequest(requestID, models.KeyRecoveryStatusApproved)
+	if err != nil {
+		return nil, err
+	}
+	if request.RequestedBy != adminID && (request.ApprovedBy == nil || *request.ApprovedBy != adminID) {
+		return nil, apperrors.New(apperrors.ErrCodeForbidden, "only the requesting or approving admin can complete a recovery")
+	}
+
+	privateKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(escrowPrivateKey))
+	if err != nil || len(privateKey) != 32 {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "escrow key must be a base64-encoded 32-byte X25519 key")
+	}
+
+	escrow, err := s.getEscrow(request.UserID, models.EnvelopeKeyEscrowOrganization)
+	if err != nil {
+		return nil, err
+	}
+	if escrow == nil {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "user's envelope key is not escrowed")
+	}
+
+	envelopeKey, err := s.openEscrow(escrow, privateKey)
+	if err != nil {
+		s.recordFailure(models.KeyRecoveryAuditFailed, request.UserID, adminID, &request.ID, err.Error())
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeUnauthorized, "escrow key does not match")
+	}
+
+	now := time.Now()
+	err = s.restoreEnvelopeKey(ctx, escrow, envelopeKey, func(tx *gorm.DB) error {
+		result := tx.Model(&models.KeyRecoveryRequest{}).
+			Where("id = ? AND status = ?", requestID, models.KeyRecoveryStatusApproved).
+			Updates(map[string]interface{}{
+				"status":       models.KeyRecoveryStatusCompleted,
+				"completed_by": adminID,
+				"completed_at": now,
+			})
+		if result.Error != nil {
+			return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to complete recovery request")
+		}
+		if result.RowsAffected == 0 {
+			return apperrors.New(apperrors.ErrCodeConflict, "recovery request is no longer approved")
+		}
+		return recordKeyRecoveryEvent(tx, models.KeyRecoveryAuditCompleted, request.UserID, adminID, &request.ID, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request.Status = models.KeyRecoveryStatusCompleted
+	request.CompletedBy = &adminID
+	request.CompletedAt = &now
+	return request, nil
+}
+
+// CancelEscrowRecovery cancels a pending or approved recovery request. Any admin can cancel.
+func (s *KeyRecoveryService) CancelEscrowRecovery(adminID, requestID uint) (*models.KeyRecoveryRequest, error) {
+	db := s.GetDB().GetDB()
+
+	var request models.KeyRecoveryRequest
+	if err := db.First(&request, requestID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "recovery request not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get recovery request")
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.KeyRecoveryRequest{}).
+			Where("id = ? AND status IN ?", requestID, []string{models.KeyRecoveryStatusPending, models.KeyRecoveryStatusApproved}).
+			Update("status", models.KeyRecoveryStatusCancelled)
+		if result.Error != nil {
+			return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to cancel recovery request")
+		}
+		if result.RowsAffected == 0 {
+			return apperrors.New(apperrors.ErrCodeInvalidArgument, "only pending or approved recovery requests can be cancelled")
+		}
+		return recordKeyRecoveryEvent(tx, models.KeyRecoveryAuditCancelled, request.UserID, adminID, &request.ID, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request.Status = models.KeyRecoveryStatusCancelled
+	return &request, nil
+}
+
+// ListRecoveryRequests lists recovery requests, newest first, optionally only those with
+// the given status.
+func (s *KeyRecoveryService) ListRecoveryRequests(status string) ([]*models.KeyRecoveryRequest, error) {
+	query := s.GetDB().GetDB().Order("created_at DESC, id DESC")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var requests []*models.KeyRecoveryRequest
+	if err := query.Find(&requests).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list recovery requests")
+	}
+	return requests, nil
+}
+
+// ListAuditEvents returns the most recent key recovery audit events, optionally only
+// those of one user.
+func (s *KeyRecoveryService) ListAuditEvents(userID *uint, limit int) ([]*models.KeyRecoveryAuditEvent, error) {
+	if limit <= 0 {
+		limit = defaultKeyRecoveryAuditLimit
+	}
+	if limit > maxKeyRecoveryAuditLimit {
+		limit = maxKeyRecoveryAuditLimit
+	}
+
+	query := s.GetDB().GetDB().Order("created_at DESC, id DESC").Limit(limit)
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	}
+
+	var events []*models.KeyRecoveryAuditEvent
+	if err := query.Find(&events).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list key recovery audit events")
+	}
+	return events, nil
+}
+
+//================================================================================
+// Helpers
+//================================================================================
+
+// getEscrow returns the user's escrow of the given kind, or nil if there is none.
+func (s *KeyRecoveryService) getEscrow(userID uint, kind string) (*models.EnvelopeKeyEscrow, error) {
+	var escrow models.EnvelopeKeyEscrow
+	if err := s.GetDB().GetDB().Where("user_id = ? AND kind = ?", userID, kind).First(&escrow).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get envelope key escrow")
+	}
+	return &escrow, nil
+}
+
+// getOpenRequest returns a recovery request with the given status that has not expired
+func (s *KeyRecoveryService) getOpenRequest(requestID uint, status string) (*models.KeyRecoveryRequest, error) {
+	var request models.KeyRecoveryRequest
+	if err := s.GetDB().GetDB().First(&request, requestID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "recovery request not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get recovery request")
+	}
+	if request.Status != status {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("recovery request is %s", strings.ToLower(request.Status)))
+	}
+	if time.Now().After(request.ExpiresAt) {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "recovery request has expired")
+	}
+	return &request, nil
+}
+
+// openEscrow opens an escrowed envelope key, after checking that privateKey belongs to the
+// public key it was sealed to.
+func (s *KeyRecoveryService) openEscrow(escrow *models.EnvelopeKeyEscrow, privateKey []byte) ([]byte, error) {
+	publicKey, err := RecoveryPublicKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if base64.StdEncoding.EncodeToString(publicKey) != escrow.PublicKey {
+		return nil, fmt.Errorf("key does not match the public key the envelope key is sealed to")
+	}
+	return s.cryptoManager.OpenEnvelopeKey(escrow.SealedEnvelopeKey, privateKey)
+}
+
+// restoreEnvelopeKey wraps a recovered envelope key with the key provider and stores it
+// on the user, together with whatever record completes the recovery. The envelope key
+// version is kept, so nothing wrapped by the key has to change.
+func (s *KeyRecoveryService) restoreEnvelopeKey(ctx context.Context, escrow *models.EnvelopeKeyEscrow, envelopeKey []byte, record func(tx *gorm.DB) error) error {
+	keyID, wrapped, err := s.cryptoManager.WrapEnvelopeKey(ctx, envelopeKey)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to wrap envelope key")
+	}
+
+	return s.GetDB().GetDB().Transaction(func(tx *gorm.DB) error {
+		// Conditional, so a key rotated since it was sealed is not rolled back
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND envelope_key_version = ?", escrow.UserID, escrow.EnvelopeKeyVersion).
+			Updates(map[string]interface{}{
+				"envelope_key":            wrapped,
+				"envelope_key_id":         keyID,
+				"envelope_key_salt":       "",
+				"envelope_key_iv":         "",
+				"envelope_key_updated_at": time.Now(),
+			})
+		if result.Error != nil {
+			return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to restore envelope key")
+		}
+		if result.RowsAffected == 0 {
+			return apperrors.New(apperrors.ErrCodeConflict, "envelope key changed since it was sealed")
+		}
+		return record(tx)
+	})
+}
+
+// recordFailure records a failed recovery attempt. The attempt has already failed, so an
+// error recording it is only logged.
+func (s *KeyRecoveryService) recordFailure(event string, userID, actorID uint, requestID *uint, detail string) {
+	if err := recordKeyRecoveryEvent(s.GetDB().GetDB(), event, userID, actorID, requestID, detail); err != nil {
+		log.Printf("Warning: failed to record key recovery audit event: %v", err)
+	}
+}
+
+// recordKeyRecoveryEvent adds an entry to the key recovery audit trail
+func recordKeyRecoveryEvent(tx *gorm.DB, event string, userID, actorID uint, requestID *uint, detail string) error {
+	if err := tx.Create(&models.KeyRecoveryAuditEvent{
+		Event:     event,
+		UserID:    userID,
+		ActorID:   actorID,
+		RequestID: requestID,
+		Detail:    detail,
+	}).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to record key recovery audit event")
+	}
+	return nil
+}
+
+// upsertEnvelopeKeyEscrow stores an escrow, replacing the user's escrow of the same kind
+func upsertEnvelopeKeyEscrow(tx *gorm.DB, escrow *models.EnvelopeKeyEscrow) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "kind"}},
+		DoUpdates: clause.AssignmentColumns([]string{"public_key", "sealed_envelope_key", "envelope_key_version", "updated_at"}),
+	}).Create(escrow).Error
+}
+
+// resealEnvelopeKeyEscrows seals a user's changed envelope key to every key it was
+// escrowed to, and to the organization escrow key when key escrow is enabled. It runs in
+// the transaction that stores the envelope key, so the copies never fall behind.
+func resealEnvelopeKeyEscrows(tx *gorm.DB, cryptoManager *CryptoManager, userID uint, envelopeKey []byte, version int) error {
+	var escrows []models.EnvelopeKeyEscrow
+	if err := tx.Where("user_id = ?", userID).Find(&escrows).Error; err != nil {
+		return fmt.Errorf("failed to get envelope key escrows: %w", err)
+	}
+
+	escrowPublicKey := cryptoManager.EscrowPublicKey()
+	organizationEscrowed := false
+	for i := range escrows {
+		escrow := &escrows[i]
+		if escrow.Kind == models.EnvelopeKeyEscrowOrganization {
+			organizationEscrowed = true
+			if escrowPublicKey != nil {
+				escrow.PublicKey = base64.StdEncoding.EncodeToString(escrowPublicKey)
+			}
+		}
+		if err := sealEscrow(tx, cryptoManager, escrow, envelopeKey, version); err != nil {
+			return err
+		}
+	}
+
+	if !organizationEscrowed && escrowPublicKey != nil {
+		escrow := &models.EnvelopeKeyEscrow{
+			UserID:    userID,
+			Kind:      models.EnvelopeKeyEscrowOrganization,
+			PublicKey: base64.StdEncoding.EncodeToString(escrowPublicKey),
+		}
+		if err := sealEscrow(tx, cryptoManager, escrow, envelopeKey, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealEscrow seals envelopeKey to the escrow's public key and stores it
+func sealEscrow(tx *gorm.DB, cryptoManager *CryptoManager, escrow *models.EnvelopeKeyEscrow, envelopeKey []byte, version int) error {
+	publicKey, err := base64.StdEncoding.DecodeString(escrow.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s public key: %w", escrow.Kind, err)
+	}
+	escrow.SealedEnvelopeKey, err = cryptoManager.SealEnvelopeKey(envelopeKey, publicKey)
+	if err != nil {
+		return err
+	}
+	escrow.EnvelopeKeyVersion = version
+	if err := upsertEnvelopeKeyEscrow(tx, escrow); err != nil {
+		return fmt.Errorf("failed to store %s escrow: %w", escrow.Kind, err)
+	}
+	return nil
+}
@@ -0,0 +1,664 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+// KeyRotationCampaignStatus is the state of a key rotation campaign
+type KeyRotationCampaignStatus string
+
+const (
+	KeyRotationCampaignRunning   KeyRotationCampaignStatus = "RUNNING"
+	KeyRotationCampaignPaused    KeyRotationCampaignStatus = "PAUSED"
+	KeyRotationCampaignCompleted KeyRotationCampaignStatus = "COMPLETED"
+	KeyRotationCampaignCancelled KeyRotationCampaignStatus = "CANCELLED"
+)
+
+const (
+	defaultCampaignConcurrency  = 4
+	maxCampaignConcurrency      = 32
+	defaultCampaignRateLimit    = 20
+	campaignEnrollmentBatchSize = 100
+	campaignShareBatchSize      = 100
+)
+
+// KeyRotationCampaignService rotates every user's envelope key and every share envelope
+// on an admin's request. Users are rotated a few at a time through KeyRotationService,
+// with the database batches of all of them rate limited, and share envelopes are then
+// re-keyed in checkpointed batches. Pausing or cancelling lets the rotations in flight
+// finish, so no user is left half rotated; a campaign interrupted by a restart resumes
+// at startup.
+type KeyRotationCampaignService struct {
+	*BaseService
+	cryptoManager   *CryptoManager
+	rotationService *KeyRotationService
+
+	mu      sync.Mutex
+	running bool
+	wake    chan struct{}
+}
+
+// KeyRotationCampaignUser is the rotation of one user in a campaign.
+type KeyRotationCampaignUser struct {
+	UserID   uint
+	Username string
+	Rotation *KeyRotationResult
+}
+
+// NewKeyRotationCampaignService creates a new KeyRotationCampaignService.
+func NewKeyRotationCampaignService(db *database.DB, cryptoManager *CryptoManager, rotationService *KeyRotationService) *KeyRotationCampaignService {
+	return &KeyRotationCampaignService{
+		BaseService:     NewBaseService(db),
+		cryptoManager:   cryptoManager,
+		rotationService: rotationService,
+		wake:            make(chan struct{}, 1),
+	}
+}
+
+//================================================================================
+// Campaign Management
+//================================================================================
+
+// StartCampaign starts a campaign that rotates every user with an envelope key, at most
+// concurrency at a time and at most ratePerSecond database batches per second. Zero
+// selects the defaults; a negative rate disables the limit. Only one campaign may be
+// running or paused at a time.
+func (s *KeyRotationCampaignService) StartCampaign(adminID uint, concurrency, ratePerSecond int) (*models.KeyRotationCampaign, error) {
+	if concurrency == 0 {
+		concurrency = defaultCampaignConcurrency
+	}
+	if concurrency < 1 || concurrency > maxCampaignConcurrency {
+		return nil, apperrors.New(apperrors.ErrCodeValidation, fmt.Sprintf("concurrency must be between 1 and %d", maxCampaignConcurrency))
+	}
+	if ratePerSecond == 0 {
+		ratePerSecond = defaultCampaignRateLimit
+	} else if ratePerSecond < 0 {
+		ratePerSecond = 0
+	}
+
+	db := s.GetDB().GetDB()
+
+	var active int64
+	if err := db.Model(&models.KeyRotationCampaign{}).
+		Where("status IN (?, ?)", KeyRotationCampaignRunning, KeyRotationCampaignPaused).Count(&active).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to check active campaigns")
+	}
+	if active > 0 {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "a key rotation campaign is already active")
+	}
+
+	var totalUsers, totalShares int64
+	if err := db.Model(&models.User{}).Where("envelope_key <> ''").Count(&totalUsers).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to count users")
+	}
+	if err := db.Model(&models.FileShare{}).Count(&totalShares).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to count shares")
+	}
+
+	campaignID, err := s.rotationService.generateRotationID()
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate campaign ID")
+	}
+
+	campaign := &models.KeyRotationCampaign{
+		CampaignID:         campaignID,
+		Status:             string(KeyRotationCampaignRunning),
+		StartedBy:          adminID,
+		Concurrency:        concurrency,
+		RateLimitPerSecond: ratePerSecond,
+		TotalUsers:         int(totalUsers),
+		TotalShares:        int(totalShares),
+		StartedAt:          time.Now(),
+	}
+	if err := db.Create(campaign).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create campaign")
+	}
+
+	s.notifyWorker()
+	return campaign, nil
+}
+
+// PauseCampaign stops a running campaign from starting further rotations.
+func (s *KeyRotationCampaignService) PauseCampaign(campaignID string) (*models.KeyRotationCampaign, error) {
+	return s.transition(campaignID, KeyRotationCampaignPaused, KeyRotationCampaignRunning)
+}
+
+// ResumeCampaign continues a paused campaign.
+func (s *KeyRotationCampaignService) ResumeCampaign(campaignID string) (*models.KeyRotationCampaign, error) {
+	campaign, err := s.transition(campaignID, KeyRotationCampaignRunning, KeyRotationCampaignPaused)
+	if err != nil {
+		return nil, err
+	}
+	s.notifyWorker()
+	return campaign, nil
+}
+
+// CancelCampaign ends a running or paused campaign. Users whose rotation had not started
+// are marked CANCELLED and keep their envelope key.
+func (s *KeyRotationCampaignService) CancelCampaign(campaignID string) (*models.KeyRotationCampaign, error) {
+	campaign, err := s.transition(campaignID, KeyRotationCampaignCancelled, KeyRotationCampaignRunning, KeyRotationCampaignPaused)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	db := s.GetDB().GetDB()
+	if err := db.Model(&models.KeyRotation{}).
+		Where("campaign_id = ? AND status = ?", campaignID, KeyRotationStatusPending).
+		Updates(map[string]interface{}{
+			"status":       string(KeyRotationStatusCancelled),
+			"completed_at": now,
+		}).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to cancel pending rotations")
+	}
+	if err := db.Model(campaign).Update("completed_at", now).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to cancel campaign")
+	}
+	return campaign, nil
+}
+
+// GetCampaign returns a campaign by its campaign ID.
+func (s *KeyRotationCampaignService) GetCampaign(campaignID string) (*models.KeyRotationCampaign, error) {
+	var campaign models.KeyRotationCampaign
+	if err := s.GetDB().GetDB().Where("campaign_id = ?", campaignID).First(&campaign).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "campaign not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get campaign")
+	}
+	return &campaign, nil
+}
+
+// ListCampaigns returns every campaign, newest first.
+func (s *KeyRotationCampaignService) ListCampaigns() ([]*models.KeyRotationCampaign, error) {
+	var campaigns []*models.KeyRotationCampaign
+	if err := s.GetDB().GetDB().Order("id DESC").Find(&campaigns).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list campaigns")
+	}
+	return campaigns, nil
+}
+
+// CampaignUsers returns the rotation of each user enrolled in a campaign, optionally only
+// those with the given status.
+func (s *KeyRotationCampaignService) CampaignUsers(campaignID string, status *KeyRotationStatus) ([]*KeyRotationCampaignUser, error) {
+	if _, err := s.GetCampaign(campaignID); err != nil {
+		return nil, err
+	}
+
+	query := s.GetDB().GetDB().Preload("User").Where("campaign_id = ?", campaignID)
+	if status != nil {
+		query = query.Where("status = ?", string(*status))
+	}
+	var rotations []models.KeyRotation
+	if err := query.Order("user_id").Find(&rotations).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list campaign rotations")
+	}
+
+	users := make([]*KeyRotationCampaignUser, len(rotations))
+	for i, rotation := range rotations {
+		users[i] = &KeyRotationCampaignUser{
+			UserID:   rotation.UserID,
+			Username: rotation.User.Username,
+			Rotation: &KeyRotationResult{
+				RotationID:         rotation.RotationID,
+				Status:             KeyRotationStatus(rotation.Status),
+				TotalFilesAffected: rotation.TotalFilesAffected,
+				FilesProcessed:     rotation.FilesProcessed,
+				ErrorMessage:       rotation.ErrorMessage,
+			},
+		}
+	}
+	return users, nil
+}
+
+// transition moves a campaign to status if it is in one of the from states.
+func (s *KeyRotationCampaignService) transition(campaignID string, status KeyRotationCampaignStatus, from ...KeyRotationCampaignStatus) (*models.KeyRotationCampaign, error) {
+	campaign, err := s.GetCampaign(campaignID)
+	if err != nil {
+		return nil, err
+	}
+
+	fromStates := make([]string, len(from))
+	for i, state := range from {
+		fromStates[i] = string(state)
+	}
+	result := s.GetDB().GetDB().Model(&models.KeyRotationCampaign{}).
+		Where("id = ? AND status IN ?", campaign.ID, fromStates).
+		Update("status", string(status))
+	if result.Error != nil {
+		return nil, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to update campaign")
+	}
+	if result.RowsAffected == 0 {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("campaign is %s", campaign.Status))
+	}
+
+	campaign.Status = string(status)
+	return campaign, nil
+}
+
+//================================================================================
+// Campaign Runner
+//================================================================================
+
+// StartWorker finishes the rotations a previous process left in flight and resumes
+// running campaigns, then runs campaigns as they are started or resumed, until ctx is
+// cancelled.
+func (s *KeyRotationCampaignService) StartWorker(ctx context.Context) {
+	go func() {
+		for {
+			if err := s.RunCampaigns(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Warning: Key rotation campaign failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			}
+		}
+	}()
+}
+
+// RunCampaigns finishes the in-flight rotations of paused and cancelled campaigns, then
+// runs every running campaign until it completes or is paused or cancelled. Only one run
+// may be in progress at a time.
+func (s *KeyRotationCampaignService) RunCampaigns(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return apperrors.New(apperrors.ErrCodeConflict, "key rotation campaigns are already running")
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	db := s.GetDB().GetDB()
+
+	var stopped []models.KeyRotationCampaign
+	if err := db.Where("status IN (?, ?)", KeyRotationCampaignPaused, KeyRotationCampaignCancelled).Find(&stopped).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find stopped campaigns")
+	}
+	for i := range stopped {
+		var rotations []models.KeyRotation
+		if err := db.Where("campaign_id = ? AND status = ?", stopped[i].CampaignID, KeyRotationStatusInProgress).
+			Find(&rotations).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find interrupted rotations")
+		}
+		if len(rotations) == 0 {
+			continue
+		}
+		if err := s.rotateUsers(ctx, &stopped[i], rotations, s.newLimiter(&stopped[i])); err != nil {
+			return err
+		}
+		if err := s.refreshUserCounts(&stopped[i]); err != nil {
+			return err
+		}
+	}
+
+	var campaigns []models.KeyRotationCampaign
+	if err := db.Where("status = ?", KeyRotationCampaignRunning).Order("id").Find(&campaigns).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find running campaigns")
+	}
+	for i := range campaigns {
+		if err := s.runCampaign(ctx, &campaigns[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCampaign enrolls every user, rotates them, then rotates every share envelope. It
+// returns early, without error, once the campaign is no longer running.
+func (s *KeyRotationCampaignService) runCampaign(ctx context.Context, campaign *models.KeyRotationCampaign) error {
+	limiter := s.newLimiter(campaign)
+
+	for !campaign.UsersEnrolled {
+		if running, err := s.stillRunning(ctx, campaign); !running || err != nil {
+			return err
+		}
+		if err := s.enrollUsers(campaign); err != nil {
+			return err
+		}
+	}
+
+	// Rotate users in waves, checking for a pause or cancellation between them
+	db := s.GetDB().GetDB()
+	for {
+		if running, err := s.stillRunning(ctx, campaign); !running || err != nil {
+			return err
+		}
+		var rotations []models.KeyRotation
+		if err := db.Where("campaign_id = ? AND status IN (?, ?)", campaign.CampaignID, KeyRotationStatusPending, KeyRotationStatusInProgress).
+			Order("id").Limit(campaign.Concurrency * 4).Find(&rotations).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find campaign rotations")
+		}
+		if len(rotations) == 0 {
+			break
+		}
+		if err := s.rotateUsers(ctx, campaign, rotations, limiter); err != nil {
+			return err
+		}
+		if err := s.refreshUserCounts(campaign); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if running, err := s.stillRunning(ctx, campaign); !running || err != nil {
+			return err
+		}
+		done, err := s.rotateShareBatch(ctx, campaign, limiter)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// enrollUsers creates a PENDING rotation of the campaign for the next batch of users after
+// the checkpoint, and advances the checkpoint in the same transaction.
+func (s *KeyRotationCampaignService) enrollUsers(campaign *models.KeyRotationCampaign) error {
+	db := s.GetDB().GetDB()
+
+	var users []models.User
+	if err := db.Where("id > ? AND envelope_key <> ''", campaign.LastUserID).
+		Order("id").Limit(campaignEnrollmentBatchSize).Find(&users).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find users to enroll")
+	}
+
+	checkpoint := map[string]interface{}{"users_enrolled": len(users) == 0}
+	if len(users) > 0 {
+		checkpoint["last_user_id"] = users[len(users)-1].ID
+	}
+
+	var enrolled int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, user := range users {
+			// A user with a rotation of their own already gets a new envelope key from it
+			var active int64
+			if err := tx.Model(&models.KeyRotation{}).Where("user_id = ? AND status IN (?, ?)",
+				user.ID, KeyRotationStatusPending, KeyRotationStatusInProgress).Count(&active).Error; err != nil {
+				return err
+			}
+			if active > 0 {
+				continue
+			}
+
+			var userFiles int64
+			if err := tx.Unscoped().Model(&models.UserFile{}).Where("user_id = ?", user.ID).Count(&userFiles).Error; err != nil {
+				return err
+			}
+			rotationID, err := s.rotationService.generateRotationID()
+			if err != nil {
+				return err
+			}
+			rotation := models.KeyRotation{
+				UserID:                user.ID,
+				RotationID:            rotationID,
+				CampaignID:            campaign.CampaignID,
+				Status:                string(KeyRotationStatusPending),
+				OldEnvelopeKeyVersion: user.EnvelopeKeyVersion,
+				NewEnvelopeKeyVersion: user.EnvelopeKeyVersion + 1,
+				TotalFilesAffected:    int(userFiles),
+				StartedAt:             time.Now(),
+			}
+			if err := tx.Create(&rotation).Error; err != nil {
+				return err
+			}
+		}
+
+		// Once every user is enrolled, the total is the number actually enrolled
+		if len(users) == 0 {
+			if err := tx.Model(&models.KeyRotation{}).Where("campaign_id = ?", campaign.CampaignID).Count(&enrolled).Error; err != nil {
+				return err
+			}
+			checkpoint["total_users"] = enrolled
+		}
+
+		result := tx.Model(&models.KeyRotationCampaign{}).
+			Where("id = ? AND last_user_id = ?", campaign.ID, campaign.LastUserID).
+			Updates(checkpoint)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRotationSuperseded
+		}
+		return nil
+	})
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to enroll users")
+	}
+
+	if len(users) > 0 {
+		campaign.LastUserID = users[len(users)-1].ID
+	} else {
+		campaign.UsersEnrolled = true
+		campaign.TotalUsers = int(enrolled)
+	}
+	return nil
+}
+
+// rotateUsers runs rotations with at most the campaign's concurrency at a time, sharing
+// limiter between them. Failed rotations are recorded on the rotation; an error is only
+// returned when the run was interrupted.
+func (s *KeyRotationCampaignService) rotateUsers(ctx context.Context, campaign *models.KeyRotationCampaign, rotations []models.KeyRotation, limiter *rate.Limiter) error {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, campaign.Concurrency)
+	for i := range rotations {
+		if ctx.Err() != nil {
+			break
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(rotation *models.KeyRotation) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			s.rotationService.runRotation(ctx, rotation, limiter.Wait)
+		}(&rotations[i])
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// refreshUserCounts recounts the rotated and failed users of a campaign from its rotations.
+func (s *KeyRotationCampaignService) refreshUserCounts(campaign *models.KeyRotationCampaign) error {
+	db := s.GetDB().GetDB()
+
+	var rotated, failed int64
+	if err := db.Model(&models.KeyRotation{}).Where("campaign_id = ? AND status = ?", campaign.CampaignID, KeyRotationStatusCompleted).
+		Count(&rotated).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to count rotated users")
+	}
+	if err := db.Model(&models.KeyRotation{}).Where("campaign_id = ? AND status = ?", campaign.CampaignID, KeyRotationStatusFailed).
+		Count(&failed).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to count failed users")
+	}
+
+	if err := db.Model(&models.KeyRotationCampaign{}).Where("id = ?", campaign.ID).Updates(map[string]interface{}{
+		"users_rotated": rotated,
+		"users_failed":  failed,
+	}).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to update campaign progress")
+	}
+	campaign.UsersRotated = int(rotated)
+	campaign.UsersFailed = int(failed)
+	return nil
+}
+
+// rotateShareBatch gives the next batch of shares after the checkpoint new envelope keys,
+// with at most the campaign's concurrency at a time, then records the outcome and
+// advances the checkpoint. It reports true once no shares are left and the campaign is
+// marked COMPLETED.
+func (s *KeyRotationCampaignService) rotateShareBatch(ctx context.Context, campaign *models.KeyRotationCampaign, limiter *rate.Limiter) (bool, error) {
+	db := s.GetDB().GetDB()
+
+	var shares []models.FileShare
+	if err := db.Where("id > ?", campaign.LastFileShareID).Order("id").Limit(campaignShareBatchSize).Find(&shares).Error; err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find shares")
+	}
+
+	if len(shares) == 0 {
+		result := db.Model(&models.KeyRotationCampaign{}).
+			Where("id = ? AND status = ?", campaign.ID, KeyRotationCampaignRunning).
+			Updates(map[string]interface{}{
+				"status":       string(KeyRotationCampaignCompleted),
+				"completed_at": time.Now(),
+			})
+		if result.Error != nil {
+			return false, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to complete campaign")
+		}
+		campaign.Status = string(KeyRotationCampaignCompleted)
+		return true, nil
+	}
+
+	var (
+		mu                       sync.Mutex
+		wg                       sync.WaitGroup
+		rotated, skipped, failed int
+		lastError                string
+	)
+	slots := make(chan struct{}, campaign.Concurrency)
+	for i := range shares {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(share *models.FileShare) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := limiter.Wait(ctx); err != nil {
+				return
+			}
+			changed, err := s.rotateShare(share)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				failed++
+				lastError = fmt.Sprintf("share %d: %v", share.ID, err)
+			case changed:
+				rotated++
+			default:
+				skipped++
+			}
+		}(&shares[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	lastShareID := shares[len(shares)-1].ID
+	updates := map[string]interface{}{
+		"last_file_share_id": lastShareID,
+		"shares_rotated":     gorm.Expr("shares_rotated + ?", rotated),
+		"shares_skipped":     gorm.Expr("shares_skipped + ?", skipped),
+		"shares_failed":      gorm.Expr("shares_failed + ?", failed),
+	}
+	if lastError != "" {
+		updates["last_error"] = lastError
+	}
+	result := db.Model(&models.KeyRotationCampaign{}).
+		Where("id = ? AND last_file_share_id = ?", campaign.ID, campaign.LastFileShareID).
+		Updates(updates)
+	if result.Error != nil {
+		return false, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to update campaign progress")
+	}
+	if result.RowsAffected == 0 {
+		return true, nil
+	}
+
+	campaign.LastFileShareID = lastShareID
+	campaign.SharesRotated += rotated
+	campaign.SharesSkipped += skipped
+	campaign.SharesFailed += failed
+	if lastError != "" {
+		campaign.LastError = lastError
+	}
+	return false, nil
+}
+
+// rotateShare gives a share a new envelope key, wrapped under its stored password, and
+// re-wraps the file key under it. It reports false for shares without a stored password
+// and shares changed since they were read.
+func (s *KeyRotationCampaignService) rotateShare(share *models.FileShare) (bool, error) {
+	if share.EncryptedPassword == "" {
+		return false, nil
+	}
+	password, err := s.cryptoManager.DecryptSharePassword(share.EncryptedPassword, share.PasswordIV, share.PasswordKeyVersion)
+	if err != nil {
+		return false, err
+	}
+	_, fileKey, err := openShareKeys(s.cryptoManager, share, password)
+	if err != nil {
+		return false, err
+	}
+	envelopeKey, err := s.cryptoManager.GenerateEnvelopeKey()
+	if err != nil {
+		return false, err
+	}
+	updates, err := sealShareKeys(s.cryptoManager, password, envelopeKey, fileKey)
+	if err != nil {
+		return false, err
+	}
+
+	result := s.GetDB().GetDB().Model(&models.FileShare{}).
+		Where("id = ? AND envelope_key = ? AND encrypted_key = ?", share.ID, share.EnvelopeKey, share.EncryptedKey).
+		Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// stillRunning reloads the status of a campaign and reports whether it is still running.
+func (s *KeyRotationCampaignService) stillRunning(ctx context.Context, campaign *models.KeyRotationCampaign) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var status string
+	if err := s.GetDB().GetDB().Model(&models.KeyRotationCampaign{}).Where("id = ?", campaign.ID).
+		Pluck("status", &status).Error; err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get campaign status")
+	}
+	campaign.Status = status
+	return status == string(KeyRotationCampaignRunning), nil
+}
+
+// newLimiter returns the rate limiter for the database batches of a campaign.
+func (s *KeyRotationCampaignService) newLimiter(campaign *models.KeyRotationCampaign) *rate.Limiter {
+	if campaign.RateLimitPerSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Limit(campaign.RateLimitPerSecond), 1)
+}
+
+// notifyWorker wakes the campaign runner without blocking.
+func (s *KeyRotationCampaignService) notifyWorker() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
@@ -1,9 +1,13 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/balkanid/aegis-backend/internal/database"
@@ -12,10 +16,22 @@ import (
 	"gorm.io/gorm"
 )
 
-// KeyRotationService handles envelope key rotation operations
+// keyRotationBatchSize is the number of file keys re-wrapped per checkpoint
+const keyRotationBatchSize = 10
+
+// errRotationSuperseded stops a runner whose rotation was advanced by another runner
+var errRotationSuperseded = errors.New("rotation was advanced by another runner")
+
+// KeyRotationService handles envelope key rotation operations. Rotations are persisted
+// and run by a job runner that checkpoints after every batch of files, so a rotation
+// interrupted by a restart continues where it stopped.
 type KeyRotationService struct {
 	*BaseService
 	cryptoManager *CryptoManager
+
+	mu      sync.Mutex
+	running bool
+	wake    chan struct{}
 }
 
 // KeyRotationStatus represents the status of a key rotation operation
@@ -27,6 +43,7 @@ const (
 	KeyRotationStatusCompleted  KeyRotationStatus = "COMPLETED"
 	KeyRotationStatusFailed     KeyRotationStatus = "FAILED"
 	KeyRotationStatusRolledBack KeyRotationStatus = "ROLLED_BACK"
+	KeyRotationStatusCancelled  KeyRotationStatus = "CANCELLED"
 )
 
 // KeyRotationResult represents the result of a key rotation operation
@@ -43,6 +60,7 @@ func NewKeyRotationService(db *database.DB, cryptoManager *CryptoManager) *KeyRo
 	return &KeyRotationService{
 		BaseService:   NewBaseService(db),
 		cryptoManager: cryptoManager,
+		wake:          make(chan struct{}, 1),
 	}
 }
 
@@ -78,9 +96,9 @@ func (s *KeyRotationService) RotateEnvelopeKey(userID uint) (*KeyRotationResult,
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get user")
 	}
 
-	// Count total files that need rotation
+	// Count total files that need rotation, trashed ones included
 	var totalFiles int64
-	if err := db.Model(&models.UserFile{}).Where("user_id = ?", userID).Count(&totalFiles).Error; err != nil {
+	if err := db.Unscoped().Model(&models.UserFile{}).Where("user_id = ?", userID).Count(&totalFiles).Error; err != nil {
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to count user files")
 	}
 
@@ -106,8 +124,11 @@ func (s *KeyRotationService) RotateEnvelopeKey(userID uint) (*KeyRotationResult,
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create rotation record")
 	}
 
-	// Start the rotation process asynchronously
-	go s.performKeyRotation(rotationID)
+	// Hand the rotation to the job runner
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
 
 	return &KeyRotationResult{
 		RotationID:         rotationID,
@@ -117,148 +138,339 @@ func (s *KeyRotationService) RotateEnvelopeKey(userID uint) (*KeyRotationResult,
 	}, nil
 }
 
-// performKeyRotation performs the actual key rotation in the background
-func (s *KeyRotationService) performKeyRotation(rotationID string) {
-	db := s.GetDB().GetDB()
+// StartWorker resumes the rotations a previous process left PENDING or IN_PROGRESS, then
+// runs new rotations as they are requested, until ctx is cancelled. A rotation
+// interrupted by shutdown stays IN_PROGRESS and continues from its last checkpoint on the
+// next start.
+func (s *KeyRotationService) StartWorker(ctx context.Context) {
+	go func() {
+		for {
+			if _, err := s.RunPending(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Warning: Key rotation run failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			}
+		}
+	}()
+}
 
-	// Update status to in progress
-	if err := db.Model(&models.KeyRotation{}).Where("rotation_id = ?", rotationID).
-		Updates(map[string]interface{}{
-			"status": string(KeyRotationStatusInProgress),
-		}).Error; err != nil {
-		s.failRotation(rotationID, fmt.Sprintf("failed to update status: %v", err))
-		return
+// RunPending runs every PENDING or IN_PROGRESS rotation to completion, oldest first, and
+// returns how many it ran. Rotations of a campaign are left to the campaign runner. Only
+// one run may be in progress at a time.
+func (s *KeyRotationService) RunPending(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return 0, apperrors.New(apperrors.ErrCodeConflict, "key rotations are already running")
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	var rotations []models.KeyRotation
+	if err := s.GetDB().GetDB().Where("status IN (?, ?) AND campaign_id = ''", KeyRotationStatusPending, KeyRotationStatusInProgress).
+		Order("id").Find(&rotations).Error; err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find pending key rotations")
 	}
 
-	// Get rotation details
-	var rotation models.KeyRotation
-	if err := db.Where("rotation_id = ?", rotationID).First(&rotation).Error; err != nil {
-		s.failRotation(rotationID, fmt.Sprintf("failed to get rotation: %v", err))
-		return
+	for i := range rotations {
+		if err := s.runRotation(ctx, &rotations[i], nil); err != nil {
+			return i, err
+		}
+	}
+	return len(rotations), nil
+}
+
+// runRotation continues a rotation from its last checkpoint, calling throttle, if set,
+// before every batch. A rotation that cannot complete is marked FAILED; an error is only
+// returned when the run was interrupted, and the rotation is left to be resumed.
+func (s *KeyRotationService) runRotation(ctx context.Context, rotation *models.KeyRotation, throttle func(context.Context) error) error {
+	err := s.continueRotation(ctx, rotation, throttle)
+	switch {
+	case err == nil, errors.Is(err, errRotationSuperseded):
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	default:
+		s.failRotation(rotation.RotationID, err.Error())
+		return nil
+	}
+}
+
+// continueRotation records the new envelope key if that has not happened yet, then
+// re-wraps the user's file keys batch by batch until none are left.
+func (s *KeyRotationService) continueRotation(ctx context.Context, rotation *models.KeyRotation, throttle func(context.Context) error) error {
+	if rotation.NewEnvelopeKey == "" {
+		if err := s.prepareRotation(ctx, rotation); err != nil {
+			return err
+		}
 	}
 
-	// Get user
+	oldEnvelopeKey, err := s.cryptoManager.UnwrapEnvelopeKey(ctx, rotation.OldEnvelopeKeyID, rotation.OldEnvelopeKey)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap current envelope key: %w", err)
+	}
+	newEnvelopeKey, err := s.cryptoManager.UnwrapEnvelopeKey(ctx, rotation.NewEnvelopeKeyID, rotation.NewEnvelopeKey)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap new envelope key: %w", err)
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if throttle != nil {
+			if err := throttle(ctx); err != nil {
+				return err
+			}
+		}
+		done, err := s.rotateBatch(rotation, oldEnvelopeKey, newEnvelopeKey)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// prepareRotation generates and wraps the new envelope key and records it on the
+// rotation, together with the key it replaces, before the user or any file is changed.
+// Every later checkpoint can then be resumed with both keys. A rotation cancelled before
+// it started is left alone.
+func (s *KeyRotationService) prepareRotation(ctx context.Context, rotation *models.KeyRotation) error {
+	db := s.GetDB().GetDB()
+
 	var user models.User
 	if err := db.First(&user, rotation.UserID).Error; err != nil {
-		s.failRotation(rotationID, fmt.Sprintf("failed to get user: %v", err))
-		return
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.EnvelopeKeyVersion != rotation.OldEnvelopeKeyVersion {
+		return fmt.Errorf("envelope key version changed from %d to %d since the rotation was requested", rotation.OldEnvelopeKeyVersion, user.EnvelopeKeyVersion)
 	}
 
-	// Generate new envelope key
 	newEnvelopeKey, err := s.cryptoManager.GenerateEnvelopeKey()
 	if err != nil {
-		s.failRotation(rotationID, fmt.Sprintf("failed to generate new envelope key: %v", err))
-		return
-	}
-
-	// Encrypt the new envelope key (using a service key or user password - for now using service key)
-	// TODO: In production, this should be encrypted with user's password or a derived key
-	newEnvelopeKeyHex := s.cryptoManager.EncodeToHex(newEnvelopeKey)
-	saltHex := s.cryptoManager.EncodeToHex([]byte("service_salt")) // TODO: Generate proper salt
-	ivHex := s.cryptoManager.EncodeToHex([]byte("service_iv"))     // TODO: Generate proper IV
-
-	// Update user's envelope key
-	if err := db.Model(&user).Updates(map[string]interface{}{
-		"envelope_key":            newEnvelopeKeyHex,
-		"envelope_key_version":    rotation.NewEnvelopeKeyVersion,
-		"envelope_key_salt":       saltHex,
-		"envelope_key_iv":         ivHex,
-		"envelope_key_updated_at": time.Now(),
-	}).Error; err != nil {
-		s.failRotation(rotationID, fmt.Sprintf("failed to update user envelope key: %v", err))
-		return
+		return fmt.Errorf("failed to generate new envelope key: %w", err)
 	}
 
-	// Process files in batches
-	batchSize := 10 // Configurable batch size
-	offset := 0
+	// Wrap the new envelope key with the key provider, which needs no salt or IV
+	newKeyID, newWrappedKey, err := s.cryptoManager.WrapEnvelopeKey(ctx, newEnvelopeKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap new envelope key: %w", err)
+	}
 
-	for {
-		var userFiles []models.UserFile
-		if err := db.Where("user_id = ?", user.ID).
-			Offset(offset).Limit(batchSize).Find(&userFiles).Error; err != nil {
-			s.failRotation(rotationID, fmt.Sprintf("failed to get user files batch: %v", err))
-			return
+	updates := map[string]interface{}{
+		"status":              string(KeyRotationStatusInProgress),
+		"old_envelope_key":    user.EnvelopeKey,
+		"old_envelope_key_id": user.EnvelopeKeyID,
+		"new_envelope_key":    newWrappedKey,
+		"new_envelope_key_id": newKeyID,
+	}
+	result := db.Model(&models.KeyRotation{}).
+		Where("id = ? AND status = ? AND new_envelope_key = ''", rotation.ID, KeyRotationStatusPending).
+		Updates(updates)
+	if result.Error != nil {
+		return fmt.Errorf("failed to record new envelope key: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return errRotationSuperseded
+	}
+
+	rotation.Status = string(KeyRotationStatusInProgress)
+	rotation.OldEnvelopeKey = user.EnvelopeKey
+	rotation.OldEnvelopeKeyID = user.EnvelopeKeyID
+	rotation.NewEnvelopeKey = newWrappedKey
+	rotation.NewEnvelopeKeyID = newKeyID
+	return nil
+}
+
+// rotateBatch re-wraps the next batch of the user's file keys after the checkpoint under
+// the new envelope key. The swap of the user's envelope key, the re-wrapped keys with
+// their backups and the advanced checkpoint are committed in one transaction, so an
+// interrupted batch leaves the rotation at its previous checkpoint. File keys stored as
+// uploaded by clients are not wrapped under the envelope key and are left as they are.
+// It reports true once no files are left and the rotation is marked COMPLETED.
+func (s *KeyRotationService) rotateBatch(rotation *models.KeyRotation, oldEnvelopeKey, newEnvelopeKey []byte) (bool, error) {
+	db := s.GetDB().GetDB()
+
+	var userFiles []models.UserFile
+	if err := db.Unscoped().Where("user_id = ? AND id > ?", rotation.UserID, rotation.LastUserFileID).
+		Order("id").Limit(keyRotationBatchSize).Find(&userFiles).Error; err != nil {
+		return false, fmt.Errorf("failed to get user files batch: %w", err)
+	}
+
+	newEncryptedKeys := make([]string, len(userFiles))
+	for i, userFile := range userFiles {
+		if _, raw := decodeRawFileKey(userFile.EncryptionKey); raw {
+			continue
+		}
+		newEncryptedKey, err := s.rewrapFileKey(&userFile, oldEnvelopeKey, newEnvelopeKey)
+		if err != nil {
+			return false, fmt.Errorf("failed to rotate file key for file %d: %w", userFile.ID, err)
 		}
+		newEncryptedKeys[i] = newEncryptedKey
+	}
 
-		if len(userFiles) == 0 {
-			break // No more files
+	done := len(userFiles) == 0
+	checkpoint := map[string]interface{}{}
+	if done {
+		checkpoint["status"] = string(KeyRotationStatusCompleted)
+		checkpoint["completed_at"] = time.Now()
+	} else {
+		checkpoint["last_user_file_id"] = userFiles[len(userFiles)-1].ID
+		checkpoint["files_processed"] = rotation.FilesProcessed + len(userFiles)
+		if total := rotation.FilesProcessed + len(userFiles); total > rotation.TotalFilesAffected {
+			// Files uploaded since the rotation was requested are rotated too
+			checkpoint["total_files_affected"] = total
 		}
+	}
 
-		// Process each file in the batch
-		for _, userFile := range userFiles {
-			if err := s.rotateFileKey(&userFile, newEnvelopeKey, rotationID, db); err != nil {
-				s.failRotation(rotationID, fmt.Sprintf("failed to rotate file key for file %d: %v", userFile.ID, err))
-				return
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := s.swapEnvelopeKey(tx, rotation, newEnvelopeKey); err != nil {
+			return err
+		}
+
+		for i, userFile := range userFiles {
+			if newEncryptedKeys[i] == "" {
+				continue
+			}
+			// Conditional, so a key replaced since the batch was read is left alone
+			result := tx.Unscoped().Model(&models.UserFile{}).
+				Where("id = ? AND encryption_key = ?", userFile.ID, userFile.EncryptionKey).
+				Update("encryption_key", newEncryptedKeys[i])
+			if result.Error != nil {
+				return fmt.Errorf("failed to update file encryption key: %w", result.Error)
+			}
+			if result.RowsAffected == 0 {
+				continue
+			}
+
+			backup := models.KeyRotationBackup{
+				RotationID:       rotation.RotationID,
+				UserFileID:       userFile.ID,
+				OldEncryptionKey: userFile.EncryptionKey,
+				OldKeyIV:         "", // IV not stored in current model
+				BackupCreatedAt:  time.Now(),
+			}
+			if err := tx.Create(&backup).Error; err != nil {
+				return fmt.Errorf("failed to create backup: %w", err)
 			}
 		}
 
-		offset += batchSize
+		result := tx.Model(&models.KeyRotation{}).
+			Where("id = ? AND status = ? AND last_user_file_id = ?", rotation.ID, KeyRotationStatusInProgress, rotation.LastUserFileID).
+			Updates(checkpoint)
+		if result.Error != nil {
+			return fmt.Errorf("failed to update progress: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return errRotationSuperseded
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
 
-		// Update progress
-		if err := db.Model(&models.KeyRotation{}).Where("rotation_id = ?", rotationID).
-			Update("files_processed", offset).Error; err != nil {
-			s.failRotation(rotationID, fmt.Sprintf("failed to update progress: %v", err))
-			return
+	if !done {
+		rotation.LastUserFileID = userFiles[len(userFiles)-1].ID
+		rotation.FilesProcessed += len(userFiles)
+		if rotation.FilesProcessed > rotation.TotalFilesAffected {
+			rotation.TotalFilesAffected = rotation.FilesProcessed
 		}
 	}
+	return done, nil
+}
 
-	// Mark rotation as completed
-	if err := db.Model(&models.KeyRotation{}).Where("rotation_id = ?", rotationID).
+// swapEnvelopeKey replaces the user's envelope key with the rotation's new one, unless an
+// earlier batch already did, and re-seals the key's recovery and escrow copies.
+func (s *KeyRotationService) swapEnvelopeKey(tx *gorm.DB, rotation *models.KeyRotation, newEnvelopeKey []byte) error {
+	result := tx.Model(&models.User{}).
+		Where("id = ? AND envelope_key_version = ?", rotation.UserID, rotation.OldEnvelopeKeyVersion).
 		Updates(map[string]interface{}{
-			"status":       string(KeyRotationStatusCompleted),
-			"completed_at": time.Now(),
-		}).Error; err != nil {
-		s.failRotation(rotationID, fmt.Sprintf("failed to mark rotation as completed: %v", err))
-		return
+			"envelope_key":            rotation.NewEnvelopeKey,
+			"envelope_key_id":         rotation.NewEnvelopeKeyID,
+			"envelope_key_version":    rotation.NewEnvelopeKeyVersion,
+			"envelope_key_salt":       "",
+			"envelope_key_iv":         "",
+			"envelope_key_updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update user envelope key: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return resealEnvelopeKeyEscrows(tx, s.cryptoManager, rotation.UserID, newEnvelopeKey, rotation.NewEnvelopeKeyVersion)
 	}
-}
 
-// rotateFileKey rotates the encryption key for a single file
-func (s *KeyRotationService) rotateFileKey(userFile *models.UserFile, newEnvelopeKey []byte, rotationID string, db *gorm.DB) error {
-	// Get the old envelope key from user (before rotation)
 	var user models.User
-	if err := db.First(&user, userFile.UserID).Error; err != nil {
+	if err := tx.Select("envelope_key_version").First(&user, rotation.UserID).Error; err != nil {
 		return fmt.Errorf("failed to get user: %w", err)
 	}
-
-	// Decode old envelope key
-	oldEnvelopeKey, err := s.cryptoManager.DecodeFromHex(user.EnvelopeKey)
-	if err != nil {
-		return fmt.Errorf("failed to decode old envelope key: %w", err)
+	if user.EnvelopeKeyVersion != rotation.NewEnvelopeKeyVersion {
+		return fmt.Errorf("envelope key version changed to %d during the rotation", user.EnvelopeKeyVersion)
 	}
+	return nil
+}
 
+// rewrapFileKey decrypts a file key with the old envelope key and encrypts it with the new one
+func (s *KeyRotationService) rewrapFileKey(userFile *models.UserFile, oldEnvelopeKey, newEnvelopeKey []byte) (string, error) {
 	// Decrypt the file's encryption key using old envelope key
 	fileKey, err := s.cryptoManager.DecryptFileKey(userFile.EncryptionKey, "", oldEnvelopeKey) // IV not stored, using empty for now
 	if err != nil {
-		return fmt.Errorf("failed to decrypt file key: %w", err)
+		return "", fmt.Errorf("failed to decrypt file key: %w", err)
 	}
 
 	// Re-encrypt the file key with new envelope key
 	newEncryptedKey, _, err := s.cryptoManager.EncryptFileKey(fileKey, newEnvelopeKey)
 	if err != nil {
-		return fmt.Errorf("failed to re-encrypt file key: %w", err)
+		return "", fmt.Errorf("failed to re-encrypt file key: %w", err)
 	}
 
-	// Create backup before updating
-	backup := models.KeyRotationBackup{
-		RotationID:       rotationID,
-		UserFileID:       userFile.ID,
-		OldEncryptionKey: userFile.EncryptionKey,
-		OldKeyIV:         "", // IV not stored in current model
-		BackupCreatedAt:  time.Now(),
-	}
+	return newEncryptedKey, nil
+}
 
-	if err := db.Create(&backup).Error; err != nil {
-		return fmt.Errorf("failed to create backup: %w", err)
+// WrapLegacyEnvelopeKeys wraps envelope keys still stored as plain hex with the key
+// provider, returning how many were wrapped. It is run at startup.
+func (s *KeyRotationService) WrapLegacyEnvelopeKeys(ctx context.Context) (int, error) {
+	db := s.GetDB().GetDB()
+
+	var users []models.User
+	if err := db.Where("envelope_key <> '' AND envelope_key_id = ''").Find(&users).Error; err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to find legacy envelope keys")
 	}
 
-	// Update the file with new encrypted key
-	if err := db.Model(userFile).Update("encryption_key", newEncryptedKey).Error; err != nil {
-		return fmt.Errorf("failed to update file encryption key: %w", err)
+	wrappedCount := 0
+	for _, user := range users {
+		envelopeKey, err := s.cryptoManager.DecodeFromHex(user.EnvelopeKey)
+		if err != nil {
+			return wrappedCount, apperrors.Wrap(err, apperrors.ErrCodeInternal, fmt.Sprintf("failed to decode envelope key of user %d", user.ID))
+		}
+		keyID, wrapped, err := s.cryptoManager.WrapEnvelopeKey(ctx, envelopeKey)
+		if err != nil {
+			return wrappedCount, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to wrap envelope key")
+		}
+
+		// Conditional, so a key rotated in the meantime is left alone
+		result := db.Model(&models.User{}).
+			Where("id = ? AND envelope_key = ? AND envelope_key_id = ''", user.ID, user.EnvelopeKey).
+			Updates(map[string]interface{}{
+				"envelope_key":      wrapped,
+				"envelope_key_id":   keyID,
+				"envelope_key_salt": "",
+				"envelope_key_iv":   "",
+			})
+		if result.Error != nil {
+			return wrappedCount, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to store wrapped envelope key")
+		}
+		wrappedCount += int(result.RowsAffected)
 	}
 
-	return nil
+	return wrappedCount, nil
 }
 
 // failRotation marks a rotation as failed
@@ -285,9 +497,9 @@ func (s *KeyRotationService) RollbackRotation(rotationID string, userID uint) er
 		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to get rotation")
 	}
 
-	// Only allow rollback of completed rotations
-	if rotation.Status != string(KeyRotationStatusCompleted) {
-		return apperrors.New(apperrors.ErrCodeInvalidArgument, "can only rollback completed rotations")
+	// Only allow rollback of rotations that are no longer running
+	if rotation.Status != string(KeyRotationStatusCompleted) && rotation.Status != string(KeyRotationStatusFailed) {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "can only rollback completed or failed rotations")
 	}
 
 	// Update status to rolled back
@@ -305,17 +517,35 @@ func (s *KeyRotationService) RollbackRotation(rotationID string, userID uint) er
 
 	// Restore each file from backup
 	for _, backup := range backups {
-		if err := db.Model(&models.UserFile{}).Where("id = ?", backup.UserFileID).
+		if err := db.Unscoped().Model(&models.UserFile{}).Where("id = ?", backup.UserFileID).
 			Update("encryption_key", backup.OldEncryptionKey).Error; err != nil {
 			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to restore file encryption key")
 		}
 	}
 
-	// Restore user's envelope key to previous version
-	if err := db.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+	// Restore user's envelope key to previous version, if the rotation swapped it
+	restore := map[string]interface{}{
 		"envelope_key_version": rotation.OldEnvelopeKeyVersion,
-	}).Error; err != nil {
-		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to restore envelope key version")
+	}
+	if rotation.NewEnvelopeKey != "" {
+		restore["envelope_key"] = rotation.OldEnvelopeKey
+		restore["envelope_key_id"] = rotation.OldEnvelopeKeyID
+	}
+	result := db.Model(&models.User{}).Where("id = ? AND envelope_key_version = ?", userID, rotation.NewEnvelopeKeyVersion).
+		Updates(restore)
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to restore envelope key version")
+	}
+
+	// The recovery and escrow copies were re-sealed with the new key, so seal the old one again
+	if rotation.NewEnvelopeKey != "" && result.RowsAffected > 0 {
+		oldEnvelopeKey, err := s.cryptoManager.UnwrapEnvelopeKey(context.Background(), rotation.OldEnvelopeKeyID, rotation.OldEnvelopeKey)
+		if err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to unwrap restored envelope key")
+		}
+		if err := resealEnvelopeKeyEscrows(db, s.cryptoManager, userID, oldEnvelopeKey, rotation.OldEnvelopeKeyVersion); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to re-seal envelope key escrows")
+		}
 	}
 
 	// Clean up backups
@@ -0,0 +1,428 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	// maxLoginLockout caps lockouts, which double in length each time an account is
+	// locked again without a successful login in between
+	maxLoginLockout = 24 * time.Hour
+
+	// maxLoginDelay caps the wait enforced between failed attempts on one account
+	maxLoginDelay = time.Minute
+
+	loginThrottleCleanupEvery = time.Hour
+
+	defaultLoginAuditLimit = 100
+	maxLoginAuditLimit     = 500
+)
+
+// LoginThrottleService protects password logins against guessing and credential
+// stuffing. Failed attempts are counted per account and per client IP address in the
+// database, so limits hold across restarts and server instances. Repeated failures on
+// an account make each further attempt wait longer, and too many lock the account or
+// address for a while. Locked users are mailed an unlock link; admins can unlock
+// accounts too, and every lockout and unlock is recorded as a LoginAuditEvent.
+type LoginThrottleService struct {
+	*BaseService
+	userService       *UserService
+	emailTokenService *EmailTokenService
+	maxFailures       int
+	ipMaxFailures     int
+	failureWindow     time.Duration
+	lockoutDuration   time.Duration
+	delayBase         time.Duration
+}
+
+// NewLoginThrottleService creates a new LoginThrottleService. Limits set to zero in cfg
+// are turned off. emailTokenService may be nil, in which case no unlock links are sent.
+func NewLoginThrottleService(cfg *config.Config, db *database.DB, userService *UserService, emailTokenService *EmailTokenService) *LoginThrottleService {
+	return &LoginThrottleService{
+		BaseService:       NewBaseService(db),
+		userService:       userService,
+		emailTokenService: emailTokenService,
+		maxFailures:       cfg.LoginMaxFailures,
+		ipMaxFailures:     cfg.LoginIPMaxFailures,
+		failureWindow:     time.Duration(cfg.LoginFailureWindowMins) * time.Minute,
+		lockoutDuration:   time.Duration(cfg.LoginLockoutMinutes) * time.Minute,
+		delayBase:         time.Duration(cfg.LoginDelayBaseSeconds) * time.Second,
+	}
+}
+
+//================================================================================
+// Login
+//================================================================================
+
+// Authenticate checks credentials like UserService.Authenticate. Attempts from a locked
+// account or address, or made before the delay since the account's last failure has
+// passed, are refused without checking the password.
+func (s *LoginThrottleService) Authenticate(identifier, password, ipAddress string) (*models.User, error) {
+	now := time.Now()
+
+	user, err := s.findUser(identifier)
+	if err != nil {
+		return nil, err
+	}
+	subject := accountThrottleSubject(identifier, user)
+
+	if ipAddress != "" && s.ipMaxFailures > 0 {
+		throttle, err := s.findThrottle(models.LoginThrottleScopeIP, ipAddress)
+		if err != nil {
+			return nil, err
+		}
+		if throttle != nil && isLocked(throttle, now) {
+			return nil, apperrors.New(apperrors.ErrCodeForbidden,
+				fmt.Sprintf("too many failed login attempts from your network, try again in %s", waitText(throttle.LockedUntil.Sub(now))))
+		}
+	}
+
+	throttle, err := s.findThrottle(models.LoginThrottleScopeAccount, subject)
+	if err != nil {
+		return nil, err
+	}
+	if throttle != nil {
+		// Locked accounts look the same whether or not they exist
+		if isLocked(throttle, now) {
+			return nil, apperrors.New(apperrors.ErrCodeForbidden,
+				fmt.Sprintf("this account is locked after too many failed login attempts, try again in %s or use the unlock link sent to its email address", waitText(throttle.LockedUntil.Sub(now))))
+		}
+		if wait := s.retryAfter(throttle, now); wait > 0 {
+			return nil, apperrors.New(apperrors.ErrCodeUnauthorized,
+				fmt.Sprintf("too many failed login attempts, wait %s before trying again", waitText(wait)))
+		}
+	}
+
+	authenticated, err := s.userService.Authenticate(identifier, password)
+	if err != nil {
+		var appErr *apperrors.Error
+		if errors.As(err, &appErr) && appErr.Code == apperrors.ErrCodeUnauthorized {
+			if recordErr := s.recordFailure(identifier, user, subject, ipAddress); recordErr != nil {
+				log.Printf("Warning: Failed to record failed login for %q: %v", identifier, recordErr)
+			}
+		}
+		return nil, err
+	}
+
+	// A successful login forgets the account's failures, but not those of the address,
+	// or one valid account would let an attacker keep guessing others
+	if err := s.db.GetDB().Where("scope = ? AND subject = ?", models.LoginThrottleScopeAccount, subject).
+		Delete(&models.LoginThrottle{}).Error; err != nil {
+		log.Printf("Warning: Failed to reset failed logins of user %d: %v", authenticated.ID, err)
+	}
+	return authenticated, nil
+}
+
+// retryAfter returns how much longer an account must wait before its next attempt.
+// The first retry after a failure is free; after that the wait doubles with each failure.
+func (s *LoginThrottleService) retryAfter(throttle *models.LoginThrottle, now time.Time) time.Duration {
+	if s.delayBase <= 0 || throttle.FailedCount < 2 || now.Sub(throttle.FirstFailedAt) > s.failureWindow {
+		return 0
+	}
+	delay := maxLoginDelay
+	if shift := throttle.FailedCount - 2; shift < 16 && s.delayBase<<shift < maxLoginDelay {
+		delay = s.delayBase << shift
+	}
+	return throttle.LastFailedAt.Add(delay).Sub(now)
+}
+
+// recordFailure counts a failed login against the account and the client address and
+// locks either once it reaches its limit.
+func (s *LoginThrottleService) recordFailure(identifier string, user *models.User, subject, ipAddress string) error {
+	var userID *uint
+	if user != nil {
+		userID = &user.ID
+	}
+
+	// Account failures also drive the delay, so they are counted even without lockouts
+	var lockedUntil *time.Time
+	if s.maxFailures > 0 || s.delayBase > 0 {
+		var err error
+		if lockedUntil, err = s.countFailure(models.LoginThrottleScopeAccount, subject, userID, s.maxFailures); err != nil {
+			return err
+		}
+	}
+	if lockedUntil != nil {
+		log.Printf("Locked account %q until %s after repeated failed logins", identifier, lockedUntil.Format(time.RFC3339))
+		if err := s.db.GetDB().Create(&models.LoginAuditEvent{
+			Event:      models.LoginAuditAccountLocked,
+			UserID:     userID,
+			Identifier: identifier,
+			IPAddress:  ipAddress,
+			Detail:     fmt.Sprintf("locked until %s", lockedUntil.UTC().Format(time.RFC3339)),
+		}).Error; err != nil {
+			return err
+		}
+		if user != nil && s.emailTokenService != nil {
+			if err := s.emailTokenService.SendAccountUnlockEmail(user); err != nil {
+				log.Printf("Warning: Failed to send unlock email to user %d: %v", user.ID, err)
+			}
+		}
+	}
+
+	if ipAddress == "" || s.ipMaxFailures <= 0 {
+		return nil
+	}
+	lockedUntil, err := s.countFailure(models.LoginThrottleScopeIP, ipAddress, nil, s.ipMaxFailures)
+	if err != nil {
+		return err
+	}
+	if lockedUntil != nil {
+		log.Printf("Locked logins from %s until %s after repeated failures", ipAddress, lockedUntil.Format(time.RFC3339))
+		return s.db.GetDB().Create(&models.LoginAuditEvent{
+			Event:      models.LoginAuditIPLocked,
+			Identifier: identifier,
+			IPAddress:  ipAddress,
+			Detail:     fmt.Sprintf("locked until %s", lockedUntil.UTC().Format(time.RFC3339)),
+		}).Error
+	}
+	return nil
+}
+
+// countFailure adds a failure to a throttle and returns the end of the lockout when this
+// failure caused one. Counts are changed with single UPDATE statements so that
+// concurrent failures are neither lost nor lock twice.
+func (s *LoginThrottleService) countFailure(scope, subject string, userID *uint, limit int) (*time.Time, error) {
+	db := s.db.GetDB()
+	now := time.Now()
+
+	throttle := models.LoginThrottle{Scope: scope, Subject: subject, UserID: userID, FirstFailedAt: now, LastFailedAt: now}
+	if err := db.Where("scope = ? AND subject = ?", scope, subject).FirstOrCreate(&throttle).Error; err != nil {
+		// Another request may have created the row first
+		if err := db.Where("scope = ? AND subject = ?", scope, subject).First(&throttle).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// Failures older than the window no longer count
+	if err := db.Model(&models.LoginThrottle{}).
+		Where("id = ? AND first_failed_at < ?", throttle.ID, now.Add(-s.failureWindow)).
+		Updates(map[string]interface{}{"failed_count": 0, "first_failed_at": now}).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&models.LoginThrottle{}).Where("id = ?", throttle.ID).
+		Updates(map[string]interface{}{"failed_count": gorm.Expr("failed_count + 1"), "last_failed_at": now}).Error; err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	if err := db.First(&throttle, throttle.ID).Error; err != nil {
+		return nil, err
+	}
+	if throttle.FailedCount < limit {
+		return nil, nil
+	}
+
+	lockedUntil := now.Add(lockoutLength(s.lockoutDuration, throttle.LockoutCount))
+	result := db.Model(&models.LoginThrottle{}).
+		Where("id = ? AND failed_count >= ? AND (locked_until IS NULL OR locked_until < ?)", throttle.ID, limit, now).
+		Updates(map[string]interface{}{
+			"failed_count":  0,
+			"locked_until":  lockedUntil,
+			"lockout_count": gorm.Expr("lockout_count + 1"),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &lockedUntil, nil
+}
+
+//================================================================================
+// Administration
+//================================================================================
+
+// UnlockAccount lifts a user's lockout on behalf of an admin and forgets their failed logins.
+func (s *LoginThrottleService) UnlockAccount(actorID, userID uint) error {
+	var user models.User
+	if err := s.db.GetDB().First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apperrors.New(apperrors.ErrCodeNotFound, "user not found")
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if _, err := clearAccountLockout(tx, user.ID); err != nil {
+			return err
+		}
+		return tx.Create(&models.LoginAuditEvent{
+			Event:   models.LoginAuditAccountUnlocked,
+			UserID:  &user.ID,
+			ActorID: &actorID,
+			Detail:  "unlocked by an administrator",
+		}).Error
+	})
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to unlock account")
+	}
+	return nil
+}
+
+// ListLockouts returns the accounts and addresses that are currently locked.
+func (s *LoginThrottleService) ListLockouts() ([]*models.LoginThrottle, error) {
+	var throttles []*models.LoginThrottle
+	if err := s.db.GetDB().Preload("User").
+		Where("locked_until > ?", time.Now()).
+		Order("locked_until DESC").
+		Find(&throttles).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list lockouts")
+	}
+	return throttles, nil
+}
+
+// ListAuditEvents returns the most recent lockout and unlock events, newest first.
+func (s *LoginThrottleService) ListAuditEvents(limit int) ([]*models.LoginAuditEvent, error) {
+	if limit <= 0 {
+		limit = defaultLoginAuditLimit
+	}
+	if limit > maxLoginAuditLimit {
+		limit = maxLoginAuditLimit
+	}
+
+	var events []*models.LoginAuditEvent
+	if err := s.db.GetDB().Order("created_at DESC, id DESC").Limit(limit).Find(&events).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list login audit events")
+	}
+	return events, nil
+}
+
+//================================================================================
+// Cleanup
+//================================================================================
+
+// CleanupExpired deletes throttles that are neither locked nor have failures inside the
+// window. Accounts that have been locked keep their lockout count, so that the next
+// lockout is longer, until they log in successfully.
+func (s *LoginThrottleService) CleanupExpired() (int64, error) {
+	now := time.Now()
+	result := s.db.GetDB().
+		Where("last_failed_at < ? AND (locked_until IS NULL OR locked_until < ?)", now.Add(-s.failureWindow), now).
+		Where("scope = ? OR lockout_count = 0", models.LoginThrottleScopeIP).
+		Delete(&models.LoginThrottle{})
+	if result.Error != nil {
+		return 0, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to delete expired login throttles")
+	}
+	return result.RowsAffected, nil
+}
+
+// StartCleanupWorker runs CleanupExpired every hour until ctx is cancelled.
+func (s *LoginThrottleService) StartCleanupWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(loginThrottleCleanupEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cleaned, err := s.CleanupExpired()
+				if err != nil {
+					log.Printf("Warning: Login throttle cleanup failed: %v", err)
+				} else if cleaned > 0 {
+					log.Printf("Cleaned up %d expired login throttles", cleaned)
+				}
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// findUser looks up the account a login identifier names, like UserService.Authenticate.
+// Find is used rather than First, which would log every unknown name as an error.
+func (s *LoginThrottleService) findUser(identifier string) (*models.User, error) {
+	var users []models.User
+	if err := s.db.GetDB().Where("email = ? OR username = ?", identifier, identifier).Limit(1).Find(&users).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
+
+// findThrottle returns the throttle for a scope and subject, or nil when there have
+// been no recent failures.
+func (s *LoginThrottleService) findThrottle(scope, subject string) (*models.LoginThrottle, error) {
+	var throttles []models.LoginThrottle
+	if err := s.db.GetDB().Where("scope = ? AND subject = ?", scope, subject).Limit(1).Find(&throttles).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	if len(throttles) == 0 {
+		return nil, nil
+	}
+	return &throttles[0], nil
+}
+
+// accountThrottleSubject identifies the account a login attempt is counted against:
+// the user when one matches, otherwise the identifier itself.
+func accountThrottleSubject(identifier string, user *models.User) string {
+	if user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	return "name:" + strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// clearAccountLockout lifts a user's lockout and forgets their failed logins. It
+// reports whether the account was locked.
+func clearAccountLockout(tx *gorm.DB, userID uint) (bool, error) {
+	var throttles []models.LoginThrottle
+	if err := tx.Where("scope = ? AND subject = ?", models.LoginThrottleScopeAccount, fmt.Sprintf("user:%d", userID)).
+		Limit(1).Find(&throttles).Error; err != nil {
+		return false, err
+	}
+	if len(throttles) == 0 {
+		return false, nil
+	}
+	if err := tx.Delete(&throttles[0]).Error; err != nil {
+		return false, err
+	}
+	return isLocked(&throttles[0], time.Now()), nil
+}
+
+// lockoutLength doubles the base lockout for each earlier consecutive lockout.
+func lockoutLength(base time.Duration, previousLockouts int) time.Duration {
+	if previousLockouts >= 16 || base<<previousLockouts > maxLoginLockout {
+		return maxLoginLockout
+	}
+	return base << previousLockouts
+}
+
+func isLocked(throttle *models.LoginThrottle, now time.Time) bool {
+	return throttle.LockedUntil != nil && throttle.LockedUntil.After(now)
+}
+
+// waitText renders a wait for error messages, rounded up to whole seconds or minutes.
+func waitText(wait time.Duration) string {
+	if wait <= time.Minute {
+		seconds := int((wait + time.Second - 1) / time.Second)
+		if seconds == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	return fmt.Sprintf("%d minutes", int((wait+time.Minute-1)/time.Minute))
+}
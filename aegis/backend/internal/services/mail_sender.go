@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// Supported mail backend names for config.Config.MailBackend.
+const (
+	MailBackendSMTP   = "smtp"
+	MailBackendLog    = "log"
+	MailBackendMemory = "memory"
+)
+
+// MailMessage is a plain-text email to a single recipient.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MailSender is the contract every outbound mail transport must satisfy.
+type MailSender interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+// NewMailSender creates the mail sender selected by cfg.MailBackend.
+func NewMailSender(cfg *config.Config) (MailSender, error) {
+	switch cfg.MailBackend {
+	case "", MailBackendLog:
+		return NewLogMailSender(), nil
+	case MailBackendSMTP:
+		return NewSMTPMailSender(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom), nil
+	case MailBackendMemory:
+		return NewMemoryMailSender(), nil
+	default:
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("unsupported mail backend: %s", cfg.MailBackend))
+	}
+}
+
+// validateMailMessage rejects messages whose header fields could inject extra headers.
+func validateMailMessage(msg MailMessage) error {
+	if msg.To == "" || !strings.Contains(msg.To, "@") {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "invalid mail recipient")
+	}
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "mail headers must not contain line breaks")
+	}
+	return nil
+}
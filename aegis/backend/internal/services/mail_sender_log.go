@@ -0,0 +1,24 @@
+package services
+
+import (
+	"context"
+	"log"
+)
+
+// LogMailSender writes messages to the server log instead of delivering them, so that
+// verification and reset links can be followed in development without a mail server.
+type LogMailSender struct{}
+
+// NewLogMailSender creates a LogMailSender.
+func NewLogMailSender() *LogMailSender {
+	return &LogMailSender{}
+}
+
+// Send logs the message.
+func (LogMailSender) Send(ctx context.Context, msg MailMessage) error {
+	if err := validateMailMessage(msg); err != nil {
+		return err
+	}
+	log.Printf("MAIL to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
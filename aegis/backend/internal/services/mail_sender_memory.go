@@ -0,0 +1,43 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryMailSender keeps sent messages in memory instead of delivering them. It is the
+// mail sink used by tests.
+type MemoryMailSender struct {
+	mu       sync.Mutex
+	messages []MailMessage
+}
+
+// NewMemoryMailSender creates an empty in-memory mail sink.
+func NewMemoryMailSender() *MemoryMailSender {
+	return &MemoryMailSender{}
+}
+
+// Send records the message.
+func (m *MemoryMailSender) Send(ctx context.Context, msg MailMessage) error {
+	if err := validateMailMessage(msg); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of every message sent so far, oldest first.
+func (m *MemoryMailSender) Messages() []MailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MailMessage(nil), m.messages...)
+}
+
+// Reset discards the recorded messages.
+func (m *MemoryMailSender) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = nil
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// smtpTimeout bounds a delivery when the caller's context has no deadline
+const smtpTimeout = 30 * time.Second
+
+// SMTPMailSender delivers messages through an SMTP relay. STARTTLS is used whenever the
+// server offers it; credentials are only sent when a username is configured.
+type SMTPMailSender struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+// NewSMTPMailSender creates an SMTPMailSender for host:port sending as from.
+func NewSMTPMailSender(host string, port int, username, password, from string) *SMTPMailSender {
+	return &SMTPMailSender{
+		addr:     net.JoinHostPort(host, strconv.Itoa(port)),
+		host:     host,
+		username: username,
+		password: password,
+		from:     from,
+	}
+}
+
+// Send delivers the message. The context's deadline, or smtpTimeout without one,
+// bounds the whole conversation with the relay.
+func (s *SMTPMailSender) Send(ctx context.Context, msg MailMessage) error {
+	if err := validateMailMessage(msg); err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(s.from)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "invalid sender address")
+	}
+
+	if err := s.deliver(ctx, from, msg); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeNetwork, "failed to send email")
+	}
+	return nil
+}
+
+func (s *SMTPMailSender) deliver(ctx context.Context, from *mail.Address, msg MailMessage) error {
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	// smtp.PlainAuth itself refuses to send credentials over an unencrypted connection
+	// to anything but localhost
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMailMessage(from.String(), msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// buildMailMessage renders an RFC 5322 plain-text message.
+func buildMailMessage(from string, msg MailMessage) []byte {
+	messageID := make([]byte, 16)
+	rand.Read(messageID)
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(messageID), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
@@ -0,0 +1,615 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	// oidcLoginStateTTL bounds how long a user may take at the identity provider
+	oidcLoginStateTTL = 10 * time.Minute
+
+	// oidcMetadataTTL is how long discovery documents and signing keys are cached
+	oidcMetadataTTL = time.Hour
+
+	// oidcKeyRefreshInterval limits refetching the JWKS when a token names an unknown key
+	oidcKeyRefreshInterval = time.Minute
+
+	oidcMaxResponseBytes = 1 << 20
+	oidcDefaultQuota     = 104857600 // 100MB, as for password sign-ups
+)
+
+var oidcUsernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// oidcDiscovery is the part of the provider's discovery document the login flow uses.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCService signs users in through an external OpenID Connect identity provider
+// using the authorization code flow with PKCE. Accounts are provisioned on first
+// login and, when admin groups are configured, their admin flag follows the
+// provider's group membership.
+type OIDCService struct {
+	*BaseService
+	cfg        *config.Config
+	httpClient *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	discoveredAt  time.Time
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// NewOIDCService creates a new OIDCService.
+func NewOIDCService(cfg *config.Config, db *database.DB) *OIDCService {
+	return &OIDCService{
+		BaseService: NewBaseService(db),
+		cfg:         cfg,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Enabled reports whether single sign-on has been configured.
+func (s *OIDCService) Enabled() bool {
+	return s.cfg.OIDCIssuerURL != "" && s.cfg.OIDCClientID != ""
+}
+
+// PasswordSignupAllowed reports whether accounts may still be registered with a
+// password, or only provisioned through the identity provider.
+func (s *OIDCService) PasswordSignupAllowed() bool {
+	return !s.cfg.PasswordSignupDisabled
+}
+
+// RequirePasswordSignup rejects password registration when accounts are only
+// provisioned through the identity provider.
+func (s *OIDCService) RequirePasswordSignup() error {
+	if !s.PasswordSignupAllowed() {
+		return apperrors.New(apperrors.ErrCodeForbidden, "accounts are created through single sign-on")
+	}
+	return nil
+}
+
+//================================================================================
+// Login Flow
+//================================================================================
+
+// BeginLogin starts a login and returns the identity provider URL to send the
+// browser to. The state, nonce and PKCE verifier are kept until the callback.
+func (s *OIDCService) BeginLogin() (string, error) {
+	if !s.Enabled() {
+		return "", apperrors.New(apperrors.ErrCodeInvalidArgument, "single sign-on is not configured")
+	}
+
+	discovery, err := s.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	state, err := randomURLToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomURLToken()
+	if err != nil {
+		return "", err
+	}
+	codeVerifier, err := randomURLToken()
+	if err != nil {
+		return "", err
+	}
+
+	// Abandoned logins are removed whenever a new one starts
+	db := s.db.GetDB()
+	if err := db.Where("expires_at < ?", time.Now()).Delete(&models.OIDCLoginState{}).Error; err != nil {
+		log.Printf("Failed to remove expired single sign-on states: %v", err)
+	}
+
+	loginState := &models.OIDCLoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    time.Now().Add(oidcLoginStateTTL),
+	}
+	if err := db.Create(loginState).Error; err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to start single sign-on login")
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", s.cfg.OIDCClientID)
+	query.Set("redirect_uri", s.cfg.OIDCRedirectURL)
+	query.Set("scope", s.cfg.OIDCScopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// CompleteLogin finishes a login from the identity provider's callback: it checks the
+// state, exchanges the code, validates the ID token and returns the matching user,
+// provisioning one on first login.
+func (s *OIDCService) CompleteLogin(state, code string) (*models.User, error) {
+	if !s.Enabled() {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "single sign-on is not configured")
+	}
+	if code == "" {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "authorization code is required")
+	}
+
+	loginState, err := s.consumeState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, err := s.exchangeCode(code, loginState.CodeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := s.verifyIDToken(rawIDToken, loginState.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.provisionUser(claims)
+}
+
+// consumeState looks up a login state and deletes it, so that each can only be used once.
+func (s *OIDCService) consumeState(state string) (*models.OIDCLoginState, error) {
+	invalid := apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired single sign-on login")
+	if state == "" {
+		return nil, invalid
+	}
+
+	db := s.db.GetDB()
+	var loginState models.OIDCLoginState
+	if err := db.Where("state = ?", state).First(&loginState).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, invalid
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	// Deleting is the claim: of two concurrent callbacks only one removes the row
+	result := db.Where("id = ?", loginState.ID).Delete(&models.OIDCLoginState{})
+	if result.Error != nil {
+		return nil, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "database error")
+	}
+	if result.RowsAffected == 0 || time.Now().After(loginState.ExpiresAt) {
+		return nil, invalid
+	}
+	return &loginState, nil
+}
+
+//================================================================================
+// Provider Communication
+//================================================================================
+
+// getDiscovery returns the provider's discovery document, fetching it when the cached
+// copy is missing or stale.
+func (s *OIDCService) getDiscovery() (*oidcDiscovery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.discovery != nil && time.Since(s.discoveredAt) < oidcMetadataTTL {
+		return s.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(s.cfg.OIDCIssuerURL, "/")
+	var discovery oidcDiscovery
+	if err := s.getJSON(issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, "identity provider reported an unexpected issuer")
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, "identity provider discovery document is incomplete")
+	}
+
+	s.discovery = &discovery
+	s.discoveredAt = time.Now()
+	return s.discovery, nil
+}
+
+// exchangeCode redeems an authorization code at the token endpoint and returns the ID token.
+func (s *OIDCService) exchangeCode(code, codeVerifier string) (string, error) {
+	discovery, err := s.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", s.cfg.OIDCRedirectURL)
+	form.Set("client_id", s.cfg.OIDCClientID)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to build token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.cfg.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(s.cfg.OIDCClientID), url.QueryEscape(s.cfg.OIDCClientSecret))
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeNetwork, "failed to contact identity provider")
+	}
+	defer resp.Body.Close()
+
+	var tokenResponse struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseBytes)).Decode(&tokenResponse); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeNetwork, "invalid token response from identity provider")
+	}
+	if resp.StatusCode != http.StatusOK {
+		// A rejected code is the user's problem, not the server's
+		log.Printf("Identity provider rejected authorization code: %s %s", tokenResponse.Error, tokenResponse.ErrorDescription)
+		return "", apperrors.New(apperrors.ErrCodeUnauthorized, "identity provider rejected the login")
+	}
+	if tokenResponse.IDToken == "" {
+		return "", apperrors.New(apperrors.ErrCodeUnauthorized, "identity provider did not return an ID token")
+	}
+	return tokenResponse.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature against the provider's JWKS, its
+// issuer, audience, expiry and nonce, and returns its claims.
+func (s *OIDCService) verifyIDToken(rawIDToken, nonce string) (jwt.MapClaims, error) {
+	issuer := strings.TrimSuffix(s.cfg.OIDCIssuerURL, "/")
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return s.signingKey(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}),
+		jwt.WithAudience(s.cfg.OIDCClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeUnauthorized, "invalid ID token")
+	}
+
+	// Issuers are compared without a trailing slash, which providers are inconsistent about
+	if tokenIssuer, _ := claims["iss"].(string); strings.TrimSuffix(tokenIssuer, "/") != issuer {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid ID token issuer")
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid ID token nonce")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != s.cfg.OIDCClientID {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "ID token was issued to another client")
+	}
+	if subject, _ := claims["sub"].(string); subject == "" {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "ID token has no subject")
+	}
+	return claims, nil
+}
+
+// signingKey returns the provider's RSA key with the given key ID. The JWKS is fetched
+// again when the key is unknown, as happens after the provider rotates its keys.
+func (s *OIDCService) signingKey(kid string) (*rsa.PublicKey, error) {
+	discovery, err := s.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key := s.lookupKey(kid); key != nil && time.Since(s.keysFetchedAt) < oidcMetadataTTL {
+		return key, nil
+	}
+	if s.keys != nil && time.Since(s.keysFetchedAt) < oidcKeyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := s.getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	s.keys = keys
+	s.keysFetchedAt = time.Now()
+
+	if key := s.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key. Tokens without a key ID are accepted when the
+// provider publishes a single key. The caller must hold s.mu.
+func (s *OIDCService) lookupKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key
+		}
+	}
+	return s.keys[kid]
+}
+
+func (s *OIDCService) getJSON(endpoint string, target interface{}) error {
+	resp, err := s.httpClient.Get(endpoint)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeNetwork, "failed to contact identity provider")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apperrors.New(apperrors.ErrCodeNetwork, fmt.Sprintf("identity provider returned status %d", resp.StatusCode))
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseBytes)).Decode(target); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeNetwork, "invalid response from identity provider")
+	}
+	return nil
+}
+
+//================================================================================
+// Account Provisioning
+//================================================================================
+
+// provisionUser maps verified ID token claims to a user. A known identity signs in its
+// linked user; otherwise an existing account with the same verified email is linked,
+// or a new account is created.
+func (s *OIDCService) provisionUser(claims jwt.MapClaims) (*models.User, error) {
+	issuer := strings.TrimSuffix(s.cfg.OIDCIssuerURL, "/")
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	email = strings.TrimSpace(email)
+	emailVerified, _ := claims["email_verified"].(bool)
+	preferredUsername, _ := claims["preferred_username"].(string)
+
+	var user models.User
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var identity models.UserIdentity
+		err := tx.Preload("User").Where("issuer = ? AND subject = ?", issuer, subject).First(&identity).Error
+		switch {
+		case err == nil:
+			user = identity.User
+			return tx.Model(&identity).Updates(map[string]interface{}{
+				"email":         email,
+				"last_login_at": time.Now(),
+			}).Error
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+
+		if email == "" {
+			return apperrors.New(apperrors.ErrCodeUnauthorized, "identity provider did not return an email address")
+		}
+
+		err = tx.Where("email = ?", email).First(&user).Error
+		switch {
+		case err == nil:
+			// Linking an existing account is only safe when the provider vouches for the address
+			if !emailVerified {
+				return apperrors.New(apperrors.ErrCodeConflict, "an account with this email already exists")
+			}
+			if !user.EmailVerified {
+				user.EmailVerified = true
+				if err := tx.Model(&user).Update("email_verified", true).Error; err != nil {
+					return err
+				}
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			username, err := uniqueUsername(tx, preferredUsername, email)
+			if err != nil {
+				return err
+			}
+			// Provisioned accounts have no password and can only sign in through the provider
+			user = models.User{
+				Username:      username,
+				Email:         email,
+				EmailVerified: emailVerified,
+				StorageQuota:  oidcDefaultQuota,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			log.Printf("Provisioned user %d from single sign-on subject %s", user.ID, subject)
+		default:
+			return err
+		}
+
+		return tx.Create(&models.UserIdentity{
+			UserID:      user.ID,
+			Issuer:      issuer,
+			Subject:     subject,
+			Email:       email,
+			LastLoginAt: time.Now(),
+		}).Error
+	})
+	if err != nil {
+		var appErr *apperrors.Error
+		if errors.As(err, &appErr) {
+			return nil, err
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to provision user")
+	}
+
+	if err := s.syncAdminFlag(&user, claims); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// syncAdminFlag grants or removes admin rights to match membership of the configured
+// admin groups. Without configured groups admin rights are managed in Aegis only.
+func (s *OIDCService) syncAdminFlag(user *models.User, claims jwt.MapClaims) error {
+	adminGroups := splitList(s.cfg.OIDCAdminGroups)
+	if len(adminGroups) == 0 {
+		return nil
+	}
+
+	isAdmin := false
+	for _, group := range claimStrings(claims[s.cfg.OIDCGroupsClaim]) {
+		for _, adminGroup := range adminGroups {
+			if group == adminGroup {
+				isAdmin = true
+			}
+		}
+	}
+	if user.IsAdmin == isAdmin {
+		return nil
+	}
+
+	if err := s.db.GetDB().Model(user).Update("is_admin", isAdmin).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to update admin status")
+	}
+	log.Printf("Set admin status of user %d to %t from identity provider groups", user.ID, isAdmin)
+	return nil
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// uniqueUsername derives a valid username from the preferred_username claim, falling
+// back to the email's local part, and appends a number if it is already taken.
+func uniqueUsername(tx *gorm.DB, preferredUsername, email string) (string, error) {
+	base := sanitizeUsername(preferredUsername)
+	if len(base) < 3 {
+		base = sanitizeUsername(strings.SplitN(email, "@", 2)[0])
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+
+	for i := 1; i <= 100; i++ {
+		candidate := base
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, i)
+		}
+		var count int64
+		if err := tx.Model(&models.User{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+	}
+
+	suffix, err := randomURLToken()
+	if err != nil {
+		return "", err
+	}
+	return base + "-" + suffix[:8], nil
+}
+
+func sanitizeUsername(username string) string {
+	return strings.Trim(oidcUsernameInvalidChars.ReplaceAllString(strings.TrimSpace(username), "_"), "_")
+}
+
+// claimStrings reads a claim that may hold a list of strings or a single string.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// randomURLToken returns 32 random bytes, base64url encoded.
+func randomURLToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate random value")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
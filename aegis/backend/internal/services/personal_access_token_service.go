@@ -0,0 +1,221 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+// PersonalAccessTokenPrefix starts every personal access token, so that they are easy
+// to tell apart from JWTs and to find with secret scanners.
+const PersonalAccessTokenPrefix = "aegis_pat_"
+
+// Scopes a personal access token can be granted
+const (
+	ScopeFilesRead    = "files:read"
+	ScopeFilesWrite   = "files:write"
+	ScopeSharesManage = "shares:manage"
+	ScopeRoomsRead    = "rooms:read"
+	ScopeAdmin        = "admin"
+)
+
+// validScopes lists every scope a token may be created with
+var validScopes = map[string]bool{
+	ScopeFilesRead:    true,
+	ScopeFilesWrite:   true,
+	ScopeSharesManage: true,
+	ScopeRoomsRead:    true,
+	ScopeAdmin:        true,
+}
+
+const (
+	maxPersonalAccessTokenNameLength = 100
+	personalAccessTokenDisplayLength = len(PersonalAccessTokenPrefix) + 8
+)
+
+// PersonalAccessTokenService manages personal access tokens, long-lived credentials with
+// a limited set of scopes that let scripts call the API without a password.
+type PersonalAccessTokenService struct {
+	*BaseService
+}
+
+// NewPersonalAccessTokenService creates a new PersonalAccessTokenService.
+func NewPersonalAccessTokenService(db *database.DB) *PersonalAccessTokenService {
+	return &PersonalAccessTokenService{
+		BaseService: NewBaseService(db),
+	}
+}
+
+//================================================================================
+// Token Operations
+//================================================================================
+
+// CreateToken issues a new token for the user and returns its value, which is only
+// shown this once. A nil expiresInDays creates a token that does not expire.
+func (s *PersonalAccessTokenService) CreateToken(user *models.User, name string, scopes []string, expiresInDays *int) (string, *models.PersonalAccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxPersonalAccessTokenNameLength {
+		return "", nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "token name must be between 1 and 100 characters")
+	}
+
+	normalized, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, scope := range normalized {
+		if scope == ScopeAdmin && !user.IsAdmin {
+			return "", nil, apperrors.New(apperrors.ErrCodeForbidden, "only administrators can create tokens with the admin scope")
+		}
+	}
+
+	var expiresAt *time.Time
+	if expiresInDays != nil {
+		if *expiresInDays <= 0 {
+			return "", nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "token expiry must be at least one day")
+		}
+		t := time.Now().Add(time.Duration(*expiresInDays) * 24 * time.Hour)
+		expiresAt = &t
+	}
+
+	value, err := generatePersonalAccessTokenValue()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := &models.PersonalAccessToken{
+		UserID:      user.ID,
+		Name:        name,
+		TokenPrefix: value[:personalAccessTokenDisplayLength],
+		TokenHash:   HashPersonalAccessToken(value),
+		Scopes:      strings.Join(normalized, " "),
+		ExpiresAt:   expiresAt,
+	}
+	if err := s.db.GetDB().Create(token).Error; err != nil {
+		return "", nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create personal access token")
+	}
+
+	return value, token, nil
+}
+
+// ListTokens returns the user's tokens that have not been revoked, newest first.
+func (s *PersonalAccessTokenService) ListTokens(userID uint) ([]*models.PersonalAccessToken, error) {
+	var tokens []*models.PersonalAccessToken
+	if err := s.db.GetDB().
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Order("created_at DESC, id DESC").
+		Find(&tokens).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to retrieve personal access tokens")
+	}
+	return tokens, nil
+}
+
+// RevokeToken revokes one of the user's tokens.
+func (s *PersonalAccessTokenService) RevokeToken(userID, tokenID uint) error {
+	result := s.db.GetDB().Model(&models.PersonalAccessToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", tokenID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to revoke personal access token")
+	}
+	if result.RowsAffected == 0 {
+		return apperrors.New(apperrors.ErrCodeNotFound, "personal access token not found")
+	}
+	return nil
+}
+
+// Authenticate resolves a token value to its active record, with the User preloaded.
+func (s *PersonalAccessTokenService) Authenticate(value string) (*models.PersonalAccessToken, error) {
+	if !strings.HasPrefix(value, PersonalAccessTokenPrefix) {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid personal access token")
+	}
+
+	var token models.PersonalAccessToken
+	if err := s.db.GetDB().Preload("User").Where("token_hash = ?", HashPersonalAccessToken(value)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid personal access token")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	if token.RevokedAt != nil {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "personal access token has been revoked")
+	}
+	if token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt) {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "personal access token has expired")
+	}
+	if token.User.ID == 0 {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid personal access token")
+	}
+	return &token, nil
+}
+
+// TouchToken records that a token was used. Writes are skipped when the previous use
+// was less than interval ago, to keep busy scripts from writing on every request.
+func (s *PersonalAccessTokenService) TouchToken(token *models.PersonalAccessToken, interval time.Duration) error {
+	now := time.Now()
+	if token.LastUsedAt != nil && now.Sub(*token.LastUsedAt) < interval {
+		return nil
+	}
+	if err := s.db.GetDB().Model(token).UpdateColumn("last_used_at", now).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to record token use")
+	}
+	return nil
+}
+
+// TokenScopes splits the stored scope list of a token.
+func TokenScopes(token *models.PersonalAccessToken) []string {
+	return strings.Fields(token.Scopes)
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// normalizeScopes validates scopes and returns them sorted without duplicates.
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !validScopes[scope] {
+			return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "unknown scope: "+scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "at least one scope is required")
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func generatePersonalAccessTokenValue() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate personal access token")
+	}
+	return PersonalAccessTokenPrefix + hex.EncodeToString(tokenBytes), nil
+}
+
+// HashPersonalAccessToken returns the SHA-256 of a token. Like refresh tokens, tokens
+// carry 256 bits of entropy, so an unsalted hash is enough.
+func HashPersonalAccessToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,461 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/utils"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const reencryptionBatchSize = 100
+
+// maxReencryptionFileSize caps the stored objects re-encrypted in memory. Deprecated
+// ciphers authenticate the whole object at once, so a file is decrypted and re-sealed
+// in full; larger files are reported as errors and stay under their old cipher.
+const maxReencryptionFileSize int64 = 512 << 20
+
+// ReencryptionService migrates ciphertexts off deprecated algorithms. Share passwords,
+// share envelope keys and share file keys stored without a format header or under a
+// deprecated cipher are re-sealed with the current key encryption algorithm, and share
+// passwords under an earlier version of the share password key move to the current one. Stored
+// files under a deprecated cipher are re-encrypted with the file encryption algorithm,
+// when the server holds their key and they are no larger than maxReencryptionFileSize;
+// the old object is left for storage GC to collect once no download can still be reading it.
+type ReencryptionService struct {
+	*BaseService
+	cryptoManager      *CryptoManager
+	fileStorageService *FileStorageService
+
+	mu         sync.Mutex
+	running    bool
+	lastReport *ReencryptionReport
+}
+
+// ReencryptionReport describes one re-encryption run.
+type ReencryptionReport struct {
+	StartedAt      time.Time
+	CompletedAt    time.Time
+	SharesScanned  int
+	SharesMigrated int
+	SharesSkipped  int
+	FilesScanned   int
+	FilesMigrated  int
+	FilesSkipped   int
+	Errors         []string
+}
+
+// SharePasswordKeyStatus describes the versions of the share password key in use.
+type SharePasswordKeyStatus struct {
+	CurrentVersion int
+	OutdatedShares int // Shares whose stored password is under an earlier version
+}
+
+// NewReencryptionService creates a new ReencryptionService.
+func NewReencryptionService(db *database.DB, cryptoManager *CryptoManager, fileStorageService *FileStorageService) *ReencryptionService {
+	return &ReencryptionService{
+		BaseService:        NewBaseService(db),
+		cryptoManager:      cryptoManager,
+		fileStorageService: fileStorageService,
+	}
+}
+
+//================================================================================
+// Re-encryption
+//================================================================================
+
+// Run migrates every share and stored file off deprecated algorithms once. Only one run
+// may be in progress at a time.
+func (s *ReencryptionService) Run(ctx context.Context) (*ReencryptionReport, error) {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "a re-encryption run is already in progress")
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	report := &ReencryptionReport{
+		StartedAt: time.Now(),
+		Errors:    []string{},
+	}
+
+	if err := s.migrateShares(ctx, report); err != nil {
+		return nil, err
+	}
+	if err := s.migrateFiles(ctx, report); err != nil {
+		return nil, err
+	}
+
+	report.CompletedAt = time.Now()
+
+	s.mu.Lock()
+	s.lastReport = report
+	s.mu.Unlock()
+
+	return report, nil
+}
+
+// LastReport returns the report of the most recent completed run, or nil if none has completed.
+func (s *ReencryptionService) LastReport() *ReencryptionReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastReport
+}
+
+// StartWorker runs the migration every interval until ctx is cancelled. A non-positive
+// interval disables the background worker; Run can still be triggered by an admin.
+func (s *ReencryptionService) StartWorker(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		log.Printf("Re-encryption worker disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := s.Run(ctx)
+				if err != nil {
+					log.Printf("Warning: Re-encryption failed: %v", err)
+					continue
+				}
+				log.Printf("Re-encryption: %d of %d shares migrated (%d skipped), %d of %d files migrated (%d skipped), %d errors",
+					report.SharesMigrated, report.SharesScanned, report.SharesSkipped,
+					report.FilesMigrated, report.FilesScanned, report.FilesSkipped, len(report.Errors))
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Shares
+//================================================================================
+
+func (s *ReencryptionService) migrateShares(ctx context.Context, report *ReencryptionReport) error {
+	// Pick up a share password key rotated by another instance
+	if err := s.cryptoManager.ReloadSharePasswordKeys(ctx); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load share password keys")
+	}
+
+	var shares []models.FileShare
+	result := s.db.GetDB().Model(&models.FileShare{}).Order("id").FindInBatches(&shares, reencryptionBatchSize, func(batch *gorm.DB, _ int) error {
+		for i := range shares {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			share := &shares[i]
+			report.SharesScanned++
+			rekey := s.shareKeysNeedMigration(share)
+			if !rekey && !s.sharePasswordKeyOutdated(share) {
+				continue
+			}
+			// Without the stored password the keys cannot be opened, so nothing is changed
+			if share.EncryptedPassword == "" {
+				report.SharesSkipped++
+				continue
+			}
+			migrated, err := s.migrateShare(share, rekey)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to re-encrypt share %d: %v", share.ID, err))
+				continue
+			}
+			if migrated {
+				report.SharesMigrated++
+			} else {
+				report.SharesSkipped++
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "share re-encryption aborted")
+	}
+	return nil
+}
+
+// shareKeysNeedMigration reports whether any ciphertext stored on the share is deprecated,
+// or its envelope key was derived with an outdated KDF. This includes the file key of
+// legacy shares, kept under the password directly.
+func (s *ReencryptionService) shareKeysNeedMigration(share *models.FileShare) bool {
+	for _, text := range []string{share.EncryptedPassword, share.EnvelopeKey, share.EncryptedKey} {
+		if text != "" && s.cryptoManager.IsDeprecatedText(text) {
+			return true
+		}
+	}
+	return share.EnvelopeKey != "" && s.cryptoManager.NeedsKDFUpgrade(share.EnvelopeKey)
+}
+
+// sharePasswordKeyOutdated reports whether the stored password of the share is under an
+// earlier version of the share password key.
+func (s *ReencryptionService) sharePasswordKeyOutdated(share *models.FileShare) bool {
+	return share.EncryptedPassword != "" && share.PasswordKeyVersion != s.cryptoManager.SharePasswordKeyVersion()
+}
+
+// migrateShare re-encrypts the stored password of a share under the current share
+// password key and, if rekey is set, re-seals its envelope key and file key too. The
+// update only applies if the share was not changed since it was read, and reports
+// false otherwise.
+func (s *ReencryptionService) migrateShare(share *models.FileShare, rekey bool) (bool, error) {
+	password, err := s.cryptoManager.DecryptSharePassword(share.EncryptedPassword, share.PasswordIV, share.PasswordKeyVersion)
+	if err != nil {
+		return false, err
+	}
+
+	updates := map[string]interface{}{}
+	if rekey {
+		envelopeKey, fileKey, err := openShareKeys(s.cryptoManager, share, password)
+		if err == nil && envelopeKey == nil {
+			// Legacy shares gain an envelope key as they are migrated
+			envelopeKey, err = s.cryptoManager.GenerateEnvelopeKey()
+		}
+		if err != nil {
+			return false, err
+		}
+		if updates, err = sealShareKeys(s.cryptoManager, password, envelopeKey, fileKey); err != nil {
+			return false, err
+		}
+	}
+	encryptedPassword, passwordIV, passwordKeyVersion, err := s.cryptoManager.EncryptSharePassword(password)
+	if err != nil {
+		return false, err
+	}
+	updates["encrypted_password"] = encryptedPassword
+	updates["password_iv"] = passwordIV
+	updates["password_key_version"] = passwordKeyVersion
+
+	result := s.db.GetDB().Model(&models.FileShare{}).
+		Where("id = ? AND encrypted_password = ? AND envelope_key = ? AND encrypted_key = ?",
+			share.ID, share.EncryptedPassword, share.EnvelopeKey, share.EncryptedKey).
+		Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// SharePasswordKeyStatus returns the current version of the share password key and the
+// number of shares not yet moved to it.
+func (s *ReencryptionService) SharePasswordKeyStatus(ctx context.Context) (*SharePasswordKeyStatus, error) {
+	if err := s.cryptoManager.ReloadSharePasswordKeys(ctx); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load share password keys")
+	}
+
+	status := &SharePasswordKeyStatus{CurrentVersion: s.cryptoManager.SharePasswordKeyVersion()}
+	var outdated int64
+	if err := s.db.GetDB().Model(&models.FileShare{}).
+		Where("encrypted_password <> '' AND password_key_version <> ?", status.CurrentVersion).
+		Count(&outdated).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to count shares")
+	}
+	status.OutdatedShares = int(outdated)
+	return status, nil
+}
+
+// RotateSharePasswordKey adds a new version of the share password key. Shares keep
+// opening under the earlier version until the next run moves them to the new one.
+func (s *ReencryptionService) RotateSharePasswordKey(ctx context.Context) (*SharePasswordKeyStatus, error) {
+	if _, err := s.cryptoManager.RotateSharePasswordKey(ctx); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to rotate share password key")
+	}
+	return s.SharePasswordKeyStatus(ctx)
+}
+
+//================================================================================
+// Files
+//================================================================================
+
+// migrateFiles records the cipher of files not yet inspected and re-encrypts files under
+// a deprecated cipher.
+func (s *ReencryptionService) migrateFiles(ctx context.Context, report *ReencryptionReport) error {
+	query := s.db.GetDB().Model(&models.File{}).Where("cipher = ''")
+	if deprecated := s.cryptoManager.GetConfig().DeprecatedAlgorithms; len(deprecated) > 0 {
+		query = query.Or("cipher IN ?", deprecated)
+	}
+
+	var files []models.File
+	result := query.Order("id").FindInBatches(&files, reencryptionBatchSize, func(batch *gorm.DB, _ int) error {
+		for i := range files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			file := &files[i]
+			report.FilesScanned++
+
+			if file.Cipher == "" {
+				cipher, err := s.recordFileCipher(ctx, file)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("failed to read cipher of file %d: %v", file.ID, err))
+					continue
+				}
+				file.Cipher = cipher
+			}
+			if !s.cryptoManager.IsDeprecatedAlgorithm(file.Cipher) {
+				continue
+			}
+
+			migrated, err := s.reencryptFile(ctx, file)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to re-encrypt file %d: %v", file.ID, err))
+				continue
+			}
+			if migrated {
+				report.FilesMigrated++
+			} else {
+				report.FilesSkipped++
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "file re-encryption aborted")
+	}
+	return nil
+}
+
+// recordFileCipher reads the header of a stored object and records its cipher.
+func (s *ReencryptionService) recordFileCipher(ctx context.Context, file *models.File) (string, error) {
+	object, err := s.fileStorageService.DownloadFile(ctx, file.StoragePath)
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	header, err := io.ReadAll(io.LimitReader(object, maxCiphertextHeaderSize))
+	if err != nil {
+		return "", err
+	}
+	cipher := FileCipher(header)
+
+	if err := s.db.GetDB().Model(&models.File{}).Where("id = ?", file.ID).UpdateColumn("cipher", cipher).Error; err != nil {
+		return "", err
+	}
+	return cipher, nil
+}
+
+// reencryptFile re-encrypts a stored file with the file encryption algorithm under the
+// same key, and points its File at the new object. Files whose references do not all
+// share one server-held key are left alone, and false is reported; files larger than
+// maxReencryptionFileSize fail without being read.
+func (s *ReencryptionService) reencryptFile(ctx context.Context, file *models.File) (bool, error) {
+	fileKey, err := s.sharedFileKey(file.ID)
+	if err != nil || fileKey == nil {
+		return false, err
+	}
+
+	if file.SizeBytes > maxReencryptionFileSize {
+		return false, apperrors.New(apperrors.ErrCodeValidation,
+			fmt.Sprintf("file is larger than the %d byte re-encryption limit", maxReencryptionFileSize))
+	}
+
+	object, err := s.fileStorageService.DownloadFile(ctx, file.StoragePath)
+	if err != nil {
+		return false, err
+	}
+	// The recorded size is not trusted to bound the read
+	data, err := io.ReadAll(io.LimitReader(object, maxReencryptionFileSize+1))
+	object.Close()
+	if err != nil {
+		return false, err
+	}
+	if int64(len(data)) > maxReencryptionFileSize {
+		return false, apperrors.New(apperrors.ErrCodeValidation,
+			fmt.Sprintf("file is larger than the %d byte re-encryption limit", maxReencryptionFileSize))
+	}
+
+	// Never re-encrypt content that no longer matches what was uploaded
+	if actualHash, err := utils.CalculateFileHash(bytes.NewReader(data)); err != nil {
+		return false, err
+	} else if actualHash != strings.ToLower(file.ContentHash) {
+		return false, apperrors.New(apperrors.ErrCodeInternal, "stored object does not match its content hash")
+	}
+
+	plaintext, err := s.cryptoManager.DecryptFileData(data, fileKey)
+	if err != nil {
+		return false, err
+	}
+	sealed, err := s.cryptoManager.SealFile(plaintext, fileKey)
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256(sealed)
+	contentHash := hex.EncodeToString(sum[:])
+	storagePath := contentHash
+	if slash := strings.LastIndex(file.StoragePath, "/"); slash >= 0 {
+		storagePath = file.StoragePath[:slash+1] + contentHash
+	}
+	if err := s.fileStorageService.UploadFile(ctx, storagePath, bytes.NewReader(sealed), int64(len(sealed)), "application/octet-stream"); err != nil {
+		return false, err
+	}
+
+	// Only switch over if the File still holds the content that was re-encrypted
+	result := s.db.GetDB().Model(&models.File{}).
+		Where("id = ? AND content_hash = ?", file.ID, file.ContentHash).
+		Updates(map[string]interface{}{
+			"content_hash": contentHash,
+			"storage_path": storagePath,
+			"size_bytes":   int64(len(sealed)),
+			"cipher":       s.cryptoManager.GetConfig().FileEncryptionAlgorithm,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		if err := s.fileStorageService.DeleteFile(ctx, storagePath); err != nil {
+			log.Printf("Warning: failed to delete re-encrypted object %s: %v", storagePath, err)
+		}
+		return false, result.Error
+	}
+	return true, nil
+}
+
+// sharedFileKey returns the key every UserFile and file version referencing a File
+// holds, or nil if they hold different keys, none, or not a plain file key.
+func (s *ReencryptionService) sharedFileKey(fileID uint) ([]byte, error) {
+	db := s.db.GetDB()
+	var keys []string
+	for _, model := range []interface{}{&models.UserFile{}, &models.FileVersion{}} {
+		var modelKeys []string
+		if err := db.Unscoped().Model(model).Where("file_id = ?", fileID).Distinct().Pluck("encryption_key", &modelKeys).Error; err != nil {
+			return nil, err
+		}
+		keys = append(keys, modelKeys...)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	for _, key := range keys {
+		if key != keys[0] {
+			return nil, nil
+		}
+	}
+
+	fileKey, ok := decodeRawFileKey(keys[0])
+	if !ok {
+		return nil, nil
+	}
+	return fileKey, nil
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// errSessionEnded aborts a rotation whose session was revoked or has expired.
+var errSessionEnded = errors.New("session ended")
+
+// RefreshTokenService issues and rotates refresh tokens. Each use of a refresh token
+// marks it used and issues a successor in the same family. Presenting a token that was
+// already used means it was copied, so the whole family and its session are revoked
+// and the user has to sign in again. A family is identified by its Session's ID.
+type RefreshTokenService struct {
+	*BaseService
+	authService *AuthService
+	tokenTTL    time.Duration
+}
+
+// NewRefreshTokenService creates a new RefreshTokenService.
+func NewRefreshTokenService(cfg *config.Config, db *database.DB, authService *AuthService) *RefreshTokenService {
+	tokenTTL := defaultRefreshTokenTTL
+	if cfg.RefreshTokenTTLHours > 0 {
+		tokenTTL = time.Duration(cfg.RefreshTokenTTLHours) * time.Hour
+	}
+
+	return &RefreshTokenService{
+		BaseService: NewBaseService(db),
+		authService: authService,
+		tokenTTL:    tokenTTL,
+	}
+}
+
+//================================================================================
+// Token Operations
+//================================================================================
+
+// IssueRefreshToken starts the token family of a newly created session.
+func (s *RefreshTokenService) IssueRefreshToken(userID uint, sessionID string) (string, error) {
+	return s.issue(s.db.GetDB(), userID, sessionID)
+}
+
+// RotateRefreshToken exchanges a refresh token for a new access token and the next
+// refresh token of its family, and extends the family's session.
+func (s *RefreshTokenService) RotateRefreshToken(refreshToken string) (*models.User, string, string, error) {
+	token, err := s.findToken(refreshToken)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if token.RevokedAt != nil {
+		return nil, "", "", apperrors.New(apperrors.ErrCodeUnauthorized, "refresh token has been revoked")
+	}
+	if token.UsedAt != nil {
+		return nil, "", "", s.handleReuse(token)
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, "", "", apperrors.New(apperrors.ErrCodeUnauthorized, "refresh token has expired")
+	}
+
+	var user models.User
+	if err := s.db.GetDB().First(&user, token.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", "", apperrors.New(apperrors.ErrCodeUnauthorized, "invalid refresh token")
+		}
+		return nil, "", "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	var nextToken string
+	reused := false
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		// Only one request can consume the token; a concurrent loser is treated as reuse
+		result := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", token.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			reused = true
+			return nil
+		}
+
+		now := time.Now()
+		result = tx.Model(&models.Session{}).
+			Where("session_id = ? AND revoked_at IS NULL AND expires_at > ?", token.FamilyID, now).
+			Updates(map[string]interface{}{
+				"last_seen_at": now,
+				"expires_at":   now.Add(s.tokenTTL),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errSessionEnded
+		}
+
+		var err error
+		nextToken, err = s.issue(tx, token.UserID, token.FamilyID)
+		return err
+	})
+	if errors.Is(err, errSessionEnded) {
+		if err := s.RevokeFamily(token.FamilyID); err != nil {
+			return nil, "", "", err
+		}
+		return nil, "", "", apperrors.New(apperrors.ErrCodeUnauthorized, "session has ended, please sign in again")
+	}
+	if err != nil {
+		return nil, "", "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to rotate refresh token")
+	}
+	if reused {
+		return nil, "", "", s.handleReuse(token)
+	}
+
+	accessToken, err := s.authService.GenerateSessionToken(&user, token.FamilyID)
+	if err != nil {
+		return nil, "", "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate token")
+	}
+
+	return &user, accessToken, nextToken, nil
+}
+
+// RevokeRefreshToken revokes the family and session of the given token, e.g. on
+// logout. Unknown tokens are ignored so that logging out twice is harmless.
+func (s *RefreshTokenService) RevokeRefreshToken(refreshToken string) error {
+	var token models.RefreshToken
+	if err := s.db.GetDB().Where("token_hash = ?", hashRefreshToken(refreshToken)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return s.RevokeFamily(token.FamilyID)
+}
+
+// RevokeFamily revokes every refresh token of a family together with its session.
+func (s *RefreshTokenService) RevokeFamily(familyID string) error {
+	now := time.Now()
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).
+			Where("session_id = ? AND revoked_at IS NULL", familyID).
+			Update("revoked_at", now).Error
+	})
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to revoke refresh tokens")
+	}
+	return nil
+}
+
+// CleanupExpiredTokens deletes refresh tokens that have expired. Used tokens are kept
+// until then so that a replayed token is still recognised as reuse.
+func (s *RefreshTokenService) CleanupExpiredTokens() (int64, error) {
+	result := s.db.GetDB().Where("expires_at < ?", time.Now()).Delete(&models.RefreshToken{})
+	if result.Error != nil {
+		return 0, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to delete expired refresh tokens")
+	}
+	return result.RowsAffected, nil
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+func (s *RefreshTokenService) issue(tx *gorm.DB, userID uint, familyID string) (string, error) {
+	value, err := generateRefreshTokenValue(32)
+	if err != nil {
+		return "", err
+	}
+
+	token := models.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashRefreshToken(value),
+		ExpiresAt: time.Now().Add(s.tokenTTL),
+	}
+	if err := tx.Create(&token).Error; err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to store refresh token")
+	}
+	return value, nil
+}
+
+func (s *RefreshTokenService) findToken(refreshToken string) (*models.RefreshToken, error) {
+	if refreshToken == "" {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid refresh token")
+	}
+
+	var token models.RefreshToken
+	if err := s.db.GetDB().Where("token_hash = ?", hashRefreshToken(refreshToken)).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid refresh token")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return &token, nil
+}
+
+// handleReuse revokes the family and session a replayed token belongs to.
+func (s *RefreshTokenService) handleReuse(token *models.RefreshToken) error {
+	log.Printf("Warning: Refresh token reuse detected for user %d, revoking token family", token.UserID)
+	if err := s.RevokeFamily(token.FamilyID); err != nil {
+		return err
+	}
+	return apperrors.New(apperrors.ErrCodeUnauthorized, "refresh token reuse detected, please sign in again")
+}
+
+func generateRefreshTokenValue(length int) (string, error) {
+	tokenBytes := make([]byte, length)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate refresh token")
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+// hashRefreshToken returns the SHA-256 of a token. Tokens carry 256 bits of entropy,
+// so an unsalted hash is enough to keep a database leak from yielding usable tokens.
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
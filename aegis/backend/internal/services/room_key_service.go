@@ -0,0 +1,275 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+// RoomMemberKey is a version of a room key wrapped on the client to a member's public key.
+type RoomMemberKey struct {
+	UserID         uint
+	Version        int
+	KeyFingerprint string // Fingerprint of the public key the room key was wrapped to
+	WrappedKey     string
+}
+
+// RoomFileKey is a file key wrapped on the client under a version of a room key.
+type RoomFileKey struct {
+	UserFileID uint
+	KeyVersion int
+	WrappedKey string
+}
+
+// RoomKeyService manages room keys. Each room key version is generated by a member's
+// client and stored only wrapped to each member's public key; the keys of files shared
+// to the room are wrapped under it. When a member leaves, their copies are deleted and
+// the room is flagged for re-keying, which blocks new files until a remaining member
+// sets the next version.
+type RoomKeyService struct {
+	*BaseService
+	roomService *RoomService
+}
+
+// NewRoomKeyService creates a new RoomKeyService.
+func NewRoomKeyService(db *database.DB, roomService *RoomService) *RoomKeyService {
+	return &RoomKeyService{
+		BaseService: NewBaseService(db),
+		roomService: roomService,
+	}
+}
+
+//================================================================================
+// Room Keys
+//================================================================================
+
+// RotateRoomKey sets the next version of a room's key, which also gives a room its
+// first key. Every member with a public key must get a copy, wrapped to their current
+// key. The keys of files already in the room can be re-wrapped under the new version at
+// the same time; the rest stay readable with the earlier versions members keep. Members
+// who can manage the room's files can rotate its key.
+func (s *RoomKeyService) RotateRoomKey(userID, roomID uint, version int, memberKeys []RoomMemberKey, fileKeys []RoomFileKey) (*models.Room, error) {
+	if err := s.roomService.requireRoomFilePermission(roomID, userID); err != nil {
+		return nil, err
+	}
+
+	var room models.Room
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&room, roomID).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeNotFound, "room not found")
+		}
+		if version != room.KeyVersion+1 {
+			return apperrors.New(apperrors.ErrCodeConflict, "room key has changed")
+		}
+
+		var members []models.RoomMember
+		if err := tx.Where("room_id = ?", roomID).Find(&members).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load room members")
+		}
+		if err := s.requireEveryMember(tx, members, memberKeys); err != nil {
+			return err
+		}
+
+		for _, memberKey := range memberKeys {
+			if memberKey.Version != version {
+				return apperrors.New(apperrors.ErrCodeInvalidArgument, "member key is for another room key version")
+			}
+			if err := s.saveMemberKey(tx, roomID, memberKey, true); err != nil {
+				return err
+			}
+		}
+
+		for _, fileKey := range fileKeys {
+			if fileKey.WrappedKey == "" || len(fileKey.WrappedKey) > maxWrappedFileKeyLength {
+				return apperrors.New(apperrors.ErrCodeInvalidArgument, "wrapped file key is missing or too long")
+			}
+			result := tx.Model(&models.RoomFile{}).
+				Where("room_id = ? AND user_file_id = ?", roomID, fileKey.UserFileID).
+				Updates(map[string]interface{}{"key_version": version, "wrapped_key": fileKey.WrappedKey})
+			if result.Error != nil {
+				return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to store room file key")
+			}
+			if result.RowsAffected == 0 {
+				return apperrors.New(apperrors.ErrCodeNotFound, "file is not shared to this room")
+			}
+		}
+
+		// Conditional on the version read above, so concurrent rotations cannot both win
+		result := tx.Model(&models.Room{}).
+			Where("id = ? AND key_version = ?", roomID, room.KeyVersion).
+			Updates(map[string]interface{}{"key_version": version, "rekey_required": false})
+		if result.Error != nil {
+			return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to update room key")
+		}
+		if result.RowsAffected == 0 {
+			return apperrors.New(apperrors.ErrCodeConflict, "room key has changed")
+		}
+		room.KeyVersion = version
+		room.RekeyRequired = false
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// GrantRoomKeys gives members copies of existing room key versions, such as a member
+// who has just joined or registered a public key. Any member can grant the versions
+// they hold.
+func (s *RoomKeyService) GrantRoomKeys(userID, roomID uint, memberKeys []RoomMemberKey) error {
+	if len(memberKeys) == 0 {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "no keys given")
+	}
+	if err := s.roomService.requireRoomMembership(roomID, userID); err != nil {
+		return err
+	}
+
+	db := s.db.GetDB()
+	var room models.Room
+	if err := db.First(&room, roomID).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeNotFound, "room not found")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, memberKey := range memberKeys {
+			if memberKey.Version < 1 || memberKey.Version > room.KeyVersion {
+				return apperrors.New(apperrors.ErrCodeInvalidArgument, "no such room key version")
+			}
+
+			var count int64
+			if err := tx.Model(&models.RoomKey{}).Where("room_id = ? AND version = ? AND user_id = ?", roomID, memberKey.Version, userID).Count(&count).Error; err != nil {
+				return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+			}
+			if count == 0 {
+				return apperrors.New(apperrors.ErrCodeForbidden, "you do not hold this room key version")
+			}
+
+			if err := s.roomService.requireRoomMembership(roomID, memberKey.UserID); err != nil {
+				return err
+			}
+			if err := s.saveMemberKey(tx, roomID, memberKey, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetMemberKeys returns the versions of a room's key wrapped to the member, oldest first.
+func (s *RoomKeyService) GetMemberKeys(userID, roomID uint) ([]*models.RoomKey, error) {
+	if err := s.roomService.requireRoomMembership(roomID, userID); err != nil {
+		return nil, err
+	}
+
+	var keys []*models.RoomKey
+	if err := s.db.GetDB().Where("room_id = ? AND user_id = ?", roomID, userID).Order("version").Find(&keys).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load room keys")
+	}
+	return keys, nil
+}
+
+// GetRoomFileKeys returns the wrapped keys of the files shared to a room.
+func (s *RoomKeyService) GetRoomFileKeys(userID, roomID uint) ([]*models.RoomFile, error) {
+	if err := s.roomService.requireRoomMembership(roomID, userID); err != nil {
+		return nil, err
+	}
+
+	var roomFiles []*models.RoomFile
+	if err := s.db.GetDB().Where("room_id = ? AND wrapped_key <> ''", roomID).Order("user_file_id").Find(&roomFiles).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load room file keys")
+	}
+	return roomFiles, nil
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// requireEveryMember checks that a new room key version is wrapped to every member
+// who has a public key, and to nobody else.
+func (s *RoomKeyService) requireEveryMember(tx *gorm.DB, members []models.RoomMember, memberKeys []RoomMemberKey) error {
+	covered := make(map[uint]bool, len(memberKeys))
+	for _, memberKey := range memberKeys {
+		covered[memberKey.UserID] = true
+	}
+
+	memberIDs := make([]uint, 0, len(members))
+	isMember := make(map[uint]bool, len(members))
+	for _, member := range members {
+		memberIDs = append(memberIDs, member.UserID)
+		isMember[member.UserID] = true
+	}
+	for userID := range covered {
+		if !isMember[userID] {
+			return apperrors.New(apperrors.ErrCodeForbidden, "access denied: user is not a member of this room")
+		}
+	}
+
+	var withKeys []uint
+	if err := tx.Model(&models.UserKeyPair{}).Where("user_id IN ?", memberIDs).Pluck("user_id", &withKeys).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	for _, userID := range withKeys {
+		if !covered[userID] {
+			return apperrors.New(apperrors.ErrCodeConflict, fmt.Sprintf("room key is not wrapped to member %d", userID))
+		}
+	}
+	return nil
+}
+
+// saveMemberKey stores a member's copy of a room key version, wrapped to their current
+// public key. Only a rotation may replace a copy; a grant never overwrites one a member
+// already holds, so members cannot swap each other's keys.
+func (s *RoomKeyService) saveMemberKey(tx *gorm.DB, roomID uint, memberKey RoomMemberKey, replace bool) error {
+	if memberKey.WrappedKey == "" || len(memberKey.WrappedKey) > maxWrappedFileKeyLength {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "wrapped room key is missing or too long")
+	}
+
+	var keyPair models.UserKeyPair
+	if err := tx.Where("user_id = ?", memberKey.UserID).First(&keyPair).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apperrors.New(apperrors.ErrCodeNotFound, "member has no public key")
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	if keyPair.Fingerprint != memberKey.KeyFingerprint {
+		return apperrors.New(apperrors.ErrCodeConflict, "member's public key has changed")
+	}
+
+	roomKey := models.RoomKey{
+		RoomID:         roomID,
+		Version:        memberKey.Version,
+		UserID:         memberKey.UserID,
+		KeyFingerprint: keyPair.Fingerprint,
+		WrappedKey:     memberKey.WrappedKey,
+	}
+	onConflict := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "room_id"}, {Name: "version"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"key_fingerprint", "wrapped_key"}),
+	}
+	if !replace {
+		onConflict = clause.OnConflict{
+			Columns:   []clause.Column{{Name: "room_id"}, {Name: "version"}, {Name: "user_id"}},
+			DoNothing: true,
+		}
+	}
+	result := tx.Clauses(onConflict).Create(&roomKey)
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to save room key")
+	}
+	if result.RowsAffected == 0 {
+		return apperrors.New(apperrors.ErrCodeConflict, "member already holds this room key version")
+	}
+	return nil
+}
@@ -111,7 +111,13 @@ func (s *RoomService) RemoveRoomMember(roomID, userID, requesterID uint) error {
 		return apperrors.New(apperrors.ErrCodeForbidden, "cannot remove room creator")
 	}
 
-	return db.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&models.RoomMember{}).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&models.RoomMember{}).Error; err != nil {
+			return err
+		}
+
+		return s.forgetRoomMember(tx, roomID, userID)
+	})
 }
 
 func (s *RoomService) UpdateRoomMemberRole(roomID, targetUserID, requesterID uint, newRole models.RoomRole) error {
@@ -173,7 +179,13 @@ func (s *RoomService) LeaveRoom(roomID, userID uint) error {
 	}
 
 	// Remove the member
-	return db.Delete(&member).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&member).Error; err != nil {
+			return err
+		}
+
+		return s.forgetRoomMember(tx, roomID, userID)
+	})
 }
 
 func (s *RoomService) GetRoomFiles(roomID, userID uint) ([]*models.UserFile, error) {
@@ -234,7 +246,11 @@ func (s *RoomService) DeleteRoom(roomID, userID uint) error {
 		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to delete room")
 	}
 
-	return nil
+	if err := db.Where("room_id = ?", roomID).Delete(&models.RoomKey{}).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to delete room keys")
+	}
+
+	return s.revokeRoomKeyGrants(db, roomID, "1 = 1")
 }
 
 //================================================================================
@@ -242,8 +258,19 @@ func (s *RoomService) DeleteRoom(roomID, userID uint) error {
 //================================================================================
 
 func (s *RoomService) ShareFileToRoom(userFileID, roomID, userID uint) error {
+	return s.ShareEncryptedFileToRoom(userFileID, roomID, userID, nil)
+}
+
+// ShareEncryptedFileToRoom shares a file to a room. Once the room has a key, the file's
+// key must come wrapped under the current version of the room key, and nothing can be
+// shared while the room is waiting to be re-keyed.
+func (s *RoomService) ShareEncryptedFileToRoom(userFileID, roomID, userID uint, key *RoomFileKey) error {
 	fmt.Printf("DEBUG: ShareFileToRoom called - userFileID: %d, roomID: %d, userID: %d\n", userFileID, roomID, userID)
 
+	if err := s.checkRoomFileKey(roomID, key); err != nil {
+		return err
+	}
+
 	var userFile models.UserFile
 	if err := s.db.GetDB().First(&userFile, userFileID).Error; err != nil {
 		fmt.Printf("DEBUG: ShareFileToRoom - file not found: %v\n", err)
@@ -260,7 +287,20 @@ func (s *RoomService) ShareFileToRoom(userFileID, roomID, userID uint) error {
 
 	entity := UserFileEntity{UserFile: &userFile}
 	fmt.Printf("DEBUG: ShareFileToRoom - calling ShareEntityToRoom\n")
-	return s.ShareEntityToRoom(entity, EntityTypeFile, roomID, userID, true)
+	if err := s.ShareEntityToRoom(entity, EntityTypeFile, roomID, userID, true); err != nil {
+		return err
+	}
+
+	if key == nil {
+		return nil
+	}
+	err := s.db.GetDB().Model(&models.RoomFile{}).
+		Where("room_id = ? AND user_file_id = ?", roomID, userFileID).
+		Updates(map[string]interface{}{"key_version": key.KeyVersion, "wrapped_key": key.WrappedKey}).Error
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to store room file key")
+	}
+	return nil
 }
 
 func (s *RoomService) RemoveFileFromRoom(userFileID, roomID, userID uint) error {
@@ -465,6 +505,69 @@ func (s *RoomService) deleteRoomAssociation(entityType EntityType, entityID, roo
 		return apperrors.Wrap(err, apperrors.ErrCodeInternal, fmt.Sprintf("failed to remove %s from room", entityType))
 	}
 
+	if entityType == EntityTypeFile {
+		return s.revokeRoomKeyGrants(db, roomID, "user_file_id = ?", entityID)
+	}
+
+	return nil
+}
+
+// checkRoomFileKey checks that a file key can be shared to the room as given: wrapped
+// under the current room key if the room has one, and not at all otherwise.
+func (s *RoomService) checkRoomFileKey(roomID uint, key *RoomFileKey) error {
+	var room models.Room
+	if err := s.db.GetDB().First(&room, roomID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apperrors.New(apperrors.ErrCodeNotFound, "room not found")
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	if room.KeyVersion == 0 {
+		if key != nil {
+			return apperrors.New(apperrors.ErrCodeInvalidArgument, "room has no key")
+		}
+		return nil
+	}
+	if room.RekeyRequired {
+		return apperrors.New(apperrors.ErrCodeConflict, "room must be re-keyed before files are shared to it")
+	}
+	if key == nil || key.WrappedKey == "" {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "file key must be wrapped under the room key")
+	}
+	if key.KeyVersion != room.KeyVersion {
+		return apperrors.New(apperrors.ErrCodeConflict, "room key has changed")
+	}
+	if len(key.WrappedKey) > maxWrappedFileKeyLength {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "wrapped file key is too long")
+	}
+	return nil
+}
+
+// forgetRoomMember removes a departed member's copies of the room key and the file keys
+// granted to them through the room. A room with a key is flagged for re-keying: no new
+// files can be shared to it until a remaining member sets a key the departed member
+// never had. It runs in the transaction that removes the member.
+func (s *RoomService) forgetRoomMember(tx *gorm.DB, roomID, userID uint) error {
+	if err := tx.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&models.RoomKey{}).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to delete room keys")
+	}
+
+	err := tx.Model(&models.Room{}).Where("id = ? AND key_version > 0", roomID).Update("rekey_required", true).Error
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to flag room for re-keying")
+	}
+
+	return s.revokeRoomKeyGrants(tx, roomID, "recipient_id = ?", userID)
+}
+
+// revokeRoomKeyGrants removes the file key grants made through a room that match the
+// condition, once a member or file has left the room. Direct grants are kept.
+func (s *RoomService) revokeRoomKeyGrants(db *gorm.DB, roomID uint, condition string, args ...interface{}) error {
+	err := db.Where("room_id = ?", roomID).Where(condition, args...).Delete(&models.FileKeyGrant{}).Error
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to revoke file key grants")
+	}
 	return nil
 }
 
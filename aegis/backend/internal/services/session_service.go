@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const sessionCleanupEvery = time.Hour
+
+// SessionService keeps track of signed-in devices. Every login starts a Session whose
+// ID is carried as the jti claim of the device's access tokens and identifies the
+// family of its refresh tokens, so revoking a session ends both.
+type SessionService struct {
+	*BaseService
+	authService         *AuthService
+	refreshTokenService *RefreshTokenService
+}
+
+// NewSessionService creates a new SessionService.
+func NewSessionService(db *database.DB, authService *AuthService, refreshTokenService *RefreshTokenService) *SessionService {
+	return &SessionService{
+		BaseService:         NewBaseService(db),
+		authService:         authService,
+		refreshTokenService: refreshTokenService,
+	}
+}
+
+//================================================================================
+// Session Operations
+//================================================================================
+
+// StartSession records a new session for a user who just signed in and returns its
+// first access and refresh tokens.
+func (s *SessionService) StartSession(user *models.User, userAgent, ipAddress string) (string, string, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		SessionID:  sessionID,
+		UserID:     user.ID,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.refreshTokenService.tokenTTL),
+	}
+	if err := s.db.GetDB().Create(&session).Error; err != nil {
+		return "", "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create session")
+	}
+
+	accessToken, err := s.authService.GenerateSessionToken(user, sessionID)
+	if err != nil {
+		return "", "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate token")
+	}
+	refreshToken, err := s.refreshTokenService.IssueRefreshToken(user.ID, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// ListSessions returns the user's active sessions, most recently seen first. The
+// session named by currentSessionID is marked as current.
+func (s *SessionService) ListSessions(userID uint, currentSessionID string) ([]*models.Session, error) {
+	var sessions []*models.Session
+	if err := s.db.GetDB().
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to retrieve sessions")
+	}
+
+	for _, session := range sessions {
+		session.IsCurrent = currentSessionID != "" && session.SessionID == currentSessionID
+	}
+	return sessions, nil
+}
+
+// EndSession revokes a session by its jti, e.g. on logout.
+func (s *SessionService) EndSession(sessionID string) error {
+	return s.refreshTokenService.RevokeFamily(sessionID)
+}
+
+// RevokeSession revokes one of the user's sessions.
+func (s *SessionService) RevokeSession(userID, id uint) error {
+	var session models.Session
+	if err := s.db.GetDB().Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apperrors.New(apperrors.ErrCodeNotFound, "session not found")
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return s.refreshTokenService.RevokeFamily(session.SessionID)
+}
+
+// RevokeOtherSessions revokes every session of the user except currentSessionID and
+// returns how many were revoked.
+func (s *SessionService) RevokeOtherSessions(userID uint, currentSessionID string) (int, error) {
+	var revoked int64
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var err error
+		revoked, err = revokeUserSessions(tx, userID, currentSessionID)
+		return err
+	})
+	if err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to revoke sessions")
+	}
+	return int(revoked), nil
+}
+
+// CleanupExpired deletes sessions and refresh tokens that have expired.
+func (s *SessionService) CleanupExpired() (int64, error) {
+	tokens, err := s.refreshTokenService.CleanupExpiredTokens()
+	if err != nil {
+		return 0, err
+	}
+
+	result := s.db.GetDB().Where("expires_at < ?", time.Now()).Delete(&models.Session{})
+	if result.Error != nil {
+		return tokens, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to delete expired sessions")
+	}
+	return tokens + result.RowsAffected, nil
+}
+
+// StartCleanupWorker runs CleanupExpired every hour until ctx is cancelled.
+func (s *SessionService) StartCleanupWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(sessionCleanupEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cleaned, err := s.CleanupExpired()
+				if err != nil {
+					log.Printf("Warning: Session cleanup failed: %v", err)
+				} else if cleaned > 0 {
+					log.Printf("Cleaned up %d expired sessions and refresh tokens", cleaned)
+				}
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// revokeUserSessions revokes every session of a user, except exceptSessionID when it is
+// set, together with their refresh tokens.
+func revokeUserSessions(tx *gorm.DB, userID uint, exceptSessionID string) (int64, error) {
+	now := time.Now()
+
+	sessions := tx.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	tokens := tx.Model(&models.RefreshToken{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	if exceptSessionID != "" {
+		sessions = sessions.Where("session_id <> ?", exceptSessionID)
+		tokens = tokens.Where("family_id <> ?", exceptSessionID)
+	}
+
+	result := sessions.Update("revoked_at", now)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if err := tokens.Update("revoked_at", now).Error; err != nil {
+		return 0, err
+	}
+	return result.RowsAffected, nil
+}
+
+func generateSessionID() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate session ID")
+	}
+	return hex.EncodeToString(idBytes), nil
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net"
 	"net/url"
 	"strings"
@@ -99,7 +100,7 @@ func (s *ShareService) CreateShare(userFileID uint, masterPassword string, maxDo
 	}
 
 	// Encrypt the share password with a service key for storage
-	encryptedPassword, passwordIV, err := s.encryptSharePassword(masterPassword)
+	encryptedPassword, passwordIV, passwordKeyVersion, err := s.encryptSharePassword(masterPassword)
 	if err != nil {
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encrypt share password")
 	}
@@ -117,16 +118,17 @@ func (s *ShareService) CreateShare(userFileID uint, masterPassword string, maxDo
 	}
 
 	fileShare := &models.FileShare{
-		UserFileID:        userFileID,
-		ShareToken:        shareToken,
-		EncryptedKey:      encryptedFileKey,
-		Salt:              "", // Keep for backward compatibility
-		IV:                fileKeyIV,
-		EnvelopeKey:       encryptedEnvelopeKey,
-		EnvelopeSalt:      envelopeSalt,
-		EnvelopeIV:        envelopeIV,
-		EncryptedPassword: encryptedPassword,
-		PasswordIV:        passwordIV,
+		UserFileID:         userFileID,
+		ShareToken:         shareToken,
+		EncryptedKey:       encryptedFileKey,
+		Salt:               "", // Keep for backward compatibility
+		IV:                 fileKeyIV,
+		EnvelopeKey:        encryptedEnvelopeKey,
+		EnvelopeSalt:       envelopeSalt,
+		EnvelopeIV:         envelopeIV,
+		EncryptedPassword:  encryptedPassword,
+		PasswordIV:         passwordIV,
+		PasswordKeyVersion: passwordKeyVersion,
 		PlainTextPassword: func() string {
 			if isPasswordless {
 				return "" // Passwordless share (either no password provided or email-based)
@@ -186,14 +188,27 @@ func (s *ShareService) UpdateShare(userID uint, shareID uint, masterPassword *st
 			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "invalid file encryption key")
 		}
 
-		encryptedKeyData, err := s.cryptoManager.EncryptFileKeyWithPassword(fileKey, *masterPassword)
+		// Re-key the share the way CreateShare keys it, so the envelope key, file key and
+		// stored password all follow the new password
+		envelopeKey, err := s.cryptoManager.GenerateEnvelopeKey()
 		if err != nil {
-			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encrypt file key")
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate envelope key")
+		}
+		keyUpdates, err := sealShareKeys(s.cryptoManager, *masterPassword, envelopeKey, fileKey)
+		if err != nil {
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encrypt share keys")
+		}
+		encryptedPassword, passwordIV, passwordKeyVersion, err := s.encryptSharePassword(*masterPassword)
+		if err != nil {
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encrypt share password")
 		}
 
-		updates["encrypted_key"] = encryptedKeyData.EncryptedKey
-		updates["salt"] = encryptedKeyData.Salt
-		updates["iv"] = encryptedKeyData.IV
+		for column, value := range keyUpdates {
+			updates[column] = value
+		}
+		updates["encrypted_password"] = encryptedPassword
+		updates["password_iv"] = passwordIV
+		updates["password_key_version"] = passwordKeyVersion
 		updates["plain_text_password"] = *masterPassword // Update plain text password for display
 	}
 
@@ -264,9 +279,10 @@ func (s *ShareService) DecryptFileKey(fileShare *models.FileShare, masterPasswor
 	// For passwordless shares, use the stored password
 	password := masterPassword
 	if fileShare.PlainTextPassword == "" && masterPassword == "" {
-		// This is a passwordless share, decrypt the stored password
-		if fileShare.EncryptedPassword != "" && fileShare.PasswordIV != "" {
-			decryptedPassword, err := s.decryptSharePassword(fileShare.EncryptedPassword, fileShare.PasswordIV)
+		// This is a passwordless share, decrypt the stored password. Passwords sealed in the
+		// ciphertext format carry their nonce, so only legacy ones have a separate IV
+		if fileShare.EncryptedPassword != "" {
+			decryptedPassword, err := s.decryptSharePassword(fileShare.EncryptedPassword, fileShare.PasswordIV, fileShare.PasswordKeyVersion)
 			if err != nil {
 				return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to decrypt stored password for passwordless share")
 			}
@@ -276,10 +292,11 @@ func (s *ShareService) DecryptFileKey(fileShare *models.FileShare, masterPasswor
 		}
 	}
 
-	// Use envelope key decryption for new shares
-	if fileShare.EnvelopeKey != "" && fileShare.EnvelopeSalt != "" && fileShare.EnvelopeIV != "" {
+	// Use envelope key decryption for new shares, whose salt and IV are either stored
+	// alongside or carried in the ciphertext header
+	if fileShare.EnvelopeKey != "" {
 		// Decrypt envelope key with password
-		envelopeKey, err := s.cryptoManager.DecryptEnvelopeKey(fileShare.EnvelopeKey, fileShare.EnvelopeSalt, fileShare.EnvelopeIV, password)
+		envelopeKey, err := s.cryptoManager.DecryptEnvelopeKey(fileShare.EnvelopeKey, fileShare.EnvelopeSalt, fileShare.EnvelopeIV, fileShare.KDFParams, password)
 		if err != nil {
 			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to decrypt envelope key")
 		}
@@ -290,6 +307,9 @@ func (s *ShareService) DecryptFileKey(fileShare *models.FileShare, masterPasswor
 			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to decrypt file key")
 		}
 
+		if s.cryptoManager.NeedsKDFUpgrade(fileShare.EnvelopeKey) {
+			s.upgradeShareKeys(fileShare, password, envelopeKey, fileKey)
+		}
 		return fileKey, nil
 	}
 
@@ -298,6 +318,7 @@ func (s *ShareService) DecryptFileKey(fileShare *models.FileShare, masterPasswor
 		EncryptedKey: fileShare.EncryptedKey,
 		Salt:         fileShare.Salt,
 		IV:           fileShare.IV,
+		KDF:          fileShare.KDFParams,
 	}
 
 	fileKey, err := s.cryptoManager.DecryptFileKeyWithPassword(encryptedKeyData, password)
@@ -305,12 +326,103 @@ func (s *ShareService) DecryptFileKey(fileShare *models.FileShare, masterPasswor
 		return nil, err
 	}
 
+	// Legacy shares gain an envelope key the first time their password is supplied
+	envelopeKey, err := s.cryptoManager.GenerateEnvelopeKey()
+	if err == nil {
+		s.upgradeShareKeys(fileShare, password, envelopeKey, fileKey)
+	}
+
 	return fileKey, nil
 }
 
+// upgradeShareKeys re-seals the keys of a share under the configured KDF now that its
+// password is known. The update only applies if the share was not changed since it was
+// read, and failures are logged rather than returned because the file key is already
+// decrypted.
+func (s *ShareService) upgradeShareKeys(fileShare *models.FileShare, password string, envelopeKey, fileKey []byte) {
+	updates, err := sealShareKeys(s.cryptoManager, password, envelopeKey, fileKey)
+	if err == nil {
+		err = s.GetDB().GetDB().Model(&models.FileShare{}).
+			Where("id = ? AND envelope_key = ? AND encrypted_key = ?", fileShare.ID, fileShare.EnvelopeKey, fileShare.EncryptedKey).
+			Updates(updates).Error
+	}
+	if err != nil {
+		log.Printf("Warning: failed to upgrade key derivation of share %d: %v", fileShare.ID, err)
+	}
+}
+
+// openShareKeys decrypts the envelope key and file key of a share with its password.
+// Legacy shares keep the file key under the password directly, and return no envelope key.
+func openShareKeys(cryptoManager *CryptoManager, share *models.FileShare, password string) (envelopeKey, fileKey []byte, err error) {
+	if share.EnvelopeKey == "" {
+		fileKey, err = cryptoManager.DecryptFileKeyWithPassword(&EncryptedKeyData{
+			EncryptedKey: share.EncryptedKey,
+			Salt:         share.Salt,
+			IV:           share.IV,
+			KDF:          share.KDFParams,
+		}, password)
+		return nil, fileKey, err
+	}
+
+	envelopeKey, err = cryptoManager.DecryptEnvelopeKey(share.EnvelopeKey, share.EnvelopeSalt, share.EnvelopeIV, share.KDFParams, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileKey, err = cryptoManager.DecryptFileKey(share.EncryptedKey, share.IV, envelopeKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return envelopeKey, fileKey, nil
+}
+
+// sealShareKeys seals the envelope key of a share under password and its file key under
+// the envelope key, and returns the column updates that store them. The ciphertext format
+// carries the salts, IVs and KDF parameters, so the legacy columns are cleared.
+func sealShareKeys(cryptoManager *CryptoManager, password string, envelopeKey, fileKey []byte) (map[string]interface{}, error) {
+	encryptedEnvelopeKey, envelopeSalt, envelopeIV, err := cryptoManager.EncryptEnvelopeKey(envelopeKey, password)
+	if err != nil {
+		return nil, err
+	}
+	encryptedFileKey, fileKeyIV, err := cryptoManager.EncryptFileKey(fileKey, envelopeKey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"encrypted_key": encryptedFileKey,
+		"salt":          "",
+		"iv":            fileKeyIV,
+		"envelope_key":  encryptedEnvelopeKey,
+		"envelope_salt": envelopeSalt,
+		"envelope_iv":   envelopeIV,
+		"kdf_params":    "",
+	}, nil
+}
+
+// RecordLegacyKDFParams stores the current PBKDF2 setting on shares whose keys were
+// derived in the legacy layout, which does not record it, so that they keep decrypting
+// after AEGIS_PBKDF2_ITERATIONS changes. It returns the number of shares updated.
+func (s *ShareService) RecordLegacyKDFParams() (int64, error) {
+	result := s.GetDB().GetDB().Model(&models.FileShare{}).
+		Where("kdf_params = '' AND (envelope_salt <> '' OR salt <> '')").
+		Update("kdf_params", s.cryptoManager.LegacyKDFParams())
+	if result.Error != nil {
+		return 0, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to record legacy key derivation parameters")
+	}
+	return result.RowsAffected, nil
+}
+
+// IncrementDownloadCount charges one download to a share. A download is charged once when
+// a recipient unlocks the share, however the file is then fetched, and the check against
+// the limit is part of the update so concurrent recipients cannot overrun it.
 func (s *ShareService) IncrementDownloadCount(shareID uint) error {
-	if err := s.GetDB().GetDB().Model(&models.FileShare{}).Where("id = ?", shareID).Update("download_count", gorm.Expr("download_count + 1")).Error; err != nil {
-		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to increment download count")
+	result := s.GetDB().GetDB().Model(&models.FileShare{}).
+		Where("id = ? AND (max_downloads = -1 OR download_count < max_downloads)", shareID).
+		Update("download_count", gorm.Expr("download_count + 1"))
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to increment download count")
+	}
+	if result.RowsAffected == 0 {
+		return apperrors.New(apperrors.ErrCodeValidation, "download limit exceeded")
 	}
 	return nil
 }
@@ -361,12 +473,12 @@ func (s *ShareService) GetUserShares(userID uint) ([]*models.FileShare, error) {
 	return shares, nil
 }
 
-func (s *ShareService) encryptSharePassword(password string) (encryptedPassword string, iv string, err error) {
+func (s *ShareService) encryptSharePassword(password string) (encryptedPassword string, iv string, keyVersion int, err error) {
 	return s.cryptoManager.EncryptSharePassword(password)
 }
 
-func (s *ShareService) decryptSharePassword(encryptedPassword, iv string) (string, error) {
-	return s.cryptoManager.DecryptSharePassword(encryptedPassword, iv)
+func (s *ShareService) decryptSharePassword(encryptedPassword, iv string, keyVersion int) (string, error) {
+	return s.cryptoManager.DecryptSharePassword(encryptedPassword, iv, keyVersion)
 }
 
 func (s *ShareService) generateRandomPassword() (string, error) {
@@ -423,6 +535,27 @@ func (s *ShareService) GenerateShareLink(fileShare *models.FileShare) (string, e
 }
 
 func (s *ShareService) ValidateShareToken(token string) (*models.FileShare, error) {
+	fileShare, err := s.findValidShare(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.IsDownloadLimitReached(fileShare) {
+		return nil, apperrors.New(apperrors.ErrCodeValidation, "download limit exceeded")
+	}
+
+	return fileShare, nil
+}
+
+// ValidateTicketedShareToken validates a share being downloaded with a ticket. The
+// download limit is not checked: the download was charged when the ticket was issued,
+// and may have used up the last one.
+func (s *ShareService) ValidateTicketedShareToken(token string) (*models.FileShare, error) {
+	return s.findValidShare(token)
+}
+
+// findValidShare loads an unexpired share by its token.
+func (s *ShareService) findValidShare(token string) (*models.FileShare, error) {
 	if token == "" {
 		return nil, apperrors.New(apperrors.ErrCodeValidation, "share token cannot be empty")
 	}
@@ -447,10 +580,6 @@ func (s *ShareService) ValidateShareToken(token string) (*models.FileShare, erro
 		return nil, apperrors.New(apperrors.ErrCodeValidation, "share has expired")
 	}
 
-	if s.IsDownloadLimitReached(&fileShare) {
-		return nil, apperrors.New(apperrors.ErrCodeValidation, "download limit exceeded")
-	}
-
 	return &fileShare, nil
 }
 
@@ -584,11 +713,39 @@ func (s *ShareService) ValidateAccess(attempt *AccessAttempt) (*models.FileShare
 	return &fileShare, nil
 }
 
-func (s *ShareService) LogSuccessfulDownload(fileShareID uint, attempt *AccessAttempt) error {
-	if err := s.GetDB().GetDB().Model(&models.FileShare{}).Where("id = ?", fileShareID).Update("download_count", gorm.Expr("download_count + 1")).Error; err != nil {
-		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to increment download count")
+// AuthorizeRecipient checks a share's allowed emails against the user opening it. Shares
+// restricted to emails can only be opened by a signed-in user whose matching address
+// has been verified, since anyone can register an account with an unverified address.
+func (s *ShareService) AuthorizeRecipient(fileShare *models.FileShare, user *models.User) error {
+	if fileShare.AllowedEmails == "" || fileShare.AllowedEmails == "[]" {
+		return nil
+	}
+
+	var allowedEmails []string
+	if err := json.Unmarshal([]byte(fileShare.AllowedEmails), &allowedEmails); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to parse allowed emails")
+	}
+	if len(allowedEmails) == 0 {
+		return nil
 	}
 
+	if user == nil {
+		return apperrors.New(apperrors.ErrCodeUnauthorized, "sign in to access this share")
+	}
+	for _, allowedEmail := range allowedEmails {
+		if strings.EqualFold(strings.TrimSpace(allowedEmail), user.Email) {
+			if !user.EmailVerified {
+				return apperrors.New(apperrors.ErrCodeForbidden, "verify your email address to access this share")
+			}
+			return nil
+		}
+	}
+	return apperrors.New(apperrors.ErrCodeForbidden, "access denied: your email is not in the allowed list for this share")
+}
+
+// LogSuccessfulDownload records a successful access. The download itself is charged by
+// IncrementDownloadCount.
+func (s *ShareService) LogSuccessfulDownload(fileShareID uint, attempt *AccessAttempt) error {
 	attempt.Success = true
 	attempt.FailureReason = ""
 	s.logAccessAttemptByID(fileShareID, attempt)
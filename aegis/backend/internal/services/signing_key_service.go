@@ -0,0 +1,514 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	// signingKeyRefreshEvery is how often the in-memory keyring is reloaded, so keys
+	// rotated by another server instance are picked up
+	signingKeyRefreshEvery = time.Minute
+
+	// minSigningKeyRefresh limits reloads triggered by tokens carrying an unknown kid
+	minSigningKeyRefresh = 10 * time.Second
+
+	rsaSigningKeyBits = 2048
+)
+
+// JSONWebKey is the public half of a signing key in RFC 7517 form.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// tokenKey is a signing key loaded into the keyring. private is nil for retired keys,
+// which only verify.
+type tokenKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	public    crypto.PublicKey
+	private   crypto.Signer
+	createdAt time.Time
+	expiresAt *time.Time
+}
+
+// SigningKeyService manages the asymmetric keys that sign access tokens. The newest
+// key signs; a rotation retires it but keeps it verifying, and published in the JWKS,
+// for a grace period that outlasts every token it signed. Private keys are stored
+// sealed with a key derived from the JWT secret and erased when the key is retired.
+type SigningKeyService struct {
+	*BaseService
+	algorithm   string
+	rotateEvery time.Duration
+	grace       time.Duration
+	sealKey     []byte
+
+	mu          sync.RWMutex
+	signer      *tokenKey
+	verifiers   map[string]*tokenKey
+	refreshedAt time.Time
+}
+
+// NewSigningKeyService creates a new SigningKeyService for cfg.JWTSigningAlgorithm,
+// which must be EdDSA or RS256. Call EnsureSigningKey before issuing tokens.
+func NewSigningKeyService(cfg *config.Config, db *database.DB) *SigningKeyService {
+	sealKey, err := hkdf.Key(sha256.New, []byte(cfg.JWTSecret), nil, "aegis token signing key", 32)
+	if err != nil {
+		// Only possible for an invalid key length
+		panic(err)
+	}
+
+	algorithm := cfg.JWTSigningAlgorithm
+	if algorithm == "" {
+		algorithm = jwt.SigningMethodEdDSA.Alg()
+	}
+
+	return &SigningKeyService{
+		BaseService: NewBaseService(db),
+		algorithm:   algorithm,
+		rotateEvery: time.Duration(cfg.JWTKeyRotationHours) * time.Hour,
+		grace:       time.Duration(cfg.JWTKeyGraceHours) * time.Hour,
+		sealKey:     sealKey,
+		verifiers:   make(map[string]*tokenKey),
+	}
+}
+
+//================================================================================
+// Key Lifecycle
+//================================================================================
+
+// EnsureSigningKey loads the keyring and creates a first key when there is none that
+// can sign, for example on first start or after the JWT secret was changed.
+func (s *SigningKeyService) EnsureSigningKey() error {
+	if err := s.Refresh(); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	signer := s.signer
+	s.mu.RUnlock()
+	if signer != nil && signer.method.Alg() == s.algorithm {
+		return nil
+	}
+
+	_, err := s.Rotate()
+	return err
+}
+
+// Rotate creates a new signing key and retires every other key. Retired keys keep
+// verifying tokens for the grace period.
+func (s *SigningKeyService) Rotate() (*models.SigningKey, error) {
+	return s.rotate(nil)
+}
+
+// RotateIfDue rotates when the signing key is older than the rotation interval. It is
+// a no-op when scheduled rotation is turned off.
+func (s *SigningKeyService) RotateIfDue() (bool, error) {
+	if s.rotateEvery <= 0 {
+		return false, nil
+	}
+
+	s.mu.RLock()
+	signer := s.signer
+	s.mu.RUnlock()
+	if signer == nil || time.Since(signer.createdAt) < s.rotateEvery {
+		return false, nil
+	}
+
+	key, err := s.rotate(signer)
+	if err != nil {
+		return false, err
+	}
+	return key != nil, nil
+}
+
+// rotate retires current, or every unretired key when current is nil, and creates a new
+// signing key. Scheduled rotations pass the key they found due so that when several
+// instances notice at once only the first rotates; the others return a nil key.
+func (s *SigningKeyService) rotate(current *tokenKey) (*models.SigningKey, error) {
+	key, err := s.generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(s.grace)
+	retire := map[string]interface{}{
+		"retired_at":            now,
+		"expires_at":            expiresAt,
+		"encrypted_private_key": "",
+	}
+
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&models.SigningKey{}).Where("retired_at IS NULL")
+		if current != nil {
+			query = query.Where("kid = ?", current.kid)
+		}
+		result := query.Updates(retire)
+		if result.Error != nil {
+			return result.Error
+		}
+		if current != nil && result.RowsAffected == 0 {
+			key = nil
+			return nil
+		}
+		return tx.Create(key).Error
+	})
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to rotate signing key")
+	}
+
+	if err := s.Refresh(); err != nil {
+		return nil, err
+	}
+	if key != nil {
+		log.Printf("Rotated token signing key, now signing with %s key %s", key.Algorithm, key.KID)
+	}
+	return key, nil
+}
+
+// ListKeys returns every signing key, newest first, including expired ones.
+func (s *SigningKeyService) ListKeys() ([]*models.SigningKey, error) {
+	var keys []*models.SigningKey
+	if err := s.db.GetDB().Order("created_at DESC, id DESC").Find(&keys).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list signing keys")
+	}
+	return keys, nil
+}
+
+// StartRotationWorker reloads the keyring every minute and rotates the signing key
+// once it reaches the rotation interval, until ctx is cancelled.
+func (s *SigningKeyService) StartRotationWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(signingKeyRefreshEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.Refresh(); err != nil {
+					log.Printf("Warning: Failed to reload signing keys: %v", err)
+					continue
+				}
+				if _, err := s.RotateIfDue(); err != nil {
+					log.Printf("Warning: Scheduled signing key rotation failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Keyring
+//================================================================================
+
+// Refresh reloads the keyring from the database.
+func (s *SigningKeyService) Refresh() error {
+	now := time.Now()
+	var keys []models.SigningKey
+	err := s.db.GetDB().
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Order("created_at DESC, id DESC").
+		Find(&keys).Error
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load signing keys")
+	}
+
+	var signer *tokenKey
+	verifiers := make(map[string]*tokenKey, len(keys))
+	for i := range keys {
+		key, err := s.loadKey(&keys[i])
+		if err != nil {
+			log.Printf("Warning: Skipping signing key %s: %v", keys[i].KID, err)
+			continue
+		}
+		verifiers[key.kid] = key
+		if signer == nil && key.private != nil {
+			signer = key
+		}
+	}
+
+	s.mu.Lock()
+	s.signer = signer
+	s.verifiers = verifiers
+	s.refreshedAt = now
+	s.mu.Unlock()
+	return nil
+}
+
+// signingKey returns the key new tokens are signed with.
+func (s *SigningKeyService) signingKey() (*tokenKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.signer == nil {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, "no token signing key is available")
+	}
+	return s.signer, nil
+}
+
+// verificationKey returns the unexpired key with the given kid. An unknown kid reloads
+// the keyring, at most every few seconds, in case another instance just rotated.
+func (s *SigningKeyService) verificationKey(kid string) (*tokenKey, bool) {
+	s.mu.RLock()
+	key, ok := s.verifiers[kid]
+	stale := time.Since(s.refreshedAt) > minSigningKeyRefresh
+	s.mu.RUnlock()
+
+	if !ok && stale {
+		if err := s.Refresh(); err != nil {
+			log.Printf("Warning: Failed to reload signing keys: %v", err)
+			return nil, false
+		}
+		s.mu.RLock()
+		key, ok = s.verifiers[kid]
+		s.mu.RUnlock()
+	}
+	if !ok || (key.expiresAt != nil && !time.Now().Before(*key.expiresAt)) {
+		return nil, false
+	}
+	return key, true
+}
+
+// JWKS returns the public keys that currently verify tokens, newest first.
+func (s *SigningKeyService) JWKS() JSONWebKeySet {
+	s.mu.RLock()
+	keys := make([]*tokenKey, 0, len(s.verifiers))
+	for _, key := range s.verifiers {
+		if key.expiresAt == nil || time.Now().Before(*key.expiresAt) {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.RUnlock()
+
+	// Newest first, with the kid breaking ties so the document is stable
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].createdAt.Equal(keys[j].createdAt) {
+			return keys[i].createdAt.After(keys[j].createdAt)
+		}
+		return keys[i].kid < keys[j].kid
+	})
+
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(keys))}
+	for _, key := range keys {
+		jwk := publicJWK(key.public)
+		jwk.Kid = key.kid
+		jwk.Alg = key.method.Alg()
+		jwk.Use = "sig"
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// generateKey creates a new key pair for the configured algorithm. The kid is the
+// RFC 7638 thumbprint of the public key.
+func (s *SigningKeyService) generateKey() (*models.SigningKey, error) {
+	var public crypto.PublicKey
+	var private crypto.Signer
+	switch s.algorithm {
+	case jwt.SigningMethodEdDSA.Alg():
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate signing key")
+		}
+		public, private = pub, priv
+	case jwt.SigningMethodRS256.Alg():
+		priv, err := rsa.GenerateKey(rand.Reader, rsaSigningKeyBits)
+		if err != nil {
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate signing key")
+		}
+		public, private = &priv.PublicKey, priv
+	default:
+		return nil, apperrors.New(apperrors.ErrCodeInternal, fmt.Sprintf("unsupported signing algorithm %q", s.algorithm))
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encode public key")
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to encode private key")
+	}
+	sealed, err := s.sealPrivateKey(privateDER)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.SigningKey{
+		KID:                 jwkThumbprint(public),
+		Algorithm:           s.algorithm,
+		PublicKey:           string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+		EncryptedPrivateKey: sealed,
+	}, nil
+}
+
+// loadKey decodes a stored key. The private key is only opened for unretired keys.
+func (s *SigningKeyService) loadKey(stored *models.SigningKey) (*tokenKey, error) {
+	method := jwt.GetSigningMethod(stored.Algorithm)
+	if method == nil || (method.Alg() != jwt.SigningMethodEdDSA.Alg() && method.Alg() != jwt.SigningMethodRS256.Alg()) {
+		return nil, fmt.Errorf("unsupported algorithm %q", stored.Algorithm)
+	}
+
+	block, _ := pem.Decode([]byte(stored.PublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	switch public.(type) {
+	case ed25519.PublicKey:
+		if method.Alg() != jwt.SigningMethodEdDSA.Alg() {
+			return nil, fmt.Errorf("Ed25519 key stored for %s", method.Alg())
+		}
+	case *rsa.PublicKey:
+		if method.Alg() != jwt.SigningMethodRS256.Alg() {
+			return nil, fmt.Errorf("RSA key stored for %s", method.Alg())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+
+	key := &tokenKey{
+		kid:       stored.KID,
+		method:    method,
+		public:    public,
+		createdAt: stored.CreatedAt,
+		expiresAt: stored.ExpiresAt,
+	}
+	if stored.RetiredAt == nil && stored.EncryptedPrivateKey != "" {
+		// A key that cannot be opened, typically because JWT_SECRET changed, still
+		// verifies; EnsureSigningKey then rotates to a new one
+		if private, err := s.openPrivateKey(stored.EncryptedPrivateKey); err != nil {
+			log.Printf("Warning: Signing key %s cannot sign: %v", stored.KID, err)
+		} else {
+			key.private = private
+		}
+	}
+	return key, nil
+}
+
+func (s *SigningKeyService) sealPrivateKey(der []byte) (string, error) {
+	gcm, err := s.privateKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate nonce")
+	}
+	sealed := gcm.Seal(nonce, nonce, der, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *SigningKeyService) openPrivateKey(encrypted string) (crypto.Signer, error) {
+	gcm, err := s.privateKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, "stored private key is malformed")
+	}
+	der, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to decrypt private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "stored private key is malformed")
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, "stored private key cannot sign")
+	}
+	return signer, nil
+}
+
+func (s *SigningKeyService) privateKeyCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.sealKey)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create GCM")
+	}
+	return gcm, nil
+}
+
+// publicJWK returns the key type specific members of a public key's JWK.
+func publicJWK(public crypto.PublicKey) JSONWebKey {
+	switch key := public.(type) {
+	case ed25519.PublicKey:
+		return JSONWebKey{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(key)}
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	}
+	return JSONWebKey{}
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint: the SHA-256 of the required JWK
+// members in lexicographic order without whitespace.
+func jwkThumbprint(public crypto.PublicKey) string {
+	jwk := publicJWK(public)
+	var canonical string
+	switch jwk.Kty {
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, jwk.Crv, jwk.Kty, jwk.X)
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, jwk.E, jwk.Kty, jwk.N)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
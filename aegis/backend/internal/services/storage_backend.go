@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// Supported storage backend names for config.Config.StorageBackend.
+const (
+	StorageBackendMinIO  = "minio"
+	StorageBackendLocal  = "local"
+	StorageBackendMemory = "memory"
+)
+
+// ObjectInfo describes an object held by a StorageBackend.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+}
+
+// StorageBackend is the contract every object store used by FileStorageService must satisfy.
+// Implementations must return an ErrCodeNotFound application error from Get and Stat when
+// the object does not exist. Readers returned by Get should also implement io.Seeker where
+// the store allows it, so that downloads can serve HTTP Range requests without buffering.
+type StorageBackend interface {
+	Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// NewStorageBackend creates the storage backend selected by cfg.StorageBackend.
+func NewStorageBackend(ctx context.Context, cfg *config.Config) (StorageBackend, error) {
+	switch cfg.StorageBackend {
+	case "", StorageBackendMinIO:
+		return NewMinIOStorageBackendFromConfig(ctx, cfg)
+	case StorageBackendLocal:
+		return NewLocalStorageBackend(cfg.StorageLocalPath)
+	case StorageBackendMemory:
+		return NewMemoryStorageBackend(), nil
+	default:
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("unsupported storage backend: %s", cfg.StorageBackend))
+	}
+}
+
+// objectNotFound returns the error StorageBackend implementations use for missing objects.
+func objectNotFound(key string) error {
+	return apperrors.New(apperrors.ErrCodeNotFound, fmt.Sprintf("object not found: %s", key))
+}
+
+// IsObjectNotFound reports whether err is the not-found error returned by a StorageBackend.
+func IsObjectNotFound(err error) bool {
+	var appErr *apperrors.Error
+	return errors.As(err, &appErr) && appErr.Code == apperrors.ErrCodeNotFound
+}
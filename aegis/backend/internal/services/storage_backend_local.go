@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// LocalStorageBackend stores objects as plain files below a root directory.
+type LocalStorageBackend struct {
+	rootDir string
+}
+
+// NewLocalStorageBackend creates a LocalStorageBackend rooted at rootDir, creating the directory if needed.
+func NewLocalStorageBackend(rootDir string) (*LocalStorageBackend, error) {
+	if rootDir == "" {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "local storage backend requires STORAGE_LOCAL_PATH")
+	}
+
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to resolve storage path")
+	}
+	if err := os.MkdirAll(absRoot, 0o750); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create storage directory")
+	}
+
+	return &LocalStorageBackend{rootDir: absRoot}, nil
+}
+
+// Put writes an object to a temporary file and renames it into place so readers never see partial data.
+func (b *LocalStorageBackend) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create object directory")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create temporary object")
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	written, err := io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to write object")
+	}
+	if size >= 0 && written != size {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("object size mismatch: expected %d bytes, got %d", size, written))
+	}
+
+	if err := os.Rename(tmpName, path); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to store object")
+	}
+	return nil
+}
+
+// Get opens an object for reading.
+func (b *LocalStorageBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, objectNotFound(key)
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to open object")
+	}
+	return file, nil
+}
+
+// Stat returns metadata for an object.
+func (b *LocalStorageBackend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, objectNotFound(key)
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to stat object")
+	}
+	if info.IsDir() {
+		return nil, objectNotFound(key)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// Delete removes an object. Removing a missing object is not an error.
+func (b *LocalStorageBackend) Delete(ctx context.Context, key string) error {
+	path, err := b.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to delete object")
+	}
+	return nil
+}
+
+// List returns every object whose key starts with prefix.
+func (b *LocalStorageBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(b.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.rootDir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list objects")
+	}
+	return objects, nil
+}
+
+// objectPath maps an object key to a path below rootDir, rejecting keys that would escape it.
+func (b *LocalStorageBackend) objectPath(key string) (string, error) {
+	if key == "" {
+		return "", apperrors.New(apperrors.ErrCodeInvalidArgument, "object key must not be empty")
+	}
+	path := filepath.Join(b.rootDir, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, b.rootDir+string(filepath.Separator)) {
+		return "", apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("invalid object key: %s", key))
+	}
+	return path, nil
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// MemoryStorageBackend keeps objects in process memory. It is intended for tests
+// and throwaway single-node deployments.
+type MemoryStorageBackend struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data         []byte
+	contentType  string
+	etag         string
+	lastModified time.Time
+}
+
+// NewMemoryStorageBackend creates an empty MemoryStorageBackend.
+func NewMemoryStorageBackend() *MemoryStorageBackend {
+	return &MemoryStorageBackend{
+		objects: make(map[string]*memoryObject),
+	}
+}
+
+// Put stores a copy of the reader's contents under key.
+func (b *MemoryStorageBackend) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to read object data")
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("object size mismatch: expected %d bytes, got %d", size, len(data)))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = &memoryObject{
+		data:         data,
+		contentType:  contentType,
+		etag:         fmt.Sprintf("%x", md5.Sum(data)),
+		lastModified: time.Now(),
+	}
+	return nil
+}
+
+// Get returns a seekable reader over the stored object.
+func (b *MemoryStorageBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, objectNotFound(key)
+	}
+	return memoryObjectReader{bytes.NewReader(obj.data)}, nil
+}
+
+// Stat returns metadata for an object.
+func (b *MemoryStorageBackend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.objects[key]
+	if !ok {
+		return nil, objectNotFound(key)
+	}
+	info := obj.info(key)
+	return &info, nil
+}
+
+// Delete removes an object. Removing a missing object is not an error.
+func (b *MemoryStorageBackend) Delete(ctx context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+// List returns every object whose key starts with prefix, sorted by key.
+func (b *MemoryStorageBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var objects []ObjectInfo
+	for key, obj := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, obj.info(key))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// memoryObjectReader adds a no-op Close to bytes.Reader while keeping it seekable.
+type memoryObjectReader struct {
+	*bytes.Reader
+}
+
+func (memoryObjectReader) Close() error {
+	return nil
+}
+
+func (o *memoryObject) info(key string) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		ContentType:  o.contentType,
+		ETag:         o.etag,
+		LastModified: o.lastModified,
+	}
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"io"
+	"log"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+)
+
+// MinIOStorageBackend stores objects in a MinIO or S3-compatible bucket.
+type MinIOStorageBackend struct {
+	client     *minio.Client
+	bucketName string
+}
+
+// NewMinIOStorageBackend wraps an existing MinIO client and bucket.
+func NewMinIOStorageBackend(client *minio.Client, bucketName string) *MinIOStorageBackend {
+	return &MinIOStorageBackend{
+		client:     client,
+		bucketName: bucketName,
+	}
+}
+
+// NewMinIOStorageBackendFromConfig connects to MinIO using cfg and makes sure the bucket exists.
+func NewMinIOStorageBackendFromConfig(ctx context.Context, cfg *config.Config) (*MinIOStorageBackend, error) {
+	if cfg.MinIOEndpoint == "" || cfg.MinIOAccessKey == "" || cfg.MinIOSecretKey == "" || cfg.MinIOBucket == "" {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "minio storage backend requires MINIO_ENDPOINT, MINIO_ACCESS_KEY, MINIO_SECRET_KEY and MINIO_BUCKET")
+	}
+
+	log.Printf("DEBUG: Initializing MinIO client with endpoint: %s, bucket: %s", cfg.MinIOEndpoint, cfg.MinIOBucket)
+	client, err := minio.New(cfg.MinIOEndpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.MinIOAccessKey, cfg.MinIOSecretKey, ""),
+		Secure: false, // Use HTTP for local development
+	})
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to initialize MinIO client")
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.MinIOBucket)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to check if bucket exists")
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.MinIOBucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create bucket")
+		}
+		log.Printf("Created MinIO bucket: %s", cfg.MinIOBucket)
+	} else {
+		log.Printf("MinIO bucket %s already exists", cfg.MinIOBucket)
+	}
+
+	return NewMinIOStorageBackend(client, cfg.MinIOBucket), nil
+}
+
+// Put uploads an object to the bucket.
+func (b *MinIOStorageBackend) Put(ctx context.Context, key string, reader io.Reader, size int64, contentType string) error {
+	_, err := b.client.PutObject(ctx, b.bucketName, key, reader, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	return err
+}
+
+// Get opens an object for reading. The object is stat'ed first so that a missing
+// key is reported here rather than on the first Read.
+func (b *MinIOStorageBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := b.client.GetObject(ctx, b.bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, b.translateError(err, key)
+	}
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, b.translateError(err, key)
+	}
+	return object, nil
+}
+
+// Stat returns metadata for an object.
+func (b *MinIOStorageBackend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := b.client.StatObject(ctx, b.bucketName, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, b.translateError(err, key)
+	}
+	return &ObjectInfo{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		ETag:         info.ETag,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+// Delete removes an object. Removing a missing object is not an error.
+func (b *MinIOStorageBackend) Delete(ctx context.Context, key string) error {
+	return b.client.RemoveObject(ctx, b.bucketName, key, minio.RemoveObjectOptions{})
+}
+
+// List returns every object whose key starts with prefix.
+func (b *MinIOStorageBackend) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	for info := range b.client.ListObjects(ctx, b.bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, apperrors.Wrap(info.Err, apperrors.ErrCodeInternal, "failed to list objects")
+		}
+		objects = append(objects, ObjectInfo{
+			Key:          info.Key,
+			Size:         info.Size,
+			ContentType:  info.ContentType,
+			ETag:         info.ETag,
+			LastModified: info.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+func (b *MinIOStorageBackend) translateError(err error, key string) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return objectNotFound(key)
+	}
+	return err
+}
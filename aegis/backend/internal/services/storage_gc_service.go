@@ -0,0 +1,308 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	defaultStorageGCGracePeriod = 24 * time.Hour
+	storageGCBatchSize          = 500
+)
+
+// StorageGCService reconciles the object store against the files table. It removes
+// objects no File references (left behind by failed uploads or aborted transactions),
+// deletes File rows that no UserFile or file version references any more, repairs
+// drifted reference counts and reports File rows whose object is missing.
+type StorageGCService struct {
+	*BaseService
+	fileStorageService *FileStorageService
+	gracePeriod        time.Duration
+
+	mu         sync.Mutex
+	lastReport *StorageGCReport
+}
+
+// StorageGCReport describes one garbage collection run. In dry-run mode it lists what
+// would be removed without touching the database or the object store.
+type StorageGCReport struct {
+	DryRun              bool
+	StartedAt           time.Time
+	CompletedAt         time.Time
+	ObjectsScanned      int
+	FilesScanned        int
+	OrphanObjects       []ObjectInfo
+	OrphanBytes         int64
+	MissingObjects      []StorageGCMissingObject
+	UnreferencedFileIDs []uint
+	RepairedRefCounts   int
+	DeletedObjects      int
+	DeletedFiles        int
+	Errors              []string
+}
+
+// StorageGCMissingObject is a File row whose object is not in the object store.
+type StorageGCMissingObject struct {
+	FileID      uint
+	StoragePath string
+}
+
+// NewStorageGCService creates a new StorageGCService. Objects younger than the grace
+// period are never collected, so in-flight uploads are not mistaken for orphans.
+func NewStorageGCService(cfg *config.Config, db *database.DB, fileStorageService *FileStorageService) *StorageGCService {
+	gracePeriod := defaultStorageGCGracePeriod
+	if cfg.StorageGCGraceHours > 0 {
+		gracePeriod = time.Duration(cfg.StorageGCGraceHours) * time.Hour
+	}
+
+	return &StorageGCService{
+		BaseService:        NewBaseService(db),
+		fileStorageService: fileStorageService,
+		gracePeriod:        gracePeriod,
+	}
+}
+
+//================================================================================
+// Garbage Collection
+//================================================================================
+
+// Run performs one reconciliation pass. With dryRun set nothing is modified and the
+// report describes what a real run would do.
+func (s *StorageGCService) Run(ctx context.Context, dryRun bool) (*StorageGCReport, error) {
+	report := &StorageGCReport{
+		DryRun:              dryRun,
+		StartedAt:           time.Now(),
+		OrphanObjects:       []ObjectInfo{},
+		MissingObjects:      []StorageGCMissingObject{},
+		UnreferencedFileIDs: []uint{},
+		Errors:              []string{},
+	}
+
+	// List the bucket first: anything uploaded after this point is simply not examined
+	objects, err := s.fileStorageService.ListFiles(ctx, "")
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list stored objects")
+	}
+	report.ObjectsScanned = len(objects)
+
+	stored := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		stored[object.Key] = true
+	}
+
+	referencedPaths, err := s.reconcileFiles(report, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	activeUploads, err := s.activeUploadTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := report.StartedAt.Add(-s.gracePeriod)
+	for _, object := range objects {
+		if referencedPaths[object.Key] > 0 || isActiveUploadChunk(object.Key, activeUploads) {
+			continue
+		}
+		if object.LastModified.After(cutoff) {
+			continue
+		}
+
+		report.OrphanObjects = append(report.OrphanObjects, object)
+		report.OrphanBytes += object.Size
+		if dryRun {
+			continue
+		}
+		if err := s.fileStorageService.DeleteFile(ctx, object.Key); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to delete orphan object %s: %v", object.Key, err))
+			continue
+		}
+		report.DeletedObjects++
+	}
+
+	report.CompletedAt = time.Now()
+
+	s.mu.Lock()
+	s.lastReport = report
+	s.mu.Unlock()
+
+	return report, nil
+}
+
+// LastReport returns the report of the most recent run, or nil if none has completed.
+func (s *StorageGCService) LastReport() *StorageGCReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastReport
+}
+
+// StartWorker runs the collector every interval until ctx is cancelled. A non-positive
+// interval disables the background worker; Run can still be triggered by an admin.
+func (s *StorageGCService) StartWorker(ctx context.Context, interval time.Duration, dryRun bool) {
+	if interval <= 0 {
+		log.Printf("Storage garbage collection worker disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := s.Run(ctx, dryRun)
+				if err != nil {
+					log.Printf("Warning: Storage garbage collection failed: %v", err)
+					continue
+				}
+				log.Printf("Storage garbage collection (dry run: %t): %d orphan objects (%d bytes), %d deleted, %d unreferenced files, %d missing objects, %d errors",
+					report.DryRun, len(report.OrphanObjects), report.OrphanBytes, report.DeletedObjects,
+					len(report.UnreferencedFileIDs), len(report.MissingObjects), len(report.Errors))
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// reconcileFiles walks the files table in batches, comparing each row against the
+// object listing and its actual UserFile and file version references. It returns how
+// many File rows still point at each storage path once unreferenced rows are handled.
+func (s *StorageGCService) reconcileFiles(report *StorageGCReport, stored map[string]bool) (map[string]int, error) {
+	db := s.db.GetDB()
+	referencedPaths := make(map[string]int)
+
+	var files []models.File
+	result := db.Unscoped().Model(&models.File{}).FindInBatches(&files, storageGCBatchSize, func(batch *gorm.DB, _ int) error {
+		fileIDs := make([]uint, len(files))
+		for i, file := range files {
+			fileIDs[i] = file.ID
+		}
+
+		// Both UserFiles (trashed ones included) and archived versions hold references
+		references := make(map[uint]int64, len(files))
+		for _, model := range []interface{}{&models.UserFile{}, &models.FileVersion{}} {
+			var counts []struct {
+				FileID uint
+				Count  int64
+			}
+			if err := db.Unscoped().Model(model).
+				Select("file_id, COUNT(*) AS count").
+				Where("file_id IN ?", fileIDs).
+				Group("file_id").
+				Scan(&counts).Error; err != nil {
+				return err
+			}
+			for _, count := range counts {
+				references[count.FileID] += count.Count
+			}
+		}
+
+		for _, file := range files {
+			report.FilesScanned++
+			actual := references[file.ID]
+
+			if actual == 0 {
+				report.UnreferencedFileIDs = append(report.UnreferencedFileIDs, file.ID)
+				if report.DryRun {
+					continue
+				}
+				deleted, err := s.deleteUnreferencedFile(file.ID)
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("failed to delete unreferenced file %d: %v", file.ID, err))
+				} else if deleted {
+					report.DeletedFiles++
+					continue
+				}
+			}
+
+			referencedPaths[file.StoragePath]++
+			// Rows created after the listing was taken may legitimately be absent from it
+			if !stored[file.StoragePath] && file.CreatedAt.Before(report.StartedAt) {
+				report.MissingObjects = append(report.MissingObjects, StorageGCMissingObject{FileID: file.ID, StoragePath: file.StoragePath})
+			}
+
+			if actual > 0 && file.RefCount != actual {
+				if report.DryRun {
+					report.RepairedRefCounts++
+					continue
+				}
+				// Only repair if nobody changed the counter since it was read
+				repair := db.Unscoped().Model(&models.File{}).
+					Where("id = ? AND ref_count = ?", file.ID, file.RefCount).
+					UpdateColumn("ref_count", actual)
+				if repair.Error != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("failed to repair reference count of file %d: %v", file.ID, repair.Error))
+				} else if repair.RowsAffected > 0 {
+					report.RepairedRefCounts++
+				}
+			}
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return nil, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to reconcile file records")
+	}
+
+	return referencedPaths, nil
+}
+
+// deleteUnreferencedFile removes a File row only if it still has no UserFile or archived
+// version. The check and the delete are a single statement, so an upload linking to the
+// row concurrently either wins (and the row survives) or finds it gone and retries.
+func (s *StorageGCService) deleteUnreferencedFile(fileID uint) (bool, error) {
+	result := s.db.GetDB().Exec(
+		"DELETE FROM files WHERE id = ? AND NOT EXISTS (SELECT 1 FROM user_files WHERE user_files.file_id = files.id) "+
+			"AND NOT EXISTS (SELECT 1 FROM file_versions WHERE file_versions.file_id = files.id)",
+		fileID,
+	)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (s *StorageGCService) activeUploadTokens() (map[string]bool, error) {
+	var tokens []string
+	if err := s.db.GetDB().Model(&models.UploadSession{}).
+		Where("status = ?", models.UploadSessionStatusActive).
+		Pluck("session_token", &tokens).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to query active upload sessions")
+	}
+
+	active := make(map[string]bool, len(tokens))
+	for _, token := range tokens {
+		active[token] = true
+	}
+	return active, nil
+}
+
+// isActiveUploadChunk reports whether key is a chunk of an upload session that is
+// still accepting data. Chunks of finished or expired sessions are fair game.
+func isActiveUploadChunk(key string, activeUploads map[string]bool) bool {
+	rest, ok := strings.CutPrefix(key, uploadChunkPrefix+"/")
+	if !ok {
+		return false
+	}
+	token, _, _ := strings.Cut(rest, "/")
+	return activeUploads[token]
+}
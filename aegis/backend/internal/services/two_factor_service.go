@@ -0,0 +1,487 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	totpIssuer = "Aegis"
+
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+
+	// maxTwoFactorAttempts wrong codes invalidate every outstanding login challenge, so
+	// guessing further requires the password again
+	maxTwoFactorAttempts = 5
+)
+
+// TwoFactorEnrollment is returned when a user starts setting up TOTP.
+type TwoFactorEnrollment struct {
+	Secret          string
+	ProvisioningURI string
+}
+
+// TwoFactorService manages optional TOTP two-factor authentication: enrollment,
+// single-use recovery codes and the second step of login. TOTP secrets are stored
+// sealed with a key derived from the JWT secret.
+type TwoFactorService struct {
+	*BaseService
+	authService *AuthService
+	secretKey   []byte
+}
+
+// NewTwoFactorService creates a new TwoFactorService.
+func NewTwoFactorService(cfg *config.Config, db *database.DB, authService *AuthService) *TwoFactorService {
+	secretKey, err := hkdf.Key(sha256.New, []byte(cfg.JWTSecret), nil, "aegis totp secret", 32)
+	if err != nil {
+		// Only possible for an invalid key length
+		panic(err)
+	}
+
+	return &TwoFactorService{
+		BaseService: NewBaseService(db),
+		authService: authService,
+		secretKey:   secretKey,
+	}
+}
+
+//================================================================================
+// Enrollment
+//================================================================================
+
+// BeginEnrollment creates a new TOTP secret for the user. Two-factor authentication
+// is only enabled once ConfirmEnrollment has seen a valid code for it.
+func (s *TwoFactorService) BeginEnrollment(userID uint) (*TwoFactorEnrollment, error) {
+	var user models.User
+	if err := s.db.GetDB().First(&user, userID).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeNotFound, "user not found")
+	}
+	if user.TwoFactorEnabled {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "two-factor authentication is already enabled")
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	encryptedSecret, err := s.sealSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		// Replace any enrollment that was started but never confirmed
+		if err := tx.Where("user_id = ?", userID).Delete(&models.UserTwoFactor{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.UserTwoFactor{UserID: userID, EncryptedSecret: encryptedSecret}).Error
+	})
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to start two-factor enrollment")
+	}
+
+	return &TwoFactorEnrollment{
+		Secret:          secret,
+		ProvisioningURI: TOTPProvisioningURI(totpIssuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmEnrollment enables two-factor authentication once the user proves their
+// authenticator produces valid codes, and returns a fresh set of recovery codes.
+func (s *TwoFactorService) ConfirmEnrollment(userID uint, code string) ([]string, error) {
+	record, err := s.findRecord(userID)
+	if err != nil {
+		return nil, err
+	}
+	if record.EnabledAt != nil {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "two-factor authentication is already enabled")
+	}
+
+	step, ok, err := s.matchTOTP(record, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "invalid verification code")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(record).Updates(map[string]interface{}{
+			"enabled_at":     now,
+			"last_used_step": step,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("two_factor_enabled", true).Error; err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(tx, userID, hashes)
+	})
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to enable two-factor authentication")
+	}
+
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes. A current TOTP or
+// recovery code is required.
+func (s *TwoFactorService) RegenerateRecoveryCodes(userID uint, code string) ([]string, error) {
+	if err := s.verifyEnabled(userID, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, hashes)
+	})
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to regenerate recovery codes")
+	}
+	return codes, nil
+}
+
+// Disable turns two-factor authentication off. A current TOTP or recovery code is
+// required.
+func (s *TwoFactorService) Disable(userID uint, code string) error {
+	if err := s.verifyEnabled(userID, code); err != nil {
+		return err
+	}
+	return s.Reset(userID)
+}
+
+// Reset removes a user's two-factor configuration without a code, e.g. when an
+// administrator helps a user who lost their authenticator and recovery codes.
+func (s *TwoFactorService) Reset(userID uint) error {
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.User{}).Where("id = ?", userID).Update("two_factor_enabled", false)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&models.UserTwoFactor{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.TwoFactorRecoveryCode{}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apperrors.New(apperrors.ErrCodeNotFound, "user not found")
+	}
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to reset two-factor authentication")
+	}
+	return nil
+}
+
+//================================================================================
+// Login
+//================================================================================
+
+// IssueChallenge returns the challenge token a user with two-factor authentication
+// exchanges, together with a code, in CompleteLogin.
+func (s *TwoFactorService) IssueChallenge(user *models.User) (string, error) {
+	challenge, err := s.authService.GenerateTwoFactorChallenge(user)
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate login challenge")
+	}
+	return challenge, nil
+}
+
+// CompleteLogin checks the second factor of a two-step login and returns the user the
+// challenge was issued to. Codes may be TOTP codes or unused recovery codes.
+func (s *TwoFactorService) CompleteLogin(challengeToken, code string) (*models.User, error) {
+	claims, err := s.authService.ParseTwoFactorChallenge(challengeToken)
+	if err != nil {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired login challenge")
+	}
+
+	record, err := s.findRecord(claims.UserID)
+	if err != nil || record.EnabledAt == nil {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired login challenge")
+	}
+	// Challenges carry their issue time in whole seconds, so one issued in the second of
+	// the lockout is invalidated too
+	if record.ChallengesValidAfter != nil && (claims.IssuedAt == nil || !claims.IssuedAt.Time.After(record.ChallengesValidAfter.Truncate(time.Second))) {
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "too many invalid codes, please sign in again")
+	}
+
+	ok, err := s.verifyCode(record, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := s.recordFailure(record); err != nil {
+			return nil, err
+		}
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid verification code")
+	}
+
+	var user models.User
+	if err := s.db.GetDB().First(&user, claims.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid or expired login challenge")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return &user, nil
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+func (s *TwoFactorService) findRecord(userID uint) (*models.UserTwoFactor, error) {
+	var record models.UserTwoFactor
+	if err := s.db.GetDB().Where("user_id = ?", userID).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "two-factor enrollment not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return &record, nil
+}
+
+// verifyEnabled checks a code for a user who has two-factor authentication enabled.
+func (s *TwoFactorService) verifyEnabled(userID uint, code string) error {
+	record, err := s.findRecord(userID)
+	if err != nil {
+		return err
+	}
+	if record.EnabledAt == nil {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "two-factor authentication is not enabled")
+	}
+
+	ok, err := s.verifyCode(record, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return apperrors.New(apperrors.ErrCodeInvalidArgument, "invalid verification code")
+	}
+	return nil
+}
+
+// verifyCode accepts a TOTP code that was not used before, or consumes a recovery code.
+// A successful check resets the failed attempt counter.
+func (s *TwoFactorService) verifyCode(record *models.UserTwoFactor, code string) (bool, error) {
+	step, ok, err := s.matchTOTP(record, code)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		// Only advance the step if no concurrent request accepted the same code
+		result := s.db.GetDB().Model(&models.UserTwoFactor{}).
+			Where("id = ? AND last_used_step < ?", record.ID, step).
+			Updates(map[string]interface{}{"last_used_step": step, "failed_attempts": 0})
+		if result.Error != nil {
+			return false, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to record verification code")
+		}
+		return result.RowsAffected == 1, nil
+	}
+
+	return s.useRecoveryCode(record, code)
+}
+
+// matchTOTP checks a code against the record's secret, refusing codes from a time step
+// that was already used.
+func (s *TwoFactorService) matchTOTP(record *models.UserTwoFactor, code string) (int64, bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits {
+		return 0, false, nil
+	}
+
+	secret, err := s.openSecret(record.EncryptedSecret)
+	if err != nil {
+		return 0, false, err
+	}
+	step, ok := matchTOTPStep(secret, code, time.Now())
+	if !ok || step <= record.LastUsedStep {
+		return 0, false, nil
+	}
+	return step, true, nil
+}
+
+func (s *TwoFactorService) useRecoveryCode(record *models.UserTwoFactor, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLength {
+		return false, nil
+	}
+
+	var candidates []models.TwoFactorRecoveryCode
+	if err := s.db.GetDB().Where("user_id = ? AND used_at IS NULL", record.UserID).Find(&candidates).Error; err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	for _, candidate := range candidates {
+		if bcrypt.CompareHashAndPassword([]byte(candidate.CodeHash), []byte(code)) != nil {
+			continue
+		}
+
+		var used bool
+		err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&models.TwoFactorRecoveryCode{}).
+				Where("id = ? AND used_at IS NULL", candidate.ID).
+				Update("used_at", time.Now())
+			if result.Error != nil {
+				return result.Error
+			}
+			used = result.RowsAffected == 1
+			if !used {
+				return nil
+			}
+			return tx.Model(&models.UserTwoFactor{}).Where("id = ?", record.ID).Update("failed_attempts", 0).Error
+		})
+		if err != nil {
+			return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to use recovery code")
+		}
+		if used {
+			log.Printf("Recovery code used for user %d", record.UserID)
+		}
+		return used, nil
+	}
+	return false, nil
+}
+
+// recordFailure counts a wrong login code. Reaching maxTwoFactorAttempts invalidates
+// all login challenges issued so far. The count is checked in the same statement that
+// increments it, so concurrent wrong codes cannot slip past the limit.
+func (s *TwoFactorService) recordFailure(record *models.UserTwoFactor) error {
+	reached := fmt.Sprintf("failed_attempts + 1 >= %d", maxTwoFactorAttempts)
+	var updated models.UserTwoFactor
+	result := s.db.GetDB().Model(&updated).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "failed_attempts"}}}).
+		Where("id = ?", record.ID).
+		Updates(map[string]interface{}{
+			"failed_attempts":        gorm.Expr("CASE WHEN " + reached + " THEN 0 ELSE failed_attempts + 1 END"),
+			"challenges_valid_after": gorm.Expr("CASE WHEN "+reached+" THEN ? ELSE challenges_valid_after END", time.Now().Truncate(time.Second)),
+		})
+	if result.Error != nil {
+		return apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to record invalid code")
+	}
+	if result.RowsAffected > 0 && updated.FailedAttempts == 0 {
+		log.Printf("Warning: Too many invalid two-factor codes for user %d, invalidated login challenges", record.UserID)
+	}
+	return nil
+}
+
+func (s *TwoFactorService) sealSecret(secret string) (string, error) {
+	gcm, err := s.secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate nonce")
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *TwoFactorService) openSecret(encryptedSecret string) ([]byte, error) {
+	gcm, err := s.secretCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encryptedSecret)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, "stored TOTP secret is malformed")
+	}
+	secret, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to decrypt TOTP secret")
+	}
+	decoded, err := DecodeTOTPSecret(string(secret))
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "stored TOTP secret is malformed")
+	}
+	return decoded, nil
+}
+
+func (s *TwoFactorService) secretCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.secretKey)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create GCM")
+	}
+	return gcm, nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint, hashes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.TwoFactorRecoveryCode{}).Error; err != nil {
+		return err
+	}
+	codes := make([]models.TwoFactorRecoveryCode, len(hashes))
+	for i, hash := range hashes {
+		codes[i] = models.TwoFactorRecoveryCode{UserID: userID, CodeHash: hash}
+	}
+	return tx.Create(&codes).Error
+}
+
+// generateRecoveryCodes returns recovery codes formatted as xxxxx-xxxxx together with
+// their bcrypt hashes.
+func generateRecoveryCodes() ([]string, []string, error) {
+	// 32 unambiguous characters, so every random byte maps to one without bias
+	const alphabet = "abcdefghjkmnpqrstuvwxyz123456789"
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate recovery codes")
+		}
+		for j, b := range raw {
+			raw[j] = alphabet[b%32]
+		}
+
+		hash, err := bcrypt.GenerateFromPassword(raw, bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to hash recovery codes")
+		}
+		codes[i] = string(raw[:recoveryCodeLength/2]) + "-" + string(raw[recoveryCodeLength/2:])
+		hashes[i] = string(hash)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,470 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	defaultUploadSessionTTL   = 24 * time.Hour
+	defaultUploadMaxChunkSize = 64 << 20 // 64MB
+	defaultUploadCleanupEvery = 15 * time.Minute
+	uploadChunkPrefix         = "uploads"
+)
+
+var contentHashPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// UploadSessionService implements resumable (tus-style) chunked uploads. Chunks are
+// stored as individual objects and stitched together into a regular File/UserFile
+// when the session is finalized.
+type UploadSessionService struct {
+	*BaseService
+	fileService        *FileService
+	fileStorageService *FileStorageService
+	userService        *UserService
+	sessionTTL         time.Duration
+	maxChunkSize       int64
+}
+
+// NewUploadSessionService creates a new UploadSessionService.
+func NewUploadSessionService(cfg *config.Config, db *database.DB, fileService *FileService, fileStorageService *FileStorageService, userService *UserService) *UploadSessionService {
+	sessionTTL := defaultUploadSessionTTL
+	if cfg.UploadSessionTTLHours > 0 {
+		sessionTTL = time.Duration(cfg.UploadSessionTTLHours) * time.Hour
+	}
+	maxChunkSize := int64(defaultUploadMaxChunkSize)
+	if cfg.UploadMaxChunkBytes > 0 {
+		maxChunkSize = cfg.UploadMaxChunkBytes
+	}
+
+	return &UploadSessionService{
+		BaseService:        NewBaseService(db),
+		fileService:        fileService,
+		fileStorageService: fileStorageService,
+		userService:        userService,
+		sessionTTL:         sessionTTL,
+		maxChunkSize:       maxChunkSize,
+	}
+}
+
+// MaxChunkSize returns the largest chunk accepted by AppendChunk.
+func (s *UploadSessionService) MaxChunkSize() int64 {
+	return s.maxChunkSize
+}
+
+//================================================================================
+// Session Lifecycle
+//================================================================================
+
+// CreateSession opens a new upload session for a file of the declared size and content hash.
+func (s *UploadSessionService) CreateSession(userID uint, filename, mimeType, contentHash, encryptionKey string, totalSize int64, folderID *uint) (*models.UploadSession, error) {
+	if filename == "" {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "filename is required")
+	}
+	if totalSize <= 0 {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "upload size must be greater than zero")
+	}
+	if !contentHashPattern.MatchString(contentHash) {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "content hash must be a hex-encoded SHA-256 digest")
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	if folderID != nil {
+		var folder models.Folder
+		if err := s.ValidateOwnership(&folder, *folderID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.userService.CheckStorageQuota(userID, totalSize); err != nil {
+		return nil, err
+	}
+
+	token, err := s.generateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &models.UploadSession{
+		SessionToken:  token,
+		UserID:        userID,
+		FolderID:      folderID,
+		Filename:      filename,
+		MimeType:      mimeType,
+		ContentHash:   contentHash,
+		EncryptionKey: encryptionKey,
+		TotalSize:     totalSize,
+		Status:        models.UploadSessionStatusActive,
+		ExpiresAt:     time.Now().Add(s.sessionTTL),
+	}
+
+	if err := s.db.GetDB().Create(session).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create upload session")
+	}
+
+	return session, nil
+}
+
+// GetSession returns an upload session owned by userID.
+func (s *UploadSessionService) GetSession(userID uint, sessionToken string) (*models.UploadSession, error) {
+	var session models.UploadSession
+	if err := s.db.GetDB().Where("session_token = ? AND user_id = ?", sessionToken, userID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "upload session not found")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return &session, nil
+}
+
+// AppendChunk stores the next chunk of an upload. offset must equal the number of bytes
+// already received, otherwise a conflict is returned and the client should re-query
+// the offset before retrying.
+func (s *UploadSessionService) AppendChunk(ctx context.Context, userID uint, sessionToken string, offset int64, chunk io.Reader, chunkSize int64) (*models.UploadSession, error) {
+	session, err := s.getActiveSession(userID, sessionToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunkSize <= 0 {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "chunk must not be empty")
+	}
+	if chunkSize > s.maxChunkSize {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, fmt.Sprintf("chunk exceeds maximum size of %d bytes", s.maxChunkSize))
+	}
+	if offset != session.UploadOffset {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, fmt.Sprintf("upload offset mismatch: expected %d, got %d", session.UploadOffset, offset))
+	}
+	if offset+chunkSize > session.TotalSize {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "chunk exceeds declared upload size")
+	}
+
+	// Every append writes its own object, so a concurrent append at the same offset cannot
+	// overwrite the chunk that won
+	chunkKey, err := uploadChunkKey(session.SessionToken, offset)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate upload chunk key")
+	}
+	if err := s.fileStorageService.UploadFile(ctx, chunkKey, chunk, chunkSize, "application/octet-stream"); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeFileUpload, "failed to store upload chunk")
+	}
+
+	// Advance the offset only if no concurrent request got there first, recording the
+	// chunk as the one to assemble at this offset
+	result := s.db.GetDB().Model(&models.UploadSession{}).
+		Where("id = ? AND upload_offset = ? AND status = ?", session.ID, offset, models.UploadSessionStatusActive).
+		Updates(map[string]interface{}{
+			"upload_offset": offset + chunkSize,
+			"chunk_count":   gorm.Expr("chunk_count + 1"),
+			"chunk_keys":    gorm.Expr("chunk_keys || ?", chunkKey+"\n"),
+			"expires_at":    time.Now().Add(s.sessionTTL),
+		})
+	if result.Error != nil {
+		s.fileStorageService.DeleteFile(ctx, chunkKey)
+		return nil, apperrors.Wrap(result.Error, apperrors.ErrCodeInternal, "failed to update upload session")
+	}
+	if result.RowsAffected == 0 {
+		// The losing chunk must not be assembled with the winner's
+		if err := s.fileStorageService.DeleteFile(ctx, chunkKey); err != nil {
+			log.Printf("Warning: Failed to delete superseded upload chunk %s: %v", chunkKey, err)
+		}
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "upload session was modified concurrently")
+	}
+
+	return s.GetSession(userID, sessionToken)
+}
+
+// FinalizeSession assembles all received chunks into a File/UserFile using the regular
+// upload path, so content deduplication and quota checks apply exactly as for direct uploads.
+func (s *UploadSessionService) FinalizeSession(ctx context.Context, userID uint, sessionToken string) (*models.UserFile, error) {
+	session, err := s.getActiveSession(userID, sessionToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.UploadOffset != session.TotalSize {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, fmt.Sprintf("upload incomplete: received %d of %d bytes", session.UploadOffset, session.TotalSize))
+	}
+
+	if err := s.userService.CheckStorageQuota(userID, session.TotalSize); err != nil {
+		return nil, err
+	}
+
+	stored, err := s.fileStorageService.ListFiles(ctx, uploadChunkPrefixFor(session.SessionToken))
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to list upload chunks")
+	}
+	storedByKey := make(map[string]ObjectInfo, len(stored))
+	for _, chunk := range stored {
+		storedByKey[chunk.Key] = chunk
+	}
+
+	// Only the chunks recorded by successful appends are assembled; objects left by appends
+	// that lost a race or died before recording theirs are ignored and deleted below
+	var chunks []ObjectInfo
+	var received int64
+	for _, key := range strings.Fields(session.ChunkKeys) {
+		chunk, ok := storedByKey[key]
+		if !ok {
+			return nil, apperrors.New(apperrors.ErrCodeInternal, fmt.Sprintf("stored chunk %s is missing", key))
+		}
+		if offset, ok := uploadChunkOffset(session.SessionToken, key); !ok || offset != received {
+			return nil, apperrors.New(apperrors.ErrCodeInternal, fmt.Sprintf("stored chunk %s does not continue at offset %d", key, received))
+		}
+		chunks = append(chunks, chunk)
+		received += chunk.Size
+	}
+	if received != session.TotalSize {
+		return nil, apperrors.New(apperrors.ErrCodeInternal, fmt.Sprintf("stored chunks total %d bytes, expected %d", received, session.TotalSize))
+	}
+
+	// Claim the session before creating the file, so concurrent finalizes create it once
+	claim := s.db.GetDB().Model(&models.UploadSession{}).
+		Where("id = ? AND status = ?", session.ID, models.UploadSessionStatusActive).
+		Updates(map[string]interface{}{
+			"status":       models.UploadSessionStatusCompleted,
+			"completed_at": time.Now(),
+		})
+	if claim.Error != nil {
+		return nil, apperrors.Wrap(claim.Error, apperrors.ErrCodeInternal, "failed to finalize upload session")
+	}
+	if claim.RowsAffected == 0 {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "upload session is already being finalized")
+	}
+
+	reader := &chunkReader{ctx: ctx, storage: s.fileStorageService, chunks: chunks}
+	defer reader.Close()
+
+	userFile, err := s.fileService.UploadFile(
+		userID,
+		session.Filename,
+		session.MimeType,
+		session.ContentHash,
+		session.EncryptionKey,
+		reader,
+		session.TotalSize,
+		session.FolderID,
+	)
+	if err != nil {
+		// Release the claim so the client can retry
+		if releaseErr := s.db.GetDB().Model(&models.UploadSession{}).
+			Where("id = ? AND status = ? AND user_file_id IS NULL", session.ID, models.UploadSessionStatusCompleted).
+			Updates(map[string]interface{}{
+				"status":       models.UploadSessionStatusActive,
+				"completed_at": nil,
+			}).Error; releaseErr != nil {
+			log.Printf("Warning: Failed to reopen upload session %d: %v", session.ID, releaseErr)
+		}
+		return nil, err
+	}
+
+	if err := s.db.GetDB().Model(&models.UploadSession{}).Where("id = ?", session.ID).
+		Update("user_file_id", userFile.ID).Error; err != nil {
+		log.Printf("Warning: Failed to record the file of upload session %d: %v", session.ID, err)
+	}
+
+	s.deleteChunks(ctx, session.SessionToken)
+
+	return userFile, nil
+}
+
+// AbortSession cancels an active session and removes any chunks already stored.
+func (s *UploadSessionService) AbortSession(ctx context.Context, userID uint, sessionToken string) error {
+	session, err := s.getActiveSession(userID, sessionToken)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.GetDB().Model(session).Update("status", models.UploadSessionStatusAborted).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to abort upload session")
+	}
+
+	s.deleteChunks(ctx, session.SessionToken)
+	return nil
+}
+
+//================================================================================
+// Expiry and Cleanup
+//================================================================================
+
+// CleanupExpiredSessions marks active sessions past their expiry as expired and deletes
+// their partial objects. It returns the number of sessions cleaned up.
+func (s *UploadSessionService) CleanupExpiredSessions(ctx context.Context) (int, error) {
+	var sessions []models.UploadSession
+	if err := s.db.GetDB().
+		Where("status = ? AND expires_at < ?", models.UploadSessionStatusActive, time.Now()).
+		Find(&sessions).Error; err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to query expired upload sessions")
+	}
+
+	cleaned := 0
+	for _, session := range sessions {
+		result := s.db.GetDB().Model(&models.UploadSession{}).
+			Where("id = ? AND status = ?", session.ID, models.UploadSessionStatusActive).
+			Update("status", models.UploadSessionStatusExpired)
+		if result.Error != nil {
+			log.Printf("Warning: Failed to expire upload session %d: %v", session.ID, result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		s.deleteChunks(ctx, session.SessionToken)
+		cleaned++
+	}
+
+	return cleaned, nil
+}
+
+// StartCleanupWorker runs CleanupExpiredSessions every interval until ctx is cancelled.
+func (s *UploadSessionService) StartCleanupWorker(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultUploadCleanupEvery
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				cleaned, err := s.CleanupExpiredSessions(ctx)
+				if err != nil {
+					log.Printf("Warning: Upload session cleanup failed: %v", err)
+				} else if cleaned > 0 {
+					log.Printf("Cleaned up %d expired upload sessions", cleaned)
+				}
+			}
+		}
+	}()
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+func (s *UploadSessionService) getActiveSession(userID uint, sessionToken string) (*models.UploadSession, error) {
+	session, err := s.GetSession(userID, sessionToken)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != models.UploadSessionStatusActive {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, fmt.Sprintf("upload session is %s", session.Status))
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "upload session has expired")
+	}
+	return session, nil
+}
+
+func (s *UploadSessionService) deleteChunks(ctx context.Context, sessionToken string) {
+	chunks, err := s.fileStorageService.ListFiles(ctx, uploadChunkPrefixFor(sessionToken))
+	if err != nil {
+		log.Printf("Warning: Failed to list chunks for upload session %s: %v", sessionToken, err)
+		return
+	}
+	for _, chunk := range chunks {
+		if err := s.fileStorageService.DeleteFile(ctx, chunk.Key); err != nil {
+			log.Printf("Warning: Failed to delete upload chunk %s: %v", chunk.Key, err)
+		}
+	}
+}
+
+func (s *UploadSessionService) generateSessionToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate upload session token")
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
+
+func uploadChunkPrefixFor(sessionToken string) string {
+	return fmt.Sprintf("%s/%s/", uploadChunkPrefix, sessionToken)
+}
+
+// uploadChunkKey zero-pads the offset so that chunk keys sort in upload order, followed by
+// a random suffix that keeps concurrent appends at the same offset apart.
+func uploadChunkKey(sessionToken string, offset int64) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%020d-%s", uploadChunkPrefixFor(sessionToken), offset, hex.EncodeToString(suffix)), nil
+}
+
+// uploadChunkOffset parses the offset back out of a chunk key.
+func uploadChunkOffset(sessionToken, key string) (int64, bool) {
+	name := strings.TrimPrefix(key, uploadChunkPrefixFor(sessionToken))
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		name = name[:i]
+	}
+	offset, err := strconv.ParseInt(name, 10, 64)
+	return offset, err == nil
+}
+
+// chunkReader reads stored chunks back-to-back, opening each one only when needed.
+type chunkReader struct {
+	ctx     context.Context
+	storage *FileStorageService
+	chunks  []ObjectInfo
+	current io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := r.storage.DownloadFile(r.ctx, r.chunks[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			r.current = reader
+			r.chunks = r.chunks[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		err := r.current.Close()
+		r.current = nil
+		return err
+	}
+	return nil
+}
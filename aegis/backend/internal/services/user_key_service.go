@@ -0,0 +1,367 @@
+package services
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+)
+
+//================================================================================
+// Service Definition
+//================================================================================
+
+const (
+	maxWrappedPrivateKeyLength = 4096
+	maxWrappedFileKeyLength    = 1024
+	maxPublicKeyLookups        = 100
+)
+
+// FileKeyGrantInput is a file key wrapped on the client to one recipient's public key.
+type FileKeyGrantInput struct {
+	RecipientID    uint
+	KeyFingerprint string // Fingerprint of the public key the file key was wrapped to
+	WrappedKey     string
+}
+
+// UserKeyService manages the X25519 key pairs users register for end-to-end sharing,
+// and the file keys they wrap to one another's public keys. Private keys and file keys
+// are wrapped on the client, so a file shared this way never passes through the server
+// under a key the server can open.
+type UserKeyService struct {
+	*BaseService
+	requireGrants bool
+}
+
+// NewUserKeyService creates a new UserKeyService.
+func NewUserKeyService(cfg *config.Config, db *database.DB) *UserKeyService {
+	return &UserKeyService{
+		BaseService:   NewBaseService(db),
+		requireGrants: !cfg.AllowLegacyFileKeys,
+	}
+}
+
+// RequireGrants reports whether users a file is shared with can only obtain its key
+// through a key grant, rather than from the server-held copy.
+func (s *UserKeyService) RequireGrants() bool {
+	return s.requireGrants
+}
+
+//================================================================================
+// Key Pairs
+//================================================================================
+
+// RegisterKeyPair stores a user's public key and wrapped private key, replacing any
+// earlier pair. File and room keys wrapped to an earlier public key can no longer be
+// unwrapped by the user and are removed, so that they can be granted again.
+func (s *UserKeyService) RegisterKeyPair(userID uint, publicKey, wrappedPrivateKey string) (*models.UserKeyPair, error) {
+	fingerprint, err := publicKeyFingerprint(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if wrappedPrivateKey == "" || len(wrappedPrivateKey) > maxWrappedPrivateKeyLength {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "wrapped private key is missing or too long")
+	}
+
+	var keyPair models.UserKeyPair
+	err = s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", userID).First(&keyPair).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+		}
+
+		if keyPair.ID != 0 && keyPair.Fingerprint != fingerprint {
+			if err := tx.Where("recipient_id = ?", userID).Delete(&models.FileKeyGrant{}).Error; err != nil {
+				return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to remove file key grants")
+			}
+			if err := tx.Where("user_id = ?", userID).Delete(&models.RoomKey{}).Error; err != nil {
+				return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to remove room keys")
+			}
+		}
+
+		keyPair.UserID = userID
+		keyPair.PublicKey = publicKey
+		keyPair.Fingerprint = fingerprint
+		keyPair.WrappedPrivateKey = wrappedPrivateKey
+		if err := tx.Save(&keyPair).Error; err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to save key pair")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair, nil
+}
+
+// GetKeyPair returns the user's key pair, or nil if they have not registered one.
+func (s *UserKeyService) GetKeyPair(userID uint) (*models.UserKeyPair, error) {
+	var keyPair models.UserKeyPair
+	if err := s.db.GetDB().Where("user_id = ?", userID).First(&keyPair).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return &keyPair, nil
+}
+
+// GetPublicKeys returns the registered key pairs of the given users, with their users.
+// Users without a key pair are left out.
+func (s *UserKeyService) GetPublicKeys(userIDs []uint) ([]*models.UserKeyPair, error) {
+	if len(userIDs) > maxPublicKeyLookups {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "too many users requested")
+	}
+
+	var keyPairs []*models.UserKeyPair
+	if len(userIDs) == 0 {
+		return keyPairs, nil
+	}
+	if err := s.db.GetDB().Preload("User").Where("user_id IN ?", userIDs).Order("user_id").Find(&keyPairs).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load public keys")
+	}
+	return keyPairs, nil
+}
+
+//================================================================================
+// File Key Grants
+//================================================================================
+
+// GrantFileKeys stores file keys wrapped to the recipients' public keys. Without a room
+// the file's owner shares it with each recipient directly. With a room, any member can
+// grant the key of a file shared to the room to other members; such grants go when the
+// file leaves the room or the recipient leaves it. Each wrapped key must name the
+// fingerprint of the recipient's current public key.
+func (s *UserKeyService) GrantFileKeys(granterID, userFileID uint, roomID *uint, grants []FileKeyGrantInput) ([]*models.FileKeyGrant, error) {
+	if len(grants) == 0 {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "no grants given")
+	}
+
+	db := s.db.GetDB()
+
+	var userFile models.UserFile
+	if err := db.First(&userFile, userFileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	if roomID == nil {
+		if userFile.UserID != granterID {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
+		}
+	} else {
+		inRoom, err := s.isFileInRoom(db, userFileID, *roomID)
+		if err != nil {
+			return nil, err
+		}
+		isMember, err := s.isRoomMember(db, *roomID, granterID)
+		if err != nil {
+			return nil, err
+		}
+		if !inRoom || !isMember {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
+		}
+	}
+
+	var granted []*models.FileKeyGrant
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, input := range grants {
+			grant, err := s.grantFileKey(tx, &userFile, granterID, roomID, input)
+			if err != nil {
+				return err
+			}
+			granted = append(granted, grant)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return granted, nil
+}
+
+// RevokeFileKeyGrant removes a recipient's grant for a file. The file's owner and
+// whoever made the grant can revoke it, and recipients can give up their own.
+func (s *UserKeyService) RevokeFileKeyGrant(userID, userFileID, recipientID uint) error {
+	db := s.db.GetDB()
+
+	var grant models.FileKeyGrant
+	if err := db.Preload("UserFile").Where("user_file_id = ? AND recipient_id = ?", userFileID, recipientID).First(&grant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return apperrors.New(apperrors.ErrCodeNotFound, "file key grant not found")
+		}
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	if userID != grant.UserFile.UserID && userID != grant.GranterID && userID != grant.RecipientID {
+		return apperrors.New(apperrors.ErrCodeNotFound, "file key grant not found")
+	}
+
+	if err := db.Delete(&grant).Error; err != nil {
+		return apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to revoke file key grant")
+	}
+	return nil
+}
+
+// GetFileKeyGrants lists a file's grants with their recipients: all of them for the
+// file's owner, otherwise only the caller's own.
+func (s *UserKeyService) GetFileKeyGrants(userID, userFileID uint) ([]*models.FileKeyGrant, error) {
+	db := s.db.GetDB()
+
+	var userFile models.UserFile
+	if err := db.First(&userFile, userFileID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "not found or access denied")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	query := db.Preload("Recipient").Where("user_file_id = ?", userFileID)
+	if userFile.UserID != userID {
+		query = query.Where("recipient_id = ?", userID)
+	}
+
+	var grants []*models.FileKeyGrant
+	if err := query.Order("created_at").Find(&grants).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load file key grants")
+	}
+	return grants, nil
+}
+
+// GetFileKeyGrant returns the recipient's grant for a file, or nil if there is none.
+func (s *UserKeyService) GetFileKeyGrant(recipientID, userFileID uint) (*models.FileKeyGrant, error) {
+	var grant models.FileKeyGrant
+	if err := s.db.GetDB().Where("user_file_id = ? AND recipient_id = ?", userFileID, recipientID).First(&grant).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return &grant, nil
+}
+
+// GetReceivedFileKeyGrants lists the grants made to a user for files that are not in
+// the trash, with the files and who granted them.
+func (s *UserKeyService) GetReceivedFileKeyGrants(recipientID uint) ([]*models.FileKeyGrant, error) {
+	var grants []*models.FileKeyGrant
+	err := s.db.GetDB().
+		Preload("UserFile.User").Preload("UserFile.File").Preload("Granter").
+		Joins("INNER JOIN user_files ON user_files.id = file_key_grants.user_file_id AND user_files.deleted_at IS NULL").
+		Where("file_key_grants.recipient_id = ?", recipientID).
+		Order("file_key_grants.created_at DESC").
+		Find(&grants).Error
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to load file key grants")
+	}
+	return grants, nil
+}
+
+//================================================================================
+// Internal Helpers
+//================================================================================
+
+// grantFileKey creates or replaces the recipient's grant for a file. A direct grant
+// stays direct when the same key is granted again through a room.
+func (s *UserKeyService) grantFileKey(tx *gorm.DB, userFile *models.UserFile, granterID uint, roomID *uint, input FileKeyGrantInput) (*models.FileKeyGrant, error) {
+	if input.RecipientID == userFile.UserID {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "the file's owner does not need a key grant")
+	}
+	if input.WrappedKey == "" || len(input.WrappedKey) > maxWrappedFileKeyLength {
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "wrapped file key is missing or too long")
+	}
+
+	var keyPair models.UserKeyPair
+	if err := tx.Where("user_id = ?", input.RecipientID).First(&keyPair).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, apperrors.New(apperrors.ErrCodeNotFound, "recipient has no public key")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	if keyPair.Fingerprint != input.KeyFingerprint {
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "recipient's public key has changed")
+	}
+
+	if roomID != nil {
+		isMember, err := s.isRoomMember(tx, *roomID, input.RecipientID)
+		if err != nil {
+			return nil, err
+		}
+		if !isMember {
+			return nil, apperrors.New(apperrors.ErrCodeForbidden, "recipient is not a member of this room")
+		}
+	}
+
+	var grant models.FileKeyGrant
+	err := tx.Where("user_file_id = ? AND recipient_id = ?", userFile.ID, input.RecipientID).First(&grant).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+
+	if grant.ID == 0 || roomID == nil || grant.RoomID != nil {
+		grant.RoomID = roomID
+	}
+	grant.UserFileID = userFile.ID
+	grant.RecipientID = input.RecipientID
+	grant.GranterID = granterID
+	grant.Version = userFile.CurrentVersion
+	grant.KeyFingerprint = keyPair.Fingerprint
+	grant.WrappedKey = input.WrappedKey
+	if err := tx.Save(&grant).Error; err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to save file key grant")
+	}
+	return &grant, nil
+}
+
+func (s *UserKeyService) isFileInRoom(db *gorm.DB, userFileID, roomID uint) (bool, error) {
+	var count int64
+	if err := db.Model(&models.RoomFile{}).Where("room_id = ? AND user_file_id = ?", roomID, userFileID).Count(&count).Error; err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return count > 0, nil
+}
+
+func (s *UserKeyService) isRoomMember(db *gorm.DB, roomID, userID uint) (bool, error) {
+	var count int64
+	if err := db.Model(&models.RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&count).Error; err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+	}
+	return count > 0, nil
+}
+
+// publicKeyFingerprint checks that publicKey is a base64 encoded X25519 public key
+// that is usable for key agreement, and returns its fingerprint.
+func publicKeyFingerprint(publicKey string) (string, error) {
+	invalid := apperrors.New(apperrors.ErrCodeInvalidArgument, "public key must be a base64 encoded X25519 key")
+
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", invalid
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return "", invalid
+	}
+
+	// Low-order points agree on the all-zero secret with every private key
+	probe, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate key")
+	}
+	if _, err := probe.ECDH(key); err != nil {
+		return "", invalid
+	}
+
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -24,36 +24,36 @@ func NewUserService(authService *AuthService, db *database.DB) *UserService {
 	return &UserService{authService: authService, db: db}
 }
 
-// Register creates a new user account
-func (s *UserService) Register(username, email, password string) (*models.User, string, error) {
+// CreateUser validates and creates a new user account
+func (s *UserService) CreateUser(username, email, password string) (*models.User, error) {
 	// Validate username
 	if result := utils.ValidateUsername(username); result.HasErrors() {
-		return nil, "", apperrors.New(apperrors.ErrCodeInvalidArgument, "username validation failed: "+strings.Join(result.Errors, ", "))
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "username validation failed: "+strings.Join(result.Errors, ", "))
 	}
 
 	// Validate email
 	if result := utils.ValidateEmail(email); result.HasErrors() {
-		return nil, "", apperrors.New(apperrors.ErrCodeInvalidArgument, "email validation failed: "+strings.Join(result.Errors, ", "))
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "email validation failed: "+strings.Join(result.Errors, ", "))
 	}
 
 	// Validate password
 	if result := utils.ValidatePassword(password, utils.DefaultPasswordRequirements()); result.HasErrors() {
-		return nil, "", apperrors.New(apperrors.ErrCodeInvalidArgument, "password validation failed: "+strings.Join(result.Errors, ", "))
+		return nil, apperrors.New(apperrors.ErrCodeInvalidArgument, "password validation failed: "+strings.Join(result.Errors, ", "))
 	}
 
 	// Check if user already exists
 	var existingUser models.User
 	if err := s.db.GetDB().Where("email = ?", email).First(&existingUser).Error; err == nil {
-		return nil, "", apperrors.New(apperrors.ErrCodeConflict, "user with this email already exists")
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "user with this email already exists")
 	}
 	if err := s.db.GetDB().Where("username = ?", username).First(&existingUser).Error; err == nil {
-		return nil, "", apperrors.New(apperrors.ErrCodeConflict, "user with this username already exists")
+		return nil, apperrors.New(apperrors.ErrCodeConflict, "user with this username already exists")
 	}
 
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return nil, "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to hash password")
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to hash password")
 	}
 
 	// Create user
@@ -67,31 +67,25 @@ func (s *UserService) Register(username, email, password string) (*models.User,
 	}
 
 	if err := s.db.GetDB().Create(user).Error; err != nil {
-		return nil, "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create user")
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to create user")
 	}
 
-	// Generate JWT token
-	token, err := s.authService.GenerateToken(user)
-	if err != nil {
-		return nil, "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate token")
-	}
-
-	return user, token, nil
+	return user, nil
 }
 
-// Login authenticates a user and returns a JWT token
-func (s *UserService) Login(identifier, password string) (*models.User, string, error) {
-	log.Printf("DEBUG: UserService.Login called with identifier: %s", identifier)
+// Authenticate checks a user's credentials, identified by email or username
+func (s *UserService) Authenticate(identifier, password string) (*models.User, error) {
+	log.Printf("DEBUG: UserService.Authenticate called with identifier: %s", identifier)
 
 	// Find user by email or username
 	var user models.User
 	if err := s.db.GetDB().Where("email = ? OR username = ?", identifier, identifier).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			log.Printf("DEBUG: User not found with identifier: %s", identifier)
-			return nil, "", apperrors.New(apperrors.ErrCodeUnauthorized, "invalid credentials")
+			return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid credentials")
 		}
 		log.Printf("DEBUG: Database error during user lookup: %v", err)
-		return nil, "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
+		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "database error")
 	}
 
 	log.Printf("DEBUG: User found: ID=%d, Email=%s, Username=%s", user.ID, user.Email, user.Username)
@@ -99,20 +93,11 @@ func (s *UserService) Login(identifier, password string) (*models.User, string,
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
 		log.Printf("DEBUG: Password verification failed for user: %s", user.Email)
-		return nil, "", apperrors.New(apperrors.ErrCodeUnauthorized, "invalid credentials")
+		return nil, apperrors.New(apperrors.ErrCodeUnauthorized, "invalid credentials")
 	}
 
 	log.Printf("DEBUG: Password verified successfully for user: %s", user.Email)
-
-	// Generate JWT token
-	token, err := s.authService.GenerateToken(&user)
-	if err != nil {
-		log.Printf("DEBUG: Failed to generate JWT token: %v", err)
-		return nil, "", apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to generate token")
-	}
-
-	log.Printf("DEBUG: Login successful, JWT token generated for user: %s", user.Email)
-	return &user, token, nil
+	return &user, nil
 }
 
 // GetUserStats returns storage statistics for a user
@@ -127,12 +112,7 @@ func (s *UserService) GetUserStats(userID uint) (*UserStats, error) {
 	s.db.GetDB().Model(&models.UserFile{}).Where("user_id = ? AND deleted_at IS NULL", userID).Count(&fileCount)
 
 	// Calculate actual storage used (sum of all file sizes the user has access to, including trashed files)
-	var usedStorage int64
-	s.db.GetDB().Table("user_files").
-		Select("COALESCE(SUM(files.size_bytes), 0)").
-		Joins("JOIN files ON user_files.file_id = files.id").
-		Where("user_files.user_id = ?", userID).
-		Scan(&usedStorage)
+	usedStorage := s.calculateStorageUsage(userID)
 
 	// No deduplication - each file upload creates a separate copy
 	storageSavings := int64(0)
@@ -152,6 +132,18 @@ func (s *UserService) UpdateStorageUsage(userID uint, deltaBytes int64) error {
 		UpdateColumn("used_storage", gorm.Expr("used_storage + ?", deltaBytes)).Error
 }
 
+// calculateStorageUsage sums the size of every distinct file the user holds, counting
+// trashed files and earlier versions. Content shared by several versions counts once.
+func (s *UserService) calculateStorageUsage(userID uint) int64 {
+	var usage int64
+	s.db.GetDB().Raw(`SELECT COALESCE(SUM(size_bytes), 0) FROM files WHERE id IN (
+		SELECT file_id FROM user_files WHERE user_id = ?
+		UNION
+		SELECT file_id FROM file_versions WHERE user_id = ?
+	)`, userID, userID).Scan(&usage)
+	return usage
+}
+
 // CheckStorageQuota checks if the user has enough storage space
 func (s *UserService) CheckStorageQuota(userID uint, additionalBytes int64) error {
 	var user models.User
@@ -160,12 +152,7 @@ func (s *UserService) CheckStorageQuota(userID uint, additionalBytes int64) erro
 	}
 
 	// Calculate current storage usage dynamically (including trashed files)
-	var currentUsage int64
-	s.db.GetDB().Table("user_files").
-		Select("COALESCE(SUM(files.size_bytes), 0)").
-		Joins("JOIN files ON user_files.file_id = files.id").
-		Where("user_files.user_id = ?", userID).
-		Scan(&currentUsage)
+	currentUsage := s.calculateStorageUsage(userID)
 
 	if currentUsage+additionalBytes > user.StorageQuota {
 		return apperrors.New(apperrors.ErrCodeForbidden, "storage quota exceeded")
@@ -247,7 +234,9 @@ func (s *UserService) UpdateProfile(userID uint, username, email, currentPasswor
 		if err := s.db.GetDB().Where("email = ? AND id != ?", email, userID).First(&existingUser).Error; err == nil {
 			return nil, apperrors.New(apperrors.ErrCodeConflict, "email already taken")
 		}
+		// The new address has to be verified again
 		user.Email = email
+		user.EmailVerified = false
 	}
 
 	// Hash new password if provided
@@ -262,9 +251,19 @@ func (s *UserService) UpdateProfile(userID uint, username, email, currentPasswor
 		user.PasswordHash = string(hashedPassword)
 	}
 
-	// Update user
+	// Update user, signing out every session when the password changed
 	user.UpdatedAt = time.Now()
-	if err := s.db.GetDB().Save(&user).Error; err != nil {
+	err := s.db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		if newPassword == "" {
+			return nil
+		}
+		_, err := revokeUserSessions(tx, userID, "")
+		return err
+	})
+	if err != nil {
 		return nil, apperrors.Wrap(err, apperrors.ErrCodeInternal, "failed to update user")
 	}
 
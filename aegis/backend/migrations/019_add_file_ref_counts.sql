@@ -0,0 +1,9 @@
+-- Track how many user_files rows reference each stored blob so that the object is only
+-- deleted when the last reference goes away
+ALTER TABLE files ADD COLUMN ref_count INTEGER NOT NULL DEFAULT 0;
+
+-- Backfill from existing references (trashed user files still hold on to their content)
+UPDATE files SET ref_count = (SELECT COUNT(*) FROM user_files WHERE user_files.file_id = files.id);
+
+-- Supports the garbage collector's lookup of unreferenced files
+CREATE INDEX IF NOT EXISTS idx_files_ref_count ON files(ref_count);
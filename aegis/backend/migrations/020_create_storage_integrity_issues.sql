@@ -0,0 +1,26 @@
+-- Integrity status shown to users whose file content failed verification
+ALTER TABLE user_files ADD COLUMN integrity_status VARCHAR(20) NOT NULL DEFAULT 'OK';
+
+-- Create storage_integrity_issues table for blobs the scrubber found corrupted or missing
+CREATE TABLE IF NOT EXISTS storage_integrity_issues (
+    id SERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    storage_path VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL CHECK (status IN ('CORRUPTED', 'MISSING')),
+    expected_hash VARCHAR(64) NOT NULL,
+    actual_hash VARCHAR(64),
+    expected_size BIGINT NOT NULL,
+    actual_size BIGINT,
+    detected_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_checked_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_storage_integrity_issues_file_id ON storage_integrity_issues(file_id);
+CREATE INDEX IF NOT EXISTS idx_storage_integrity_issues_status ON storage_integrity_issues(status);
+CREATE INDEX IF NOT EXISTS idx_storage_integrity_issues_resolved_at ON storage_integrity_issues(resolved_at);
+
+-- At most one open issue per file
+CREATE UNIQUE INDEX IF NOT EXISTS idx_storage_integrity_issues_open_file ON storage_integrity_issues(file_id) WHERE resolved_at IS NULL;
@@ -0,0 +1,22 @@
+-- Number and upload time of the revision each user file currently points at
+ALTER TABLE user_files ADD COLUMN current_version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE user_files ADD COLUMN version_uploaded_at TIMESTAMP WITH TIME ZONE;
+UPDATE user_files SET version_uploaded_at = created_at;
+
+-- Create file_versions table for earlier revisions of a user file
+CREATE TABLE IF NOT EXISTS file_versions (
+    id SERIAL PRIMARY KEY,
+    user_file_id INTEGER NOT NULL REFERENCES user_files(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    version_number INTEGER NOT NULL CHECK (version_number > 0),
+    file_id INTEGER NOT NULL REFERENCES files(id),
+    mime_type VARCHAR(255) NOT NULL,
+    encryption_key TEXT NOT NULL,
+    uploaded_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(user_file_id, version_number)
+);
+
+-- Create indexes for efficient queries
+CREATE INDEX IF NOT EXISTS idx_file_versions_user_id ON file_versions(user_id);
+CREATE INDEX IF NOT EXISTS idx_file_versions_file_id ON file_versions(file_id);
@@ -0,0 +1,16 @@
+-- Create personal_access_tokens table for scripts and CI, storing token hashes only
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    token_prefix VARCHAR(32) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL, -- SHA-256 of the token
+    scopes TEXT NOT NULL, -- Space separated, e.g. files:read files:write
+    expires_at TIMESTAMP WITH TIME ZONE, -- NULL for tokens that do not expire
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
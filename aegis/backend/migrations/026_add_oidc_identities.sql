@@ -0,0 +1,25 @@
+-- Create user_identities table linking users to OpenID Connect provider accounts
+CREATE TABLE IF NOT EXISTS user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer VARCHAR(512) NOT NULL,
+    subject VARCHAR(255) NOT NULL, -- The sub claim, stable for the account at the issuer
+    email VARCHAR(255),
+    last_login_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create oidc_login_states table for logins waiting on the identity provider callback
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    id SERIAL PRIMARY KEY,
+    state VARCHAR(64) UNIQUE NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL, -- PKCE verifier, sent with the code exchange
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_identities_issuer_subject ON user_identities(issuer, subject);
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+CREATE INDEX IF NOT EXISTS idx_oidc_login_states_expires_at ON oidc_login_states(expires_at);
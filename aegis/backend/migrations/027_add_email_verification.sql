@@ -0,0 +1,18 @@
+-- Whether the user has proven control of their email address. Existing accounts start
+-- unverified, as their addresses were never checked
+ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Create email_tokens table for email verification and password reset links
+CREATE TABLE IF NOT EXISTS email_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose VARCHAR(32) NOT NULL, -- verify_email or password_reset
+    email VARCHAR(255) NOT NULL, -- The address the token was sent to
+    token_hash VARCHAR(64) UNIQUE NOT NULL, -- SHA-256 of the token
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE INDEX IF NOT EXISTS idx_email_tokens_user_id ON email_tokens(user_id);
@@ -0,0 +1,34 @@
+-- Create login_throttles table counting failed logins per account and per client IP
+CREATE TABLE IF NOT EXISTS login_throttles (
+    id SERIAL PRIMARY KEY,
+    scope VARCHAR(16) NOT NULL, -- account or ip
+    subject VARCHAR(255) NOT NULL, -- User ID, unmatched identifier or IP address
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    first_failed_at TIMESTAMP WITH TIME ZONE,
+    last_failed_at TIMESTAMP WITH TIME ZONE,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    lockout_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create login_audit_events table recording lockouts and unlocks
+CREATE TABLE IF NOT EXISTS login_audit_events (
+    id SERIAL PRIMARY KEY,
+    event VARCHAR(32) NOT NULL, -- account_locked, ip_locked or account_unlocked
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    identifier VARCHAR(255),
+    ip_address VARCHAR(64),
+    detail TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE UNIQUE INDEX IF NOT EXISTS idx_login_throttles_scope_subject ON login_throttles(scope, subject);
+CREATE INDEX IF NOT EXISTS idx_login_throttles_user_id ON login_throttles(user_id);
+CREATE INDEX IF NOT EXISTS idx_login_throttles_locked_until ON login_throttles(locked_until);
+CREATE INDEX IF NOT EXISTS idx_login_audit_events_event ON login_audit_events(event);
+CREATE INDEX IF NOT EXISTS idx_login_audit_events_user_id ON login_audit_events(user_id);
+CREATE INDEX IF NOT EXISTS idx_login_audit_events_created_at ON login_audit_events(created_at);
@@ -0,0 +1,15 @@
+-- Create signing_keys table holding the asymmetric keys that sign access tokens
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id SERIAL PRIMARY KEY,
+    kid VARCHAR(64) NOT NULL UNIQUE,
+    algorithm VARCHAR(16) NOT NULL, -- EdDSA or RS256
+    public_key TEXT NOT NULL,
+    encrypted_private_key TEXT, -- Cleared once the key is retired
+    retired_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE INDEX IF NOT EXISTS idx_signing_keys_retired_at ON signing_keys(retired_at);
+CREATE INDEX IF NOT EXISTS idx_signing_keys_expires_at ON signing_keys(expires_at);
@@ -0,0 +1,10 @@
+-- Create download_ticket_redemptions table recording used single-use download tickets
+CREATE TABLE IF NOT EXISTS download_ticket_redemptions (
+    id SERIAL PRIMARY KEY,
+    ticket_id VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE INDEX IF NOT EXISTS idx_download_ticket_redemptions_expires_at ON download_ticket_redemptions(expires_at);
@@ -0,0 +1,31 @@
+-- Create user_key_pairs table holding each user's X25519 key pair for end-to-end sharing.
+-- The private key is wrapped by the client and opaque to the server
+CREATE TABLE IF NOT EXISTS user_key_pairs (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER UNIQUE NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    public_key VARCHAR(64) NOT NULL, -- Base64 encoded X25519 public key
+    fingerprint VARCHAR(64) NOT NULL, -- Hex SHA-256 of the public key
+    wrapped_private_key TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create file_key_grants table holding file keys wrapped to a recipient's public key
+CREATE TABLE IF NOT EXISTS file_key_grants (
+    id SERIAL PRIMARY KEY,
+    user_file_id INTEGER NOT NULL REFERENCES user_files(id) ON DELETE CASCADE,
+    recipient_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    granter_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    room_id INTEGER REFERENCES rooms(id) ON DELETE CASCADE, -- Null for a direct share
+    version INTEGER NOT NULL, -- Revision of the file whose key is wrapped
+    key_fingerprint VARCHAR(64) NOT NULL, -- Recipient key the file key is wrapped to
+    wrapped_key TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE UNIQUE INDEX IF NOT EXISTS idx_file_key_grants_file_recipient ON file_key_grants(user_file_id, recipient_id);
+CREATE INDEX IF NOT EXISTS idx_user_key_pairs_fingerprint ON user_key_pairs(fingerprint);
+CREATE INDEX IF NOT EXISTS idx_file_key_grants_recipient_id ON file_key_grants(recipient_id);
+CREATE INDEX IF NOT EXISTS idx_file_key_grants_room_id ON file_key_grants(room_id);
@@ -0,0 +1,22 @@
+-- Add room key state. key_version is 0 until the room's first key is set
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS key_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS rekey_required BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Add the file key wrapped under the room key to files shared to a room
+ALTER TABLE room_files ADD COLUMN IF NOT EXISTS key_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE room_files ADD COLUMN IF NOT EXISTS wrapped_key TEXT NOT NULL DEFAULT '';
+
+-- Create room_keys table holding each version of a room key wrapped to each member
+CREATE TABLE IF NOT EXISTS room_keys (
+    id SERIAL PRIMARY KEY,
+    room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key_fingerprint VARCHAR(64) NOT NULL, -- Member key the room key is wrapped to
+    wrapped_key TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE UNIQUE INDEX IF NOT EXISTS idx_room_keys_room_version_user ON room_keys(room_id, version, user_id);
+CREATE INDEX IF NOT EXISTS idx_room_keys_user_id ON room_keys(user_id);
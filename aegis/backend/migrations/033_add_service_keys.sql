@@ -0,0 +1,15 @@
+-- Record the key provider key that wrapped each envelope key. Empty marks a legacy key stored as plain hex
+ALTER TABLE users ADD COLUMN IF NOT EXISTS envelope_key_id VARCHAR(512) NOT NULL DEFAULT '';
+
+-- Create service_keys table holding service-wide keys wrapped by the key provider
+CREATE TABLE IF NOT EXISTS service_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    key_id VARCHAR(512) NOT NULL, -- Key provider key that wrapped the key
+    wrapped_key TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create indexes for efficient queries
+CREATE UNIQUE INDEX IF NOT EXISTS idx_service_keys_name ON service_keys(name);
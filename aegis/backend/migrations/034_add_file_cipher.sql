@@ -0,0 +1,5 @@
+-- Record the cipher of each stored object. Empty until the re-encryption job has read its header
+ALTER TABLE files ADD COLUMN IF NOT EXISTS cipher VARCHAR(32) NOT NULL DEFAULT '';
+
+-- Create indexes for efficient queries
+CREATE INDEX IF NOT EXISTS idx_files_cipher ON files(cipher);
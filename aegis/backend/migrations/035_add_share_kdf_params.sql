@@ -0,0 +1,3 @@
+-- Record the KDF parameters of legacy share salts, for example pbkdf2-sha256$i=100000.
+-- Empty once the keys are sealed in the ciphertext format, which carries them itself
+ALTER TABLE file_shares ADD COLUMN IF NOT EXISTS kdf_params VARCHAR(64) NOT NULL DEFAULT '';
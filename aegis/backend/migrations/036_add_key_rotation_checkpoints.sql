@@ -0,0 +1,8 @@
+-- Let key rotations resume after a restart. The wrapped old and new envelope keys are
+-- recorded before the user or any file is changed, and last_user_file_id is the
+-- checkpoint up to which file keys are re-wrapped
+ALTER TABLE key_rotations ADD COLUMN IF NOT EXISTS last_user_file_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE key_rotations ADD COLUMN IF NOT EXISTS old_envelope_key TEXT NOT NULL DEFAULT '';
+ALTER TABLE key_rotations ADD COLUMN IF NOT EXISTS old_envelope_key_id VARCHAR(512) NOT NULL DEFAULT '';
+ALTER TABLE key_rotations ADD COLUMN IF NOT EXISTS new_envelope_key TEXT NOT NULL DEFAULT '';
+ALTER TABLE key_rotations ADD COLUMN IF NOT EXISTS new_envelope_key_id VARCHAR(512) NOT NULL DEFAULT '';
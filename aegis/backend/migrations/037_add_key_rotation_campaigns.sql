@@ -0,0 +1,38 @@
+-- Admin-initiated campaigns that rotate every user's envelope key and every share envelope.
+-- Each user's rotation is a key_rotations row carrying the campaign_id, and
+-- last_user_id and last_file_share_id are the checkpoints a resumed campaign continues from
+CREATE TABLE IF NOT EXISTS key_rotation_campaigns (
+    id SERIAL PRIMARY KEY,
+    campaign_id VARCHAR(64) UNIQUE NOT NULL,
+    status VARCHAR(50) NOT NULL CHECK (status IN ('RUNNING', 'PAUSED', 'COMPLETED', 'CANCELLED')),
+    started_by INTEGER NOT NULL REFERENCES users(id),
+    concurrency INTEGER NOT NULL,
+    rate_limit_per_second INTEGER NOT NULL,
+    users_enrolled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_user_id INTEGER NOT NULL DEFAULT 0,
+    last_file_share_id INTEGER NOT NULL DEFAULT 0,
+    total_users INTEGER NOT NULL DEFAULT 0,
+    users_rotated INTEGER NOT NULL DEFAULT 0,
+    users_failed INTEGER NOT NULL DEFAULT 0,
+    total_shares INTEGER NOT NULL DEFAULT 0,
+    shares_rotated INTEGER NOT NULL DEFAULT 0,
+    shares_skipped INTEGER NOT NULL DEFAULT 0,
+    shares_failed INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_rotation_campaigns_status ON key_rotation_campaigns(status);
+
+CREATE TRIGGER update_key_rotation_campaigns_updated_at BEFORE UPDATE ON key_rotation_campaigns FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+ALTER TABLE key_rotations ADD COLUMN IF NOT EXISTS campaign_id VARCHAR(64) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_key_rotations_campaign_id ON key_rotations(campaign_id);
+
+-- Rotations a cancelled campaign never started are CANCELLED
+ALTER TABLE key_rotations DROP CONSTRAINT IF EXISTS key_rotations_status_check;
+ALTER TABLE key_rotations ADD CONSTRAINT key_rotations_status_check
+    CHECK (status IN ('PENDING', 'IN_PROGRESS', 'COMPLETED', 'FAILED', 'ROLLED_BACK', 'CANCELLED'));
@@ -0,0 +1,9 @@
+-- Version service keys so the share password key can be rotated. Earlier versions are
+-- kept, and each share records the version its stored password is encrypted under until
+-- the re-encryption job moves it to the current one
+ALTER TABLE service_keys ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+DROP INDEX IF EXISTS idx_service_keys_name;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_service_keys_name_version ON service_keys(name, version);
+
+ALTER TABLE file_shares ADD COLUMN IF NOT EXISTS password_key_version INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS idx_file_shares_password_key_version ON file_shares(password_key_version);
@@ -0,0 +1,54 @@
+-- Envelope key copies sealed to a user's printed recovery key or to the organization
+-- escrow key. The private keys are never stored, and each copy is re-sealed whenever the
+-- user's envelope key is rotated
+CREATE TABLE IF NOT EXISTS envelope_key_escrows (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(32) NOT NULL CHECK (kind IN ('recovery_key', 'organization')),
+    public_key VARCHAR(64) NOT NULL,
+    sealed_envelope_key TEXT NOT NULL,
+    envelope_key_version INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_envelope_key_escrows_user_kind ON envelope_key_escrows(user_id, kind);
+
+CREATE TRIGGER update_envelope_key_escrows_updated_at BEFORE UPDATE ON envelope_key_escrows FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Escrow recoveries, requested by one admin and approved by a second
+CREATE TABLE IF NOT EXISTS key_recovery_requests (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    requested_by INTEGER NOT NULL REFERENCES users(id),
+    approved_by INTEGER REFERENCES users(id),
+    completed_by INTEGER REFERENCES users(id),
+    reason TEXT NOT NULL,
+    status VARCHAR(50) NOT NULL CHECK (status IN ('PENDING', 'APPROVED', 'COMPLETED', 'CANCELLED')),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    approved_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_recovery_requests_user_id ON key_recovery_requests(user_id);
+CREATE INDEX IF NOT EXISTS idx_key_recovery_requests_status ON key_recovery_requests(status);
+
+CREATE TRIGGER update_key_recovery_requests_updated_at BEFORE UPDATE ON key_recovery_requests FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Audit trail of recovery key use and escrow recoveries. It outlives the users it names
+CREATE TABLE IF NOT EXISTS key_recovery_audit_events (
+    id SERIAL PRIMARY KEY,
+    event VARCHAR(32) NOT NULL,
+    user_id INTEGER NOT NULL,
+    actor_id INTEGER NOT NULL,
+    request_id INTEGER,
+    detail TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_key_recovery_audit_events_event ON key_recovery_audit_events(event);
+CREATE INDEX IF NOT EXISTS idx_key_recovery_audit_events_user_id ON key_recovery_audit_events(user_id);
+CREATE INDEX IF NOT EXISTS idx_key_recovery_audit_events_request_id ON key_recovery_audit_events(request_id);
+CREATE INDEX IF NOT EXISTS idx_key_recovery_audit_events_created_at ON key_recovery_audit_events(created_at);
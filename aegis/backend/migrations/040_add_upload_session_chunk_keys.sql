@@ -0,0 +1,4 @@
+-- Record the object key of each chunk accepted into an upload session, so finalization
+-- assembles only those and ignores objects left behind by failed or concurrent appends.
+-- Sessions with chunks from before this migration cannot be finalized and expire
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS chunk_keys TEXT NOT NULL DEFAULT '';
@@ -2,15 +2,21 @@
 package integration
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
 )
 
 // FileIntegrationTestSuite tests file management functionality
@@ -1944,6 +1950,99 @@ func (suite *FileIntegrationTestSuite) TestEndToEndShareCreationAndAccessFlow()
 	suite.True(statsResponse.GetShareStats.UniqueIPs >= 1, "Should have at least 1 unique IP")
 }
 
+// newContentVerifyingFileService builds a FileService over the suite database and an
+// in-memory object store so upload verification can be exercised end to end.
+func (suite *FileIntegrationTestSuite) newContentVerifyingFileService() (*services.FileService, *services.MemoryStorageBackend) {
+	backend := services.NewMemoryStorageBackend()
+	fileService := services.NewFileService(
+		suite.Config,
+		database.NewDB(suite.TestDB),
+		services.NewFileStorageServiceWithBackend(backend),
+		services.NewAuthService(suite.Config),
+	)
+	return fileService, backend
+}
+
+// TestUploadClaimingKnownHashWithoutContent covers the deduplication attack: a user who
+// only knows the hash of someone else's file must not be linked to that file's blob.
+func (suite *FileIntegrationTestSuite) TestUploadClaimingKnownHashWithoutContent() {
+	ctx := context.Background()
+	fileService, backend := suite.newContentVerifyingFileService()
+
+	victimContent := []byte("quarterly payroll export")
+	victimHash := generateSHA256Hash(string(victimContent))
+	victimFile, err := fileService.UploadFile(suite.TestData.RegularUser.ID, "payroll.csv", "text/csv", victimHash, "victim_key", bytes.NewReader(victimContent), int64(len(victimContent)), nil)
+	suite.Require().NoError(err, "Victim upload should succeed")
+
+	// The attacker declares the victim's hash but sends different bytes of the same size
+	forged := []byte(strings.Repeat("x", len(victimContent)))
+	_, err = fileService.UploadFile(suite.TestData.AnotherUser.ID, "stolen.csv", "text/csv", victimHash, "attacker_key", bytes.NewReader(forged), int64(len(forged)), nil)
+	suite.Require().Error(err, "Upload with mismatching content must be rejected")
+	suite.Contains(err.Error(), "does not match content_hash")
+
+	var linked int64
+	suite.TestDB.Model(&models.UserFile{}).Where("user_id = ? AND file_id = ?", suite.TestData.AnotherUser.ID, victimFile.FileID).Count(&linked)
+	suite.Equal(int64(0), linked, "Attacker must not be linked to the victim's file")
+
+	// Neither the forged bytes nor a staging copy may be left in storage
+	staged, err := backend.List(ctx, "staging/")
+	suite.Require().NoError(err)
+	suite.Empty(staged, "Staging objects should be removed after a rejected upload")
+
+	reader, _, err := fileService.StreamFile(suite.TestData.RegularUser.ID, victimFile.ID)
+	suite.Require().NoError(err)
+	defer reader.Close()
+	stored, err := io.ReadAll(reader)
+	suite.Require().NoError(err)
+	suite.Equal(victimContent, stored, "Victim's blob must be untouched")
+}
+
+// TestUploadClaimingHashOfUnstoredFile ensures a hash recorded in the database cannot be
+// claimed with arbitrary bytes even when the attacker also lies about the size.
+func (suite *FileIntegrationTestSuite) TestUploadClaimingHashOfUnstoredFile() {
+	fileService, _ := suite.newContentVerifyingFileService()
+
+	knownHash := suite.TestData.File1.ContentHash
+	forged := []byte("not the real content")
+	_, err := fileService.UploadFile(suite.TestData.AnotherUser.ID, "claimed.txt", "text/plain", knownHash, "attacker_key", bytes.NewReader(forged), suite.TestData.File1.SizeBytes, nil)
+	suite.Require().Error(err, "Upload with mismatching size must be rejected")
+
+	suite.AssertUserFileCount(suite.TestData.AnotherUser.ID, 0)
+}
+
+// TestUploadWithProvenContentIsDeduplicated checks that dedup still happens once the
+// bytes have been verified, and that only one blob is kept.
+func (suite *FileIntegrationTestSuite) TestUploadWithProvenContentIsDeduplicated() {
+	ctx := context.Background()
+	fileService, backend := suite.newContentVerifyingFileService()
+
+	content := []byte("shared team handbook")
+	contentHash := generateSHA256Hash(string(content))
+
+	first, err := fileService.UploadFile(suite.TestData.RegularUser.ID, "handbook.pdf", "application/pdf", contentHash, "key_one", bytes.NewReader(content), int64(len(content)), nil)
+	suite.Require().NoError(err)
+	second, err := fileService.UploadFile(suite.TestData.AnotherUser.ID, "handbook.pdf", "application/pdf", contentHash, "key_two", bytes.NewReader(content), int64(len(content)), nil)
+	suite.Require().NoError(err, "Upload with matching content should succeed")
+
+	suite.Equal(first.FileID, second.FileID, "Verified uploads of the same content should share a File")
+	suite.Equal(contentHash, second.File.ContentHash)
+
+	objects, err := backend.List(ctx, "")
+	suite.Require().NoError(err)
+	suite.Len(objects, 1, "Only the original blob should be stored")
+	suite.Equal(first.File.StoragePath, objects[0].Key)
+}
+
+// TestUploadRejectsMalformedHash ensures the declared hash must be a SHA-256 digest.
+func (suite *FileIntegrationTestSuite) TestUploadRejectsMalformedHash() {
+	fileService, _ := suite.newContentVerifyingFileService()
+
+	content := []byte("some content")
+	_, err := fileService.UploadFile(suite.TestData.RegularUser.ID, "bad.txt", "text/plain", "not-a-hash", "key", bytes.NewReader(content), int64(len(content)), nil)
+	suite.Require().Error(err)
+	suite.Contains(err.Error(), "content_hash")
+}
+
 // Helper function to generate SHA-256 hash
 func generateSHA256Hash(content string) string {
 	hash := sha256.Sum256([]byte(content))
@@ -55,14 +55,34 @@ func NewTestGraphQLServer(cfg *config.Config) *TestGraphQLServer {
 	// Initialize services
 	authService := services.NewAuthService(cfg)
 	userService := services.NewUserService(authService, dbService)
-	roomService := services.NewRoomService(dbService)
+	refreshTokenService := services.NewRefreshTokenService(cfg, dbService, authService)
+	sessionService := services.NewSessionService(dbService, authService, refreshTokenService)
+	twoFactorService := services.NewTwoFactorService(cfg, dbService, authService)
+	personalAccessTokenService := services.NewPersonalAccessTokenService(dbService)
+	oidcService := services.NewOIDCService(cfg, dbService)
+	emailTokenService := services.NewEmailTokenService(cfg, dbService, services.NewMemoryMailSender())
+	loginThrottleService := services.NewLoginThrottleService(cfg, dbService, userService, emailTokenService)
+	userKeyService := services.NewUserKeyService(cfg, dbService)
+	roomService := services.NewRoomService(dbService, userService)
+	roomKeyService := services.NewRoomKeyService(dbService, roomService)
 	adminService := services.NewAdminService(dbService)
+	downloadTicketService := services.NewDownloadTicketService(cfg, dbService)
 
 	// Initialize GraphQL resolver
 	resolver := &graph.Resolver{
-		UserService:  userService,
-		RoomService:  roomService,
-		AdminService: adminService,
+		UserService:                userService,
+		RefreshTokenService:        refreshTokenService,
+		SessionService:             sessionService,
+		TwoFactorService:           twoFactorService,
+		PersonalAccessTokenService: personalAccessTokenService,
+		OIDCService:                oidcService,
+		EmailTokenService:          emailTokenService,
+		LoginThrottleService:       loginThrottleService,
+		UserKeyService:             userKeyService,
+		RoomService:                roomService,
+		RoomKeyService:             roomKeyService,
+		AdminService:               adminService,
+		DownloadTicketService:      downloadTicketService,
 	}
 
 	// Create GraphQL server
@@ -28,6 +28,34 @@ func SetupTestDatabase(db *gorm.DB) error {
 		"../../migrations/010_add_allowed_usernames_to_file_shares.sql",
 		"../../migrations/011_add_plain_text_password_to_file_shares.sql",
 		"../../migrations/012_add_encrypted_password_fields.sql",
+		"../../migrations/013_add_user_envelope_keys.sql",
+		"../../migrations/014_add_key_rotations_table.sql",
+		"../../migrations/015_add_key_rotation_backups_table.sql",
+		"../../migrations/016_rename_allowed_usernames_to_allowed_emails.sql",
+		"../../migrations/017_change_allowed_emails_to_text.sql",
+		"../../migrations/018_add_upload_sessions.sql",
+		"../../migrations/019_add_file_ref_counts.sql",
+		"../../migrations/020_create_storage_integrity_issues.sql",
+		"../../migrations/021_add_file_versions.sql",
+		"../../migrations/022_add_refresh_tokens.sql",
+		"../../migrations/023_add_sessions.sql",
+		"../../migrations/024_add_two_factor.sql",
+		"../../migrations/025_add_personal_access_tokens.sql",
+		"../../migrations/026_add_oidc_identities.sql",
+		"../../migrations/027_add_email_verification.sql",
+		"../../migrations/028_add_login_throttling.sql",
+		"../../migrations/029_add_signing_keys.sql",
+		"../../migrations/030_add_download_ticket_redemptions.sql",
+		"../../migrations/031_add_user_key_pairs_and_file_key_grants.sql",
+		"../../migrations/032_add_room_keys.sql",
+		"../../migrations/033_add_service_keys.sql",
+		"../../migrations/034_add_file_cipher.sql",
+		"../../migrations/035_add_share_kdf_params.sql",
+		"../../migrations/036_add_key_rotation_checkpoints.sql",
+		"../../migrations/037_add_key_rotation_campaigns.sql",
+		"../../migrations/038_add_service_key_versions.sql",
+		"../../migrations/039_add_envelope_key_recovery.sql",
+		"../../migrations/040_add_upload_session_chunk_keys.sql",
 	}
 
 	for _, file := range migrationFiles {
@@ -178,6 +206,11 @@ func ConvertPostgresToSQLite(postgresSQL string) string {
 		sqliteSQL = convertAlterColumn(sqliteSQL)
 	}
 
+	// Handle ALTER TABLE ADD COLUMN with a CURRENT_TIMESTAMP default - SQLite only allows constant defaults
+	if strings.Contains(sqliteSQL, "ADD COLUMN") && strings.Contains(sqliteSQL, "DEFAULT CURRENT_TIMESTAMP") {
+		sqliteSQL = convertAddTimestampColumn(sqliteSQL)
+	}
+
 	// Remove PostgreSQL-specific constructs that don't apply to SQLite
 	sqliteSQL = removePostgresSpecific(sqliteSQL)
 
@@ -227,6 +260,14 @@ UNIQUE (user_id, file_id);`,
 			`CREATE UNIQUE INDEX IF NOT EXISTS user_files_user_content_unique ON user_files (user_id, file_id);`)
 	}
 
+	// SQLite can't replace a CHECK constraint, so migration 037 keeps the original one
+	if strings.Contains(sql, "ADD CONSTRAINT key_rotations_status_check") {
+		sql = strings.ReplaceAll(sql,
+			`ALTER TABLE key_rotations ADD CONSTRAINT key_rotations_status_check
+    CHECK (status IN ('PENDING', 'IN_PROGRESS', 'COMPLETED', 'FAILED', 'ROLLED_BACK', 'CANCELLED'));`,
+			``)
+	}
+
 	return sql
 }
 
@@ -238,6 +279,11 @@ func convertDropConstraint(sql string) string {
 			`ALTER TABLE files DROP CONSTRAINT IF EXISTS files_content_hash_key;`,
 			`DROP INDEX IF EXISTS files_content_hash_key;`)
 	}
+	if strings.Contains(sql, "DROP CONSTRAINT IF EXISTS key_rotations_status_check") {
+		return strings.ReplaceAll(sql,
+			`ALTER TABLE key_rotations DROP CONSTRAINT IF EXISTS key_rotations_status_check;`,
+			``)
+	}
 	return sql
 }
 
@@ -270,7 +316,27 @@ func convertAlterColumn(sql string) string {
 			`-- SQLite doesn't support ALTER COLUMN, skipping SET NOT NULL operation`)
 	}
 
-	return sql
+	// Column type, default and nullability changes (e.g. migration 017) only tighten the
+	// PostgreSQL schema, so they are skipped as well
+	lines := strings.Split(sql, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "ALTER COLUMN") && !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines[i] = "-- SQLite doesn't support ALTER COLUMN, skipping: " + strings.TrimSuffix(strings.TrimSpace(line), ";") + ";"
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// convertAddTimestampColumn drops CURRENT_TIMESTAMP defaults from added columns
+func convertAddTimestampColumn(sql string) string {
+	lines := strings.Split(sql, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "ADD COLUMN") {
+			lines[i] = strings.ReplaceAll(line, " DEFAULT CURRENT_TIMESTAMP", "")
+		}
+	}
+	return strings.Join(lines, "\n")
 }
 
 // removePostgresSpecific removes PostgreSQL-specific constructs
@@ -1,19 +1,31 @@
 package integration
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 
 	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/handlers"
+	"github.com/balkanid/aegis-backend/internal/middleware"
 	"github.com/balkanid/aegis-backend/internal/models"
 	"github.com/balkanid/aegis-backend/internal/services"
 )
 
 type ShareIntegrationTestSuite struct {
 	BaseIntegrationTestSuite
-	shareService *services.ShareService
+	shareService  *services.ShareService
+	cryptoManager *services.CryptoManager
 }
 
 func (suite *ShareIntegrationTestSuite) SetupTest() {
@@ -29,6 +41,7 @@ func (suite *ShareIntegrationTestSuite) SetupTest() {
 	// Create database service wrapper
 	dbService := database.NewDB(suite.TestDB)
 
+	suite.cryptoManager = cryptoManager
 	suite.shareService = services.NewShareService(dbService, "http://localhost:8080", cryptoManager)
 }
 
@@ -38,13 +51,13 @@ func (suite *ShareIntegrationTestSuite) TestCreateShareWithUsernameRestrictions(
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), fileShare)
-	assert.Equal(suite.T(), allowedUsernames, fileShare.AllowedUsernames)
+	assert.Equal(suite.T(), `["alice","bob","charlie"]`, fileShare.AllowedEmails)
 
 	// Verify share was created in database
 	var dbShare models.FileShare
 	err = suite.TestDB.Preload("UserFile").Where("id = ?", fileShare.ID).First(&dbShare).Error
 	assert.NoError(suite.T(), err)
-	assert.Equal(suite.T(), allowedUsernames, dbShare.AllowedUsernames)
+	assert.Equal(suite.T(), `["alice","bob","charlie"]`, dbShare.AllowedEmails)
 }
 
 func (suite *ShareIntegrationTestSuite) TestCreateShareWithoutUsernameRestrictions() {
@@ -52,13 +65,13 @@ func (suite *ShareIntegrationTestSuite) TestCreateShareWithoutUsernameRestrictio
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), fileShare)
-	assert.Nil(suite.T(), fileShare.AllowedUsernames)
+	assert.Equal(suite.T(), "[]", fileShare.AllowedEmails)
 
 	// Verify share was created in database
 	var dbShare models.FileShare
 	err = suite.TestDB.Preload("UserFile").Where("id = ?", fileShare.ID).First(&dbShare).Error
 	assert.NoError(suite.T(), err)
-	assert.Nil(suite.T(), dbShare.AllowedUsernames)
+	assert.Equal(suite.T(), "[]", dbShare.AllowedEmails)
 }
 
 func (suite *ShareIntegrationTestSuite) TestUsernameAuthorization_AllowedUser() {
@@ -152,18 +165,102 @@ func (suite *ShareIntegrationTestSuite) TestUsernameAuthorization_EmptyRestricti
 	assert.True(suite.T(), isAuthorized, "Any user should be authorized when restrictions are empty")
 }
 
+// TestRESTShareAccess_AllowedEmails opens a share restricted to emails through the REST
+// routes used by the share page, which check recipients like the GraphQL mutation does
+func (suite *ShareIntegrationTestSuite) TestRESTShareAccess_AllowedEmails() {
+	dbService := database.NewDB(suite.TestDB)
+	authService := services.NewAuthService(suite.Config)
+	fileService := services.NewFileService(suite.Config, dbService, services.NewFileStorageServiceWithBackend(services.NewMemoryStorageBackend()), authService)
+	tickets := services.NewDownloadTicketService(suite.Config, dbService)
+	sessions := services.NewSessionService(dbService, authService, services.NewRefreshTokenService(suite.Config, dbService, authService))
+
+	content := []byte("for the allowed recipient only")
+	fileKey := bytes.Repeat([]byte{9}, 32)
+	sealed, err := suite.cryptoManager.SealFile(content, fileKey)
+	suite.Require().NoError(err)
+	userFile, err := fileService.UploadFile(suite.TestData.AdminUser.ID, "restricted.txt", "text/plain", fmt.Sprintf("%x", sha256.Sum256(sealed)), base64.StdEncoding.EncodeToString(fileKey), bytes.NewReader(sealed), int64(len(sealed)), nil)
+	suite.Require().NoError(err)
+
+	recipient := suite.TestData.RegularUser
+	fileShare, err := suite.shareService.CreateShare(userFile.ID, "", -1, nil, []string{recipient.Email})
+	suite.Require().NoError(err)
+
+	shareHandler := handlers.NewShareHandler(suite.shareService, fileService, tickets, suite.cryptoManager, "/v1/share")
+	router := gin.New()
+	router.POST("/v1/share/:token/access", middleware.OptionalAuthMiddleware(authService, dbService), shareHandler.AccessShare)
+	router.GET("/v1/share/:token/download", shareHandler.DownloadShare)
+
+	tokenFor := func(user *models.User) string {
+		token, _, err := sessions.StartSession(user, "test", "127.0.0.1")
+		suite.Require().NoError(err)
+		return token
+	}
+	access := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/share/"+fileShare.ShareToken+"/access", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	download := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	// Shares restricted to emails have no password; the link alone is not enough
+	assert.Equal(suite.T(), http.StatusUnauthorized, access("").Code)
+
+	// Nor is an account with the address, until the address is verified
+	suite.Require().NoError(suite.TestDB.Model(recipient).Update("email_verified", false).Error)
+	assert.Equal(suite.T(), http.StatusForbidden, access(tokenFor(recipient)).Code)
+
+	// Other users are turned away
+	suite.Require().NoError(suite.TestDB.Model(suite.TestData.AnotherUser).Update("email_verified", true).Error)
+	assert.Equal(suite.T(), http.StatusForbidden, access(tokenFor(suite.TestData.AnotherUser)).Code)
+
+	suite.Require().NoError(suite.TestDB.Model(recipient).Update("email_verified", true).Error)
+	w := access(tokenFor(recipient))
+	suite.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		DownloadURL string `json:"downloadUrl"`
+	}
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &body))
+
+	w = download(body.DownloadURL)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), content, w.Body.Bytes())
+
+	// Tickets stop working once the recipient is no longer allowed
+	suite.Require().NoError(suite.TestDB.Model(fileShare).Update("allowed_emails", `["someone@example.com"]`).Error)
+	assert.Equal(suite.T(), http.StatusForbidden, download(body.DownloadURL).Code)
+
+	// Only the successful access was charged
+	var reloaded models.FileShare
+	suite.Require().NoError(suite.TestDB.First(&reloaded, fileShare.ID).Error)
+	assert.Equal(suite.T(), 1, reloaded.DownloadCount)
+}
+
 // Helper method to check username authorization (mimics GraphQL resolver logic)
 func (suite *ShareIntegrationTestSuite) checkUsernameAuthorization(fileShare *models.FileShare, user *models.User) bool {
 	if user == nil {
 		return false
 	}
 
-	if len(fileShare.AllowedUsernames) == 0 {
+	var allowedUsernames []string
+	if err := json.Unmarshal([]byte(fileShare.AllowedEmails), &allowedUsernames); err != nil {
+		return false
+	}
+
+	if len(allowedUsernames) == 0 {
 		return true // No restrictions means public access
 	}
 
 	// Check if the user's username is in the allowed list
-	for _, allowedUsername := range fileShare.AllowedUsernames {
+	for _, allowedUsername := range allowedUsernames {
 		if user.Username == allowedUsername {
 			return true
 		}
@@ -0,0 +1,174 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/handlers"
+	"github.com/balkanid/aegis-backend/internal/middleware"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type FileHandlerTestSuite struct {
+	suite.Suite
+	db       *gorm.DB
+	router   *gin.Engine
+	user     models.User
+	userFile *models.UserFile
+	content  []byte
+	versions *models.UserFile
+}
+
+func (suite *FileHandlerTestSuite) SetupSuite() {
+	gin.SetMode(gin.TestMode)
+
+	db, err := gorm.Open(sqlite.Open("file:file_handler_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.File{}, &models.UserFile{}, &models.Folder{}, &models.RoomFile{}, &models.RoomMember{}, &models.StorageIntegrityIssue{}, &models.FileVersion{})
+	suite.Require().NoError(err)
+
+	suite.user = models.User{Username: "downloader", Email: "downloader@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(db.Create(&suite.user).Error)
+
+	cfg := &config.Config{}
+	dbService := database.NewDB(db)
+	authService := services.NewAuthService(cfg)
+	fileService := services.NewFileService(cfg, dbService, services.NewFileStorageServiceWithBackend(services.NewMemoryStorageBackend()), authService)
+
+	suite.content = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	contentHash := fmt.Sprintf("%x", sha256.Sum256(suite.content))
+	suite.userFile, err = fileService.UploadFile(suite.user.ID, "movie.bin", "application/octet-stream", contentHash, "key", bytes.NewReader(suite.content), int64(len(suite.content)), nil)
+	suite.Require().NoError(err)
+
+	// A second file with two versions
+	for _, draft := range []string{"first draft", "second draft"} {
+		suite.versions, err = fileService.UploadFile(suite.user.ID, "notes.txt", "text/plain", fmt.Sprintf("%x", sha256.Sum256([]byte(draft))), "key", bytes.NewReader([]byte(draft)), int64(len(draft)), nil)
+		suite.Require().NoError(err)
+	}
+
+	fileHandler := handlers.NewFileHandler(fileService, authService)
+	suite.router = gin.New()
+	suite.router.Use(middleware.ErrorHandler())
+	suite.router.GET("/files/:id/download", func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), middleware.UserContextKey, &suite.user)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}, fileHandler.DownloadFile)
+}
+
+func (suite *FileHandlerTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *FileHandlerTestSuite) download(headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/files/%d/download", suite.userFile.ID), nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	return w
+}
+
+func (suite *FileHandlerTestSuite) etag() string {
+	return handlers.ContentETag(suite.userFile.File.ContentHash, "")
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_Full() {
+	w := suite.download(nil)
+
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), suite.content, w.Body.Bytes())
+	assert.Equal(suite.T(), suite.etag(), w.Header().Get("ETag"))
+	assert.NotEmpty(suite.T(), w.Header().Get("Last-Modified"))
+	assert.Equal(suite.T(), "bytes", w.Header().Get("Accept-Ranges"))
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_Range() {
+	w := suite.download(map[string]string{"Range": "bytes=10-19"})
+
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), suite.content[10:20], w.Body.Bytes())
+	assert.Equal(suite.T(), fmt.Sprintf("bytes 10-19/%d", len(suite.content)), w.Header().Get("Content-Range"))
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_IfRangeMatches() {
+	w := suite.download(map[string]string{"Range": "bytes=30-", "If-Range": suite.etag()})
+
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), suite.content[30:], w.Body.Bytes())
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_IfRangeStale() {
+	w := suite.download(map[string]string{"Range": "bytes=30-", "If-Range": "\"stale\""})
+
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), suite.content, w.Body.Bytes())
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_IfNoneMatch() {
+	w := suite.download(map[string]string{"If-None-Match": suite.etag()})
+
+	assert.Equal(suite.T(), http.StatusNotModified, w.Code)
+	assert.Empty(suite.T(), w.Body.Bytes())
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_UnsatisfiableRange() {
+	w := suite.download(map[string]string{"Range": "bytes=1000-"})
+
+	assert.Equal(suite.T(), http.StatusRequestedRangeNotSatisfiable, w.Code)
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_IntegrityWarning() {
+	assert.Empty(suite.T(), suite.download(nil).Header().Get("X-Integrity-Status"))
+
+	suite.db.Model(&models.UserFile{}).Where("id = ?", suite.userFile.ID).UpdateColumn("integrity_status", models.IntegrityStatusCorrupted)
+	defer suite.db.Model(&models.UserFile{}).Where("id = ?", suite.userFile.ID).UpdateColumn("integrity_status", models.IntegrityStatusOK)
+
+	w := suite.download(nil)
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), models.IntegrityStatusCorrupted, w.Header().Get("X-Integrity-Status"))
+}
+
+func (suite *FileHandlerTestSuite) TestDownloadFile_Version() {
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/files/%d/download%s", suite.versions.ID, query), nil)
+		w := httptest.NewRecorder()
+		suite.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("?version=1")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), "first draft", w.Body.String())
+	assert.Equal(suite.T(), handlers.ContentETag(fmt.Sprintf("%x", sha256.Sum256([]byte("first draft"))), ""), w.Header().Get("ETag"))
+
+	w = get("")
+	assert.Equal(suite.T(), "second draft", w.Body.String())
+
+	assert.Equal(suite.T(), http.StatusBadRequest, get("?version=0").Code)
+	assert.Equal(suite.T(), http.StatusNotFound, get("?version=3").Code)
+}
+
+func TestFileHandlerSuite(t *testing.T) {
+	suite.Run(t, new(FileHandlerTestSuite))
+}
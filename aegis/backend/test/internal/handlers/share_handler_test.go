@@ -0,0 +1,189 @@
+package handlers_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/handlers"
+	"github.com/balkanid/aegis-backend/internal/middleware"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+const sharePassword = "Correct!Horse1"
+
+type ShareHandlerTestSuite struct {
+	suite.Suite
+	db           *gorm.DB
+	router       *gin.Engine
+	shareService *services.ShareService
+	userFile     *models.UserFile
+	content      []byte
+}
+
+func (suite *ShareHandlerTestSuite) SetupSuite() {
+	gin.SetMode(gin.TestMode)
+
+	db, err := gorm.Open(sqlite.Open("file:share_handler_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.File{}, &models.UserFile{}, &models.Folder{}, &models.StorageIntegrityIssue{}, &models.FileVersion{}, &models.FileShare{}, &models.DownloadTicketRedemption{})
+	suite.Require().NoError(err)
+
+	user := models.User{Username: "sharer", Email: "sharer@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(db.Create(&user).Error)
+
+	cryptoConfig := config.DefaultCryptoConfig()
+	cryptoConfig.PBKDF2Iterations = 10000
+	cryptoConfig.Argon2Time = 1
+	cryptoConfig.Argon2MemoryKiB = 8192
+	cryptoConfig.Argon2Threads = 1
+	cryptoManager, err := services.NewCryptoManagerWithConfig(cryptoConfig)
+	suite.Require().NoError(err)
+
+	cfg := &config.Config{JWTSecret: "share-handler-test-secret"}
+	dbService := database.NewDB(db)
+	authService := services.NewAuthService(cfg)
+	fileService := services.NewFileService(cfg, dbService, services.NewFileStorageServiceWithBackend(services.NewMemoryStorageBackend()), authService)
+	suite.shareService = services.NewShareService(dbService, "http://localhost", cryptoManager)
+	downloadTicketService := services.NewDownloadTicketService(cfg, dbService)
+
+	// Files are stored encrypted; the share unlocks the key
+	suite.content = []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	fileKey := bytes.Repeat([]byte{7}, 32)
+	sealed, err := cryptoManager.SealFile(suite.content, fileKey)
+	suite.Require().NoError(err)
+	contentHash := fmt.Sprintf("%x", sha256.Sum256(sealed))
+	suite.userFile, err = fileService.UploadFile(user.ID, "movie.bin", "application/octet-stream", contentHash, base64.StdEncoding.EncodeToString(fileKey), bytes.NewReader(sealed), int64(len(sealed)), nil)
+	suite.Require().NoError(err)
+
+	shareHandler := handlers.NewShareHandler(suite.shareService, fileService, downloadTicketService, cryptoManager, "/share")
+	suite.router = gin.New()
+	suite.router.Use(middleware.ErrorHandler())
+	suite.router.POST("/share/:token/access", shareHandler.AccessShare)
+	suite.router.GET("/share/:token/download", shareHandler.DownloadShare)
+}
+
+func (suite *ShareHandlerTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *ShareHandlerTestSuite) createShare(maxDownloads int) *models.FileShare {
+	fileShare, err := suite.shareService.CreateShare(suite.userFile.ID, sharePassword, maxDownloads, nil, nil)
+	suite.Require().NoError(err)
+	return fileShare
+}
+
+func (suite *ShareHandlerTestSuite) access(token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/share/"+token+"/access", strings.NewReader(`{"password":"`+sharePassword+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	return w
+}
+
+func (suite *ShareHandlerTestSuite) downloadURL(token string) string {
+	w := suite.access(token)
+	suite.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		DownloadURL string `json:"downloadUrl"`
+	}
+	suite.Require().NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	return body.DownloadURL
+}
+
+func (suite *ShareHandlerTestSuite) download(url, rangeHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	w := httptest.NewRecorder()
+	suite.router.ServeHTTP(w, req)
+	return w
+}
+
+func (suite *ShareHandlerTestSuite) downloadCount(fileShare *models.FileShare) int {
+	var reloaded models.FileShare
+	suite.Require().NoError(suite.db.First(&reloaded, fileShare.ID).Error)
+	return reloaded.DownloadCount
+}
+
+func (suite *ShareHandlerTestSuite) TestDownloadShare_ServesRanges() {
+	fileShare := suite.createShare(-1)
+	url := suite.downloadURL(fileShare.ShareToken)
+
+	w := suite.download(url, "")
+	assert.Equal(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), suite.content, w.Body.Bytes())
+	assert.Equal(suite.T(), "bytes", w.Header().Get("Accept-Ranges"))
+
+	w = suite.download(url, "bytes=-6")
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), "uvwxyz", w.Body.String())
+	assert.Equal(suite.T(), fmt.Sprintf("bytes 30-35/%d", len(suite.content)), w.Header().Get("Content-Range"))
+}
+
+func (suite *ShareHandlerTestSuite) TestDownloadShare_ChargedOncePerAccess() {
+	fileShare := suite.createShare(-1)
+	url := suite.downloadURL(fileShare.ShareToken)
+	assert.Equal(suite.T(), 1, suite.downloadCount(fileShare))
+
+	// A suffix range covering the whole file, and the file fetched in pieces, are all
+	// part of the same download
+	w := suite.download(url, fmt.Sprintf("bytes=-%d", len(suite.content)))
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), suite.content, w.Body.Bytes())
+	for _, rangeHeader := range []string{"bytes=0-", "bytes=1-", "bytes=10-19"} {
+		assert.Equal(suite.T(), http.StatusPartialContent, suite.download(url, rangeHeader).Code)
+	}
+	assert.Equal(suite.T(), 1, suite.downloadCount(fileShare))
+}
+
+func (suite *ShareHandlerTestSuite) TestAccessShare_DownloadLimit() {
+	fileShare := suite.createShare(1)
+	url := suite.downloadURL(fileShare.ShareToken)
+
+	// The limit is used up by the access, and the ticket it issued still works
+	w := suite.access(fileShare.ShareToken)
+	assert.NotEqual(suite.T(), http.StatusOK, w.Code)
+	assert.Equal(suite.T(), 1, suite.downloadCount(fileShare))
+
+	w = suite.download(url, "bytes=-6")
+	assert.Equal(suite.T(), http.StatusPartialContent, w.Code)
+	assert.Equal(suite.T(), "uvwxyz", w.Body.String())
+}
+
+func (suite *ShareHandlerTestSuite) TestDownloadShare_RequiresTicket() {
+	fileShare := suite.createShare(-1)
+	assert.Equal(suite.T(), http.StatusBadRequest, suite.download("/share/"+fileShare.ShareToken+"/download", "").Code)
+	assert.Equal(suite.T(), http.StatusUnauthorized, suite.download("/share/"+fileShare.ShareToken+"/download?ticket=forged", "").Code)
+
+	// Tickets only open the share they were issued for
+	other := suite.createShare(-1)
+	url := suite.downloadURL(other.ShareToken)
+	url = strings.Replace(url, other.ShareToken, fileShare.ShareToken, 1)
+	assert.Equal(suite.T(), http.StatusUnauthorized, suite.download(url, "").Code)
+}
+
+func TestShareHandlerSuite(t *testing.T) {
+	suite.Run(t, new(ShareHandlerTestSuite))
+}
@@ -0,0 +1,100 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/middleware"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+// newThrottledLoginRouter serves a login route that, like the GraphQL login, throttles
+// failed attempts by the request's client IP
+func newThrottledLoginRouter(t *testing.T, cfg *config.Config) (*gin.Engine, *gorm.DB) {
+	gin.SetMode(gin.TestMode)
+
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.LoginThrottle{}, &models.LoginAuditEvent{}))
+
+	dbService := database.NewDB(db)
+	authService := services.NewAuthService(cfg)
+	throttleService := services.NewLoginThrottleService(cfg, dbService, services.NewUserService(authService, dbService), nil)
+
+	router := gin.New()
+	require.NoError(t, middleware.TrustProxies(router, cfg))
+	router.POST("/login", func(c *gin.Context) {
+		if _, err := throttleService.Authenticate("nobody", "wrong", c.ClientIP()); err != nil {
+			c.String(http.StatusUnauthorized, err.Error())
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	return router, db
+}
+
+func login(router *gin.Engine, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	req.Header.Set("X-Real-IP", forwardedFor)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func ipThrottleSubjects(t *testing.T, db *gorm.DB) []string {
+	var subjects []string
+	require.NoError(t, db.Model(&models.LoginThrottle{}).Where("scope = ?", models.LoginThrottleScopeIP).Order("subject").Pluck("subject", &subjects).Error)
+	return subjects
+}
+
+func TestTrustProxies_SpoofedHeaderDoesNotChangeThrottleSubject(t *testing.T) {
+	cfg := &config.Config{
+		JWTSecret:              "test-secret-key",
+		LoginIPMaxFailures:     3,
+		LoginFailureWindowMins: 15,
+		LoginLockoutMinutes:    15,
+	}
+	router, db := newThrottledLoginRouter(t, cfg)
+
+	// Rotating the header neither spreads failures over many addresses nor lands them on
+	// someone else's
+	for _, forged := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		login(router, "203.0.113.9:4321", forged)
+	}
+	assert.Equal(t, []string{"203.0.113.9"}, ipThrottleSubjects(t, db))
+
+	w := login(router, "203.0.113.9:4321", "198.51.100.4")
+	assert.Contains(t, w.Body.String(), "too many failed login attempts from your network")
+}
+
+func TestTrustProxies_ConfiguredProxy(t *testing.T) {
+	cfg := &config.Config{
+		JWTSecret:              "test-secret-key",
+		TrustedProxies:         "10.0.0.0/8, 192.0.2.1",
+		LoginIPMaxFailures:     3,
+		LoginFailureWindowMins: 15,
+		LoginLockoutMinutes:    15,
+	}
+	router, db := newThrottledLoginRouter(t, cfg)
+
+	// Requests relayed by a trusted proxy are counted under the address it forwards
+	login(router, "10.1.2.3:4321", "198.51.100.1")
+	login(router, "192.0.2.1:4321", "198.51.100.2")
+	// Other clients cannot claim an address
+	login(router, "203.0.113.9:4321", "198.51.100.1")
+	assert.Equal(t, []string{"198.51.100.1", "198.51.100.2", "203.0.113.9"}, ipThrottleSubjects(t, db))
+
+	assert.Error(t, middleware.TrustProxies(gin.New(), &config.Config{TrustedProxies: "not-an-address"}))
+}
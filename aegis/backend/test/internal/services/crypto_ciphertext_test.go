@@ -0,0 +1,358 @@
+package services_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+func newTestCryptoManager(t *testing.T, configure func(*config.CryptoConfig)) *services.CryptoManager {
+	cryptoConfig := config.DefaultCryptoConfig()
+	cryptoConfig.PBKDF2Iterations = 10000
+	cryptoConfig.Argon2Time = 1
+	cryptoConfig.Argon2MemoryKiB = 8192
+	cryptoConfig.Argon2Threads = 1
+	if configure != nil {
+		configure(cryptoConfig)
+	}
+	manager, err := services.NewCryptoManagerWithConfig(cryptoConfig)
+	require.NoError(t, err)
+	return manager
+}
+
+func TestCiphertext_RoundTrip(t *testing.T) {
+	manager := newTestCryptoManager(t, nil)
+	key := bytes.Repeat([]byte{1}, 32)
+	plaintext := []byte("attack at dawn")
+
+	for _, algorithm := range []string{services.CipherNaClSecretbox, services.CipherAESGCM, services.CipherXChaCha20Poly1305} {
+		t.Run(algorithm, func(t *testing.T) {
+			sealed, err := manager.SealCiphertext(algorithm, key, plaintext, "share_password", services.KDFParams{})
+			require.NoError(t, err)
+			assert.True(t, services.IsSealedCiphertext(sealed))
+
+			header, _, err := services.ParseCiphertextHeader(sealed)
+			require.NoError(t, err)
+			assert.Equal(t, algorithm, header.Algorithm)
+			assert.Equal(t, "share_password", header.KeyID)
+			assert.Equal(t, services.KDFNone, header.KDF.Algorithm)
+			assert.Equal(t, algorithm, services.FileCipher(sealed))
+
+			opened, _, err := manager.OpenCiphertext(sealed, key)
+			require.NoError(t, err)
+			assert.Equal(t, plaintext, opened)
+
+			_, _, err = manager.OpenCiphertext(sealed, bytes.Repeat([]byte{2}, 32))
+			assert.Error(t, err)
+
+			// The ciphertext body is authenticated
+			tampered := append([]byte{}, sealed...)
+			tampered[len(tampered)-1] ^= 1
+			_, _, err = manager.OpenCiphertext(tampered, key)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCiphertext_HeaderIsAuthenticated(t *testing.T) {
+	manager := newTestCryptoManager(t, nil)
+	key := bytes.Repeat([]byte{1}, 32)
+
+	sealed, err := manager.SealCiphertext(services.CipherXChaCha20Poly1305, key, []byte("secret"), "a", services.KDFParams{})
+	require.NoError(t, err)
+	header, headerLen, err := services.ParseCiphertextHeader(sealed)
+	require.NoError(t, err)
+	require.Equal(t, "a", header.KeyID)
+
+	// Relabelling the key ID breaks decryption
+	relabelled := append([]byte{}, sealed...)
+	relabelled[headerLen-len(header.Nonce)-2] = 'b'
+	_, _, err = manager.OpenCiphertext(relabelled, key)
+	assert.Error(t, err)
+}
+
+func TestCiphertext_RejectsMalformedHeaders(t *testing.T) {
+	manager := newTestCryptoManager(t, nil)
+	sealed, err := manager.SealCiphertext(services.CipherAESGCM, bytes.Repeat([]byte{1}, 32), []byte("secret"), "", services.KDFParams{})
+	require.NoError(t, err)
+
+	_, _, err = services.ParseCiphertextHeader([]byte("not sealed"))
+	assert.Error(t, err)
+	_, _, err = services.ParseCiphertextHeader(sealed[:8])
+	assert.Error(t, err)
+
+	unknownVersion := append([]byte{}, sealed...)
+	unknownVersion[4] = 99
+	_, _, err = services.ParseCiphertextHeader(unknownVersion)
+	assert.Error(t, err)
+
+	unknownCipher := append([]byte{}, sealed...)
+	unknownCipher[5] = 99
+	_, _, err = services.ParseCiphertextHeader(unknownCipher)
+	assert.Error(t, err)
+}
+
+func TestDecryptFileData_DispatchesOnHeader(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	plaintext := []byte("file contents")
+
+	for _, algorithm := range []string{services.CipherNaClSecretbox, services.CipherAESGCM} {
+		manager := newTestCryptoManager(t, func(c *config.CryptoConfig) { c.FileEncryptionAlgorithm = algorithm })
+		sealed, err := manager.SealFile(plaintext, key)
+		require.NoError(t, err)
+		assert.Equal(t, algorithm, services.FileCipher(sealed))
+
+		decrypted, err := manager.DecryptFileData(sealed, key)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	}
+
+	// Files uploaded by browsers are secretbox with the nonce prepended
+	manager := newTestCryptoManager(t, nil)
+	var nonce [24]byte
+	var secretboxKey [32]byte
+	copy(nonce[:], bytes.Repeat([]byte{4}, 24))
+	copy(secretboxKey[:], key)
+	legacy := secretbox.Seal(nonce[:], plaintext, &nonce, &secretboxKey)
+	assert.Equal(t, services.CipherNaClSecretbox, services.FileCipher(legacy))
+
+	decrypted, err := manager.DecryptFileData(legacy, key)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestCryptoManager_SealsKeysAndPasswords(t *testing.T) {
+	manager := newTestCryptoManager(t, nil)
+
+	envelopeKey, err := manager.GenerateEnvelopeKey()
+	require.NoError(t, err)
+	encryptedEnvelopeKey, salt, iv, err := manager.EncryptEnvelopeKey(envelopeKey, "correct horse")
+	require.NoError(t, err)
+	assert.Empty(t, salt)
+	assert.Empty(t, iv)
+
+	sealed, err := base64.StdEncoding.DecodeString(encryptedEnvelopeKey)
+	require.NoError(t, err)
+	header, _, err := services.ParseCiphertextHeader(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, services.CipherXChaCha20Poly1305, header.Algorithm)
+	assert.Equal(t, services.KDFArgon2id, header.KDF.Algorithm)
+	assert.EqualValues(t, 1, header.KDF.Iterations)
+	assert.EqualValues(t, 8192, header.KDF.MemoryKiB)
+	assert.EqualValues(t, 1, header.KDF.Threads)
+	assert.Len(t, header.KDF.Salt, 16)
+
+	// The parameters recorded in the header are used, not the current setting
+	stronger := newTestCryptoManager(t, func(c *config.CryptoConfig) { c.Argon2Time = 2 })
+	decrypted, err := stronger.DecryptEnvelopeKey(encryptedEnvelopeKey, "", "", "", "correct horse")
+	require.NoError(t, err)
+	assert.Equal(t, envelopeKey, decrypted)
+	_, err = stronger.DecryptEnvelopeKey(encryptedEnvelopeKey, "", "", "", "wrong horse")
+	assert.Error(t, err)
+
+	fileKey, err := manager.GenerateFileKey()
+	require.NoError(t, err)
+	encryptedFileKey, fileKeyIV, err := manager.EncryptFileKey(fileKey, envelopeKey)
+	require.NoError(t, err)
+	assert.Empty(t, fileKeyIV)
+	decrypted, err = manager.DecryptFileKey(encryptedFileKey, fileKeyIV, envelopeKey)
+	require.NoError(t, err)
+	assert.Equal(t, fileKey, decrypted)
+
+	encryptedPassword, passwordIV, keyVersion, err := manager.EncryptSharePassword("share password")
+	require.NoError(t, err)
+	assert.Empty(t, passwordIV)
+	assert.Equal(t, 1, keyVersion)
+	sealed, err = base64.StdEncoding.DecodeString(encryptedPassword)
+	require.NoError(t, err)
+	header, _, err = services.ParseCiphertextHeader(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, services.ServiceKeySharePassword, header.KeyID)
+	password, err := manager.DecryptSharePassword(encryptedPassword, passwordIV, keyVersion)
+	require.NoError(t, err)
+	assert.Equal(t, "share password", password)
+}
+
+func TestCryptoManager_DecryptsLegacyLayouts(t *testing.T) {
+	manager := newTestCryptoManager(t, nil)
+	envelopeKey := bytes.Repeat([]byte{5}, 32)
+	fileKey := bytes.Repeat([]byte{6}, 32)
+
+	// Envelope keys: hex AES-GCM under a PBKDF2 key, with separate salt and IV
+	salt := bytes.Repeat([]byte{7}, 16)
+	iv := bytes.Repeat([]byte{8}, 12)
+	encrypted, err := manager.EncryptWithAESGCM(envelopeKey, manager.DeriveKeyFromPassword("correct horse", salt), iv)
+	require.NoError(t, err)
+	decrypted, err := manager.DecryptEnvelopeKey(hex.EncodeToString(encrypted), hex.EncodeToString(salt), hex.EncodeToString(iv), "", "correct horse")
+	require.NoError(t, err)
+	assert.Equal(t, envelopeKey, decrypted)
+	assert.True(t, manager.IsDeprecatedText(hex.EncodeToString(encrypted)))
+
+	// Once recorded, the PBKDF2 setting they were derived with survives a change to it
+	stronger := newTestCryptoManager(t, func(c *config.CryptoConfig) { c.PBKDF2Iterations = 20000 })
+	_, err = stronger.DecryptEnvelopeKey(hex.EncodeToString(encrypted), hex.EncodeToString(salt), hex.EncodeToString(iv), "", "correct horse")
+	assert.Error(t, err)
+	decrypted, err = stronger.DecryptEnvelopeKey(hex.EncodeToString(encrypted), hex.EncodeToString(salt), hex.EncodeToString(iv), manager.LegacyKDFParams(), "correct horse")
+	require.NoError(t, err)
+	assert.Equal(t, envelopeKey, decrypted)
+
+	// File keys: hex AES-GCM under the envelope key
+	encrypted, err = manager.EncryptWithAESGCM(fileKey, envelopeKey, iv)
+	require.NoError(t, err)
+	decrypted, err = manager.DecryptFileKey(hex.EncodeToString(encrypted), hex.EncodeToString(iv), envelopeKey)
+	require.NoError(t, err)
+	assert.Equal(t, fileKey, decrypted)
+
+	// Share passwords: base64 AES-GCM under the service key
+	encrypted, err = manager.EncryptWithAESGCM([]byte("share password"), manager.GetConfig().SharePasswordKey, iv)
+	require.NoError(t, err)
+	password, err := manager.DecryptSharePassword(base64.StdEncoding.EncodeToString(encrypted), base64.StdEncoding.EncodeToString(iv), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "share password", password)
+}
+
+func TestKDFParams_FormatAndParse(t *testing.T) {
+	for _, kdf := range []services.KDFParams{
+		{Algorithm: services.KDFPBKDF2SHA256, Iterations: 100000},
+		{Algorithm: services.KDFArgon2id, Iterations: 3, MemoryKiB: 65536, Threads: 4},
+	} {
+		text := services.FormatKDFParams(kdf)
+		parsed, err := services.ParseKDFParams(text)
+		require.NoError(t, err)
+		assert.Equal(t, kdf, parsed)
+	}
+	assert.Equal(t, "pbkdf2-sha256$i=100000", services.FormatKDFParams(services.KDFParams{Algorithm: services.KDFPBKDF2SHA256, Iterations: 100000}))
+
+	for _, text := range []string{"", "scrypt$n=1", "pbkdf2-sha256", "pbkdf2-sha256$i=x", "argon2id$t=3,m=65536", "argon2id$t=3,m=65536,p=4,x=1"} {
+		_, err := services.ParseKDFParams(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestCryptoManager_NeedsKDFUpgrade(t *testing.T) {
+	manager := newTestCryptoManager(t, nil)
+	current, _, _, err := manager.EncryptEnvelopeKey(bytes.Repeat([]byte{1}, 32), "correct horse")
+	require.NoError(t, err)
+	assert.False(t, manager.NeedsKDFUpgrade(current))
+
+	pbkdf2 := newTestCryptoManager(t, func(c *config.CryptoConfig) { c.KDFAlgorithm = services.KDFPBKDF2SHA256 })
+	old, _, _, err := pbkdf2.EncryptEnvelopeKey(bytes.Repeat([]byte{1}, 32), "correct horse")
+	require.NoError(t, err)
+	assert.False(t, pbkdf2.NeedsKDFUpgrade(old))
+	assert.True(t, manager.NeedsKDFUpgrade(old))
+
+	// Raising the cost upgrades keys derived with less, lowering it does not
+	assert.True(t, newTestCryptoManager(t, func(c *config.CryptoConfig) { c.Argon2MemoryKiB = 16384 }).NeedsKDFUpgrade(current))
+	assert.False(t, newTestCryptoManager(t, func(c *config.CryptoConfig) { c.Argon2Threads = 2 }).NeedsKDFUpgrade(current))
+	assert.True(t, manager.NeedsKDFUpgrade(hex.EncodeToString([]byte("legacy"))))
+}
+
+func TestCryptoManager_DeprecatedAlgorithms(t *testing.T) {
+	manager := newTestCryptoManager(t, func(c *config.CryptoConfig) {
+		c.KeyEncryptionAlgorithm = services.CipherAESGCM
+	})
+	encryptedPassword, _, _, err := manager.EncryptSharePassword("share password")
+	require.NoError(t, err)
+	assert.False(t, manager.IsDeprecatedText(encryptedPassword))
+
+	deprecating := newTestCryptoManager(t, func(c *config.CryptoConfig) {
+		c.SharePasswordKey = manager.GetConfig().SharePasswordKey
+		c.DeprecatedAlgorithms = []string{services.CipherAESGCM}
+	})
+	assert.True(t, deprecating.IsDeprecatedAlgorithm(services.CipherAESGCM))
+	assert.True(t, deprecating.IsDeprecatedText(encryptedPassword))
+
+	// Deprecated ciphertexts still decrypt until they are migrated
+	password, err := deprecating.DecryptSharePassword(encryptedPassword, "", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "share password", password)
+}
+
+func TestValidateCryptoConfig_Algorithms(t *testing.T) {
+	cryptoConfig := config.DefaultCryptoConfig()
+	require.NoError(t, config.ValidateCryptoConfig(cryptoConfig))
+
+	cryptoConfig.DeprecatedAlgorithms = []string{"rot13"}
+	assert.Error(t, config.ValidateCryptoConfig(cryptoConfig))
+
+	// The algorithms in use cannot be deprecated
+	cryptoConfig.DeprecatedAlgorithms = []string{"xchacha20-poly1305"}
+	assert.Error(t, config.ValidateCryptoConfig(cryptoConfig))
+	cryptoConfig.DeprecatedAlgorithms = []string{"nacl-secretbox"}
+	assert.Error(t, config.ValidateCryptoConfig(cryptoConfig))
+
+	cryptoConfig.FileEncryptionAlgorithm = "aes-gcm"
+	require.NoError(t, config.ValidateCryptoConfig(cryptoConfig))
+
+	// Browsers cannot decrypt XChaCha20-Poly1305 files
+	cryptoConfig.FileEncryptionAlgorithm = "xchacha20-poly1305"
+	assert.Error(t, config.ValidateCryptoConfig(cryptoConfig))
+}
+
+func TestValidateCryptoConfig_KDF(t *testing.T) {
+	cryptoConfig := config.DefaultCryptoConfig()
+	assert.Equal(t, "argon2id", cryptoConfig.KDFAlgorithm)
+
+	cryptoConfig.Argon2MemoryKiB = 1024
+	assert.Error(t, config.ValidateCryptoConfig(cryptoConfig))
+
+	// Argon2id parameters are not checked when PBKDF2 is selected
+	cryptoConfig.KDFAlgorithm = "pbkdf2-sha256"
+	require.NoError(t, config.ValidateCryptoConfig(cryptoConfig))
+
+	cryptoConfig.KDFAlgorithm = "scrypt"
+	assert.Error(t, config.ValidateCryptoConfig(cryptoConfig))
+}
+
+func TestDecryptFileToTemp(t *testing.T) {
+	manager := newTestCryptoManager(t, nil)
+	key := bytes.Repeat([]byte{4}, 32)
+	plaintext := bytes.Repeat([]byte("range me "), 1000)
+
+	legacy, err := manager.EncryptFile(plaintext, key)
+	require.NoError(t, err)
+	files := map[string][]byte{"legacy": append(legacy.Nonce, legacy.EncryptedData...)}
+	for _, algorithm := range []string{services.CipherNaClSecretbox, services.CipherAESGCM, services.CipherXChaCha20Poly1305} {
+		files[algorithm], err = manager.SealCiphertext(algorithm, key, plaintext, "", services.KDFParams{})
+		require.NoError(t, err)
+	}
+
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			decrypted, err := manager.DecryptFileToTemp(bytes.NewReader(data), key)
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(plaintext)), decrypted.Size)
+			got, err := io.ReadAll(decrypted)
+			require.NoError(t, err)
+			assert.Equal(t, plaintext, got)
+
+			// The temporary file is removed when closed
+			require.NoError(t, decrypted.Close())
+			_, err = os.Stat(decrypted.Name())
+			assert.True(t, os.IsNotExist(err))
+
+			// Tampered files are rejected as a whole
+			tampered := append([]byte(nil), data...)
+			tampered[len(tampered)-1] ^= 1
+			_, err = manager.DecryptFileToTemp(bytes.NewReader(tampered), key)
+			assert.Error(t, err)
+		})
+	}
+
+	empty, err := manager.SealFile(nil, key)
+	require.NoError(t, err)
+	decrypted, err := manager.DecryptFileToTemp(bytes.NewReader(empty), key)
+	require.NoError(t, err)
+	defer decrypted.Close()
+	assert.Equal(t, int64(0), decrypted.Size)
+}
@@ -0,0 +1,204 @@
+package services_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type DownloadTicketServiceTestSuite struct {
+	suite.Suite
+	db      *gorm.DB
+	cfg     *config.Config
+	tickets *services.DownloadTicketService
+}
+
+func (suite *DownloadTicketServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:download_ticket_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.DownloadTicketRedemption{}, &models.User{}, &models.File{}, &models.UserFile{})
+	suite.Require().NoError(err)
+}
+
+func (suite *DownloadTicketServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *DownloadTicketServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM download_ticket_redemptions")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM files")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.cfg = &config.Config{JWTSecret: "test-secret-key-that-is-long-enough-for-hs256"}
+	suite.tickets = services.NewDownloadTicketService(suite.cfg, database.NewDB(suite.db))
+}
+
+func (suite *DownloadTicketServiceTestSuite) assertInvalidTicket(err error) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), apperrors.ErrCodeUnauthorized, appErr.Code)
+}
+
+func (suite *DownloadTicketServiceTestSuite) TestFileTicket() {
+	ticket, err := suite.tickets.IssueFileTicket(7, 42, 2)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), ticket, url.QueryEscape(ticket), "tickets must not need escaping in URLs")
+
+	redeemed, err := suite.tickets.Redeem(ticket, services.DownloadTicketFile)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), uint(7), redeemed.UserID)
+	assert.Equal(suite.T(), uint(42), redeemed.UserFileID)
+	assert.Equal(suite.T(), 2, redeemed.Version)
+	assert.WithinDuration(suite.T(), time.Now().Add(5*time.Minute), time.Unix(redeemed.ExpiresAt, 0), 5*time.Second)
+
+	// Tickets are reusable until they expire unless configured otherwise
+	_, err = suite.tickets.Redeem(ticket, services.DownloadTicketFile)
+	assert.NoError(suite.T(), err)
+
+	// A file ticket does not open a share
+	_, err = suite.tickets.Redeem(ticket, services.DownloadTicketShare)
+	suite.assertInvalidTicket(err)
+}
+
+func (suite *DownloadTicketServiceTestSuite) TestRedeem_RejectsForgedTickets() {
+	ticket, err := suite.tickets.IssueFileTicket(7, 42, 0)
+	suite.Require().NoError(err)
+	payload, signature, _ := strings.Cut(ticket, ".")
+
+	// Re-target the ticket at another file, keeping the signature
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	suite.Require().NoError(err)
+	var claims map[string]interface{}
+	suite.Require().NoError(json.Unmarshal(decoded, &claims))
+	claims["file"] = 43
+	tampered, err := json.Marshal(claims)
+	suite.Require().NoError(err)
+	retargeted := base64.RawURLEncoding.EncodeToString(tampered) + "." + signature
+
+	// Signed with another server's secret
+	other := services.NewDownloadTicketService(&config.Config{JWTSecret: "another-secret-key-that-is-long-enough"}, database.NewDB(suite.db))
+	foreign, err := other.IssueFileTicket(7, 42, 0)
+	suite.Require().NoError(err)
+
+	for _, forged := range []string{"", payload, payload + ".", retargeted, foreign, "x" + ticket} {
+		_, err := suite.tickets.Redeem(forged, services.DownloadTicketFile)
+		suite.assertInvalidTicket(err)
+	}
+}
+
+func (suite *DownloadTicketServiceTestSuite) TestRedeem_Expired() {
+	suite.cfg.DownloadTicketTTLSeconds = 1
+	tickets := services.NewDownloadTicketService(suite.cfg, database.NewDB(suite.db))
+	ticket, err := tickets.IssueFileTicket(7, 42, 0)
+	suite.Require().NoError(err)
+
+	assert.Eventually(suite.T(), func() bool {
+		_, err := tickets.Redeem(ticket, services.DownloadTicketFile)
+		return err != nil
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func (suite *DownloadTicketServiceTestSuite) TestSingleUse() {
+	suite.cfg.DownloadTicketSingleUse = true
+	tickets := services.NewDownloadTicketService(suite.cfg, database.NewDB(suite.db))
+	ticket, err := tickets.IssueFileTicket(7, 42, 0)
+	suite.Require().NoError(err)
+
+	_, err = tickets.Redeem(ticket, services.DownloadTicketFile)
+	suite.Require().NoError(err)
+	_, err = tickets.Redeem(ticket, services.DownloadTicketFile)
+	suite.assertInvalidTicket(err)
+
+	// Another ticket for the same file is unaffected
+	second, err := tickets.IssueFileTicket(7, 42, 0)
+	suite.Require().NoError(err)
+	_, err = tickets.Redeem(second, services.DownloadTicketFile)
+	assert.NoError(suite.T(), err)
+
+	// Used tickets are forgotten once they have expired
+	cleaned, err := tickets.CleanupExpired()
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), cleaned)
+	suite.db.Model(&models.DownloadTicketRedemption{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute))
+	cleaned, err = tickets.CleanupExpired()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), int64(2), cleaned)
+}
+
+func (suite *DownloadTicketServiceTestSuite) TestShareTicket() {
+	fileKey := []byte("0123456789abcdef0123456789abcdef")
+	ticket, err := suite.tickets.IssueShareTicket(5, 0, fileKey)
+	suite.Require().NoError(err)
+
+	// Neither the key nor its encoding appears in the ticket
+	assert.NotContains(suite.T(), ticket, base64.RawURLEncoding.EncodeToString(fileKey))
+	payload, _, _ := strings.Cut(ticket, ".")
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	suite.Require().NoError(err)
+	assert.NotContains(suite.T(), string(decoded), string(fileKey))
+	assert.NotContains(suite.T(), string(decoded), base64.StdEncoding.EncodeToString(fileKey))
+
+	redeemed, err := suite.tickets.Redeem(ticket, services.DownloadTicketShare)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), uint(5), redeemed.FileShareID)
+	key, err := suite.tickets.FileKey(redeemed)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), fileKey, key)
+
+	_, err = suite.tickets.Redeem(ticket, services.DownloadTicketFile)
+	suite.assertInvalidTicket(err)
+}
+
+func (suite *DownloadTicketServiceTestSuite) TestFileService_DownloadURLs() {
+	user := models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&user).Error)
+	file := models.File{ContentHash: strings.Repeat("a", 64), SizeBytes: 5, StoragePath: "objects/a", RefCount: 1}
+	suite.Require().NoError(suite.db.Create(&file).Error)
+	userFile := models.UserFile{UserID: user.ID, FileID: file.ID, Filename: "a.txt", MimeType: "text/plain", EncryptionKey: "key", CurrentVersion: 1}
+	suite.Require().NoError(suite.db.Create(&userFile).Error)
+
+	authService := services.NewAuthService(suite.cfg)
+	fileService := services.NewFileService(suite.cfg, database.NewDB(suite.db), nil, authService)
+
+	downloadURL, err := fileService.GetFileDownloadURL(context.Background(), &user, userFile.ID)
+	suite.Require().NoError(err)
+	parsed, err := url.Parse(downloadURL)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), parsed.Query().Get("token"), "no login token in the URL")
+
+	// The ticket is not a login token
+	_, err = authService.ParseToken(parsed.Query().Get("ticket"))
+	assert.Error(suite.T(), err)
+
+	redeemed, err := suite.tickets.Redeem(parsed.Query().Get("ticket"), services.DownloadTicketFile)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), user.ID, redeemed.UserID)
+	assert.Equal(suite.T(), userFile.ID, redeemed.UserFileID)
+	assert.Zero(suite.T(), redeemed.Version)
+}
+
+func TestDownloadTicketServiceSuite(t *testing.T) {
+	suite.Run(t, new(DownloadTicketServiceTestSuite))
+}
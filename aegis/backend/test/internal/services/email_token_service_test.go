@@ -0,0 +1,221 @@
+package services_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type EmailTokenServiceTestSuite struct {
+	suite.Suite
+	db                *gorm.DB
+	mail              *services.MemoryMailSender
+	emailTokenService *services.EmailTokenService
+	sessionService    *services.SessionService
+	user              models.User
+}
+
+func (suite *EmailTokenServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:email_token_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.EmailToken{}, &models.Session{}, &models.RefreshToken{},
+		&models.LoginThrottle{}, &models.LoginAuditEvent{})
+	suite.Require().NoError(err)
+}
+
+func (suite *EmailTokenServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *EmailTokenServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM refresh_tokens")
+	suite.db.Exec("DELETE FROM sessions")
+	suite.db.Exec("DELETE FROM email_tokens")
+	suite.db.Exec("DELETE FROM users")
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("OldPassword123!"), bcrypt.MinCost)
+	suite.Require().NoError(err)
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: string(passwordHash), StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+
+	cfg := &config.Config{
+		JWTSecret:   "test-secret-key-that-is-long-enough-for-hs256",
+		FrontendURL: "https://aegis.example.com/",
+	}
+	dbService := database.NewDB(suite.db)
+	authService := services.NewAuthService(cfg)
+	refreshTokenService := services.NewRefreshTokenService(cfg, dbService, authService)
+	suite.sessionService = services.NewSessionService(dbService, authService, refreshTokenService)
+	suite.mail = services.NewMemoryMailSender()
+	suite.emailTokenService = services.NewEmailTokenService(cfg, dbService, suite.mail)
+}
+
+// lastToken returns the token from the link in the most recent message.
+func (suite *EmailTokenServiceTestSuite) lastToken(path string) string {
+	messages := suite.mail.Messages()
+	suite.Require().NotEmpty(messages)
+	body := messages[len(messages)-1].Body
+
+	prefix := "https://aegis.example.com" + path + "?token="
+	start := strings.Index(body, prefix)
+	suite.Require().GreaterOrEqual(start, 0, "link not found in %q", body)
+	encoded := strings.Fields(body[start+len(prefix):])[0]
+	token, err := url.QueryUnescape(encoded)
+	suite.Require().NoError(err)
+	return token
+}
+
+func (suite *EmailTokenServiceTestSuite) assertInvalidLink(err error) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), apperrors.ErrCodeUnauthorized, appErr.Code)
+}
+
+func (suite *EmailTokenServiceTestSuite) TestVerifyEmail() {
+	suite.Require().NoError(suite.emailTokenService.SendVerificationEmail(&suite.user))
+
+	messages := suite.mail.Messages()
+	suite.Require().Len(messages, 1)
+	assert.Equal(suite.T(), "owner@example.com", messages[0].To)
+	token := suite.lastToken("/verify-email")
+
+	user, err := suite.emailTokenService.VerifyEmail(token)
+	suite.Require().NoError(err)
+	assert.True(suite.T(), user.EmailVerified)
+
+	var reloaded models.User
+	suite.Require().NoError(suite.db.First(&reloaded, suite.user.ID).Error)
+	assert.True(suite.T(), reloaded.EmailVerified)
+
+	// Links can only be used once
+	_, err = suite.emailTokenService.VerifyEmail(token)
+	suite.assertInvalidLink(err)
+
+	err = suite.emailTokenService.SendVerificationEmail(&reloaded)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *EmailTokenServiceTestSuite) TestVerifyEmail_RejectsForgedTokens() {
+	suite.Require().NoError(suite.emailTokenService.SendVerificationEmail(&suite.user))
+	token := suite.lastToken("/verify-email")
+	value, signature, _ := strings.Cut(token, ".")
+
+	for _, forged := range []string{"", value, value + ".", value + "." + strings.ToUpper(signature), "x" + token} {
+		_, err := suite.emailTokenService.VerifyEmail(forged)
+		suite.assertInvalidLink(err)
+	}
+
+	// A verification token cannot be redeemed as a reset token
+	err := suite.emailTokenService.ResetPassword(token, "NewPassword456!")
+	suite.assertInvalidLink(err)
+
+	_, err = suite.emailTokenService.VerifyEmail(token)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *EmailTokenServiceTestSuite) TestVerifyEmail_Expired() {
+	suite.Require().NoError(suite.emailTokenService.SendVerificationEmail(&suite.user))
+	token := suite.lastToken("/verify-email")
+
+	suite.db.Model(&models.EmailToken{}).Where("user_id = ?", suite.user.ID).Update("expires_at", time.Now().Add(-time.Minute))
+
+	_, err := suite.emailTokenService.VerifyEmail(token)
+	suite.assertInvalidLink(err)
+}
+
+func (suite *EmailTokenServiceTestSuite) TestVerifyEmail_AddressChanged() {
+	suite.Require().NoError(suite.emailTokenService.SendVerificationEmail(&suite.user))
+	token := suite.lastToken("/verify-email")
+
+	suite.Require().NoError(suite.db.Model(&suite.user).Update("email", "new@example.com").Error)
+
+	_, err := suite.emailTokenService.VerifyEmail(token)
+	assert.Error(suite.T(), err)
+
+	var reloaded models.User
+	suite.Require().NoError(suite.db.First(&reloaded, suite.user.ID).Error)
+	assert.False(suite.T(), reloaded.EmailVerified)
+}
+
+func (suite *EmailTokenServiceTestSuite) TestSendVerificationEmail_Throttled() {
+	suite.Require().NoError(suite.emailTokenService.SendVerificationEmail(&suite.user))
+	first := suite.lastToken("/verify-email")
+
+	err := suite.emailTokenService.SendVerificationEmail(&suite.user)
+	assert.Error(suite.T(), err)
+	assert.Len(suite.T(), suite.mail.Messages(), 1)
+
+	// Once the interval has passed a new link replaces the old one
+	suite.db.Model(&models.EmailToken{}).Where("user_id = ?", suite.user.ID).Update("created_at", time.Now().Add(-2*time.Minute))
+	suite.Require().NoError(suite.emailTokenService.SendVerificationEmail(&suite.user))
+	second := suite.lastToken("/verify-email")
+
+	_, err = suite.emailTokenService.VerifyEmail(first)
+	suite.assertInvalidLink(err)
+	_, err = suite.emailTokenService.VerifyEmail(second)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *EmailTokenServiceTestSuite) TestRequestPasswordReset_UnknownEmail() {
+	suite.Require().NoError(suite.emailTokenService.RequestPasswordReset("nobody@example.com"))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(suite.T(), suite.mail.Messages())
+
+	var count int64
+	suite.db.Model(&models.EmailToken{}).Count(&count)
+	assert.Zero(suite.T(), count)
+}
+
+func (suite *EmailTokenServiceTestSuite) TestResetPassword() {
+	_, _, err := suite.sessionService.StartSession(&suite.user, "Laptop", "203.0.113.7")
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.emailTokenService.RequestPasswordReset("owner@example.com"))
+	assert.Eventually(suite.T(), func() bool { return len(suite.mail.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	token := suite.lastToken("/reset-password")
+
+	// A rejected password leaves the link usable
+	err = suite.emailTokenService.ResetPassword(token, "weak")
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), apperrors.ErrCodeInvalidArgument, appErr.Code)
+
+	suite.Require().NoError(suite.emailTokenService.ResetPassword(token, "NewPassword456!"))
+
+	var reloaded models.User
+	suite.Require().NoError(suite.db.First(&reloaded, suite.user.ID).Error)
+	assert.NoError(suite.T(), bcrypt.CompareHashAndPassword([]byte(reloaded.PasswordHash), []byte("NewPassword456!")))
+	assert.True(suite.T(), reloaded.EmailVerified)
+
+	sessions, err := suite.sessionService.ListSessions(suite.user.ID, "")
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), sessions)
+
+	err = suite.emailTokenService.ResetPassword(token, "AnotherPassword789!")
+	suite.assertInvalidLink(err)
+}
+
+func TestEmailTokenServiceSuite(t *testing.T) {
+	suite.Run(t, new(EmailTokenServiceTestSuite))
+}
@@ -41,6 +41,8 @@ func (suite *FileServiceTestSuite) SetupSuite() {
 		&models.File{},
 		&models.UserFile{},
 		&models.Folder{},
+		&models.StorageIntegrityIssue{},
+		&models.FileVersion{},
 	)
 	suite.Require().NoError(err)
 
@@ -505,8 +507,8 @@ func (suite *FileServiceTestSuite) TestUploadFileFromMap_Success_WithFolderIDAsS
 	uploadData := map[string]interface{}{
 		"filename":      "test_upload.txt",
 		"mime_type":     "text/plain",
-		"size_bytes":    1024.0,
-		"content_hash":  "test_hash_upload",
+		"size_bytes":    float64(len("test file content")),
+		"content_hash":  hashOf([]byte("test file content")),
 		"encrypted_key": "test_encryption_key_upload",
 		"folder_id":     "1", // String representation of folder ID
 		"file_data":     base64.StdEncoding.EncodeToString([]byte("test file content")),
@@ -527,8 +529,8 @@ func (suite *FileServiceTestSuite) TestUploadFileFromMap_Success_WithoutFolderID
 	uploadData := map[string]interface{}{
 		"filename":      "test_upload_root.txt",
 		"mime_type":     "text/plain",
-		"size_bytes":    1024.0,
-		"content_hash":  "test_hash_upload_root",
+		"size_bytes":    float64(len("test file content")),
+		"content_hash":  hashOf([]byte("test file content")),
 		"encrypted_key": "test_encryption_key_upload",
 		"file_data":     base64.StdEncoding.EncodeToString([]byte("test file content")),
 	}
@@ -547,8 +549,8 @@ func (suite *FileServiceTestSuite) TestUploadFileFromMap_InvalidFolderID() {
 	uploadData := map[string]interface{}{
 		"filename":      "test_upload_invalid.txt",
 		"mime_type":     "text/plain",
-		"size_bytes":    1024.0,
-		"content_hash":  "test_hash_upload_invalid",
+		"size_bytes":    float64(len("test file content")),
+		"content_hash":  hashOf([]byte("test file content")),
 		"encrypted_key": "test_encryption_key_upload",
 		"folder_id":     "invalid_string", // Invalid folder ID
 		"file_data":     base64.StdEncoding.EncodeToString([]byte("test file content")),
@@ -565,8 +567,8 @@ func (suite *FileServiceTestSuite) TestUploadFileFromMap_FolderNotFound() {
 	uploadData := map[string]interface{}{
 		"filename":      "test_upload_missing.txt",
 		"mime_type":     "text/plain",
-		"size_bytes":    1024.0,
-		"content_hash":  "test_hash_upload_missing",
+		"size_bytes":    float64(len("test file content")),
+		"content_hash":  hashOf([]byte("test file content")),
 		"encrypted_key": "test_encryption_key_upload",
 		"folder_id":     "99999", // Non-existent folder ID
 		"file_data":     base64.StdEncoding.EncodeToString([]byte("test file content")),
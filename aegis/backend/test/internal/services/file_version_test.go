@@ -0,0 +1,233 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type FileVersionTestSuite struct {
+	suite.Suite
+	db          *gorm.DB
+	backend     *services.MemoryStorageBackend
+	fileService *services.FileService
+	userService *services.UserService
+	owner       models.User
+}
+
+func (suite *FileVersionTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:file_version_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.File{},
+		&models.UserFile{},
+		&models.Folder{},
+		&models.RoomFile{},
+		&models.RoomMember{},
+		&models.StorageIntegrityIssue{},
+		&models.FileVersion{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *FileVersionTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *FileVersionTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM file_versions")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM files")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.owner = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.owner).Error)
+
+	cfg := &config.Config{}
+	dbService := database.NewDB(suite.db)
+	authService := services.NewAuthService(cfg)
+	suite.backend = services.NewMemoryStorageBackend()
+	suite.fileService = services.NewFileService(cfg, dbService, services.NewFileStorageServiceWithBackend(suite.backend), authService)
+	suite.userService = services.NewUserService(authService, dbService)
+}
+
+func (suite *FileVersionTestSuite) upload(filename, encryptionKey string, content []byte) *models.UserFile {
+	userFile, err := suite.fileService.UploadFile(suite.owner.ID, filename, "text/plain", hashOf(content), encryptionKey, bytes.NewReader(content), int64(len(content)), nil)
+	suite.Require().NoError(err)
+	return userFile
+}
+
+func (suite *FileVersionTestSuite) readVersion(userFileID uint, versionNumber int) []byte {
+	reader, _, err := suite.fileService.StreamFileVersion(suite.owner.ID, userFileID, versionNumber)
+	suite.Require().NoError(err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	suite.Require().NoError(err)
+	return data
+}
+
+func (suite *FileVersionTestSuite) refCount(fileID uint) int64 {
+	var file models.File
+	suite.Require().NoError(suite.db.Unscoped().First(&file, fileID).Error)
+	return file.RefCount
+}
+
+func (suite *FileVersionTestSuite) TestUploadOverExistingName_AddsVersion() {
+	first := suite.upload("notes.txt", "key-1", []byte("first draft"))
+	second := suite.upload("notes.txt", "key-2", []byte("second draft"))
+
+	assert.Equal(suite.T(), first.ID, second.ID)
+	assert.Equal(suite.T(), 2, second.CurrentVersion)
+	assert.NotEqual(suite.T(), first.FileID, second.FileID)
+	assert.Equal(suite.T(), "key-2", second.EncryptionKey)
+
+	versions, err := suite.fileService.GetFileVersions(suite.owner.ID, first.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(versions, 2)
+	assert.True(suite.T(), versions[0].IsCurrent)
+	assert.Equal(suite.T(), 2, versions[0].VersionNumber)
+	assert.Equal(suite.T(), second.FileID, versions[0].FileID)
+	assert.False(suite.T(), versions[1].IsCurrent)
+	assert.Equal(suite.T(), 1, versions[1].VersionNumber)
+	assert.Equal(suite.T(), first.FileID, versions[1].FileID)
+	assert.Equal(suite.T(), "key-1", versions[1].EncryptionKey)
+	assert.Equal(suite.T(), int64(len("first draft")), versions[1].File.SizeBytes)
+
+	// The archived version still holds its reference
+	assert.Equal(suite.T(), int64(1), suite.refCount(first.FileID))
+	assert.Equal(suite.T(), int64(1), suite.refCount(second.FileID))
+}
+
+func (suite *FileVersionTestSuite) TestStreamFileVersion() {
+	userFile := suite.upload("notes.txt", "key-1", []byte("first draft"))
+	suite.upload("notes.txt", "key-2", []byte("second draft"))
+
+	assert.Equal(suite.T(), []byte("first draft"), suite.readVersion(userFile.ID, 1))
+	assert.Equal(suite.T(), []byte("second draft"), suite.readVersion(userFile.ID, 2))
+
+	_, _, err := suite.fileService.StreamFileVersion(suite.owner.ID, userFile.ID, 3)
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), apperrors.ErrCodeNotFound, appErr.Code)
+}
+
+func (suite *FileVersionTestSuite) TestRestoreFileVersion() {
+	first := suite.upload("notes.txt", "key-1", []byte("first draft"))
+	suite.upload("notes.txt", "key-2", []byte("second draft"))
+
+	restored, err := suite.fileService.RestoreFileVersion(suite.owner.ID, first.ID, 1)
+	suite.Require().NoError(err)
+
+	assert.Equal(suite.T(), 3, restored.CurrentVersion)
+	assert.Equal(suite.T(), first.FileID, restored.FileID)
+	assert.Equal(suite.T(), "key-1", restored.EncryptionKey)
+	assert.Equal(suite.T(), []byte("first draft"), suite.readVersion(first.ID, 3))
+
+	versions, err := suite.fileService.GetFileVersions(suite.owner.ID, first.ID)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), versions, 3)
+
+	// Version 1 and the restored version 3 both reference the first content
+	assert.Equal(suite.T(), int64(2), suite.refCount(first.FileID))
+}
+
+func (suite *FileVersionTestSuite) TestRestoreCurrentVersionIsRejected() {
+	userFile := suite.upload("notes.txt", "key-1", []byte("first draft"))
+
+	_, err := suite.fileService.RestoreFileVersion(suite.owner.ID, userFile.ID, 1)
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), apperrors.ErrCodeInvalidArgument, appErr.Code)
+}
+
+func (suite *FileVersionTestSuite) TestPruneFileVersions() {
+	first := suite.upload("notes.txt", "key-1", []byte("first draft"))
+	second := suite.upload("notes.txt", "key-2", []byte("second draft"))
+	third := suite.upload("notes.txt", "key-3", []byte("third draft"))
+
+	removed, err := suite.fileService.PruneFileVersions(suite.owner.ID, first.ID, 1)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, removed)
+
+	versions, err := suite.fileService.GetFileVersions(suite.owner.ID, first.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(versions, 2)
+	assert.Equal(suite.T(), 3, versions[0].VersionNumber)
+	assert.Equal(suite.T(), 2, versions[1].VersionNumber)
+
+	// The pruned content was only referenced by version 1
+	var count int64
+	suite.db.Unscoped().Model(&models.File{}).Where("id = ?", first.FileID).Count(&count)
+	assert.Zero(suite.T(), count)
+	_, err = suite.backend.Stat(context.Background(), first.File.StoragePath)
+	assert.True(suite.T(), services.IsObjectNotFound(err))
+
+	_, err = suite.backend.Stat(context.Background(), second.File.StoragePath)
+	assert.NoError(suite.T(), err)
+	_, err = suite.backend.Stat(context.Background(), third.File.StoragePath)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *FileVersionTestSuite) TestPermanentlyDeleteFile_RemovesAllVersions() {
+	first := suite.upload("notes.txt", "key-1", []byte("first draft"))
+	second := suite.upload("notes.txt", "key-2", []byte("second draft"))
+
+	suite.Require().NoError(suite.fileService.DeleteFile(suite.owner.ID, first.ID))
+	suite.Require().NoError(suite.fileService.PermanentlyDeleteFile(suite.owner.ID, first.ID))
+
+	var versions, files int64
+	suite.db.Model(&models.FileVersion{}).Count(&versions)
+	suite.db.Unscoped().Model(&models.File{}).Count(&files)
+	assert.Zero(suite.T(), versions)
+	assert.Zero(suite.T(), files)
+
+	for _, path := range []string{first.File.StoragePath, second.File.StoragePath} {
+		_, err := suite.backend.Stat(context.Background(), path)
+		assert.True(suite.T(), services.IsObjectNotFound(err), path)
+	}
+}
+
+func (suite *FileVersionTestSuite) TestStorageUsageCountsVersions() {
+	first := suite.upload("notes.txt", "key-1", []byte("first draft"))
+	suite.upload("notes.txt", "key-2", []byte("second draft"))
+
+	stats, err := suite.userService.GetUserStats(suite.owner.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), len("first draft")+len("second draft"), stats.UsedStorage)
+
+	// Restoring reuses stored content, so it is not counted twice
+	_, err = suite.fileService.RestoreFileVersion(suite.owner.ID, first.ID, 1)
+	suite.Require().NoError(err)
+	stats, err = suite.userService.GetUserStats(suite.owner.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), len("first draft")+len("second draft"), stats.UsedStorage)
+
+	// The quota check sees the same total
+	suite.db.Model(&models.User{}).Where("id = ?", suite.owner.ID).UpdateColumn("storage_quota", len("first draft")+len("second draft"))
+	assert.NoError(suite.T(), suite.userService.CheckStorageQuota(suite.owner.ID, 0))
+	assert.Error(suite.T(), suite.userService.CheckStorageQuota(suite.owner.ID, 1))
+}
+
+func TestFileVersionSuite(t *testing.T) {
+	suite.Run(t, new(FileVersionTestSuite))
+}
@@ -0,0 +1,220 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type IntegrityScrubServiceTestSuite struct {
+	suite.Suite
+	db            *gorm.DB
+	backend       *services.MemoryStorageBackend
+	fileService   *services.FileService
+	scrubService  *services.IntegrityScrubService
+	owner         models.User
+	other         models.User
+	shared        *models.UserFile
+	sharedContent []byte
+}
+
+func (suite *IntegrityScrubServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:integrity_scrub_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.File{},
+		&models.UserFile{},
+		&models.Folder{},
+		&models.RoomFile{},
+		&models.RoomMember{},
+		&models.StorageIntegrityIssue{},
+		&models.FileVersion{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *IntegrityScrubServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM storage_integrity_issues")
+	suite.db.Exec("DELETE FROM file_versions")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM files")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.owner = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.owner).Error)
+	suite.other = models.User{Username: "other", Email: "other@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.other).Error)
+
+	cfg := &config.Config{}
+	dbService := database.NewDB(suite.db)
+	suite.backend = services.NewMemoryStorageBackend()
+	fileStorageService := services.NewFileStorageServiceWithBackend(suite.backend)
+	suite.fileService = services.NewFileService(cfg, dbService, fileStorageService, services.NewAuthService(cfg))
+	suite.scrubService = services.NewIntegrityScrubService(dbService, fileStorageService)
+
+	// One file stored once and referenced by both users, plus an unrelated file
+	suite.sharedContent = []byte("content shared by two users")
+	suite.shared = suite.upload(suite.owner, "shared.bin", suite.sharedContent)
+	suite.upload(suite.other, "shared.bin", suite.sharedContent)
+	suite.upload(suite.owner, "intact.bin", []byte("content nobody touches"))
+}
+
+func (suite *IntegrityScrubServiceTestSuite) upload(user models.User, filename string, content []byte) *models.UserFile {
+	userFile, err := suite.fileService.UploadFile(user.ID, filename, "application/octet-stream", hashOf(content), "key", bytes.NewReader(content), int64(len(content)), nil)
+	suite.Require().NoError(err)
+	return userFile
+}
+
+func (suite *IntegrityScrubServiceTestSuite) overwriteShared(content []byte) {
+	err := suite.backend.Put(context.Background(), suite.shared.File.StoragePath, bytes.NewReader(content), int64(len(content)), "")
+	suite.Require().NoError(err)
+}
+
+func (suite *IntegrityScrubServiceTestSuite) integrityStatuses(fileID uint) []string {
+	var statuses []string
+	suite.db.Unscoped().Model(&models.UserFile{}).Where("file_id = ?", fileID).Pluck("integrity_status", &statuses)
+	return statuses
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TestRun_IntactStorage() {
+	report, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+
+	assert.Equal(suite.T(), 2, report.FilesChecked)
+	assert.Zero(suite.T(), report.CorruptedFiles)
+	assert.Zero(suite.T(), report.MissingFiles)
+	assert.Empty(suite.T(), report.Errors)
+
+	issues, err := suite.scrubService.ListIssues(true)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), issues)
+	assert.Same(suite.T(), report, suite.scrubService.LastReport())
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TestRun_DetectsCorruption() {
+	suite.overwriteShared([]byte("content shared by two userz"))
+	// Trashed copies are flagged too, so a restore does not hide the problem
+	suite.Require().NoError(suite.fileService.DeleteFile(suite.owner.ID, suite.shared.ID))
+
+	report, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.CorruptedFiles)
+	assert.Zero(suite.T(), report.MissingFiles)
+
+	issues, err := suite.scrubService.ListIssues(false)
+	suite.Require().NoError(err)
+	suite.Require().Len(issues, 1)
+	assert.Equal(suite.T(), suite.shared.FileID, issues[0].FileID)
+	assert.Equal(suite.T(), models.IntegrityStatusCorrupted, issues[0].Status)
+	assert.Equal(suite.T(), hashOf(suite.sharedContent), issues[0].ExpectedHash)
+	assert.Equal(suite.T(), hashOf([]byte("content shared by two userz")), issues[0].ActualHash)
+	assert.Nil(suite.T(), issues[0].ResolvedAt)
+
+	assert.Equal(suite.T(), []string{models.IntegrityStatusCorrupted, models.IntegrityStatusCorrupted}, suite.integrityStatuses(suite.shared.FileID))
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TestRun_DetectsTruncation() {
+	suite.overwriteShared(suite.sharedContent[:10])
+
+	report, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.CorruptedFiles)
+
+	issues, err := suite.scrubService.ListIssues(false)
+	suite.Require().NoError(err)
+	suite.Require().Len(issues, 1)
+	assert.Equal(suite.T(), int64(len(suite.sharedContent)), issues[0].ExpectedSize)
+	assert.Equal(suite.T(), int64(10), issues[0].ActualSize)
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TestRun_DetectsMissingObject() {
+	suite.Require().NoError(suite.backend.Delete(context.Background(), suite.shared.File.StoragePath))
+
+	report, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.MissingFiles)
+	assert.Equal(suite.T(), 2, report.FilesChecked)
+
+	issues, err := suite.scrubService.ListIssues(false)
+	suite.Require().NoError(err)
+	suite.Require().Len(issues, 1)
+	assert.Equal(suite.T(), models.IntegrityStatusMissing, issues[0].Status)
+	assert.Equal(suite.T(), []string{models.IntegrityStatusMissing, models.IntegrityStatusMissing}, suite.integrityStatuses(suite.shared.FileID))
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TestRun_RepeatedRunsKeepOneIssue() {
+	suite.overwriteShared([]byte("garbage"))
+	_, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.backend.Delete(context.Background(), suite.shared.File.StoragePath))
+	_, err = suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+
+	issues, err := suite.scrubService.ListIssues(true)
+	suite.Require().NoError(err)
+	suite.Require().Len(issues, 1)
+	assert.Equal(suite.T(), models.IntegrityStatusMissing, issues[0].Status)
+	assert.False(suite.T(), issues[0].LastCheckedAt.Before(issues[0].DetectedAt))
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TestRun_ResolvesRepairedObject() {
+	suite.overwriteShared([]byte("garbage"))
+	_, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+
+	// An operator restores the object from backup
+	suite.overwriteShared(suite.sharedContent)
+	report, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.ResolvedIssues)
+	assert.Zero(suite.T(), report.CorruptedFiles)
+
+	open, err := suite.scrubService.ListIssues(false)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), open)
+
+	all, err := suite.scrubService.ListIssues(true)
+	suite.Require().NoError(err)
+	suite.Require().Len(all, 1)
+	assert.NotNil(suite.T(), all[0].ResolvedAt)
+
+	assert.Equal(suite.T(), []string{models.IntegrityStatusOK, models.IntegrityStatusOK}, suite.integrityStatuses(suite.shared.FileID))
+}
+
+func (suite *IntegrityScrubServiceTestSuite) TestUpload_DeduplicatedCopyInheritsStatus() {
+	suite.overwriteShared([]byte("garbage"))
+	_, err := suite.scrubService.Run(context.Background())
+	suite.Require().NoError(err)
+
+	third := models.User{Username: "third", Email: "third@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&third).Error)
+	userFile := suite.upload(third, "shared.bin", suite.sharedContent)
+
+	assert.Equal(suite.T(), suite.shared.FileID, userFile.FileID)
+	assert.Equal(suite.T(), models.IntegrityStatusCorrupted, userFile.IntegrityStatus)
+}
+
+func TestIntegrityScrubServiceSuite(t *testing.T) {
+	suite.Run(t, new(IntegrityScrubServiceTestSuite))
+}
@@ -0,0 +1,305 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+func exerciseKeyProvider(t *testing.T, provider services.KeyProvider, keyIDPrefix string) {
+	ctx := context.Background()
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	keyID, wrapped, err := provider.WrapKey(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(keyID, keyIDPrefix), "unexpected key ID %q", keyID)
+	assert.NotContains(t, wrapped, string(key))
+	assert.NotContains(t, wrapped, base64.StdEncoding.EncodeToString(key))
+
+	unwrapped, err := provider.UnwrapKey(ctx, keyID, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	// Wrapping is randomized
+	_, again, err := provider.WrapKey(ctx, key)
+	require.NoError(t, err)
+	assert.NotEqual(t, wrapped, again)
+
+	// Tampered values and keys of other providers are rejected
+	_, err = provider.UnwrapKey(ctx, keyID, "x"+wrapped[1:])
+	assert.Error(t, err)
+	_, err = provider.UnwrapKey(ctx, "other:"+keyID, wrapped)
+	assert.Error(t, err)
+}
+
+// testSealer stands in for the key held by a key management service.
+type testSealer struct {
+	gcm cipher.AEAD
+}
+
+func newTestSealer(t *testing.T) *testSealer {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	return &testSealer{gcm: gcm}
+}
+
+func (s *testSealer) seal(plaintext []byte) string {
+	nonce := make([]byte, s.gcm.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(s.gcm.Seal(nonce, nonce, plaintext, nil))
+}
+
+func (s *testSealer) open(sealed string) ([]byte, bool) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < s.gcm.NonceSize() {
+		return nil, false
+	}
+	plaintext, err := s.gcm.Open(nil, data[:s.gcm.NonceSize()], data[s.gcm.NonceSize():], nil)
+	return plaintext, err == nil
+}
+
+func TestLocalKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "keystore.json")
+	provider, err := services.NewLocalKeyProvider(path)
+	require.NoError(t, err)
+	exerciseKeyProvider(t, provider, "local:")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// Keys wrapped before a rotation still unwrap, also after reopening the keystore
+	ctx := context.Background()
+	oldKeyID, oldWrapped, err := provider.WrapKey(ctx, []byte("old"))
+	require.NoError(t, err)
+	newActive, err := provider.RotateKey()
+	require.NoError(t, err)
+	newKeyID, newWrapped, err := provider.WrapKey(ctx, []byte("new"))
+	require.NoError(t, err)
+	assert.NotEqual(t, oldKeyID, newKeyID)
+	assert.Equal(t, newActive, newKeyID)
+
+	reopened, err := services.NewLocalKeyProvider(path)
+	require.NoError(t, err)
+	unwrapped, err := reopened.UnwrapKey(ctx, oldKeyID, oldWrapped)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), unwrapped)
+	unwrapped, err = reopened.UnwrapKey(ctx, newKeyID, newWrapped)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), unwrapped)
+
+	// A value cannot be unwrapped under another keystore key
+	_, err = reopened.UnwrapKey(ctx, newKeyID, oldWrapped)
+	assert.Error(t, err)
+
+	// Another keystore cannot unwrap it at all
+	other, err := services.NewLocalKeyProvider(filepath.Join(t.TempDir(), "keystore.json"))
+	require.NoError(t, err)
+	_, err = other.UnwrapKey(ctx, newKeyID, newWrapped)
+	assert.Error(t, err)
+}
+
+func TestVaultKeyProvider(t *testing.T) {
+	sealer := newTestSealer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/aegis":
+			plaintext, err := base64.StdEncoding.DecodeString(body["plaintext"])
+			require.NoError(t, err)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + sealer.seal(plaintext)}})
+		case "/v1/transit/decrypt/aegis":
+			plaintext, ok := sealer.open(strings.TrimPrefix(body["ciphertext"], "vault:v1:"))
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"cipher: message authentication failed"}})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": base64.StdEncoding.EncodeToString(plaintext)}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{}})
+		}
+	}))
+	defer server.Close()
+
+	provider := services.NewVaultKeyProvider(server.URL, "test-token", "transit", "aegis")
+	exerciseKeyProvider(t, provider, "vault:aegis")
+
+	// A bad token is reported rather than treated as a key
+	_, _, err := services.NewVaultKeyProvider(server.URL, "wrong", "transit", "aegis").WrapKey(context.Background(), []byte("key"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "permission denied")
+}
+
+func TestAWSKMSKeyProvider(t *testing.T) {
+	const keyARN = "arn:aws:kms:us-east-1:000000000000:key/test"
+	sealer := newTestSealer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests carry a Signature Version 4 signature for the KMS service
+		auth := r.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDTEST/"), auth)
+		assert.Contains(t, auth, "/us-east-1/kms/aws4_request")
+		assert.Contains(t, auth, "SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target")
+		assert.Equal(t, "session", r.Header.Get("X-Amz-Security-Token"))
+		assert.NotEmpty(t, r.Header.Get("X-Amz-Date"))
+		assert.Equal(t, "application/x-amz-json-1.1", r.Header.Get("Content-Type"))
+
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["KeyId"] != "alias/aegis" && body["KeyId"] != keyARN {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "NotFoundException", "message": "key not found"})
+			return
+		}
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			plaintext, err := base64.StdEncoding.DecodeString(body["Plaintext"])
+			require.NoError(t, err)
+			json.NewEncoder(w).Encode(map[string]string{"CiphertextBlob": sealer.seal(plaintext), "KeyId": keyARN})
+		case "TrentService.Decrypt":
+			plaintext, ok := sealer.open(body["CiphertextBlob"])
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"__type": "InvalidCiphertextException"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"Plaintext": base64.StdEncoding.EncodeToString(plaintext), "KeyId": keyARN})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	provider := services.NewAWSKMSKeyProvider(server.URL, "us-east-1", "alias/aegis", "AKIDTEST", "secret", "session")
+	// The key ARN reported by KMS is stored rather than the configured alias
+	exerciseKeyProvider(t, provider, "awskms:"+keyARN)
+
+	missing := services.NewAWSKMSKeyProvider(server.URL, "us-east-1", "alias/missing", "AKIDTEST", "secret", "session")
+	_, _, err := missing.WrapKey(context.Background(), []byte("key"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "NotFoundException")
+}
+
+func TestNewKeyProvider(t *testing.T) {
+	provider, err := services.NewKeyProvider(&config.Config{KeyProvider: "local", KeystorePath: filepath.Join(t.TempDir(), "keystore.json")})
+	require.NoError(t, err)
+	assert.IsType(t, &services.LocalKeyProvider{}, provider)
+
+	provider, err = services.NewKeyProvider(&config.Config{KeyProvider: "vault", VaultAddr: "http://localhost:8200"})
+	require.NoError(t, err)
+	assert.IsType(t, &services.VaultKeyProvider{}, provider)
+
+	provider, err = services.NewKeyProvider(&config.Config{KeyProvider: "awskms", AWSRegion: "us-east-1"})
+	require.NoError(t, err)
+	assert.IsType(t, &services.AWSKMSKeyProvider{}, provider)
+
+	_, err = services.NewKeyProvider(&config.Config{KeyProvider: "rot13"})
+	assert.Error(t, err)
+}
+
+func TestCryptoManager_KeyProviderWrapping(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:crypto_manager_key_provider_test?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.ServiceKey{}, &models.User{}))
+	defer func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	}()
+
+	ctx := context.Background()
+	provider, err := services.NewLocalKeyProvider(filepath.Join(t.TempDir(), "keystore.json"))
+	require.NoError(t, err)
+
+	// The share password key is seeded from the environment and stored wrapped
+	seed := bytes.Repeat([]byte{7}, 32)
+	t.Setenv("AEGIS_SHARE_PASSWORD_KEY", base64.StdEncoding.EncodeToString(seed))
+	manager, err := services.NewCryptoManagerWithKeyProvider(ctx, provider, database.NewDB(db))
+	require.NoError(t, err)
+	assert.Equal(t, seed, manager.GetConfig().SharePasswordKey)
+
+	var stored models.ServiceKey
+	require.NoError(t, db.Where("name = ?", services.ServiceKeySharePassword).First(&stored).Error)
+	assert.True(t, strings.HasPrefix(stored.KeyID, "local:"))
+	assert.NotContains(t, stored.WrappedKey, base64.StdEncoding.EncodeToString(seed))
+
+	encrypted, iv, keyVersion, err := manager.EncryptSharePassword("share password")
+	require.NoError(t, err)
+
+	// Later starts use the stored key, whatever the environment says
+	t.Setenv("AEGIS_SHARE_PASSWORD_KEY", "")
+	restarted, err := services.NewCryptoManagerWithKeyProvider(ctx, provider, database.NewDB(db))
+	require.NoError(t, err)
+	password, err := restarted.DecryptSharePassword(encrypted, iv, keyVersion)
+	require.NoError(t, err)
+	assert.Equal(t, "share password", password)
+
+	// Envelope keys are wrapped with the provider, and legacy hex keys still unwrap
+	envelopeKey, err := manager.GenerateEnvelopeKey()
+	require.NoError(t, err)
+	keyID, wrapped, err := manager.WrapEnvelopeKey(ctx, envelopeKey)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(keyID, "local:"))
+	assert.NotContains(t, wrapped, hex.EncodeToString(envelopeKey))
+	unwrapped, err := restarted.UnwrapEnvelopeKey(ctx, keyID, wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, envelopeKey, unwrapped)
+	unwrapped, err = restarted.UnwrapEnvelopeKey(ctx, "", hex.EncodeToString(envelopeKey))
+	require.NoError(t, err)
+	assert.Equal(t, envelopeKey, unwrapped)
+
+	// Legacy hex envelope keys are wrapped in place
+	legacy := models.User{Username: "legacy", Email: "legacy@example.com", PasswordHash: "hash", EnvelopeKey: hex.EncodeToString(envelopeKey)}
+	fresh := models.User{Username: "fresh", Email: "fresh@example.com", PasswordHash: "hash"}
+	require.NoError(t, db.Create(&legacy).Error)
+	require.NoError(t, db.Create(&fresh).Error)
+
+	rotation := services.NewKeyRotationService(database.NewDB(db), manager)
+	count, err := rotation.WrapLegacyEnvelopeKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	require.NoError(t, db.First(&legacy, legacy.ID).Error)
+	assert.True(t, strings.HasPrefix(legacy.EnvelopeKeyID, "local:"))
+	unwrapped, err = manager.UnwrapEnvelopeKey(ctx, legacy.EnvelopeKeyID, legacy.EnvelopeKey)
+	require.NoError(t, err)
+	assert.Equal(t, envelopeKey, unwrapped)
+
+	count, err = rotation.WrapLegacyEnvelopeKeys(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
@@ -0,0 +1,281 @@
+package services_test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/nacl/box"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type KeyRecoveryServiceTestSuite struct {
+	suite.Suite
+	db               *gorm.DB
+	cryptoManager    *services.CryptoManager
+	recoveryService  *services.KeyRecoveryService
+	user             models.User
+	envelopeKey      []byte
+	escrowPrivateKey string
+}
+
+func (suite *KeyRecoveryServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:key_recovery_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.UserFile{},
+		&models.KeyRotation{},
+		&models.KeyRotationBackup{},
+		&models.ServiceKey{},
+		&models.EnvelopeKeyEscrow{},
+		&models.KeyRecoveryRequest{},
+		&models.KeyRecoveryAuditEvent{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *KeyRecoveryServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *KeyRecoveryServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM key_recovery_audit_events")
+	suite.db.Exec("DELETE FROM key_recovery_requests")
+	suite.db.Exec("DELETE FROM envelope_key_escrows")
+	suite.db.Exec("DELETE FROM key_rotation_backups")
+	suite.db.Exec("DELETE FROM key_rotations")
+	suite.db.Exec("DELETE FROM service_keys")
+	suite.db.Exec("DELETE FROM users")
+
+	// Escrow every envelope key to a freshly generated organization key
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	suite.Require().NoError(err)
+	suite.T().Setenv("AEGIS_KEY_ESCROW_PUBLIC_KEY", base64.StdEncoding.EncodeToString(publicKey[:]))
+	suite.escrowPrivateKey = base64.StdEncoding.EncodeToString(privateKey[:])
+
+	suite.useNewKeyProvider()
+
+	ctx := context.Background()
+	suite.envelopeKey, err = suite.cryptoManager.GenerateEnvelopeKey()
+	suite.Require().NoError(err)
+	keyID, wrapped, err := suite.cryptoManager.WrapEnvelopeKey(ctx, suite.envelopeKey)
+	suite.Require().NoError(err)
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", EnvelopeKey: wrapped, EnvelopeKeyID: keyID}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+}
+
+// useNewKeyProvider starts over with an empty keystore, as after losing the key provider's
+// keys. Envelope keys wrapped before can no longer be unwrapped.
+func (suite *KeyRecoveryServiceTestSuite) useNewKeyProvider() {
+	suite.db.Exec("DELETE FROM service_keys")
+
+	ctx := context.Background()
+	provider, err := services.NewLocalKeyProvider(filepath.Join(suite.T().TempDir(), "keystore.json"))
+	suite.Require().NoError(err)
+	suite.cryptoManager, err = services.NewCryptoManagerWithKeyProvider(ctx, provider, database.NewDB(suite.db))
+	suite.Require().NoError(err)
+	suite.recoveryService = services.NewKeyRecoveryService(database.NewDB(suite.db), suite.cryptoManager)
+}
+
+// currentEnvelopeKey unwraps the envelope key stored on the user.
+func (suite *KeyRecoveryServiceTestSuite) currentEnvelopeKey() (models.User, []byte, error) {
+	var user models.User
+	suite.Require().NoError(suite.db.First(&user, suite.user.ID).Error)
+	envelopeKey, err := suite.cryptoManager.UnwrapEnvelopeKey(context.Background(), user.EnvelopeKeyID, user.EnvelopeKey)
+	return user, envelopeKey, err
+}
+
+// auditEvents returns the audit trail of the user, oldest first.
+func (suite *KeyRecoveryServiceTestSuite) auditEvents() []string {
+	events, err := suite.recoveryService.ListAuditEvents(&suite.user.ID, 0)
+	suite.Require().NoError(err)
+	names := make([]string, len(events))
+	for i, event := range events {
+		names[len(events)-1-i] = event.Event
+	}
+	return names
+}
+
+func (suite *KeyRecoveryServiceTestSuite) requireErrorCode(err error, code apperrors.ErrorCode) {
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code)
+}
+
+func (suite *KeyRecoveryServiceTestSuite) TestRecoveryKey_RestoresLostEnvelopeKey() {
+	ctx := context.Background()
+	recoveryKey, err := suite.recoveryService.EnrollRecoveryKey(ctx, suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), strings.Split(recoveryKey, "-"), 13)
+
+	status, err := suite.recoveryService.GetRecoveryStatus(suite.user.ID)
+	suite.Require().NoError(err)
+	assert.True(suite.T(), status.RecoveryKeyEnrolled)
+	assert.NotNil(suite.T(), status.EnrolledAt)
+
+	suite.useNewKeyProvider()
+	_, _, err = suite.currentEnvelopeKey()
+	suite.Require().Error(err)
+
+	// The key is accepted however it was typed back in
+	typed := strings.ToLower(strings.ReplaceAll(recoveryKey, "-", " "))
+	suite.Require().NoError(suite.recoveryService.RecoverWithRecoveryKey(ctx, suite.user.ID, typed))
+
+	user, envelopeKey, err := suite.currentEnvelopeKey()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.envelopeKey, envelopeKey)
+	assert.Equal(suite.T(), 1, user.EnvelopeKeyVersion)
+	assert.Equal(suite.T(), []string{models.KeyRecoveryAuditRecoveryKeyEnrolled, models.KeyRecoveryAuditRecoveryKeyUsed}, suite.auditEvents())
+}
+
+func (suite *KeyRecoveryServiceTestSuite) TestRecoveryKey_RejectsOtherKey() {
+	ctx := context.Background()
+	_, err := suite.recoveryService.EnrollRecoveryKey(ctx, suite.user.ID)
+	suite.Require().NoError(err)
+	otherKey, _, err := suite.cryptoManager.GenerateRecoveryKey()
+	suite.Require().NoError(err)
+
+	err = suite.recoveryService.RecoverWithRecoveryKey(ctx, suite.user.ID, otherKey)
+	suite.requireErrorCode(err, apperrors.ErrCodeUnauthorized)
+
+	err = suite.recoveryService.RecoverWithRecoveryKey(ctx, suite.user.ID, "not-a-recovery-key")
+	suite.requireErrorCode(err, apperrors.ErrCodeInvalidArgument)
+
+	var stored models.User
+	suite.Require().NoError(suite.db.First(&stored, suite.user.ID).Error)
+	assert.Equal(suite.T(), suite.user.EnvelopeKey, stored.EnvelopeKey)
+	assert.Equal(suite.T(), []string{models.KeyRecoveryAuditRecoveryKeyEnrolled, models.KeyRecoveryAuditRecoveryKeyRejected}, suite.auditEvents())
+}
+
+func (suite *KeyRecoveryServiceTestSuite) TestEscrowRecovery_RequiresTwoAdmins() {
+	ctx := context.Background()
+	const requester, approver uint = 1001, 1002
+
+	escrowed, err := suite.recoveryService.EscrowEnvelopeKeys(ctx)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, escrowed)
+
+	// Already escrowed keys are left alone
+	escrowed, err = suite.recoveryService.EscrowEnvelopeKeys(ctx)
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), escrowed)
+
+	suite.useNewKeyProvider()
+
+	_, err = suite.recoveryService.RequestEscrowRecovery(requester, suite.user.ID, " ")
+	suite.requireErrorCode(err, apperrors.ErrCodeValidation)
+	request, err := suite.recoveryService.RequestEscrowRecovery(requester, suite.user.ID, "Lost the key provider's keys")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.KeyRecoveryStatusPending, request.Status)
+
+	_, err = suite.recoveryService.RequestEscrowRecovery(approver, suite.user.ID, "Duplicate")
+	suite.requireErrorCode(err, apperrors.ErrCodeConflict)
+
+	// Neither can one admin approve their own request, nor complete it unapproved
+	_, err = suite.recoveryService.ApproveEscrowRecovery(requester, request.ID)
+	suite.requireErrorCode(err, apperrors.ErrCodeForbidden)
+	_, err = suite.recoveryService.CompleteEscrowRecovery(ctx, requester, request.ID, suite.escrowPrivateKey)
+	suite.requireErrorCode(err, apperrors.ErrCodeInvalidArgument)
+
+	approved, err := suite.recoveryService.ApproveEscrowRecovery(approver, request.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.KeyRecoveryStatusApproved, approved.Status)
+
+	// A third admin cannot complete it, and a key other than the escrow key does not open it
+	_, err = suite.recoveryService.CompleteEscrowRecovery(ctx, 1003, request.ID, suite.escrowPrivateKey)
+	suite.requireErrorCode(err, apperrors.ErrCodeForbidden)
+	_, otherKey, err := box.GenerateKey(rand.Reader)
+	suite.Require().NoError(err)
+	_, err = suite.recoveryService.CompleteEscrowRecovery(ctx, approver, request.ID, base64.StdEncoding.EncodeToString(otherKey[:]))
+	suite.requireErrorCode(err, apperrors.ErrCodeUnauthorized)
+
+	completed, err := suite.recoveryService.CompleteEscrowRecovery(ctx, approver, request.ID, suite.escrowPrivateKey)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.KeyRecoveryStatusCompleted, completed.Status)
+	suite.Require().NotNil(completed.CompletedBy)
+	assert.Equal(suite.T(), approver, *completed.CompletedBy)
+
+	_, envelopeKey, err := suite.currentEnvelopeKey()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.envelopeKey, envelopeKey)
+
+	assert.Equal(suite.T(), []string{
+		models.KeyRecoveryAuditRequested,
+		models.KeyRecoveryAuditApproved,
+		models.KeyRecoveryAuditFailed,
+		models.KeyRecoveryAuditCompleted,
+	}, suite.auditEvents())
+}
+
+func (suite *KeyRecoveryServiceTestSuite) TestEscrowRecovery_Cancel() {
+	ctx := context.Background()
+	_, err := suite.recoveryService.EscrowEnvelopeKeys(ctx)
+	suite.Require().NoError(err)
+
+	request, err := suite.recoveryService.RequestEscrowRecovery(1001, suite.user.ID, "Support ticket")
+	suite.Require().NoError(err)
+	cancelled, err := suite.recoveryService.CancelEscrowRecovery(1002, request.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.KeyRecoveryStatusCancelled, cancelled.Status)
+
+	_, err = suite.recoveryService.ApproveEscrowRecovery(1002, request.ID)
+	suite.requireErrorCode(err, apperrors.ErrCodeInvalidArgument)
+
+	// A new request can be opened once the previous one is closed
+	_, err = suite.recoveryService.RequestEscrowRecovery(1001, suite.user.ID, "Support ticket")
+	suite.Require().NoError(err)
+}
+
+func (suite *KeyRecoveryServiceTestSuite) TestRotation_ResealsRecoveryCopies() {
+	ctx := context.Background()
+	recoveryKey, err := suite.recoveryService.EnrollRecoveryKey(ctx, suite.user.ID)
+	suite.Require().NoError(err)
+
+	rotationService := services.NewKeyRotationService(database.NewDB(suite.db), suite.cryptoManager)
+	result, err := rotationService.RotateEnvelopeKey(suite.user.ID)
+	suite.Require().NoError(err)
+	_, err = rotationService.RunPending(ctx)
+	suite.Require().NoError(err)
+
+	user, rotatedKey, err := suite.currentEnvelopeKey()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 2, user.EnvelopeKeyVersion)
+
+	// The rotation escrowed the new key as well as re-sealing it to the recovery key
+	status, err := suite.recoveryService.GetRecoveryStatus(suite.user.ID)
+	suite.Require().NoError(err)
+	assert.True(suite.T(), status.RecoveryKeyEnrolled)
+	assert.True(suite.T(), status.Escrowed)
+
+	// Rolling back seals the old key again
+	suite.Require().NoError(rotationService.RollbackRotation(result.RotationID, suite.user.ID))
+
+	suite.useNewKeyProvider()
+	suite.Require().NoError(suite.recoveryService.RecoverWithRecoveryKey(ctx, suite.user.ID, recoveryKey))
+	user, envelopeKey, err := suite.currentEnvelopeKey()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, user.EnvelopeKeyVersion)
+	assert.Equal(suite.T(), suite.envelopeKey, envelopeKey)
+	assert.NotEqual(suite.T(), rotatedKey, envelopeKey)
+}
+
+func TestKeyRecoveryServiceSuite(t *testing.T) {
+	suite.Run(t, new(KeyRecoveryServiceTestSuite))
+}
@@ -0,0 +1,343 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type KeyRotationCampaignServiceTestSuite struct {
+	suite.Suite
+	db              *gorm.DB
+	cryptoManager   *services.CryptoManager
+	campaignService *services.KeyRotationCampaignService
+	shareService    *services.ShareService
+	admin           models.User
+	users           []models.User
+	envelopeKeys    map[uint][]byte
+	fileKeys        map[uint][]byte
+	shareFileKey    []byte
+	share           *models.FileShare
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:key_rotation_campaign_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.UserFile{},
+		&models.FileShare{},
+		&models.KeyRotation{},
+		&models.KeyRotationBackup{},
+		&models.KeyRotationCampaign{},
+		&models.ServiceKey{},
+		&models.EnvelopeKeyEscrow{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM key_rotation_campaigns")
+	suite.db.Exec("DELETE FROM key_rotation_backups")
+	suite.db.Exec("DELETE FROM key_rotations")
+	suite.db.Exec("DELETE FROM file_shares")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM service_keys")
+	suite.db.Exec("DELETE FROM envelope_key_escrows")
+	suite.db.Exec("DELETE FROM users")
+
+	// Keep share key derivation cheap
+	suite.T().Setenv("AEGIS_ARGON2_TIME", "1")
+	suite.T().Setenv("AEGIS_ARGON2_MEMORY_KIB", "8192")
+	suite.T().Setenv("AEGIS_ARGON2_THREADS", "1")
+
+	ctx := context.Background()
+	dbService := database.NewDB(suite.db)
+	provider, err := services.NewLocalKeyProvider(filepath.Join(suite.T().TempDir(), "keystore.json"))
+	suite.Require().NoError(err)
+	suite.cryptoManager, err = services.NewCryptoManagerWithKeyProvider(ctx, provider, dbService)
+	suite.Require().NoError(err)
+	rotationService := services.NewKeyRotationService(dbService, suite.cryptoManager)
+	suite.campaignService = services.NewKeyRotationCampaignService(dbService, suite.cryptoManager, rotationService)
+	suite.shareService = services.NewShareService(dbService, "http://localhost", suite.cryptoManager)
+
+	// The admin has no envelope key and is not rotated
+	suite.admin = models.User{Username: "admin", Email: "admin@example.com", PasswordHash: "hash", IsAdmin: true}
+	suite.Require().NoError(suite.db.Create(&suite.admin).Error)
+
+	suite.users = nil
+	suite.envelopeKeys = map[uint][]byte{}
+	suite.fileKeys = map[uint][]byte{}
+	for i := 0; i < 3; i++ {
+		envelopeKey, err := suite.cryptoManager.GenerateEnvelopeKey()
+		suite.Require().NoError(err)
+		keyID, wrapped, err := suite.cryptoManager.WrapEnvelopeKey(ctx, envelopeKey)
+		suite.Require().NoError(err)
+		user := models.User{Username: fmt.Sprintf("user-%d", i), Email: fmt.Sprintf("user-%d@example.com", i), PasswordHash: "hash", EnvelopeKey: wrapped, EnvelopeKeyID: keyID}
+		suite.Require().NoError(suite.db.Create(&user).Error)
+		suite.users = append(suite.users, user)
+		suite.envelopeKeys[user.ID] = envelopeKey
+
+		for j := 0; j < 3; j++ {
+			fileKey, err := suite.cryptoManager.GenerateFileKey()
+			suite.Require().NoError(err)
+			encryptedKey, _, err := suite.cryptoManager.EncryptFileKey(fileKey, envelopeKey)
+			suite.Require().NoError(err)
+			userFile := models.UserFile{UserID: user.ID, FileID: uint(i*3 + j + 1), Filename: fmt.Sprintf("file-%d-%d.txt", i, j), MimeType: "text/plain", EncryptionKey: encryptedKey}
+			suite.Require().NoError(suite.db.Create(&userFile).Error)
+			suite.fileKeys[userFile.ID] = fileKey
+		}
+	}
+
+	// The admin's own upload carries its file key, as browsers send it, and is shared
+	suite.shareFileKey = bytes.Repeat([]byte{7}, 32)
+	sharedFile := models.UserFile{UserID: suite.admin.ID, FileID: 100, Filename: "shared.txt", MimeType: "text/plain", EncryptionKey: base64.StdEncoding.EncodeToString(suite.shareFileKey)}
+	suite.Require().NoError(suite.db.Create(&sharedFile).Error)
+	suite.share, err = suite.shareService.CreateShare(sharedFile.ID, "Correct!Horse1", 0, nil, nil)
+	suite.Require().NoError(err)
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) assertErrorCode(err error, code apperrors.ErrorCode) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code)
+}
+
+// assertRotated checks that a user has a new envelope key and that every file key
+// decrypts under it.
+func (suite *KeyRotationCampaignServiceTestSuite) assertRotated(user models.User) {
+	var current models.User
+	suite.Require().NoError(suite.db.First(&current, user.ID).Error)
+	assert.Equal(suite.T(), 2, current.EnvelopeKeyVersion, "user %s", user.Username)
+	envelopeKey, err := suite.cryptoManager.UnwrapEnvelopeKey(context.Background(), current.EnvelopeKeyID, current.EnvelopeKey)
+	suite.Require().NoError(err)
+	assert.NotEqual(suite.T(), suite.envelopeKeys[user.ID], envelopeKey)
+
+	var userFiles []models.UserFile
+	suite.Require().NoError(suite.db.Where("user_id = ?", user.ID).Find(&userFiles).Error)
+	suite.Require().Len(userFiles, 3)
+	for _, userFile := range userFiles {
+		fileKey, err := suite.cryptoManager.DecryptFileKey(userFile.EncryptionKey, "", envelopeKey)
+		suite.Require().NoError(err, "file %d", userFile.ID)
+		assert.Equal(suite.T(), suite.fileKeys[userFile.ID], fileKey)
+	}
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) TestRunCampaigns_RotatesUsersAndShares() {
+	// A share whose password is not stored cannot be re-keyed
+	var passwordless models.UserFile
+	suite.Require().NoError(suite.db.Where("file_id = ?", 100).First(&passwordless).Error)
+	unstored, err := suite.shareService.CreateShare(passwordless.ID, "Correct!Horse2", 0, nil, nil)
+	suite.Require().NoError(err)
+	suite.Require().NoError(suite.db.Model(unstored).Update("encrypted_password", "").Error)
+
+	campaign, err := suite.campaignService.StartCampaign(suite.admin.ID, 2, -1)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), string(services.KeyRotationCampaignRunning), campaign.Status)
+	assert.Equal(suite.T(), 3, campaign.TotalUsers)
+	assert.Equal(suite.T(), 2, campaign.TotalShares)
+	assert.Equal(suite.T(), 0, campaign.RateLimitPerSecond)
+
+	suite.Require().NoError(suite.campaignService.RunCampaigns(context.Background()))
+
+	report, err := suite.campaignService.GetCampaign(campaign.CampaignID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), string(services.KeyRotationCampaignCompleted), report.Status)
+	assert.NotNil(suite.T(), report.CompletedAt)
+	assert.Equal(suite.T(), 3, report.TotalUsers)
+	assert.Equal(suite.T(), 3, report.UsersRotated)
+	assert.Zero(suite.T(), report.UsersFailed)
+	assert.Equal(suite.T(), 1, report.SharesRotated)
+	assert.Equal(suite.T(), 1, report.SharesSkipped)
+	assert.Zero(suite.T(), report.SharesFailed)
+
+	for _, user := range suite.users {
+		suite.assertRotated(user)
+	}
+
+	users, err := suite.campaignService.CampaignUsers(campaign.CampaignID, nil)
+	suite.Require().NoError(err)
+	suite.Require().Len(users, 3)
+	for i, user := range users {
+		assert.Equal(suite.T(), suite.users[i].Username, user.Username)
+		assert.Equal(suite.T(), services.KeyRotationStatusCompleted, user.Rotation.Status)
+		assert.Equal(suite.T(), 3, user.Rotation.FilesProcessed)
+	}
+
+	// The share has a new envelope key and still opens with its password
+	var share models.FileShare
+	suite.Require().NoError(suite.db.First(&share, suite.share.ID).Error)
+	assert.NotEqual(suite.T(), suite.share.EnvelopeKey, share.EnvelopeKey)
+	fileKey, err := suite.shareService.DecryptFileKey(&share, "Correct!Horse1")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.shareFileKey, fileKey)
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) TestRunCampaigns_RotatesUsersWithUploadedKeys() {
+	// Files uploaded by browsers keep their file key in plain base64, not under the envelope key
+	ctx := context.Background()
+	envelopeKey, err := suite.cryptoManager.GenerateEnvelopeKey()
+	suite.Require().NoError(err)
+	keyID, wrapped, err := suite.cryptoManager.WrapEnvelopeKey(ctx, envelopeKey)
+	suite.Require().NoError(err)
+	uploader := models.User{Username: "uploader", Email: "uploader@example.com", PasswordHash: "hash", EnvelopeKey: wrapped, EnvelopeKeyID: keyID}
+	suite.Require().NoError(suite.db.Create(&uploader).Error)
+
+	var uploaded []models.UserFile
+	for i, owner := range []uint{uploader.ID, uploader.ID, suite.users[0].ID} {
+		fileKey, err := suite.cryptoManager.GenerateFileKey()
+		suite.Require().NoError(err)
+		userFile := models.UserFile{UserID: owner, FileID: uint(200 + i), Filename: fmt.Sprintf("uploaded-%d.txt", i), MimeType: "text/plain", EncryptionKey: base64.StdEncoding.EncodeToString(fileKey)}
+		suite.Require().NoError(suite.db.Create(&userFile).Error)
+		uploaded = append(uploaded, userFile)
+	}
+
+	campaign, err := suite.campaignService.StartCampaign(suite.admin.ID, 2, -1)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 4, campaign.TotalUsers)
+	suite.Require().NoError(suite.campaignService.RunCampaigns(ctx))
+
+	report, err := suite.campaignService.GetCampaign(campaign.CampaignID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), string(services.KeyRotationCampaignCompleted), report.Status)
+	assert.Equal(suite.T(), 4, report.UsersRotated)
+	assert.Zero(suite.T(), report.UsersFailed)
+
+	var current models.User
+	suite.Require().NoError(suite.db.First(&current, uploader.ID).Error)
+	assert.Equal(suite.T(), 2, current.EnvelopeKeyVersion)
+
+	// Uploaded keys are left as they are
+	for _, userFile := range uploaded {
+		var stored models.UserFile
+		suite.Require().NoError(suite.db.First(&stored, userFile.ID).Error)
+		assert.Equal(suite.T(), userFile.EncryptionKey, stored.EncryptionKey)
+	}
+
+	suite.Require().NoError(suite.db.Unscoped().Delete(&uploaded[2]).Error)
+	for _, user := range suite.users {
+		suite.assertRotated(user)
+	}
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) TestPauseAndResume() {
+	campaign, err := suite.campaignService.StartCampaign(suite.admin.ID, 0, 0)
+	suite.Require().NoError(err)
+
+	// Only one campaign may be active
+	_, err = suite.campaignService.StartCampaign(suite.admin.ID, 0, 0)
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+
+	paused, err := suite.campaignService.PauseCampaign(campaign.CampaignID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), string(services.KeyRotationCampaignPaused), paused.Status)
+
+	// A paused campaign is not run
+	suite.Require().NoError(suite.campaignService.RunCampaigns(context.Background()))
+	for _, user := range suite.users {
+		var current models.User
+		suite.Require().NoError(suite.db.First(&current, user.ID).Error)
+		assert.Equal(suite.T(), 1, current.EnvelopeKeyVersion)
+	}
+
+	_, err = suite.campaignService.PauseCampaign(campaign.CampaignID)
+	suite.assertErrorCode(err, apperrors.ErrCodeInvalidArgument)
+
+	_, err = suite.campaignService.ResumeCampaign(campaign.CampaignID)
+	suite.Require().NoError(err)
+	suite.Require().NoError(suite.campaignService.RunCampaigns(context.Background()))
+
+	report, err := suite.campaignService.GetCampaign(campaign.CampaignID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), string(services.KeyRotationCampaignCompleted), report.Status)
+	assert.Equal(suite.T(), 3, report.UsersRotated)
+	for _, user := range suite.users {
+		suite.assertRotated(user)
+	}
+
+	// A finished campaign cannot be cancelled
+	_, err = suite.campaignService.CancelCampaign(campaign.CampaignID)
+	suite.assertErrorCode(err, apperrors.ErrCodeInvalidArgument)
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) TestInterruptedCampaignResumes() {
+	campaign, err := suite.campaignService.StartCampaign(suite.admin.ID, 1, -1)
+	suite.Require().NoError(err)
+
+	// Stop once every user is enrolled, before any is rotated, as a shutdown would
+	err = suite.campaignService.RunCampaigns(&cancelAfterChecks{Context: context.Background(), checks: 3})
+	assert.ErrorIs(suite.T(), err, context.Canceled)
+
+	pending := services.KeyRotationStatusPending
+	users, err := suite.campaignService.CampaignUsers(campaign.CampaignID, &pending)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), users, 3)
+
+	// A restarted process picks the campaign up where it stopped
+	dbService := database.NewDB(suite.db)
+	restarted := services.NewKeyRotationCampaignService(dbService, suite.cryptoManager, services.NewKeyRotationService(dbService, suite.cryptoManager))
+	suite.Require().NoError(restarted.RunCampaigns(context.Background()))
+
+	report, err := restarted.GetCampaign(campaign.CampaignID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), string(services.KeyRotationCampaignCompleted), report.Status)
+	assert.Equal(suite.T(), 3, report.UsersRotated)
+	assert.Equal(suite.T(), 1, report.SharesRotated)
+	for _, user := range suite.users {
+		suite.assertRotated(user)
+	}
+}
+
+func (suite *KeyRotationCampaignServiceTestSuite) TestCancelCampaign() {
+	campaign, err := suite.campaignService.StartCampaign(suite.admin.ID, 1, -1)
+	suite.Require().NoError(err)
+	err = suite.campaignService.RunCampaigns(&cancelAfterChecks{Context: context.Background(), checks: 3})
+	assert.ErrorIs(suite.T(), err, context.Canceled)
+
+	cancelled, err := suite.campaignService.CancelCampaign(campaign.CampaignID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), string(services.KeyRotationCampaignCancelled), cancelled.Status)
+
+	// Users whose rotation had not started keep their envelope key
+	suite.Require().NoError(suite.campaignService.RunCampaigns(context.Background()))
+	status := services.KeyRotationStatusCancelled
+	users, err := suite.campaignService.CampaignUsers(campaign.CampaignID, &status)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), users, 3)
+	for _, user := range suite.users {
+		var current models.User
+		suite.Require().NoError(suite.db.First(&current, user.ID).Error)
+		assert.Equal(suite.T(), 1, current.EnvelopeKeyVersion)
+	}
+
+	// Another campaign can be started once it is cancelled
+	_, err = suite.campaignService.StartCampaign(suite.admin.ID, 0, 0)
+	suite.Require().NoError(err)
+}
+
+func TestKeyRotationCampaignServiceSuite(t *testing.T) {
+	suite.Run(t, new(KeyRotationCampaignServiceTestSuite))
+}
@@ -0,0 +1,258 @@
+package services_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type KeyRotationServiceTestSuite struct {
+	suite.Suite
+	db              *gorm.DB
+	cryptoManager   *services.CryptoManager
+	rotationService *services.KeyRotationService
+	user            models.User
+	envelopeKey     []byte
+	fileKeys        map[uint][]byte
+}
+
+// cancelAfterChecks is a context that reports cancellation once Err has been checked
+// more than a given number of times, to interrupt a rotation between two batches.
+type cancelAfterChecks struct {
+	context.Context
+	checks int
+}
+
+func (c *cancelAfterChecks) Err() error {
+	c.checks--
+	if c.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func (suite *KeyRotationServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:key_rotation_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.UserFile{},
+		&models.KeyRotation{},
+		&models.KeyRotationBackup{},
+		&models.ServiceKey{},
+		&models.EnvelopeKeyEscrow{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *KeyRotationServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *KeyRotationServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM key_rotation_backups")
+	suite.db.Exec("DELETE FROM key_rotations")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM service_keys")
+	suite.db.Exec("DELETE FROM envelope_key_escrows")
+	suite.db.Exec("DELETE FROM users")
+
+	ctx := context.Background()
+	provider, err := services.NewLocalKeyProvider(filepath.Join(suite.T().TempDir(), "keystore.json"))
+	suite.Require().NoError(err)
+	suite.cryptoManager, err = services.NewCryptoManagerWithKeyProvider(ctx, provider, database.NewDB(suite.db))
+	suite.Require().NoError(err)
+	suite.rotationService = services.NewKeyRotationService(database.NewDB(suite.db), suite.cryptoManager)
+
+	suite.envelopeKey, err = suite.cryptoManager.GenerateEnvelopeKey()
+	suite.Require().NoError(err)
+	keyID, wrapped, err := suite.cryptoManager.WrapEnvelopeKey(ctx, suite.envelopeKey)
+	suite.Require().NoError(err)
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", EnvelopeKey: wrapped, EnvelopeKeyID: keyID}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+
+	// 25 files take three batches
+	suite.fileKeys = map[uint][]byte{}
+	for i := 0; i < 25; i++ {
+		fileKey, err := suite.cryptoManager.GenerateFileKey()
+		suite.Require().NoError(err)
+		encryptedKey, _, err := suite.cryptoManager.EncryptFileKey(fileKey, suite.envelopeKey)
+		suite.Require().NoError(err)
+		userFile := models.UserFile{UserID: suite.user.ID, FileID: uint(i + 1), Filename: fmt.Sprintf("file-%d.txt", i), MimeType: "text/plain", EncryptionKey: encryptedKey}
+		suite.Require().NoError(suite.db.Create(&userFile).Error)
+		suite.fileKeys[userFile.ID] = fileKey
+	}
+}
+
+// currentEnvelopeKey unwraps the envelope key stored on the user.
+func (suite *KeyRotationServiceTestSuite) currentEnvelopeKey() (models.User, []byte) {
+	var user models.User
+	suite.Require().NoError(suite.db.First(&user, suite.user.ID).Error)
+	envelopeKey, err := suite.cryptoManager.UnwrapEnvelopeKey(context.Background(), user.EnvelopeKeyID, user.EnvelopeKey)
+	suite.Require().NoError(err)
+	return user, envelopeKey
+}
+
+// assertFileKeysUnder checks that every file key decrypts under envelopeKey.
+func (suite *KeyRotationServiceTestSuite) assertFileKeysUnder(envelopeKey []byte) {
+	var userFiles []models.UserFile
+	suite.Require().NoError(suite.db.Unscoped().Where("user_id = ?", suite.user.ID).Find(&userFiles).Error)
+	suite.Require().Len(userFiles, len(suite.fileKeys))
+	for _, userFile := range userFiles {
+		fileKey, err := suite.cryptoManager.DecryptFileKey(userFile.EncryptionKey, "", envelopeKey)
+		suite.Require().NoError(err, "file %d", userFile.ID)
+		assert.Equal(suite.T(), suite.fileKeys[userFile.ID], fileKey)
+	}
+}
+
+func (suite *KeyRotationServiceTestSuite) TestRunPending_RotatesInBatches() {
+	// Trashed files are rotated too, so they still open once restored
+	var trashed models.UserFile
+	suite.Require().NoError(suite.db.Where("user_id = ?", suite.user.ID).First(&trashed).Error)
+	suite.Require().NoError(suite.db.Delete(&trashed).Error)
+
+	result, err := suite.rotationService.RotateEnvelopeKey(suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), services.KeyRotationStatusPending, result.Status)
+	assert.Equal(suite.T(), 25, result.TotalFilesAffected)
+
+	ran, err := suite.rotationService.RunPending(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, ran)
+
+	status, err := suite.rotationService.GetRotationStatus(result.RotationID, suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), services.KeyRotationStatusCompleted, status.Status)
+	assert.Equal(suite.T(), 25, status.FilesProcessed)
+
+	user, envelopeKey := suite.currentEnvelopeKey()
+	assert.Equal(suite.T(), 2, user.EnvelopeKeyVersion)
+	assert.NotEqual(suite.T(), suite.envelopeKey, envelopeKey)
+	suite.assertFileKeysUnder(envelopeKey)
+
+	var backups int64
+	suite.Require().NoError(suite.db.Model(&models.KeyRotationBackup{}).Where("rotation_id = ?", result.RotationID).Count(&backups).Error)
+	assert.EqualValues(suite.T(), 25, backups)
+
+	// Nothing is left to run
+	ran, err = suite.rotationService.RunPending(context.Background())
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), ran)
+}
+
+func (suite *KeyRotationServiceTestSuite) TestRunPending_ResumesAfterInterruption() {
+	result, err := suite.rotationService.RotateEnvelopeKey(suite.user.ID)
+	suite.Require().NoError(err)
+
+	// Stop after the first batch, as a shutdown would
+	_, err = suite.rotationService.RunPending(&cancelAfterChecks{Context: context.Background(), checks: 1})
+	assert.ErrorIs(suite.T(), err, context.Canceled)
+
+	status, err := suite.rotationService.GetRotationStatus(result.RotationID, suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), services.KeyRotationStatusInProgress, status.Status)
+	assert.Equal(suite.T(), 10, status.FilesProcessed)
+
+	// The envelope key was swapped together with the first batch
+	user, _ := suite.currentEnvelopeKey()
+	assert.Equal(suite.T(), 2, user.EnvelopeKeyVersion)
+
+	// A restarted process picks the rotation up from its checkpoint
+	restarted := services.NewKeyRotationService(database.NewDB(suite.db), suite.cryptoManager)
+	ran, err := restarted.RunPending(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, ran)
+
+	status, err = restarted.GetRotationStatus(result.RotationID, suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), services.KeyRotationStatusCompleted, status.Status)
+	assert.Equal(suite.T(), 25, status.FilesProcessed)
+
+	_, envelopeKey := suite.currentEnvelopeKey()
+	suite.assertFileKeysUnder(envelopeKey)
+
+	// Every file was re-wrapped exactly once
+	var backups int64
+	suite.Require().NoError(suite.db.Model(&models.KeyRotationBackup{}).Where("rotation_id = ?", result.RotationID).Count(&backups).Error)
+	assert.EqualValues(suite.T(), 25, backups)
+}
+
+func (suite *KeyRotationServiceTestSuite) TestRunPending_FailedRotationRollsBack() {
+	// A file key that is not wrapped by the envelope key stops the rotation mid-way
+	var userFiles []models.UserFile
+	suite.Require().NoError(suite.db.Where("user_id = ?", suite.user.ID).Order("id").Find(&userFiles).Error)
+	broken := userFiles[15]
+	suite.Require().NoError(suite.db.Model(&broken).Update("encryption_key", "not-wrapped").Error)
+
+	result, err := suite.rotationService.RotateEnvelopeKey(suite.user.ID)
+	suite.Require().NoError(err)
+	_, err = suite.rotationService.RunPending(context.Background())
+	suite.Require().NoError(err)
+
+	status, err := suite.rotationService.GetRotationStatus(result.RotationID, suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), services.KeyRotationStatusFailed, status.Status)
+	assert.Contains(suite.T(), status.ErrorMessage, fmt.Sprintf("file %d", broken.ID))
+	assert.Equal(suite.T(), 10, status.FilesProcessed)
+
+	// Rolling back restores the old envelope key and the file keys under it
+	suite.Require().NoError(suite.rotationService.RollbackRotation(result.RotationID, suite.user.ID))
+	user, envelopeKey := suite.currentEnvelopeKey()
+	assert.Equal(suite.T(), 1, user.EnvelopeKeyVersion)
+	assert.Equal(suite.T(), suite.envelopeKey, envelopeKey)
+
+	delete(suite.fileKeys, broken.ID)
+	suite.Require().NoError(suite.db.Delete(&broken).Error)
+	suite.Require().NoError(suite.db.Unscoped().Delete(&broken).Error)
+	suite.assertFileKeysUnder(suite.envelopeKey)
+}
+
+func (suite *KeyRotationServiceTestSuite) TestRunPending_LeavesUploadedKeysAlone() {
+	// Clients upload the file key itself, base64 encoded, not wrapped by the envelope key
+	fileKey, err := suite.cryptoManager.GenerateFileKey()
+	suite.Require().NoError(err)
+	uploaded := models.UserFile{UserID: suite.user.ID, FileID: 100, Filename: "uploaded.txt", MimeType: "text/plain", EncryptionKey: base64.StdEncoding.EncodeToString(fileKey)}
+	suite.Require().NoError(suite.db.Create(&uploaded).Error)
+
+	result, err := suite.rotationService.RotateEnvelopeKey(suite.user.ID)
+	suite.Require().NoError(err)
+	_, err = suite.rotationService.RunPending(context.Background())
+	suite.Require().NoError(err)
+
+	status, err := suite.rotationService.GetRotationStatus(result.RotationID, suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), services.KeyRotationStatusCompleted, status.Status)
+	assert.Equal(suite.T(), 26, status.FilesProcessed)
+
+	var stored models.UserFile
+	suite.Require().NoError(suite.db.First(&stored, uploaded.ID).Error)
+	assert.Equal(suite.T(), uploaded.EncryptionKey, stored.EncryptionKey)
+
+	var backups int64
+	suite.Require().NoError(suite.db.Model(&models.KeyRotationBackup{}).Where("rotation_id = ?", result.RotationID).Count(&backups).Error)
+	assert.EqualValues(suite.T(), 25, backups)
+
+	suite.Require().NoError(suite.db.Unscoped().Delete(&uploaded).Error)
+	_, envelopeKey := suite.currentEnvelopeKey()
+	suite.assertFileKeysUnder(envelopeKey)
+}
+
+func TestKeyRotationServiceSuite(t *testing.T) {
+	suite.Run(t, new(KeyRotationServiceTestSuite))
+}
@@ -0,0 +1,376 @@
+package services_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+const throttleTestPassword = "Password123!"
+
+type LoginThrottleServiceTestSuite struct {
+	suite.Suite
+	db                *gorm.DB
+	dbService         *database.DB
+	cfg               *config.Config
+	mail              *services.MemoryMailSender
+	emailTokenService *services.EmailTokenService
+	throttleService   *services.LoginThrottleService
+	user              models.User
+	other             models.User
+	admin             models.User
+}
+
+func (suite *LoginThrottleServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:login_throttle_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.EmailToken{}, &models.Session{}, &models.RefreshToken{},
+		&models.LoginThrottle{}, &models.LoginAuditEvent{})
+	suite.Require().NoError(err)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *LoginThrottleServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM login_audit_events")
+	suite.db.Exec("DELETE FROM login_throttles")
+	suite.db.Exec("DELETE FROM refresh_tokens")
+	suite.db.Exec("DELETE FROM sessions")
+	suite.db.Exec("DELETE FROM email_tokens")
+	suite.db.Exec("DELETE FROM users")
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(throttleTestPassword), bcrypt.MinCost)
+	suite.Require().NoError(err)
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: string(passwordHash), StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+	suite.other = models.User{Username: "other", Email: "other@example.com", PasswordHash: string(passwordHash), StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.other).Error)
+	suite.admin = models.User{Username: "admin", Email: "admin@example.com", PasswordHash: string(passwordHash), StorageQuota: 10485760, IsAdmin: true}
+	suite.Require().NoError(suite.db.Create(&suite.admin).Error)
+
+	suite.dbService = database.NewDB(suite.db)
+	suite.mail = services.NewMemoryMailSender()
+	suite.newService(&config.Config{
+		JWTSecret:              "test-secret-key-that-is-long-enough-for-hs256",
+		FrontendURL:            "https://aegis.example.com",
+		LoginMaxFailures:       3,
+		LoginIPMaxFailures:     5,
+		LoginFailureWindowMins: 15,
+		LoginLockoutMinutes:    15,
+	})
+}
+
+func (suite *LoginThrottleServiceTestSuite) newService(cfg *config.Config) {
+	suite.cfg = cfg
+	authService := services.NewAuthService(cfg)
+	userService := services.NewUserService(authService, suite.dbService)
+	suite.emailTokenService = services.NewEmailTokenService(cfg, suite.dbService, suite.mail)
+	suite.throttleService = services.NewLoginThrottleService(cfg, suite.dbService, userService, suite.emailTokenService)
+}
+
+func (suite *LoginThrottleServiceTestSuite) login(identifier, password, ip string) error {
+	_, err := suite.throttleService.Authenticate(identifier, password, ip)
+	return err
+}
+
+func (suite *LoginThrottleServiceTestSuite) assertCode(err error, code apperrors.ErrorCode) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code, err.Error())
+}
+
+func (suite *LoginThrottleServiceTestSuite) auditEvents(event string) []models.LoginAuditEvent {
+	var events []models.LoginAuditEvent
+	suite.Require().NoError(suite.db.Where("event = ?", event).Order("id").Find(&events).Error)
+	return events
+}
+
+func (suite *LoginThrottleServiceTestSuite) accountThrottle(userID uint) models.LoginThrottle {
+	var throttle models.LoginThrottle
+	suite.Require().NoError(suite.db.Where("scope = ? AND user_id = ?", models.LoginThrottleScopeAccount, userID).First(&throttle).Error)
+	return throttle
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestLockoutAfterRepeatedFailures() {
+	for i := 0; i < 2; i++ {
+		suite.assertCode(suite.login("owner", "wrong", "203.0.113.7"), apperrors.ErrCodeUnauthorized)
+	}
+	assert.Empty(suite.T(), suite.auditEvents(models.LoginAuditAccountLocked))
+
+	suite.assertCode(suite.login("owner@example.com", "wrong", "203.0.113.7"), apperrors.ErrCodeUnauthorized)
+
+	// Once locked, even the right password is refused
+	err := suite.login("owner", throttleTestPassword, "198.51.100.1")
+	suite.assertCode(err, apperrors.ErrCodeForbidden)
+	assert.Contains(suite.T(), err.Error(), "locked")
+
+	events := suite.auditEvents(models.LoginAuditAccountLocked)
+	suite.Require().Len(events, 1)
+	suite.Require().NotNil(events[0].UserID)
+	assert.Equal(suite.T(), suite.user.ID, *events[0].UserID)
+	assert.Equal(suite.T(), "203.0.113.7", events[0].IPAddress)
+
+	// Other accounts are not affected
+	assert.NoError(suite.T(), suite.login("other", throttleTestPassword, "198.51.100.1"))
+
+	lockouts, err := suite.throttleService.ListLockouts()
+	suite.Require().NoError(err)
+	suite.Require().Len(lockouts, 1)
+	suite.Require().NotNil(lockouts[0].User)
+	assert.Equal(suite.T(), "owner", lockouts[0].User.Username)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestUnlockByEmail() {
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+
+	assert.Eventually(suite.T(), func() bool { return len(suite.mail.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	msg := suite.mail.Messages()[0]
+	assert.Equal(suite.T(), "owner@example.com", msg.To)
+
+	prefix := "https://aegis.example.com/unlock-account?token="
+	start := strings.Index(msg.Body, prefix)
+	suite.Require().GreaterOrEqual(start, 0, msg.Body)
+	token, err := url.QueryUnescape(strings.Fields(msg.Body[start+len(prefix):])[0])
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.emailTokenService.UnlockAccount(token))
+	assert.NoError(suite.T(), suite.login("owner", throttleTestPassword, ""))
+
+	events := suite.auditEvents(models.LoginAuditAccountUnlocked)
+	suite.Require().Len(events, 1)
+	assert.Nil(suite.T(), events[0].ActorID)
+	assert.Equal(suite.T(), "unlocked by email link", events[0].Detail)
+
+	// Unlock links are single-use
+	suite.assertCode(suite.emailTokenService.UnlockAccount(token), apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestAdminUnlock() {
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+	suite.assertCode(suite.login("owner", throttleTestPassword, ""), apperrors.ErrCodeForbidden)
+
+	suite.Require().NoError(suite.throttleService.UnlockAccount(suite.admin.ID, suite.user.ID))
+	assert.NoError(suite.T(), suite.login("owner", throttleTestPassword, ""))
+
+	events := suite.auditEvents(models.LoginAuditAccountUnlocked)
+	suite.Require().Len(events, 1)
+	suite.Require().NotNil(events[0].ActorID)
+	assert.Equal(suite.T(), suite.admin.ID, *events[0].ActorID)
+
+	suite.assertCode(suite.throttleService.UnlockAccount(suite.admin.ID, 9999), apperrors.ErrCodeNotFound)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestUnknownIdentifierLocksLikeRealAccount() {
+	for i := 0; i < 3; i++ {
+		suite.assertCode(suite.login("nobody", "wrong", ""), apperrors.ErrCodeUnauthorized)
+	}
+
+	unknownErr := suite.login("nobody", "wrong", "")
+	suite.assertCode(unknownErr, apperrors.ErrCodeForbidden)
+
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+	realErr := suite.login("owner", "wrong", "")
+
+	// Minutes remaining are the same, so the messages match exactly
+	assert.Equal(suite.T(), realErr.Error(), unknownErr.Error())
+
+	events := suite.auditEvents(models.LoginAuditAccountLocked)
+	suite.Require().Len(events, 2)
+	assert.Nil(suite.T(), events[0].UserID)
+	assert.Equal(suite.T(), "nobody", events[0].Identifier)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestIPLockout() {
+	// Spread over accounts so that no single account is locked
+	for _, identifier := range []string{"owner", "owner", "other", "other", "nobody"} {
+		suite.login(identifier, "wrong", "203.0.113.7")
+	}
+
+	err := suite.login("admin", throttleTestPassword, "203.0.113.7")
+	suite.assertCode(err, apperrors.ErrCodeForbidden)
+	assert.Contains(suite.T(), err.Error(), "network")
+	assert.Len(suite.T(), suite.auditEvents(models.LoginAuditIPLocked), 1)
+
+	// Other addresses can still sign in
+	assert.NoError(suite.T(), suite.login("admin", throttleTestPassword, "198.51.100.1"))
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestSuccessResetsAccountFailures() {
+	suite.login("owner", "wrong", "203.0.113.7")
+	suite.login("owner", "wrong", "203.0.113.7")
+	suite.Require().NoError(suite.login("owner", throttleTestPassword, "203.0.113.7"))
+
+	var count int64
+	suite.db.Model(&models.LoginThrottle{}).Where("scope = ?", models.LoginThrottleScopeAccount).Count(&count)
+	assert.Zero(suite.T(), count)
+
+	// The address keeps its failures
+	var ip models.LoginThrottle
+	suite.Require().NoError(suite.db.Where("scope = ? AND subject = ?", models.LoginThrottleScopeIP, "203.0.113.7").First(&ip).Error)
+	assert.Equal(suite.T(), 2, ip.FailedCount)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestRepeatedLockoutsGrowLonger() {
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+	first := suite.accountThrottle(suite.user.ID)
+	suite.Require().NotNil(first.LockedUntil)
+	assert.WithinDuration(suite.T(), time.Now().Add(15*time.Minute), *first.LockedUntil, time.Minute)
+
+	// Let the lockout run out and fail again
+	suite.db.Model(&models.LoginThrottle{}).Where("id = ?", first.ID).Update("locked_until", time.Now().Add(-time.Second))
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+	second := suite.accountThrottle(suite.user.ID)
+	suite.Require().NotNil(second.LockedUntil)
+	assert.Equal(suite.T(), 2, second.LockoutCount)
+	assert.WithinDuration(suite.T(), time.Now().Add(30*time.Minute), *second.LockedUntil, time.Minute)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestProgressiveDelay() {
+	suite.newService(&config.Config{
+		JWTSecret:              "test-secret-key-that-is-long-enough-for-hs256",
+		LoginMaxFailures:       10,
+		LoginFailureWindowMins: 15,
+		LoginLockoutMinutes:    15,
+		LoginDelayBaseSeconds:  30,
+	})
+
+	// The first retry is immediate
+	suite.assertCode(suite.login("owner", "wrong", ""), apperrors.ErrCodeUnauthorized)
+	suite.assertCode(suite.login("owner", "wrong", ""), apperrors.ErrCodeUnauthorized)
+
+	err := suite.login("owner", throttleTestPassword, "")
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+	assert.Contains(suite.T(), err.Error(), "wait 30 seconds")
+	assert.Equal(suite.T(), 2, suite.accountThrottle(suite.user.ID).FailedCount, "refused attempts are not counted")
+
+	// After the delay the password is checked again, and the next delay doubles
+	throttle := suite.accountThrottle(suite.user.ID)
+	suite.db.Model(&throttle).Update("last_failed_at", time.Now().Add(-31*time.Second))
+	suite.assertCode(suite.login("owner", "wrong", ""), apperrors.ErrCodeUnauthorized)
+	err = suite.login("owner", throttleTestPassword, "")
+	assert.Contains(suite.T(), err.Error(), "wait 60 seconds")
+
+	throttle = suite.accountThrottle(suite.user.ID)
+	suite.db.Model(&throttle).Update("last_failed_at", time.Now().Add(-61*time.Second))
+	assert.NoError(suite.T(), suite.login("owner", throttleTestPassword, ""))
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestFailuresOutsideWindowAreForgotten() {
+	suite.login("owner", "wrong", "")
+	suite.login("owner", "wrong", "")
+
+	throttle := suite.accountThrottle(suite.user.ID)
+	suite.db.Model(&throttle).Update("first_failed_at", time.Now().Add(-16*time.Minute))
+
+	suite.login("owner", "wrong", "")
+	throttle = suite.accountThrottle(suite.user.ID)
+	assert.Equal(suite.T(), 1, throttle.FailedCount)
+	assert.Nil(suite.T(), throttle.LockedUntil)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestPasswordResetClearsLockout() {
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+	assert.Eventually(suite.T(), func() bool { return len(suite.mail.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+
+	suite.Require().NoError(suite.emailTokenService.RequestPasswordReset("owner@example.com"))
+	assert.Eventually(suite.T(), func() bool { return len(suite.mail.Messages()) == 2 }, time.Second, 10*time.Millisecond)
+	body := suite.mail.Messages()[1].Body
+	prefix := "https://aegis.example.com/reset-password?token="
+	start := strings.Index(body, prefix)
+	suite.Require().GreaterOrEqual(start, 0, body)
+	token, err := url.QueryUnescape(strings.Fields(body[start+len(prefix):])[0])
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.emailTokenService.ResetPassword(token, "NewPassword456!"))
+	assert.NoError(suite.T(), suite.login("owner", "NewPassword456!", ""))
+
+	events := suite.auditEvents(models.LoginAuditAccountUnlocked)
+	suite.Require().Len(events, 1)
+	assert.Equal(suite.T(), "unlocked by password reset", events[0].Detail)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestDisabledWithoutLimits() {
+	suite.newService(&config.Config{JWTSecret: "test-secret-key-that-is-long-enough-for-hs256"})
+
+	for i := 0; i < 10; i++ {
+		suite.login("owner", "wrong", "203.0.113.7")
+	}
+	assert.NoError(suite.T(), suite.login("owner", throttleTestPassword, "203.0.113.7"))
+
+	var count int64
+	suite.db.Model(&models.LoginThrottle{}).Count(&count)
+	assert.Zero(suite.T(), count)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestCleanupExpired() {
+	suite.login("nobody", "wrong", "203.0.113.7")
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+
+	suite.db.Model(&models.LoginThrottle{}).Where("1 = 1").Updates(map[string]interface{}{
+		"last_failed_at": time.Now().Add(-time.Hour),
+		"locked_until":   gorm.Expr("CASE WHEN locked_until IS NULL THEN NULL ELSE ? END", time.Now().Add(-time.Minute)),
+	})
+
+	cleaned, err := suite.throttleService.CleanupExpired()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), int64(2), cleaned)
+
+	// The locked account keeps its lockout count
+	assert.Equal(suite.T(), 1, suite.accountThrottle(suite.user.ID).LockoutCount)
+}
+
+func (suite *LoginThrottleServiceTestSuite) TestListAuditEvents() {
+	for i := 0; i < 3; i++ {
+		suite.login("owner", "wrong", "")
+	}
+	suite.Require().NoError(suite.throttleService.UnlockAccount(suite.admin.ID, suite.user.ID))
+
+	events, err := suite.throttleService.ListAuditEvents(0)
+	suite.Require().NoError(err)
+	suite.Require().Len(events, 2)
+	assert.Equal(suite.T(), models.LoginAuditAccountUnlocked, events[0].Event)
+	assert.Equal(suite.T(), models.LoginAuditAccountLocked, events[1].Event)
+
+	events, err = suite.throttleService.ListAuditEvents(1)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), events, 1)
+}
+
+func TestLoginThrottleServiceSuite(t *testing.T) {
+	suite.Run(t, new(LoginThrottleServiceTestSuite))
+}
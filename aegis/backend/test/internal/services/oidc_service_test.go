@@ -0,0 +1,433 @@
+package services_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+const (
+	mockIdPClientID     = "aegis-test-client"
+	mockIdPClientSecret = "aegis-test-secret"
+	mockIdPRedirectURL  = "http://localhost:3000/auth/callback"
+)
+
+// mockIdP is an in-process OpenID Connect provider. authorize stands in for the user
+// signing in at the provider; the token endpoint checks PKCE and client credentials
+// like a real provider would.
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+
+	// tamper, when set, edits ID token claims before signing
+	tamper func(claims jwt.MapClaims)
+	// signingKey, when set, signs ID tokens instead of the published key
+	signingKey *rsa.PrivateKey
+}
+
+type mockAuthorization struct {
+	nonce         string
+	codeChallenge string
+	redirectURI   string
+	claims        jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, kid: "mock-key-1", codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                           idp.server.URL,
+			"authorization_endpoint":           idp.server.URL + "/authorize",
+			"token_endpoint":                   idp.server.URL + "/token",
+			"jwks_uri":                         idp.server.URL + "/jwks",
+			"code_challenge_methods_supported": []string{"S256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": idp.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", idp.handleToken)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize plays the user signing in at the provider: it checks the authorization
+// request and returns the code the provider would send to the redirect URI.
+func (idp *mockIdP) authorize(t *testing.T, authorizationURL string, claims jwt.MapClaims) (state, code string) {
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	assert.Equal(t, idp.server.URL+"/authorize", parsed.Scheme+"://"+parsed.Host+parsed.Path)
+	assert.Equal(t, "code", query.Get("response_type"))
+	assert.Equal(t, mockIdPClientID, query.Get("client_id"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Contains(t, query.Get("scope"), "openid")
+
+	code = base64.RawURLEncoding.EncodeToString(big.NewInt(time.Now().UnixNano()).Bytes())
+	idp.mu.Lock()
+	idp.codes[code] = mockAuthorization{
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		redirectURI:   query.Get("redirect_uri"),
+		claims:        claims,
+	}
+	idp.mu.Unlock()
+	return query.Get("state"), code
+}
+
+func (idp *mockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != mockIdPClientID || clientSecret != mockIdPClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		tokenError("unsupported_grant_type")
+		return
+	}
+
+	idp.mu.Lock()
+	authorization, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+	if !ok || authorization.redirectURI != r.PostFormValue("redirect_uri") {
+		tokenError("invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   mockIdPClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"nonce": authorization.nonce,
+	}
+	for name, value := range authorization.claims {
+		claims[name] = value
+	}
+	if idp.tamper != nil {
+		idp.tamper(claims)
+	}
+
+	signingKey := idp.key
+	if idp.signingKey != nil {
+		signingKey = idp.signingKey
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	idToken, err := token.SignedString(signingKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+type OIDCServiceTestSuite struct {
+	suite.Suite
+	db          *gorm.DB
+	idp         *mockIdP
+	config      *config.Config
+	oidcService *services.OIDCService
+}
+
+func (suite *OIDCServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:oidc_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.UserIdentity{}, &models.OIDCLoginState{})
+	suite.Require().NoError(err)
+}
+
+func (suite *OIDCServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *OIDCServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM oidc_login_states")
+	suite.db.Exec("DELETE FROM user_identities")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.idp = newMockIdP(suite.T())
+	suite.config = &config.Config{
+		OIDCIssuerURL:    suite.idp.server.URL,
+		OIDCClientID:     mockIdPClientID,
+		OIDCClientSecret: mockIdPClientSecret,
+		OIDCRedirectURL:  mockIdPRedirectURL,
+		OIDCScopes:       "openid email profile",
+		OIDCGroupsClaim:  "groups",
+	}
+	suite.oidcService = services.NewOIDCService(suite.config, database.NewDB(suite.db))
+}
+
+// login runs the whole authorization code flow for a user with the given claims.
+func (suite *OIDCServiceTestSuite) login(claims jwt.MapClaims) (*models.User, error) {
+	authorizationURL, err := suite.oidcService.BeginLogin()
+	suite.Require().NoError(err)
+	state, code := suite.idp.authorize(suite.T(), authorizationURL, claims)
+	return suite.oidcService.CompleteLogin(state, code)
+}
+
+func (suite *OIDCServiceTestSuite) assertCode(err error, code apperrors.ErrorCode) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code)
+}
+
+func janeClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":                "idp-user-1",
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"preferred_username": "jane.doe",
+	}
+}
+
+func (suite *OIDCServiceTestSuite) TestBeginLogin() {
+	authorizationURL, err := suite.oidcService.BeginLogin()
+	suite.Require().NoError(err)
+
+	parsed, err := url.Parse(authorizationURL)
+	suite.Require().NoError(err)
+	query := parsed.Query()
+	assert.Equal(suite.T(), mockIdPRedirectURL, query.Get("redirect_uri"))
+	assert.Equal(suite.T(), "S256", query.Get("code_challenge_method"))
+	assert.NotEmpty(suite.T(), query.Get("nonce"))
+
+	// The verifier stays on the server; only its challenge is sent
+	var loginState models.OIDCLoginState
+	suite.Require().NoError(suite.db.Where("state = ?", query.Get("state")).First(&loginState).Error)
+	challenge := sha256.Sum256([]byte(loginState.CodeVerifier))
+	assert.Equal(suite.T(), base64.RawURLEncoding.EncodeToString(challenge[:]), query.Get("code_challenge"))
+	assert.Equal(suite.T(), loginState.Nonce, query.Get("nonce"))
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_ProvisionsUser() {
+	user, err := suite.login(janeClaims())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), "jane@example.com", user.Email)
+	assert.Equal(suite.T(), "jane_doe", user.Username)
+	assert.False(suite.T(), user.IsAdmin)
+	assert.Empty(suite.T(), user.PasswordHash)
+
+	var identity models.UserIdentity
+	suite.Require().NoError(suite.db.Where("subject = ?", "idp-user-1").First(&identity).Error)
+	assert.Equal(suite.T(), user.ID, identity.UserID)
+	assert.Equal(suite.T(), suite.idp.server.URL, identity.Issuer)
+
+	// Signing in again finds the same account through the identity
+	again, err := suite.login(janeClaims())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), user.ID, again.ID)
+
+	var count int64
+	suite.db.Model(&models.User{}).Count(&count)
+	assert.Equal(suite.T(), int64(1), count)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_UsernameTaken() {
+	existing := models.User{Username: "jane_doe", Email: "other@example.com", PasswordHash: "hash", StorageQuota: 1024}
+	suite.Require().NoError(suite.db.Create(&existing).Error)
+
+	user, err := suite.login(janeClaims())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), "jane_doe-2", user.Username)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_LinksVerifiedEmail() {
+	existing := models.User{Username: "jane", Email: "jane@example.com", PasswordHash: "hash", StorageQuota: 1024}
+	suite.Require().NoError(suite.db.Create(&existing).Error)
+
+	user, err := suite.login(janeClaims())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), existing.ID, user.ID)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_UnverifiedEmailConflict() {
+	existing := models.User{Username: "jane", Email: "jane@example.com", PasswordHash: "hash", StorageQuota: 1024}
+	suite.Require().NoError(suite.db.Create(&existing).Error)
+
+	claims := janeClaims()
+	claims["email_verified"] = false
+	_, err := suite.login(claims)
+	suite.assertCode(err, apperrors.ErrCodeConflict)
+
+	var count int64
+	suite.db.Model(&models.UserIdentity{}).Count(&count)
+	assert.Equal(suite.T(), int64(0), count)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_AdminGroups() {
+	suite.config.OIDCAdminGroups = "aegis-admins, platform"
+
+	claims := janeClaims()
+	claims["groups"] = []string{"engineering", "aegis-admins"}
+	user, err := suite.login(claims)
+	suite.Require().NoError(err)
+	assert.True(suite.T(), user.IsAdmin)
+
+	// Leaving the group at the provider removes admin rights at the next login
+	claims["groups"] = []string{"engineering"}
+	user, err = suite.login(claims)
+	suite.Require().NoError(err)
+	assert.False(suite.T(), user.IsAdmin)
+
+	var stored models.User
+	suite.Require().NoError(suite.db.First(&stored, user.ID).Error)
+	assert.False(suite.T(), stored.IsAdmin)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_StateIsSingleUse() {
+	authorizationURL, err := suite.oidcService.BeginLogin()
+	suite.Require().NoError(err)
+	state, code := suite.idp.authorize(suite.T(), authorizationURL, janeClaims())
+
+	_, err = suite.oidcService.CompleteLogin(state, code)
+	suite.Require().NoError(err)
+
+	_, err = suite.oidcService.CompleteLogin(state, code)
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+
+	_, err = suite.oidcService.CompleteLogin("unknown-state", code)
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_ExpiredState() {
+	authorizationURL, err := suite.oidcService.BeginLogin()
+	suite.Require().NoError(err)
+	state, code := suite.idp.authorize(suite.T(), authorizationURL, janeClaims())
+
+	suite.db.Model(&models.OIDCLoginState{}).Where("state = ?", state).Update("expires_at", time.Now().Add(-time.Minute))
+	_, err = suite.oidcService.CompleteLogin(state, code)
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_PKCEVerifierMismatch() {
+	authorizationURL, err := suite.oidcService.BeginLogin()
+	suite.Require().NoError(err)
+	state, code := suite.idp.authorize(suite.T(), authorizationURL, janeClaims())
+
+	// A code intercepted for another login cannot be redeemed without its verifier
+	suite.db.Model(&models.OIDCLoginState{}).Where("state = ?", state).Update("code_verifier", "another-verifier")
+	_, err = suite.oidcService.CompleteLogin(state, code)
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *OIDCServiceTestSuite) TestCompleteLogin_RejectsInvalidIDTokens() {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	suite.Require().NoError(err)
+
+	tests := []struct {
+		name       string
+		tamper     func(claims jwt.MapClaims)
+		signingKey *rsa.PrivateKey
+	}{
+		{name: "nonce mismatch", tamper: func(claims jwt.MapClaims) { claims["nonce"] = "replayed-nonce" }},
+		{name: "other audience", tamper: func(claims jwt.MapClaims) { claims["aud"] = "another-client" }},
+		{name: "other issuer", tamper: func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }},
+		{name: "expired", tamper: func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "unknown signing key", signingKey: otherKey},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			suite.idp.tamper = tt.tamper
+			suite.idp.signingKey = tt.signingKey
+			defer func() {
+				suite.idp.tamper = nil
+				suite.idp.signingKey = nil
+			}()
+
+			_, err := suite.login(janeClaims())
+			suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+		})
+	}
+
+	var count int64
+	suite.db.Model(&models.User{}).Count(&count)
+	assert.Equal(suite.T(), int64(0), count)
+}
+
+func (suite *OIDCServiceTestSuite) TestDisabled() {
+	suite.config.OIDCIssuerURL = ""
+
+	assert.False(suite.T(), suite.oidcService.Enabled())
+	_, err := suite.oidcService.BeginLogin()
+	suite.assertCode(err, apperrors.ErrCodeInvalidArgument)
+}
+
+func (suite *OIDCServiceTestSuite) TestRequirePasswordSignup() {
+	assert.NoError(suite.T(), suite.oidcService.RequirePasswordSignup())
+
+	suite.config.PasswordSignupDisabled = true
+	assert.False(suite.T(), suite.oidcService.PasswordSignupAllowed())
+	suite.assertCode(suite.oidcService.RequirePasswordSignup(), apperrors.ErrCodeForbidden)
+}
+
+func TestOIDCServiceSuite(t *testing.T) {
+	suite.Run(t, new(OIDCServiceTestSuite))
+}
@@ -0,0 +1,185 @@
+package services_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type PersonalAccessTokenServiceTestSuite struct {
+	suite.Suite
+	db         *gorm.DB
+	patService *services.PersonalAccessTokenService
+	user       models.User
+	admin      models.User
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:personal_access_token_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.PersonalAccessToken{})
+	suite.Require().NoError(err)
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM personal_access_tokens")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+	suite.admin = models.User{Username: "admin", Email: "admin@example.com", PasswordHash: "hash", StorageQuota: 10485760, IsAdmin: true}
+	suite.Require().NoError(suite.db.Create(&suite.admin).Error)
+
+	suite.patService = services.NewPersonalAccessTokenService(database.NewDB(suite.db))
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) create(user models.User, scopes ...string) (string, *models.PersonalAccessToken) {
+	value, token, err := suite.patService.CreateToken(&user, "ci", scopes, nil)
+	suite.Require().NoError(err)
+	return value, token
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) assertCode(err error, code apperrors.ErrorCode) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code)
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TestCreateToken() {
+	value, token := suite.create(suite.user, "files:write", " Files:Read ", "files:write")
+
+	assert.True(suite.T(), strings.HasPrefix(value, "aegis_pat_"))
+	assert.Len(suite.T(), value, len("aegis_pat_")+64)
+	assert.Equal(suite.T(), value[:len("aegis_pat_")+8], token.TokenPrefix)
+	assert.Equal(suite.T(), "files:read files:write", token.Scopes)
+	assert.Nil(suite.T(), token.ExpiresAt)
+
+	// Only the hash is stored
+	var stored models.PersonalAccessToken
+	suite.Require().NoError(suite.db.First(&stored, token.ID).Error)
+	assert.Equal(suite.T(), services.HashPersonalAccessToken(value), stored.TokenHash)
+	assert.NotContains(suite.T(), stored.TokenHash, value[len("aegis_pat_"):])
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TestCreateToken_Validation() {
+	_, _, err := suite.patService.CreateToken(&suite.user, "ci", []string{"files:delete"}, nil)
+	suite.assertCode(err, apperrors.ErrCodeInvalidArgument)
+
+	_, _, err = suite.patService.CreateToken(&suite.user, "ci", nil, nil)
+	suite.assertCode(err, apperrors.ErrCodeInvalidArgument)
+
+	_, _, err = suite.patService.CreateToken(&suite.user, "  ", []string{"files:read"}, nil)
+	suite.assertCode(err, apperrors.ErrCodeInvalidArgument)
+
+	zero := 0
+	_, _, err = suite.patService.CreateToken(&suite.user, "ci", []string{"files:read"}, &zero)
+	suite.assertCode(err, apperrors.ErrCodeInvalidArgument)
+
+	// Only administrators can grant the admin scope
+	_, _, err = suite.patService.CreateToken(&suite.user, "ci", []string{"admin"}, nil)
+	suite.assertCode(err, apperrors.ErrCodeForbidden)
+	_, _, err = suite.patService.CreateToken(&suite.admin, "ci", []string{"admin"}, nil)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TestAuthenticate() {
+	value, token := suite.create(suite.user, "files:read")
+
+	authenticated, err := suite.patService.Authenticate(value)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), token.ID, authenticated.ID)
+	assert.Equal(suite.T(), suite.user.Email, authenticated.User.Email)
+	assert.Equal(suite.T(), []string{"files:read"}, services.TokenScopes(authenticated))
+
+	_, err = suite.patService.Authenticate("aegis_pat_unknown")
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+	_, err = suite.patService.Authenticate(value[len("aegis_pat_"):])
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TestAuthenticate_Expired() {
+	days := 7
+	value, token, err := suite.patService.CreateToken(&suite.user, "ci", []string{"files:read"}, &days)
+	suite.Require().NoError(err)
+	suite.Require().NotNil(token.ExpiresAt)
+	assert.WithinDuration(suite.T(), time.Now().Add(7*24*time.Hour), *token.ExpiresAt, time.Minute)
+
+	_, err = suite.patService.Authenticate(value)
+	suite.Require().NoError(err)
+
+	suite.db.Model(&models.PersonalAccessToken{}).Where("id = ?", token.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	_, err = suite.patService.Authenticate(value)
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TestRevokeToken() {
+	value, token := suite.create(suite.user, "files:read")
+
+	// Tokens of other users cannot be revoked
+	err := suite.patService.RevokeToken(suite.admin.ID, token.ID)
+	suite.assertCode(err, apperrors.ErrCodeNotFound)
+
+	suite.Require().NoError(suite.patService.RevokeToken(suite.user.ID, token.ID))
+	_, err = suite.patService.Authenticate(value)
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+
+	tokens, err := suite.patService.ListTokens(suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), tokens)
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TestListTokens() {
+	_, first := suite.create(suite.user, "files:read")
+	_, second := suite.create(suite.user, "rooms:read")
+	suite.create(suite.admin, "admin")
+
+	tokens, err := suite.patService.ListTokens(suite.user.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(tokens, 2)
+	assert.Equal(suite.T(), second.ID, tokens[0].ID)
+	assert.Equal(suite.T(), first.ID, tokens[1].ID)
+}
+
+func (suite *PersonalAccessTokenServiceTestSuite) TestTouchToken() {
+	value, _ := suite.create(suite.user, "files:read")
+	token, err := suite.patService.Authenticate(value)
+	suite.Require().NoError(err)
+	suite.Require().Nil(token.LastUsedAt)
+
+	suite.Require().NoError(suite.patService.TouchToken(token, time.Minute))
+
+	token, err = suite.patService.Authenticate(value)
+	suite.Require().NoError(err)
+	suite.Require().NotNil(token.LastUsedAt)
+	lastUsed := *token.LastUsedAt
+
+	// A second use within the interval is not written
+	suite.Require().NoError(suite.patService.TouchToken(token, time.Minute))
+	token, err = suite.patService.Authenticate(value)
+	suite.Require().NoError(err)
+	assert.True(suite.T(), lastUsed.Equal(*token.LastUsedAt))
+}
+
+func TestPersonalAccessTokenServiceSuite(t *testing.T) {
+	suite.Run(t, new(PersonalAccessTokenServiceTestSuite))
+}
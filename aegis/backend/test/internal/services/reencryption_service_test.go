@@ -0,0 +1,385 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/nacl/secretbox"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type ReencryptionServiceTestSuite struct {
+	suite.Suite
+	db                  *gorm.DB
+	backend             *services.MemoryStorageBackend
+	fileService         *services.FileService
+	cryptoManager       *services.CryptoManager
+	reencryptionService *services.ReencryptionService
+	owner               models.User
+	fileKey             []byte
+	plaintext           []byte
+	userFile            *models.UserFile
+}
+
+func (suite *ReencryptionServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:reencryption_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.File{},
+		&models.UserFile{},
+		&models.Folder{},
+		&models.RoomFile{},
+		&models.RoomMember{},
+		&models.StorageIntegrityIssue{},
+		&models.FileVersion{},
+		&models.FileShare{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *ReencryptionServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *ReencryptionServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM file_shares")
+	suite.db.Exec("DELETE FROM file_versions")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM files")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.owner = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.owner).Error)
+
+	// Browsers upload secretbox ciphertext with the nonce prepended
+	suite.fileKey = bytes.Repeat([]byte{9}, 32)
+	suite.plaintext = []byte("quarterly report")
+	legacy := suite.sealLegacy(suite.plaintext, suite.fileKey)
+
+	cfg := &config.Config{}
+	dbService := database.NewDB(suite.db)
+	suite.backend = services.NewMemoryStorageBackend()
+	fileStorageService := services.NewFileStorageServiceWithBackend(suite.backend)
+	suite.fileService = services.NewFileService(cfg, dbService, fileStorageService, services.NewAuthService(cfg))
+	suite.cryptoManager = newTestCryptoManager(suite.T(), func(c *config.CryptoConfig) {
+		c.FileEncryptionAlgorithm = services.CipherAESGCM
+		c.DeprecatedAlgorithms = []string{services.CipherNaClSecretbox}
+	})
+	suite.reencryptionService = services.NewReencryptionService(dbService, suite.cryptoManager, fileStorageService)
+
+	userFile, err := suite.fileService.UploadFile(suite.owner.ID, "report.txt", "text/plain", hashOf(legacy), base64.StdEncoding.EncodeToString(suite.fileKey), bytes.NewReader(legacy), int64(len(legacy)), nil)
+	suite.Require().NoError(err)
+	suite.userFile = userFile
+}
+
+func (suite *ReencryptionServiceTestSuite) sealLegacy(plaintext, key []byte) []byte {
+	var nonce [24]byte
+	var secretboxKey [32]byte
+	copy(nonce[:], bytes.Repeat([]byte{1}, 24))
+	copy(secretboxKey[:], key)
+	return secretbox.Seal(nonce[:], plaintext, &nonce, &secretboxKey)
+}
+
+// createLegacyShare stores a share the way shares were stored before the ciphertext
+// format: hex AES-GCM keys and a base64 AES-GCM password, each with its own IV.
+func (suite *ReencryptionServiceTestSuite) createLegacyShare(password string) *models.FileShare {
+	manager := suite.cryptoManager
+	envelopeKey := bytes.Repeat([]byte{2}, 32)
+	salt := bytes.Repeat([]byte{3}, 16)
+	iv := bytes.Repeat([]byte{4}, 12)
+
+	encryptedEnvelopeKey, err := manager.EncryptWithAESGCM(envelopeKey, manager.DeriveKeyFromPassword(password, salt), iv)
+	suite.Require().NoError(err)
+	encryptedFileKey, err := manager.EncryptWithAESGCM(suite.fileKey, envelopeKey, iv)
+	suite.Require().NoError(err)
+	encryptedPassword, err := manager.EncryptWithAESGCM([]byte(password), manager.GetConfig().SharePasswordKey, iv)
+	suite.Require().NoError(err)
+
+	share := &models.FileShare{
+		UserFileID:        suite.userFile.ID,
+		ShareToken:        "legacy-" + password,
+		EncryptedKey:      hex.EncodeToString(encryptedFileKey),
+		IV:                hex.EncodeToString(iv),
+		EnvelopeKey:       hex.EncodeToString(encryptedEnvelopeKey),
+		EnvelopeSalt:      hex.EncodeToString(salt),
+		EnvelopeIV:        hex.EncodeToString(iv),
+		EncryptedPassword: base64.StdEncoding.EncodeToString(encryptedPassword),
+		PasswordIV:        base64.StdEncoding.EncodeToString(iv),
+	}
+	suite.Require().NoError(suite.db.Create(share).Error)
+	return share
+}
+
+func (suite *ReencryptionServiceTestSuite) TestRun_MigratesLegacyShares() {
+	share := suite.createLegacyShare("Correct-Horse-1")
+	shareService := services.NewShareService(database.NewDB(suite.db), "http://localhost", suite.cryptoManager)
+
+	report, err := suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.SharesScanned)
+	assert.Equal(suite.T(), 1, report.SharesMigrated)
+	assert.Empty(suite.T(), report.Errors)
+
+	var migrated models.FileShare
+	suite.Require().NoError(suite.db.First(&migrated, share.ID).Error)
+	assert.Empty(suite.T(), migrated.EnvelopeSalt)
+	assert.Empty(suite.T(), migrated.EnvelopeIV)
+	assert.Empty(suite.T(), migrated.PasswordIV)
+	for _, text := range []string{migrated.EncryptedKey, migrated.EnvelopeKey, migrated.EncryptedPassword} {
+		assert.False(suite.T(), suite.cryptoManager.IsDeprecatedText(text))
+	}
+
+	// The share opens with its password, and with the stored one when none is given
+	fileKey, err := shareService.DecryptFileKey(&migrated, "Correct-Horse-1")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.fileKey, fileKey)
+	fileKey, err = shareService.DecryptFileKey(&migrated, "")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.fileKey, fileKey)
+
+	// A second run finds nothing left to do
+	report, err = suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), report.SharesMigrated)
+}
+
+func (suite *ReencryptionServiceTestSuite) TestRun_ReencryptsDeprecatedFiles() {
+	var original models.File
+	suite.Require().NoError(suite.db.First(&original, suite.userFile.FileID).Error)
+
+	report, err := suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.FilesScanned)
+	assert.Equal(suite.T(), 1, report.FilesMigrated)
+	assert.Empty(suite.T(), report.Errors)
+	assert.Same(suite.T(), report, suite.reencryptionService.LastReport())
+
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, original.ID).Error)
+	assert.Equal(suite.T(), services.CipherAESGCM, file.Cipher)
+	assert.NotEqual(suite.T(), original.ContentHash, file.ContentHash)
+	assert.NotEqual(suite.T(), original.StoragePath, file.StoragePath)
+
+	// The new object matches the File and decrypts under the same key
+	object, err := suite.backend.Get(context.Background(), file.StoragePath)
+	suite.Require().NoError(err)
+	data, err := io.ReadAll(object)
+	object.Close()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), file.ContentHash, hashOf(data))
+	assert.EqualValues(suite.T(), len(data), file.SizeBytes)
+	assert.Equal(suite.T(), services.CipherAESGCM, services.FileCipher(data))
+	decrypted, err := suite.cryptoManager.DecryptFileData(data, suite.fileKey)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.plaintext, decrypted)
+
+	// The old object is left for storage GC
+	_, err = suite.backend.Get(context.Background(), original.StoragePath)
+	assert.NoError(suite.T(), err)
+
+	report, err = suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), report.FilesScanned)
+}
+
+func (suite *ReencryptionServiceTestSuite) TestRun_RecordsCipherOfCurrentFiles() {
+	suite.reencryptionService = services.NewReencryptionService(database.NewDB(suite.db), newTestCryptoManager(suite.T(), nil),
+		services.NewFileStorageServiceWithBackend(suite.backend))
+
+	report, err := suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.FilesScanned)
+	assert.Zero(suite.T(), report.FilesMigrated)
+
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, suite.userFile.FileID).Error)
+	assert.Equal(suite.T(), services.CipherNaClSecretbox, file.Cipher)
+
+	// Files whose cipher is known and current are not read again
+	report, err = suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), report.FilesScanned)
+}
+
+func (suite *ReencryptionServiceTestSuite) TestRun_SkipsFilesWithoutOneServerKey() {
+	suite.Require().NoError(suite.db.Model(&models.UserFile{}).Where("id = ?", suite.userFile.ID).Update("encryption_key", "client-wrapped").Error)
+
+	report, err := suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.FilesSkipped)
+	assert.Zero(suite.T(), report.FilesMigrated)
+
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, suite.userFile.FileID).Error)
+	assert.Equal(suite.T(), hashOf(suite.sealLegacy(suite.plaintext, suite.fileKey)), file.ContentHash)
+}
+
+func (suite *ReencryptionServiceTestSuite) TestRun_SkipsFilesOverSizeLimit() {
+	var original models.File
+	suite.Require().NoError(suite.db.First(&original, suite.userFile.FileID).Error)
+	suite.Require().NoError(suite.db.Model(&original).Update("size_bytes", int64(1)<<40).Error)
+
+	report, err := suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), report.FilesMigrated)
+	suite.Require().Len(report.Errors, 1)
+	assert.Contains(suite.T(), report.Errors[0], "re-encryption limit")
+
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, original.ID).Error)
+	assert.Equal(suite.T(), original.ContentHash, file.ContentHash)
+	assert.Equal(suite.T(), original.StoragePath, file.StoragePath)
+}
+
+func (suite *ReencryptionServiceTestSuite) TestRun_UpgradesOutdatedKDF() {
+	// Migrate the share while PBKDF2 is configured, leaving only its KDF outdated
+	pbkdf2 := newTestCryptoManager(suite.T(), func(c *config.CryptoConfig) {
+		c.KDFAlgorithm = services.KDFPBKDF2SHA256
+		c.SharePasswordKey = suite.cryptoManager.GetConfig().SharePasswordKey
+	})
+	share := suite.createLegacyShare("Correct-Horse-1")
+	report, err := services.NewReencryptionService(database.NewDB(suite.db), pbkdf2,
+		services.NewFileStorageServiceWithBackend(suite.backend)).Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.SharesMigrated)
+
+	// Argon2id is configured again, so the envelope key is re-derived with it
+	report, err = suite.reencryptionService.Run(context.Background())
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, report.SharesMigrated)
+
+	var migrated models.FileShare
+	suite.Require().NoError(suite.db.First(&migrated, share.ID).Error)
+	assert.False(suite.T(), suite.cryptoManager.NeedsKDFUpgrade(migrated.EnvelopeKey))
+}
+
+func (suite *ReencryptionServiceTestSuite) TestDecryptFileKey_UpgradesLegacyShares() {
+	share := suite.createLegacyShare("Correct-Horse-1")
+	shareService := services.NewShareService(database.NewDB(suite.db), "http://localhost", suite.cryptoManager)
+	recorded, err := shareService.RecordLegacyKDFParams()
+	suite.Require().NoError(err)
+	assert.EqualValues(suite.T(), 1, recorded)
+
+	// Raising the PBKDF2 setting no longer breaks the share
+	stronger := newTestCryptoManager(suite.T(), func(c *config.CryptoConfig) {
+		c.PBKDF2Iterations = 20000
+		c.SharePasswordKey = suite.cryptoManager.GetConfig().SharePasswordKey
+	})
+	shareService = services.NewShareService(database.NewDB(suite.db), "http://localhost", stronger)
+	suite.Require().NoError(suite.db.First(share, share.ID).Error)
+	assert.Equal(suite.T(), "pbkdf2-sha256$i=10000", share.KDFParams)
+	fileKey, err := shareService.DecryptFileKey(share, "Correct-Horse-1")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.fileKey, fileKey)
+
+	// Supplying the password moved the keys to the ciphertext format under Argon2id
+	var upgraded models.FileShare
+	suite.Require().NoError(suite.db.First(&upgraded, share.ID).Error)
+	assert.Empty(suite.T(), upgraded.KDFParams)
+	assert.Empty(suite.T(), upgraded.EnvelopeSalt)
+	assert.False(suite.T(), stronger.NeedsKDFUpgrade(upgraded.EnvelopeKey))
+	fileKey, err = shareService.DecryptFileKey(&upgraded, "Correct-Horse-1")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.fileKey, fileKey)
+
+	// The wrong password neither decrypts nor upgrades
+	_, err = shareService.DecryptFileKey(&upgraded, "Wrong-Horse-1")
+	assert.Error(suite.T(), err)
+}
+
+func TestReencryption_MovesSharesToRotatedPasswordKey(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:share_password_key_rotation_test?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.ServiceKey{}, &models.User{}, &models.File{}, &models.UserFile{}, &models.FileShare{}))
+	defer func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	}()
+	t.Setenv("AEGIS_ARGON2_TIME", "1")
+	t.Setenv("AEGIS_ARGON2_MEMORY_KIB", "8192")
+	t.Setenv("AEGIS_ARGON2_THREADS", "1")
+
+	ctx := context.Background()
+	dbService := database.NewDB(db)
+	provider, err := services.NewLocalKeyProvider(filepath.Join(t.TempDir(), "keystore.json"))
+	require.NoError(t, err)
+	manager, err := services.NewCryptoManagerWithKeyProvider(ctx, provider, dbService)
+	require.NoError(t, err)
+	other, err := services.NewCryptoManagerWithKeyProvider(ctx, provider, dbService)
+	require.NoError(t, err)
+	shareService := services.NewShareService(dbService, "http://localhost", manager)
+	reencryptionService := services.NewReencryptionService(dbService, manager, services.NewFileStorageServiceWithBackend(services.NewMemoryStorageBackend()))
+
+	fileKey := bytes.Repeat([]byte{5}, 32)
+	owner := models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash"}
+	require.NoError(t, db.Create(&owner).Error)
+	userFile := models.UserFile{UserID: owner.ID, FileID: 1, Filename: "report.txt", MimeType: "text/plain", EncryptionKey: base64.StdEncoding.EncodeToString(fileKey)}
+	require.NoError(t, db.Create(&userFile).Error)
+
+	// Passwordless shares depend on their stored password alone
+	share, err := shareService.CreateShare(userFile.ID, "", 0, nil, []string{"recipient@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, share.PasswordKeyVersion)
+
+	status, err := reencryptionService.RotateSharePasswordKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, status.CurrentVersion)
+	assert.Equal(t, 1, status.OutdatedShares)
+
+	// Until migrated the share still opens under the earlier version
+	fileKeyOut, err := shareService.DecryptFileKey(share, "")
+	require.NoError(t, err)
+	assert.Equal(t, fileKey, fileKeyOut)
+
+	report, err := reencryptionService.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.SharesMigrated)
+	assert.Empty(t, report.Errors)
+
+	var migrated models.FileShare
+	require.NoError(t, db.First(&migrated, share.ID).Error)
+	assert.Equal(t, 2, migrated.PasswordKeyVersion)
+	assert.NotEqual(t, share.EncryptedPassword, migrated.EncryptedPassword)
+	// Only the stored password is re-encrypted
+	assert.Equal(t, share.EnvelopeKey, migrated.EnvelopeKey)
+
+	status, err = reencryptionService.SharePasswordKeyStatus(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, status.OutdatedShares)
+
+	// Another instance started before the rotation picks the new version up when it meets it
+	assert.Equal(t, 1, other.SharePasswordKeyVersion())
+	fileKeyOut, err = services.NewShareService(dbService, "http://localhost", other).DecryptFileKey(&migrated, "")
+	require.NoError(t, err)
+	assert.Equal(t, fileKey, fileKeyOut)
+	assert.Equal(t, 2, other.SharePasswordKeyVersion())
+
+	// New shares use the current version
+	created, err := shareService.CreateShare(userFile.ID, "", 0, nil, []string{"recipient@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, created.PasswordKeyVersion)
+}
+
+func TestReencryptionServiceSuite(t *testing.T) {
+	suite.Run(t, new(ReencryptionServiceTestSuite))
+}
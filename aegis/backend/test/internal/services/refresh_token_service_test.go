@@ -0,0 +1,184 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type RefreshTokenServiceTestSuite struct {
+	suite.Suite
+	db                  *gorm.DB
+	authService         *services.AuthService
+	refreshTokenService *services.RefreshTokenService
+	sessionService      *services.SessionService
+	user                models.User
+}
+
+func (suite *RefreshTokenServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:refresh_token_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.Session{}, &models.RefreshToken{})
+	suite.Require().NoError(err)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *RefreshTokenServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM refresh_tokens")
+	suite.db.Exec("DELETE FROM sessions")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+
+	cfg := &config.Config{JWTSecret: "test-secret-key-that-is-long-enough-for-hs256"}
+	suite.authService = services.NewAuthService(cfg)
+	dbService := database.NewDB(suite.db)
+	suite.refreshTokenService = services.NewRefreshTokenService(cfg, dbService, suite.authService)
+	suite.sessionService = services.NewSessionService(dbService, suite.authService, suite.refreshTokenService)
+}
+
+// startSession signs the user in and returns the session's first refresh token.
+func (suite *RefreshTokenServiceTestSuite) startSession() string {
+	_, refreshToken, err := suite.sessionService.StartSession(&suite.user, "test-agent", "127.0.0.1")
+	suite.Require().NoError(err)
+	return refreshToken
+}
+
+func (suite *RefreshTokenServiceTestSuite) assertUnauthorized(err error) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), apperrors.ErrCodeUnauthorized, appErr.Code)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestIssueRefreshToken_StoresOnlyHash() {
+	token := suite.startSession()
+	assert.Len(suite.T(), token, 64)
+
+	var stored models.RefreshToken
+	suite.Require().NoError(suite.db.First(&stored).Error)
+	assert.Equal(suite.T(), suite.user.ID, stored.UserID)
+	assert.NotEqual(suite.T(), token, stored.TokenHash)
+	assert.WithinDuration(suite.T(), time.Now().Add(30*24*time.Hour), stored.ExpiresAt, time.Minute)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestRotateRefreshToken() {
+	first := suite.startSession()
+
+	user, accessToken, second, err := suite.refreshTokenService.RotateRefreshToken(first)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.user.ID, user.ID)
+	assert.NotEqual(suite.T(), first, second)
+
+	claims, err := suite.authService.ParseToken(accessToken)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.user.ID, claims.UserID)
+	assert.WithinDuration(suite.T(), time.Now().Add(15*time.Minute), claims.ExpiresAt.Time, time.Minute)
+
+	// The successor belongs to the same family and can be rotated in turn
+	var tokens []models.RefreshToken
+	suite.Require().NoError(suite.db.Order("id").Find(&tokens).Error)
+	suite.Require().Len(tokens, 2)
+	assert.Equal(suite.T(), tokens[0].FamilyID, tokens[1].FamilyID)
+	assert.NotNil(suite.T(), tokens[0].UsedAt)
+	assert.Nil(suite.T(), tokens[1].UsedAt)
+	assert.Equal(suite.T(), tokens[0].FamilyID, claims.ID)
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(second)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestRotateRefreshToken_ReuseRevokesFamily() {
+	first := suite.startSession()
+	_, _, second, err := suite.refreshTokenService.RotateRefreshToken(first)
+	suite.Require().NoError(err)
+
+	// A second session is unaffected by reuse in the first
+	other := suite.startSession()
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(first)
+	suite.assertUnauthorized(err)
+
+	// The legitimate successor no longer works either
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(second)
+	suite.assertUnauthorized(err)
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(other)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestRotateRefreshToken_Expired() {
+	token := suite.startSession()
+	suite.db.Model(&models.RefreshToken{}).Where("1 = 1").Update("expires_at", time.Now().Add(-time.Minute))
+
+	_, _, _, err := suite.refreshTokenService.RotateRefreshToken(token)
+	suite.assertUnauthorized(err)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestRotateRefreshToken_RevokedSession() {
+	token := suite.startSession()
+	var session models.Session
+	suite.Require().NoError(suite.db.First(&session).Error)
+	suite.Require().NoError(suite.sessionService.RevokeSession(suite.user.ID, session.ID))
+
+	_, _, _, err := suite.refreshTokenService.RotateRefreshToken(token)
+	suite.assertUnauthorized(err)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestRotateRefreshToken_Unknown() {
+	_, _, _, err := suite.refreshTokenService.RotateRefreshToken("not-a-token")
+	suite.assertUnauthorized(err)
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken("")
+	suite.assertUnauthorized(err)
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestRevokeRefreshToken() {
+	first := suite.startSession()
+	_, _, second, err := suite.refreshTokenService.RotateRefreshToken(first)
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.refreshTokenService.RevokeRefreshToken(first))
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(second)
+	suite.assertUnauthorized(err)
+
+	// Revoking again, or an unknown token, is harmless
+	assert.NoError(suite.T(), suite.refreshTokenService.RevokeRefreshToken(second))
+	assert.NoError(suite.T(), suite.refreshTokenService.RevokeRefreshToken("not-a-token"))
+}
+
+func (suite *RefreshTokenServiceTestSuite) TestCleanupExpiredTokens() {
+	suite.startSession()
+	live := suite.startSession()
+	suite.db.Model(&models.RefreshToken{}).Where("id = (SELECT MIN(id) FROM refresh_tokens)").Update("expires_at", time.Now().Add(-time.Minute))
+
+	cleaned, err := suite.refreshTokenService.CleanupExpiredTokens()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), int64(1), cleaned)
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(live)
+	assert.NoError(suite.T(), err)
+}
+
+func TestRefreshTokenServiceSuite(t *testing.T) {
+	suite.Run(t, new(RefreshTokenServiceTestSuite))
+}
@@ -0,0 +1,250 @@
+package services_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type RoomKeyServiceTestSuite struct {
+	suite.Suite
+	db             *gorm.DB
+	userKeyService *services.UserKeyService
+	roomService    *services.RoomService
+	roomKeyService *services.RoomKeyService
+	owner          models.User
+	alice          models.User
+	bob            models.User
+	fingerprints   map[uint]string
+	room           *models.Room
+}
+
+func (suite *RoomKeyServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:room_key_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.File{}, &models.UserFile{}, &models.Room{}, &models.RoomMember{},
+		&models.RoomFile{}, &models.UserKeyPair{}, &models.FileKeyGrant{}, &models.RoomKey{})
+	suite.Require().NoError(err)
+}
+
+func (suite *RoomKeyServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *RoomKeyServiceTestSuite) SetupTest() {
+	for _, table := range []string{"room_keys", "file_key_grants", "user_key_pairs", "room_files", "room_members", "rooms", "user_files", "files", "users"} {
+		suite.db.Exec("DELETE FROM " + table)
+	}
+
+	suite.owner = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.alice = models.User{Username: "alice", Email: "alice@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.bob = models.User{Username: "bob", Email: "bob@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	for _, user := range []*models.User{&suite.owner, &suite.alice, &suite.bob} {
+		suite.Require().NoError(suite.db.Create(user).Error)
+	}
+
+	cfg := &config.Config{JWTSecret: "test-secret-key-that-is-long-enough-for-hs256"}
+	dbService := database.NewDB(suite.db)
+	suite.userKeyService = services.NewUserKeyService(cfg, dbService)
+	suite.roomService = services.NewRoomService(dbService, services.NewUserService(services.NewAuthService(cfg), dbService))
+	suite.roomKeyService = services.NewRoomKeyService(dbService, suite.roomService)
+
+	suite.fingerprints = make(map[uint]string)
+	for _, user := range []models.User{suite.owner, suite.alice} {
+		privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+		suite.Require().NoError(err)
+		keyPair, err := suite.userKeyService.RegisterKeyPair(user.ID, base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()), "wrapped-private-key")
+		suite.Require().NoError(err)
+		suite.fingerprints[user.ID] = keyPair.Fingerprint
+	}
+
+	room, err := suite.roomService.CreateRoom(suite.owner.ID, "Team")
+	suite.Require().NoError(err)
+	suite.room = room
+	suite.Require().NoError(suite.roomService.AddRoomMember(room.ID, "alice", suite.owner.ID, models.RoomRoleContentViewer))
+}
+
+func (suite *RoomKeyServiceTestSuite) memberKey(userID uint, version int) services.RoomMemberKey {
+	return services.RoomMemberKey{UserID: userID, Version: version, KeyFingerprint: suite.fingerprints[userID], WrappedKey: "wrapped-room-key"}
+}
+
+func (suite *RoomKeyServiceTestSuite) createFile(name string) models.UserFile {
+	file := models.File{ContentHash: strings.Repeat(name[:1], 64), SizeBytes: 5, StoragePath: "objects/" + name, RefCount: 1}
+	suite.Require().NoError(suite.db.Create(&file).Error)
+	userFile := models.UserFile{UserID: suite.owner.ID, FileID: file.ID, Filename: name, MimeType: "text/plain", EncryptionKey: "key"}
+	suite.Require().NoError(suite.db.Create(&userFile).Error)
+	return userFile
+}
+
+func (suite *RoomKeyServiceTestSuite) assertErrorCode(err error, code apperrors.ErrorCode) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code)
+}
+
+func (suite *RoomKeyServiceTestSuite) TestRotateRoomKey() {
+	// Viewers cannot rotate the key
+	_, err := suite.roomKeyService.RotateRoomKey(suite.alice.ID, suite.room.ID, 1,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 1), suite.memberKey(suite.alice.ID, 1)}, nil)
+	suite.assertErrorCode(err, apperrors.ErrCodeForbidden)
+
+	// Every member with a public key needs a copy
+	_, err = suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 1,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 1)}, nil)
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+
+	// Versions go up one at a time
+	_, err = suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 2,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 2), suite.memberKey(suite.alice.ID, 2)}, nil)
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+
+	// Copies must be wrapped to the member's current key
+	stale := suite.memberKey(suite.alice.ID, 1)
+	stale.KeyFingerprint = strings.Repeat("0", 64)
+	_, err = suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 1,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 1), stale}, nil)
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+
+	room, err := suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 1,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 1), suite.memberKey(suite.alice.ID, 1)}, nil)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, room.KeyVersion)
+
+	keys, err := suite.roomKeyService.GetMemberKeys(suite.alice.ID, suite.room.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(keys, 1)
+	assert.Equal(suite.T(), suite.fingerprints[suite.alice.ID], keys[0].KeyFingerprint)
+
+	_, err = suite.roomKeyService.GetMemberKeys(suite.bob.ID, suite.room.ID)
+	suite.assertErrorCode(err, apperrors.ErrCodeForbidden)
+}
+
+func (suite *RoomKeyServiceTestSuite) TestShareFileToRoom_RequiresRoomKey() {
+	before := suite.createFile("before.txt")
+	suite.Require().NoError(suite.roomService.ShareFileToRoom(before.ID, suite.room.ID, suite.owner.ID))
+
+	_, err := suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 1,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 1), suite.memberKey(suite.alice.ID, 1)},
+		[]services.RoomFileKey{{UserFileID: before.ID, WrappedKey: "wrapped-before"}})
+	suite.Require().NoError(err)
+
+	after := suite.createFile("after.txt")
+	err = suite.roomService.ShareFileToRoom(after.ID, suite.room.ID, suite.owner.ID)
+	suite.assertErrorCode(err, apperrors.ErrCodeInvalidArgument)
+	err = suite.roomService.ShareEncryptedFileToRoom(after.ID, suite.room.ID, suite.owner.ID, &services.RoomFileKey{KeyVersion: 2, WrappedKey: "wrapped-after"})
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+	suite.Require().NoError(suite.roomService.ShareEncryptedFileToRoom(after.ID, suite.room.ID, suite.owner.ID, &services.RoomFileKey{KeyVersion: 1, WrappedKey: "wrapped-after"}))
+
+	fileKeys, err := suite.roomKeyService.GetRoomFileKeys(suite.alice.ID, suite.room.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(fileKeys, 2)
+	assert.Equal(suite.T(), "wrapped-before", fileKeys[0].WrappedKey)
+	assert.Equal(suite.T(), "wrapped-after", fileKeys[1].WrappedKey)
+	assert.Equal(suite.T(), 1, fileKeys[1].KeyVersion)
+}
+
+func (suite *RoomKeyServiceTestSuite) TestLeavingRequiresRekey() {
+	_, err := suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 1,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 1), suite.memberKey(suite.alice.ID, 1)}, nil)
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.roomService.LeaveRoom(suite.room.ID, suite.alice.ID))
+
+	var count int64
+	suite.db.Model(&models.RoomKey{}).Where("user_id = ?", suite.alice.ID).Count(&count)
+	assert.Zero(suite.T(), count, "departed members lose their copies of the room key")
+
+	var room models.Room
+	suite.Require().NoError(suite.db.First(&room, suite.room.ID).Error)
+	assert.True(suite.T(), room.RekeyRequired)
+
+	// Nothing new can be shared under the key the departed member had
+	userFile := suite.createFile("secret.txt")
+	err = suite.roomService.ShareEncryptedFileToRoom(userFile.ID, suite.room.ID, suite.owner.ID, &services.RoomFileKey{KeyVersion: 1, WrappedKey: "wrapped"})
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+
+	// The departed member cannot be given the new key
+	_, err = suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 2,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 2), suite.memberKey(suite.alice.ID, 2)}, nil)
+	suite.assertErrorCode(err, apperrors.ErrCodeForbidden)
+
+	rotated, err := suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 2,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 2)}, nil)
+	suite.Require().NoError(err)
+	assert.False(suite.T(), rotated.RekeyRequired)
+	suite.Require().NoError(suite.roomService.ShareEncryptedFileToRoom(userFile.ID, suite.room.ID, suite.owner.ID, &services.RoomFileKey{KeyVersion: 2, WrappedKey: "wrapped"}))
+
+	// Remaining members keep the earlier version for older files
+	keys, err := suite.roomKeyService.GetMemberKeys(suite.owner.ID, suite.room.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(keys, 2)
+	assert.Equal(suite.T(), 1, keys[0].Version)
+	assert.Equal(suite.T(), 2, keys[1].Version)
+}
+
+func (suite *RoomKeyServiceTestSuite) TestGrantRoomKeys() {
+	_, err := suite.roomKeyService.RotateRoomKey(suite.owner.ID, suite.room.ID, 1,
+		[]services.RoomMemberKey{suite.memberKey(suite.owner.ID, 1), suite.memberKey(suite.alice.ID, 1)}, nil)
+	suite.Require().NoError(err)
+
+	// Bob joins and registers a key after the room key was made
+	suite.Require().NoError(suite.roomService.AddRoomMember(suite.room.ID, "bob", suite.owner.ID, models.RoomRoleContentViewer))
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	suite.Require().NoError(err)
+	keyPair, err := suite.userKeyService.RegisterKeyPair(suite.bob.ID, base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()), "wrapped-private-key")
+	suite.Require().NoError(err)
+	suite.fingerprints[suite.bob.ID] = keyPair.Fingerprint
+
+	// Only versions that exist, and that the granter holds, can be granted
+	err = suite.roomKeyService.GrantRoomKeys(suite.alice.ID, suite.room.ID, []services.RoomMemberKey{suite.memberKey(suite.bob.ID, 2)})
+	suite.assertErrorCode(err, apperrors.ErrCodeInvalidArgument)
+	err = suite.roomKeyService.GrantRoomKeys(suite.bob.ID, suite.room.ID, []services.RoomMemberKey{suite.memberKey(suite.bob.ID, 1)})
+	suite.assertErrorCode(err, apperrors.ErrCodeForbidden)
+
+	suite.Require().NoError(suite.roomKeyService.GrantRoomKeys(suite.alice.ID, suite.room.ID, []services.RoomMemberKey{suite.memberKey(suite.bob.ID, 1)}))
+	keys, err := suite.roomKeyService.GetMemberKeys(suite.bob.ID, suite.room.ID)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), keys, 1)
+
+	// A grant cannot replace a copy a member already holds
+	overwrite := suite.memberKey(suite.owner.ID, 1)
+	overwrite.WrappedKey = "attacker-room-key"
+	err = suite.roomKeyService.GrantRoomKeys(suite.alice.ID, suite.room.ID, []services.RoomMemberKey{overwrite})
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+	ownerKeys, err := suite.roomKeyService.GetMemberKeys(suite.owner.ID, suite.room.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(ownerKeys, 1)
+	assert.Equal(suite.T(), "wrapped-room-key", ownerKeys[0].WrappedKey)
+
+	// A new key pair cannot unwrap the old copies
+	privateKey, err = ecdh.X25519().GenerateKey(rand.Reader)
+	suite.Require().NoError(err)
+	_, err = suite.userKeyService.RegisterKeyPair(suite.bob.ID, base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()), "wrapped-private-key")
+	suite.Require().NoError(err)
+	keys, err = suite.roomKeyService.GetMemberKeys(suite.bob.ID, suite.room.ID)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), keys)
+}
+
+func TestRoomKeyServiceSuite(t *testing.T) {
+	suite.Run(t, new(RoomKeyServiceTestSuite))
+}
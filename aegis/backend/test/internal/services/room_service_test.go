@@ -9,6 +9,7 @@ import (
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"github.com/balkanid/aegis-backend/internal/config"
 	"github.com/balkanid/aegis-backend/internal/database"
 	"github.com/balkanid/aegis-backend/internal/models"
 	"github.com/balkanid/aegis-backend/internal/services"
@@ -46,10 +47,14 @@ func (suite *RoomServiceTestSuite) SetupSuite() {
 		&models.RoomMember{},
 		&models.RoomFile{},
 		&models.DownloadLog{},
+		&models.FileKeyGrant{},
+		&models.RoomKey{},
 	)
 	suite.Require().NoError(err)
 
-	suite.roomService = services.NewRoomService(dbService)
+	authService := services.NewAuthService(&config.Config{})
+	userService := services.NewUserService(authService, dbService)
+	suite.roomService = services.NewRoomService(dbService, userService)
 }
 
 func (suite *RoomServiceTestSuite) TearDownSuite() {
@@ -130,7 +135,7 @@ func (suite *RoomServiceTestSuite) SetupTest() {
 }
 
 func (suite *RoomServiceTestSuite) TestNewRoomService() {
-	service := services.NewRoomService(database.NewDB(suite.db))
+	service := services.NewRoomService(database.NewDB(suite.db), nil)
 	assert.NotNil(suite.T(), service)
 }
 
@@ -245,7 +250,7 @@ func (suite *RoomServiceTestSuite) TestGetRoom_RoomNotFound() {
 }
 
 func (suite *RoomServiceTestSuite) TestAddRoomMember_Success() {
-	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentViewer)
+	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentViewer)
 
 	assert.NoError(suite.T(), err)
 
@@ -258,7 +263,7 @@ func (suite *RoomServiceTestSuite) TestAddRoomMember_Success() {
 
 func (suite *RoomServiceTestSuite) TestAddRoomMember_AccessDenied() {
 	// Try to add member as non-admin
-	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser2.ID, models.RoomRoleContentViewer)
+	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser2.ID, models.RoomRoleContentViewer)
 
 	assert.Error(suite.T(), err)
 	assert.Contains(suite.T(), err.Error(), "access denied")
@@ -266,18 +271,18 @@ func (suite *RoomServiceTestSuite) TestAddRoomMember_AccessDenied() {
 
 func (suite *RoomServiceTestSuite) TestAddRoomMember_AlreadyMember() {
 	// Add user as member first
-	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentViewer)
+	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentViewer)
 	suite.Require().NoError(err)
 
 	// Try to add the same user again
-	err = suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentEditor)
+	err = suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentEditor)
 
 	assert.Error(suite.T(), err)
 	assert.Contains(suite.T(), err.Error(), "already a member")
 }
 
 func (suite *RoomServiceTestSuite) TestAddRoomMember_RoomNotFound() {
-	err := suite.roomService.AddRoomMember(99999, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentViewer)
+	err := suite.roomService.AddRoomMember(99999, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentViewer)
 
 	assert.Error(suite.T(), err)
 	assert.Contains(suite.T(), err.Error(), "access denied") // Because requireRoomAdmin fails first
@@ -285,7 +290,7 @@ func (suite *RoomServiceTestSuite) TestAddRoomMember_RoomNotFound() {
 
 func (suite *RoomServiceTestSuite) TestRemoveRoomMember_Success() {
 	// First add a member
-	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentViewer)
+	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentViewer)
 	suite.Require().NoError(err)
 
 	// Now remove the member
@@ -310,7 +315,7 @@ func (suite *RoomServiceTestSuite) TestRemoveRoomMember_Creator() {
 
 func (suite *RoomServiceTestSuite) TestRemoveRoomMember_AccessDenied() {
 	// First add a member
-	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentViewer)
+	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentViewer)
 	suite.Require().NoError(err)
 
 	// Try to remove as non-admin
@@ -339,7 +344,7 @@ func (suite *RoomServiceTestSuite) TestShareFileToRoom_Success() {
 
 func (suite *RoomServiceTestSuite) TestShareFileToRoom_AccessDenied() {
 	// Add user2 as viewer (no file sharing permission)
-	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentViewer)
+	err := suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentViewer)
 	suite.Require().NoError(err)
 
 	// Try to share file as viewer
@@ -403,7 +408,7 @@ func (suite *RoomServiceTestSuite) TestRemoveFileFromRoom_AccessDenied() {
 	suite.Require().NoError(err)
 
 	// Add user2 as viewer
-	err = suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.ID, suite.testUser.ID, models.RoomRoleContentViewer)
+	err = suite.roomService.AddRoomMember(suite.testRoom.ID, suite.testUser2.Username, suite.testUser.ID, models.RoomRoleContentViewer)
 	suite.Require().NoError(err)
 
 	// Try to remove file as viewer
@@ -0,0 +1,191 @@
+package services_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type SessionServiceTestSuite struct {
+	suite.Suite
+	db                  *gorm.DB
+	authService         *services.AuthService
+	refreshTokenService *services.RefreshTokenService
+	sessionService      *services.SessionService
+	userService         *services.UserService
+	user                models.User
+	other               models.User
+}
+
+func (suite *SessionServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:session_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.Session{}, &models.RefreshToken{})
+	suite.Require().NoError(err)
+}
+
+func (suite *SessionServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *SessionServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM refresh_tokens")
+	suite.db.Exec("DELETE FROM sessions")
+	suite.db.Exec("DELETE FROM users")
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("OldPassword123!"), bcrypt.MinCost)
+	suite.Require().NoError(err)
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: string(passwordHash), StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+	suite.other = models.User{Username: "other", Email: "other@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.other).Error)
+
+	cfg := &config.Config{JWTSecret: "test-secret-key-that-is-long-enough-for-hs256"}
+	dbService := database.NewDB(suite.db)
+	suite.authService = services.NewAuthService(cfg)
+	suite.refreshTokenService = services.NewRefreshTokenService(cfg, dbService, suite.authService)
+	suite.sessionService = services.NewSessionService(dbService, suite.authService, suite.refreshTokenService)
+	suite.userService = services.NewUserService(suite.authService, dbService)
+}
+
+// startSession signs a user in from the given device and returns the session ID
+// carried by its access token, and its refresh token.
+func (suite *SessionServiceTestSuite) startSession(user models.User, userAgent string) (string, string) {
+	accessToken, refreshToken, err := suite.sessionService.StartSession(&user, userAgent, "203.0.113.7")
+	suite.Require().NoError(err)
+	claims, err := suite.authService.ParseToken(accessToken)
+	suite.Require().NoError(err)
+	return claims.ID, refreshToken
+}
+
+func (suite *SessionServiceTestSuite) sessionByJTI(sessionID string) models.Session {
+	var session models.Session
+	suite.Require().NoError(suite.db.Where("session_id = ?", sessionID).First(&session).Error)
+	return session
+}
+
+func (suite *SessionServiceTestSuite) TestStartSession() {
+	sessionID, _ := suite.startSession(suite.user, "Firefox")
+	suite.Require().NotEmpty(sessionID)
+
+	session := suite.sessionByJTI(sessionID)
+	assert.Equal(suite.T(), suite.user.ID, session.UserID)
+	assert.Equal(suite.T(), "Firefox", session.UserAgent)
+	assert.Equal(suite.T(), "203.0.113.7", session.IPAddress)
+	assert.Nil(suite.T(), session.RevokedAt)
+	assert.True(suite.T(), session.ExpiresAt.After(time.Now().Add(29*24*time.Hour)))
+
+	var token models.RefreshToken
+	suite.Require().NoError(suite.db.First(&token).Error)
+	assert.Equal(suite.T(), sessionID, token.FamilyID)
+}
+
+func (suite *SessionServiceTestSuite) TestListSessions() {
+	laptop, _ := suite.startSession(suite.user, "Laptop")
+	phone, _ := suite.startSession(suite.user, "Phone")
+	suite.startSession(suite.other, "Other")
+	revoked, _ := suite.startSession(suite.user, "Old tablet")
+	suite.Require().NoError(suite.sessionService.EndSession(revoked))
+
+	suite.db.Model(&models.Session{}).Where("session_id = ?", laptop).Update("last_seen_at", time.Now().Add(-time.Hour))
+
+	sessions, err := suite.sessionService.ListSessions(suite.user.ID, laptop)
+	suite.Require().NoError(err)
+	suite.Require().Len(sessions, 2)
+	assert.Equal(suite.T(), phone, sessions[0].SessionID)
+	assert.False(suite.T(), sessions[0].IsCurrent)
+	assert.Equal(suite.T(), laptop, sessions[1].SessionID)
+	assert.True(suite.T(), sessions[1].IsCurrent)
+}
+
+func (suite *SessionServiceTestSuite) TestRevokeSession() {
+	sessionID, refreshToken := suite.startSession(suite.user, "Laptop")
+	session := suite.sessionByJTI(sessionID)
+
+	// Sessions of other users cannot be revoked
+	err := suite.sessionService.RevokeSession(suite.other.ID, session.ID)
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), apperrors.ErrCodeNotFound, appErr.Code)
+
+	suite.Require().NoError(suite.sessionService.RevokeSession(suite.user.ID, session.ID))
+	assert.NotNil(suite.T(), suite.sessionByJTI(sessionID).RevokedAt)
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(refreshToken)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *SessionServiceTestSuite) TestRevokeOtherSessions() {
+	current, currentRefresh := suite.startSession(suite.user, "Laptop")
+	suite.startSession(suite.user, "Phone")
+	suite.startSession(suite.user, "Tablet")
+	otherUser, _ := suite.startSession(suite.other, "Other")
+
+	revoked, err := suite.sessionService.RevokeOtherSessions(suite.user.ID, current)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 2, revoked)
+
+	sessions, err := suite.sessionService.ListSessions(suite.user.ID, current)
+	suite.Require().NoError(err)
+	suite.Require().Len(sessions, 1)
+	assert.True(suite.T(), sessions[0].IsCurrent)
+	assert.Nil(suite.T(), suite.sessionByJTI(otherUser).RevokedAt)
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(currentRefresh)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *SessionServiceTestSuite) TestPasswordChangeRevokesAllSessions() {
+	laptop, refreshToken := suite.startSession(suite.user, "Laptop")
+	phone, _ := suite.startSession(suite.user, "Phone")
+
+	// Profile changes that keep the password leave sessions alone
+	_, err := suite.userService.UpdateProfile(suite.user.ID, "renamed", "", "", "")
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), suite.sessionByJTI(laptop).RevokedAt)
+
+	_, err = suite.userService.UpdateProfile(suite.user.ID, "", "", "OldPassword123!", "NewPassword456!")
+	suite.Require().NoError(err)
+	assert.NotNil(suite.T(), suite.sessionByJTI(laptop).RevokedAt)
+	assert.NotNil(suite.T(), suite.sessionByJTI(phone).RevokedAt)
+
+	_, _, _, err = suite.refreshTokenService.RotateRefreshToken(refreshToken)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *SessionServiceTestSuite) TestCleanupExpired() {
+	expired, _ := suite.startSession(suite.user, "Laptop")
+	live, _ := suite.startSession(suite.user, "Phone")
+	suite.db.Model(&models.Session{}).Where("session_id = ?", expired).Update("expires_at", time.Now().Add(-time.Minute))
+	suite.db.Model(&models.RefreshToken{}).Where("family_id = ?", expired).Update("expires_at", time.Now().Add(-time.Minute))
+
+	cleaned, err := suite.sessionService.CleanupExpired()
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), int64(2), cleaned)
+
+	var count int64
+	suite.db.Model(&models.Session{}).Count(&count)
+	assert.Equal(suite.T(), int64(1), count)
+	suite.sessionByJTI(live)
+}
+
+func TestSessionServiceSuite(t *testing.T) {
+	suite.Run(t, new(SessionServiceTestSuite))
+}
@@ -48,10 +48,10 @@ func (suite *ShareLinkServiceTestSuite) SetupSuite() {
 	dbService := database.NewDB(db)
 
 	// Create encryption service for testing
-	keyManagementService := services.NewKeyManagementService()
-	encryptionService := services.NewEncryptionService(keyManagementService)
+	cryptoManager, err := services.NewCryptoManager()
+	suite.Require().NoError(err)
 
-	suite.shareLinkService = services.NewShareService(dbService, "http://localhost:8080", encryptionService)
+	suite.shareLinkService = services.NewShareService(dbService, "http://localhost:8080", cryptoManager)
 }
 
 func (suite *ShareLinkServiceTestSuite) TearDownSuite() {
@@ -120,9 +120,9 @@ func (suite *ShareLinkServiceTestSuite) SetupTest() {
 
 func (suite *ShareLinkServiceTestSuite) TestNewShareLinkService() {
 	dbService := database.NewDB(suite.db)
-	keyManagementService := services.NewKeyManagementService()
-	encryptionService := services.NewEncryptionService(keyManagementService)
-	service := services.NewShareService(dbService, "http://test.com", encryptionService)
+	cryptoManager, err := services.NewCryptoManager()
+	suite.Require().NoError(err)
+	service := services.NewShareService(dbService, "http://test.com", cryptoManager)
 	assert.NotNil(suite.T(), service)
 }
 
@@ -386,7 +386,7 @@ func (suite *ShareLinkServiceTestSuite) TestCreateShare_WithAllowedUsernames() {
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), fileShare)
-	assert.Equal(suite.T(), allowedUsernames, fileShare.AllowedUsernames)
+	assert.Equal(suite.T(), `["alice","bob","charlie"]`, fileShare.AllowedEmails)
 }
 
 func (suite *ShareLinkServiceTestSuite) TestCreateShare_WithEmptyAllowedUsernames() {
@@ -395,7 +395,7 @@ func (suite *ShareLinkServiceTestSuite) TestCreateShare_WithEmptyAllowedUsername
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), fileShare)
-	assert.Equal(suite.T(), allowedUsernames, fileShare.AllowedUsernames)
+	assert.Equal(suite.T(), "[]", fileShare.AllowedEmails)
 }
 
 func (suite *ShareLinkServiceTestSuite) TestCreateShare_WithNilAllowedUsernames() {
@@ -403,7 +403,7 @@ func (suite *ShareLinkServiceTestSuite) TestCreateShare_WithNilAllowedUsernames(
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), fileShare)
-	assert.Nil(suite.T(), fileShare.AllowedUsernames)
+	assert.Equal(suite.T(), "[]", fileShare.AllowedEmails)
 }
 
 func (suite *ShareLinkServiceTestSuite) TestUpdateShare_WithAllowedUsernames() {
@@ -417,7 +417,7 @@ func (suite *ShareLinkServiceTestSuite) TestUpdateShare_WithAllowedUsernames() {
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), updatedShare)
-	assert.Equal(suite.T(), newUsernames, updatedShare.AllowedUsernames)
+	assert.Equal(suite.T(), `["user1","user2"]`, updatedShare.AllowedEmails)
 }
 
 func (suite *ShareLinkServiceTestSuite) TestUpdateShare_RemoveAllowedUsernames() {
@@ -432,7 +432,34 @@ func (suite *ShareLinkServiceTestSuite) TestUpdateShare_RemoveAllowedUsernames()
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), updatedShare)
-	assert.Equal(suite.T(), emptyUsernames, updatedShare.AllowedUsernames)
+	assert.Equal(suite.T(), "[]", updatedShare.AllowedEmails)
+}
+
+func (suite *ShareLinkServiceTestSuite) TestAuthorizeRecipient() {
+	fileShare, err := suite.shareLinkService.CreateShare(suite.testUserFile.ID, "", 5, nil, []string{"alice@example.com"})
+	suite.Require().NoError(err)
+
+	verified := &models.User{Email: "Alice@example.com", EmailVerified: true}
+	unverified := &models.User{Email: "alice@example.com"}
+	other := &models.User{Email: "mallory@example.com", EmailVerified: true}
+
+	assert.NoError(suite.T(), suite.shareLinkService.AuthorizeRecipient(fileShare, verified))
+
+	// Anyone can register an account with an address they do not control
+	err = suite.shareLinkService.AuthorizeRecipient(fileShare, unverified)
+	assert.Error(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "verify your email address")
+
+	assert.Error(suite.T(), suite.shareLinkService.AuthorizeRecipient(fileShare, other))
+	assert.Error(suite.T(), suite.shareLinkService.AuthorizeRecipient(fileShare, nil))
+}
+
+func (suite *ShareLinkServiceTestSuite) TestAuthorizeRecipient_NoRestrictions() {
+	fileShare, err := suite.shareLinkService.CreateShare(suite.testUserFile.ID, "Password123!", 5, nil, nil)
+	suite.Require().NoError(err)
+
+	assert.NoError(suite.T(), suite.shareLinkService.AuthorizeRecipient(fileShare, nil))
+	assert.NoError(suite.T(), suite.shareLinkService.AuthorizeRecipient(fileShare, &models.User{Email: "anyone@example.com"}))
 }
 
 func TestShareLinkServiceSuite(t *testing.T) {
@@ -0,0 +1,312 @@
+package services_test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type SigningKeyServiceTestSuite struct {
+	suite.Suite
+	db          *gorm.DB
+	cfg         *config.Config
+	keys        *services.SigningKeyService
+	authService *services.AuthService
+	user        *models.User
+}
+
+func (suite *SigningKeyServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:signing_key_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.SigningKey{})
+	suite.Require().NoError(err)
+}
+
+func (suite *SigningKeyServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *SigningKeyServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM signing_keys")
+
+	suite.cfg = &config.Config{
+		JWTSecret:           "test-secret-key-that-is-long-enough-for-hs256",
+		JWTSigningAlgorithm: "EdDSA",
+		JWTKeyRotationHours: 720,
+		JWTKeyGraceHours:    24,
+	}
+	suite.keys = services.NewSigningKeyService(suite.cfg, database.NewDB(suite.db))
+	suite.Require().NoError(suite.keys.EnsureSigningKey())
+	suite.authService = services.NewAuthServiceWithKeys(suite.cfg, suite.keys)
+	suite.user = &models.User{ID: 7, Email: "owner@example.com"}
+}
+
+func (suite *SigningKeyServiceTestSuite) tokenHeader(tokenString string) map[string]interface{} {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &services.Claims{})
+	suite.Require().NoError(err)
+	return token.Header
+}
+
+func (suite *SigningKeyServiceTestSuite) TestEnsureSigningKey_CreatesOnce() {
+	suite.Require().NoError(suite.keys.EnsureSigningKey())
+
+	keys, err := suite.keys.ListKeys()
+	suite.Require().NoError(err)
+	suite.Require().Len(keys, 1)
+	assert.Equal(suite.T(), "EdDSA", keys[0].Algorithm)
+	assert.Nil(suite.T(), keys[0].RetiredAt)
+	assert.NotEmpty(suite.T(), keys[0].EncryptedPrivateKey)
+	assert.NotContains(suite.T(), keys[0].EncryptedPrivateKey, "PRIVATE KEY")
+}
+
+func (suite *SigningKeyServiceTestSuite) TestTokensCarryKid() {
+	token, err := suite.authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+
+	keys, err := suite.keys.ListKeys()
+	suite.Require().NoError(err)
+	header := suite.tokenHeader(token)
+	assert.Equal(suite.T(), "EdDSA", header["alg"])
+	assert.Equal(suite.T(), keys[0].KID, header["kid"])
+
+	claims, err := suite.authService.ParseToken(token)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), uint(7), claims.UserID)
+	assert.Equal(suite.T(), "session-1", claims.ID)
+
+	// Another instance sharing the database verifies without any shared secret
+	other := services.NewAuthServiceWithKeys(suite.cfg, services.NewSigningKeyService(suite.cfg, database.NewDB(suite.db)))
+	_, err = other.ParseToken(token)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *SigningKeyServiceTestSuite) TestRotate_OldTokensVerifyDuringGrace() {
+	before, err := suite.authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+
+	rotated, err := suite.keys.Rotate()
+	suite.Require().NoError(err)
+	after, err := suite.authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), rotated.KID, suite.tokenHeader(after)["kid"])
+	assert.NotEqual(suite.T(), suite.tokenHeader(before)["kid"], suite.tokenHeader(after)["kid"])
+
+	_, err = suite.authService.ParseToken(before)
+	assert.NoError(suite.T(), err)
+	_, err = suite.authService.ParseToken(after)
+	assert.NoError(suite.T(), err)
+
+	// The retired key no longer holds private key material
+	keys, err := suite.keys.ListKeys()
+	suite.Require().NoError(err)
+	suite.Require().Len(keys, 2)
+	suite.Require().NotNil(keys[1].RetiredAt)
+	suite.Require().NotNil(keys[1].ExpiresAt)
+	assert.Empty(suite.T(), keys[1].EncryptedPrivateKey)
+	assert.WithinDuration(suite.T(), time.Now().Add(24*time.Hour), *keys[1].ExpiresAt, time.Minute)
+
+	// Once the grace period is over tokens signed with the old key are rejected
+	suite.db.Model(&models.SigningKey{}).Where("kid = ?", keys[1].KID).Update("expires_at", time.Now().Add(-time.Minute))
+	suite.Require().NoError(suite.keys.Refresh())
+	_, err = suite.authService.ParseToken(before)
+	assert.Error(suite.T(), err)
+	_, err = suite.authService.ParseToken(after)
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *SigningKeyServiceTestSuite) TestRotateIfDue() {
+	rotated, err := suite.keys.RotateIfDue()
+	suite.Require().NoError(err)
+	assert.False(suite.T(), rotated)
+
+	suite.db.Model(&models.SigningKey{}).Where("1 = 1").Update("created_at", time.Now().Add(-721*time.Hour))
+	suite.Require().NoError(suite.keys.Refresh())
+
+	// A second instance that noticed the same due key does not rotate again
+	other := services.NewSigningKeyService(suite.cfg, database.NewDB(suite.db))
+	suite.Require().NoError(other.Refresh())
+
+	rotated, err = suite.keys.RotateIfDue()
+	suite.Require().NoError(err)
+	assert.True(suite.T(), rotated)
+	rotated, err = other.RotateIfDue()
+	suite.Require().NoError(err)
+	assert.False(suite.T(), rotated)
+
+	keys, err := suite.keys.ListKeys()
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), keys, 2)
+}
+
+func (suite *SigningKeyServiceTestSuite) TestJWKS() {
+	token, err := suite.authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+	_, err = suite.keys.Rotate()
+	suite.Require().NoError(err)
+
+	set := suite.keys.JWKS()
+	suite.Require().Len(set.Keys, 2)
+	for _, jwk := range set.Keys {
+		assert.Equal(suite.T(), "OKP", jwk.Kty)
+		assert.Equal(suite.T(), "Ed25519", jwk.Crv)
+		assert.Equal(suite.T(), "EdDSA", jwk.Alg)
+		assert.Equal(suite.T(), "sig", jwk.Use)
+	}
+
+	// The published key verifies tokens on its own, as an outside service would
+	kid := suite.tokenHeader(token)["kid"]
+	var published *services.JSONWebKey
+	for i := range set.Keys {
+		if set.Keys[i].Kid == kid {
+			published = &set.Keys[i]
+		}
+	}
+	suite.Require().NotNil(published)
+	x, err := base64.RawURLEncoding.DecodeString(published.X)
+	suite.Require().NoError(err)
+	_, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return ed25519.PublicKey(x), nil },
+		jwt.WithValidMethods([]string{"EdDSA"}))
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *SigningKeyServiceTestSuite) TestRS256() {
+	suite.cfg.JWTSigningAlgorithm = "RS256"
+	keys := services.NewSigningKeyService(suite.cfg, database.NewDB(suite.db))
+	suite.Require().NoError(keys.EnsureSigningKey())
+	authService := services.NewAuthServiceWithKeys(suite.cfg, keys)
+
+	token, err := authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), "RS256", suite.tokenHeader(token)["alg"])
+	_, err = authService.ParseToken(token)
+	assert.NoError(suite.T(), err)
+
+	set := keys.JWKS()
+	suite.Require().NotEmpty(set.Keys)
+	assert.Equal(suite.T(), "RSA", set.Keys[0].Kty)
+	assert.Equal(suite.T(), "AQAB", set.Keys[0].E)
+	assert.NotEmpty(suite.T(), set.Keys[0].N)
+}
+
+func (suite *SigningKeyServiceTestSuite) TestParse_RejectsForgedTokens() {
+	token, err := suite.authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+	kid := suite.tokenHeader(token)["kid"]
+	claims := &services.Claims{
+		UserID:  7,
+		IsAdmin: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+
+	// HMAC signed with the published public key under the real kid
+	set := suite.keys.JWKS()
+	x, err := base64.RawURLEncoding.DecodeString(set.Keys[0].X)
+	suite.Require().NoError(err)
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	confused.Header["kid"] = kid
+	forged, err := confused.SignedString(x)
+	suite.Require().NoError(err)
+	_, err = suite.authService.ParseToken(forged)
+	assert.Error(suite.T(), err)
+
+	// A key that was never published
+	_, stranger, err := ed25519.GenerateKey(nil)
+	suite.Require().NoError(err)
+	unknown := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	unknown.Header["kid"] = "unknown"
+	forged, err = unknown.SignedString(stranger)
+	suite.Require().NoError(err)
+	_, err = suite.authService.ParseToken(forged)
+	assert.Error(suite.T(), err)
+
+	// The right kid with the wrong key
+	unknown.Header["kid"] = kid
+	forged, err = unknown.SignedString(stranger)
+	suite.Require().NoError(err)
+	_, err = suite.authService.ParseToken(forged)
+	assert.Error(suite.T(), err)
+
+	// Unsigned
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	none.Header["kid"] = kid
+	forged, err = none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	suite.Require().NoError(err)
+	_, err = suite.authService.ParseToken(forged)
+	assert.Error(suite.T(), err)
+
+	// Tampered claims
+	parts := strings.Split(token, ".")
+	body := base64.RawURLEncoding.EncodeToString([]byte(`{"user_id":1,"is_admin":true}`))
+	_, err = suite.authService.ParseToken(parts[0] + "." + body + "." + parts[2])
+	assert.Error(suite.T(), err)
+}
+
+func (suite *SigningKeyServiceTestSuite) TestLegacyHS256Tokens() {
+	legacyToken := func(issuedAt time.Time) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &services.Claims{
+			UserID: 7,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(issuedAt.Add(15 * time.Minute)),
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+			},
+		})
+		signed, err := token.SignedString([]byte(suite.cfg.JWTSecret))
+		suite.Require().NoError(err)
+		return signed
+	}
+
+	// Tokens issued before the switch keep working until they expire
+	_, err := suite.authService.ParseToken(legacyToken(time.Now().Add(-5 * time.Minute)))
+	assert.NoError(suite.T(), err)
+
+	// New HS256 tokens are not accepted any more
+	_, err = suite.authService.ParseToken(legacyToken(time.Now()))
+	assert.Error(suite.T(), err)
+	later := services.NewAuthServiceWithKeys(suite.cfg, suite.keys)
+	issued, err := services.NewAuthService(suite.cfg).GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+	_, err = later.ParseToken(issued)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *SigningKeyServiceTestSuite) TestChangedSecret_RotatesToNewKey() {
+	before, err := suite.authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+
+	suite.cfg.JWTSecret = "another-secret-key-that-is-long-enough-for-hs256"
+	keys := services.NewSigningKeyService(suite.cfg, database.NewDB(suite.db))
+	suite.Require().NoError(keys.EnsureSigningKey())
+	authService := services.NewAuthServiceWithKeys(suite.cfg, keys)
+
+	after, err := authService.GenerateSessionToken(suite.user, "session-1")
+	suite.Require().NoError(err)
+	assert.NotEqual(suite.T(), suite.tokenHeader(before)["kid"], suite.tokenHeader(after)["kid"])
+
+	// The key that can no longer be opened still verifies what it signed
+	_, err = authService.ParseToken(before)
+	assert.NoError(suite.T(), err)
+}
+
+func TestSigningKeyServiceSuite(t *testing.T) {
+	suite.Run(t, new(SigningKeyServiceTestSuite))
+}
@@ -0,0 +1,133 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+func exerciseStorageBackend(t *testing.T, backend services.StorageBackend) {
+	ctx := context.Background()
+	content := []byte("hello storage backend")
+
+	// Missing objects report not found
+	_, err := backend.Get(ctx, "1/missing")
+	assert.True(t, services.IsObjectNotFound(err))
+	_, err = backend.Stat(ctx, "1/missing")
+	assert.True(t, services.IsObjectNotFound(err))
+
+	// Put and read back
+	require.NoError(t, backend.Put(ctx, "1/abc", bytes.NewReader(content), int64(len(content)), "text/plain"))
+	require.NoError(t, backend.Put(ctx, "2/def", bytes.NewReader(content), int64(len(content)), "text/plain"))
+
+	reader, err := backend.Get(ctx, "1/abc")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, content, data)
+
+	info, err := backend.Stat(ctx, "1/abc")
+	require.NoError(t, err)
+	assert.Equal(t, "1/abc", info.Key)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	// Size mismatches are rejected
+	err = backend.Put(ctx, "1/short", bytes.NewReader(content), int64(len(content))+1, "text/plain")
+	assert.Error(t, err)
+
+	// List honours the prefix
+	objects, err := backend.List(ctx, "1/")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+	assert.Equal(t, "1/abc", objects[0].Key)
+
+	objects, err = backend.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, objects, 2)
+
+	// Delete is idempotent
+	require.NoError(t, backend.Delete(ctx, "1/abc"))
+	require.NoError(t, backend.Delete(ctx, "1/abc"))
+	_, err = backend.Stat(ctx, "1/abc")
+	assert.True(t, services.IsObjectNotFound(err))
+}
+
+func TestMemoryStorageBackend(t *testing.T) {
+	exerciseStorageBackend(t, services.NewMemoryStorageBackend())
+}
+
+func TestLocalStorageBackend(t *testing.T) {
+	backend, err := services.NewLocalStorageBackend(t.TempDir())
+	require.NoError(t, err)
+	exerciseStorageBackend(t, backend)
+}
+
+func TestLocalStorageBackend_RejectsPathTraversal(t *testing.T) {
+	backend, err := services.NewLocalStorageBackend(t.TempDir())
+	require.NoError(t, err)
+
+	err = backend.Put(context.Background(), "../escape", bytes.NewReader([]byte("x")), 1, "text/plain")
+	assert.Error(t, err)
+}
+
+func TestNewStorageBackend_SelectsFromConfig(t *testing.T) {
+	backend, err := services.NewStorageBackend(context.Background(), &config.Config{StorageBackend: services.StorageBackendMemory})
+	require.NoError(t, err)
+	assert.IsType(t, &services.MemoryStorageBackend{}, backend)
+
+	backend, err = services.NewStorageBackend(context.Background(), &config.Config{StorageBackend: services.StorageBackendLocal, StorageLocalPath: t.TempDir()})
+	require.NoError(t, err)
+	assert.IsType(t, &services.LocalStorageBackend{}, backend)
+
+	_, err = services.NewStorageBackend(context.Background(), &config.Config{StorageBackend: "ftp"})
+	assert.Error(t, err)
+}
+
+func TestFileService_UploadAndStreamWithMemoryBackend(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:storage_backend_test?mode=memory&cache=shared"), &gorm.Config{})
+	require.NoError(t, err)
+	defer func() {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+	}()
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.File{}, &models.UserFile{}, &models.Folder{}, &models.RoomFile{}, &models.RoomMember{}, &models.StorageIntegrityIssue{}, &models.FileVersion{}))
+
+	user := models.User{Username: "storageuser", Email: "storage@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	require.NoError(t, db.Create(&user).Error)
+
+	cfg := &config.Config{}
+	backend := services.NewMemoryStorageBackend()
+	fileService := services.NewFileService(cfg, database.NewDB(db), services.NewFileStorageServiceWithBackend(backend), services.NewAuthService(cfg))
+
+	content := []byte("encrypted file content")
+	contentHash := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	userFile, err := fileService.UploadFile(user.ID, "notes.txt", "text/plain", contentHash, "key", bytes.NewReader(content), int64(len(content)), nil)
+	require.NoError(t, err)
+
+	info, err := backend.Stat(context.Background(), fmt.Sprintf("%d/%s", user.ID, contentHash))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+
+	reader, mimeType, err := fileService.StreamFile(user.ID, userFile.ID)
+	require.NoError(t, err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, "text/plain", mimeType)
+}
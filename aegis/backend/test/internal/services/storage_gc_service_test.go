@@ -0,0 +1,280 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+// agedStorageBackend reports every object as older than it is, so the garbage
+// collector's grace period can be exercised without waiting.
+type agedStorageBackend struct {
+	*services.MemoryStorageBackend
+	age time.Duration
+}
+
+func (b *agedStorageBackend) List(ctx context.Context, prefix string) ([]services.ObjectInfo, error) {
+	objects, err := b.MemoryStorageBackend.List(ctx, prefix)
+	for i := range objects {
+		objects[i].LastModified = objects[i].LastModified.Add(-b.age)
+	}
+	return objects, err
+}
+
+type StorageGCServiceTestSuite struct {
+	suite.Suite
+	db          *gorm.DB
+	backend     *agedStorageBackend
+	fileService *services.FileService
+	gcService   *services.StorageGCService
+	owner       models.User
+	other       models.User
+}
+
+func (suite *StorageGCServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:storage_gc_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.File{},
+		&models.UserFile{},
+		&models.Folder{},
+		&models.RoomFile{},
+		&models.RoomMember{},
+		&models.UploadSession{},
+		&models.StorageIntegrityIssue{},
+		&models.FileVersion{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *StorageGCServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *StorageGCServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM upload_sessions")
+	suite.db.Exec("DELETE FROM file_versions")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM files")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.owner = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.owner).Error)
+	suite.other = models.User{Username: "other", Email: "other@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.other).Error)
+
+	cfg := &config.Config{StorageGCGraceHours: 1}
+	dbService := database.NewDB(suite.db)
+	suite.backend = &agedStorageBackend{MemoryStorageBackend: services.NewMemoryStorageBackend(), age: 2 * time.Hour}
+	fileStorageService := services.NewFileStorageServiceWithBackend(suite.backend)
+	suite.fileService = services.NewFileService(cfg, dbService, fileStorageService, services.NewAuthService(cfg))
+	suite.gcService = services.NewStorageGCService(cfg, dbService, fileStorageService)
+}
+
+func (suite *StorageGCServiceTestSuite) upload(user models.User, filename string, content []byte) *models.UserFile {
+	userFile, err := suite.fileService.UploadFile(user.ID, filename, "application/octet-stream", hashOf(content), "key", bytes.NewReader(content), int64(len(content)), nil)
+	suite.Require().NoError(err)
+	return userFile
+}
+
+func (suite *StorageGCServiceTestSuite) trashAndPurge(user models.User, userFile *models.UserFile) {
+	suite.Require().NoError(suite.fileService.DeleteFile(user.ID, userFile.ID))
+	suite.Require().NoError(suite.fileService.PermanentlyDeleteFile(user.ID, userFile.ID))
+}
+
+func (suite *StorageGCServiceTestSuite) objectExists(key string) bool {
+	_, err := suite.backend.Stat(context.Background(), key)
+	return err == nil
+}
+
+func (suite *StorageGCServiceTestSuite) TestUpload_CountsReferences() {
+	content := []byte("deduplicated content")
+	first := suite.upload(suite.owner, "a.bin", content)
+	second := suite.upload(suite.other, "b.bin", content)
+	suite.Require().Equal(first.FileID, second.FileID)
+
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, first.FileID).Error)
+	assert.Equal(suite.T(), int64(2), file.RefCount)
+}
+
+func (suite *StorageGCServiceTestSuite) TestPermanentlyDeleteFile_KeepsBlobWhileReferenced() {
+	content := []byte("shared between two users")
+	first := suite.upload(suite.owner, "a.bin", content)
+	second := suite.upload(suite.other, "b.bin", content)
+
+	suite.trashAndPurge(suite.owner, first)
+
+	// The other user's copy must survive the first owner's permanent delete
+	assert.True(suite.T(), suite.objectExists(first.File.StoragePath))
+	reader, _, err := suite.fileService.StreamFile(suite.other.ID, second.ID)
+	suite.Require().NoError(err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), content, data)
+
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, first.FileID).Error)
+	assert.Equal(suite.T(), int64(1), file.RefCount)
+}
+
+func (suite *StorageGCServiceTestSuite) TestPermanentlyDeleteFile_LastReferenceRemovesBlob() {
+	content := []byte("shared between two users")
+	first := suite.upload(suite.owner, "a.bin", content)
+	second := suite.upload(suite.other, "b.bin", content)
+
+	suite.trashAndPurge(suite.owner, first)
+	suite.trashAndPurge(suite.other, second)
+
+	assert.False(suite.T(), suite.objectExists(first.File.StoragePath))
+	var count int64
+	suite.db.Unscoped().Model(&models.File{}).Where("id = ?", first.FileID).Count(&count)
+	assert.Equal(suite.T(), int64(0), count)
+}
+
+func (suite *StorageGCServiceTestSuite) TestPermanentlyDeleteFile_UndercountedFileIsKept() {
+	content := []byte("written before reference counting")
+	first := suite.upload(suite.owner, "a.bin", content)
+	suite.upload(suite.other, "b.bin", content)
+
+	// Simulate a row that predates reference counting
+	suite.db.Model(&models.File{}).Where("id = ?", first.FileID).UpdateColumn("ref_count", 1)
+
+	suite.trashAndPurge(suite.owner, first)
+
+	assert.True(suite.T(), suite.objectExists(first.File.StoragePath))
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, first.FileID).Error)
+	assert.Equal(suite.T(), int64(1), file.RefCount)
+}
+
+// seedGarbage creates one of each thing the collector looks at and returns the live file.
+func (suite *StorageGCServiceTestSuite) seedGarbage() *models.UserFile {
+	ctx := context.Background()
+	live := suite.upload(suite.owner, "live.bin", []byte("live content"))
+
+	// An object no File points at, e.g. from a crashed upload
+	suite.Require().NoError(suite.backend.Put(ctx, "1/orphaned", bytes.NewReader([]byte("orphan")), 6, ""))
+
+	// A File row nobody references, with its blob
+	unreferenced := models.File{ContentHash: hashOf([]byte("nobody")), SizeBytes: 6, StoragePath: "1/unreferenced"}
+	suite.Require().NoError(suite.db.Create(&unreferenced).Error)
+	suite.Require().NoError(suite.backend.Put(ctx, "1/unreferenced", bytes.NewReader([]byte("nobody")), 6, ""))
+
+	// A referenced File whose blob has gone missing
+	missing := models.File{ContentHash: hashOf([]byte("missing")), SizeBytes: 7, StoragePath: "2/missing", RefCount: 1}
+	suite.Require().NoError(suite.db.Create(&missing).Error)
+	suite.Require().NoError(suite.db.Create(&models.UserFile{UserID: suite.other.ID, FileID: missing.ID, Filename: "missing.bin", MimeType: "text/plain", EncryptionKey: "key"}).Error)
+
+	// Chunks of an upload that is still in progress
+	session := models.UploadSession{SessionToken: "active", UserID: suite.owner.ID, Filename: "big.bin", MimeType: "text/plain", ContentHash: hashOf([]byte("x")), EncryptionKey: "key", TotalSize: 10, Status: models.UploadSessionStatusActive, ExpiresAt: time.Now().Add(time.Hour)}
+	suite.Require().NoError(suite.db.Create(&session).Error)
+	suite.Require().NoError(suite.backend.Put(ctx, "uploads/active/00000000000000000000", bytes.NewReader([]byte("chunk")), 5, ""))
+
+	// Drift the live file's counter
+	suite.db.Model(&models.File{}).Where("id = ?", live.FileID).UpdateColumn("ref_count", 5)
+
+	return live
+}
+
+func (suite *StorageGCServiceTestSuite) TestRun_DryRunOnlyReports() {
+	live := suite.seedGarbage()
+
+	report, err := suite.gcService.Run(context.Background(), true)
+	suite.Require().NoError(err)
+
+	assert.True(suite.T(), report.DryRun)
+	assert.Equal(suite.T(), 4, report.ObjectsScanned)
+	assert.Equal(suite.T(), 3, report.FilesScanned)
+	var orphanKeys []string
+	for _, object := range report.OrphanObjects {
+		orphanKeys = append(orphanKeys, object.Key)
+	}
+	assert.ElementsMatch(suite.T(), []string{"1/orphaned", "1/unreferenced"}, orphanKeys)
+	assert.Equal(suite.T(), int64(12), report.OrphanBytes)
+	assert.Len(suite.T(), report.UnreferencedFileIDs, 1)
+	suite.Require().Len(report.MissingObjects, 1)
+	assert.Equal(suite.T(), "2/missing", report.MissingObjects[0].StoragePath)
+	assert.Equal(suite.T(), 1, report.RepairedRefCounts)
+	assert.Zero(suite.T(), report.DeletedObjects)
+	assert.Zero(suite.T(), report.DeletedFiles)
+
+	// Nothing was touched
+	assert.True(suite.T(), suite.objectExists("1/orphaned"))
+	assert.True(suite.T(), suite.objectExists("1/unreferenced"))
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, live.FileID).Error)
+	assert.Equal(suite.T(), int64(5), file.RefCount)
+
+	assert.Same(suite.T(), report, suite.gcService.LastReport())
+}
+
+func (suite *StorageGCServiceTestSuite) TestRun_CollectsGarbage() {
+	live := suite.seedGarbage()
+
+	report, err := suite.gcService.Run(context.Background(), false)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), report.Errors)
+	assert.Equal(suite.T(), 2, report.DeletedObjects)
+	assert.Equal(suite.T(), 1, report.DeletedFiles)
+	assert.Equal(suite.T(), 1, report.RepairedRefCounts)
+
+	assert.False(suite.T(), suite.objectExists("1/orphaned"))
+	assert.False(suite.T(), suite.objectExists("1/unreferenced"))
+	assert.True(suite.T(), suite.objectExists(live.File.StoragePath))
+	assert.True(suite.T(), suite.objectExists("uploads/active/00000000000000000000"))
+
+	var file models.File
+	suite.Require().NoError(suite.db.First(&file, live.FileID).Error)
+	assert.Equal(suite.T(), int64(1), file.RefCount)
+
+	var remaining int64
+	suite.db.Unscoped().Model(&models.File{}).Count(&remaining)
+	assert.Equal(suite.T(), int64(2), remaining)
+}
+
+func (suite *StorageGCServiceTestSuite) TestRun_KeepsFilesReferencedOnlyByVersions() {
+	first := suite.upload(suite.owner, "notes.bin", []byte("first draft"))
+	suite.upload(suite.owner, "notes.bin", []byte("second draft"))
+
+	report, err := suite.gcService.Run(context.Background(), false)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), report.UnreferencedFileIDs)
+	assert.Zero(suite.T(), report.RepairedRefCounts)
+	assert.Zero(suite.T(), report.DeletedFiles)
+	assert.True(suite.T(), suite.objectExists(first.File.StoragePath))
+}
+
+func (suite *StorageGCServiceTestSuite) TestRun_GracePeriodProtectsRecentObjects() {
+	suite.backend.age = 0
+	suite.Require().NoError(suite.backend.Put(context.Background(), "staging/1/in-flight", bytes.NewReader([]byte("new")), 3, ""))
+
+	report, err := suite.gcService.Run(context.Background(), false)
+	suite.Require().NoError(err)
+
+	assert.Empty(suite.T(), report.OrphanObjects)
+	assert.True(suite.T(), suite.objectExists("staging/1/in-flight"))
+}
+
+func TestStorageGCServiceSuite(t *testing.T) {
+	suite.Run(t, new(StorageGCServiceTestSuite))
+}
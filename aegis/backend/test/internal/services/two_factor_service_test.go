@@ -0,0 +1,322 @@
+package services_test
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+// Test vectors from RFC 4226 appendix D
+func TestHOTPCode_RFC4226Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+
+	for counter, code := range expected {
+		assert.Equal(t, code, services.HOTPCode(secret, int64(counter), 6, sha1.New), "counter %d", counter)
+	}
+}
+
+// Test vectors from RFC 6238 appendix B
+func TestTOTPCode_RFC6238Vectors(t *testing.T) {
+	secrets := map[string][]byte{
+		"SHA1":   []byte("12345678901234567890"),
+		"SHA256": []byte("12345678901234567890123456789012"),
+		"SHA512": []byte("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+	hashes := map[string]func() hash.Hash{"SHA1": sha1.New, "SHA256": sha256.New, "SHA512": sha512.New}
+
+	vectors := []struct {
+		unix      int64
+		algorithm string
+		code      string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1111111109, "SHA256", "68084774"},
+		{1111111109, "SHA512", "25091201"},
+		{1111111111, "SHA1", "14050471"},
+		{1111111111, "SHA256", "67062674"},
+		{1111111111, "SHA512", "99943326"},
+		{1234567890, "SHA1", "89005924"},
+		{1234567890, "SHA256", "91819424"},
+		{1234567890, "SHA512", "93441116"},
+		{2000000000, "SHA1", "69279037"},
+		{2000000000, "SHA256", "90698825"},
+		{2000000000, "SHA512", "38618901"},
+		{20000000000, "SHA1", "65353130"},
+		{20000000000, "SHA256", "77737706"},
+		{20000000000, "SHA512", "47863826"},
+	}
+
+	for _, v := range vectors {
+		code := services.TOTPCode(secrets[v.algorithm], time.Unix(v.unix, 0), 8, hashes[v.algorithm])
+		assert.Equal(t, v.code, code, "%s at %d", v.algorithm, v.unix)
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := services.TOTPProvisioningURI("Aegis", "alice@example.com", "JBSWY3DPEHPK3PXP")
+
+	parsed, err := url.Parse(uri)
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", parsed.Scheme)
+	assert.Equal(t, "totp", parsed.Host)
+	assert.Equal(t, "/Aegis:alice@example.com", parsed.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", parsed.Query().Get("secret"))
+	assert.Equal(t, "Aegis", parsed.Query().Get("issuer"))
+	assert.Equal(t, "6", parsed.Query().Get("digits"))
+	assert.Equal(t, "30", parsed.Query().Get("period"))
+}
+
+type TwoFactorServiceTestSuite struct {
+	suite.Suite
+	db               *gorm.DB
+	authService      *services.AuthService
+	twoFactorService *services.TwoFactorService
+	user             models.User
+}
+
+func (suite *TwoFactorServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:two_factor_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.UserTwoFactor{}, &models.TwoFactorRecoveryCode{})
+	suite.Require().NoError(err)
+}
+
+func (suite *TwoFactorServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *TwoFactorServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM two_factor_recovery_codes")
+	suite.db.Exec("DELETE FROM user_two_factors")
+	suite.db.Exec("DELETE FROM users")
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	suite.Require().NoError(err)
+	suite.user = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: string(passwordHash), StorageQuota: 10485760}
+	suite.Require().NoError(suite.db.Create(&suite.user).Error)
+
+	cfg := &config.Config{JWTSecret: "test-secret-key-that-is-long-enough-for-hs256"}
+	suite.authService = services.NewAuthService(cfg)
+	suite.twoFactorService = services.NewTwoFactorService(cfg, database.NewDB(suite.db), suite.authService)
+}
+
+// codeAt returns the TOTP code for the secret at now plus the given number of steps.
+func (suite *TwoFactorServiceTestSuite) codeAt(secret string, steps int) string {
+	key, err := services.DecodeTOTPSecret(secret)
+	suite.Require().NoError(err)
+	return services.TOTPCode(key, time.Now().Add(time.Duration(steps)*services.TOTPPeriod), services.TOTPDigits, sha1.New)
+}
+
+// enroll enables two-factor authentication for the test user and returns the secret
+// and the recovery codes.
+func (suite *TwoFactorServiceTestSuite) enroll() (string, []string) {
+	enrollment, err := suite.twoFactorService.BeginEnrollment(suite.user.ID)
+	suite.Require().NoError(err)
+	codes, err := suite.twoFactorService.ConfirmEnrollment(suite.user.ID, suite.codeAt(enrollment.Secret, -1))
+	suite.Require().NoError(err)
+	return enrollment.Secret, codes
+}
+
+func (suite *TwoFactorServiceTestSuite) challenge() string {
+	challenge, err := suite.twoFactorService.IssueChallenge(&suite.user)
+	suite.Require().NoError(err)
+	return challenge
+}
+
+func (suite *TwoFactorServiceTestSuite) assertCode(err error, code apperrors.ErrorCode) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestEnrollment() {
+	enrollment, err := suite.twoFactorService.BeginEnrollment(suite.user.ID)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), enrollment.Secret, 32)
+	assert.True(suite.T(), strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/Aegis:owner@example.com?"))
+	assert.Contains(suite.T(), enrollment.ProvisioningURI, "secret="+enrollment.Secret)
+
+	// The secret is not stored in the clear and nothing is enabled yet
+	var record models.UserTwoFactor
+	suite.Require().NoError(suite.db.Where("user_id = ?", suite.user.ID).First(&record).Error)
+	assert.NotContains(suite.T(), record.EncryptedSecret, enrollment.Secret)
+	assert.Nil(suite.T(), record.EnabledAt)
+
+	_, err = suite.twoFactorService.ConfirmEnrollment(suite.user.ID, "000000")
+	suite.assertCode(err, apperrors.ErrCodeInvalidArgument)
+
+	codes, err := suite.twoFactorService.ConfirmEnrollment(suite.user.ID, suite.codeAt(enrollment.Secret, 0))
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), codes, 10)
+
+	var user models.User
+	suite.Require().NoError(suite.db.First(&user, suite.user.ID).Error)
+	assert.True(suite.T(), user.TwoFactorEnabled)
+
+	// Recovery codes are stored hashed
+	var stored []models.TwoFactorRecoveryCode
+	suite.Require().NoError(suite.db.Where("user_id = ?", suite.user.ID).Find(&stored).Error)
+	suite.Require().Len(stored, 10)
+	for _, code := range stored {
+		assert.NotContains(suite.T(), codes, code.CodeHash)
+	}
+
+	_, err = suite.twoFactorService.BeginEnrollment(suite.user.ID)
+	suite.assertCode(err, apperrors.ErrCodeConflict)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestCompleteLogin_TOTP() {
+	secret, _ := suite.enroll()
+
+	user, err := suite.twoFactorService.CompleteLogin(suite.challenge(), suite.codeAt(secret, 0))
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), suite.user.ID, user.ID)
+
+	// The same code cannot be replayed
+	_, err = suite.twoFactorService.CompleteLogin(suite.challenge(), suite.codeAt(secret, 0))
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestCompleteLogin_RecoveryCode() {
+	_, codes := suite.enroll()
+
+	// Recovery codes are accepted without dashes and in upper case, but only once
+	code := strings.ToUpper(strings.ReplaceAll(codes[3], "-", ""))
+	_, err := suite.twoFactorService.CompleteLogin(suite.challenge(), code)
+	suite.Require().NoError(err)
+
+	_, err = suite.twoFactorService.CompleteLogin(suite.challenge(), codes[3])
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+
+	_, err = suite.twoFactorService.CompleteLogin(suite.challenge(), codes[4])
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestCompleteLogin_InvalidChallenge() {
+	secret, _ := suite.enroll()
+
+	// Access tokens are not challenges
+	accessToken, err := suite.authService.GenerateSessionToken(&suite.user, "session-1")
+	suite.Require().NoError(err)
+	_, err = suite.twoFactorService.CompleteLogin(accessToken, suite.codeAt(secret, 0))
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+
+	_, err = suite.twoFactorService.CompleteLogin("not-a-token", suite.codeAt(secret, 0))
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestChallengeIsNotAnAccessToken() {
+	_, err := suite.authService.ParseToken(suite.challenge())
+	assert.Error(suite.T(), err)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestTooManyInvalidCodesInvalidateChallenge() {
+	secret, _ := suite.enroll()
+	challenge := suite.challenge()
+
+	for i := 0; i < 5; i++ {
+		_, err := suite.twoFactorService.CompleteLogin(challenge, "000000")
+		suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+	}
+
+	// Even a valid code no longer works with the old challenge
+	_, err := suite.twoFactorService.CompleteLogin(challenge, suite.codeAt(secret, 0))
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+
+	// A challenge issued after the lockout, i.e. after entering the password again, works
+	time.Sleep(time.Second)
+	_, err = suite.twoFactorService.CompleteLogin(suite.challenge(), suite.codeAt(secret, 0))
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestLockoutInvalidatesChallengesFromTheSameSecond() {
+	secret, _ := suite.enroll()
+	challenge := suite.challenge()
+
+	// The lockout time as a database without sub-second precision would store it
+	lockedAt := time.Now().Truncate(time.Second)
+	suite.Require().NoError(suite.db.Model(&models.UserTwoFactor{}).Where("user_id = ?", suite.user.ID).Update("challenges_valid_after", lockedAt).Error)
+
+	_, err := suite.twoFactorService.CompleteLogin(challenge, suite.codeAt(secret, 0))
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestRegenerateRecoveryCodes() {
+	secret, oldCodes := suite.enroll()
+
+	newCodes, err := suite.twoFactorService.RegenerateRecoveryCodes(suite.user.ID, suite.codeAt(secret, 0))
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), newCodes, 10)
+
+	_, err = suite.twoFactorService.CompleteLogin(suite.challenge(), oldCodes[0])
+	suite.assertCode(err, apperrors.ErrCodeUnauthorized)
+	_, err = suite.twoFactorService.CompleteLogin(suite.challenge(), newCodes[0])
+	assert.NoError(suite.T(), err)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestDisable() {
+	secret, _ := suite.enroll()
+
+	err := suite.twoFactorService.Disable(suite.user.ID, "000000")
+	suite.assertCode(err, apperrors.ErrCodeInvalidArgument)
+
+	suite.Require().NoError(suite.twoFactorService.Disable(suite.user.ID, suite.codeAt(secret, 0)))
+
+	var user models.User
+	suite.Require().NoError(suite.db.First(&user, suite.user.ID).Error)
+	assert.False(suite.T(), user.TwoFactorEnabled)
+}
+
+func (suite *TwoFactorServiceTestSuite) TestReset() {
+	suite.enroll()
+
+	suite.Require().NoError(suite.twoFactorService.Reset(suite.user.ID))
+
+	var user models.User
+	suite.Require().NoError(suite.db.First(&user, suite.user.ID).Error)
+	assert.False(suite.T(), user.TwoFactorEnabled)
+
+	var records, codes int64
+	suite.db.Model(&models.UserTwoFactor{}).Count(&records)
+	suite.db.Model(&models.TwoFactorRecoveryCode{}).Count(&codes)
+	assert.Zero(suite.T(), records)
+	assert.Zero(suite.T(), codes)
+
+	// The user can enroll again
+	_, err := suite.twoFactorService.BeginEnrollment(suite.user.ID)
+	assert.NoError(suite.T(), err)
+
+	suite.assertCode(suite.twoFactorService.Reset(9999), apperrors.ErrCodeNotFound)
+}
+
+func TestTwoFactorServiceSuite(t *testing.T) {
+	suite.Run(t, new(TwoFactorServiceTestSuite))
+}
@@ -0,0 +1,287 @@
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type UploadSessionServiceTestSuite struct {
+	suite.Suite
+	db            *gorm.DB
+	backend       *services.MemoryStorageBackend
+	uploadService *services.UploadSessionService
+	fileService   *services.FileService
+	testUser      models.User
+}
+
+func (suite *UploadSessionServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:upload_session_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(
+		&models.User{},
+		&models.File{},
+		&models.UserFile{},
+		&models.Folder{},
+		&models.RoomFile{},
+		&models.RoomMember{},
+		&models.UploadSession{},
+		&models.StorageIntegrityIssue{},
+		&models.FileVersion{},
+	)
+	suite.Require().NoError(err)
+}
+
+func (suite *UploadSessionServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *UploadSessionServiceTestSuite) SetupTest() {
+	suite.db.Exec("DELETE FROM upload_sessions")
+	suite.db.Exec("DELETE FROM user_files")
+	suite.db.Exec("DELETE FROM files")
+	suite.db.Exec("DELETE FROM users")
+
+	suite.testUser = models.User{
+		Username:     "uploader",
+		Email:        "uploader@example.com",
+		PasswordHash: "hash",
+		StorageQuota: 1024,
+	}
+	suite.Require().NoError(suite.db.Create(&suite.testUser).Error)
+
+	cfg := &config.Config{UploadMaxChunkBytes: 16}
+	dbService := database.NewDB(suite.db)
+	suite.backend = services.NewMemoryStorageBackend()
+	fileStorageService := services.NewFileStorageServiceWithBackend(suite.backend)
+	authService := services.NewAuthService(cfg)
+	userService := services.NewUserService(authService, dbService)
+	suite.fileService = services.NewFileService(cfg, dbService, fileStorageService, authService)
+	suite.uploadService = services.NewUploadSessionService(cfg, dbService, suite.fileService, fileStorageService, userService)
+}
+
+func hashOf(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+func (suite *UploadSessionServiceTestSuite) TestChunkedUpload_Success() {
+	ctx := context.Background()
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "big.bin", "application/octet-stream", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), int64(0), session.UploadOffset)
+	assert.Len(suite.T(), session.SessionToken, 64)
+
+	for offset := 0; offset < len(content); offset += 16 {
+		end := offset + 16
+		if end > len(content) {
+			end = len(content)
+		}
+		session, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, int64(offset), bytes.NewReader(content[offset:end]), int64(end-offset))
+		suite.Require().NoError(err)
+		assert.Equal(suite.T(), int64(end), session.UploadOffset)
+	}
+	assert.Equal(suite.T(), 3, session.ChunkCount)
+
+	userFile, err := suite.uploadService.FinalizeSession(ctx, suite.testUser.ID, session.SessionToken)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), "big.bin", userFile.Filename)
+	assert.Equal(suite.T(), hashOf(content), userFile.File.ContentHash)
+
+	reader, _, err := suite.fileService.StreamFile(suite.testUser.ID, userFile.ID)
+	suite.Require().NoError(err)
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), content, data)
+
+	// Chunks are removed once the file has been assembled
+	chunks, err := suite.backend.List(ctx, "uploads/")
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), chunks)
+
+	finalized, err := suite.uploadService.GetSession(suite.testUser.ID, session.SessionToken)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.UploadSessionStatusCompleted, finalized.Status)
+	suite.Require().NotNil(finalized.UserFileID)
+	assert.Equal(suite.T(), userFile.ID, *finalized.UserFileID)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestAppendChunk_OffsetMismatch() {
+	content := []byte("hello world")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+
+	_, err = suite.uploadService.AppendChunk(context.Background(), suite.testUser.ID, session.SessionToken, 5, bytes.NewReader(content[5:]), int64(len(content)-5))
+	assert.Error(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "offset mismatch")
+}
+
+func (suite *UploadSessionServiceTestSuite) TestAppendChunk_ExceedsDeclaredSize() {
+	content := []byte("hello")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+
+	_, err = suite.uploadService.AppendChunk(context.Background(), suite.testUser.ID, session.SessionToken, 0, bytes.NewReader([]byte("hello!")), 6)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestFinalizeSession_Incomplete() {
+	content := []byte("hello world")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+
+	_, err = suite.uploadService.AppendChunk(context.Background(), suite.testUser.ID, session.SessionToken, 0, bytes.NewReader(content[:5]), 5)
+	suite.Require().NoError(err)
+
+	_, err = suite.uploadService.FinalizeSession(context.Background(), suite.testUser.ID, session.SessionToken)
+	assert.Error(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "upload incomplete")
+}
+
+func (suite *UploadSessionServiceTestSuite) TestFinalizeSession_SupersededChunkIsNotAssembled() {
+	ctx := context.Background()
+	content := []byte("hello world")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 0, bytes.NewReader(content[:5]), 5)
+	suite.Require().NoError(err)
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 5, bytes.NewReader(content[5:]), int64(len(content)-5))
+	suite.Require().NoError(err)
+
+	// A concurrent append at offset 0 that lost the race but could not delete its object
+	stray := fmt.Sprintf("uploads/%s/%020d-ffffffffffffffff", session.SessionToken, 0)
+	suite.Require().NoError(suite.backend.Put(ctx, stray, bytes.NewReader([]byte("HELLO")), 5, ""))
+
+	userFile, err := suite.uploadService.FinalizeSession(ctx, suite.testUser.ID, session.SessionToken)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), hashOf(content), userFile.File.ContentHash)
+
+	// The stray object is removed with the recorded chunks
+	_, err = suite.backend.Get(ctx, stray)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestFinalizeSession_AfterUnrecordedChunk() {
+	ctx := context.Background()
+	content := []byte("hello world")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+
+	// An append that stored its chunk but died before recording it
+	orphan := fmt.Sprintf("uploads/%s/%020d-0000000000000000", session.SessionToken, 0)
+	suite.Require().NoError(suite.backend.Put(ctx, orphan, bytes.NewReader(content[:5]), 5, ""))
+
+	// The client retries at the same offset and completes the upload
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 0, bytes.NewReader(content[:5]), 5)
+	suite.Require().NoError(err)
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 5, bytes.NewReader(content[5:]), int64(len(content)-5))
+	suite.Require().NoError(err)
+
+	userFile, err := suite.uploadService.FinalizeSession(ctx, suite.testUser.ID, session.SessionToken)
+	suite.Require().NoError(err)
+	assert.EqualValues(suite.T(), len(content), userFile.File.SizeBytes)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestFinalizeSession_OnlyOnce() {
+	ctx := context.Background()
+	content := []byte("hello")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 0, bytes.NewReader(content), int64(len(content)))
+	suite.Require().NoError(err)
+
+	_, err = suite.uploadService.FinalizeSession(ctx, suite.testUser.ID, session.SessionToken)
+	suite.Require().NoError(err)
+	_, err = suite.uploadService.FinalizeSession(ctx, suite.testUser.ID, session.SessionToken)
+	assert.Error(suite.T(), err)
+
+	var userFiles int64
+	suite.Require().NoError(suite.db.Model(&models.UserFile{}).Count(&userFiles).Error)
+	assert.EqualValues(suite.T(), 1, userFiles)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestCreateSession_QuotaExceeded() {
+	_, err := suite.uploadService.CreateSession(suite.testUser.ID, "huge.bin", "", hashOf([]byte("x")), "key", 4096, nil)
+	assert.Error(suite.T(), err)
+	assert.Contains(suite.T(), err.Error(), "quota")
+}
+
+func (suite *UploadSessionServiceTestSuite) TestCreateSession_InvalidHash() {
+	_, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "", "not-a-hash", "key", 10, nil)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestGetSession_OtherUser() {
+	content := []byte("hello")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+
+	_, err = suite.uploadService.GetSession(suite.testUser.ID+1, session.SessionToken)
+	assert.Error(suite.T(), err)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestCleanupExpiredSessions() {
+	ctx := context.Background()
+	content := []byte("hello world")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 0, bytes.NewReader(content[:5]), 5)
+	suite.Require().NoError(err)
+
+	suite.db.Model(&models.UploadSession{}).Where("id = ?", session.ID).Update("expires_at", time.Now().Add(-time.Hour))
+
+	cleaned, err := suite.uploadService.CleanupExpiredSessions(ctx)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), 1, cleaned)
+
+	chunks, err := suite.backend.List(ctx, "uploads/")
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), chunks)
+
+	expired, err := suite.uploadService.GetSession(suite.testUser.ID, session.SessionToken)
+	suite.Require().NoError(err)
+	assert.Equal(suite.T(), models.UploadSessionStatusExpired, expired.Status)
+
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 5, bytes.NewReader(content[5:]), int64(len(content)-5))
+	assert.Error(suite.T(), err)
+}
+
+func (suite *UploadSessionServiceTestSuite) TestAbortSession() {
+	ctx := context.Background()
+	content := []byte("hello world")
+	session, err := suite.uploadService.CreateSession(suite.testUser.ID, "a.txt", "text/plain", hashOf(content), "key", int64(len(content)), nil)
+	suite.Require().NoError(err)
+	_, err = suite.uploadService.AppendChunk(ctx, suite.testUser.ID, session.SessionToken, 0, bytes.NewReader(content[:5]), 5)
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(suite.uploadService.AbortSession(ctx, suite.testUser.ID, session.SessionToken))
+
+	chunks, err := suite.backend.List(ctx, "uploads/")
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), chunks)
+}
+
+func TestUploadSessionServiceSuite(t *testing.T) {
+	suite.Run(t, new(UploadSessionServiceTestSuite))
+}
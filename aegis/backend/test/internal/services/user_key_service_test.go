@@ -0,0 +1,256 @@
+package services_test
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/balkanid/aegis-backend/internal/config"
+	"github.com/balkanid/aegis-backend/internal/database"
+	apperrors "github.com/balkanid/aegis-backend/internal/errors"
+	"github.com/balkanid/aegis-backend/internal/models"
+	"github.com/balkanid/aegis-backend/internal/services"
+)
+
+type UserKeyServiceTestSuite struct {
+	suite.Suite
+	db             *gorm.DB
+	userKeyService *services.UserKeyService
+	roomService    *services.RoomService
+	fileService    *services.FileService
+	owner          models.User
+	alice          models.User
+	bob            models.User
+	userFile       models.UserFile
+	room           *models.Room
+}
+
+func (suite *UserKeyServiceTestSuite) SetupSuite() {
+	db, err := gorm.Open(sqlite.Open("file:user_key_service_test?mode=memory&cache=shared"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.db = db
+
+	err = db.AutoMigrate(&models.User{}, &models.File{}, &models.UserFile{}, &models.Room{}, &models.RoomMember{},
+		&models.RoomFile{}, &models.UserKeyPair{}, &models.FileKeyGrant{}, &models.RoomKey{}, &models.DownloadTicketRedemption{})
+	suite.Require().NoError(err)
+}
+
+func (suite *UserKeyServiceTestSuite) TearDownSuite() {
+	if suite.db != nil {
+		sqlDB, _ := suite.db.DB()
+		sqlDB.Close()
+	}
+}
+
+func (suite *UserKeyServiceTestSuite) SetupTest() {
+	for _, table := range []string{"file_key_grants", "user_key_pairs", "room_files", "room_members", "rooms", "user_files", "files", "users"} {
+		suite.db.Exec("DELETE FROM " + table)
+	}
+
+	suite.owner = models.User{Username: "owner", Email: "owner@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.alice = models.User{Username: "alice", Email: "alice@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	suite.bob = models.User{Username: "bob", Email: "bob@example.com", PasswordHash: "hash", StorageQuota: 10485760}
+	for _, user := range []*models.User{&suite.owner, &suite.alice, &suite.bob} {
+		suite.Require().NoError(suite.db.Create(user).Error)
+	}
+
+	file := models.File{ContentHash: strings.Repeat("b", 64), SizeBytes: 5, StoragePath: "objects/b", RefCount: 1}
+	suite.Require().NoError(suite.db.Create(&file).Error)
+	suite.userFile = models.UserFile{UserID: suite.owner.ID, FileID: file.ID, Filename: "b.txt", MimeType: "text/plain", EncryptionKey: "key", CurrentVersion: 3}
+	suite.Require().NoError(suite.db.Create(&suite.userFile).Error)
+
+	cfg := &config.Config{JWTSecret: "test-secret-key-that-is-long-enough-for-hs256"}
+	dbService := database.NewDB(suite.db)
+	authService := services.NewAuthService(cfg)
+	suite.userKeyService = services.NewUserKeyService(cfg, dbService)
+	suite.roomService = services.NewRoomService(dbService, services.NewUserService(authService, dbService))
+	suite.fileService = services.NewFileService(cfg, dbService, nil, authService)
+
+	room, err := suite.roomService.CreateRoom(suite.owner.ID, "Team")
+	suite.Require().NoError(err)
+	suite.room = room
+	suite.Require().NoError(suite.roomService.AddRoomMember(room.ID, "alice", suite.owner.ID, models.RoomRoleContentViewer))
+	suite.Require().NoError(suite.roomService.ShareFileToRoom(suite.userFile.ID, room.ID, suite.owner.ID))
+}
+
+// registerKey registers a fresh key pair for the user and returns its fingerprint.
+func (suite *UserKeyServiceTestSuite) registerKey(userID uint) string {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	suite.Require().NoError(err)
+	publicKey := base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes())
+
+	keyPair, err := suite.userKeyService.RegisterKeyPair(userID, publicKey, "wrapped-private-key")
+	suite.Require().NoError(err)
+	return keyPair.Fingerprint
+}
+
+func (suite *UserKeyServiceTestSuite) assertErrorCode(err error, code apperrors.ErrorCode) {
+	suite.Require().Error(err)
+	var appErr *apperrors.Error
+	suite.Require().ErrorAs(err, &appErr)
+	assert.Equal(suite.T(), code, appErr.Code)
+}
+
+func (suite *UserKeyServiceTestSuite) TestRegisterKeyPair() {
+	fingerprint := suite.registerKey(suite.alice.ID)
+	assert.Len(suite.T(), fingerprint, 64)
+
+	keyPair, err := suite.userKeyService.GetKeyPair(suite.alice.ID)
+	suite.Require().NoError(err)
+	suite.Require().NotNil(keyPair)
+	assert.Equal(suite.T(), "wrapped-private-key", keyPair.WrappedPrivateKey)
+
+	keyPair, err = suite.userKeyService.GetKeyPair(suite.bob.ID)
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), keyPair)
+
+	keyPairs, err := suite.userKeyService.GetPublicKeys([]uint{suite.alice.ID, suite.bob.ID})
+	suite.Require().NoError(err)
+	suite.Require().Len(keyPairs, 1)
+	assert.Equal(suite.T(), "alice", keyPairs[0].User.Username)
+}
+
+func (suite *UserKeyServiceTestSuite) TestRegisterKeyPair_RejectsInvalidKeys() {
+	lowOrder := make([]byte, 32) // The all-zero point agrees on an all-zero secret
+	for _, publicKey := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short")), base64.StdEncoding.EncodeToString(lowOrder)} {
+		_, err := suite.userKeyService.RegisterKeyPair(suite.alice.ID, publicKey, "wrapped-private-key")
+		suite.assertErrorCode(err, apperrors.ErrCodeInvalidArgument)
+	}
+
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	suite.Require().NoError(err)
+	_, err = suite.userKeyService.RegisterKeyPair(suite.alice.ID, base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes()), "")
+	suite.assertErrorCode(err, apperrors.ErrCodeInvalidArgument)
+}
+
+func (suite *UserKeyServiceTestSuite) TestDirectGrant() {
+	fingerprint := suite.registerKey(suite.bob.ID)
+
+	// Bob is not in the room, so the file is not shared with him yet
+	_, err := suite.fileService.GetFileDownloadURL(context.Background(), &suite.bob, suite.userFile.ID)
+	suite.Require().Error(err)
+
+	// Only the owner can share a file directly
+	_, err = suite.userKeyService.GrantFileKeys(suite.alice.ID, suite.userFile.ID, nil,
+		[]services.FileKeyGrantInput{{RecipientID: suite.bob.ID, KeyFingerprint: fingerprint, WrappedKey: "wrapped-file-key"}})
+	suite.assertErrorCode(err, apperrors.ErrCodeNotFound)
+
+	grants, err := suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, nil,
+		[]services.FileKeyGrantInput{{RecipientID: suite.bob.ID, KeyFingerprint: fingerprint, WrappedKey: "wrapped-file-key"}})
+	suite.Require().NoError(err)
+	suite.Require().Len(grants, 1)
+	assert.Nil(suite.T(), grants[0].RoomID)
+	assert.Equal(suite.T(), 3, grants[0].Version)
+
+	// A key grant alone does not give access to the stored object
+	_, err = suite.fileService.GetFileDownloadURL(context.Background(), &suite.bob, suite.userFile.ID)
+	assert.Error(suite.T(), err)
+
+	grant, err := suite.userKeyService.GetFileKeyGrant(suite.bob.ID, suite.userFile.ID)
+	suite.Require().NoError(err)
+	suite.Require().NotNil(grant)
+	assert.Equal(suite.T(), "wrapped-file-key", grant.WrappedKey)
+
+	received, err := suite.userKeyService.GetReceivedFileKeyGrants(suite.bob.ID)
+	suite.Require().NoError(err)
+	suite.Require().Len(received, 1)
+	assert.Equal(suite.T(), "owner", received[0].UserFile.User.Username)
+
+	// Revoking the grant stops sharing the file
+	suite.Require().NoError(suite.userKeyService.RevokeFileKeyGrant(suite.owner.ID, suite.userFile.ID, suite.bob.ID))
+	grant, err = suite.userKeyService.GetFileKeyGrant(suite.bob.ID, suite.userFile.ID)
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), grant)
+}
+
+func (suite *UserKeyServiceTestSuite) TestRequireGrants_DefaultsToOn() {
+	assert.True(suite.T(), suite.userKeyService.RequireGrants())
+
+	legacy := services.NewUserKeyService(&config.Config{AllowLegacyFileKeys: true}, database.NewDB(suite.db))
+	assert.False(suite.T(), legacy.RequireGrants())
+}
+
+func (suite *UserKeyServiceTestSuite) TestGrant_RequiresCurrentPublicKey() {
+	input := []services.FileKeyGrantInput{{RecipientID: suite.bob.ID, KeyFingerprint: strings.Repeat("0", 64), WrappedKey: "wrapped-file-key"}}
+	_, err := suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, nil, input)
+	suite.assertErrorCode(err, apperrors.ErrCodeNotFound)
+
+	oldFingerprint := suite.registerKey(suite.bob.ID)
+	_, err = suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, nil, input)
+	suite.assertErrorCode(err, apperrors.ErrCodeConflict)
+
+	input[0].KeyFingerprint = oldFingerprint
+	_, err = suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, nil, input)
+	suite.Require().NoError(err)
+
+	// A new key pair cannot unwrap keys granted to the old one
+	suite.registerKey(suite.bob.ID)
+	grant, err := suite.userKeyService.GetFileKeyGrant(suite.bob.ID, suite.userFile.ID)
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), grant)
+}
+
+func (suite *UserKeyServiceTestSuite) TestRoomGrant() {
+	aliceFingerprint := suite.registerKey(suite.alice.ID)
+	bobFingerprint := suite.registerKey(suite.bob.ID)
+	roomID := suite.room.ID
+
+	// Bob is not a member of the room
+	_, err := suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, &roomID,
+		[]services.FileKeyGrantInput{{RecipientID: suite.bob.ID, KeyFingerprint: bobFingerprint, WrappedKey: "wrapped-file-key"}})
+	suite.assertErrorCode(err, apperrors.ErrCodeForbidden)
+
+	grants, err := suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, &roomID,
+		[]services.FileKeyGrantInput{{RecipientID: suite.alice.ID, KeyFingerprint: aliceFingerprint, WrappedKey: "wrapped-file-key"}})
+	suite.Require().NoError(err)
+	suite.Require().NotNil(grants[0].RoomID)
+
+	// Members see their own grant, the owner sees every grant
+	visible, err := suite.userKeyService.GetFileKeyGrants(suite.alice.ID, suite.userFile.ID)
+	suite.Require().NoError(err)
+	assert.Len(suite.T(), visible, 1)
+	visible, err = suite.userKeyService.GetFileKeyGrants(suite.bob.ID, suite.userFile.ID)
+	suite.Require().NoError(err)
+	assert.Empty(suite.T(), visible)
+
+	// The grant goes with the membership
+	suite.Require().NoError(suite.roomService.RemoveRoomMember(roomID, suite.alice.ID, suite.owner.ID))
+	grant, err := suite.userKeyService.GetFileKeyGrant(suite.alice.ID, suite.userFile.ID)
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), grant)
+}
+
+func (suite *UserKeyServiceTestSuite) TestRoomGrant_KeepsDirectGrants() {
+	aliceFingerprint := suite.registerKey(suite.alice.ID)
+	roomID := suite.room.ID
+	input := []services.FileKeyGrantInput{{RecipientID: suite.alice.ID, KeyFingerprint: aliceFingerprint, WrappedKey: "wrapped-file-key"}}
+
+	_, err := suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, nil, input)
+	suite.Require().NoError(err)
+	grants, err := suite.userKeyService.GrantFileKeys(suite.owner.ID, suite.userFile.ID, &roomID, input)
+	suite.Require().NoError(err)
+	assert.Nil(suite.T(), grants[0].RoomID)
+
+	// Removing the file from the room leaves the direct share in place
+	suite.Require().NoError(suite.roomService.RemoveFileFromRoom(suite.userFile.ID, roomID, suite.owner.ID))
+	grant, err := suite.userKeyService.GetFileKeyGrant(suite.alice.ID, suite.userFile.ID)
+	suite.Require().NoError(err)
+	assert.NotNil(suite.T(), grant)
+
+	// Nobody else can revoke it
+	err = suite.userKeyService.RevokeFileKeyGrant(suite.bob.ID, suite.userFile.ID, suite.alice.ID)
+	suite.assertErrorCode(err, apperrors.ErrCodeNotFound)
+	assert.NoError(suite.T(), suite.userKeyService.RevokeFileKeyGrant(suite.alice.ID, suite.userFile.ID, suite.alice.ID))
+}
+
+func TestUserKeyServiceSuite(t *testing.T) {
+	suite.Run(t, new(UserKeyServiceTestSuite))
+}
@@ -39,6 +39,7 @@ func (suite *UserServiceTestSuite) SetupSuite() {
 		&models.RoomMember{},
 		&models.RoomFile{},
 		&models.DownloadLog{},
+		&models.FileVersion{},
 	)
 	suite.Require().NoError(err)
 
@@ -82,12 +83,11 @@ func (suite *UserServiceTestSuite) TestNewUserService() {
 	assert.NotNil(suite.T(), service)
 }
 
-func (suite *UserServiceTestSuite) TestRegister_Success() {
-	user, token, err := suite.userService.Register("testuser", "test@example.com", "TestPass123!")
+func (suite *UserServiceTestSuite) TestCreateUser_Success() {
+	user, err := suite.userService.CreateUser("testuser", "test@example.com", "TestPass123!")
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), user)
-	assert.NotEmpty(suite.T(), token)
 	assert.Equal(suite.T(), "test@example.com", user.Email)
 	assert.Equal(suite.T(), "testuser", user.Username)
 	assert.False(suite.T(), user.IsAdmin)
@@ -99,7 +99,7 @@ func (suite *UserServiceTestSuite) TestRegister_Success() {
 	assert.NoError(suite.T(), err)
 }
 
-func (suite *UserServiceTestSuite) TestRegister_UserAlreadyExists() {
+func (suite *UserServiceTestSuite) TestCreateUser_UserAlreadyExists() {
 	// Create existing user
 	existingUser := models.User{
 		Email:        "test@example.com",
@@ -108,23 +108,21 @@ func (suite *UserServiceTestSuite) TestRegister_UserAlreadyExists() {
 	}
 	suite.db.Create(&existingUser)
 
-	user, token, err := suite.userService.Register("testuser", "test@example.com", "TestPass123!")
+	user, err := suite.userService.CreateUser("testuser", "test@example.com", "TestPass123!")
 
 	assert.Error(suite.T(), err)
 	assert.Nil(suite.T(), user)
-	assert.Empty(suite.T(), token)
 	assert.Contains(suite.T(), err.Error(), "already exists")
 }
 
-func (suite *UserServiceTestSuite) TestRegister_InvalidPassword() {
-	user, token, err := suite.userService.Register("testuser", "test@example.com", "")
+func (suite *UserServiceTestSuite) TestCreateUser_InvalidPassword() {
+	user, err := suite.userService.CreateUser("testuser", "test@example.com", "")
 
 	assert.Error(suite.T(), err)
 	assert.Nil(suite.T(), user)
-	assert.Empty(suite.T(), token)
 }
 
-func (suite *UserServiceTestSuite) TestLogin_Success() {
+func (suite *UserServiceTestSuite) TestAuthenticate_Success() {
 	// Create user
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 	user := models.User{
@@ -134,25 +132,23 @@ func (suite *UserServiceTestSuite) TestLogin_Success() {
 	}
 	suite.db.Create(&user)
 
-	loggedInUser, token, err := suite.userService.Login("test@example.com", "password123")
+	loggedInUser, err := suite.userService.Authenticate("test@example.com", "password123")
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), loggedInUser)
-	assert.NotEmpty(suite.T(), token)
 	assert.Equal(suite.T(), user.ID, loggedInUser.ID)
 	assert.Equal(suite.T(), user.Email, loggedInUser.Email)
 }
 
-func (suite *UserServiceTestSuite) TestLogin_UserNotFound() {
-	user, token, err := suite.userService.Login("nonexistent@example.com", "password123")
+func (suite *UserServiceTestSuite) TestAuthenticate_UserNotFound() {
+	user, err := suite.userService.Authenticate("nonexistent@example.com", "password123")
 
 	assert.Error(suite.T(), err)
 	assert.Nil(suite.T(), user)
-	assert.Empty(suite.T(), token)
 	assert.Contains(suite.T(), err.Error(), "invalid credentials")
 }
 
-func (suite *UserServiceTestSuite) TestLogin_InvalidPassword() {
+func (suite *UserServiceTestSuite) TestAuthenticate_InvalidPassword() {
 	// Create user
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
 	user := models.User{
@@ -162,11 +158,10 @@ func (suite *UserServiceTestSuite) TestLogin_InvalidPassword() {
 	}
 	suite.db.Create(&user)
 
-	loggedInUser, token, err := suite.userService.Login("test@example.com", "wrongpassword")
+	loggedInUser, err := suite.userService.Authenticate("test@example.com", "wrongpassword")
 
 	assert.Error(suite.T(), err)
 	assert.Nil(suite.T(), loggedInUser)
-	assert.Empty(suite.T(), token)
 	assert.Contains(suite.T(), err.Error(), "invalid credentials")
 }
 
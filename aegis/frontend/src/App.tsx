@@ -9,6 +9,11 @@ import apolloClient from './apollo/client';
 // Import components (to be created)
 import Login from './components/auth/Login';
 import Register from './components/auth/Register';
+import OIDCCallback from './components/auth/OIDCCallback';
+import VerifyEmail from './components/auth/VerifyEmail';
+import ForgotPassword from './components/auth/ForgotPassword';
+import ResetPassword from './components/auth/ResetPassword';
+import UnlockAccount from './components/auth/UnlockAccount';
 import Dashboard from './components/dashboard/Dashboard';
 import Profile from './components/profile/Profile';
 import SharedDashboard from './components/dashboard/SharedDashboard';
@@ -139,6 +144,20 @@ const AppRoutes: React.FC = () => {
             <Register />
           </PublicRoute>
         } />
+        <Route path="/auth/callback" element={
+          <PublicRoute>
+            <OIDCCallback />
+          </PublicRoute>
+        } />
+        <Route path="/forgot-password" element={
+          <PublicRoute>
+            <ForgotPassword />
+          </PublicRoute>
+        } />
+        {/* Links from emails work whether or not the user is signed in */}
+        <Route path="/verify-email" element={<VerifyEmail />} />
+        <Route path="/reset-password" element={<ResetPassword />} />
+        <Route path="/unlock-account" element={<UnlockAccount />} />
 
         {/* Protected routes */}
         <Route path="/dashboard" element={
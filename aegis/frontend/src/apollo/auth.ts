@@ -5,6 +5,7 @@ export const REGISTER_MUTATION = gql`
   mutation Register($input: RegisterInput!) {
     register(input: $input) {
       token
+      refresh_token
       user {
         id
         username
@@ -21,7 +22,65 @@ export const REGISTER_MUTATION = gql`
 export const LOGIN_MUTATION = gql`
   mutation Login($input: LoginInput!) {
     login(input: $input) {
+      two_factor_required
+      challenge_token
       token
+      refresh_token
+      user {
+        id
+        username
+        email
+        storage_quota
+        used_storage
+        is_admin
+        created_at
+      }
+    }
+  }
+`;
+
+export const VERIFY_TWO_FACTOR_LOGIN_MUTATION = gql`
+  mutation VerifyTwoFactorLogin($challenge_token: String!, $code: String!) {
+    verifyTwoFactorLogin(challenge_token: $challenge_token, code: $code) {
+      token
+      refresh_token
+      user {
+        id
+        username
+        email
+        storage_quota
+        used_storage
+        is_admin
+        two_factor_enabled
+        created_at
+      }
+    }
+  }
+`;
+
+// Single sign-on through the configured OpenID Connect provider
+export const GET_AUTH_SETTINGS = gql`
+  query GetAuthSettings {
+    authSettings {
+      oidc_enabled
+      password_signup_enabled
+    }
+  }
+`;
+
+export const BEGIN_OIDC_LOGIN_MUTATION = gql`
+  mutation BeginOIDCLogin {
+    beginOIDCLogin
+  }
+`;
+
+export const COMPLETE_OIDC_LOGIN_MUTATION = gql`
+  mutation CompleteOIDCLogin($state: String!, $code: String!) {
+    completeOIDCLogin(state: $state, code: $code) {
+      two_factor_required
+      challenge_token
+      token
+      refresh_token
       user {
         id
         username
@@ -36,15 +95,16 @@ export const LOGIN_MUTATION = gql`
 `;
 
 export const LOGOUT_MUTATION = gql`
-  mutation Logout {
-    logout
+  mutation Logout($refresh_token: String) {
+    logout(refresh_token: $refresh_token)
   }
 `;
 
 export const REFRESH_TOKEN_MUTATION = gql`
-  mutation RefreshToken {
-    refreshToken {
+  mutation RefreshToken($refresh_token: String!) {
+    refreshToken(refresh_token: $refresh_token) {
       token
+      refresh_token
       user {
         id
         username
@@ -58,6 +118,37 @@ export const REFRESH_TOKEN_MUTATION = gql`
   }
 `;
 
+// Email verification, password reset and account unlock links
+export const SEND_VERIFICATION_EMAIL_MUTATION = gql`
+  mutation SendVerificationEmail {
+    sendVerificationEmail
+  }
+`;
+
+export const VERIFY_EMAIL_MUTATION = gql`
+  mutation VerifyEmail($token: String!) {
+    verifyEmail(token: $token)
+  }
+`;
+
+export const REQUEST_PASSWORD_RESET_MUTATION = gql`
+  mutation RequestPasswordReset($email: String!) {
+    requestPasswordReset(email: $email)
+  }
+`;
+
+export const RESET_PASSWORD_MUTATION = gql`
+  mutation ResetPassword($token: String!, $new_password: String!) {
+    resetPassword(token: $token, new_password: $new_password)
+  }
+`;
+
+export const UNLOCK_ACCOUNT_WITH_TOKEN_MUTATION = gql`
+  mutation UnlockAccountWithToken($token: String!) {
+    unlockAccountWithToken(token: $token)
+  }
+`;
+
 // Profile Mutations
 export const UPDATE_PROFILE_MUTATION = gql`
   mutation UpdateProfile($input: UpdateProfileInput!) {
@@ -65,6 +156,7 @@ export const UPDATE_PROFILE_MUTATION = gql`
       id
       username
       email
+      email_verified
       storage_quota
       used_storage
       is_admin
@@ -80,6 +172,7 @@ export const ME_QUERY = gql`
       id
       username
       email
+      email_verified
       storage_quota
       used_storage
       is_admin
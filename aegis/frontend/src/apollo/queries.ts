@@ -5,6 +5,7 @@ export const REGISTER_MUTATION = gql`
   mutation Register($input: RegisterInput!) {
     register(input: $input) {
       token
+      refresh_token
       user {
         id
         username
@@ -21,7 +22,10 @@ export const REGISTER_MUTATION = gql`
 export const LOGIN_MUTATION = gql`
   mutation Login($input: LoginInput!) {
     login(input: $input) {
+      two_factor_required
+      challenge_token
       token
+      refresh_token
       user {
         id
         username
@@ -35,16 +39,36 @@ export const LOGIN_MUTATION = gql`
   }
 `;
 
+export const VERIFY_TWO_FACTOR_LOGIN_MUTATION = gql`
+  mutation VerifyTwoFactorLogin($challenge_token: String!, $code: String!) {
+    verifyTwoFactorLogin(challenge_token: $challenge_token, code: $code) {
+      token
+      refresh_token
+      user {
+        id
+        username
+        email
+        storage_quota
+        used_storage
+        is_admin
+        two_factor_enabled
+        created_at
+      }
+    }
+  }
+`;
+
 export const LOGOUT_MUTATION = gql`
-  mutation Logout {
-    logout
+  mutation Logout($refresh_token: String) {
+    logout(refresh_token: $refresh_token)
   }
 `;
 
 export const REFRESH_TOKEN_MUTATION = gql`
-  mutation RefreshToken {
-    refreshToken {
+  mutation RefreshToken($refresh_token: String!) {
+    refreshToken(refresh_token: $refresh_token) {
       token
+      refresh_token
       user {
         id
         username
@@ -58,6 +82,105 @@ export const REFRESH_TOKEN_MUTATION = gql`
   }
 `;
 
+// Two-factor authentication
+export const BEGIN_TWO_FACTOR_ENROLLMENT_MUTATION = gql`
+  mutation BeginTwoFactorEnrollment {
+    beginTwoFactorEnrollment {
+      secret
+      provisioning_uri
+    }
+  }
+`;
+
+export const CONFIRM_TWO_FACTOR_ENROLLMENT_MUTATION = gql`
+  mutation ConfirmTwoFactorEnrollment($code: String!) {
+    confirmTwoFactorEnrollment(code: $code)
+  }
+`;
+
+export const REGENERATE_RECOVERY_CODES_MUTATION = gql`
+  mutation RegenerateRecoveryCodes($code: String!) {
+    regenerateRecoveryCodes(code: $code)
+  }
+`;
+
+export const DISABLE_TWO_FACTOR_MUTATION = gql`
+  mutation DisableTwoFactor($code: String!) {
+    disableTwoFactor(code: $code)
+  }
+`;
+
+export const RESET_USER_TWO_FACTOR_MUTATION = gql`
+  mutation ResetUserTwoFactor($user_id: ID!) {
+    resetUserTwoFactor(user_id: $user_id)
+  }
+`;
+
+// Session Queries
+export const GET_MY_SESSIONS = gql`
+  query GetMySessions {
+    mySessions {
+      id
+      user_agent
+      ip_address
+      created_at
+      last_seen_at
+      expires_at
+      is_current
+    }
+  }
+`;
+
+export const REVOKE_SESSION_MUTATION = gql`
+  mutation RevokeSession($session_id: ID!) {
+    revokeSession(session_id: $session_id)
+  }
+`;
+
+export const REVOKE_ALL_OTHER_SESSIONS_MUTATION = gql`
+  mutation RevokeAllOtherSessions {
+    revokeAllOtherSessions
+  }
+`;
+
+// Personal Access Token Queries
+export const GET_MY_PERSONAL_ACCESS_TOKENS = gql`
+  query GetMyPersonalAccessTokens {
+    myPersonalAccessTokens {
+      id
+      name
+      token_prefix
+      scopes
+      expires_at
+      last_used_at
+      created_at
+    }
+  }
+`;
+
+export const CREATE_PERSONAL_ACCESS_TOKEN_MUTATION = gql`
+  mutation CreatePersonalAccessToken($input: CreatePersonalAccessTokenInput!) {
+    createPersonalAccessToken(input: $input) {
+      token
+      personal_access_token {
+        id
+        name
+        token_prefix
+        scopes
+        expires_at
+        last_used_at
+        created_at
+      }
+    }
+  }
+`;
+
+export const REVOKE_PERSONAL_ACCESS_TOKEN_MUTATION = gql`
+  mutation RevokePersonalAccessToken($id: ID!) {
+    revokePersonalAccessToken(id: $id)
+  }
+`;
+
 // User Queries
 export const GET_ME = gql`
   query GetMe {
@@ -81,6 +204,7 @@ export const GET_MY_FILES = gql`
       encryption_key
       folder_id
       is_starred
+      integrity_status
       created_at
       file {
         id
@@ -349,6 +473,8 @@ export const GET_ROOM = gql`
       id
       name
       creator_id
+      key_version
+      rekey_required
       created_at
       creator {
         id
@@ -513,8 +639,155 @@ export const REMOVE_ROOM_MEMBER_MUTATION = gql`
 `;
 
 export const SHARE_FILE_TO_ROOM_MUTATION = gql`
-  mutation ShareFileToRoom($user_file_id: ID!, $room_id: ID!) {
-    shareFileToRoom(user_file_id: $user_file_id, room_id: $room_id)
+  mutation ShareFileToRoom($user_file_id: ID!, $room_id: ID!, $room_key_version: Int, $wrapped_key: String) {
+    shareFileToRoom(user_file_id: $user_file_id, room_id: $room_id, room_key_version: $room_key_version, wrapped_key: $wrapped_key)
+  }
+`;
+
+// Room keys
+export const GET_MY_ROOM_KEYS = gql`
+  query GetMyRoomKeys($room_id: ID!) {
+    myRoomKeys(room_id: $room_id) {
+      room_id
+      version
+      key_fingerprint
+      wrapped_key
+      created_at
+    }
+  }
+`;
+
+export const GET_ROOM_FILE_KEYS = gql`
+  query GetRoomFileKeys($room_id: ID!) {
+    roomFileKeys(room_id: $room_id) {
+      user_file_id
+      key_version
+      wrapped_key
+    }
+  }
+`;
+
+export const ROTATE_ROOM_KEY_MUTATION = gql`
+  mutation RotateRoomKey($input: RotateRoomKeyInput!) {
+    rotateRoomKey(input: $input) {
+      id
+      key_version
+      rekey_required
+    }
+  }
+`;
+
+export const GRANT_ROOM_KEYS_MUTATION = gql`
+  mutation GrantRoomKeys($input: GrantRoomKeysInput!) {
+    grantRoomKeys(input: $input)
+  }
+`;
+
+// End-to-end sharing keys
+export const GET_MY_KEY_PAIR = gql`
+  query GetMyKeyPair {
+    myKeyPair {
+      user_id
+      public_key
+      fingerprint
+      wrapped_private_key
+      created_at
+      updated_at
+    }
+  }
+`;
+
+export const GET_PUBLIC_KEYS = gql`
+  query GetPublicKeys($user_ids: [ID!]!) {
+    publicKeys(user_ids: $user_ids) {
+      user_id
+      public_key
+      fingerprint
+      user {
+        id
+        username
+      }
+    }
+  }
+`;
+
+export const REGISTER_KEY_PAIR_MUTATION = gql`
+  mutation RegisterKeyPair($input: RegisterKeyPairInput!) {
+    registerKeyPair(input: $input) {
+      user_id
+      public_key
+      fingerprint
+      created_at
+      updated_at
+    }
+  }
+`;
+
+export const GET_FILE_KEY_GRANTS = gql`
+  query GetFileKeyGrants($user_file_id: ID!) {
+    fileKeyGrants(user_file_id: $user_file_id) {
+      id
+      recipient_id
+      room_id
+      version
+      key_fingerprint
+      wrapped_key
+      created_at
+      recipient {
+        id
+        username
+      }
+    }
+  }
+`;
+
+export const GET_MY_FILE_KEY_GRANTS = gql`
+  query GetMyFileKeyGrants {
+    myFileKeyGrants {
+      id
+      user_file_id
+      room_id
+      version
+      key_fingerprint
+      wrapped_key
+      created_at
+      granter {
+        id
+        username
+      }
+      user_file {
+        id
+        filename
+        mime_type
+        current_version
+        user {
+          id
+          username
+        }
+        file {
+          id
+          size_bytes
+        }
+      }
+    }
+  }
+`;
+
+export const GRANT_FILE_KEYS_MUTATION = gql`
+  mutation GrantFileKeys($input: GrantFileKeysInput!) {
+    grantFileKeys(input: $input) {
+      id
+      recipient_id
+      room_id
+      version
+      key_fingerprint
+    }
+  }
+`;
+
+export const REVOKE_FILE_KEY_GRANT_MUTATION = gql`
+  mutation RevokeFileKeyGrant($user_file_id: ID!, $recipient_id: ID!) {
+    revokeFileKeyGrant(user_file_id: $user_file_id, recipient_id: $recipient_id)
   }
 `;
 
@@ -656,6 +929,70 @@ export const DELETE_USER_ACCOUNT_MUTATION = gql`
   }
 `;
 
+export const UNLOCK_ACCOUNT_MUTATION = gql`
+  mutation UnlockAccount($user_id: ID!) {
+    unlockAccount(user_id: $user_id)
+  }
+`;
+
+// Failed login lockouts and their audit trail
+export const GET_LOGIN_LOCKOUTS = gql`
+  query GetLoginLockouts {
+    loginLockouts {
+      id
+      scope
+      subject
+      user {
+        id
+        username
+        email
+      }
+      failed_count
+      last_failed_at
+      locked_until
+      lockout_count
+    }
+  }
+`;
+
+export const GET_LOGIN_AUDIT_EVENTS = gql`
+  query GetLoginAuditEvents($limit: Int) {
+    loginAuditEvents(limit: $limit) {
+      id
+      event
+      user_id
+      actor_id
+      identifier
+      ip_address
+      detail
+      created_at
+    }
+  }
+`;
+
+// Access token signing keys
+export const GET_SIGNING_KEYS = gql`
+  query GetSigningKeys {
+    signingKeys {
+      kid
+      algorithm
+      created_at
+      retired_at
+      expires_at
+    }
+  }
+`;
+
+export const ROTATE_SIGNING_KEY_MUTATION = gql`
+  mutation RotateSigningKey {
+    rotateSigningKey {
+      kid
+      algorithm
+      created_at
+    }
+  }
+`;
+
 // File Share Queries
 export const GET_FILE_SHARES = gql`
   query GetFileShares {
@@ -0,0 +1,82 @@
+import React, { useState } from 'react';
+import { Link as RouterLink } from 'react-router-dom';
+import { useMutation } from '@apollo/client';
+import { Box, Container, Paper, TextField, Button, Typography, Link, Alert } from '@mui/material';
+import { REQUEST_PASSWORD_RESET_MUTATION } from '../../apollo/auth';
+import { isValidEmail } from '../../utils/sanitization';
+
+// Asks for the account's email and mails a password reset link to it
+const ForgotPassword: React.FC = () => {
+  const [email, setEmail] = useState('');
+  const [submitted, setSubmitted] = useState(false);
+  const [error, setError] = useState('');
+  const [requestPasswordResetMutation, { loading }] = useMutation(REQUEST_PASSWORD_RESET_MUTATION);
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setError('');
+    try {
+      await requestPasswordResetMutation({ variables: { email: email.trim() } });
+      setSubmitted(true);
+    } catch (err: any) {
+      setError(err.message || 'Failed to request a password reset');
+    }
+  };
+
+  return (
+    <Box sx={{ minHeight: '100vh', backgroundColor: '#f8fafc', display: 'flex', alignItems: 'center' }}>
+      <Container component="main" maxWidth="sm">
+        <Paper sx={{ p: 4, border: '1px solid #e5e7eb', boxShadow: 'none', borderRadius: 3 }}>
+          <Typography component="h1" variant="h5" sx={{ fontWeight: 600, mb: 1 }}>
+            Reset your password
+          </Typography>
+
+          {submitted ? (
+            // The same message is shown whether or not an account exists
+            <Alert severity="success" sx={{ mt: 2 }}>
+              If an account exists for {email.trim()}, a link to reset its password is on its way. The link expires in one hour.
+            </Alert>
+          ) : (
+            <Box component="form" onSubmit={handleSubmit}>
+              <Typography color="#6b7280" variant="body2" sx={{ mb: 2 }}>
+                Enter the email address of your account and we will send you a link to choose a new password.
+              </Typography>
+              {error && (
+                <Alert severity="error" sx={{ mb: 2 }}>
+                  {error}
+                </Alert>
+              )}
+              <TextField
+                required
+                fullWidth
+                label="Email"
+                type="email"
+                autoComplete="email"
+                autoFocus
+                value={email}
+                onChange={(e) => setEmail(e.target.value)}
+              />
+              <Button
+                type="submit"
+                fullWidth
+                variant="contained"
+                disabled={loading || !isValidEmail(email.trim())}
+                sx={{ mt: 3, mb: 2, py: 1.5, borderRadius: 2, textTransform: 'none', fontWeight: 600 }}
+              >
+                {loading ? 'Sending...' : 'Send reset link'}
+              </Button>
+            </Box>
+          )}
+
+          <Box textAlign="center" sx={{ mt: 2 }}>
+            <Link component={RouterLink} to="/login" variant="body2" sx={{ color: '#3b82f6', textDecoration: 'none' }}>
+              Back to sign in
+            </Link>
+          </Box>
+        </Paper>
+      </Container>
+    </Box>
+  );
+};
+
+export default ForgotPassword;
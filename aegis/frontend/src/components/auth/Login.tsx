@@ -1,5 +1,6 @@
 import React, { useState, useEffect, useRef, memo } from 'react';
-import { Link as RouterLink, useNavigate } from 'react-router-dom';
+import { Link as RouterLink, useLocation, useNavigate } from 'react-router-dom';
+import { useMutation, useQuery } from '@apollo/client';
 import { useForm, Controller } from 'react-hook-form';
 import { yupResolver } from '@hookform/resolvers/yup';
 import * as yup from 'yup';
@@ -18,6 +19,7 @@ import {
 } from '@mui/material';
 import { Visibility, VisibilityOff, Storage, Person } from '@mui/icons-material';
 import { useAuth } from '../../contexts/AuthContext';
+import { GET_AUTH_SETTINGS, BEGIN_OIDC_LOGIN_MUTATION } from '../../apollo/auth';
 import { sanitizeUserInput, isValidEmail, isValidUsername } from '../../utils/sanitization';
 
 // Validation schema
@@ -59,9 +61,19 @@ const Login: React.FC = () => {
   const [error, setError] = useState('');
   const [loading, setLoading] = useState(false);
   const [snackbarOpen, setSnackbarOpen] = useState(false);
+  const location = useLocation();
+  // Single sign-on logins that need a second factor arrive with their challenge
+  const [challengeToken, setChallengeToken] = useState<string | null>(
+    (location.state as { challengeToken?: string } | null)?.challengeToken ?? null
+  );
+  const [twoFactorCode, setTwoFactorCode] = useState('');
 
-  const { login } = useAuth();
+  const { login, verifyTwoFactorLogin } = useAuth();
   const navigate = useNavigate();
+  const { data: authSettingsData } = useQuery(GET_AUTH_SETTINGS);
+  const [beginOIDCLoginMutation] = useMutation(BEGIN_OIDC_LOGIN_MUTATION);
+  const oidcEnabled = authSettingsData?.authSettings?.oidc_enabled ?? false;
+  const passwordSignupEnabled = authSettingsData?.authSettings?.password_signup_enabled ?? true;
   const isMountedRef = useRef(true);
 
   const {
@@ -108,7 +120,14 @@ const Login: React.FC = () => {
         throw new Error('Invalid username format');
       }
 
-      await login(sanitizedIdentifier, sanitizedPassword);
+      const challenge = await login(sanitizedIdentifier, sanitizedPassword);
+      if (challenge) {
+        // Ask for the authenticator or recovery code before signing in
+        if (isMountedRef.current) {
+          setChallengeToken(challenge);
+        }
+        return;
+      }
       if (isMountedRef.current) {
         navigate('/dashboard');
       }
@@ -132,6 +151,53 @@ const Login: React.FC = () => {
     }
   };
 
+  const onSingleSignOn = async () => {
+    setError('');
+    setLoading(true);
+
+    try {
+      const { data } = await beginOIDCLoginMutation();
+      // Continue at the identity provider, which redirects back to /auth/callback
+      window.location.assign(data.beginOIDCLogin);
+    } catch (err: any) {
+      if (isMountedRef.current) {
+        setError(err.message || 'Single sign-on is unavailable.');
+        setSnackbarOpen(true);
+        setLoading(false);
+      }
+    }
+  };
+
+  const onVerifyTwoFactor = async (event: React.FormEvent) => {
+    event.preventDefault();
+    if (!challengeToken || !isMountedRef.current) return;
+
+    setError('');
+    setLoading(true);
+
+    try {
+      await verifyTwoFactorLogin(challengeToken, sanitizeUserInput(twoFactorCode));
+      if (isMountedRef.current) {
+        navigate('/dashboard');
+      }
+    } catch (err: any) {
+      if (isMountedRef.current) {
+        const errorMessage = err.message || 'Verification failed.';
+        // An expired or exhausted challenge means starting over with the password
+        if (errorMessage.includes('sign in again') || errorMessage.includes('challenge')) {
+          setChallengeToken(null);
+        }
+        setTwoFactorCode('');
+        setError(errorMessage);
+        setSnackbarOpen(true);
+      }
+    } finally {
+      if (isMountedRef.current) {
+        setLoading(false);
+      }
+    }
+  };
+
   return (
     <Box sx={{ 
       minHeight: '100vh',
@@ -181,6 +247,39 @@ const Login: React.FC = () => {
               </div>
             )}
 
+            {challengeToken ? (
+            <Box component="form" role="form" onSubmit={onVerifyTwoFactor} sx={{ mt: 3, width: '100%' }}>
+              <Typography variant="body2" color="#6b7280">
+                Enter the 6-digit code from your authenticator app, or one of your recovery codes.
+              </Typography>
+              <TextField
+                margin="normal"
+                required
+                fullWidth
+                id="two-factor-code"
+                label="Verification Code"
+                name="code"
+                autoComplete="one-time-code"
+                autoFocus
+                value={twoFactorCode}
+                onChange={(e) => setTwoFactorCode(e.target.value)}
+              />
+              <Button
+                type="submit"
+                fullWidth
+                variant="contained"
+                disabled={loading || !twoFactorCode}
+                sx={{ mt: 3, mb: 2, py: 1.5, borderRadius: 2, textTransform: 'none', fontWeight: 600 }}
+              >
+                {loading ? 'Verifying...' : 'Verify'}
+              </Button>
+              <Box textAlign="center">
+                <Link component="button" type="button" variant="body2" onClick={() => setChallengeToken(null)}>
+                  Back to sign in
+                </Link>
+              </Box>
+            </Box>
+            ) : (
             <Box component="form" role="form" onSubmit={handleSubmit(onSubmit)} sx={{ mt: 3, width: '100%' }}>
               <Controller
                 name="identifier"
@@ -293,6 +392,29 @@ const Login: React.FC = () => {
               >
                 {loading ? 'Signing In...' : 'Sign In'}
               </Button>
+              <Box textAlign="right" sx={{ mt: -1, mb: 2 }}>
+                <Link
+                  component={RouterLinkRef}
+                  to="/forgot-password"
+                  variant="body2"
+                  sx={{ color: '#3b82f6', textDecoration: 'none', '&:hover': { textDecoration: 'underline' } }}
+                >
+                  Forgot password?
+                </Link>
+              </Box>
+              {oidcEnabled && (
+                <Button
+                  type="button"
+                  fullWidth
+                  variant="outlined"
+                  disabled={loading}
+                  onClick={onSingleSignOn}
+                  sx={{ mb: 2, py: 1.5, borderRadius: 2, textTransform: 'none', fontWeight: 600 }}
+                >
+                  Sign in with SSO
+                </Button>
+              )}
+              {passwordSignupEnabled && (
               <Box textAlign="center">
                 <Link 
                   component={RouterLinkRef} 
@@ -309,7 +431,9 @@ const Login: React.FC = () => {
                   {"Don't have an account? Sign up"}
                 </Link>
               </Box>
+              )}
             </Box>
+            )}
           </Box>
         </Paper>
       </Container>
@@ -0,0 +1,68 @@
+import React, { useEffect, useRef, useState } from 'react';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import { Box, CircularProgress, Typography, Button } from '@mui/material';
+import { useAuth } from '../../contexts/AuthContext';
+
+// Landing page for the identity provider's redirect after single sign-on
+const OIDCCallback: React.FC = () => {
+  const [searchParams] = useSearchParams();
+  const [error, setError] = useState('');
+  const { completeOIDCLogin } = useAuth();
+  const navigate = useNavigate();
+  const startedRef = useRef(false);
+
+  useEffect(() => {
+    // The state can only be redeemed once, so guard against effects running twice
+    if (startedRef.current) return;
+    startedRef.current = true;
+
+    const providerError = searchParams.get('error');
+    const state = searchParams.get('state');
+    const code = searchParams.get('code');
+    if (providerError || !state || !code) {
+      setError(searchParams.get('error_description') || 'Single sign-on was cancelled or failed.');
+      return;
+    }
+
+    completeOIDCLogin(state, code)
+      .then((challengeToken) => {
+        if (challengeToken) {
+          // Accounts with two-factor authentication enter their code on the login page
+          navigate('/login', { replace: true, state: { challengeToken } });
+        } else {
+          navigate('/dashboard', { replace: true });
+        }
+      })
+      .catch((err: any) => {
+        setError(err.message || 'Single sign-on failed.');
+      });
+  }, [searchParams, completeOIDCLogin, navigate]);
+
+  return (
+    <Box sx={{
+      minHeight: '100vh',
+      backgroundColor: '#f8fafc',
+      display: 'flex',
+      flexDirection: 'column',
+      alignItems: 'center',
+      justifyContent: 'center',
+      gap: 2
+    }}>
+      {error ? (
+        <>
+          <Typography color="#dc2626">{error}</Typography>
+          <Button variant="contained" onClick={() => navigate('/login', { replace: true })} sx={{ textTransform: 'none' }}>
+            Back to sign in
+          </Button>
+        </>
+      ) : (
+        <>
+          <CircularProgress />
+          <Typography color="#6b7280">Signing you in...</Typography>
+        </>
+      )}
+    </Box>
+  );
+};
+
+export default OIDCCallback;
@@ -0,0 +1,97 @@
+import React, { useState } from 'react';
+import { Link as RouterLink, useSearchParams } from 'react-router-dom';
+import { useMutation } from '@apollo/client';
+import { Box, Container, Paper, TextField, Button, Typography, Link, Alert } from '@mui/material';
+import { RESET_PASSWORD_MUTATION } from '../../apollo/auth';
+
+// Landing page for the link in password reset emails
+const ResetPassword: React.FC = () => {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token') || '';
+  const [newPassword, setNewPassword] = useState('');
+  const [confirmPassword, setConfirmPassword] = useState('');
+  const [error, setError] = useState('');
+  const [done, setDone] = useState(false);
+  const [resetPasswordMutation, { loading }] = useMutation(RESET_PASSWORD_MUTATION);
+
+  const handleSubmit = async (e: React.FormEvent) => {
+    e.preventDefault();
+    setError('');
+    if (newPassword !== confirmPassword) {
+      setError('Passwords do not match');
+      return;
+    }
+    try {
+      await resetPasswordMutation({ variables: { token, new_password: newPassword } });
+      setDone(true);
+    } catch (err: any) {
+      setError(err.message || 'Failed to reset password');
+    }
+  };
+
+  return (
+    <Box sx={{ minHeight: '100vh', backgroundColor: '#f8fafc', display: 'flex', alignItems: 'center' }}>
+      <Container component="main" maxWidth="sm">
+        <Paper sx={{ p: 4, border: '1px solid #e5e7eb', boxShadow: 'none', borderRadius: 3 }}>
+          <Typography component="h1" variant="h5" sx={{ fontWeight: 600, mb: 2 }}>
+            Choose a new password
+          </Typography>
+
+          {!token ? (
+            <Alert severity="error">This reset link is incomplete. Request a new one from the sign in page.</Alert>
+          ) : done ? (
+            <Alert severity="success">
+              Your password has been changed and all of your devices have been signed out. You can now sign in with the new password.
+            </Alert>
+          ) : (
+            <Box component="form" onSubmit={handleSubmit}>
+              {error && (
+                <Alert severity="error" sx={{ mb: 2 }}>
+                  {error}
+                </Alert>
+              )}
+              <TextField
+                required
+                fullWidth
+                margin="normal"
+                label="New password"
+                type="password"
+                autoComplete="new-password"
+                value={newPassword}
+                onChange={(e) => setNewPassword(e.target.value)}
+                helperText="At least 8 characters with upper and lower case letters, a number and a special character"
+              />
+              <TextField
+                required
+                fullWidth
+                margin="normal"
+                label="Confirm new password"
+                type="password"
+                autoComplete="new-password"
+                value={confirmPassword}
+                onChange={(e) => setConfirmPassword(e.target.value)}
+              />
+              <Button
+                type="submit"
+                fullWidth
+                variant="contained"
+                disabled={loading || !newPassword}
+                sx={{ mt: 3, mb: 2, py: 1.5, borderRadius: 2, textTransform: 'none', fontWeight: 600 }}
+              >
+                {loading ? 'Saving...' : 'Set new password'}
+              </Button>
+            </Box>
+          )}
+
+          <Box textAlign="center" sx={{ mt: 2 }}>
+            <Link component={RouterLink} to="/login" variant="body2" sx={{ color: '#3b82f6', textDecoration: 'none' }}>
+              Back to sign in
+            </Link>
+          </Box>
+        </Paper>
+      </Container>
+    </Box>
+  );
+};
+
+export default ResetPassword;
@@ -0,0 +1,78 @@
+import React, { useEffect, useRef, useState } from 'react';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import { useMutation } from '@apollo/client';
+import { Box, CircularProgress, Typography, Button } from '@mui/material';
+import { UNLOCK_ACCOUNT_WITH_TOKEN_MUTATION } from '../../apollo/auth';
+
+// Landing page for the link mailed when an account is locked after failed logins
+const UnlockAccount: React.FC = () => {
+  const [searchParams] = useSearchParams();
+  const [status, setStatus] = useState<'unlocking' | 'unlocked' | 'failed'>('unlocking');
+  const [error, setError] = useState('');
+  const navigate = useNavigate();
+  const startedRef = useRef(false);
+  const [unlockAccountMutation] = useMutation(UNLOCK_ACCOUNT_WITH_TOKEN_MUTATION);
+
+  useEffect(() => {
+    // Links can only be redeemed once, so guard against effects running twice
+    if (startedRef.current) return;
+    startedRef.current = true;
+
+    const token = searchParams.get('token');
+    if (!token) {
+      setError('This unlock link is incomplete.');
+      setStatus('failed');
+      return;
+    }
+
+    unlockAccountMutation({ variables: { token } })
+      .then(() => setStatus('unlocked'))
+      .catch((err: any) => {
+        setError(err.message || 'This unlock link is invalid or has expired.');
+        setStatus('failed');
+      });
+  }, [searchParams, unlockAccountMutation]);
+
+  return (
+    <Box sx={{
+      minHeight: '100vh',
+      backgroundColor: '#f8fafc',
+      display: 'flex',
+      flexDirection: 'column',
+      alignItems: 'center',
+      justifyContent: 'center',
+      gap: 2
+    }}>
+      {status === 'unlocking' && (
+        <>
+          <CircularProgress />
+          <Typography color="#6b7280">Unlocking your account...</Typography>
+        </>
+      )}
+      {status === 'unlocked' && (
+        <>
+          <Typography variant="h6" sx={{ fontWeight: 600 }}>Your account is unlocked.</Typography>
+          <Typography color="#6b7280" variant="body2">
+            If the failed attempts were not yours, reset your password after signing in.
+          </Typography>
+          <Button variant="contained" onClick={() => navigate('/login', { replace: true })} sx={{ textTransform: 'none' }}>
+            Sign in
+          </Button>
+        </>
+      )}
+      {status === 'failed' && (
+        <>
+          <Typography color="#dc2626">{error}</Typography>
+          <Typography color="#6b7280" variant="body2">
+            The lockout also ends on its own, or you can reset your password to unlock the account now.
+          </Typography>
+          <Button variant="contained" onClick={() => navigate('/forgot-password', { replace: true })} sx={{ textTransform: 'none' }}>
+            Reset password
+          </Button>
+        </>
+      )}
+    </Box>
+  );
+};
+
+export default UnlockAccount;
@@ -0,0 +1,75 @@
+import React, { useEffect, useRef, useState } from 'react';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import { useMutation } from '@apollo/client';
+import { Box, CircularProgress, Typography, Button } from '@mui/material';
+import { VERIFY_EMAIL_MUTATION, GET_ME } from '../../apollo/auth';
+
+// Landing page for the link in verification emails
+const VerifyEmail: React.FC = () => {
+  const [searchParams] = useSearchParams();
+  const [status, setStatus] = useState<'verifying' | 'verified' | 'failed'>('verifying');
+  const [error, setError] = useState('');
+  const navigate = useNavigate();
+  const startedRef = useRef(false);
+  const [verifyEmailMutation] = useMutation(VERIFY_EMAIL_MUTATION, {
+    refetchQueries: [{ query: GET_ME }],
+  });
+
+  useEffect(() => {
+    // Links can only be redeemed once, so guard against effects running twice
+    if (startedRef.current) return;
+    startedRef.current = true;
+
+    const token = searchParams.get('token');
+    if (!token) {
+      setError('This verification link is incomplete.');
+      setStatus('failed');
+      return;
+    }
+
+    verifyEmailMutation({ variables: { token } })
+      .then(() => setStatus('verified'))
+      .catch((err: any) => {
+        setError(err.message || 'This verification link is invalid or has expired.');
+        setStatus('failed');
+      });
+  }, [searchParams, verifyEmailMutation]);
+
+  return (
+    <Box sx={{
+      minHeight: '100vh',
+      backgroundColor: '#f8fafc',
+      display: 'flex',
+      flexDirection: 'column',
+      alignItems: 'center',
+      justifyContent: 'center',
+      gap: 2
+    }}>
+      {status === 'verifying' && (
+        <>
+          <CircularProgress />
+          <Typography color="#6b7280">Verifying your email address...</Typography>
+        </>
+      )}
+      {status === 'verified' && (
+        <>
+          <Typography variant="h6" sx={{ fontWeight: 600 }}>Your email address is verified.</Typography>
+          <Button variant="contained" onClick={() => navigate('/dashboard', { replace: true })} sx={{ textTransform: 'none' }}>
+            Continue
+          </Button>
+        </>
+      )}
+      {status === 'failed' && (
+        <>
+          <Typography color="#dc2626">{error}</Typography>
+          <Typography color="#6b7280" variant="body2">You can request a new link from your profile.</Typography>
+          <Button variant="contained" onClick={() => navigate('/profile', { replace: true })} sx={{ textTransform: 'none' }}>
+            Go to profile
+          </Button>
+        </>
+      )}
+    </Box>
+  );
+};
+
+export default VerifyEmail;
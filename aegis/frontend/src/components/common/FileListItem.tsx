@@ -7,6 +7,7 @@ import {
   ListItem,
   ListItemIcon,
   ListItemText,
+  Tooltip,
 } from '@mui/material';
 import {
   Folder as FolderIcon,
@@ -14,6 +15,7 @@ import {
   Download as DownloadIcon,
   Delete as DeleteIcon,
   Restore as RestoreIcon,
+  Warning as WarningIcon,
 } from '@mui/icons-material';
 
 interface FileListItemProps {
@@ -271,6 +273,13 @@ export const FileListItem: React.FC<FileListItemProps> = ({
             {isFolder(item) && item.is_starred && (
               <StarIcon sx={{ color: 'warning.main', fontSize: 16 }} />
             )}
+            {isFile(item) && item.integrity_status && item.integrity_status !== 'OK' && (
+              <Tooltip title={item.integrity_status === 'MISSING'
+                ? 'The stored content of this file is missing. Downloads will fail.'
+                : 'The stored content of this file is damaged. Downloads may not decrypt correctly.'}>
+                <WarningIcon sx={{ color: 'error.main', fontSize: 16 }} />
+              </Tooltip>
+            )}
           </Box>
         }
         secondary={
@@ -79,12 +79,6 @@ const FileUploadDropzone: React.FC<FileUploadDropzoneProps> = ({
         u.file === file ? { ...u, status: 'uploading', progress: 10 } : u
       ));
 
-      // Calculate file hash
-      const contentHash = await calculateFileHash(file);
-      setUploads(prev => prev.map(u =>
-        u.file === file ? { ...u, progress: 30 } : u
-      ));
-
       // Generate encryption key
       const encryptionKey = generateEncryptionKey();
       setUploads(prev => prev.map(u =>
@@ -103,6 +97,9 @@ const FileUploadDropzone: React.FC<FileUploadDropzoneProps> = ({
       encryptedDataWithNonce.set(nonce, 0);
       encryptedDataWithNonce.set(encryptedData, nonce.length);
       console.log(`DEBUG upload: Combined data length (nonce + encrypted): ${encryptedDataWithNonce.length}`);
+
+      // Hash the ciphertext: the server verifies content_hash against the bytes it stores
+      const contentHash = await calculateFileHash(new File([encryptedDataWithNonce], file.name));
       console.log(`DEBUG upload: First 10 bytes of combined data: [${Array.from(encryptedDataWithNonce.slice(0, 10)).join(', ')}]`);
       
       setUploads(prev => prev.map(u =>
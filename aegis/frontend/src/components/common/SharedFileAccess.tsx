@@ -20,7 +20,7 @@ import { AccessSharedFileDialog } from '../../shared/components';
 import { ACCESS_SHARED_FILE_MUTATION } from '../../apollo/queries';
 import { formatFileSize } from '../../shared/utils';
 import { SharedFileAccess as SharedFileAccessType, AccessSharedFileInput } from '../../types';
-import { decryptFile, base64ToEncryptionKey, createDownloadBlob, downloadFile, extractNonceAndData } from '../../utils/crypto';
+import { decryptFileData, base64ToEncryptionKey, createDownloadBlob, downloadFile } from '../../utils/crypto';
 import { getErrorMessage } from '../../utils/errorHandling';
 
 interface SharedFileAccessProps {
@@ -103,16 +103,13 @@ export const SharedFileAccess: React.FC<SharedFileAccessProps> = ({
         throw new Error('Failed to download file');
       }
 
-      const encryptedDataWithNonce = new Uint8Array(await response.arrayBuffer());
-
-      // Extract nonce and encrypted data
-      const { nonce, encryptedData } = extractNonceAndData(encryptedDataWithNonce);
+      const encryptedFileData = new Uint8Array(await response.arrayBuffer());
 
       // Convert base64 encryption key back to Uint8Array
       const encryptionKey = base64ToEncryptionKey(file.encryption_key);
 
-      // Decrypt the file
-      const decryptedData = decryptFile(encryptedData, nonce, encryptionKey);
+      // Decrypt the file with the cipher its header names
+      const decryptedData = await decryptFileData(encryptedFileData, encryptionKey);
 
       if (!decryptedData) {
         throw new Error('Failed to decrypt file - invalid key or corrupted data');
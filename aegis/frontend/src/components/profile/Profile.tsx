@@ -13,7 +13,7 @@ import {
 } from '@mui/material';
 import { useMutation, useQuery } from '@apollo/client';
 import { useAuth } from '../../contexts/AuthContext';
-import { UPDATE_PROFILE_MUTATION } from '../../apollo/auth';
+import { UPDATE_PROFILE_MUTATION, SEND_VERIFICATION_EMAIL_MUTATION } from '../../apollo/auth';
 import { GET_MY_STATS } from '../../apollo/queries';
 import DashboardAppBar from '../dashboard/DashboardAppBar';
 import DashboardSidebar from '../dashboard/DashboardSidebar';
@@ -37,6 +37,18 @@ const Profile: React.FC = () => {
   });
 
   const [updateProfileMutation] = useMutation(UPDATE_PROFILE_MUTATION);
+  const [sendVerificationEmailMutation, { loading: sendingVerification }] = useMutation(SEND_VERIFICATION_EMAIL_MUTATION);
+
+  const handleSendVerification = async () => {
+    setError(null);
+    setSuccess(null);
+    try {
+      await sendVerificationEmailMutation();
+      setSuccess(`A verification link was sent to ${user?.email}.`);
+    } catch (err: any) {
+      setError(err.message || 'Failed to send verification email');
+    }
+  };
 
   const {
     anchorEl,
@@ -135,6 +147,20 @@ const Profile: React.FC = () => {
             </Alert>
           )}
 
+          {user && user.email_verified === false && (
+            <Alert
+              severity="warning"
+              sx={{ mb: 3 }}
+              action={
+                <Button color="inherit" size="small" disabled={sendingVerification} onClick={handleSendVerification}>
+                  Resend link
+                </Button>
+              }
+            >
+              Your email address is not verified. Shares restricted to your email cannot be opened until it is.
+            </Alert>
+          )}
+
           <form onSubmit={handleSubmit}>
             <Grid container spacing={3}>
               <Grid item xs={12}>
@@ -78,13 +78,13 @@ const ShareAccess: React.FC = () => {
     onCompleted: async (data) => {
       if (data?.accessSharedFile && token) {
         try {
-          // Extract the decryption key from the GraphQL response URL
+          // Extract the short-lived download ticket from the GraphQL response URL
           const responseUrl = data.accessSharedFile;
           const url = new URL(responseUrl);
-          const key = url.searchParams.get('key');
+          const ticket = url.searchParams.get('ticket');
           
           // Construct the direct download URL using the new backend endpoint
-          const directDownloadUrl = `http://localhost:8080/v1/share/${token}/download?key=${encodeURIComponent(key || '')}`;
+          const directDownloadUrl = `http://localhost:8080/v1/share/${token}/download?ticket=${encodeURIComponent(ticket || '')}`;
           
           console.log('=== DOWNLOAD DEBUG ===');
           console.log('Download URL:', directDownloadUrl);
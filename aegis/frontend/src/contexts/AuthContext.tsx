@@ -1,7 +1,7 @@
 import React, { createContext, useContext, useState, useEffect, ReactNode } from 'react';
 import { useMutation, useQuery } from '@apollo/client';
-import { LOGIN_MUTATION, REGISTER_MUTATION, GET_ME, LOGOUT_MUTATION, REFRESH_TOKEN_MUTATION } from '../apollo/auth';
-import { AuthContextType, User, AuthPayload } from '../types';
+import { LOGIN_MUTATION, VERIFY_TWO_FACTOR_LOGIN_MUTATION, COMPLETE_OIDC_LOGIN_MUTATION, REGISTER_MUTATION, GET_ME, LOGOUT_MUTATION, REFRESH_TOKEN_MUTATION } from '../apollo/auth';
+import { AuthContextType, User, AuthPayload, LoginPayload } from '../types';
 
 const AuthContext = createContext<AuthContextType | undefined>(undefined);
 
@@ -15,6 +15,8 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
   const [sharedFileTokens, setSharedFileTokens] = useState<Record<string, { token: string; user: User; expiresAt?: number }>>({});
 
   const [loginMutation] = useMutation(LOGIN_MUTATION);
+  const [verifyTwoFactorLoginMutation] = useMutation(VERIFY_TWO_FACTOR_LOGIN_MUTATION);
+  const [completeOIDCLoginMutation] = useMutation(COMPLETE_OIDC_LOGIN_MUTATION);
   const [registerMutation] = useMutation(REGISTER_MUTATION);
   const [logoutMutation] = useMutation(LOGOUT_MUTATION);
   const [refreshTokenMutation] = useMutation(REFRESH_TOKEN_MUTATION);
@@ -52,7 +54,9 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
 
   const refreshToken = async (): Promise<boolean> => {
     try {
-      const { data, errors } = await refreshTokenMutation();
+      const { data, errors } = await refreshTokenMutation({
+        variables: { refresh_token: localStorage.getItem('refresh_token') ?? '' }
+      });
 
       if (errors && errors.length > 0) {
         console.error('Token refresh failed:', errors[0].message);
@@ -63,6 +67,9 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
       if (data?.refreshToken) {
         const authPayload: AuthPayload = data.refreshToken;
         setUser(authPayload.user);
+        // Refresh tokens rotate on every use, so the old one must be replaced
+        localStorage.setItem('auth_token', authPayload.token);
+        localStorage.setItem('refresh_token', authPayload.refresh_token);
         return true;
       }
 
@@ -74,7 +81,7 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     }
   };
 
-  const login = async (identifier: string, password: string): Promise<void> => {
+  const login = async (identifier: string, password: string): Promise<string | null> => {
     try {
       console.log('DEBUG: AuthContext.login called with identifier:', identifier);
       const { data, errors } = await loginMutation({
@@ -91,11 +98,17 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
       }
 
       if (data?.login) {
-        const authPayload: AuthPayload = data.login;
-        console.log('DEBUG: Login successful, user:', authPayload.user);
-        setUser(authPayload.user);
-        // Store JWT token in localStorage
-        localStorage.setItem('auth_token', authPayload.token);
+        const loginPayload: LoginPayload = data.login;
+        // Accounts with two-factor authentication finish signing in with verifyTwoFactorLogin
+        if (loginPayload.two_factor_required && loginPayload.challenge_token) {
+          return loginPayload.challenge_token;
+        }
+        console.log('DEBUG: Login successful, user:', loginPayload.user);
+        setUser(loginPayload.user ?? null);
+        // Store JWT and refresh tokens in localStorage
+        localStorage.setItem('auth_token', loginPayload.token ?? '');
+        localStorage.setItem('refresh_token', loginPayload.refresh_token ?? '');
+        return null;
       } else {
         console.error('DEBUG: Login failed: No data returned from mutation');
         throw new Error('Login failed: No data returned');
@@ -106,6 +119,49 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     }
   };
 
+  const verifyTwoFactorLogin = async (challengeToken: string, code: string): Promise<void> => {
+    const { data, errors } = await verifyTwoFactorLoginMutation({
+      variables: { challenge_token: challengeToken, code }
+    });
+
+    if (errors && errors.length > 0) {
+      throw new Error(errors[0].message);
+    }
+
+    if (data?.verifyTwoFactorLogin) {
+      const authPayload: AuthPayload = data.verifyTwoFactorLogin;
+      setUser(authPayload.user);
+      localStorage.setItem('auth_token', authPayload.token);
+      localStorage.setItem('refresh_token', authPayload.refresh_token);
+    } else {
+      throw new Error('Verification failed: No data returned');
+    }
+  };
+
+  const completeOIDCLogin = async (state: string, code: string): Promise<string | null> => {
+    const { data, errors } = await completeOIDCLoginMutation({
+      variables: { state, code }
+    });
+
+    if (errors && errors.length > 0) {
+      throw new Error(errors[0].message);
+    }
+
+    if (!data?.completeOIDCLogin) {
+      throw new Error('Single sign-on failed: No data returned');
+    }
+
+    const loginPayload: LoginPayload = data.completeOIDCLogin;
+    // The identity provider does not replace Aegis two-factor authentication
+    if (loginPayload.two_factor_required && loginPayload.challenge_token) {
+      return loginPayload.challenge_token;
+    }
+    setUser(loginPayload.user ?? null);
+    localStorage.setItem('auth_token', loginPayload.token ?? '');
+    localStorage.setItem('refresh_token', loginPayload.refresh_token ?? '');
+    return null;
+  };
+
   const register = async (username: string, email: string, password: string): Promise<void> => {
     try {
       setLoading(true);
@@ -122,8 +178,9 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
       if (data?.register) {
         const authPayload: AuthPayload = data.register;
         setUser(authPayload.user);
-        // Store JWT token in localStorage
+        // Store JWT and refresh tokens in localStorage
         localStorage.setItem('auth_token', authPayload.token);
+        localStorage.setItem('refresh_token', authPayload.refresh_token);
       } else {
         throw new Error('Registration failed: No data returned');
       }
@@ -137,15 +194,18 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
 
   const logout = async (): Promise<void> => {
     try {
-      await logoutMutation();
+      await logoutMutation({
+        variables: { refresh_token: localStorage.getItem('refresh_token') }
+      });
     } catch (error) {
       console.error('Logout error:', error);
     } finally {
       setUser(null);
       // Clear all shared file tokens on logout
       setSharedFileTokens({});
-      // Clear JWT token from localStorage
+      // Clear JWT and refresh tokens from localStorage
       localStorage.removeItem('auth_token');
+      localStorage.removeItem('refresh_token');
     }
   };
 
@@ -228,6 +288,8 @@ export const AuthProvider: React.FC<AuthProviderProps> = ({ children }) => {
     user,
     token: localStorage.getItem('auth_token'), // JWT token stored in localStorage
     login,
+    verifyTwoFactorLogin,
+    completeOIDCLogin,
     register,
     logout,
     refreshToken,
@@ -2,12 +2,11 @@ import { useState, useCallback } from 'react';
 import { useMutation } from '@apollo/client';
 import { DELETE_FILE_MUTATION, DOWNLOAD_FILE_MUTATION, GET_MY_STATS, GET_MY_FILES, GET_MY_TRASHED_FILES, CREATE_FILE_SHARE_MUTATION, ACCESS_SHARED_FILE_MUTATION } from '../apollo/queries';
 import {
-  decryptFile,
   base64ToEncryptionKey,
 } from '../utils/cryptoManager';
 import { 
   uint8ArrayToBase64,
-  extractNonceAndData,
+  decryptFileData,
   createDownloadBlob,
   downloadFile,
 } from '../utils/crypto';
@@ -56,16 +55,13 @@ export const useFileOperations = () => {
         throw new Error('Failed to download file');
       }
 
-      const encryptedDataWithNonce = new Uint8Array(await response.arrayBuffer());
-
-      // Extract nonce and encrypted data
-      const { nonce, encryptedData } = extractNonceAndData(encryptedDataWithNonce);
+      const encryptedFileData = new Uint8Array(await response.arrayBuffer());
 
       // Convert base64 encryption key back to Uint8Array
       const encryptionKey = base64ToEncryptionKey(file.encryption_key);
 
-      // Decrypt the file
-      const decryptedData = decryptFile(encryptedData, nonce, encryptionKey);
+      // Decrypt the file with the cipher its header names
+      const decryptedData = await decryptFileData(encryptedFileData, encryptionKey);
 
       if (!decryptedData) {
         throw new Error('Failed to decrypt file - invalid key or corrupted data');
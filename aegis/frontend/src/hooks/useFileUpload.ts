@@ -122,11 +122,6 @@ export const useFileUpload = (onUploadComplete?: () => void) => {
         u.file === file ? { ...u, status: 'uploading', progress: 10 } : u
       ));
 
-      const contentHash = await calculateFileHash(file);
-      safeSetUploads(prev => prev.map(u =>
-        u.file === file ? { ...u, progress: 30 } : u
-      ));
-
       const encryptionKey = generateEncryptionKey();
       safeSetUploads(prev => prev.map(u =>
         u.file === file ? { ...u, progress: 40 } : u
@@ -164,6 +159,9 @@ export const useFileUpload = (onUploadComplete?: () => void) => {
       encryptedDataWithNonce.set(nonce, 0);
       encryptedDataWithNonce.set(encryptedData, nonce.length);
 
+      // The server verifies the hash against the bytes it stores, i.e. the ciphertext
+      const contentHash = await calculateFileHash(new File([encryptedDataWithNonce], file.name));
+
       safeSetUploads(prev => prev.map(u =>
         u.file === file ? { ...u, progress: 70 } : u
       ));
@@ -351,6 +351,7 @@ describe('AuthContext', () => {
         {
           request: {
             query: LOGOUT_MUTATION,
+            variables: { refresh_token: null },
           },
           result: {
             data: { logout: true },
@@ -396,6 +397,7 @@ describe('AuthContext', () => {
         {
           request: {
             query: LOGOUT_MUTATION,
+            variables: { refresh_token: null },
           },
           error: new Error('Logout failed'),
         }
@@ -450,6 +452,7 @@ describe('AuthContext', () => {
         {
           request: {
             query: REFRESH_TOKEN_MUTATION,
+            variables: { refresh_token: '' },
           },
           result: {
             data: {
@@ -500,6 +503,7 @@ describe('AuthContext', () => {
         {
           request: {
             query: REFRESH_TOKEN_MUTATION,
+            variables: { refresh_token: '' },
           },
           result: {
             errors: [{ message: 'Token expired' }]
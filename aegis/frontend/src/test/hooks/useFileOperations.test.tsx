@@ -22,6 +22,7 @@ jest.mock('../../utils/crypto', () => ({
   createDownloadBlob: jest.fn(),
   downloadFile: jest.fn(),
   extractNonceAndData: jest.fn(),
+  decryptFileData: jest.fn(),
 }));
 
 // Mock the auth context
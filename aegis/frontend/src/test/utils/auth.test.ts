@@ -29,6 +29,7 @@ describe('Auth Utils', () => {
       expect(result).toBe(true);
       expect(mockClient.mutate).toHaveBeenCalledWith({
         mutation: expect.any(Object), // REFRESH_TOKEN_MUTATION
+        variables: { refresh_token: '' },
         fetchPolicy: 'no-cache',
       });
     });
@@ -3,17 +3,85 @@ export interface User {
   id: string;
   username: string;
   email: string;
+  email_verified?: boolean;
   storage_quota: number;
   used_storage: number;
   is_admin: boolean;
+  two_factor_enabled?: boolean;
   created_at: string;
 }
 
 export interface AuthPayload {
   token: string;
+  refresh_token: string;
   user: User;
 }
 
+export interface LoginPayload {
+  two_factor_required: boolean;
+  challenge_token?: string | null;
+  token?: string | null;
+  refresh_token?: string | null;
+  user?: User | null;
+}
+
+export interface TwoFactorEnrollment {
+  secret: string;
+  provisioning_uri: string;
+}
+
+export interface Session {
+  id: string;
+  user_agent: string;
+  ip_address: string;
+  created_at: string;
+  last_seen_at: string;
+  expires_at: string;
+  is_current: boolean;
+}
+
+export interface PersonalAccessToken {
+  id: string;
+  name: string;
+  token_prefix: string;
+  scopes: string[];
+  expires_at?: string;
+  last_used_at?: string;
+  created_at: string;
+}
+
+// Failed login lockouts (admin only)
+export interface LoginThrottle {
+  id: string;
+  scope: 'account' | 'ip';
+  subject: string;
+  user?: Pick<User, 'id' | 'username' | 'email'>;
+  failed_count: number;
+  last_failed_at: string;
+  locked_until?: string;
+  lockout_count: number;
+}
+
+export interface LoginAuditEvent {
+  id: string;
+  event: 'account_locked' | 'ip_locked' | 'account_unlocked';
+  user_id?: string;
+  actor_id?: string;
+  identifier: string;
+  ip_address: string;
+  detail: string;
+  created_at: string;
+}
+
+// Access token signing keys (admin only)
+export interface SigningKey {
+  kid: string;
+  algorithm: 'EdDSA' | 'RS256';
+  created_at: string;
+  retired_at?: string;
+  expires_at?: string;
+}
+
 // File types
 export interface FileMetadata {
   id: string;
@@ -31,11 +99,41 @@ export interface UserFile {
   encryption_key: string;
   folder_id?: string;
   is_starred: boolean;
+  integrity_status?: string; // OK, CORRUPTED or MISSING
   created_at: string;
   updated_at: string;
   user?: User;
   file?: FileMetadata;
   folder?: Folder;
+  key_grant?: FileKeyGrant;
+}
+
+// End-to-end sharing keys. Public keys are base64 encoded X25519 keys; private keys
+// and file keys are wrapped in the browser before they are sent
+export interface UserKeyPair {
+  user_id: string;
+  public_key: string;
+  fingerprint: string;
+  wrapped_private_key?: string; // Only returned for the signed-in user's own key
+  created_at: string;
+  updated_at: string;
+  user?: User;
+}
+
+export interface FileKeyGrant {
+  id: string;
+  user_file_id: string;
+  recipient_id: string;
+  granter_id: string;
+  room_id?: string; // Unset for a file shared directly
+  version: number;
+  key_fingerprint: string;
+  wrapped_key: string;
+  created_at: string;
+  updated_at: string;
+  recipient?: User;
+  granter?: User;
+  user_file?: UserFile;
 }
 
 // Folder types
@@ -86,6 +184,8 @@ export interface Room {
   id: string;
   name: string;
   creator_id: string;
+  key_version: number; // 0 while the room has no key
+  rekey_required: boolean; // A member left; the key must be rotated before sharing more files
   created_at: string;
   creator?: User;
   members?: RoomMember[];
@@ -93,6 +193,25 @@ export interface Room {
   folders?: Folder[];
 }
 
+// A version of a room key wrapped to a member's public key
+export interface RoomKey {
+  room_id: string;
+  version: number;
+  user_id: string;
+  key_fingerprint: string;
+  wrapped_key: string;
+  created_at: string;
+}
+
+// The key of a file shared to a room, wrapped under a version of the room key
+export interface RoomFileKey {
+  room_id: string;
+  user_file_id: string;
+  key_version: number;
+  wrapped_key: string;
+  created_at: string;
+}
+
 // Input types
 export interface RegisterInput {
   username: string;
@@ -189,7 +308,11 @@ export interface AdminDashboard {
 export interface AuthContextType {
   user: User | null;
   token: string | null;
-  login: (email: string, password: string) => Promise<void>;
+  // Resolves to a challenge token when a second factor is required, otherwise null
+  login: (email: string, password: string) => Promise<string | null>;
+  verifyTwoFactorLogin: (challengeToken: string, code: string) => Promise<void>;
+  // Finishes a single sign-on login; resolves like login
+  completeOIDCLogin: (state: string, code: string) => Promise<string | null>;
   register: (username: string, email: string, password: string) => Promise<void>;
   logout: () => void;
   refreshToken: () => Promise<boolean>;
@@ -17,6 +17,7 @@ export const refreshAuthToken = async (client: any): Promise<boolean> => {
     refreshPromise = (async () => {
       const { data, errors } = await client.mutate({
         mutation: REFRESH_TOKEN_MUTATION,
+        variables: { refresh_token: localStorage.getItem('refresh_token') ?? '' },
         fetchPolicy: 'no-cache', // Don't cache refresh requests
       });
 
@@ -26,6 +27,12 @@ export const refreshAuthToken = async (client: any): Promise<boolean> => {
       }
 
       if (data?.refreshToken) {
+        const authPayload: AuthPayload = data.refreshToken;
+        // Refresh tokens rotate on every use, so the old one must be replaced
+        if (authPayload.token && authPayload.refresh_token) {
+          localStorage.setItem('auth_token', authPayload.token);
+          localStorage.setItem('refresh_token', authPayload.refresh_token);
+        }
         console.log('Token refreshed successfully');
         return true;
       }
@@ -232,3 +232,70 @@ export const extractNonceAndData = (encryptedDataWithNonce: Uint8Array): { nonce
   
   return { nonce, encryptedData };
 };
+
+// Files re-encrypted by the server start with a header naming the cipher:
+// "AEGC", version, cipher, kdf (and its params), key id and nonce, each length-prefixed.
+// AEAD ciphers authenticate the header as additional data.
+const CIPHERTEXT_MAGIC = [0x41, 0x45, 0x47, 0x43];
+const CIPHER_NACL_SECRETBOX = 1;
+const CIPHER_AES_GCM = 2;
+const KDF_PBKDF2_SHA256 = 1;
+
+// Parse the ciphertext header, or return null for data without one
+export const parseCiphertextHeader = (data: Uint8Array): { cipher: number; nonce: Uint8Array; headerLength: number } | null => {
+  if (data.length < 7 || CIPHERTEXT_MAGIC.some((byte, i) => data[i] !== byte) || data[4] !== 1) {
+    return null;
+  }
+
+  const cipher = data[5];
+  let pos = 7;
+  if (data[6] === KDF_PBKDF2_SHA256) {
+    pos += 4;
+    pos += 1 + (data[pos] ?? 0);
+  } else if (data[6] !== 0) {
+    return null;
+  }
+  pos += 1 + (data[pos] ?? 0); // key id
+  const nonceLength = data[pos] ?? 0;
+  const nonce = data.slice(pos + 1, pos + 1 + nonceLength);
+  pos += 1 + nonceLength;
+
+  if (pos > data.length || nonce.length !== nonceLength) {
+    return null;
+  }
+  return { cipher, nonce, headerLength: pos };
+};
+
+// Decrypt downloaded file data with the cipher named in its header, or as
+// nonce-prefixed secretbox data when it has none
+export const decryptFileData = async (data: Uint8Array, key: Uint8Array): Promise<Uint8Array | null> => {
+  const header = parseCiphertextHeader(data);
+  if (!header) {
+    const { nonce, encryptedData } = extractNonceAndData(data);
+    return decryptFile(encryptedData, nonce, key);
+  }
+
+  const encryptedData = data.slice(header.headerLength);
+  switch (header.cipher) {
+    case CIPHER_NACL_SECRETBOX:
+      return decryptFile(encryptedData, header.nonce, key);
+    case CIPHER_AES_GCM:
+      try {
+        const cryptoKey = await crypto.subtle.importKey('raw', key as any, 'AES-GCM', false, ['decrypt']);
+        const decrypted = await crypto.subtle.decrypt(
+          {
+            name: 'AES-GCM',
+            iv: header.nonce as any,
+            additionalData: data.slice(0, header.headerLength) as any
+          },
+          cryptoKey,
+          encryptedData as any
+        );
+        return new Uint8Array(decrypted);
+      } catch (error) {
+        return null;
+      }
+    default:
+      throw new Error(`Unsupported file cipher: ${header.cipher}`);
+  }
+};